@@ -0,0 +1,248 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils/v3/tar"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// metadataFormatVersion is the version of the metadata written to new
+// backups.
+const metadataFormatVersion = 1
+
+// Contents describes what goes into a new backup file.
+type Contents struct {
+	// DumpDir holds the mongodump output for the backup. It is moved
+	// into the backup's staging directory.
+	DumpDir string
+
+	// RootDir is the filesystem root the controller's files are
+	// collected from - / on a controller machine.
+	RootDir string
+
+	// MachineID is the Juju machine ID of the controller machine the
+	// backup is taken on.
+	MachineID string
+
+	// Metadata identifies the controller and when the backup was
+	// started. For an incremental backup ParentID and OplogStart
+	// identify the backup it follows. For a full backup OplogEnd can
+	// be set to the oplog position before the dump started, in case
+	// the dump's oplog is empty. The ID, FormatVersion, ContainsLogs,
+	// ModelCount and CloudCount fields are ignored.
+	Metadata core.BackupMetadata
+
+	// Notes are stored with the backup.
+	Notes string
+}
+
+// controllerFiles returns the files and directories under
+// /var/lib/juju and /home/ubuntu that are saved in root.tar, matching
+// what Juju's own backups include.
+func controllerFiles(machineID string) []string {
+	return []string{
+		"var/lib/juju/agents",
+		"var/lib/juju/init",
+		"var/lib/juju/system-identity",
+		"var/lib/juju/nonce.txt",
+		"var/lib/juju/server.pem",
+		"var/lib/juju/shared-secret",
+		"home/ubuntu/.ssh/authorized_keys",
+		"var/log/juju/machine-" + machineID + ".log",
+	}
+}
+
+// Create writes a backup file in the standard Juju format to path: a
+// tar.gz holding juju-backup/metadata.json, juju-backup/root.tar with
+// the controller's files, and the database dump in juju-backup/dump.
+// Files that don't exist on the machine are skipped. An incremental
+// backup has the same layout, with an empty root.tar and only the
+// oplog in the dump.
+func Create(path string, contents Contents) (err error) {
+	target, err := createTarget(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err != nil {
+			target.Close()
+			_ = os.Remove(path)
+		}
+	}()
+
+	stageDir, err := ioutil.TempDir(filepath.Dir(path), ".juju-backup")
+	if err != nil {
+		return errors.Annotate(err, "creating staging directory")
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(stageDir); removeErr != nil {
+			logger.Errorf("couldn't remove staging dir %q: %s", stageDir, removeErr)
+		}
+	}()
+	backupDir := filepath.Join(stageDir, topLevelDir)
+	if err := os.Mkdir(backupDir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := writeRootTar(filepath.Join(backupDir, rootTarFile), contents); err != nil {
+		return errors.Annotate(err, "writing root.tar")
+	}
+	if err := moveDir(contents.DumpDir, filepath.Join(stageDir, dumpDir)); err != nil {
+		return errors.Annotate(err, "adding database dump")
+	}
+	if err := writeMetadataJSON(stageDir, contents); err != nil {
+		return errors.Annotate(err, "writing metadata")
+	}
+
+	if err := writeArchive(target, stageDir); err != nil {
+		return errors.Annotatef(err, "writing %q", path)
+	}
+	return errors.Trace(target.Close())
+}
+
+// createTarget opens path for writing a new backup file, failing if
+// it already exists.
+func createTarget(path string) (*os.File, error) {
+	target, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	return target, errors.Trace(err)
+}
+
+// writeArchive writes the juju-backup directory under stageDir to
+// target as a tar.gz.
+func writeArchive(target io.Writer, stageDir string) error {
+	gzWriter := gzip.NewWriter(target)
+	_, err := tar.TarFiles([]string{filepath.Join(stageDir, topLevelDir)}, gzWriter, stageDir+string(filepath.Separator))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(gzWriter.Close())
+}
+
+func writeRootTar(path string, contents Contents) error {
+	var files []string
+	var names []string
+	if !contents.Metadata.Incremental() {
+		names = controllerFiles(contents.MachineID)
+	}
+	for _, name := range names {
+		fullPath := filepath.Join(contents.RootDir, name)
+		if _, err := os.Lstat(fullPath); os.IsNotExist(err) {
+			logger.Debugf("skipping %q - not found", fullPath)
+			continue
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		files = append(files, fullPath)
+	}
+	strip := strings.TrimSuffix(contents.RootDir, string(filepath.Separator)) + string(filepath.Separator)
+	return errors.Trace(writeTar(path, files, strip))
+}
+
+// writeTar writes the files to a tar file at path, with strip removed
+// from the start of their names.
+func writeTar(path string, files []string, strip string) error {
+	target, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := tar.TarFiles(files, target, strip); err != nil {
+		target.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(target.Close())
+}
+
+func writeMetadataJSON(stageDir string, contents Contents) error {
+	source := contents.Metadata
+	oplog, err := readDumpOplog(filepath.Join(stageDir, oplogFile))
+	if err != nil {
+		return errors.Annotate(err, "reading oplog")
+	}
+	// An incremental starts where its parent ended, whether or not
+	// that entry is still the first in its oplog.
+	if source.OplogStart == 0 {
+		source.OplogStart = oplog.First
+	}
+	if oplog.Last > source.OplogEnd {
+		source.OplogEnd = oplog.Last
+	}
+	metadata := flatMetadata{
+		ID:                          source.BackupCreated.UTC().Format("20060102-150405") + "." + source.ControllerModelUUID,
+		FormatVersion:               metadataFormatVersion,
+		Started:                     source.BackupCreated.UTC(),
+		Finished:                    time.Now().UTC(),
+		Notes:                       contents.Notes,
+		ModelUUID:                   source.ControllerModelUUID,
+		Machine:                     contents.MachineID,
+		Hostname:                    source.Hostname,
+		Version:                     source.JujuVersion,
+		Series:                      source.Series,
+		ControllerUUID:              source.ControllerUUID,
+		HANodes:                     int64(source.HANodes),
+		ControllerMachineID:         contents.MachineID,
+		CACert:                      source.CACert,
+		ControllerMachineInstanceID: source.ControllerMachineInstanceID,
+		ParentID:                    source.ParentID,
+		OplogStart:                  int64(source.OplogStart),
+		OplogEnd:                    int64(source.OplogEnd),
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(filepath.Join(stageDir, metadataFile), data, 0600))
+}
+
+// moveDir moves src to dest, copying it if they're on different
+// filesystems.
+func moveDir(src, dest string) error {
+	err := os.Rename(src, dest)
+	if err == nil {
+		return nil
+	}
+	logger.Debugf("couldn't rename %q to %q (%v), copying instead", src, dest, err)
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		target := filepath.Join(dest, relPath)
+		if info.IsDir() {
+			return errors.Trace(os.MkdirAll(target, 0700))
+		}
+		return errors.Trace(copyFile(path, target, info.Mode().Perm()))
+	})
+}
+
+func copyFile(src, dest string, perm os.FileMode) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer source.Close()
+	target, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(target.Close())
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/mgo/v2/bson"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+func writeTestFile(c *gc.C, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *backupSuite) TestCreate(c *gc.C) {
+	root := c.MkDir()
+	writeTestFile(c, filepath.Join(root, "var/lib/juju/agents/machine-3/agent.conf"), "tag: machine-3\n")
+	writeTestFile(c, filepath.Join(root, "var/lib/juju/server.pem"), "pem")
+	writeTestFile(c, filepath.Join(root, "var/lib/juju/unrelated"), "skipped")
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeTestFile(c, filepath.Join(dumpDir, "juju/models.bson"), "")
+	writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+	writeTestFile(c, filepath.Join(dumpDir, "oplog.bson"), "")
+
+	created := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	// The dump's oplog is empty, so the end is the position before
+	// the dump.
+	before := core.NewOplogPosition(created, 4)
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   root,
+		MachineID: "3",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			ControllerUUID:      "controller-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			Series:              "focal",
+			BackupCreated:       created,
+			Hostname:            "juju-0",
+			HANodes:             3,
+			OplogEnd:            before,
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	// The staging directory is cleaned up.
+	items, err := ioutil.ReadDir(filepath.Dir(path))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(items, gc.HasLen, 1)
+
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	metadata, err := opened.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata, jc.DeepEquals, core.BackupMetadata{
+		FormatVersion:       1,
+		ControllerModelUUID: "how-bizarre-uuid",
+		ControllerUUID:      "controller-uuid",
+		JujuVersion:         version.MustParse("2.9.37"),
+		Series:              "focal",
+		BackupCreated:       created,
+		Hostname:            "juju-0",
+		HANodes:             3,
+		ID:                  "20200317-162824.how-bizarre-uuid",
+		OplogEnd:            before,
+		ControllerMachineID: "3",
+		Oplog:               core.DumpOplog{Present: true},
+		Databases: []core.DatabaseSize{{
+			Name:        "juju",
+			Collections: map[string]int64{"clouds": 0, "models": 0},
+		}},
+	})
+	_, err = os.Stat(filepath.Join(opened.DumpDirectory(), "oplog.bson"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The controller's files are in root.tar, which is extracted
+	// alongside the dump.
+	extracted := filepath.Dir(opened.DumpDirectory())
+	data, err := ioutil.ReadFile(filepath.Join(extracted, "var/lib/juju/agents/machine-3/agent.conf"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "tag: machine-3\n")
+	c.Assert(filepath.Join(extracted, "var/lib/juju/server.pem"), jc.IsNonEmptyFile)
+	c.Assert(filepath.Join(extracted, "var/lib/juju/unrelated"), jc.DoesNotExist)
+}
+
+func writeOplog(c *gc.C, path string, positions ...core.OplogPosition) {
+	var data []byte
+	for _, position := range positions {
+		entry, err := bson.Marshal(bson.M{"ts": bson.MongoTimestamp(position), "op": "n"})
+		c.Assert(err, jc.ErrorIsNil)
+		data = append(data, entry...)
+	}
+	writeTestFile(c, path, string(data))
+}
+
+func (s *backupSuite) TestCreateIncremental(c *gc.C) {
+	root := c.MkDir()
+	writeTestFile(c, filepath.Join(root, "var/lib/juju/server.pem"), "pem")
+	created := time.Date(2020, 3, 17, 18, 0, 0, 0, time.UTC)
+	start := core.NewOplogPosition(created.Add(-time.Hour), 1)
+	end := core.NewOplogPosition(created, 2)
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeOplog(c, filepath.Join(dumpDir, "oplog.bson"), start, core.NewOplogPosition(created, 1), end)
+
+	path := filepath.Join(c.MkDir(), "incremental.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   root,
+		MachineID: "3",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			ControllerUUID:      "controller-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			Series:              "focal",
+			BackupCreated:       created,
+			Hostname:            "juju-0",
+			HANodes:             3,
+			ParentID:            "20200317-162824.how-bizarre-uuid",
+			OplogStart:          start,
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	metadata, err := opened.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Incremental(), jc.IsTrue)
+	c.Assert(metadata.ID, gc.Equals, "20200317-180000.how-bizarre-uuid")
+	c.Assert(metadata.ParentID, gc.Equals, "20200317-162824.how-bizarre-uuid")
+	c.Assert(metadata.OplogStart, gc.Equals, start)
+	c.Assert(metadata.OplogEnd, gc.Equals, end)
+	c.Assert(filepath.Join(opened.DumpDirectory(), "oplog.bson"), jc.IsNonEmptyFile)
+	// No controller files are included.
+	extracted := filepath.Dir(opened.DumpDirectory())
+	c.Assert(filepath.Join(extracted, "var/lib/juju/server.pem"), jc.DoesNotExist)
+}
+
+func (s *backupSuite) TestCreateExistingFile(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	writeTestFile(c, path, "precious")
+	dumpDir := c.MkDir()
+	err := backup.Create(path, backup.Contents{DumpDir: dumpDir, RootDir: c.MkDir()})
+	c.Assert(err, gc.ErrorMatches, "open .*backup.tar.gz: file exists")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "precious")
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// BackupDiff describes what changed between two backups.
+type BackupDiff struct {
+	// From and To are the metadata of the older and newer backups,
+	// in the order they were given.
+	From core.BackupMetadata
+	To   core.BackupMetadata
+
+	// ModelsAdded and ModelsRemoved list the models (as
+	// <name> (<uuid>)) only in To or only in From.
+	ModelsAdded   []string
+	ModelsRemoved []string
+
+	// Collections lists the collections whose document counts
+	// differ, by namespace.
+	Collections []CollectionDiff
+
+	// Settings lists the controller settings that differ.
+	Settings []SettingDiff
+}
+
+// CollectionDiff records a collection's document count in each backup.
+// A collection missing from a backup has a count of -1.
+type CollectionDiff struct {
+	Name string
+	From int
+	To   int
+}
+
+// SettingDiff records a controller setting's value in each backup,
+// formatted as text. A setting missing from a backup has an empty
+// value and isn't Set.
+type SettingDiff struct {
+	Name    string
+	From    string
+	To      string
+	FromSet bool
+	ToSet   bool
+}
+
+// backupContents is the part of a backup compared by Diff.
+type backupContents struct {
+	metadata    core.BackupMetadata
+	models      map[string]string
+	collections map[string]int
+	settings    map[string]interface{}
+}
+
+// Diff unpacks the two backup files under tempRoot and compares their
+// metadata, models, collection document counts and controller
+// settings, without needing a database.
+func Diff(fromPath, toPath, tempRoot string) (BackupDiff, error) {
+	from, err := readContents(fromPath, tempRoot)
+	if err != nil {
+		return BackupDiff{}, errors.Annotatef(err, "reading %s", fromPath)
+	}
+	to, err := readContents(toPath, tempRoot)
+	if err != nil {
+		return BackupDiff{}, errors.Annotatef(err, "reading %s", toPath)
+	}
+	result := BackupDiff{From: from.metadata, To: to.metadata}
+
+	for uuid, name := range to.models {
+		if _, ok := from.models[uuid]; !ok {
+			result.ModelsAdded = append(result.ModelsAdded, name+" ("+uuid+")")
+		}
+	}
+	for uuid, name := range from.models {
+		if _, ok := to.models[uuid]; !ok {
+			result.ModelsRemoved = append(result.ModelsRemoved, name+" ("+uuid+")")
+		}
+	}
+	sort.Strings(result.ModelsAdded)
+	sort.Strings(result.ModelsRemoved)
+
+	collections := set.NewStrings()
+	for name := range from.collections {
+		collections.Add(name)
+	}
+	for name := range to.collections {
+		collections.Add(name)
+	}
+	for _, name := range collections.SortedValues() {
+		fromCount, ok := from.collections[name]
+		if !ok {
+			fromCount = -1
+		}
+		toCount, ok := to.collections[name]
+		if !ok {
+			toCount = -1
+		}
+		if fromCount != toCount {
+			result.Collections = append(result.Collections, CollectionDiff{Name: name, From: fromCount, To: toCount})
+		}
+	}
+
+	settings := set.NewStrings()
+	for name := range from.settings {
+		settings.Add(name)
+	}
+	for name := range to.settings {
+		settings.Add(name)
+	}
+	for _, name := range settings.SortedValues() {
+		fromValue, fromSet := from.settings[name]
+		toValue, toSet := to.settings[name]
+		if fromSet == toSet && reflect.DeepEqual(fromValue, toValue) {
+			continue
+		}
+		diff := SettingDiff{Name: name, FromSet: fromSet, ToSet: toSet}
+		if fromSet {
+			diff.From = filterText(fromValue)
+		}
+		if toSet {
+			diff.To = filterText(toValue)
+		}
+		result.Settings = append(result.Settings, diff)
+	}
+	return result, nil
+}
+
+// readContents unpacks the backup file and reads the parts compared
+// by Diff, removing the unpacked files afterwards.
+func readContents(path, tempRoot string) (backupContents, error) {
+	opened, err := open(path, tempRoot, nil)
+	if err != nil {
+		return backupContents{}, errors.Trace(err)
+	}
+	defer func() {
+		if err := opened.Close(); err != nil {
+			logger.Errorf("couldn't remove unpacked backup: %s", err)
+		}
+	}()
+	var contents backupContents
+	contents.metadata, err = opened.Metadata()
+	if err != nil {
+		return backupContents{}, errors.Trace(err)
+	}
+
+	contents.models = make(map[string]string)
+	if err := readBsonFile(filepath.Join(opened.dir, modelsFile), func(data []byte) error {
+		var doc struct {
+			ID    string `bson:"_id"`
+			Name  string `bson:"name"`
+			Owner string `bson:"owner"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		name := doc.Name
+		if doc.Owner != "" {
+			name = doc.Owner + "/" + name
+		}
+		contents.models[doc.ID] = name
+		return nil
+	}); err != nil {
+		return backupContents{}, errors.Annotate(err, "reading models")
+	}
+
+	contents.settings = make(map[string]interface{})
+	if err := readBsonFile(filepath.Join(opened.dir, controllersFile), func(data []byte) error {
+		var doc struct {
+			ID       string                 `bson:"_id"`
+			Settings map[string]interface{} `bson:"settings"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		if doc.ID == "controllerSettings" {
+			contents.settings = doc.Settings
+		}
+		return nil
+	}); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return backupContents{}, errors.Annotate(err, "reading controller settings")
+	}
+
+	contents.collections = make(map[string]int)
+	dir := opened.DumpDirectory()
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// The oplog isn't a collection.
+		collection, isBson := collectionFileName(info.Name())
+		if info.IsDir() || !isBson || filepath.Dir(path) == dir {
+			return nil
+		}
+		count, err := countBsonDocs(filepath.Join(filepath.Dir(path), collection+".bson"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		contents.collections[filepath.Base(filepath.Dir(path))+"."+collection] = count
+		return nil
+	})
+	if err != nil {
+		return backupContents{}, errors.Annotate(err, "counting documents")
+	}
+	return contents, nil
+}
+
+// readBsonFile calls callback with each document in the file.
+func readBsonFile(path string, callback func([]byte) error) error {
+	source, err := openBsonFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer source.Close()
+	return errors.Trace(eachBsonDoc(source, callback))
+}
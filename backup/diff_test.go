@@ -0,0 +1,96 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/juju/mgo/v2/bson"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+func (s *backupSuite) createDiffBackup(c *gc.C, created time.Time, jujuVersion string, models []bson.M, machines int, settings bson.M) string {
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	var modelDocs []interface{}
+	for _, model := range models {
+		modelDocs = append(modelDocs, model)
+	}
+	writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), modelDocs...)
+	writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+	var machineDocs []interface{}
+	for i := 0; i < machines; i++ {
+		machineDocs = append(machineDocs, bson.M{"_id": i})
+	}
+	writeDocs(c, filepath.Join(dumpDir, "juju/machines.bson"), machineDocs...)
+	writeDocs(c, filepath.Join(dumpDir, "juju/controllers.bson"),
+		bson.M{"_id": "controllerSettings", "settings": settings},
+	)
+	writeTestFile(c, filepath.Join(dumpDir, "oplog.bson"), "")
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.MkDir(),
+		MachineID: "0",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse(jujuVersion),
+			BackupCreated:       created,
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return path
+}
+
+func (s *backupSuite) TestDiff(c *gc.C) {
+	created := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	controller := bson.M{"_id": "how-bizarre-uuid", "name": "controller", "owner": "admin"}
+	from := s.createDiffBackup(c, created, "2.9.37",
+		[]bson.M{controller, {"_id": "rain-uuid", "name": "rain", "owner": "admin"}},
+		2, bson.M{"audit-log-max-size": "300M", "api-port": 17070, "max-logs-age": "72h"})
+	to := s.createDiffBackup(c, created.Add(2*time.Hour), "2.9.38",
+		[]bson.M{controller, {"_id": "slide-uuid", "name": "slide", "owner": "bob"}},
+		3, bson.M{"audit-log-max-size": "500M", "api-port": 17070, "audit-log-capture-args": true})
+
+	diff, err := backup.Diff(from, to, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(diff.From.BackupCreated.Equal(created), jc.IsTrue)
+	c.Assert(diff.To.JujuVersion, gc.Equals, version.MustParse("2.9.38"))
+	c.Assert(diff.ModelsAdded, jc.DeepEquals, []string{"bob/slide (slide-uuid)"})
+	c.Assert(diff.ModelsRemoved, jc.DeepEquals, []string{"admin/rain (rain-uuid)"})
+	c.Assert(diff.Collections, jc.DeepEquals, []backup.CollectionDiff{
+		{Name: "juju.machines", From: 2, To: 3},
+	})
+	c.Assert(diff.Settings, jc.DeepEquals, []backup.SettingDiff{
+		{Name: "audit-log-capture-args", To: "true", ToSet: true},
+		{Name: "audit-log-max-size", From: "300M", To: "500M", FromSet: true, ToSet: true},
+		{Name: "max-logs-age", From: "72h", FromSet: true},
+	})
+}
+
+func (s *backupSuite) TestDiffSame(c *gc.C) {
+	created := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	models := []bson.M{{"_id": "how-bizarre-uuid", "name": "controller"}}
+	settings := bson.M{"api-port": 17070}
+	from := s.createDiffBackup(c, created, "2.9.37", models, 1, settings)
+	to := s.createDiffBackup(c, created, "2.9.37", models, 1, settings)
+
+	diff, err := backup.Diff(from, to, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(diff.ModelsAdded, gc.HasLen, 0)
+	c.Assert(diff.ModelsRemoved, gc.HasLen, 0)
+	c.Assert(diff.Collections, gc.HasLen, 0)
+	c.Assert(diff.Settings, gc.HasLen, 0)
+}
+
+func (s *backupSuite) TestDiffMissingBackup(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "missing.tar.gz")
+	_, err := backup.Diff(path, path, s.dir)
+	c.Assert(err, gc.ErrorMatches, `reading .*missing.tar.gz: .*`)
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+)
+
+// The formats collections can be exported in.
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// DefaultExportCollections are the collections exported if none are
+// chosen - the ones most often needed to say what was in a backup.
+var DefaultExportCollections = []string{"users", "models", "machines", "settings"}
+
+// ExportedCollection describes a collection written by Export.
+type ExportedCollection struct {
+	// Name is the collection's name in the juju database.
+	Name string
+
+	// Path is the file the documents were written to.
+	Path string
+
+	// Documents is the number of documents written.
+	Documents int
+}
+
+// Export unpacks the backup file under tempRoot and writes the
+// documents from each of the named collections in its juju database
+// to <collection>.<format> in outputDir, without needing a database.
+// JSON files hold one document per line; CSV files have a column for
+// each top-level field, with documents and arrays in them written as
+// JSON. Existing files aren't overwritten.
+func Export(path, tempRoot, outputDir, format string, collections []string) ([]ExportedCollection, error) {
+	var write func(source, target *os.File) (int, error)
+	switch format {
+	case ExportJSON:
+		write = exportJSON
+	case ExportCSV:
+		write = exportCSV
+	default:
+		return nil, errors.NotValidf("export format %q", format)
+	}
+	opened, err := open(path, tempRoot, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() {
+		if err := opened.Close(); err != nil {
+			logger.Errorf("couldn't remove unpacked backup: %s", err)
+		}
+	}()
+	// Check they're all there before writing anything.
+	for _, name := range collections {
+		if _, err := os.Stat(namespacePath(opened.DumpDirectory(), "juju."+name, ".bson")); err != nil {
+			return nil, errors.Errorf("collection %q isn't in the backup", name)
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result []ExportedCollection
+	for _, name := range collections {
+		exported := ExportedCollection{
+			Name: name,
+			Path: filepath.Join(outputDir, name+"."+format),
+		}
+		exported.Documents, err = exportCollection(namespacePath(opened.DumpDirectory(), "juju."+name, ".bson"), exported.Path, write)
+		if err != nil {
+			return result, errors.Annotatef(err, "exporting %s", name)
+		}
+		result = append(result, exported)
+	}
+	return result, nil
+}
+
+// exportCollection writes the documents in the dumped collection at
+// source to a new file at target, removing it if writing fails.
+func exportCollection(source, target string, write func(source, target *os.File) (int, error)) (int, error) {
+	in, err := os.Open(source)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer in.Close()
+	// The documents can hold password hashes and credentials.
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	count, err := write(in, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(target)
+		return 0, errors.Trace(err)
+	}
+	return count, nil
+}
+
+func exportJSON(source, target *os.File) (int, error) {
+	count := 0
+	encoder := json.NewEncoder(target)
+	err := eachBsonDoc(source, func(data []byte) error {
+		var doc bson.D
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		count++
+		return errors.Trace(encoder.Encode(exportDoc(doc)))
+	})
+	return count, errors.Trace(err)
+}
+
+// exportCSV reads the collection twice: first to find every
+// top-level field for the header, then to write the rows.
+func exportCSV(source, target *os.File) (int, error) {
+	var fields []string
+	columns := make(map[string]int)
+	err := eachBsonDoc(source, func(data []byte) error {
+		var doc bson.D
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		for _, elem := range doc {
+			if _, ok := columns[elem.Name]; !ok {
+				columns[elem.Name] = len(fields)
+				fields = append(fields, elem.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return 0, errors.Trace(err)
+	}
+	writer := csv.NewWriter(target)
+	if err := writer.Write(fields); err != nil {
+		return 0, errors.Trace(err)
+	}
+	count := 0
+	err = eachBsonDoc(source, func(data []byte) error {
+		var doc bson.D
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		row := make([]string, len(fields))
+		for _, elem := range doc {
+			cell, err := csvCell(elem.Value)
+			if err != nil {
+				return errors.Annotatef(err, "field %q", elem.Name)
+			}
+			row[columns[elem.Name]] = cell
+		}
+		count++
+		return errors.Trace(writer.Write(row))
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	writer.Flush()
+	return count, errors.Trace(writer.Error())
+}
+
+// csvCell formats a field's value for a CSV file: strings (including
+// object IDs and times) are written as they are and anything else as
+// JSON.
+func csvCell(value interface{}) (string, error) {
+	value = exportValue(value)
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(data), nil
+}
+
+// exportDoc is a document that keeps its fields in order when it's
+// written as JSON.
+type exportDoc bson.D
+
+// MarshalJSON is part of json.Marshaler.
+func (d exportDoc) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, elem := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(elem.Name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		value, err := json.Marshal(exportValue(elem.Value))
+		if err != nil {
+			return nil, errors.Annotatef(err, "field %q", elem.Name)
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// exportValue converts the BSON types that don't have a natural JSON
+// form: object IDs become hex strings, binary data base64 strings
+// and oplog timestamps numbers.
+func exportValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		return exportDoc(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			result[i] = exportValue(elem)
+		}
+		return result
+	case bson.ObjectId:
+		return v.Hex()
+	case bson.Binary:
+		return v.Data
+	case bson.MongoTimestamp:
+		return int64(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return value
+}
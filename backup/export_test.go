@@ -0,0 +1,112 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/mgo/v2/bson"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+func (s *backupSuite) createExportBackup(c *gc.C) string {
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), bson.M{"_id": "how-bizarre-uuid", "name": "controller"})
+	writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+	writeDocs(c, filepath.Join(dumpDir, "juju/users.bson"),
+		doc("_id", "admin", "passwordhash", "hash", "createdby", "admin"),
+		doc("_id", "bob", "deactivated", true, "lastlogin", time.Date(2020, 3, 17, 16, 0, 0, 0, time.UTC)),
+	)
+	writeDocs(c, filepath.Join(dumpDir, "juju/settings.bson"),
+		doc("_id", "e", "settings", doc("name", "controller", "ports", []interface{}{17070, 37017}),
+			"txn-queue", []interface{}{bson.ObjectIdHex("5e70f9b8b8e1f1a2c3d4e5f6")}),
+	)
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.MkDir(),
+		MachineID: "0",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			BackupCreated:       time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC),
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return path
+}
+
+func readTestFile(c *gc.C, path string) string {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, jc.ErrorIsNil)
+	return string(data)
+}
+
+func (s *backupSuite) TestExportJSON(c *gc.C) {
+	path := s.createExportBackup(c)
+	output := filepath.Join(c.MkDir(), "export")
+	exported, err := backup.Export(path, s.dir, output, backup.ExportJSON, []string{"users", "settings"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(exported, jc.DeepEquals, []backup.ExportedCollection{
+		{Name: "users", Path: filepath.Join(output, "users.json"), Documents: 2},
+		{Name: "settings", Path: filepath.Join(output, "settings.json"), Documents: 1},
+	})
+	c.Assert(readTestFile(c, exported[0].Path), gc.Equals, `
+{"_id":"admin","passwordhash":"hash","createdby":"admin"}
+{"_id":"bob","deactivated":true,"lastlogin":"2020-03-17T16:00:00Z"}
+`[1:])
+	c.Assert(readTestFile(c, exported[1].Path), gc.Equals, `
+{"_id":"e","settings":{"name":"controller","ports":[17070,37017]},"txn-queue":["5e70f9b8b8e1f1a2c3d4e5f6"]}
+`[1:])
+	info, err := os.Stat(exported[0].Path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0600))
+}
+
+func (s *backupSuite) TestExportCSV(c *gc.C) {
+	path := s.createExportBackup(c)
+	output := c.MkDir()
+	exported, err := backup.Export(path, s.dir, output, backup.ExportCSV, []string{"users", "settings"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(exported, gc.HasLen, 2)
+	c.Assert(readTestFile(c, filepath.Join(output, "users.csv")), gc.Equals, `
+_id,passwordhash,createdby,deactivated,lastlogin
+admin,hash,admin,,
+bob,,,true,2020-03-17T16:00:00Z
+`[1:])
+	c.Assert(readTestFile(c, filepath.Join(output, "settings.csv")), gc.Equals, `
+_id,settings,txn-queue
+e,"{""name"":""controller"",""ports"":[17070,37017]}","[""5e70f9b8b8e1f1a2c3d4e5f6""]"
+`[1:])
+}
+
+func (s *backupSuite) TestExportMissingCollection(c *gc.C) {
+	path := s.createExportBackup(c)
+	output := filepath.Join(c.MkDir(), "export")
+	_, err := backup.Export(path, s.dir, output, backup.ExportJSON, []string{"users", "machines"})
+	c.Assert(err, gc.ErrorMatches, `collection "machines" isn't in the backup`)
+	c.Assert(output, jc.DoesNotExist)
+}
+
+func (s *backupSuite) TestExportDoesNotOverwrite(c *gc.C) {
+	path := s.createExportBackup(c)
+	output := c.MkDir()
+	writeTestFile(c, filepath.Join(output, "users.json"), "precious")
+	_, err := backup.Export(path, s.dir, output, backup.ExportJSON, []string{"users"})
+	c.Assert(err, gc.ErrorMatches, `exporting users: open .*users.json: file exists`)
+	c.Assert(readTestFile(c, filepath.Join(output, "users.json")), gc.Equals, "precious")
+}
+
+func (s *backupSuite) TestExportInvalidFormat(c *gc.C) {
+	_, err := backup.Export("backup.tar.gz", s.dir, c.MkDir(), "xml", backup.DefaultExportCollections)
+	c.Assert(err, gc.ErrorMatches, `export format "xml" not valid`)
+}
@@ -10,10 +10,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
+	"github.com/juju/mgo/v2/bson"
 	"github.com/juju/utils/v3/tar"
 
 	"github.com/juju/juju-restore/core"
@@ -29,16 +31,43 @@ const (
 	logsDir             = "juju-backup/dump/logs"
 	modelsFile          = "juju-backup/dump/juju/models.bson"
 	cloudsFile          = "juju-backup/dump/juju/clouds.bson"
+	usersFile           = "juju-backup/dump/juju/users.bson"
+	permissionsFile     = "juju-backup/dump/juju/permissions.bson"
+	settingsFile        = "juju-backup/dump/juju/settings.bson"
+	oplogFile           = "juju-backup/dump/oplog.bson"
 	machinesFile        = "juju-backup/dump/juju/machines.bson"
 	controllerNodesFile = "juju-backup/dump/juju/controllerNodes.bson"
+	controllersFile     = "juju-backup/dump/juju/controllers.bson"
+
+	// tempDirPrefix starts the names of the directories made under
+	// the temp root to unpack backup files into.
+	tempDirPrefix = "juju-restore"
 )
 
 // Open unpacks a backup file in a temp location and returns a
 // core.BackupFile that gives access to the db dumps, files and
 // metadata contained therein. The backup file passed in should be a
 // tar.gz file in the standard Juju format.
-func Open(path string, tempRoot string) (_ core.BackupFile, err error) {
-	destDir, err := ioutil.TempDir(tempRoot, "juju-restore")
+func Open(path string, tempRoot string) (core.BackupFile, error) {
+	return OpenChecked(path, tempRoot, nil)
+}
+
+// OpenChecked is like Open, but also passes checkDump the size of the
+// backup's database dump before anything is extracted, so checks of
+// other places the dump will be copied to can fail early too.
+func OpenChecked(path string, tempRoot string, checkDump func(dumpSize int64) error) (core.BackupFile, error) {
+	expanded, err := open(path, tempRoot, checkDump)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return expanded, nil
+}
+
+func open(path string, tempRoot string, checkDump func(dumpSize int64) error) (_ *expandedBackup, err error) {
+	if err := checkTempRoot(path, tempRoot, checkDump); err != nil {
+		return nil, errors.Trace(err)
+	}
+	destDir, err := ioutil.TempDir(tempRoot, tempDirPrefix)
 	if err != nil {
 		return nil, errors.Annotatef(err, "creating temp directory in %q", tempRoot)
 	}
@@ -67,6 +96,27 @@ func Open(path string, tempRoot string) (_ core.BackupFile, err error) {
 	return &expandedBackup{dir: destDir}, nil
 }
 
+// FindTempDirs returns the directories under tempRoot that backup
+// files were unpacked into and not removed, because juju-restore was
+// killed before it could tidy up.
+func FindTempDirs(tempRoot string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(tempRoot, tempDirPrefix+"*"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var dirs []string
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		}
+	}
+	return dirs, nil
+}
+
 type expandedBackup struct {
 	dir string
 }
@@ -74,21 +124,40 @@ type expandedBackup struct {
 // Metadata returns the collected info from the backup file. Part of
 // core.BackupFile.
 func (b *expandedBackup) Metadata() (core.BackupMetadata, error) {
+	oplog, err := readDumpOplog(filepath.Join(b.dir, oplogFile))
+	if err != nil {
+		return core.BackupMetadata{}, errors.Annotate(err, "reading oplog")
+	}
 	result, err := readMetadataJSON(b.dir)
+	if os.IsNotExist(errors.Cause(err)) {
+		logger.Warningf("backup has no metadata.json, inferring metadata from the dump")
+		result, err = inferMetadata(b.dir, oplog)
+	}
 	if err != nil {
 		return core.BackupMetadata{}, errors.Annotate(err, "reading metadata")
 	}
+	result.Oplog = oplog
+	if result.OplogEnd == 0 {
+		// Backups not made by juju-restore don't record the oplog
+		// range, so get it from the dump.
+		result.OplogStart, result.OplogEnd = oplog.First, oplog.Last
+	}
+	if result.Incremental() {
+		// Incrementals only hold the oplog - there's nothing to count.
+		return result, nil
+	}
 	result.ContainsLogs, err = b.containsLogs()
 	if err != nil {
 		return core.BackupMetadata{}, errors.Annotate(err, "checking for logs")
 	}
-	result.ModelCount, err = b.countModels()
+	counts, err := countBsonFiles(filepath.Join(b.dir, modelsFile), filepath.Join(b.dir, cloudsFile))
 	if err != nil {
-		return core.BackupMetadata{}, errors.Annotate(err, "counting models")
+		return core.BackupMetadata{}, errors.Trace(err)
 	}
-	result.CloudCount, err = b.countClouds()
+	result.ModelCount, result.CloudCount = counts[0], counts[1]
+	result.Databases, err = dumpSizes(b.DumpDirectory())
 	if err != nil {
-		return core.BackupMetadata{}, errors.Annotate(err, "counting clouds")
+		return core.BackupMetadata{}, errors.Annotate(err, "measuring dump")
 	}
 	return result, nil
 }
@@ -104,17 +173,71 @@ func (b *expandedBackup) containsLogs() (bool, error) {
 	return len(items) > 0, nil
 }
 
-func (b *expandedBackup) countModels() (int, error) {
-	return countBsonDocs(filepath.Join(b.dir, modelsFile))
+// DumpDirectory returns the path of the contained database dump.
+func (b *expandedBackup) DumpDirectory() string {
+	return filepath.Join(b.dir, dumpDir)
+}
+
+// Entities returns the IDs of the users and clouds in the backup's
+// dump. Part of core.BackupFile.
+func (b *expandedBackup) Entities() (core.ControllerEntities, error) {
+	var result core.ControllerEntities
+	var err error
+	result.Users, err = readIDs(filepath.Join(b.dir, usersFile))
+	if err != nil {
+		return core.ControllerEntities{}, errors.Annotate(err, "reading users")
+	}
+	result.Clouds, err = readIDs(filepath.Join(b.dir, cloudsFile))
+	if err != nil {
+		return core.ControllerEntities{}, errors.Annotate(err, "reading clouds")
+	}
+	return result, nil
 }
 
-func (b *expandedBackup) countClouds() (int, error) {
-	return countBsonDocs(filepath.Join(b.dir, cloudsFile))
+// Permissions returns the _id and object-global-key of the permission
+// documents in the backup's dump, in the order they were dumped. Part
+// of core.BackupFile.
+func (b *expandedBackup) Permissions() ([]core.PermissionDoc, error) {
+	var docs []core.PermissionDoc
+	err := readBsonFile(filepath.Join(b.dir, permissionsFile), func(data []byte) error {
+		var doc struct {
+			ID              string `bson:"_id"`
+			ObjectGlobalKey string `bson:"object-global-key"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		docs = append(docs, core.PermissionDoc{ID: doc.ID, ObjectGlobalKey: doc.ObjectGlobalKey})
+		return nil
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	return docs, errors.Annotate(err, "reading permissions")
 }
 
-// DumpDirectory returns the path of the contained database dump.
-func (b *expandedBackup) DumpDirectory() string {
-	return filepath.Join(b.dir, dumpDir)
+// readIDs returns the string IDs of the documents in a dumped
+// collection, sorted. A collection that wasn't dumped has none.
+func readIDs(path string) ([]string, error) {
+	var ids []string
+	err := readBsonFile(path, func(data []byte) error {
+		var doc struct {
+			ID string `bson:"_id"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		ids = append(ids, doc.ID)
+		return nil
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(ids)
+	return ids, nil
 }
 
 // Close is part of core.BackupFile. It removes the temp directory the
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
 	"github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	"github.com/juju/version/v2"
@@ -77,6 +79,62 @@ func (s *backupSuite) TestOpenMissingRoot(c *gc.C) {
 	c.Assert(opened, gc.Equals, nil)
 }
 
+func (s *backupSuite) TestOpenMissingTempRoot(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup.tar.gz")
+	tempRoot := filepath.Join(s.dir, "missing")
+	opened, err := backup.Open(path, tempRoot)
+	c.Assert(err, gc.ErrorMatches, `temp root ".*/missing" doesn't exist`)
+	c.Assert(opened, gc.Equals, nil)
+}
+
+func (s *backupSuite) TestOpenTempRootNotDirectory(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup.tar.gz")
+	tempRoot := filepath.Join(s.dir, "file")
+	err := ioutil.WriteFile(tempRoot, nil, 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	opened, err := backup.Open(path, tempRoot)
+	c.Assert(err, gc.ErrorMatches, `temp root ".*/file" isn't a directory`)
+	c.Assert(opened, gc.Equals, nil)
+}
+
+func (s *backupSuite) TestOpenCheckedDumpSize(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup.tar.gz")
+	var dumpSize int64
+	opened, err := backup.OpenChecked(path, s.dir, func(size int64) error {
+		dumpSize = size
+		return nil
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	c.Assert(dumpSize, gc.Equals, int64(7098))
+}
+
+func (s *backupSuite) TestOpenCheckedFailsBeforeExtracting(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup.tar.gz")
+	opened, err := backup.OpenChecked(path, s.dir, func(int64) error {
+		return errors.New("no room for the dump")
+	})
+	c.Assert(err, gc.ErrorMatches, "no room for the dump")
+	c.Assert(opened, gc.Equals, nil)
+	items, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(items, gc.HasLen, 0)
+}
+
+func (s *backupSuite) TestFindTempDirs(c *gc.C) {
+	for _, name := range []string{"juju-restore123", "juju-restore456", "other"} {
+		c.Assert(os.Mkdir(filepath.Join(s.dir, name), 0700), jc.ErrorIsNil)
+	}
+	err := ioutil.WriteFile(filepath.Join(s.dir, "juju-restore.log"), nil, 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	dirs, err := backup.FindTempDirs(s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(dirs, jc.DeepEquals, []string{
+		filepath.Join(s.dir, "juju-restore123"),
+		filepath.Join(s.dir, "juju-restore456"),
+	})
+}
+
 func (s *backupSuite) TestMetadataFormatVersion0(c *gc.C) {
 	path := filepath.Join("testdata", "valid-backup.tar.gz")
 	opened, err := backup.Open(path, s.dir)
@@ -87,7 +145,9 @@ func (s *backupSuite) TestMetadataFormatVersion0(c *gc.C) {
 	c.Assert(err, jc.ErrorIsNil)
 	expectCreated, err := time.Parse(time.RFC3339, "2020-02-25T04:12:41.038760008Z")
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(metadata, gc.Equals, core.BackupMetadata{
+	c.Assert(metadata.CACert, jc.HasPrefix, "-----BEGIN CERTIFICATE-----\n")
+	metadata.CACert = ""
+	c.Assert(metadata, jc.DeepEquals, core.BackupMetadata{
 		FormatVersion:       0,
 		ControllerUUID:      "<unspecified>",
 		ControllerModelUUID: "e2a6a1e5-abea-4393-8593-5a45ae53ab97",
@@ -95,10 +155,23 @@ func (s *backupSuite) TestMetadataFormatVersion0(c *gc.C) {
 		Series:              "bionic",
 		BackupCreated:       expectCreated,
 		Hostname:            "juju-53ab97-0",
+		ControllerMachineID: "0",
 		ContainsLogs:        false,
 		ModelCount:          2,
 		HANodes:             3,
 		CloudCount:          2,
+		Databases: []core.DatabaseSize{{
+			Name:  "juju",
+			Bytes: 7098,
+			Collections: map[string]int64{
+				"clouds":   2203,
+				"machines": 3918,
+				"models":   977,
+			},
+		}, {
+			Name:        "logs",
+			Collections: map[string]int64{},
+		}},
 	})
 }
 
@@ -112,7 +185,9 @@ func (s *backupSuite) TestMetadataFormatVersion1(c *gc.C) {
 	c.Assert(err, jc.ErrorIsNil)
 	expectCreated, err := time.Parse(time.RFC3339, "2020-03-03T15:56:49.610854672Z")
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(metadata, gc.Equals, core.BackupMetadata{
+	c.Assert(metadata.CACert, jc.HasPrefix, "-----BEGIN CERTIFICATE-----\n")
+	metadata.CACert = ""
+	c.Assert(metadata, jc.DeepEquals, core.BackupMetadata{
 		FormatVersion:       1,
 		ControllerUUID:      "bda3b637-7972-47f7-87fd-a3f2d0c748a5",
 		ControllerModelUUID: "1be318f6-9460-4fe1-8eb4-b1df2db23b53",
@@ -124,6 +199,14 @@ func (s *backupSuite) TestMetadataFormatVersion1(c *gc.C) {
 		ModelCount:          2,
 		HANodes:             3,
 		CloudCount:          2,
+
+		ControllerMachineID:         "2",
+		ControllerMachineInstanceID: "juju-b23b53-2",
+		Databases: []core.DatabaseSize{{
+			Name:        "juju",
+			Bytes:       3355,
+			Collections: map[string]int64{"clouds": 2203, "models": 1152},
+		}},
 	})
 }
 
@@ -137,6 +220,74 @@ func (s *backupSuite) TestMetadataFormatVersion2(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "reading metadata: unsupported backup format version 2")
 }
 
+func (s *backupSuite) TestEntities(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup-ver-1.tar.gz")
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+
+	// The test backup's dump has no users collection.
+	entities, err := opened.Entities()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entities, jc.DeepEquals, core.ControllerEntities{
+		Clouds: []string{"aws", "localhost"},
+	})
+}
+
+func (s *backupSuite) TestModels(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup-ver-1.tar.gz")
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+
+	// The test backup's dump has no settings, and its clouds don't
+	// include the model's, so neither the version nor the cloud type
+	// is known.
+	models, err := opened.Models()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(models, jc.DeepEquals, []core.ModelSummary{{
+		Name:       "admin/default",
+		Cloud:      "apt-proxy-lxd",
+		Credential: "apt-proxy-lxd#admin#localhost",
+	}})
+}
+
+func (s *backupSuite) TestPermissions(c *gc.C) {
+	path := filepath.Join("testdata", "valid-backup-ver-1.tar.gz")
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+
+	// The test backup's dump has no permissions collection.
+	docs, err := opened.Permissions()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(docs, gc.HasLen, 0)
+
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeDocs(c, filepath.Join(dumpDir, "juju/permissions.bson"),
+		bson.M{"_id": "cloud#aws#us#bob", "object-global-key": "cloud#aws", "access": "add-model"},
+		bson.M{"_id": "e#rain-uuid#us#mary", "object-global-key": "e#rain-uuid", "access": "admin"},
+	)
+	path = filepath.Join(c.MkDir(), "backup.tar.gz")
+	err = backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.MkDir(),
+		MachineID: "0",
+		Metadata:  core.BackupMetadata{JujuVersion: version.MustParse("2.9.37")},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	withPermissions, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer withPermissions.Close()
+
+	docs, err = withPermissions.Permissions()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(docs, jc.DeepEquals, []core.PermissionDoc{
+		{ID: "cloud#aws#us#bob", ObjectGlobalKey: "cloud#aws"},
+		{ID: "e#rain-uuid#us#mary", ObjectGlobalKey: "e#rain-uuid"},
+	})
+}
+
 func (s *backupSuite) TestDumpDirectory(c *gc.C) {
 	path := filepath.Join("testdata", "valid-backup-ver-1.tar.gz")
 	opened, err := backup.Open(path, s.dir)
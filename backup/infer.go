@@ -0,0 +1,163 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"path/filepath"
+
+	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+	"github.com/juju/version/v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+const alive = 0
+
+// inferMetadata works out the metadata of a backup without a
+// metadata.json from its database dump, the same way the controller
+// info is read from a live database: the controller model from the
+// models collection, the Juju version from its settings, and the HA
+// node count and series from its controller machines, with the
+// creation time taken from the last entry in the dumped oplog. The
+// result is flagged as inferred.
+func inferMetadata(directory string, oplog core.DumpOplog) (core.BackupMetadata, error) {
+	type modelDoc struct {
+		ID             string `bson:"_id"`
+		Name           string `bson:"name"`
+		ControllerUUID string `bson:"controller-uuid"`
+	}
+	var model modelDoc
+	found, err := findBsonDoc(filepath.Join(directory, modelsFile), func(data []byte) (bool, error) {
+		var doc modelDoc
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return false, errors.Trace(err)
+		}
+		model = doc
+		return doc.Name == "controller", nil
+	})
+	if err != nil {
+		return core.BackupMetadata{}, errors.Annotate(err, "reading models")
+	}
+	if !found {
+		return core.BackupMetadata{}, errors.New("no controller model in the dump")
+	}
+
+	var settings map[string]interface{}
+	found, err = findBsonDoc(filepath.Join(directory, settingsFile), func(data []byte) (bool, error) {
+		var doc struct {
+			ID       string                 `bson:"_id"`
+			Settings map[string]interface{} `bson:"settings"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return false, errors.Trace(err)
+		}
+		settings = doc.Settings
+		return doc.ID == model.ID+":e", nil
+	})
+	if err != nil {
+		return core.BackupMetadata{}, errors.Annotate(err, "reading settings")
+	}
+	if !found {
+		return core.BackupMetadata{}, errors.New("no controller model settings in the dump")
+	}
+	versionStr, ok := settings["agent-version"].(string)
+	if !ok {
+		return core.BackupMetadata{}, errors.Errorf("expected agent-version to be a string, got %#v", settings["agent-version"])
+	}
+	jujuVersion, err := version.Parse(versionStr)
+	if err != nil {
+		return core.BackupMetadata{}, errors.Trace(err)
+	}
+
+	haNodes, series, err := controllerMachines(directory, model.ID)
+	if err != nil {
+		return core.BackupMetadata{}, errors.Annotate(err, "reading machines")
+	}
+	result := core.BackupMetadata{
+		FormatVersion:       metadataFormatVersion,
+		ControllerUUID:      model.ControllerUUID,
+		ControllerModelUUID: model.ID,
+		JujuVersion:         jujuVersion,
+		Series:              series,
+		HANodes:             haNodes,
+		Inferred:            true,
+	}
+	if oplog.Last != 0 {
+		result.BackupCreated = oplog.Last.Time()
+	}
+	return result, nil
+}
+
+// controllerMachines returns the number of live controller machines
+// in the dump and their series, which must all be the same.
+func controllerMachines(directory, modelUUID string) (int, string, error) {
+	source, err := openBsonFile(filepath.Join(directory, machinesFile))
+	if err != nil {
+		return 0, "", errors.Trace(err)
+	}
+	defer source.Close()
+
+	var haNodes, docCount int
+	allSeries := set.NewStrings()
+	err = eachBsonDoc(source, func(data []byte) error {
+		docCount++
+		var doc struct {
+			ModelUUID string `bson:"model-uuid"`
+			Jobs      []int  `bson:"jobs"`
+			Life      int    `bson:"life"`
+			Series    string `bson:"series"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Annotatef(err, "reading machine doc %d", docCount)
+		}
+		if doc.ModelUUID != modelUUID || doc.Life != alive {
+			return nil
+		}
+		for _, job := range doc.Jobs {
+			if job == jobManageModel {
+				haNodes++
+				allSeries.Add(doc.Series)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, "", errors.Trace(err)
+	}
+	allSeriesNames := allSeries.SortedValues()
+	if len(allSeriesNames) != 1 {
+		return 0, "", errors.Errorf("expected one controller series, got %#v", allSeriesNames)
+	}
+	return haNodes, allSeriesNames[0], nil
+}
+
+// findBsonDoc calls match with each document in the file at path
+// until it returns true, returning whether one matched.
+func findBsonDoc(path string, match func(data []byte) (bool, error)) (bool, error) {
+	source, err := openBsonFile(path)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer source.Close()
+
+	// There's no way to stop early other than an error.
+	errFound := errors.New("found")
+	err = eachBsonDoc(source, func(data []byte) error {
+		matched, err := match(data)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if matched {
+			return errFound
+		}
+		return nil
+	})
+	if errors.Cause(err) == errFound {
+		return true, nil
+	}
+	return false, errors.Trace(err)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+// removeFromBackup copies the backup at path without the named file.
+func removeFromBackup(c *gc.C, path, name string) string {
+	source, err := os.Open(path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer source.Close()
+	gzReader, err := gzip.NewReader(source)
+	c.Assert(err, jc.ErrorIsNil)
+	reader := tar.NewReader(gzReader)
+
+	result := filepath.Join(c.MkDir(), "edited.tar.gz")
+	target, err := os.Create(result)
+	c.Assert(err, jc.ErrorIsNil)
+	defer target.Close()
+	gzWriter := gzip.NewWriter(target)
+	writer := tar.NewWriter(gzWriter)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, jc.ErrorIsNil)
+		if header.Name == name {
+			continue
+		}
+		c.Assert(writer.WriteHeader(header), jc.ErrorIsNil)
+		_, err = io.Copy(writer, reader)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	c.Assert(writer.Close(), jc.ErrorIsNil)
+	c.Assert(gzWriter.Close(), jc.ErrorIsNil)
+	return result
+}
+
+func (s *backupSuite) TestMetadataInferred(c *gc.C) {
+	last := core.NewOplogPosition(time.Date(2020, 3, 17, 16, 30, 0, 0, time.UTC), 3)
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"),
+			doc("_id", "hosted-uuid", "name", "default", "controller-uuid", "dawkins-rules"),
+			doc("_id", "how-bizarre-uuid", "name", "controller", "controller-uuid", "dawkins-rules"),
+		)
+		writeDocs(c, filepath.Join(dumpDir, "juju/settings.bson"),
+			doc("_id", "hosted-uuid:e", "settings", doc("agent-version", "2.9.30")),
+			doc("_id", "how-bizarre-uuid:e", "settings", doc("agent-version", "2.9.37")),
+		)
+		writeDocs(c, filepath.Join(dumpDir, "juju/machines.bson"),
+			doc("model-uuid", "how-bizarre-uuid", "jobs", []int{1, 2}, "life", 0, "series", "focal"),
+			doc("model-uuid", "how-bizarre-uuid", "jobs", []int{2}, "life", 0, "series", "focal"),
+			doc("model-uuid", "how-bizarre-uuid", "jobs", []int{2}, "life", 2, "series", "bionic"),
+			doc("model-uuid", "how-bizarre-uuid", "jobs", []int{1}, "life", 0, "series", "jammy"),
+			doc("model-uuid", "hosted-uuid", "jobs", []int{2}, "life", 0, "series", "jammy"),
+		)
+		writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+		writeOplog(c, filepath.Join(dumpDir, "oplog.bson"), last-1, last)
+	}, "")
+	path = removeFromBackup(c, path, "juju-backup/metadata.json")
+
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	metadata, err := opened.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Databases, gc.HasLen, 1)
+	metadata.Databases = nil
+	c.Assert(metadata, jc.DeepEquals, core.BackupMetadata{
+		FormatVersion:       1,
+		ControllerUUID:      "dawkins-rules",
+		ControllerModelUUID: "how-bizarre-uuid",
+		JujuVersion:         version.MustParse("2.9.37"),
+		Series:              "focal",
+		BackupCreated:       last.Time(),
+		HANodes:             2,
+		ModelCount:          2,
+		OplogStart:          last - 1,
+		OplogEnd:            last,
+		Oplog: core.DumpOplog{
+			Present: true,
+			Entries: 2,
+			First:   last - 1,
+			Last:    last,
+		},
+		Inferred: true,
+	})
+}
+
+func (s *backupSuite) TestMetadataInferredNoControllerModel(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), doc("_id", "hosted-uuid", "name", "default"))
+	}, "")
+	path = removeFromBackup(c, path, "juju-backup/metadata.json")
+
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	_, err = opened.Metadata()
+	c.Assert(err, gc.ErrorMatches, "reading metadata: no controller model in the dump")
+}
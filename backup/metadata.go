@@ -4,13 +4,16 @@
 package backup
 
 import (
-	"bytes"
+	"bufio"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
@@ -89,18 +92,31 @@ type flatMetadata struct {
 	ControllerMachineInstanceID string
 	CACert                      string
 	CAPrivateKey                string
+
+	// incremental backups
+
+	ParentID   string `json:",omitempty"`
+	OplogStart int64  `json:",omitempty"`
+	OplogEnd   int64  `json:",omitempty"`
 }
 
 func flatToBackupMetadata(source flatMetadata) core.BackupMetadata {
 	return core.BackupMetadata{
-		FormatVersion:       source.FormatVersion,
-		ControllerUUID:      source.ControllerUUID,
-		ControllerModelUUID: source.ModelUUID,
-		JujuVersion:         source.Version,
-		Series:              source.Series,
-		BackupCreated:       source.Started,
-		Hostname:            source.Hostname,
-		HANodes:             int(source.HANodes),
+		FormatVersion:               source.FormatVersion,
+		ControllerUUID:              source.ControllerUUID,
+		ControllerModelUUID:         source.ModelUUID,
+		JujuVersion:                 source.Version,
+		Series:                      source.Series,
+		BackupCreated:               source.Started,
+		Hostname:                    source.Hostname,
+		HANodes:                     int(source.HANodes),
+		ID:                          source.ID,
+		ParentID:                    source.ParentID,
+		CACert:                      source.CACert,
+		ControllerMachineID:         source.ControllerMachineID,
+		ControllerMachineInstanceID: source.ControllerMachineInstanceID,
+		OplogStart:                  core.OplogPosition(source.OplogStart),
+		OplogEnd:                    core.OplogPosition(source.OplogEnd),
 	}
 }
 
@@ -139,51 +155,170 @@ func flatV0ToBackupMetadata(source flatMetadataV0, haNodes int) core.BackupMetad
 		BackupCreated:       source.Started,
 		Hostname:            source.Hostname,
 		HANodes:             haNodes,
+		ID:                  source.ID,
+		ControllerMachineID: source.Machine,
+		CACert:              source.CACert,
 	}
 }
 
+// maxBsonDocSize is the largest document MongoDB will store (16MB)
+// plus the headroom it allows for internal documents like oplog
+// entries. A larger size means the file is corrupt, so it's rejected
+// rather than allocated.
+const maxBsonDocSize = 16*1024*1024 + 16*1024
+
+// bsonReadBufferSize is the size of the buffer for reading dumps -
+// most documents are much smaller, so reading them one at a time from
+// the file would mean a syscall for each.
+const bsonReadBufferSize = 64 * 1024
+
+// readBsonDocSize reads the 32-bit little-endian size that starts
+// each bson document, checking that it's plausible. It returns io.EOF
+// if there are no more documents.
+func readBsonDocSize(source io.Reader, header []byte) (int64, error) {
+	if _, err := io.ReadFull(source, header); err != nil {
+		return 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	// The smallest document is the size, then the terminating 0.
+	if size < 5 || size > maxBsonDocSize {
+		return 0, errors.Errorf("invalid document size %d", size)
+	}
+	return size, nil
+}
+
+// eachBsonDoc calls callback with the bytes of each document in
+// source in turn. The slice is reused for the next document, so
+// memory use is bounded by the largest document rather than the size
+// of the file.
 func eachBsonDoc(source io.Reader, callback func([]byte) error) error {
-	var size uint32
-	var buf bytes.Buffer
+	reader := bufio.NewReaderSize(source, bsonReadBufferSize)
+	header := make([]byte, 4)
+	var buf []byte
 	for {
-		// Each bson document starts with a 32-bit little-endian size.
-		err := binary.Read(source, binary.LittleEndian, &size)
+		size, err := readBsonDocSize(reader, header)
 		if err == io.EOF {
 			return nil
 		}
 		if err != nil {
 			return errors.Trace(err)
 		}
-		buf.Grow(int(size))
-		err = binary.Write(&buf, binary.LittleEndian, size)
-		if err != nil {
-			return errors.Trace(err)
+		if int64(cap(buf)) < size {
+			buf = make([]byte, size)
 		}
-		_, err = io.CopyN(&buf, source, int64(size-4))
-		if err != nil {
+		buf = buf[:size]
+		copy(buf, header)
+		if _, err := io.ReadFull(reader, buf[4:]); err != nil {
 			return errors.Trace(err)
 		}
 
 		// Pass the bytes rather than unmarshalling so the callback
 		// can decide how (or whether) to unmarshal it.
-		err = callback(buf.Bytes())
-		if err != nil {
+		if err := callback(buf); err != nil {
 			return errors.Trace(err)
 		}
+	}
+}
+
+// compressedSuffix is added to the dumped collections' file names by
+// mongodump --gzip.
+const compressedSuffix = ".gz"
+
+// openBsonFile opens a dumped collection, reading it through gzip if
+// the dump only has a compressed copy (path + ".gz").
+func openBsonFile(path string) (io.ReadCloser, error) {
+	source, err := os.Open(path)
+	if err == nil {
+		return source, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+	compressed, gzErr := os.Open(path + compressedSuffix)
+	if gzErr != nil {
+		// Report the uncompressed file as missing.
+		return nil, errors.Trace(err)
+	}
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		compressed.Close()
+		return nil, errors.Annotatef(err, "reading %s", filepath.Base(path)+compressedSuffix)
+	}
+	return &gzipFile{Reader: reader, file: compressed}, nil
+}
 
-		buf.Reset()
+// gzipFile closes the compressed file along with its reader.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+// Close is part of io.Closer.
+func (f *gzipFile) Close() error {
+	err := f.Reader.Close()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// collectionFileName returns the collection a dump file name holds,
+// and whether it holds one - compressed or not.
+func collectionFileName(name string) (string, bool) {
+	for _, suffix := range []string{".bson", ".bson" + compressedSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
 	}
+	return "", false
 }
 
+// countBsonDocs counts the documents in a dumped collection, seeking
+// past each one rather than reading it.
 func countBsonDocs(path string) (int, error) {
 	source, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return countCompressedBsonDocs(path)
+	}
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
 	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
 
 	var count int
-	err = eachBsonDoc(source, func(_ []byte) error {
+	var offset int64
+	header := make([]byte, 4)
+	for offset < info.Size() {
+		size, err := readBsonDocSize(io.NewSectionReader(source, offset, 4), header)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, errors.Annotatef(err, "document %d", count+1)
+		}
+		offset += size
+		if offset > info.Size() {
+			return 0, errors.Annotatef(io.ErrUnexpectedEOF, "document %d", count+1)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// countCompressedBsonDocs counts the documents in a compressed dump of
+// a collection, which has to be read through since it can't be seeked.
+func countCompressedBsonDocs(path string) (int, error) {
+	source, err := openBsonFile(path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer source.Close()
+	var count int
+	err = eachBsonDoc(source, func([]byte) error {
 		count++
 		return nil
 	})
@@ -193,6 +328,103 @@ func countBsonDocs(path string) (int, error) {
 	return count, nil
 }
 
+// countBsonFiles counts the documents in each of the dumped
+// collections at the same time, since they're independent.
+func countBsonFiles(paths ...string) ([]int, error) {
+	counts := make([]int, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			counts[i], errs[i] = countBsonDocs(path)
+		}(i, path)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, errors.Annotatef(err, "counting %s", filepath.Base(paths[i]))
+		}
+	}
+	return counts, nil
+}
+
+// readDumpOplog returns the number of entries in a dumped oplog and
+// the positions of the first and last. It's not Present if the file
+// doesn't exist.
+func readDumpOplog(path string) (core.DumpOplog, error) {
+	source, err := openBsonFile(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return core.DumpOplog{}, nil
+	}
+	if err != nil {
+		return core.DumpOplog{}, errors.Trace(err)
+	}
+	defer source.Close()
+
+	result := core.DumpOplog{Present: true}
+	err = eachBsonDoc(source, func(data []byte) error {
+		var entry struct {
+			Timestamp bson.MongoTimestamp `bson:"ts"`
+		}
+		if err := bson.Unmarshal(data, &entry); err != nil {
+			return errors.Annotate(err, "reading oplog entry")
+		}
+		if result.Entries == 0 {
+			result.First = core.OplogPosition(entry.Timestamp)
+		}
+		result.Last = core.OplogPosition(entry.Timestamp)
+		result.Entries++
+		return nil
+	})
+	if err != nil {
+		return core.DumpOplog{}, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// dumpSizes returns the size of each database's files in the dump
+// under dir, in name order. Each database is a directory holding a
+// .bson file and .metadata.json file for each collection.
+func dumpSizes(dir string) ([]core.DatabaseSize, error) {
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result []core.DatabaseSize
+	for _, item := range items {
+		if !item.IsDir() {
+			// The oplog is dumped alongside the databases.
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, item.Name()))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		database := core.DatabaseSize{
+			Name:        item.Name(),
+			Collections: make(map[string]int64),
+		}
+		for _, file := range files {
+			name := file.Name()
+			collection, isBson := collectionFileName(name)
+			switch {
+			case isBson:
+				name = collection
+			case strings.HasSuffix(name, ".metadata.json"):
+				name = strings.TrimSuffix(name, ".metadata.json")
+			default:
+				continue
+			}
+			database.Collections[name] += file.Size()
+			database.Bytes += file.Size()
+		}
+		result = append(result, database)
+	}
+	return result, nil
+}
+
 const jobManageModel = 2
 
 func countHANodes(directory, modelUUID string) (int, error) {
@@ -206,7 +438,7 @@ func countHANodes(directory, modelUUID string) (int, error) {
 
 	// Fall back to counting machines in the right model with the
 	// right job.
-	source, err := os.Open(filepath.Join(directory, machinesFile))
+	source, err := openBsonFile(filepath.Join(directory, machinesFile))
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
@@ -0,0 +1,99 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+	"github.com/juju/version/v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// Models returns the backup's hosted models, sorted by name, the same
+// way they're read from a live database: the models collection gives
+// each one's cloud and credential, the model's settings its agent
+// version, and the clouds collection the cloud's type. Part of
+// core.BackupFile.
+func (b *expandedBackup) Models() ([]core.ModelSummary, error) {
+	var models []core.ModelSummary
+	settingsIDs := make(map[string]int)
+	err := readBsonFile(filepath.Join(b.dir, modelsFile), func(data []byte) error {
+		var doc struct {
+			ID              string `bson:"_id"`
+			Name            string `bson:"name"`
+			Owner           string `bson:"owner"`
+			Cloud           string `bson:"cloud"`
+			CloudCredential string `bson:"cloud-credential"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		if doc.Name == "controller" {
+			return nil
+		}
+		settingsIDs[doc.ID+":e"] = len(models)
+		models = append(models, core.ModelSummary{
+			Name:       doc.Owner + "/" + doc.Name,
+			Cloud:      doc.Cloud,
+			Credential: strings.Replace(doc.CloudCredential, "/", "#", -1),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "reading models")
+	}
+
+	err = readBsonFile(filepath.Join(b.dir, settingsFile), func(data []byte) error {
+		var doc struct {
+			ID       string                 `bson:"_id"`
+			Settings map[string]interface{} `bson:"settings"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		i, ok := settingsIDs[doc.ID]
+		if !ok {
+			return nil
+		}
+		// A version that can't be read is left for the checks to skip.
+		if versionStr, ok := doc.Settings["agent-version"].(string); ok {
+			models[i].AgentVersion, _ = version.Parse(versionStr)
+		}
+		return nil
+	})
+	// Without settings every agent version is left unknown.
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Annotate(err, "reading settings")
+	}
+
+	cloudTypes := make(map[string]string)
+	err = readBsonFile(filepath.Join(b.dir, cloudsFile), func(data []byte) error {
+		var doc struct {
+			ID   string `bson:"_id"`
+			Type string `bson:"type"`
+		}
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		cloudTypes[doc.ID] = doc.Type
+		return nil
+	})
+	// Likewise the cloud types, without clouds.
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Annotate(err, "reading clouds")
+	}
+	for i := range models {
+		models[i].CloudType = cloudTypes[models[i].Cloud]
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+	return models, nil
+}
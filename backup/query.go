@@ -0,0 +1,201 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+)
+
+// Filter selects documents by their fields. A document matches if it
+// matches every term.
+type Filter []filterTerm
+
+// filterTerm tests the values found at a dotted field path.
+type filterTerm struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// The operators a filter term can use, checked in this order so that
+// != isn't read as =.
+var filterOps = []string{"!=", "=", "~"}
+
+// ParseFilter reads filter terms, each one of:
+//
+//	field=value   the field has the value
+//	field!=value  the field doesn't have the value (or is missing)
+//	field~regexp  the field has a value matching the regular expression
+//	field         the field is present
+//
+// Fields are dotted paths into nested documents, and a term matches
+// a field holding an array if it matches any of its elements, as in
+// mongo queries. Values are compared as text: numbers and booleans as
+// they're written, object IDs in hex and times in RFC3339.
+func ParseFilter(terms []string) (Filter, error) {
+	var filter Filter
+	for _, term := range terms {
+		parsed := filterTerm{field: term}
+		for _, op := range filterOps {
+			if i := strings.Index(term, op); i >= 0 {
+				parsed = filterTerm{field: term[:i], op: op, value: term[i+len(op):]}
+				break
+			}
+		}
+		if parsed.field == "" {
+			return nil, errors.Errorf("invalid filter %q (expected field=value, field!=value, field~regexp or field)", term)
+		}
+		if parsed.op == "~" {
+			re, err := regexp.Compile(parsed.value)
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid filter %q", term)
+			}
+			parsed.re = re
+		}
+		filter = append(filter, parsed)
+	}
+	return filter, nil
+}
+
+// Matches returns whether the document matches all of the filter's
+// terms.
+func (f Filter) Matches(doc bson.D) bool {
+	for _, term := range f {
+		if !term.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t filterTerm) matches(doc bson.D) bool {
+	values := fieldValues(doc, strings.Split(t.field, "."))
+	switch t.op {
+	case "":
+		return len(values) > 0
+	case "!=":
+		for _, value := range values {
+			if filterText(value) == t.value {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range values {
+		text := filterText(value)
+		if t.op == "=" && text == t.value || t.op == "~" && t.re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValues returns the values at the path in the document,
+// looking in each element of any arrays on the way.
+func fieldValues(value interface{}, path []string) []interface{} {
+	if elems, ok := value.([]interface{}); ok {
+		var values []interface{}
+		for _, elem := range elems {
+			values = append(values, fieldValues(elem, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+	doc, ok := value.(bson.D)
+	if !ok {
+		return nil
+	}
+	i := indexOf(doc, path[0])
+	if i < 0 {
+		return nil
+	}
+	return fieldValues(doc[i].Value, path[1:])
+}
+
+// filterText is the text a filter compares a value with.
+func filterText(value interface{}) string {
+	value = exportValue(value)
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	case bool, int, int64, float64:
+		return fmt.Sprint(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// errQueryLimit stops reading a collection once enough documents
+// have matched.
+var errQueryLimit = errors.New("query limit reached")
+
+// Query unpacks the backup file under tempRoot and writes the
+// documents in the collection that match the filter to output as
+// JSON, a document per line, stopping after limit matches if it's
+// more than 0. The collection is in the juju database unless it's
+// given as <database>.<collection>. It returns the number of
+// documents written.
+func Query(path, tempRoot, collection string, filter Filter, limit int, output io.Writer) (int, error) {
+	opened, err := open(path, tempRoot, nil)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer func() {
+		if err := opened.Close(); err != nil {
+			logger.Errorf("couldn't remove unpacked backup: %s", err)
+		}
+	}()
+	ns := collection
+	if !strings.Contains(ns, ".") {
+		ns = "juju." + ns
+	}
+	source, err := openBsonFile(namespacePath(opened.DumpDirectory(), ns, ".bson"))
+	if os.IsNotExist(errors.Cause(err)) {
+		return 0, errors.Errorf("collection %q isn't in the backup", ns)
+	}
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer source.Close()
+
+	matched := 0
+	encoder := json.NewEncoder(output)
+	err = eachBsonDoc(source, func(data []byte) error {
+		var doc bson.D
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		if !filter.Matches(doc) {
+			return nil
+		}
+		if err := encoder.Encode(exportDoc(doc)); err != nil {
+			return errors.Trace(err)
+		}
+		matched++
+		if limit > 0 && matched >= limit {
+			return errQueryLimit
+		}
+		return nil
+	})
+	if errors.Cause(err) == errQueryLimit {
+		err = nil
+	}
+	return matched, errors.Annotatef(err, "reading %s", ns)
+}
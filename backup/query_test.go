@@ -0,0 +1,163 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/mgo/v2/bson"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+func (s *backupSuite) TestFilterMatches(c *gc.C) {
+	machine := doc(
+		"_id", "uuid:0",
+		"machineid", "0",
+		"life", 0,
+		"series", "focal",
+		"jobs", []interface{}{1, 2},
+		"addresses", []interface{}{
+			doc("value", "10.0.0.1", "scope", "local-cloud"),
+			doc("value", "1.2.3.4", "scope", "public"),
+		},
+		"instance", doc("id", "i-0abc", "hasvote", true),
+	)
+	for i, test := range []struct {
+		terms   []string
+		matches bool
+	}{
+		{nil, true},
+		{[]string{"machineid=0"}, true},
+		{[]string{"machineid=1"}, false},
+		{[]string{"life=0", "series=focal"}, true},
+		{[]string{"life=0", "series=bionic"}, false},
+		{[]string{"series!=bionic"}, true},
+		{[]string{"series!=focal"}, false},
+		{[]string{"missing!=anything"}, true},
+		{[]string{"series~^fo"}, true},
+		{[]string{"series~^bi"}, false},
+		{[]string{"jobs=2"}, true},
+		{[]string{"jobs=3"}, false},
+		{[]string{"addresses.scope=public"}, true},
+		{[]string{"addresses.value~^10\\."}, true},
+		{[]string{"instance.hasvote=true"}, true},
+		{[]string{"instance.id"}, true},
+		{[]string{"instance.status"}, false},
+	} {
+		c.Logf("%d: %v", i, test.terms)
+		filter, err := backup.ParseFilter(test.terms)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(filter.Matches(machine), gc.Equals, test.matches)
+	}
+}
+
+func (s *backupSuite) TestParseFilterErrors(c *gc.C) {
+	_, err := backup.ParseFilter([]string{"=focal"})
+	c.Assert(err, gc.ErrorMatches, `invalid filter "=focal" \(expected field=value, field!=value, field~regexp or field\)`)
+	_, err = backup.ParseFilter([]string{"series~(focal"})
+	c.Assert(err, gc.ErrorMatches, `invalid filter "series~\(focal": error parsing regexp: .*`)
+}
+
+func (s *backupSuite) createQueryBackup(c *gc.C) string {
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), bson.M{"_id": "how-bizarre-uuid", "name": "controller"})
+	writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+	writeDocs(c, filepath.Join(dumpDir, "juju/machines.bson"),
+		doc("_id", "uuid:0", "machineid", "0", "series", "focal"),
+		doc("_id", "uuid:1", "machineid", "1", "series", "bionic"),
+		doc("_id", "uuid:2", "machineid", "2", "series", "focal"),
+	)
+	writeDocs(c, filepath.Join(dumpDir, "logs/logs.how-bizarre-uuid.bson"),
+		doc("_id", bson.ObjectIdHex("5e70f9b8b8e1f1a2c3d4e5f6"), "x", "agent started"),
+	)
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.MkDir(),
+		MachineID: "0",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			BackupCreated:       time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC),
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return path
+}
+
+func (s *backupSuite) TestQuery(c *gc.C) {
+	path := s.createQueryBackup(c)
+	filter, err := backup.ParseFilter([]string{"series=focal"})
+	c.Assert(err, jc.ErrorIsNil)
+	var out bytes.Buffer
+	matched, err := backup.Query(path, s.dir, "machines", filter, 0, &out)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(matched, gc.Equals, 2)
+	c.Assert(out.String(), gc.Equals, `
+{"_id":"uuid:0","machineid":"0","series":"focal"}
+{"_id":"uuid:2","machineid":"2","series":"focal"}
+`[1:])
+}
+
+func (s *backupSuite) TestQueryLimit(c *gc.C) {
+	path := s.createQueryBackup(c)
+	var out bytes.Buffer
+	matched, err := backup.Query(path, s.dir, "machines", nil, 1, &out)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(matched, gc.Equals, 1)
+	c.Assert(out.String(), gc.Equals, `{"_id":"uuid:0","machineid":"0","series":"focal"}`+"\n")
+}
+
+func (s *backupSuite) TestQueryOtherDatabase(c *gc.C) {
+	path := s.createQueryBackup(c)
+	filter, err := backup.ParseFilter([]string{"_id=5e70f9b8b8e1f1a2c3d4e5f6"})
+	c.Assert(err, jc.ErrorIsNil)
+	var out bytes.Buffer
+	matched, err := backup.Query(path, s.dir, "logs.logs.how-bizarre-uuid", filter, 0, &out)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(matched, gc.Equals, 1)
+	c.Assert(out.String(), gc.Equals, `{"_id":"5e70f9b8b8e1f1a2c3d4e5f6","x":"agent started"}`+"\n")
+}
+
+func (s *backupSuite) TestQueryCompressed(c *gc.C) {
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), bson.M{"_id": "how-bizarre-uuid", "name": "controller"})
+	writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+	writeDocs(c, filepath.Join(dumpDir, "juju/machines.bson"),
+		doc("_id", "uuid:0", "series", "focal"),
+		doc("_id", "uuid:1", "series", "bionic"),
+	)
+	compressTestFile(c, filepath.Join(dumpDir, "juju/machines.bson"))
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.MkDir(),
+		MachineID: "0",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	filter, err := backup.ParseFilter([]string{"series=bionic"})
+	c.Assert(err, jc.ErrorIsNil)
+	var out bytes.Buffer
+	matched, err := backup.Query(path, s.dir, "machines", filter, 0, &out)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(matched, gc.Equals, 1)
+	c.Assert(out.String(), gc.Equals, `{"_id":"uuid:1","series":"bionic"}`+"\n")
+}
+
+func (s *backupSuite) TestQueryMissingCollection(c *gc.C) {
+	path := s.createQueryBackup(c)
+	_, err := backup.Query(path, s.dir, "units", nil, 0, &bytes.Buffer{})
+	c.Assert(err, gc.ErrorMatches, `collection "juju.units" isn't in the backup`)
+}
@@ -0,0 +1,383 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// rootDir is where the files from root.tar are unpacked in a salvaged
+// backup, so they can be packed up again.
+const rootDir = "root"
+
+// requiredCollections are needed to restore a full backup, so they're
+// reported as lost even if nothing in the archive mentions them.
+var requiredCollections = []string{"juju.models", "juju.clouds"}
+
+// SalvagedBackup holds what could be recovered from a truncated or
+// corrupt backup file.
+type SalvagedBackup interface {
+	// Report describes what was recovered and what was lost.
+	Report() SalvageReport
+
+	// Write writes a backup file holding the recovered collections
+	// and files to output. If metadataPath isn't empty that file is
+	// used as the backup's metadata. Otherwise the backup's own is
+	// kept, or if it was lost the metadata is inferred from the dump
+	// when the written backup is opened.
+	Write(output, metadataPath string) error
+
+	// Close removes the recovered files.
+	Close() error
+}
+
+// SalvageReport describes the contents of a SalvagedBackup.
+type SalvageReport struct {
+	// ArchiveError is why reading the archive stopped before the end,
+	// or empty if the whole archive could be read.
+	ArchiveError string
+
+	// Recovered lists the collections (as db.collection) whose dumps
+	// are intact.
+	Recovered []string
+
+	// Lost lists the collections and files that were cut off,
+	// damaged or missing.
+	Lost []LostItem
+
+	// MetadataLost is true if the backup's metadata.json couldn't be
+	// recovered.
+	MetadataLost bool
+}
+
+// Intact returns whether nothing was lost from the backup.
+func (r SalvageReport) Intact() bool {
+	return r.ArchiveError == "" && len(r.Lost) == 0
+}
+
+// LostItem is a collection or file that couldn't be recovered.
+type LostItem struct {
+	Name   string
+	Reason string
+}
+
+// Salvage unpacks as much of a backup file as it can under tempRoot,
+// keeping every file that was read completely and every collection
+// dump whose documents can all be parsed. Unlike Open it doesn't stop
+// at the first problem - what was lost is listed in the returned
+// backup's report. It only fails if nothing at all can be read.
+func Salvage(path, tempRoot string) (_ SalvagedBackup, err error) {
+	destDir, err := ioutil.TempDir(tempRoot, tempDirPrefix)
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating temp directory in %q", tempRoot)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if removeErr := os.RemoveAll(destDir); removeErr != nil {
+			logger.Errorf("couldn't remove temp dir %q: %s", destDir, removeErr)
+		}
+	}()
+
+	source, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer source.Close()
+	gzReader, err := gzip.NewReader(source)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading compressed backup")
+	}
+	defer gzReader.Close()
+
+	salvaged := &salvagedBackup{dir: destDir, lost: make(map[string]string)}
+	cutOff, err := salvageTar(gzReader, destDir)
+	if err != nil {
+		salvaged.report.ArchiveError = err.Error()
+		if cutOff != "" {
+			salvaged.report.ArchiveError += " in " + cutOff
+		}
+		logger.Warningf("backup archive damaged: %s", salvaged.report.ArchiveError)
+	}
+
+	extractedDir := filepath.Join(destDir, topLevelDir)
+	if err := salvaged.salvageRootTar(filepath.Join(extractedDir, rootTarFile), cutOff == filepath.Join(topLevelDir, rootTarFile)); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, metadataFile)); os.IsNotExist(err) {
+		salvaged.report.MetadataLost = true
+		salvaged.lose("metadata.json", reasonFor(cutOff == metadataFile))
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := salvaged.salvageDump(filepath.Join(destDir, dumpDir), cutOff); err != nil {
+		return nil, errors.Trace(err)
+	}
+	salvaged.finishReport()
+	return salvaged, nil
+}
+
+type salvagedBackup struct {
+	dir    string
+	report SalvageReport
+	lost   map[string]string
+}
+
+// Report is part of SalvagedBackup.
+func (b *salvagedBackup) Report() SalvageReport {
+	return b.report
+}
+
+// Write is part of SalvagedBackup.
+func (b *salvagedBackup) Write(output, metadataPath string) (err error) {
+	target, err := createTarget(output)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err != nil {
+			target.Close()
+			_ = os.Remove(output)
+		}
+	}()
+
+	backupDir := filepath.Join(b.dir, topLevelDir)
+	if err := os.MkdirAll(filepath.Join(backupDir, "dump"), 0700); err != nil {
+		return errors.Trace(err)
+	}
+	if metadataPath != "" {
+		if err := copyFile(metadataPath, filepath.Join(b.dir, metadataFile), 0600); err != nil {
+			return errors.Annotate(err, "copying metadata")
+		}
+	}
+	unpackedRoot := filepath.Join(b.dir, rootDir)
+	items, err := ioutil.ReadDir(unpackedRoot)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var files []string
+	for _, item := range items {
+		files = append(files, filepath.Join(unpackedRoot, item.Name()))
+	}
+	if err := writeTar(filepath.Join(backupDir, rootTarFile), files, unpackedRoot+string(filepath.Separator)); err != nil {
+		return errors.Annotate(err, "writing root.tar")
+	}
+
+	if err := writeArchive(target, b.dir); err != nil {
+		return errors.Annotatef(err, "writing %q", output)
+	}
+	return errors.Trace(target.Close())
+}
+
+// Close is part of SalvagedBackup.
+func (b *salvagedBackup) Close() error {
+	return errors.Trace(os.RemoveAll(b.dir))
+}
+
+func (b *salvagedBackup) lose(name, reason string) {
+	if _, ok := b.lost[name]; !ok {
+		b.lost[name] = reason
+	}
+}
+
+func reasonFor(cutOff bool) string {
+	if cutOff {
+		return "cut off"
+	}
+	return "missing"
+}
+
+// salvageRootTar unpacks as many of the controller's files from
+// root.tar as it can.
+func (b *salvagedBackup) salvageRootTar(path string, cutOff bool) error {
+	unpackedRoot := filepath.Join(b.dir, rootDir)
+	if err := os.Mkdir(unpackedRoot, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	source, err := os.Open(path)
+	if os.IsNotExist(err) {
+		b.lose(rootTarFile, reasonFor(cutOff))
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	defer source.Close()
+	damaged, err := salvageTar(source, unpackedRoot)
+	if err != nil {
+		reason := "damaged: " + err.Error()
+		if damaged != "" {
+			reason += " in " + damaged
+		}
+		b.lose(rootTarFile, reason)
+	}
+	return errors.Trace(os.Remove(path))
+}
+
+// salvageDump checks each collection dump, removing the ones that
+// can't be parsed so they aren't restored.
+func (b *salvagedBackup) salvageDump(dir, cutOff string) error {
+	if name := strings.TrimPrefix(cutOff, dumpDir+"/"); name != cutOff {
+		if ns, ok := dumpNamespace(name); ok {
+			b.lose(ns, "cut off")
+		}
+	}
+	// seen maps each collection in the dump to the path of its
+	// documents.
+	seen := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ns, ok := dumpNamespace(relPath)
+		if info.IsDir() || !ok {
+			return nil
+		}
+		if filepath.Ext(path) != ".bson" {
+			seen[ns] = strings.TrimSuffix(path, ".metadata.json") + ".bson"
+			return nil
+		}
+		seen[ns] = path
+		if _, err := verifyBsonFile(path); err != nil {
+			b.lose(ns, "damaged: "+err.Error())
+			return nil
+		}
+		b.report.Recovered = append(b.report.Recovered, ns)
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	recovered := make(map[string]bool)
+	for _, ns := range b.report.Recovered {
+		recovered[ns] = true
+	}
+	// Damaged collections are removed so they aren't restored. A
+	// collection whose metadata was unpacked but not its documents
+	// was lost after the metadata.
+	for ns, path := range seen {
+		if !recovered[ns] {
+			b.lose(ns, "missing")
+			if err := removeDump(path); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	if !recovered["oplog"] || len(b.report.Recovered) > 1 {
+		// Not an incremental backup.
+		for _, ns := range requiredCollections {
+			if !recovered[ns] {
+				b.lose(ns, "missing")
+			}
+		}
+	}
+	return nil
+}
+
+func (b *salvagedBackup) finishReport() {
+	sort.Strings(b.report.Recovered)
+	for name, reason := range b.lost {
+		b.report.Lost = append(b.report.Lost, LostItem{Name: name, Reason: reason})
+	}
+	sort.Slice(b.report.Lost, func(i, j int) bool {
+		return b.report.Lost[i].Name < b.report.Lost[j].Name
+	})
+}
+
+// dumpNamespace returns the db.collection name for a file in a
+// database dump, or false if it isn't a collection's file.
+func dumpNamespace(relPath string) (string, bool) {
+	name := filepath.ToSlash(relPath)
+	switch {
+	case strings.HasSuffix(name, ".bson"):
+		name = strings.TrimSuffix(name, ".bson")
+	case strings.HasSuffix(name, ".metadata.json"):
+		name = strings.TrimSuffix(name, ".metadata.json")
+	default:
+		return "", false
+	}
+	return strings.Replace(name, "/", ".", 1), true
+}
+
+// removeDump removes the dump of a collection and its metadata, given
+// the path of its .bson file.
+func removeDump(path string) error {
+	for _, name := range []string{path, strings.TrimSuffix(path, ".bson") + ".metadata.json"} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// salvageTar unpacks the files in source under dest until it reaches
+// the end or a read fails. A file that can't be read completely is
+// removed, and its name returned with the error.
+func salvageTar(source io.Reader, dest string) (string, error) {
+	reader := tar.NewReader(source)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		path := filepath.Join(dest, header.Name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0700)
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+				err = os.Symlink(header.Linkname, path)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				break
+			}
+			if err = salvageFile(reader, path, os.FileMode(header.Mode).Perm()); err != nil {
+				return filepath.Clean(header.Name), errors.Trace(err)
+			}
+		default:
+			logger.Debugf("skipping %q - unsupported type %q", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return "", errors.Annotatef(err, "unpacking %q", header.Name)
+		}
+	}
+}
+
+// salvageFile writes the file being read from reader to path,
+// removing it if it can't be read completely.
+func salvageFile(reader io.Reader, path string, perm os.FileMode) error {
+	target, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = io.Copy(target, reader)
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return errors.Trace(err)
+	}
+	return nil
+}
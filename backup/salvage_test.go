@@ -0,0 +1,127 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+)
+
+// truncateBackup copies the backup at path, stopping halfway through
+// the named file as if the copy had been cut off.
+func truncateBackup(c *gc.C, path, name string) string {
+	source, err := os.Open(path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer source.Close()
+	gzReader, err := gzip.NewReader(source)
+	c.Assert(err, jc.ErrorIsNil)
+	reader := tar.NewReader(gzReader)
+
+	truncated := filepath.Join(c.MkDir(), "truncated.tar.gz")
+	target, err := os.Create(truncated)
+	c.Assert(err, jc.ErrorIsNil)
+	defer target.Close()
+	gzWriter := gzip.NewWriter(target)
+	defer gzWriter.Close()
+	writer := tar.NewWriter(gzWriter)
+	for {
+		header, err := reader.Next()
+		c.Assert(err, jc.ErrorIsNil, gc.Commentf("%s not found", name))
+		c.Assert(writer.WriteHeader(header), jc.ErrorIsNil)
+		if header.Name == name {
+			// Don't close the tar writer - there's no end marker.
+			_, err := io.CopyN(writer, reader, header.Size/2)
+			c.Assert(err, jc.ErrorIsNil)
+			c.Assert(writer.Flush(), gc.NotNil)
+			return truncated
+		}
+		_, err = io.Copy(writer, reader)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+}
+
+func (s *backupSuite) TestSalvageIntact(c *gc.C) {
+	salvaged, err := backup.Salvage(filepath.Join("testdata", "valid-backup.tar.gz"), s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer salvaged.Close()
+	report := salvaged.Report()
+	c.Assert(report.Intact(), jc.IsTrue, gc.Commentf("%#v", report))
+	c.Assert(report.Recovered, jc.DeepEquals, []string{"juju.clouds", "juju.machines", "juju.models"})
+}
+
+func (s *backupSuite) TestSalvageTruncated(c *gc.C) {
+	path := truncateBackup(c, filepath.Join("testdata", "valid-backup.tar.gz"), "juju-backup/dump/juju/machines.bson")
+	_, err := backup.Open(path, s.dir)
+	c.Assert(err, gc.ErrorMatches, "extracting backup .*")
+
+	salvaged, err := backup.Salvage(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer salvaged.Close()
+	report := salvaged.Report()
+	c.Assert(report.ArchiveError, gc.Equals, "unexpected EOF in juju-backup/dump/juju/machines.bson")
+	c.Assert(report.Recovered, jc.DeepEquals, []string{"juju.models"})
+	c.Assert(report.Lost, jc.DeepEquals, []backup.LostItem{
+		{Name: "juju.clouds", Reason: "missing"},
+		{Name: "juju.machines", Reason: "cut off"},
+		{Name: "metadata.json", Reason: "missing"},
+		{Name: "root.tar", Reason: "missing"},
+	})
+	c.Assert(report.MetadataLost, jc.IsTrue)
+
+	// The metadata is inferred when the repaired backup is opened.
+	output := filepath.Join(c.MkDir(), "repaired.tar.gz")
+	err = salvaged.Write(output, "")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(output, jc.IsNonEmptyFile)
+}
+
+func (s *backupSuite) TestSalvageDamagedCollection(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), doc("_id", "how-bizarre-uuid"))
+		writeDocs(c, filepath.Join(dumpDir, "juju/clouds.bson"), doc("_id", "lxd"))
+		writeTestFile(c, filepath.Join(dumpDir, "juju/machines.metadata.json"), "{}")
+		writeTestFile(c, filepath.Join(dumpDir, "juju/machines.bson"), "\x40\x00\x00\x00\x0a")
+	}, "")
+
+	salvaged, err := backup.Salvage(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer salvaged.Close()
+	report := salvaged.Report()
+	c.Assert(report.ArchiveError, gc.Equals, "")
+	c.Assert(report.Recovered, jc.DeepEquals, []string{"juju.clouds", "juju.models"})
+	c.Assert(report.Lost, gc.HasLen, 1)
+	c.Assert(report.Lost[0].Name, gc.Equals, "juju.machines")
+	c.Assert(report.Lost[0].Reason, gc.Matches, "damaged: .*EOF")
+
+	output := filepath.Join(c.MkDir(), "repaired.tar.gz")
+	err = salvaged.Write(output, "")
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The repaired backup can be opened and doesn't have the damaged
+	// collection.
+	opened, err := backup.Open(output, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	metadata, err := opened.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ControllerModelUUID, gc.Equals, "how-bizarre-uuid")
+	c.Assert(metadata.ModelCount, gc.Equals, 1)
+	c.Assert(filepath.Join(opened.DumpDirectory(), "juju/machines.bson"), jc.DoesNotExist)
+	c.Assert(filepath.Join(opened.DumpDirectory(), "juju/machines.metadata.json"), jc.DoesNotExist)
+}
+
+func (s *backupSuite) TestSalvageNotGzip(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	writeTestFile(c, path, "not a backup")
+	_, err := backup.Salvage(path, s.dir)
+	c.Assert(err, gc.ErrorMatches, "reading compressed backup: .*")
+}
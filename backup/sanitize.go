@@ -0,0 +1,398 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+)
+
+// sanitizeRule identifies a field holding secrets.
+type sanitizeRule struct {
+	// field is the dotted path of the field.
+	field string
+
+	// children, if set, means only the values of the field's
+	// children with matching names are replaced, rather than the
+	// whole field.
+	children *regexp.Regexp
+}
+
+var (
+	allChildren       = regexp.MustCompile(`.`)
+	sensitiveSettings = regexp.MustCompile(`(?i)secret|password|token|private|key`)
+)
+
+// sanitizeRules lists the fields holding secrets in each collection,
+// keyed by namespace (<database>.<collection>).
+var sanitizeRules = map[string][]sanitizeRule{
+	"juju.users":            {{field: "passwordhash"}, {field: "passwordsalt"}},
+	"juju.machines":         {{field: "passwordhash"}, {field: "nonce"}},
+	"juju.units":            {{field: "passwordhash"}},
+	"juju.applications":     {{field: "passwordhash"}},
+	"juju.cloudCredentials": {{field: "attributes", children: allChildren}},
+	"juju.controllers": {
+		{field: "privatekey"},
+		{field: "caprivatekey"},
+		{field: "sharedsecret"},
+		{field: "systemidentity"},
+	},
+	"juju.bakeryConfig": {
+		{field: "local-users-private-key"},
+		{field: "local-users-third-party-private-key"},
+		{field: "external-users-third-party-private-key"},
+		{field: "offers-third-party-private-key"},
+	},
+	"juju.secretRevisions": {{field: "data", children: allChildren}},
+	"juju.secretBackends":  {{field: "config", children: allChildren}},
+	"juju.settings":        {{field: "settings", children: sensitiveSettings}},
+}
+
+// removedCollections are left out of sanitized backups entirely - the
+// database users' credentials can't be replaced and still restore.
+var removedCollections = []string{"admin.system.users"}
+
+// Sanitize writes a copy of the backup file at path to output with
+// the secrets it holds replaced: password hashes, credentials,
+// private keys and secret values in the dump and its oplog are
+// replaced by keyed hashes (so values that were the same still match,
+// but can't be recovered), the database users and the controller's
+// files are left out, and the CA private key is removed from the
+// metadata. It returns the number of values replaced.
+func Sanitize(path, output, tempRoot string) (_ int, err error) {
+	target, err := createTarget(output)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer func() {
+		if err != nil {
+			target.Close()
+			_ = os.Remove(output)
+		}
+	}()
+
+	opened, err := open(path, tempRoot, nil)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer func() {
+		if err := opened.Close(); err != nil {
+			logger.Errorf("couldn't remove unpacked backup: %s", err)
+		}
+	}()
+
+	stageDir, err := ioutil.TempDir(filepath.Dir(output), ".juju-backup")
+	if err != nil {
+		return 0, errors.Annotate(err, "creating staging directory")
+	}
+	defer func() {
+		if removeErr := os.RemoveAll(stageDir); removeErr != nil {
+			logger.Errorf("couldn't remove staging dir %q: %s", stageDir, removeErr)
+		}
+	}()
+	backupDir := filepath.Join(stageDir, topLevelDir)
+	if err := os.Mkdir(backupDir, 0700); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	s, err := newSanitizer()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if err := sanitizeMetadataJSON(filepath.Join(opened.dir, metadataFile), filepath.Join(stageDir, metadataFile)); err != nil {
+		return 0, errors.Annotate(err, "sanitizing metadata")
+	}
+	if err := writeTar(filepath.Join(backupDir, rootTarFile), nil, ""); err != nil {
+		return 0, errors.Annotate(err, "writing root.tar")
+	}
+	if err := s.sanitizeDump(opened.DumpDirectory()); err != nil {
+		return 0, errors.Annotate(err, "sanitizing dump")
+	}
+	if err := moveDir(opened.DumpDirectory(), filepath.Join(stageDir, dumpDir)); err != nil {
+		return 0, errors.Annotate(err, "adding database dump")
+	}
+
+	if err := writeArchive(target, stageDir); err != nil {
+		return 0, errors.Annotatef(err, "writing %q", output)
+	}
+	return s.count, errors.Trace(target.Close())
+}
+
+// sanitizeMetadataJSON copies the metadata, removing the CA private
+// key. It's copied as generic JSON so fields this package doesn't
+// know about are kept.
+func sanitizeMetadataJSON(src, dest string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Oplog positions don't fit in a float64.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var metadata map[string]interface{}
+	if err := decoder.Decode(&metadata); err != nil {
+		return errors.Trace(err)
+	}
+	if _, ok := metadata["CAPrivateKey"]; ok {
+		metadata["CAPrivateKey"] = ""
+	}
+	data, err = json.Marshal(metadata)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(dest, data, 0600))
+}
+
+// sanitizer replaces secret values with hashes keyed by a random key,
+// counting the replacements.
+type sanitizer struct {
+	key   []byte
+	count int
+}
+
+func newSanitizer() (*sanitizer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Annotate(err, "generating hash key")
+	}
+	return &sanitizer{key: key}, nil
+}
+
+// sanitizeDump rewrites the collections with secrets in the dump
+// directory in place, along with the oplog and the transaction log,
+// which hold copies of the documents.
+func (s *sanitizer) sanitizeDump(dir string) error {
+	for _, ns := range removedCollections {
+		for _, suffix := range []string{".bson", ".metadata.json"} {
+			if err := os.Remove(namespacePath(dir, ns, suffix)); err != nil && !os.IsNotExist(err) {
+				return errors.Trace(err)
+			}
+		}
+	}
+	for ns, rules := range sanitizeRules {
+		rules := rules
+		err := rewriteBsonFile(namespacePath(dir, ns, ".bson"), func(doc bson.D) bson.D {
+			s.sanitizeFields(doc, rules)
+			return doc
+		})
+		if err != nil {
+			return errors.Annotatef(err, "sanitizing %s", ns)
+		}
+	}
+	if err := rewriteBsonFile(filepath.Join(dir, "juju", "txns.bson"), s.sanitizeTxn); err != nil {
+		return errors.Annotate(err, "sanitizing transactions")
+	}
+	return errors.Annotate(rewriteBsonFile(filepath.Join(dir, "oplog.bson"), s.sanitizeOplogEntry), "sanitizing oplog")
+}
+
+func namespacePath(dir, ns, suffix string) string {
+	parts := strings.SplitN(ns, ".", 2)
+	return filepath.Join(dir, parts[0], parts[1]+suffix)
+}
+
+// rewriteBsonFile replaces each document in the file at path with the
+// result of calling rewrite on it, dropping it if that's nil. It does
+// nothing if the file doesn't exist.
+func rewriteBsonFile(path string, rewrite func(bson.D) bson.D) error {
+	source, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer source.Close()
+	target, err := os.Create(path + ".sanitized")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = eachBsonDoc(source, func(data []byte) error {
+		var doc bson.D
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return errors.Trace(err)
+		}
+		doc = rewrite(doc)
+		if doc == nil {
+			return nil
+		}
+		out, err := bson.Marshal(doc)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, err = target.Write(out)
+		return errors.Trace(err)
+	})
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(target.Name())
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(target.Name(), path))
+}
+
+// sanitizeOplogEntry sanitizes the document inserted or update
+// applied by an oplog entry, dropping entries for removed
+// collections.
+func (s *sanitizer) sanitizeOplogEntry(entry bson.D) bson.D {
+	ns, _ := lookup(entry, "ns").(string)
+	for _, removed := range removedCollections {
+		if ns == removed {
+			return nil
+		}
+	}
+	if o, ok := lookup(entry, "o").(bson.D); ok {
+		s.sanitizeChange(ns, o)
+	}
+	return entry
+}
+
+// sanitizeTxn sanitizes the documents inserted and updates applied by
+// the operations in a mgo/txn transaction.
+func (s *sanitizer) sanitizeTxn(txn bson.D) bson.D {
+	ops, _ := lookup(txn, "o").([]interface{})
+	for _, op := range ops {
+		op, ok := op.(bson.D)
+		if !ok {
+			continue
+		}
+		collection, _ := lookup(op, "c").(string)
+		for _, name := range []string{"i", "u"} {
+			if change, ok := lookup(op, name).(bson.D); ok {
+				s.sanitizeChange("juju."+collection, change)
+			}
+		}
+	}
+	return txn
+}
+
+// sanitizeChange sanitizes a document or update for the namespace
+// passed in.
+func (s *sanitizer) sanitizeChange(ns string, change bson.D) {
+	rules := sanitizeRules[ns]
+	if len(rules) == 0 {
+		return
+	}
+	s.sanitizeFields(change, rules)
+	set, ok := lookup(change, "$set").(bson.D)
+	if !ok {
+		return
+	}
+	s.sanitizeFields(set, rules)
+	// Updates can also set fields within a secret field by path.
+	for i, elem := range set {
+		for _, rule := range rules {
+			child := strings.TrimPrefix(elem.Name, rule.field+".")
+			if child == elem.Name {
+				continue
+			}
+			if rule.children == nil || rule.children.MatchString(child) {
+				set[i].Value = s.sanitizeValue(elem.Value)
+				break
+			}
+		}
+	}
+}
+
+// sanitizeFields replaces the values of the fields matching the rules
+// in the document.
+func (s *sanitizer) sanitizeFields(doc bson.D, rules []sanitizeRule) {
+	for _, rule := range rules {
+		parts := strings.Split(rule.field, ".")
+		current := doc
+		for i, part := range parts {
+			index := indexOf(current, part)
+			if index < 0 {
+				break
+			}
+			if i < len(parts)-1 {
+				next, ok := current[index].Value.(bson.D)
+				if !ok {
+					break
+				}
+				current = next
+				continue
+			}
+			if rule.children == nil {
+				current[index].Value = s.sanitizeValue(current[index].Value)
+				continue
+			}
+			if children, ok := current[index].Value.(bson.D); ok {
+				for j, child := range children {
+					if rule.children.MatchString(child.Name) {
+						children[j].Value = s.sanitizeValue(child.Value)
+					}
+				}
+			}
+		}
+	}
+}
+
+// sanitizeValue returns the value with any strings or binary data in
+// it replaced by keyed hashes, keeping the structure of documents and
+// arrays.
+func (s *sanitizer) sanitizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return v
+		}
+		s.count++
+		return "sanitized-" + hex.EncodeToString(s.hash([]byte(v)))[:16]
+	case []byte:
+		s.count++
+		return s.hash(v)
+	case bson.Binary:
+		s.count++
+		return bson.Binary{Kind: v.Kind, Data: s.hash(v.Data)}
+	case bson.D:
+		result := make(bson.D, len(v))
+		for i, elem := range v {
+			result[i] = bson.DocElem{Name: elem.Name, Value: s.sanitizeValue(elem.Value)}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			result[i] = s.sanitizeValue(elem)
+		}
+		return result
+	}
+	return value
+}
+
+func (s *sanitizer) hash(data []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func indexOf(doc bson.D, name string) int {
+	for i, elem := range doc {
+		if elem.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func lookup(doc bson.D, name string) interface{} {
+	if i := indexOf(doc, name); i >= 0 {
+		return doc[i].Value
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/mgo/v2/bson"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+func writeDocs(c *gc.C, path string, docs ...interface{}) {
+	var data []byte
+	for _, doc := range docs {
+		out, err := bson.Marshal(doc)
+		c.Assert(err, jc.ErrorIsNil)
+		data = append(data, out...)
+	}
+	writeTestFile(c, path, string(data))
+}
+
+// doc makes an ordered document from alternating names and values.
+func doc(pairs ...interface{}) bson.D {
+	var result bson.D
+	for i := 0; i < len(pairs); i += 2 {
+		result = append(result, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return result
+}
+
+func readDocs(c *gc.C, path string) []bson.M {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, jc.ErrorIsNil)
+	var docs []bson.M
+	for len(data) > 0 {
+		size := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		var doc bson.M
+		err := bson.Unmarshal(data[:size], &doc)
+		c.Assert(err, jc.ErrorIsNil)
+		docs = append(docs, doc)
+		data = data[size:]
+	}
+	return docs
+}
+
+func (s *backupSuite) TestSanitize(c *gc.C) {
+	root := c.MkDir()
+	writeTestFile(c, filepath.Join(root, "var/lib/juju/server.pem"), "private key")
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), bson.M{"_id": "how-bizarre-uuid", "name": "controller"})
+	writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+	writeDocs(c, filepath.Join(dumpDir, "juju/users.bson"),
+		doc("_id", "admin", "passwordhash", "hash", "passwordsalt", "salt"),
+		doc("_id", "bob", "passwordhash", "hash", "passwordsalt", ""),
+	)
+	writeDocs(c, filepath.Join(dumpDir, "juju/cloudCredentials.bson"),
+		doc("_id", "aws/admin/default", "auth-type", "access-key",
+			"attributes", doc("access-key", "AKIA", "secret-key", "shhh")),
+	)
+	writeDocs(c, filepath.Join(dumpDir, "juju/settings.bson"),
+		doc("_id", "e", "settings", doc("name", "controller", "vault-token", "s.123")),
+	)
+	writeDocs(c, filepath.Join(dumpDir, "juju/txns.bson"),
+		doc("_id", 1, "o", []interface{}{
+			doc("c", "users", "d", "carol", "i", doc("passwordhash", "hash")),
+			doc("c", "cloudCredentials", "d", "aws/admin/default",
+				"u", doc("$set", doc("attributes.secret-key", "shhh"))),
+		}),
+	)
+	writeDocs(c, filepath.Join(dumpDir, "admin/system.users.bson"), bson.M{"user": "machine-0"})
+	position := core.NewOplogPosition(time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC), 1)
+	writeDocs(c, filepath.Join(dumpDir, "oplog.bson"),
+		doc("ts", bson.MongoTimestamp(position), "op", "u", "ns", "juju.users",
+			"o", doc("$set", doc("passwordhash", "hash"))),
+		doc("ts", bson.MongoTimestamp(position+1), "op", "i", "ns", "admin.system.users",
+			"o", doc("user", "machine-1")),
+	)
+
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   root,
+		MachineID: "0",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			BackupCreated:       time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC),
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	output := filepath.Join(c.MkDir(), "sanitized.tar.gz")
+	count, err := backup.Sanitize(path, output, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(count, gc.Equals, 9)
+
+	opened, err := backup.Open(output, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	metadata, err := opened.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ID, gc.Equals, "20200317-162824.how-bizarre-uuid")
+	c.Assert(metadata.ModelCount, gc.Equals, 1)
+	c.Assert(metadata.OplogEnd, gc.Equals, position+1)
+	dump := opened.DumpDirectory()
+	c.Assert(filepath.Join(filepath.Dir(dump), "var/lib/juju/server.pem"), jc.DoesNotExist)
+	c.Assert(filepath.Join(dump, "admin/system.users.bson"), jc.DoesNotExist)
+
+	users := readDocs(c, filepath.Join(dump, "juju/users.bson"))
+	c.Assert(users, gc.HasLen, 2)
+	hash := users[0]["passwordhash"]
+	c.Assert(hash, gc.Matches, "sanitized-[0-9a-f]{16}")
+	c.Assert(users[0]["passwordsalt"], gc.Not(gc.Equals), "salt")
+	// The same values are replaced by the same hash, and empty values
+	// are left alone.
+	c.Assert(users[1]["passwordhash"], gc.Equals, hash)
+	c.Assert(users[1]["passwordsalt"], gc.Equals, "")
+
+	creds := readDocs(c, filepath.Join(dump, "juju/cloudCredentials.bson"))
+	c.Assert(creds[0]["auth-type"], gc.Equals, "access-key")
+	attributes := creds[0]["attributes"].(bson.M)
+	c.Assert(attributes["access-key"], gc.Matches, "sanitized-.*")
+	secretKey := attributes["secret-key"]
+	c.Assert(secretKey, gc.Matches, "sanitized-.*")
+
+	settings := readDocs(c, filepath.Join(dump, "juju/settings.bson"))
+	c.Assert(settings[0]["settings"], jc.DeepEquals, bson.M{
+		"name":        "controller",
+		"vault-token": settings[0]["settings"].(bson.M)["vault-token"],
+	})
+	c.Assert(settings[0]["settings"].(bson.M)["vault-token"], gc.Matches, "sanitized-.*")
+
+	txns := readDocs(c, filepath.Join(dump, "juju/txns.bson"))
+	ops := txns[0]["o"].([]interface{})
+	c.Assert(ops[0].(bson.M)["i"], jc.DeepEquals, bson.M{"passwordhash": hash})
+	c.Assert(ops[1].(bson.M)["u"], jc.DeepEquals, bson.M{"$set": bson.M{"attributes.secret-key": secretKey}})
+
+	oplog := readDocs(c, filepath.Join(dump, "oplog.bson"))
+	c.Assert(oplog, gc.HasLen, 1)
+	c.Assert(oplog[0]["o"], jc.DeepEquals, bson.M{"$set": bson.M{"passwordhash": hash}})
+}
+
+func (s *backupSuite) TestSanitizeExistingOutput(c *gc.C) {
+	output := filepath.Join(c.MkDir(), "sanitized.tar.gz")
+	writeTestFile(c, output, "precious")
+	_, err := backup.Sanitize(filepath.Join("testdata", "valid-backup.tar.gz"), output, s.dir)
+	c.Assert(err, gc.ErrorMatches, "open .*sanitized.tar.gz: file exists")
+	data, err := ioutil.ReadFile(output)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, "precious")
+}
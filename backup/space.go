@@ -0,0 +1,123 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// tmpfsMagic is the filesystem type statfs reports for tmpfs.
+	tmpfsMagic = 0x01021994
+
+	// Mount flags statfs reports (ST_NODEV and ST_NOEXEC).
+	mountNoDev  = 0x4
+	mountNoExec = 0x8
+
+	// writeAccess is W_OK for access(2).
+	writeAccess = 0x2
+)
+
+// checkTempRoot makes sure the backup file at path can be extracted
+// under tempRoot before starting, rather than failing part way. If
+// checkDump isn't nil it's also passed the size of the dump, measured
+// in the same pass, to check anywhere else the dump will be copied.
+func checkTempRoot(path, tempRoot string, checkDump func(dumpSize int64) error) error {
+	info, err := os.Stat(tempRoot)
+	if os.IsNotExist(err) {
+		return errors.Errorf("temp root %q doesn't exist", tempRoot)
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("temp root %q isn't a directory", tempRoot)
+	}
+	if err := syscall.Access(tempRoot, writeAccess); err != nil {
+		return errors.Errorf("temp root %q isn't writable: %v", tempRoot, err)
+	}
+	needed, dumpSize, err := extractedSize(path)
+	if err != nil {
+		// Extracting a damaged file reports what's wrong with it
+		// better than measuring it does.
+		logger.Debugf("couldn't measure %q: %v", path, err)
+		return nil
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(tempRoot, &fs); err != nil {
+		return errors.Annotatef(err, "checking free space in %q", tempRoot)
+	}
+	available := int64(fs.Bavail) * int64(fs.Bsize)
+	if needed > available {
+		return errors.Errorf("not enough space to extract the backup under %q%s: need %d bytes, %d available (%d bytes short) - use --temp-root to extract it somewhere with more room",
+			tempRoot, describeMount(fs), needed, available, needed-available)
+	}
+	if checkDump != nil {
+		return errors.Trace(checkDump(dumpSize))
+	}
+	return nil
+}
+
+// extractedSize returns how much space extracting the backup file
+// will take (its contents, and root.tar's again once that's extracted
+// in place) and how much of that is the database dump, from one pass
+// over the archive's headers.
+func extractedSize(backupPath string) (total int64, dump int64, _ error) {
+	source, err := os.Open(backupPath)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	defer source.Close()
+
+	tarSource := io.Reader(source)
+	if strings.HasSuffix(backupPath, ".gz") {
+		gzReader, err := gzip.NewReader(source)
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		defer gzReader.Close()
+		tarSource = gzReader
+	}
+
+	reader := tar.NewReader(tarSource)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return total, dump, nil
+		} else if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		total += header.Size
+		if path.Base(header.Name) == rootTarFile {
+			total += header.Size
+		}
+		if header.Typeflag == tar.TypeReg && strings.HasPrefix(path.Clean(header.Name), dumpDir+"/") {
+			dump += header.Size
+		}
+	}
+}
+
+// describeMount explains why a filesystem might be smaller than
+// expected - tmpfs is held in memory - or "" if it's unremarkable.
+func describeMount(fs syscall.Statfs_t) string {
+	if int64(fs.Type) != tmpfsMagic {
+		return ""
+	}
+	options := []string{"tmpfs"}
+	if int64(fs.Flags)&mountNoExec != 0 {
+		options = append(options, "noexec")
+	}
+	if int64(fs.Flags)&mountNoDev != 0 {
+		options = append(options, "nodev")
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(options, ", "))
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// Verify unpacks the backup file under tempRoot and checks that it
+// could be restored: the metadata can be read, the dump holds the
+// collections a restore needs (or the oplog for an incremental), and
+// every BSON document in the dump is well-formed. It returns the
+// backup's metadata and the number of documents checked.
+func Verify(path, tempRoot string) (core.BackupMetadata, int, error) {
+	opened, err := open(path, tempRoot, nil)
+	if err != nil {
+		return core.BackupMetadata{}, 0, errors.Trace(err)
+	}
+	defer func() {
+		if err := opened.Close(); err != nil {
+			logger.Errorf("couldn't remove unpacked backup: %s", err)
+		}
+	}()
+	metadata, err := opened.Metadata()
+	if err != nil {
+		return core.BackupMetadata{}, 0, errors.Trace(err)
+	}
+	// Reading the metadata of a full backup has already checked the
+	// models and clouds collections are there.
+	if metadata.Incremental() && metadata.OplogEnd == 0 {
+		return metadata, 0, errors.New("incremental backup has no oplog entries")
+	}
+	dumpDir := opened.DumpDirectory()
+
+	var documents int
+	err = filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		collection, isBson := collectionFileName(info.Name())
+		if info.IsDir() || !isBson {
+			return nil
+		}
+		count, err := verifyBsonFile(filepath.Join(filepath.Dir(path), collection+".bson"))
+		if err != nil {
+			relPath, _ := filepath.Rel(dumpDir, path)
+			return errors.Annotatef(err, "checking %s", relPath)
+		}
+		documents += count
+		return nil
+	})
+	if err != nil {
+		return metadata, documents, errors.Trace(err)
+	}
+	return metadata, documents, nil
+}
+
+// verifyBsonFile checks that each document in a dumped collection can
+// be parsed, returning the number of documents.
+func verifyBsonFile(path string) (int, error) {
+	source, err := openBsonFile(path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer source.Close()
+
+	var count int
+	err = eachBsonDoc(source, func(data []byte) error {
+		count++
+		var doc bson.D
+		return errors.Annotatef(bson.Unmarshal(data, &doc), "document %d", count)
+	})
+	if err != nil {
+		return count, errors.Trace(err)
+	}
+	return count, nil
+}
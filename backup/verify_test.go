@@ -0,0 +1,168 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package backup_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+)
+
+func (s *backupSuite) TestVerify(c *gc.C) {
+	for _, name := range []string{"valid-backup.tar.gz", "valid-backup-ver-1.tar.gz"} {
+		c.Logf("verifying %s", name)
+		metadata, documents, err := backup.Verify(filepath.Join("testdata", name), s.dir)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(metadata.ModelCount, gc.Not(gc.Equals), 0)
+		c.Assert(documents >= metadata.ModelCount+metadata.CloudCount, jc.IsTrue)
+	}
+	// The unpacked files are removed.
+	c.Assert(s.dir, jc.IsDirectory)
+	items, err := filepath.Glob(filepath.Join(s.dir, "*"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(items, gc.HasLen, 0)
+}
+
+func (s *backupSuite) TestVerifyMissingRoot(c *gc.C) {
+	_, _, err := backup.Verify(filepath.Join("testdata", "missing-root-backup.tar.gz"), s.dir)
+	c.Assert(err, gc.ErrorMatches, "extracting root.tar in .*")
+}
+
+func (s *backupSuite) createForVerify(c *gc.C, populate func(dumpDir string), parentID string) string {
+	dumpDir := filepath.Join(c.MkDir(), "dump")
+	populate(dumpDir)
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	created := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	err := backup.Create(path, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.MkDir(),
+		MachineID: "0",
+		Metadata: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			BackupCreated:       created,
+			ParentID:            parentID,
+			OplogStart:          core.NewOplogPosition(created, 1),
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return path
+}
+
+func (s *backupSuite) TestVerifyCorruptCollection(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeTestFile(c, filepath.Join(dumpDir, "juju/models.bson"), "")
+		writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+		// A document that claims to be longer than the file.
+		writeTestFile(c, filepath.Join(dumpDir, "juju/machines.bson"), "\x40\x00\x00\x00\x0a")
+	}, "")
+	_, _, err := backup.Verify(path, s.dir)
+	c.Assert(err, gc.ErrorMatches, "checking juju/machines.bson: .*EOF")
+}
+
+func (s *backupSuite) TestVerifyIncremental(c *gc.C) {
+	start := core.NewOplogPosition(time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC), 1)
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeOplog(c, filepath.Join(dumpDir, "oplog.bson"), start, start+1)
+	}, "parent")
+	metadata, documents, err := backup.Verify(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.Incremental(), jc.IsTrue)
+	c.Assert(documents, gc.Equals, 2)
+}
+
+func (s *backupSuite) TestVerifyLargeDocuments(c *gc.C) {
+	// Documents bigger than the read buffer are read whole.
+	large := strings.Repeat("x", 200*1024)
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), doc("_id", "how-bizarre-uuid"))
+		writeDocs(c, filepath.Join(dumpDir, "juju/clouds.bson"), doc("_id", "lxd"))
+		writeDocs(c, filepath.Join(dumpDir, "juju/statuseshistory.bson"),
+			doc("_id", 1, "data", large),
+			doc("_id", 2, "data", large),
+			doc("_id", 3),
+		)
+	}, "")
+	metadata, documents, err := backup.Verify(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ModelCount, gc.Equals, 1)
+	c.Assert(documents, gc.Equals, 5)
+}
+
+func (s *backupSuite) TestVerifyInvalidDocumentSize(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeTestFile(c, filepath.Join(dumpDir, "juju/models.bson"), "")
+		writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+		// A corrupt size isn't allocated.
+		writeTestFile(c, filepath.Join(dumpDir, "juju/machines.bson"), "\xff\xff\xff\x7f\x0a")
+	}, "")
+	_, _, err := backup.Verify(path, s.dir)
+	c.Assert(err, gc.ErrorMatches, "checking juju/machines.bson: invalid document size 2147483647")
+}
+
+// compressTestFile replaces the file at path with a gzipped copy, as
+// mongodump --gzip writes.
+func compressTestFile(c *gc.C, path string) {
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, jc.ErrorIsNil)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err = writer.Write(data)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(writer.Close(), jc.ErrorIsNil)
+	c.Assert(ioutil.WriteFile(path+".gz", compressed.Bytes(), 0644), jc.ErrorIsNil)
+	c.Assert(os.Remove(path), jc.ErrorIsNil)
+}
+
+func (s *backupSuite) TestVerifyCompressed(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), doc("_id", "how-bizarre-uuid"))
+		writeDocs(c, filepath.Join(dumpDir, "juju/clouds.bson"), doc("_id", "lxd"), doc("_id", "aws"))
+		writeDocs(c, filepath.Join(dumpDir, "juju/machines.bson"), doc("_id", "uuid:0"), doc("_id", "uuid:1"), doc("_id", "uuid:2"))
+		for _, name := range []string{"models", "clouds", "machines"} {
+			compressTestFile(c, filepath.Join(dumpDir, "juju", name+".bson"))
+		}
+	}, "")
+	metadata, documents, err := backup.Verify(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata.ModelCount, gc.Equals, 1)
+	c.Assert(metadata.CloudCount, gc.Equals, 2)
+	c.Assert(documents, gc.Equals, 6)
+	c.Assert(metadata.Databases, gc.HasLen, 1)
+	_, ok := metadata.Databases[0].Collections["machines"]
+	c.Assert(ok, jc.IsTrue)
+}
+
+func (s *backupSuite) TestVerifyCompressedCorrupt(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeTestFile(c, filepath.Join(dumpDir, "juju/models.bson"), "")
+		writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "")
+		writeTestFile(c, filepath.Join(dumpDir, "juju/machines.bson.gz"), "this is not gzipped")
+	}, "")
+	_, _, err := backup.Verify(path, s.dir)
+	c.Assert(err, gc.ErrorMatches, "checking juju/machines.bson.gz: reading machines.bson.gz: gzip: invalid header")
+}
+
+func (s *backupSuite) TestMetadataCountTruncated(c *gc.C) {
+	path := s.createForVerify(c, func(dumpDir string) {
+		writeDocs(c, filepath.Join(dumpDir, "juju/models.bson"), doc("_id", "how-bizarre-uuid"))
+		writeTestFile(c, filepath.Join(dumpDir, "juju/clouds.bson"), "\x40\x00\x00\x00\x0a")
+	}, "")
+	opened, err := backup.Open(path, s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	defer opened.Close()
+	_, err = opened.Metadata()
+	c.Assert(err, gc.ErrorMatches, "counting clouds.bson: document 1: unexpected EOF")
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Keys identifying the confirmation prompts in an answers file.
+const (
+	promptManageAgents     = "manage-agents"
+	promptInferredMetadata = "use-inferred-metadata"
+	promptProceed          = "proceed"
+	promptHostKey          = "trust-host-key "
+)
+
+// Answers holds the responses to confirmation prompts, keyed by
+// prompt, so that a rehearsed restore can be repeated later with the
+// same decisions. Host key prompts are keyed by "trust-host-key "
+// followed by the machine's address.
+type Answers map[string]bool
+
+// ReadAnswers loads answers from the YAML file at path, for example:
+//
+//	use-inferred-metadata: yes
+//	manage-agents: yes
+//	trust-host-key 10.0.0.5: yes
+//	proceed: yes
+func ReadAnswers(path string) (Answers, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var answers Answers
+	if err := yaml.UnmarshalStrict(data, &answers); err != nil {
+		return nil, errors.Annotatef(err, "unmarshalling %q", path)
+	}
+	if answers == nil {
+		answers = make(Answers)
+	}
+	return answers, nil
+}
+
+// Write saves the answers to path in the format read by ReadAnswers.
+func (a Answers) Write(path string) error {
+	data, err := yaml.Marshal(a)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(path, data, 0644))
+}
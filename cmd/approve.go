@@ -0,0 +1,368 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// Approval records a second operator's sign-off on restoring a
+// particular backup file, for organisations that need two people to
+// agree to a controller restore. The backup is identified by its
+// SHA-256 checksum, so an approval can't be used for a different
+// backup. It's signed with the approver's ssh key, so the operator
+// running the restore can't write or alter one without that key.
+type Approval struct {
+	Backup       string    `yaml:"backup"`
+	BackupSHA256 string    `yaml:"backup-sha256"`
+	ApprovedBy   string    `yaml:"approved-by"`
+	ApprovedAt   time.Time `yaml:"approved-at"`
+	Expires      time.Time `yaml:"expires"`
+	Note         string    `yaml:"note,omitempty"`
+
+	// Signature is the ssh-keygen -Y sign signature of the rest of
+	// the approval, made by ApprovedBy.
+	Signature string `yaml:"signature,omitempty"`
+}
+
+// approvalNamespace is the ssh signature namespace approvals are
+// signed in, so a signature made for something else can't be passed
+// off as an approval.
+const approvalNamespace = "juju-restore-approval@juju.is"
+
+// DefaultApproversFile is where the ssh keys trusted to sign
+// approvals are read from unless --approvers is given.
+const DefaultApproversFile = "/etc/juju-restore/allowed_signers"
+
+// approvalPolicyFile turns on required approvals for the machine when
+// it exists: every restore then needs an approval signed by a key in
+// it, whatever flags are passed. It's a variable so tests can point
+// it somewhere else.
+var approvalPolicyFile = DefaultApproversFile
+
+// signedContent returns what the signature covers: the approval
+// without its signature.
+func (a Approval) signedContent() ([]byte, error) {
+	a.Signature = ""
+	data, err := yaml.Marshal(a)
+	return data, errors.Trace(err)
+}
+
+// Sign returns the approval signed with the ssh private key in
+// keyFile (or the public key of one held by ssh-agent).
+func (a Approval) Sign(keyFile string) (Approval, error) {
+	content, err := a.signedContent()
+	if err != nil {
+		return a, errors.Trace(err)
+	}
+	dir, err := ioutil.TempDir("", "juju-restore-approval")
+	if err != nil {
+		return a, errors.Trace(err)
+	}
+	defer os.RemoveAll(dir)
+	contentFile := filepath.Join(dir, "approval")
+	if err := ioutil.WriteFile(contentFile, content, 0600); err != nil {
+		return a, errors.Trace(err)
+	}
+	command := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyFile, "-n", approvalNamespace, contentFile)
+	command.Stdin = os.Stdin
+	if output, err := command.CombinedOutput(); err != nil {
+		return a, errors.Errorf("signing with %s: %s", keyFile, describeCommandError(output, err))
+	}
+	signature, err := ioutil.ReadFile(contentFile + ".sig")
+	if err != nil {
+		return a, errors.Trace(err)
+	}
+	a.Signature = string(signature)
+	return a, nil
+}
+
+// Verify returns an error unless the approval was signed by
+// ApprovedBy with one of their keys in allowedSigners, a file in the
+// ssh-keygen ALLOWED SIGNERS format.
+func (a Approval) Verify(allowedSigners string) error {
+	if a.Signature == "" {
+		return errors.New("approval isn't signed - it has to be written by juju-restore approve")
+	}
+	if _, err := os.Stat(allowedSigners); err != nil {
+		return errors.Annotate(err, "reading approvers")
+	}
+	content, err := a.signedContent()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dir, err := ioutil.TempDir("", "juju-restore-approval")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(dir)
+	signatureFile := filepath.Join(dir, "approval.sig")
+	if err := ioutil.WriteFile(signatureFile, []byte(a.Signature), 0600); err != nil {
+		return errors.Trace(err)
+	}
+	command := exec.Command("ssh-keygen", "-Y", "verify",
+		"-f", allowedSigners, "-I", a.ApprovedBy, "-n", approvalNamespace, "-s", signatureFile)
+	command.Stdin = bytes.NewReader(content)
+	if output, err := command.CombinedOutput(); err != nil {
+		return errors.Errorf("approval signature isn't from a key of %s's in %s: %s", a.ApprovedBy, allowedSigners, describeCommandError(output, err))
+	}
+	return nil
+}
+
+// describeCommandError returns the output of a failed command, or the
+// error if it didn't write anything.
+func describeCommandError(output []byte, err error) string {
+	// ssh-keygen reports over several lines, the first being the reason.
+	if message := strings.TrimSpace(string(output)); message != "" {
+		return strings.TrimSpace(strings.SplitN(message, "\n", 2)[0])
+	}
+	return err.Error()
+}
+
+// defaultSigningKey returns the first of the usual ssh private keys
+// that exists, or "" if there aren't any.
+func defaultSigningKey() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// ReadApproval loads an approval from the YAML file at path.
+func ReadApproval(path string) (Approval, error) {
+	var approval Approval
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return approval, errors.Trace(err)
+	}
+	if err := yaml.UnmarshalStrict(data, &approval); err != nil {
+		return approval, errors.Annotatef(err, "unmarshalling %q", path)
+	}
+	return approval, nil
+}
+
+// Write saves the approval to path in the format read by
+// ReadApproval.
+func (a Approval) Write(path string) error {
+	data, err := yaml.Marshal(a)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(path, data, 0644))
+}
+
+// Check returns an error if the approval doesn't allow username to
+// restore a backup with the given checksum at now.
+func (a Approval) Check(checksum, username string, now time.Time) error {
+	if a.BackupSHA256 != checksum {
+		return errors.Errorf("approval is for a different backup (%s, sha256 %s)", a.Backup, a.BackupSHA256)
+	}
+	if a.ApprovedBy == username {
+		return errors.Errorf("approval was given by %s, who is running the restore - it has to come from someone else", username)
+	}
+	if !now.Before(a.Expires) {
+		return errors.Errorf("approval from %s expired at %s", a.ApprovedBy, a.Expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 checksum of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", errors.Annotatef(err, "reading %q", path)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// currentUsername returns the name of the user running juju-restore.
+func currentUsername() (string, error) {
+	current, err := user.Current()
+	if err != nil {
+		return "", errors.Annotate(err, "finding the current user")
+	}
+	return current.Username, nil
+}
+
+// NewApproveCommand creates a cmd.Command that writes an approval for
+// another operator to restore a backup file.
+func NewApproveCommand() cmd.Command {
+	return &approveCommand{}
+}
+
+type approveCommand struct {
+	cmd.CommandBase
+
+	output     string
+	validFor   time.Duration
+	note       string
+	key        string
+	backupFile string
+}
+
+// Info is part of cmd.Command.
+func (c *approveCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore approve",
+		Args:    "<backup file>",
+		Purpose: "Approve another operator restoring a backup",
+		Doc:     approveDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *approveCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.output, "output", "", "file to write the approval to (default <backup file>-approval.yaml)")
+	f.DurationVar(&c.validFor, "valid-for", 24*time.Hour, "how long the approval can be used for")
+	f.StringVar(&c.note, "note", "", "reason for the restore, such as a change ticket, recorded in the approval")
+	f.StringVar(&c.key, "key", "", "ssh private key to sign the approval with (default ~/.ssh/id_ed25519, id_ecdsa or id_rsa)")
+}
+
+// Init is part of cmd.Command.
+func (c *approveCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing backup file")
+	}
+	c.backupFile, args = args[0], args[1:]
+	if c.validFor <= 0 {
+		return errors.New("--valid-for must be positive")
+	}
+	if c.key == "" {
+		c.key = defaultSigningKey()
+		if c.key == "" {
+			return errors.New("no ssh key found to sign the approval with - pass --key")
+		}
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *approveCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	output := c.output
+	if output == "" {
+		output = strings.TrimSuffix(c.backupFile, ".tar.gz") + "-approval.yaml"
+	}
+	output = ctx.AbsPath(output)
+	username, err := currentUsername()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ui.Notify("Checksumming backup... ")
+	checksum, err := fileSHA256(ctx.AbsPath(c.backupFile))
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "checksumming backup")
+	}
+	ui.Notify("✓\n")
+	now := time.Now().UTC().Round(time.Second)
+	approval := Approval{
+		Backup:       c.backupFile,
+		BackupSHA256: checksum,
+		ApprovedBy:   username,
+		ApprovedAt:   now,
+		Expires:      now.Add(c.validFor),
+		Note:         c.note,
+	}
+	approval, err = approval.Sign(ctx.AbsPath(c.key))
+	if err != nil {
+		return errors.Annotate(err, "signing approval")
+	}
+	if err := approval.Write(output); err != nil {
+		return errors.Annotate(err, "writing approval")
+	}
+	ui.Notify(populate(approvalWrittenTemplate, struct {
+		Approval
+		Path string
+	}{approval, output}))
+	return nil
+}
+
+// checkApproval makes sure the restore has been approved by someone
+// else, with a key trusted in --approvers, if --approval was passed or
+// approvals are required, recording who approved it.
+func (c *restoreCommand) checkApproval() error {
+	policy, err := approvalRequiredBy()
+	if err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Trace(err))
+	}
+	if policy != "" && c.approversFile != policy {
+		return core.NewFailure(core.PrecheckFailure, errors.Errorf("approvals are required by %s, so --approvers can't be another file", policy))
+	}
+	if policy == "" && c.requireApproval {
+		policy = "--require-approval"
+	}
+	if c.approvalFile == "" {
+		if policy == "" {
+			return nil
+		}
+		if c.copyFrom != "" {
+			return core.NewFailure(core.PrecheckFailure, errors.Errorf("restores need an approval (required by %s), and --copy-from restores can't be approved - restore from a backup file instead", policy))
+		}
+		return core.NewFailure(core.PrecheckFailure, errors.Errorf("restores need an approval from another operator (required by %s) - pass --approval with one written by juju-restore approve", policy))
+	}
+	approval, err := ReadApproval(c.approvalFile)
+	if err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Annotate(err, "reading approval"))
+	}
+	if err := approval.Verify(c.approversFile); err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Trace(err))
+	}
+	username, err := currentUsername()
+	if err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Trace(err))
+	}
+	checksum, err := fileSHA256(c.backupFile)
+	if err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Annotate(err, "checksumming backup"))
+	}
+	if err := approval.Check(checksum, username, time.Now()); err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Trace(err))
+	}
+	c.ui.Progress(populate(approvedTemplate, approval))
+	c.report.decided("approval", true, approval.ApprovedBy+" (approval file)")
+	return nil
+}
+
+// approvalRequiredBy returns the approval policy file if it exists,
+// meaning every restore on this machine needs an approval.
+func approvalRequiredBy() (string, error) {
+	if _, err := os.Stat(approvalPolicyFile); err == nil {
+		return approvalPolicyFile, nil
+	} else if !os.IsNotExist(err) {
+		return "", errors.Annotate(err, "checking approval policy")
+	}
+	return "", nil
+}
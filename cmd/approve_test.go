@@ -0,0 +1,147 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+)
+
+// backupChecksum is the SHA-256 of "backup contents".
+const backupChecksum = "f97c387c9eb1a86dd0fa1d22c75c998d4695ec1bb0e7834cd7d4f5607b676cbc"
+
+type approveSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&approveSuite{})
+
+func writeBackupFile(c *gc.C) string {
+	path := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := ioutil.WriteFile(path, []byte("backup contents"), 0600)
+	c.Assert(err, jc.ErrorIsNil)
+	return path
+}
+
+// hostPath is the PATH the tests started with, before the isolation
+// suites clear it, so ssh-keygen can still be found.
+var hostPath = os.Getenv("PATH")
+
+type envPatcher interface {
+	PatchEnvironment(name, value string)
+}
+
+// newSigningKey makes an ssh key for principal, returning the private
+// key file and an allowed signers file trusting it.
+func newSigningKey(c *gc.C, s envPatcher, principal string) (string, string) {
+	s.PatchEnvironment("PATH", hostPath)
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		c.Skip("ssh-keygen not available")
+	}
+	dir := c.MkDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", principal, "-f", keyFile).Run()
+	c.Assert(err, jc.ErrorIsNil)
+	public, err := ioutil.ReadFile(keyFile + ".pub")
+	c.Assert(err, jc.ErrorIsNil)
+	allowedSigners := filepath.Join(dir, "allowed_signers")
+	err = ioutil.WriteFile(allowedSigners, []byte(principal+" "+string(public)), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	return keyFile, allowedSigners
+}
+
+func (s *approveSuite) TestApprove(c *gc.C) {
+	current, err := user.Current()
+	c.Assert(err, jc.ErrorIsNil)
+	keyFile, allowedSigners := newSigningKey(c, s, current.Username)
+	backupFile := writeBackupFile(c)
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewApproveCommand(), backupFile, "--valid-for", "2h", "--note", "CHG-1234", "--key", keyFile)
+	c.Assert(err, jc.ErrorIsNil)
+	output := filepath.Join(filepath.Dir(backupFile), "backup-approval.yaml")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "Approval written to "+output+":\n")
+
+	approval, err := cmd.ReadApproval(output)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(approval.Verify(allowedSigners), jc.ErrorIsNil)
+	c.Assert(approval.Backup, gc.Equals, backupFile)
+	c.Assert(approval.BackupSHA256, gc.Equals, backupChecksum)
+	c.Assert(approval.ApprovedBy, gc.Equals, current.Username)
+	c.Assert(approval.Expires.Sub(approval.ApprovedAt), gc.Equals, 2*time.Hour)
+	c.Assert(approval.Note, gc.Equals, "CHG-1234")
+}
+
+func (s *approveSuite) TestApproveMissingBackup(c *gc.C) {
+	_, err := cmdtesting.RunCommand(c, cmd.NewApproveCommand())
+	c.Assert(err, gc.ErrorMatches, "missing backup file")
+	_, err = cmdtesting.RunCommand(c, cmd.NewApproveCommand(), filepath.Join(c.MkDir(), "nothing.tar.gz"), "--key", "id_ed25519")
+	c.Assert(err, gc.ErrorMatches, "checksumming backup: open .*nothing.tar.gz: no such file or directory")
+}
+
+func (s *approveSuite) TestCheck(c *gc.C) {
+	approvedAt := time.Date(2020, 3, 17, 16, 0, 0, 0, time.UTC)
+	approval := cmd.Approval{
+		Backup:       "backup.tar.gz",
+		BackupSHA256: backupChecksum,
+		ApprovedBy:   "mary",
+		ApprovedAt:   approvedAt,
+		Expires:      approvedAt.Add(time.Hour),
+	}
+	c.Assert(approval.Check(backupChecksum, "bob", approvedAt.Add(time.Minute)), jc.ErrorIsNil)
+	c.Assert(approval.Check("1234", "bob", approvedAt), gc.ErrorMatches, `approval is for a different backup \(backup.tar.gz, sha256 f97c.*\)`)
+	c.Assert(approval.Check(backupChecksum, "mary", approvedAt), gc.ErrorMatches, "approval was given by mary, who is running the restore - it has to come from someone else")
+	c.Assert(approval.Check(backupChecksum, "bob", approvedAt.Add(time.Hour)), gc.ErrorMatches, "approval from mary expired at 2020-03-17T17:00:00Z")
+}
+
+func (s *approveSuite) TestVerify(c *gc.C) {
+	keyFile, allowedSigners := newSigningKey(c, s, "mary")
+	approvedAt := time.Date(2020, 3, 17, 16, 0, 0, 0, time.UTC)
+	approval := cmd.Approval{
+		Backup:       "backup.tar.gz",
+		BackupSHA256: backupChecksum,
+		ApprovedBy:   "mary",
+		ApprovedAt:   approvedAt,
+		Expires:      approvedAt.Add(time.Hour),
+	}
+	c.Assert(approval.Verify(allowedSigners), gc.ErrorMatches, "approval isn't signed - it has to be written by juju-restore approve")
+
+	signed, err := approval.Sign(keyFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(signed.Signature, jc.HasPrefix, "-----BEGIN SSH SIGNATURE-----\n")
+	c.Assert(signed.Verify(allowedSigners), jc.ErrorIsNil)
+
+	// Written and read back, it still verifies.
+	path := filepath.Join(c.MkDir(), "approval.yaml")
+	c.Assert(signed.Write(path), jc.ErrorIsNil)
+	read, err := cmd.ReadApproval(path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(read.Verify(allowedSigners), jc.ErrorIsNil)
+
+	// Changing who approved it or how long it lasts breaks the
+	// signature.
+	tampered := signed
+	tampered.ApprovedBy = "bob"
+	c.Assert(tampered.Verify(allowedSigners), gc.ErrorMatches, "approval signature isn't from a key of bob's in .*allowed_signers: .*")
+	tampered = signed
+	tampered.Expires = approvedAt.Add(24 * time.Hour)
+	c.Assert(tampered.Verify(allowedSigners), gc.ErrorMatches, "approval signature isn't from a key of mary's in .*: .*")
+
+	// A key that isn't trusted can't sign approvals.
+	otherKey, _ := newSigningKey(c, s, "mary")
+	forged, err := approval.Sign(otherKey)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(forged.Verify(allowedSigners), gc.ErrorMatches, "approval signature isn't from a key of mary's in .*: .*")
+
+	c.Assert(signed.Verify(filepath.Join(c.MkDir(), "missing")), gc.ErrorMatches, "reading approvers: .*no such file or directory")
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/db"
+)
+
+// NewCleanupCommand creates a cmd.Command that removes what a failed
+// or killed restore left behind: the staging database and the
+// directories backup files were unpacked into.
+func NewCleanupCommand(
+	dbConnect func(info db.DialInfo) (core.Database, error),
+	loadCreds func(agentConf string) ([]AgentConf, error),
+	findTempDirs func(tempRoot string) ([]string, error),
+) cmd.Command {
+	return &cleanupCommand{
+		connect:      dbConnect,
+		loadCreds:    loadCreds,
+		findTempDirs: findTempDirs,
+	}
+}
+
+type cleanupCommand struct {
+	cmd.CommandBase
+
+	connect      func(info db.DialInfo) (core.Database, error)
+	loadCreds    func(agentConf string) ([]AgentConf, error)
+	findTempDirs func(tempRoot string) ([]string, error)
+
+	agentConf string
+	hostname  string
+	port      string
+	ssl       bool
+	tempRoot  string
+	assumeYes bool
+}
+
+// Info is part of cmd.Command.
+func (c *cleanupCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore cleanup",
+		Purpose: "Remove the staging database and temp directories left by a failed restore",
+		Doc:     cleanupDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *cleanupCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.agentConf, "agent-conf", "", "agent.conf to get credentials from (default is to try each machine agent's)")
+	f.StringVar(&c.hostname, "hostname", "", "hostname of the Juju MongoDB server (default from agent.conf, or localhost)")
+	f.StringVar(&c.port, "port", "", "port of the Juju MongoDB server (default from agent.conf, or 37017)")
+	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location backup files were unpacked under")
+	f.BoolVar(&c.assumeYes, "yes", false, "remove what's found without asking")
+}
+
+// Run is part of cmd.Command.
+func (c *cleanupCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	dirs, err := c.findTempDirs(c.tempRoot)
+	if err != nil {
+		return errors.Annotatef(err, "looking for temp directories under %q", c.tempRoot)
+	}
+	creds, err := c.loadCreds(c.agentConf)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "loading credentials"))
+	}
+	settings := connectionSettings{
+		Hostname: c.hostname,
+		Port:     c.port,
+		SSL:      c.ssl,
+	}
+	database, _, err := connectWithCreds(c.connect, settings, creds)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "connecting to database"))
+	}
+	defer database.Close()
+	staging, err := database.HasStagingDatabase()
+	if err != nil {
+		return errors.Annotate(err, "checking for the staging database")
+	}
+
+	if !staging && len(dirs) == 0 {
+		ui.Notify("Nothing to clean up.\n")
+		return nil
+	}
+	ui.Notify(populate(cleanupTemplate, struct {
+		Staging bool
+		Dirs    []string
+	}{staging, dirs}))
+	if !c.assumeYes {
+		ui.Notify("\nRemove these? (y/N): ")
+		if err := ui.UserConfirmYes(); err != nil {
+			return errors.Annotate(err, "cleanup")
+		}
+	}
+
+	failed, total := 0, len(dirs)
+	if staging {
+		total++
+		if _, err := database.DropStagingDatabase(); err != nil {
+			logger.Errorf("%v", err)
+			failed++
+		} else {
+			ui.Notify("Removed the staging database.\n")
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Errorf("removing %s: %v", dir, err)
+			failed++
+			continue
+		}
+		ui.Notify(fmt.Sprintf("Removed %s.\n", dir))
+	}
+	if failed > 0 {
+		return errors.Errorf("couldn't remove %d of %d items", failed, total)
+	}
+	return nil
+}
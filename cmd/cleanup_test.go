@@ -0,0 +1,113 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+	"github.com/juju/juju-restore/db"
+)
+
+type cleanupSuite struct {
+	testing.IsolationSuite
+
+	database *coretesting.Database
+	tempRoot string
+	dirs     []string
+}
+
+var _ = gc.Suite(&cleanupSuite{})
+
+func (s *cleanupSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.database = &coretesting.Database{Staging: true}
+	s.tempRoot = ""
+	dir := filepath.Join(c.MkDir(), "juju-restore123")
+	c.Assert(os.Mkdir(dir, 0700), jc.ErrorIsNil)
+	s.dirs = []string{dir}
+}
+
+func (s *cleanupSuite) runCmd(c *gc.C, input string, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewCleanupCommand(
+		func(info db.DialInfo) (core.Database, error) {
+			return s.database, nil
+		},
+		func(agentConf string) ([]cmd.AgentConf, error) {
+			return []cmd.AgentConf{{
+				Path:     "/var/lib/juju/agents/machine-0/agent.conf",
+				Username: "machine-0",
+				Password: "secret",
+			}}, nil
+		},
+		func(tempRoot string) ([]string, error) {
+			s.tempRoot = tempRoot
+			return s.dirs, nil
+		},
+	)
+	err := cmdtesting.InitCommand(command, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx := cmdtesting.Context(c)
+	ctx.Stdin = strings.NewReader(input)
+	return ctx, command.Run(ctx)
+}
+
+func (s *cleanupSuite) TestCleanup(c *gc.C) {
+	ctx, err := s.runCmd(c, "y\n", "--temp-root", "/var/tmp")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.tempRoot, gc.Equals, "/var/tmp")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Found:
+    the jujucontroller staging database
+    `+s.dirs[0]+`
+
+Remove these? (y/N): Removed the staging database.
+Removed `+s.dirs[0]+`.
+`)
+	s.database.CheckCallNames(c, "HasStagingDatabase", "DropStagingDatabase", "Close")
+	c.Assert(s.dirs[0], jc.DoesNotExist)
+}
+
+func (s *cleanupSuite) TestCleanupAborted(c *gc.C) {
+	_, err := s.runCmd(c, "n\n")
+	c.Assert(err, gc.ErrorMatches, "cleanup: aborted")
+	s.database.CheckCallNames(c, "HasStagingDatabase", "Close")
+	c.Assert(s.dirs[0], jc.IsDirectory)
+}
+
+func (s *cleanupSuite) TestCleanupYes(c *gc.C) {
+	s.database.Staging = false
+	ctx, err := s.runCmd(c, "", "--yes")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "Removed "+s.dirs[0]+".\n")
+	s.database.CheckCallNames(c, "HasStagingDatabase", "Close")
+}
+
+func (s *cleanupSuite) TestCleanupNothing(c *gc.C) {
+	s.database.Staging = false
+	s.dirs = nil
+	ctx, err := s.runCmd(c, "")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Nothing to clean up.\n")
+}
+
+func (s *cleanupSuite) TestCleanupDropFails(c *gc.C) {
+	s.database.SetErrors(nil, errors.New("not authorized"))
+	_, err := s.runCmd(c, "", "--yes")
+	c.Assert(err, gc.ErrorMatches, "couldn't remove 1 of 2 items")
+	c.Assert(s.dirs[0], jc.DoesNotExist)
+}
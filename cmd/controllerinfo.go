@@ -0,0 +1,140 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/db"
+)
+
+// NewControllerInfoCommand creates a cmd.Command that shows what
+// juju-restore sees of the controller it's run on, without needing a
+// backup file.
+func NewControllerInfoCommand(
+	dbConnect func(info db.DialInfo) (core.Database, error),
+	loadCreds func(agentConf string) ([]AgentConf, error),
+) cmd.Command {
+	return &controllerInfoCommand{
+		connect:   dbConnect,
+		loadCreds: loadCreds,
+	}
+}
+
+type controllerInfoCommand struct {
+	cmd.CommandBase
+
+	connect   func(info db.DialInfo) (core.Database, error)
+	loadCreds func(agentConf string) ([]AgentConf, error)
+
+	agentConf string
+	hostname  string
+	port      string
+	ssl       bool
+}
+
+// Info is part of cmd.Command.
+func (c *controllerInfoCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore controller-info",
+		Purpose: "Show the controller and replica set details juju-restore would check",
+		Doc:     controllerInfoDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *controllerInfoCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.agentConf, "agent-conf", "", "agent.conf to get credentials from (default is to try each machine agent's)")
+	f.StringVar(&c.hostname, "hostname", "", "hostname of the Juju MongoDB server (default from agent.conf, or localhost)")
+	f.StringVar(&c.port, "port", "", "port of the Juju MongoDB server (default from agent.conf, or 37017)")
+	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB")
+}
+
+// Run is part of cmd.Command.
+func (c *controllerInfoCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	creds, err := c.loadCreds(c.agentConf)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "loading credentials"))
+	}
+	settings := connectionSettings{
+		Hostname: c.hostname,
+		Port:     c.port,
+		SSL:      c.ssl,
+	}
+	database, _, err := connectWithCreds(c.connect, settings, creds)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "connecting to database"))
+	}
+	defer database.Close()
+
+	// Whatever can be read is shown, since this is most useful when
+	// something is already wrong with the controller.
+	info, infoErr := database.ControllerInfo()
+	if infoErr == nil {
+		ui.Notify(populate(controllerInfoTemplate, info))
+	}
+	replicaSet, replicaSetErr := database.ReplicaSet()
+	if replicaSetErr == nil {
+		ui.Notify(formatReplicaSet(replicaSet))
+	}
+	if infoErr != nil {
+		return errors.Annotate(infoErr, "getting controller info")
+	}
+	return errors.Annotate(replicaSetErr, "getting database replica set")
+}
+
+// formatReplicaSet renders the replica set members as a table.
+func formatReplicaSet(replicaSet core.ReplicaSet) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "\nReplica set %s:\n", replicaSet.Name)
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "    ID\tNAME\tSTATE\tHEALTHY\tMACHINE\tLAG\tNOTES")
+	for _, member := range replicaSet.Members {
+		healthy := "✗"
+		if member.Healthy {
+			healthy = "✓"
+		}
+		machine := orDash(member.JujuMachineID)
+		if member.MachineIDInferred {
+			machine += " (inferred)"
+		}
+		var notes []string
+		if member.Self {
+			notes = append(notes, "connected")
+		}
+		if member.Arbiter {
+			notes = append(notes, "arbiter")
+		}
+		if member.Hidden {
+			notes = append(notes, "hidden")
+		}
+		if member.Delay > 0 {
+			notes = append(notes, fmt.Sprintf("delayed %s", member.Delay))
+		}
+		fmt.Fprintf(w, "    %d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			member.ID,
+			member.Name,
+			strings.ToLower(member.State),
+			healthy,
+			machine,
+			member.Lag,
+			orDash(strings.Join(notes, ", ")),
+		)
+	}
+	w.Flush()
+	if replicaSet.OplogWindow > 0 {
+		fmt.Fprintf(&buf, "Oplog window: %s\n", replicaSet.OplogWindow)
+	}
+	return buf.String()
+}
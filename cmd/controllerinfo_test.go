@@ -0,0 +1,150 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"time"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+	"github.com/juju/juju-restore/db"
+)
+
+type controllerInfoSuite struct {
+	testing.IsolationSuite
+
+	database *coretesting.Database
+	dialErr  error
+}
+
+var _ = gc.Suite(&controllerInfoSuite{})
+
+func (s *controllerInfoSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.dialErr = nil
+	s.database = &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{
+				Name: "juju",
+				Members: []core.ReplicaSetMember{{
+					Healthy:       true,
+					ID:            1,
+					Name:          "10.0.0.1:37017",
+					State:         "PRIMARY",
+					Self:          true,
+					JujuMachineID: "0",
+				}, {
+					Healthy:           true,
+					ID:                2,
+					Name:              "10.0.0.2:37017",
+					State:             "SECONDARY",
+					JujuMachineID:     "1",
+					MachineIDInferred: true,
+					Lag:               3 * time.Second,
+				}, {
+					ID:      3,
+					Name:    "10.0.0.3:37017",
+					State:   "ARBITER",
+					Arbiter: true,
+				}},
+				OplogWindow: 26 * time.Hour,
+			}, nil
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				ControllerUUID:      "dawkins-rules",
+				ControllerModelUUID: "how-bizarre",
+				JujuVersion:         version.MustParse("2.9.37"),
+				Series:              "focal",
+				HANodes:             2,
+				Models:              4,
+			}, nil
+		},
+	}
+}
+
+func (s *controllerInfoSuite) runCmd(c *gc.C, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewControllerInfoCommand(
+		func(info db.DialInfo) (core.Database, error) {
+			if s.dialErr != nil {
+				return nil, s.dialErr
+			}
+			return s.database, nil
+		},
+		func(agentConf string) ([]cmd.AgentConf, error) {
+			return []cmd.AgentConf{{
+				Path:     "/var/lib/juju/agents/machine-0/agent.conf",
+				Username: "machine-0",
+				Password: "secret",
+			}}, nil
+		},
+	)
+	err := cmdtesting.InitCommand(command, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx := cmdtesting.Context(c)
+	return ctx, command.Run(ctx)
+}
+
+func (s *controllerInfoSuite) TestShowsControllerInfo(c *gc.C) {
+	ctx, err := s.runCmd(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+This controller:
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Series:       focal
+    HA nodes:     2
+    Models:       4
+
+Replica set juju:
+    ID  NAME            STATE      HEALTHY  MACHINE       LAG  NOTES
+    1   10.0.0.1:37017  primary    ✓        0             0s   connected
+    2   10.0.0.2:37017  secondary  ✓        1 (inferred)  3s   -
+    3   10.0.0.3:37017  arbiter    ✗        -             0s   arbiter
+Oplog window: 26h0m0s
+`)
+	s.database.CheckCallNames(c, "ControllerInfo", "ReplicaSet", "Close")
+}
+
+func (s *controllerInfoSuite) TestShowsBase(c *gc.C) {
+	s.database.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{
+			JujuVersion: version.MustParse("3.1.6"),
+			Base:        "ubuntu@22.04",
+		}, nil
+	}
+	ctx, err := s.runCmd(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Juju version: 3.1.6\n    Base:         ubuntu@22.04\n")
+}
+
+func (s *controllerInfoSuite) TestControllerInfoFails(c *gc.C) {
+	s.database.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{}, errors.New("no controller model")
+	}
+	ctx, err := s.runCmd(c)
+	c.Assert(err, gc.ErrorMatches, "getting controller info: no controller model")
+	// The replica set is still shown.
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasPrefix, "\nReplica set juju:\n")
+	s.database.CheckCallNames(c, "ControllerInfo", "ReplicaSet", "Close")
+}
+
+func (s *controllerInfoSuite) TestConnectFails(c *gc.C) {
+	s.dialErr = errors.New("no route to host")
+	_, err := s.runCmd(c)
+	c.Assert(err, gc.ErrorMatches, "connecting to database: no route to host")
+	c.Assert(err, jc.Satisfies, core.IsConnectivityError)
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/db"
+)
+
+// NewCreateBackupCommand creates a cmd.Command that takes a backup of
+// the controller in the standard Juju format. dumpDatabase is used to
+// dump the database, or dumpOplog the oplog for an incremental backup
+// following on from one read with openBackup, and createBackup to
+// write the backup file, with the controller's files collected from
+// under rootDir.
+func NewCreateBackupCommand(
+	dbConnect func(info db.DialInfo) (core.Database, error),
+	loadCreds func(agentConf string) ([]AgentConf, error),
+	dumpDatabase func(info db.DialInfo, dumpDir, logFile string) error,
+	dumpOplog func(info db.DialInfo, dumpDir, logFile string, since core.OplogPosition) error,
+	openBackup func(path, tempRoot string) (core.BackupFile, error),
+	createBackup func(path string, contents backup.Contents) error,
+	rootDir string,
+) cmd.Command {
+	return &createBackupCommand{
+		connect:      dbConnect,
+		loadCreds:    loadCreds,
+		dumpDatabase: dumpDatabase,
+		dumpOplog:    dumpOplog,
+		openBackup:   openBackup,
+		createBackup: createBackup,
+		rootDir:      rootDir,
+	}
+}
+
+type createBackupCommand struct {
+	cmd.CommandBase
+
+	connect      func(info db.DialInfo) (core.Database, error)
+	loadCreds    func(agentConf string) ([]AgentConf, error)
+	dumpDatabase func(info db.DialInfo, dumpDir, logFile string) error
+	dumpOplog    func(info db.DialInfo, dumpDir, logFile string, since core.OplogPosition) error
+	openBackup   func(path, tempRoot string) (core.BackupFile, error)
+	createBackup func(path string, contents backup.Contents) error
+	rootDir      string
+
+	output    string
+	notes     string
+	agentConf string
+	hostname  string
+	port      string
+	ssl       bool
+	tempRoot  string
+	dumpLog   string
+
+	// snapDumpDir, if set, is where the juju-db snap's mongodump
+	// writes the dump before it's moved into place.
+	snapDumpDir string
+
+	// incrementalFrom, if set, is the backup file an incremental
+	// backup follows on from.
+	incrementalFrom string
+}
+
+// Info is part of cmd.Command.
+func (c *createBackupCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore create-backup",
+		Purpose: "Take a backup of the controller that juju-restore can restore",
+		Doc:     createBackupDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *createBackupCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.output, "output", "", "file to write the backup to (default juju-backup-<date>-<time>.tar.gz)")
+	f.StringVar(&c.notes, "notes", "", "notes to store with the backup")
+	f.StringVar(&c.agentConf, "agent-conf", "", "agent.conf to get credentials from (default is the machine agent's for this controller machine)")
+	f.StringVar(&c.hostname, "hostname", "", "hostname of the Juju MongoDB server (default from agent.conf, or localhost)")
+	f.StringVar(&c.port, "port", "", "port of the Juju MongoDB server (default from agent.conf, or 37017)")
+	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to dump the database to before it's added to the backup")
+	f.StringVar(&c.dumpLog, "dump-log", "dump.log", "location to write mongodump logging output")
+	f.StringVar(&c.snapDumpDir, "snap-dump-dir", "", "location the juju-db snap's mongodump can write to (default is the snap's common dir for this user)")
+	f.StringVar(&c.incrementalFrom, "incremental-from", "", "take an incremental backup of the changes since this backup or incremental")
+}
+
+// Run is part of cmd.Command.
+func (c *createBackupCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	started := time.Now()
+	output := c.output
+	if output == "" {
+		output = "juju-backup-" + started.UTC().Format("20060102-150405") + ".tar.gz"
+	}
+	output = ctx.AbsPath(output)
+	// Check before the dump, which can take a while.
+	if _, err := os.Stat(output); err == nil {
+		return errors.Errorf("%s already exists", output)
+	}
+
+	creds, err := c.loadCreds(c.agentConf)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "loading credentials"))
+	}
+	settings := connectionSettings{
+		Hostname: c.hostname,
+		Port:     c.port,
+		SSL:      c.ssl,
+	}
+	if c.snapDumpDir != "" {
+		settings.SnapDumpDir = ctx.AbsPath(c.snapDumpDir)
+	}
+	ui.Notify("Connecting to database... ")
+	database, conf, err := connectWithCreds(c.connect, settings, creds)
+	if err != nil {
+		ui.Notify("✗\n")
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "connecting to database"))
+	}
+	defer database.Close()
+	ui.Notify("✓\n")
+
+	controller, err := database.ControllerInfo()
+	if err != nil {
+		return errors.Annotate(err, "getting controller info")
+	}
+	machineID, err := localMachineID(database, conf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tempDir, err := ioutil.TempDir(c.tempRoot, "juju-restore")
+	if err != nil {
+		return errors.Annotatef(err, "creating temp directory in %q", c.tempRoot)
+	}
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			logger.Errorf("couldn't remove temp dir %q: %s", tempDir, err)
+		}
+	}()
+	metadata := core.BackupMetadata{
+		ControllerModelUUID: controller.ControllerModelUUID,
+		ControllerUUID:      controller.ControllerUUID,
+		JujuVersion:         controller.JujuVersion,
+		Series:              controller.Series,
+		BackupCreated:       started,
+		Hostname:            hostname,
+		HANodes:             controller.HANodes,
+	}
+	dumpDir := filepath.Join(tempDir, "dump")
+	if c.incrementalFrom == "" {
+		// Record where the oplog is before the dump so an incremental
+		// can follow on even if nothing changes while dumping.
+		metadata.OplogEnd, err = database.LatestOplogPosition()
+		if err != nil {
+			return errors.Annotate(err, "getting oplog position")
+		}
+		ui.Notify("Dumping database... ")
+		err = c.dumpDatabase(settings.dialInfo(conf), dumpDir, c.dumpLog)
+	} else {
+		var parent core.BackupMetadata
+		parent, err = c.readParent(controller)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		metadata.ParentID = parent.ID
+		metadata.OplogStart = parent.OplogEnd
+		ui.Notify(fmt.Sprintf("Dumping oplog since %s... ", parent.OplogEnd.Time()))
+		err = c.dumpOplog(settings.dialInfo(conf), dumpDir, c.dumpLog, parent.OplogEnd)
+	}
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotatef(err, "dumping database (see %s)", c.dumpLog)
+	}
+	ui.Notify("✓\n")
+
+	ui.Notify("Writing backup file... ")
+	err = c.createBackup(output, backup.Contents{
+		DumpDir:   dumpDir,
+		RootDir:   c.rootDir,
+		MachineID: machineID,
+		Notes:     c.notes,
+		Metadata:  metadata,
+	})
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "writing backup file")
+	}
+	ui.Notify("✓\n")
+	ui.Notify(populate(backupCreatedTemplate, struct {
+		Path      string
+		MachineID string
+		ParentID  string
+		core.ControllerInfo
+	}{output, machineID, metadata.ParentID, controller}))
+	return nil
+}
+
+// readParent gets the metadata of the backup an incremental backup
+// follows on from, checking that it's from this controller.
+func (c *createBackupCommand) readParent(controller core.ControllerInfo) (core.BackupMetadata, error) {
+	parent, err := c.openBackup(c.incrementalFrom, c.tempRoot)
+	if err != nil {
+		return core.BackupMetadata{}, errors.Annotatef(err, "opening %q", c.incrementalFrom)
+	}
+	metadata, err := parent.Metadata()
+	if closeErr := parent.Close(); closeErr != nil {
+		logger.Warningf("removing unpacked backup: %v", closeErr)
+	}
+	if err != nil {
+		return core.BackupMetadata{}, errors.Annotatef(err, "reading metadata from %q", c.incrementalFrom)
+	}
+	if metadata.ControllerModelUUID != controller.ControllerModelUUID {
+		return core.BackupMetadata{}, errors.Errorf("%s is a backup of a different controller (model %q, not %q)",
+			c.incrementalFrom, metadata.ControllerModelUUID, controller.ControllerModelUUID)
+	}
+	if metadata.ID == "" || metadata.OplogEnd == 0 {
+		return core.BackupMetadata{}, errors.Errorf("%s doesn't record its ID and oplog position, so incrementals can't follow it", c.incrementalFrom)
+	}
+	return metadata, nil
+}
+
+// localMachineID returns the Juju machine ID of the replica set
+// member the database connection is to, falling back to the
+// agent.conf's machine if the member isn't tagged.
+func localMachineID(database core.Database, conf AgentConf) (string, error) {
+	replicaSet, err := database.ReplicaSet()
+	if err != nil {
+		return "", errors.Annotate(err, "getting replica set")
+	}
+	for _, member := range replicaSet.Members {
+		if member.Self && member.JujuMachineID != "" {
+			return member.JujuMachineID, nil
+		}
+	}
+	if strings.HasPrefix(conf.Username, "machine-") {
+		return strings.TrimPrefix(conf.Username, "machine-"), nil
+	}
+	return "", errors.Errorf("couldn't find the machine ID of this controller machine")
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+	"github.com/juju/juju-restore/db"
+)
+
+type createBackupSuite struct {
+	testing.IsolationSuite
+
+	database   *coretesting.Database
+	dumpInfo   db.DialInfo
+	dumpErr    error
+	oplogSince core.OplogPosition
+	parent     core.BackupMetadata
+	path       string
+	contents   backup.Contents
+}
+
+var _ = gc.Suite(&createBackupSuite{})
+
+func (s *createBackupSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.database = &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{Members: []core.ReplicaSetMember{
+				{ID: 1, Name: "10.0.0.1:37017", Self: true, State: "PRIMARY", JujuMachineID: "2"},
+			}}, nil
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				ControllerModelUUID: "how-bizarre-uuid",
+				ControllerUUID:      "controller-uuid",
+				JujuVersion:         version.MustParse("2.9.37"),
+				Series:              "focal",
+				HANodes:             1,
+				Models:              3,
+			}, nil
+		},
+	}
+	s.dumpInfo = db.DialInfo{}
+	s.database.OplogPosition = 1234 << 32
+	s.dumpErr = nil
+	s.oplogSince = 0
+	s.parent = core.BackupMetadata{
+		ControllerModelUUID: "how-bizarre-uuid",
+		ID:                  "20200317-162824.how-bizarre-uuid",
+		OplogEnd:            core.NewOplogPosition(time.Date(2020, 3, 17, 16, 28, 30, 0, time.UTC), 2),
+	}
+	s.path = ""
+	s.contents = backup.Contents{}
+}
+
+func (s *createBackupSuite) runCmd(c *gc.C, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewCreateBackupCommand(
+		func(info db.DialInfo) (core.Database, error) {
+			return s.database, nil
+		},
+		func(agentConf string) ([]cmd.AgentConf, error) {
+			return []cmd.AgentConf{{
+				Path:     "/var/lib/juju/agents/machine-2/agent.conf",
+				Username: "machine-2",
+				Password: "secret",
+			}}, nil
+		},
+		func(info db.DialInfo, dumpDir, logFile string) error {
+			s.dumpInfo = info
+			if s.dumpErr != nil {
+				return s.dumpErr
+			}
+			return os.MkdirAll(dumpDir, 0700)
+		},
+		func(info db.DialInfo, dumpDir, logFile string, since core.OplogPosition) error {
+			s.dumpInfo = info
+			s.oplogSince = since
+			if s.dumpErr != nil {
+				return s.dumpErr
+			}
+			return os.MkdirAll(dumpDir, 0700)
+		},
+		func(path, tempRoot string) (core.BackupFile, error) {
+			c.Assert(path, gc.Equals, "full.tar.gz")
+			return &coretesting.BackupFile{
+				MetadataF: func() (core.BackupMetadata, error) {
+					return s.parent, nil
+				},
+			}, nil
+		},
+		func(path string, contents backup.Contents) error {
+			s.path = path
+			s.contents = contents
+			// The dump is still there to be added.
+			c.Assert(contents.DumpDir, jc.IsDirectory)
+			return nil
+		},
+		"/root-dir",
+	)
+	ctx := cmdtesting.Context(c)
+	ctx.Dir = c.MkDir()
+	err := cmdtesting.InitCommand(command, args)
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, command.Run(ctx)
+}
+
+func (s *createBackupSuite) TestCreateBackup(c *gc.C) {
+	ctx, err := s.runCmd(c, "--output", "backup.tar.gz", "--notes", "before upgrade", "--temp-root", c.MkDir())
+	c.Assert(err, jc.ErrorIsNil)
+	path := filepath.Join(ctx.Dir, "backup.tar.gz")
+	c.Assert(s.path, gc.Equals, path)
+	c.Assert(s.dumpInfo, jc.DeepEquals, db.DialInfo{
+		Hostname: "localhost",
+		Port:     "37017",
+		Username: "machine-2",
+		Password: "secret",
+		SSL:      true,
+	})
+	c.Assert(s.contents.RootDir, gc.Equals, "/root-dir")
+	c.Assert(s.contents.MachineID, gc.Equals, "2")
+	c.Assert(s.contents.Notes, gc.Equals, "before upgrade")
+	metadata := s.contents.Metadata
+	c.Assert(metadata.ControllerUUID, gc.Equals, "controller-uuid")
+	c.Assert(metadata.ControllerModelUUID, gc.Equals, "how-bizarre-uuid")
+	c.Assert(metadata.JujuVersion, gc.Equals, version.MustParse("2.9.37"))
+	c.Assert(metadata.Series, gc.Equals, "focal")
+	c.Assert(metadata.HANodes, gc.Equals, 1)
+	c.Assert(metadata.BackupCreated.IsZero(), jc.IsFalse)
+	c.Assert(metadata.OplogEnd, gc.Equals, core.OplogPosition(1234<<32))
+	c.Assert(metadata.Incremental(), jc.IsFalse)
+	// The temporary dump is removed.
+	c.Assert(s.contents.DumpDir, jc.DoesNotExist)
+
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, (`
+Connecting to database... ✓
+Dumping database... ✓
+Writing backup file... ✓
+
+Backup written to ` + path + `:
+    Controller:   controller-uuid
+    Machine:      2
+    Juju version: 2.9.37
+    Models:       3
+`)[1:])
+}
+
+func (s *createBackupSuite) TestCreateIncrementalBackup(c *gc.C) {
+	ctx, err := s.runCmd(c, "--incremental-from", "full.tar.gz", "--output", "incremental.tar.gz", "--temp-root", c.MkDir())
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.oplogSince, gc.Equals, s.parent.OplogEnd)
+	metadata := s.contents.Metadata
+	c.Assert(metadata.ParentID, gc.Equals, "20200317-162824.how-bizarre-uuid")
+	c.Assert(metadata.OplogStart, gc.Equals, s.parent.OplogEnd)
+	c.Assert(metadata.Incremental(), jc.IsTrue)
+	// The position comes from the parent, not the database.
+	s.database.CheckCallNames(c, "ControllerInfo", "ReplicaSet", "Close")
+
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, (`
+Connecting to database... ✓
+Dumping oplog since 2020-03-17 16:28:30 +0000 UTC... ✓
+Writing backup file... ✓
+
+Backup written to ` + filepath.Join(ctx.Dir, "incremental.tar.gz") + `:
+    Controller:   controller-uuid
+    Machine:      2
+    Juju version: 2.9.37
+    Models:       3
+    Follows:      20200317-162824.how-bizarre-uuid
+`)[1:])
+}
+
+func (s *createBackupSuite) TestIncrementalFromOtherController(c *gc.C) {
+	s.parent.ControllerModelUUID = "different-uuid"
+	_, err := s.runCmd(c, "--incremental-from", "full.tar.gz", "--temp-root", c.MkDir())
+	c.Assert(err, gc.ErrorMatches, `full.tar.gz is a backup of a different controller \(model "different-uuid", not "how-bizarre-uuid"\)`)
+	c.Assert(s.path, gc.Equals, "")
+
+	s.parent.ControllerModelUUID = "how-bizarre-uuid"
+	s.parent.OplogEnd = 0
+	_, err = s.runCmd(c, "--incremental-from", "full.tar.gz", "--temp-root", c.MkDir())
+	c.Assert(err, gc.ErrorMatches, "full.tar.gz doesn't record its ID and oplog position, so incrementals can't follow it")
+}
+
+func (s *createBackupSuite) TestIncrementalDumpFails(c *gc.C) {
+	s.dumpErr = errors.New("the oplog no longer goes back to 2020-03-17 16:28:30 +0000 UTC - take a full backup instead")
+	_, err := s.runCmd(c, "--incremental-from", "full.tar.gz", "--temp-root", c.MkDir())
+	c.Assert(err, gc.ErrorMatches, `dumping database \(see dump.log\): the oplog no longer goes back .*`)
+	c.Assert(s.path, gc.Equals, "")
+}
+
+func (s *createBackupSuite) TestSnapDumpDir(c *gc.C) {
+	ctx, err := s.runCmd(c, "--output", "backup.tar.gz", "--temp-root", c.MkDir(), "--snap-dump-dir", "staging")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.dumpInfo.SnapDumpDir, gc.Equals, filepath.Join(ctx.Dir, "staging"))
+}
+
+func (s *createBackupSuite) TestMachineIDFromAgentConf(c *gc.C) {
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		return core.ReplicaSet{Members: []core.ReplicaSetMember{{ID: 1, Self: true}}}, nil
+	}
+	_, err := s.runCmd(c, "--temp-root", c.MkDir())
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.contents.MachineID, gc.Equals, "2")
+	c.Assert(filepath.Base(s.path), gc.Matches, `juju-backup-\d{8}-\d{6}\.tar\.gz`)
+}
+
+func (s *createBackupSuite) TestDumpFails(c *gc.C) {
+	s.dumpErr = errors.New("running mongodump: exit status 1")
+	_, err := s.runCmd(c, "--temp-root", c.MkDir())
+	c.Assert(err, gc.ErrorMatches, `dumping database \(see dump.log\): running mongodump: exit status 1`)
+	c.Assert(s.path, gc.Equals, "")
+}
+
+func (s *createBackupSuite) TestOutputExists(c *gc.C) {
+	output := filepath.Join(c.MkDir(), "backup.tar.gz")
+	err := ioutil.WriteFile(output, []byte("precious"), 0600)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.runCmd(c, "--output", output)
+	c.Assert(err, gc.ErrorMatches, ".*backup.tar.gz already exists")
+	c.Assert(s.database.Calls(), gc.HasLen, 0)
+}
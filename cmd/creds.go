@@ -0,0 +1,219 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/db"
+)
+
+// NewCredsCommand creates a cmd.Command that shows the database
+// connection details juju-restore would use, and checks that they
+// work.
+func NewCredsCommand(
+	dbConnect func(info db.DialInfo) (core.Database, error),
+	loadCreds func(agentConf string) ([]AgentConf, error),
+) cmd.Command {
+	return &credsCommand{
+		connect:   dbConnect,
+		loadCreds: loadCreds,
+	}
+}
+
+type credsCommand struct {
+	cmd.CommandBase
+
+	connect   func(info db.DialInfo) (core.Database, error)
+	loadCreds func(agentConf string) ([]AgentConf, error)
+
+	agentConf string
+	hostname  string
+	port      string
+	ssl       bool
+}
+
+// Info is part of cmd.Command.
+func (c *credsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore creds",
+		Purpose: "Show the database credentials and address juju-restore would use",
+		Doc:     credsDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *credsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.agentConf, "agent-conf", "", "agent.conf to get credentials from (default is to try each machine agent's)")
+	f.StringVar(&c.hostname, "hostname", "", "hostname of the Juju MongoDB server (default from agent.conf, or localhost)")
+	f.StringVar(&c.port, "port", "", "port of the Juju MongoDB server (default from agent.conf, or 37017)")
+	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB")
+}
+
+// Run is part of cmd.Command.
+func (c *credsCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	creds, err := c.loadCreds(c.agentConf)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "loading credentials"))
+	}
+	settings := connectionSettings{
+		Hostname: c.hostname,
+		Port:     c.port,
+		SSL:      c.ssl,
+	}
+	for _, conf := range creds {
+		ui.Notify(populate(credsTemplate, settings.describe(conf)))
+	}
+
+	ui.Notify("\nConnecting to database... ")
+	database, conf, err := connectWithCreds(c.connect, settings, creds)
+	if err != nil {
+		ui.Notify("✗\n")
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "connecting to database"))
+	}
+	database.Close()
+	ui.Notify(fmt.Sprintf("✓\nUsing credentials from %s.\n", conf.Path))
+	return nil
+}
+
+// connectionSettings hold the database address and SSL options, which
+// override the address from agent.conf.
+type connectionSettings struct {
+	Hostname string
+	Port     string
+	SSL      bool
+
+	// DefaultHostname is used if neither the options nor
+	// agent.conf give a hostname, defaulting to localhost.
+	DefaultHostname string
+
+	// SnapDumpDir is where dumps are staged for the juju-db snap's
+	// tools, found from the snap if it's empty.
+	SnapDumpDir string
+}
+
+// describe returns the details shown for connecting with the
+// credentials passed in.
+func (s connectionSettings) describe(conf AgentConf) credsInfo {
+	info := credsInfo{
+		AgentConf: conf,
+		SSL:       s.SSL,
+		Hostname:  connectionSetting{conf.Hostname, "agent.conf"},
+		Port:      connectionSetting{conf.Port, "agent.conf"},
+	}
+	if s.Hostname != "" {
+		info.Hostname = connectionSetting{s.Hostname, "--hostname"}
+	} else if info.Hostname.Value == "" {
+		info.Hostname = connectionSetting{s.DefaultHostname, "default"}
+		if info.Hostname.Value == "" {
+			info.Hostname.Value = defaultHostname
+		}
+	}
+	if s.Port != "" {
+		info.Port = connectionSetting{s.Port, "--port"}
+	} else if info.Port.Value == "" {
+		info.Port = connectionSetting{defaultPort, "default"}
+	}
+	return info
+}
+
+// dialInfo returns the details for connecting with the credentials
+// passed in.
+func (s connectionSettings) dialInfo(conf AgentConf) db.DialInfo {
+	info := s.describe(conf)
+	return db.DialInfo{
+		Hostname:    info.Hostname.Value,
+		Port:        info.Port.Value,
+		Username:    conf.Username,
+		Password:    conf.Password,
+		SSL:         s.SSL,
+		CACert:      conf.CACert,
+		SnapDumpDir: s.SnapDumpDir,
+	}
+}
+
+// connectWithCreds connects to the database with the credentials
+// passed in. If there's more than one set, each is tried and the ones
+// for the local replica set member's machine agent are preferred,
+// since other agent.conf files can be left over from removed agents.
+func connectWithCreds(
+	connect func(info db.DialInfo) (core.Database, error),
+	settings connectionSettings,
+	creds []AgentConf,
+) (core.Database, AgentConf, error) {
+	if len(creds) == 1 {
+		database, err := connect(settings.dialInfo(creds[0]))
+		if err != nil {
+			return nil, AgentConf{}, errors.Trace(err)
+		}
+		return database, creds[0], nil
+	}
+	var (
+		fallback     core.Database
+		fallbackConf AgentConf
+		failures     []string
+	)
+	for _, conf := range creds {
+		database, err := connect(settings.dialInfo(conf))
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", conf.Path, err))
+			continue
+		}
+		if isLocalMachineAgent(database, conf) {
+			if fallback != nil {
+				fallback.Close()
+			}
+			return database, conf, nil
+		}
+		if fallback != nil {
+			database.Close()
+			continue
+		}
+		fallback, fallbackConf = database, conf
+	}
+	if fallback == nil {
+		return nil, AgentConf{}, errors.Errorf("couldn't connect with any agent.conf:\n    %s", strings.Join(failures, "\n    "))
+	}
+	logger.Warningf("none of the agent.conf files are for this machine's agent, using %s", fallbackConf.Path)
+	return fallback, fallbackConf, nil
+}
+
+// isLocalMachineAgent returns true if the credentials are for the
+// machine agent of the replica set member the database connection is
+// to.
+func isLocalMachineAgent(database core.Database, conf AgentConf) bool {
+	replicaSet, err := database.ReplicaSet()
+	if err != nil {
+		logger.Debugf("getting replica set with %s: %v", conf.Path, err)
+		return false
+	}
+	for _, member := range replicaSet.Members {
+		if member.Self {
+			return member.JujuMachineID != "" && conf.Username == "machine-"+member.JujuMachineID
+		}
+	}
+	return false
+}
+
+// credsInfo is what the creds command shows for an agent.conf.
+type credsInfo struct {
+	AgentConf
+	Hostname connectionSetting
+	Port     connectionSetting
+	SSL      bool
+}
+
+// connectionSetting is a connection detail and where it came from.
+type connectionSetting struct {
+	Value  string
+	Source string
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+	"github.com/juju/juju-restore/db"
+)
+
+type credsSuite struct {
+	testing.IsolationSuite
+
+	database  *coretesting.Database
+	dialInfo  db.DialInfo
+	dialErr   error
+	confs     []cmd.AgentConf
+	confErr   error
+	agentConf string
+}
+
+var _ = gc.Suite(&credsSuite{})
+
+func (s *credsSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.database = &coretesting.Database{}
+	s.dialInfo = db.DialInfo{}
+	s.dialErr = nil
+	s.confs = []cmd.AgentConf{{
+		Path:     "/var/lib/juju/agents/machine-0/agent.conf",
+		Username: "machine-0",
+		Password: "secret",
+		Port:     "37017",
+		CACert:   "ca cert",
+	}}
+	s.confErr = nil
+	s.agentConf = ""
+}
+
+func (s *credsSuite) runCmd(c *gc.C, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewCredsCommand(
+		func(info db.DialInfo) (core.Database, error) {
+			s.dialInfo = info
+			if s.dialErr != nil {
+				return nil, s.dialErr
+			}
+			return s.database, nil
+		},
+		func(agentConf string) ([]cmd.AgentConf, error) {
+			s.agentConf = agentConf
+			return s.confs, s.confErr
+		},
+	)
+	err := cmdtesting.InitCommand(command, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx := cmdtesting.Context(c)
+	return ctx, command.Run(ctx)
+}
+
+func (s *credsSuite) TestShowsCreds(c *gc.C) {
+	ctx, err := s.runCmd(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+
+Credentials from /var/lib/juju/agents/machine-0/agent.conf:
+    Username: machine-0
+    Password: set
+    CA cert:  present
+Database:
+    Hostname: localhost (default)
+    Port:     37017 (agent.conf)
+    SSL:      on
+
+Connecting to database... ✓
+Using credentials from /var/lib/juju/agents/machine-0/agent.conf.
+`[1:])
+	c.Assert(s.dialInfo, gc.DeepEquals, db.DialInfo{
+		Hostname: "localhost",
+		Port:     "37017",
+		Username: "machine-0",
+		Password: "secret",
+		SSL:      true,
+		CACert:   "ca cert",
+	})
+	s.database.CheckCallNames(c, "Close")
+}
+
+func (s *credsSuite) TestOverrides(c *gc.C) {
+	ctx, err := s.runCmd(c, "--hostname", "db.local", "--port", "37018", "--ssl=false")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Hostname: db.local (--hostname)
+    Port:     37018 (--port)
+    SSL:      off
+`)
+	c.Assert(s.dialInfo.Hostname, gc.Equals, "db.local")
+	c.Assert(s.dialInfo.Port, gc.Equals, "37018")
+	c.Assert(s.dialInfo.SSL, jc.IsFalse)
+}
+
+func (s *credsSuite) TestConnectionFails(c *gc.C) {
+	s.dialErr = errors.New("auth failed")
+	ctx, err := s.runCmd(c)
+	c.Assert(err, gc.ErrorMatches, "connecting to database: auth failed")
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasSuffix, "\nConnecting to database... ✗\n")
+}
+
+func (s *credsSuite) TestLoadingCredsFails(c *gc.C) {
+	s.confErr = errors.New("couldn't find an agent.conf - please specify username and password")
+	_, err := s.runCmd(c)
+	c.Assert(err, gc.ErrorMatches, "loading credentials: couldn't find an agent.conf.*")
+}
+
+func (s *credsSuite) TestAgentConf(c *gc.C) {
+	_, err := s.runCmd(c, "--agent-conf", "/var/lib/juju/agents/machine-0/agent.conf")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.agentConf, gc.Equals, "/var/lib/juju/agents/machine-0/agent.conf")
+}
+
+func (s *credsSuite) TestChoosesLocalMachineAgent(c *gc.C) {
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		return core.ReplicaSet{
+			Name: "juju",
+			Members: []core.ReplicaSetMember{{
+				Name:          "10.0.0.1:37017",
+				Self:          true,
+				JujuMachineID: "1",
+			}},
+		}, nil
+	}
+	s.confs = []cmd.AgentConf{{
+		Path:     "/var/lib/juju/agents/machine-0/agent.conf",
+		Username: "machine-0",
+		Password: "stale",
+	}, {
+		Path:     "/var/lib/juju/agents/machine-1/agent.conf",
+		Username: "machine-1",
+		Password: "secret",
+	}}
+	ctx, err := s.runCmd(c)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "\nCredentials from /var/lib/juju/agents/machine-0/agent.conf:\n")
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasSuffix, "Using credentials from /var/lib/juju/agents/machine-1/agent.conf.\n")
+	c.Assert(s.dialInfo.Password, gc.Equals, "secret")
+	s.database.CheckCallNames(c, "ReplicaSet", "ReplicaSet", "Close", "Close")
+}
+
+func (s *credsSuite) TestNoCredsConnect(c *gc.C) {
+	s.dialErr = errors.New("auth failed")
+	s.confs = append(s.confs, cmd.AgentConf{
+		Path:     "/var/lib/juju/agents/machine-1/agent.conf",
+		Username: "machine-1",
+		Password: "stale",
+	})
+	_, err := s.runCmd(c)
+	c.Assert(err, gc.ErrorMatches, `connecting to database: couldn't connect with any agent.conf:
+    /var/lib/juju/agents/machine-0/agent.conf: auth failed
+    /var/lib/juju/agents/machine-1/agent.conf: auth failed`)
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/backup"
+)
+
+// NewDiffCommand creates a cmd.Command that summarises what changed
+// between two backup files with diff.
+func NewDiffCommand(diff func(fromPath, toPath, tempRoot string) (backup.BackupDiff, error)) cmd.Command {
+	return &diffCommand{diff: diff}
+}
+
+type diffCommand struct {
+	cmd.CommandBase
+
+	diff func(fromPath, toPath, tempRoot string) (backup.BackupDiff, error)
+
+	tempRoot string
+	fromFile string
+	toFile   string
+}
+
+// Info is part of cmd.Command.
+func (c *diffCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore diff",
+		Args:    "<backup A> <backup B>",
+		Purpose: "Summarise what changed between two backup files",
+		Doc:     diffDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *diffCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack the backup files while comparing them")
+}
+
+// Init is part of cmd.Command.
+func (c *diffCommand) Init(args []string) error {
+	switch len(args) {
+	case 0:
+		return errors.New("missing backup files")
+	case 1:
+		return errors.New("missing second backup file")
+	}
+	c.fromFile, c.toFile, args = args[0], args[1], args[2:]
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *diffCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	ui.Notify("Comparing backups... ")
+	diff, err := c.diff(ctx.AbsPath(c.fromFile), ctx.AbsPath(c.toFile), c.tempRoot)
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "comparing backups")
+	}
+	ui.Notify("✓\n")
+	ui.Notify(populate(diffTemplate, newDiffSummary(c.fromFile, c.toFile, diff)))
+	return nil
+}
+
+// diffRow is a value that differs between the two backups.
+type diffRow struct {
+	Name string
+	From string
+	To   string
+}
+
+// diffSummary is the diff laid out for diffTemplate.
+type diffSummary struct {
+	From          string
+	To            string
+	Created       diffRow
+	Gap           string
+	Metadata      []diffRow
+	ModelsAdded   []string
+	ModelsRemoved []string
+	Collections   []diffRow
+	Settings      []diffRow
+}
+
+func newDiffSummary(fromFile, toFile string, diff backup.BackupDiff) diffSummary {
+	summary := diffSummary{
+		From:          fromFile,
+		To:            toFile,
+		ModelsAdded:   diff.ModelsAdded,
+		ModelsRemoved: diff.ModelsRemoved,
+		Created: diffRow{
+			From: diff.From.BackupCreated.UTC().Format(time.RFC3339),
+			To:   diff.To.BackupCreated.UTC().Format(time.RFC3339),
+		},
+	}
+	// The gap is how much would be lost restoring A rather than B.
+	gap := diff.To.BackupCreated.Sub(diff.From.BackupCreated)
+	if gap >= 0 {
+		summary.Gap = fmt.Sprintf("B is %s newer", gap)
+	} else {
+		summary.Gap = fmt.Sprintf("B is %s older", -gap)
+	}
+
+	for _, row := range []diffRow{
+		{"Controller", diff.From.ControllerUUID, diff.To.ControllerUUID},
+		{"Model", diff.From.ControllerModelUUID, diff.To.ControllerModelUUID},
+		{"Juju version", diff.From.JujuVersion.String(), diff.To.JujuVersion.String()},
+		{"Series", diff.From.Series, diff.To.Series},
+		{"Hostname", diff.From.Hostname, diff.To.Hostname},
+	} {
+		if row.From != row.To {
+			summary.Metadata = append(summary.Metadata, row)
+		}
+	}
+
+	countText := func(count int) string {
+		if count < 0 {
+			return "missing"
+		}
+		return strconv.Itoa(count)
+	}
+	for _, collection := range diff.Collections {
+		summary.Collections = append(summary.Collections, diffRow{
+			Name: collection.Name,
+			From: countText(collection.From),
+			To:   countText(collection.To),
+		})
+	}
+
+	settingText := func(value string, set bool) string {
+		if !set {
+			return "not set"
+		}
+		return strconv.Quote(value)
+	}
+	for _, setting := range diff.Settings {
+		summary.Settings = append(summary.Settings, diffRow{
+			Name: setting.Name,
+			From: settingText(setting.From, setting.FromSet),
+			To:   settingText(setting.To, setting.ToSet),
+		})
+	}
+	return summary
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+)
+
+type diffSuite struct {
+	testing.IsolationSuite
+
+	fromPath string
+	toPath   string
+	result   backup.BackupDiff
+	err      error
+}
+
+var _ = gc.Suite(&diffSuite{})
+
+func (s *diffSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	created := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	s.fromPath, s.toPath, s.err = "", "", nil
+	s.result = backup.BackupDiff{
+		From: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.37"),
+			BackupCreated:       created,
+		},
+		To: core.BackupMetadata{
+			ControllerModelUUID: "how-bizarre-uuid",
+			JujuVersion:         version.MustParse("2.9.38"),
+			BackupCreated:       created.Add(2 * time.Hour),
+		},
+	}
+}
+
+func (s *diffSuite) diff(fromPath, toPath, tempRoot string) (backup.BackupDiff, error) {
+	s.fromPath, s.toPath = fromPath, toPath
+	return s.result, s.err
+}
+
+func (s *diffSuite) TestDiff(c *gc.C) {
+	s.result.ModelsAdded = []string{"bob/slide (slide-uuid)"}
+	s.result.ModelsRemoved = []string{"admin/rain (rain-uuid)"}
+	s.result.Collections = []backup.CollectionDiff{
+		{Name: "juju.machines", From: 2, To: 3},
+		{Name: "juju.units", From: -1, To: 4},
+	}
+	s.result.Settings = []backup.SettingDiff{
+		{Name: "audit-log-max-size", From: "300M", To: "500M", FromSet: true, ToSet: true},
+		{Name: "max-logs-age", From: "72h", FromSet: true},
+	}
+	dir := c.MkDir()
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewDiffCommand(s.diff),
+		filepath.Join(dir, "a.tar.gz"), filepath.Join(dir, "b.tar.gz"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.fromPath, gc.Equals, filepath.Join(dir, "a.tar.gz"))
+	c.Assert(s.toPath, gc.Equals, filepath.Join(dir, "b.tar.gz"))
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Comparing backups... ✓\n"+`
+A: `+filepath.Join(dir, "a.tar.gz")+`
+B: `+filepath.Join(dir, "b.tar.gz")+`
+Created: 2020-03-17T16:28:24Z → 2020-03-17T18:28:24Z (B is 2h0m0s newer)
+Metadata:
+    Juju version: 2.9.37 → 2.9.38
+Models only in B:
+    bob/slide (slide-uuid)
+Models only in A:
+    admin/rain (rain-uuid)
+Document counts:
+    juju.machines: 2 → 3
+    juju.units: missing → 4
+Controller settings:
+    audit-log-max-size: "300M" → "500M"
+    max-logs-age: "72h" → not set
+`)
+}
+
+func (s *diffSuite) TestDiffNoChanges(c *gc.C) {
+	s.result.To = s.result.From
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewDiffCommand(s.diff), "a.tar.gz", "b.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasSuffix, `
+Created: 2020-03-17T16:28:24Z → 2020-03-17T16:28:24Z (B is 0s newer)
+No differences apart from when the backups were created.
+`)
+}
+
+func (s *diffSuite) TestDiffFails(c *gc.C) {
+	s.err = errors.New("reading a.tar.gz: boom")
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewDiffCommand(s.diff), "a.tar.gz", "b.tar.gz")
+	c.Assert(err, gc.ErrorMatches, "comparing backups: reading a.tar.gz: boom")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Comparing backups... ✗\n")
+}
+
+func (s *diffSuite) TestInitErrors(c *gc.C) {
+	for i, test := range []struct {
+		args     []string
+		errMatch string
+	}{{
+		errMatch: "missing backup files",
+	}, {
+		args:     []string{"a.tar.gz"},
+		errMatch: "missing second backup file",
+	}, {
+		args:     []string{"a.tar.gz", "b.tar.gz", "c.tar.gz"},
+		errMatch: `unrecognized args: \["c.tar.gz"\]`,
+	}} {
+		c.Logf("%d: %v", i, test.args)
+		_, err := cmdtesting.RunCommand(c, cmd.NewDiffCommand(s.diff), test.args...)
+		c.Assert(err, gc.ErrorMatches, test.errMatch)
+	}
+}
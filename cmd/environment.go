@@ -0,0 +1,56 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// jujuDBPaths are where signs of the juju-db service can be found on
+// a controller machine, for the snap and older deb installs.
+var jujuDBPaths = []string{
+	"var/snap/juju-db/common",
+	"etc/systemd/system/juju-db.service",
+	"lib/systemd/system/juju-db.service",
+}
+
+// ControllerEvidence records what was found on a machine that shows
+// whether it's a Juju controller machine.
+type ControllerEvidence struct {
+	// AgentDirs are the machine agent directories found.
+	AgentDirs []string
+
+	// JujuDB is where the juju-db service was found, or empty if it
+	// wasn't.
+	JujuDB string
+}
+
+// IsController returns true if there's a machine agent and juju-db on
+// the machine.
+func (e ControllerEvidence) IsController() bool {
+	return len(e.AgentDirs) > 0 && e.JujuDB != ""
+}
+
+// DetectController looks for a machine agent and the juju-db service
+// on this machine.
+func DetectController() ControllerEvidence {
+	return DetectControllerUnder("/")
+}
+
+// DetectControllerUnder looks for a machine agent and the juju-db
+// service in the filesystem under root.
+func DetectControllerUnder(root string) ControllerEvidence {
+	var result ControllerEvidence
+	// The pattern's fixed apart from the root, so Glob can't fail.
+	result.AgentDirs, _ = filepath.Glob(filepath.Join(root, filepath.Dir(agentConfPattern)))
+	for _, path := range jujuDBPaths {
+		path = filepath.Join(root, path)
+		if _, err := os.Stat(path); err == nil {
+			result.JujuDB = path
+			break
+		}
+	}
+	return result
+}
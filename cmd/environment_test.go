@@ -0,0 +1,41 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+)
+
+type environmentSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&environmentSuite{})
+
+func (s *environmentSuite) TestDetectController(c *gc.C) {
+	root := c.MkDir()
+	evidence := cmd.DetectControllerUnder(root)
+	c.Assert(evidence, gc.DeepEquals, cmd.ControllerEvidence{})
+	c.Assert(evidence.IsController(), jc.IsFalse)
+
+	agentDir := filepath.Join(root, "var/lib/juju/agents/machine-0")
+	c.Assert(os.MkdirAll(agentDir, 0755), jc.ErrorIsNil)
+	c.Assert(os.MkdirAll(filepath.Join(root, "var/lib/juju/agents/unit-ubuntu-0"), 0755), jc.ErrorIsNil)
+	evidence = cmd.DetectControllerUnder(root)
+	c.Assert(evidence.AgentDirs, gc.DeepEquals, []string{agentDir})
+	c.Assert(evidence.IsController(), jc.IsFalse)
+
+	jujuDB := filepath.Join(root, "var/snap/juju-db/common")
+	c.Assert(os.MkdirAll(jujuDB, 0755), jc.ErrorIsNil)
+	evidence = cmd.DetectControllerUnder(root)
+	c.Assert(evidence.JujuDB, gc.Equals, jujuDB)
+	c.Assert(evidence.IsController(), jc.IsTrue)
+}
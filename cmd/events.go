@@ -0,0 +1,224 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// runEvent is sent to event stream clients as a line of JSON.
+type runEvent struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Phase string    `json:"phase,omitempty"`
+	Node  string    `json:"node,omitempty"`
+	// Message holds the warning for warning events, the action
+	// taken for change events (when Node is what was changed) and a
+	// line of a script's output for output events.
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Progress is the percentage of the run's phases finished.
+	Progress int `json:"progress"`
+}
+
+const (
+	eventPhaseStarted  = "phase-started"
+	eventPhaseFinished = "phase-finished"
+	eventNode          = "node"
+	eventWarning       = "warning"
+	eventChange        = "change"
+	eventOutput        = "output"
+	eventFinished      = "finished"
+)
+
+// eventWriteTimeout is how long a client can take to accept an event
+// before it's disconnected.
+const eventWriteTimeout = 5 * time.Second
+
+// eventClientBuffer is how many events can be waiting for a client
+// (besides the ones replayed when it connects) before it's dropped
+// for falling behind.
+const eventClientBuffer = 256
+
+// eventStream sends the events of a run to clients connected to a
+// Unix socket. Clients are sent the events so far when they connect,
+// so they don't miss any by connecting late. Each client has its own
+// writer, so one that stops reading can't hold up the run.
+type eventStream struct {
+	path     string
+	listener net.Listener
+
+	mu      sync.Mutex
+	events  [][]byte
+	clients []*eventClient
+	closed  bool
+	done    chan struct{}
+	writers sync.WaitGroup
+}
+
+// eventClient is a connection with the events waiting to be written
+// to it.
+type eventClient struct {
+	conn    net.Conn
+	pending chan []byte
+}
+
+// newEventStream starts listening for clients on a socket at path,
+// which mustn't exist. Only the user running juju-restore can
+// connect, since the events name the controller's machines and show
+// the output of scripts run on them.
+func newEventStream(path string) (*eventStream, error) {
+	// The socket is created in a directory only we can get into and
+	// made private there, then linked into place, so there's no
+	// window when anyone else could connect. (Narrowing the umask
+	// instead would affect files created by the rest of the process
+	// meanwhile.)
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".juju-restore-events")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "socket")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// The name it was created with goes with the directory; Close
+	// removes path.
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		return nil, errors.Trace(err)
+	}
+	if err := os.Link(private, path); err != nil {
+		listener.Close()
+		return nil, errors.Trace(err)
+	}
+	s := &eventStream{
+		path:     path,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *eventStream) accept() {
+	defer close(s.done)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		client := &eventClient{
+			conn:    conn,
+			pending: make(chan []byte, len(s.events)+eventClientBuffer),
+		}
+		for _, event := range s.events {
+			client.pending <- event
+		}
+		s.clients = append(s.clients, client)
+		s.writers.Add(1)
+		go s.write(client)
+		s.mu.Unlock()
+	}
+}
+
+// write sends the client's events to it until they run out, dropping
+// it if a write fails.
+func (s *eventStream) write(client *eventClient) {
+	defer s.writers.Done()
+	defer client.conn.Close()
+	for event := range client.pending {
+		_ = client.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := client.conn.Write(event); err != nil {
+			logger.Debugf("dropping event stream client: %v", err)
+			s.mu.Lock()
+			s.drop(client)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// drop stops sending events to a client and disconnects it once its
+// writer has finished. It must be called with the lock held.
+func (s *eventStream) drop(client *eventClient) {
+	for i, c := range s.clients {
+		if c == client {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			close(client.pending)
+			return
+		}
+	}
+}
+
+// send records the event and sends it to the connected clients.
+func (s *eventStream) send(event runEvent) {
+	event.Time = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("encoding event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, data)
+	for _, client := range append([]*eventClient(nil), s.clients...) {
+		select {
+		case client.pending <- data:
+		default:
+			logger.Debugf("dropping event stream client: too far behind")
+			s.drop(client)
+			client.conn.Close()
+		}
+	}
+}
+
+// Close gives the clients a little time to receive the remaining
+// events, then disconnects them and removes the socket.
+func (s *eventStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	clients := append([]*eventClient(nil), s.clients...)
+	for len(s.clients) > 0 {
+		s.drop(s.clients[0])
+	}
+	s.mu.Unlock()
+	err := s.listener.Close()
+	<-s.done
+
+	flushed := make(chan struct{})
+	go func() {
+		s.writers.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(eventWriteTimeout):
+		for _, client := range clients {
+			client.conn.Close()
+		}
+		<-flushed
+	}
+	if removeErr := os.Remove(s.path); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+		err = removeErr
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type eventStreamSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&eventStreamSuite{})
+
+func (s *eventStreamSuite) TestSocketOnlyForOwner(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "events.sock")
+	stream, err := newEventStream(path)
+	c.Assert(err, jc.ErrorIsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0600))
+	// The private directory it was made in is gone, and clients can
+	// connect at path.
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	conn, err := net.Dial("unix", path)
+	c.Assert(err, jc.ErrorIsNil)
+	conn.Close()
+
+	c.Assert(stream.Close(), jc.ErrorIsNil)
+	_, err = os.Stat(path)
+	c.Assert(err, jc.Satisfies, os.IsNotExist)
+}
+
+func (s *eventStreamSuite) TestSocketPathExists(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "events.sock")
+	c.Assert(ioutil.WriteFile(path, nil, 0600), jc.ErrorIsNil)
+	_, err := newEventStream(path)
+	c.Assert(err, gc.ErrorMatches, "link .*: file exists")
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 1)
+}
+
+func (s *eventStreamSuite) TestStalledClientDoesNotBlock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "events.sock")
+	stream, err := newEventStream(path)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// This client never reads.
+	stalled, err := net.Dial("unix", path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer stalled.Close()
+	reader, err := net.Dial("unix", path)
+	c.Assert(err, jc.ErrorIsNil)
+	defer reader.Close()
+	waitForClients(c, stream, 2)
+
+	lines := make(chan struct{}, eventClientBuffer)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			lines <- struct{}{}
+		}
+		close(lines)
+	}()
+
+	// Enough output to fill the stalled client's socket buffer and
+	// its queue many times over. The reader is kept up to date so
+	// only the stalled client falls behind.
+	message := strings.Repeat("x", 4096)
+	const batch, batches = 50, 40
+	deadline := time.After(testing.LongWait)
+	for i := 0; i < batches; i++ {
+		start := time.Now()
+		for j := 0; j < batch; j++ {
+			stream.send(runEvent{Type: eventOutput, Message: message})
+		}
+		c.Assert(time.Since(start) < eventWriteTimeout, jc.IsTrue)
+		for j := 0; j < batch; j++ {
+			select {
+			case _, ok := <-lines:
+				c.Assert(ok, jc.IsTrue)
+			case <-deadline:
+				c.Fatalf("timed out waiting for events")
+			}
+		}
+	}
+	waitForClients(c, stream, 1)
+	c.Assert(stream.Close(), jc.ErrorIsNil)
+}
+
+func waitForClients(c *gc.C, stream *eventStream, n int) {
+	deadline := time.Now().Add(testing.LongWait)
+	for time.Now().Before(deadline) {
+		stream.mu.Lock()
+		count := len(stream.clients)
+		stream.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %d clients", n)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"github.com/juju/cmd/v3"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// Exit codes for each kind of failure, so scripts can tell them apart.
+// These are a stable contract: add new codes rather than changing
+// these. Other errors exit with 1, and invalid arguments with 2.
+const (
+	ExitPrecheckFailed     = 3
+	ExitUserAborted        = 4
+	ExitRestoreFailed      = 5
+	ExitPostcheckFailed    = 6
+	ExitConnectivityFailed = 7
+)
+
+// ExitCode returns the process exit code for an error from running
+// a command.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if IsUserAbortedError(err) {
+		return ExitUserAborted
+	}
+	switch core.FailureKindOf(err) {
+	case core.PrecheckFailure:
+		return ExitPrecheckFailed
+	case core.ConnectivityFailure:
+		return ExitConnectivityFailed
+	case core.RestoreFailure:
+		return ExitRestoreFailed
+	case core.PostcheckFailure:
+		return ExitPostcheckFailed
+	}
+	return 1
+}
+
+// WithExitCodes wraps a command so that when it fails the process
+// exits with the code for the kind of failure.
+func WithExitCodes(command cmd.Command) cmd.Command {
+	return &exitCodeCommand{command}
+}
+
+type exitCodeCommand struct {
+	cmd.Command
+}
+
+// Run is part of cmd.Command.
+func (c *exitCodeCommand) Run(ctx *cmd.Context) error {
+	err := c.Command.Run(ctx)
+	code := ExitCode(err)
+	if code <= 1 {
+		return err
+	}
+	cmd.WriteError(ctx.Stderr, err)
+	return cmd.NewRcPassthroughError(code)
+}
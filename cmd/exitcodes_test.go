@@ -0,0 +1,36 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+)
+
+type exitCodesSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&exitCodesSuite{})
+
+func (s *exitCodesSuite) TestExitCode(c *gc.C) {
+	for i, test := range []struct {
+		err  error
+		code int
+	}{
+		{nil, 0},
+		{errors.New("boom"), 1},
+		{core.NewFailure(core.PrecheckFailure, errors.New("boom")), cmd.ExitPrecheckFailed},
+		{core.NewFailure(core.RestoreFailure, errors.New("boom")), cmd.ExitRestoreFailed},
+		{core.NewFailure(core.PostcheckFailure, errors.New("boom")), cmd.ExitPostcheckFailed},
+		{errors.Annotate(core.NewFailure(core.ConnectivityFailure, errors.New("boom")), "connecting"), cmd.ExitConnectivityFailed},
+	} {
+		c.Logf("%d: %v", i, test.err)
+		c.Check(cmd.ExitCode(test.err), gc.Equals, test.code)
+	}
+}
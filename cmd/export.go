@@ -0,0 +1,101 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/backup"
+)
+
+// NewExportCommand creates a cmd.Command that writes chosen
+// collections from a backup file to JSON or CSV files with export.
+func NewExportCommand(export func(path, tempRoot, outputDir, format string, collections []string) ([]backup.ExportedCollection, error)) cmd.Command {
+	return &exportCommand{export: export}
+}
+
+type exportCommand struct {
+	cmd.CommandBase
+
+	export func(path, tempRoot, outputDir, format string, collections []string) ([]backup.ExportedCollection, error)
+
+	output      string
+	format      string
+	collections string
+	tempRoot    string
+	backupFile  string
+}
+
+// Info is part of cmd.Command.
+func (c *exportCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore export",
+		Args:    "<backup file>",
+		Purpose: "Write collections from a backup to JSON or CSV files",
+		Doc:     exportDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *exportCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.output, "output", "", "directory to write the collections to (default <backup file>-export)")
+	f.StringVar(&c.format, "format", backup.ExportJSON, "format to write the collections in: json (a document per line) or csv")
+	f.StringVar(&c.collections, "collections", strings.Join(backup.DefaultExportCollections, ","), "comma-separated collections in the juju database to export")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack the backup file while exporting from it")
+}
+
+// Init is part of cmd.Command.
+func (c *exportCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing backup file")
+	}
+	c.backupFile, args = args[0], args[1:]
+	switch c.format {
+	case backup.ExportJSON, backup.ExportCSV:
+	default:
+		return errors.Errorf("--format must be %s or %s", backup.ExportJSON, backup.ExportCSV)
+	}
+	if len(c.exportedCollections()) == 0 {
+		return errors.New("--collections can't be empty")
+	}
+	return c.CommandBase.Init(args)
+}
+
+func (c *exportCommand) exportedCollections() []string {
+	var collections []string
+	for _, name := range strings.Split(c.collections, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			collections = append(collections, name)
+		}
+	}
+	return collections
+}
+
+// Run is part of cmd.Command.
+func (c *exportCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	output := c.output
+	if output == "" {
+		output = strings.TrimSuffix(c.backupFile, ".tar.gz") + "-export"
+	}
+	output = ctx.AbsPath(output)
+
+	ui.Notify("Exporting collections... ")
+	exported, err := c.export(ctx.AbsPath(c.backupFile), c.tempRoot, output, c.format, c.exportedCollections())
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "exporting collections")
+	}
+	ui.Notify("✓\n")
+	for _, collection := range exported {
+		ui.Notify(fmt.Sprintf("    %s: %d documents written to %s\n", collection.Name, collection.Documents, collection.Path))
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+// ApprovalPolicyFile is exported for the cmd_test tests, so they
+// don't depend on whether the machine requires approvals.
+var ApprovalPolicyFile = &approvalPolicyFile
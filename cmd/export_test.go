@@ -0,0 +1,99 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"path/filepath"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/cmd"
+)
+
+type exportSuite struct {
+	testing.IsolationSuite
+
+	path        string
+	output      string
+	format      string
+	collections []string
+	err         error
+}
+
+var _ = gc.Suite(&exportSuite{})
+
+func (s *exportSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.path, s.output, s.format, s.collections, s.err = "", "", "", nil, nil
+}
+
+func (s *exportSuite) export(path, tempRoot, outputDir, format string, collections []string) ([]backup.ExportedCollection, error) {
+	s.path, s.output, s.format, s.collections = path, outputDir, format, collections
+	var exported []backup.ExportedCollection
+	for i, name := range collections {
+		exported = append(exported, backup.ExportedCollection{
+			Name:      name,
+			Path:      filepath.Join(outputDir, name+"."+format),
+			Documents: i + 1,
+		})
+	}
+	return exported, s.err
+}
+
+func (s *exportSuite) TestExport(c *gc.C) {
+	dir := c.MkDir()
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewExportCommand(s.export), filepath.Join(dir, "backup.tar.gz"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.path, gc.Equals, filepath.Join(dir, "backup.tar.gz"))
+	c.Assert(s.output, gc.Equals, filepath.Join(dir, "backup-export"))
+	c.Assert(s.format, gc.Equals, "json")
+	c.Assert(s.collections, jc.DeepEquals, []string{"users", "models", "machines", "settings"})
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Exporting collections... ✓
+    users: 1 documents written to `[1:]+s.output+`/users.json
+    models: 2 documents written to `+s.output+`/models.json
+    machines: 3 documents written to `+s.output+`/machines.json
+    settings: 4 documents written to `+s.output+`/settings.json
+`)
+}
+
+func (s *exportSuite) TestExportOptions(c *gc.C) {
+	_, err := cmdtesting.RunCommand(c, cmd.NewExportCommand(s.export), "backup.tar.gz",
+		"--output", "/tmp/audit", "--format", "csv", "--collections", "users, cloudCredentials")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.output, gc.Equals, "/tmp/audit")
+	c.Assert(s.format, gc.Equals, "csv")
+	c.Assert(s.collections, jc.DeepEquals, []string{"users", "cloudCredentials"})
+}
+
+func (s *exportSuite) TestExportFails(c *gc.C) {
+	s.err = errors.New(`collection "machines" isn't in the backup`)
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewExportCommand(s.export), "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, `exporting collections: collection "machines" isn't in the backup`)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Exporting collections... ✗\n")
+}
+
+func (s *exportSuite) TestInitErrors(c *gc.C) {
+	for i, test := range []struct {
+		args     []string
+		errMatch string
+	}{{
+		errMatch: "missing backup file",
+	}, {
+		args:     []string{"backup.tar.gz", "--format", "xml"},
+		errMatch: "--format must be json or csv",
+	}, {
+		args:     []string{"backup.tar.gz", "--collections", " , "},
+		errMatch: "--collections can't be empty",
+	}} {
+		c.Logf("%d: %v", i, test.args)
+		_, err := cmdtesting.RunCommand(c, cmd.NewExportCommand(s.export), test.args...)
+		c.Assert(err, gc.ErrorMatches, test.errMatch)
+	}
+}
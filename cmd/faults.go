@@ -0,0 +1,183 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/version/v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// faultsEnvVar holds the failures to inject into a restore, so DR
+// rehearsals against staging controllers can practise recovering from
+// a partial restore. For example:
+//
+//	JUJU_RESTORE_INJECT_FAULTS=stop-agent:10.0.0.2,restore
+//
+// makes stopping the agents on 10.0.0.2 fail, and then the database
+// restore.
+const faultsEnvVar = "JUJU_RESTORE_INJECT_FAULTS"
+
+// Operations that can be made to fail. All but faultRestore can be
+// limited to one controller node.
+const (
+	faultStopAgent       = "stop-agent"
+	faultStartAgent      = "start-agent"
+	faultRestartDatabase = "restart-database"
+	faultUpdateVersion   = "update-version"
+	faultRestore         = "restore"
+)
+
+var nodeFaults = []string{faultStopAgent, faultStartAgent, faultRestartDatabase, faultUpdateVersion}
+
+// faults records which operations should fail, and on which nodes.
+// An operation mapped to an empty node list fails on every node.
+type faults map[string][]string
+
+// parseFaults reads a comma-separated list of operations, each
+// optionally followed by a colon and the name or IP address of the
+// node it should fail on.
+func parseFaults(value string) (faults, error) {
+	result := make(faults)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		operation, node := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			operation, node = item[:i], item[i+1:]
+		}
+		switch {
+		case operation == faultRestore:
+			if node != "" {
+				return nil, errors.Errorf("%s fault can't be limited to a node", faultRestore)
+			}
+		case !isNodeFault(operation):
+			return nil, errors.Errorf("unknown fault %q (expected %s or %s)", operation, strings.Join(nodeFaults, ", "), faultRestore)
+		}
+		if node == "" {
+			result[operation] = nil
+		} else if nodes, ok := result[operation]; !ok || nodes != nil {
+			result[operation] = append(nodes, node)
+		}
+	}
+	return result, nil
+}
+
+func isNodeFault(operation string) bool {
+	for _, fault := range nodeFaults {
+		if fault == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the faults for warnings.
+func (f faults) String() string {
+	var items []string
+	for _, operation := range append(nodeFaults, faultRestore) {
+		nodes, ok := f[operation]
+		if !ok {
+			continue
+		}
+		if len(nodes) == 0 {
+			items = append(items, operation)
+			continue
+		}
+		for _, node := range nodes {
+			items = append(items, operation+" on "+node)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// fails returns the injected error for the operation on the node, or
+// nil if it should go ahead.
+func (f faults) fails(operation string, node core.ControllerNode) error {
+	nodes, ok := f[operation]
+	if !ok {
+		return nil
+	}
+	matched := len(nodes) == 0
+	for _, name := range nodes {
+		if node != nil && (name == node.Name() || name == node.IP()) {
+			matched = true
+		}
+	}
+	if !matched {
+		return nil
+	}
+	return errors.Errorf("injected %s failure (%s)", operation, faultsEnvVar)
+}
+
+// wrapNodes makes the nodes created by factory fail as requested.
+func (f faults) wrapNodes(factory core.ControllerNodeFactory) core.ControllerNodeFactory {
+	return func(member core.ReplicaSetMember) core.ControllerNode {
+		return &faultyNode{ControllerNode: factory(member), faults: f}
+	}
+}
+
+// wrapDatabase makes the database restore fail if requested.
+func (f faults) wrapDatabase(database core.Database) core.Database {
+	if _, ok := f[faultRestore]; !ok {
+		return database
+	}
+	return &faultyDatabase{Database: database, faults: f}
+}
+
+// faultyNode is a controller node whose operations can be made to
+// fail without doing anything.
+type faultyNode struct {
+	core.ControllerNode
+	faults faults
+}
+
+// StopAgent is part of core.ControllerNode.
+func (n *faultyNode) StopAgent() error {
+	if err := n.faults.fails(faultStopAgent, n.ControllerNode); err != nil {
+		return err
+	}
+	return n.ControllerNode.StopAgent()
+}
+
+// StartAgent is part of core.ControllerNode.
+func (n *faultyNode) StartAgent() error {
+	if err := n.faults.fails(faultStartAgent, n.ControllerNode); err != nil {
+		return err
+	}
+	return n.ControllerNode.StartAgent()
+}
+
+// RestartDatabase is part of core.ControllerNode.
+func (n *faultyNode) RestartDatabase() error {
+	if err := n.faults.fails(faultRestartDatabase, n.ControllerNode); err != nil {
+		return err
+	}
+	return n.ControllerNode.RestartDatabase()
+}
+
+// UpdateAgentVersion is part of core.ControllerNode.
+func (n *faultyNode) UpdateAgentVersion(target version.Number) error {
+	if err := n.faults.fails(faultUpdateVersion, n.ControllerNode); err != nil {
+		return err
+	}
+	return n.ControllerNode.UpdateAgentVersion(target)
+}
+
+// faultyDatabase is a database whose restore fails without doing
+// anything.
+type faultyDatabase struct {
+	core.Database
+	faults faults
+}
+
+// RestoreFromDump is part of core.Database.
+func (d *faultyDatabase) RestoreFromDump(dumpDir string, options core.RestoreOptions) ([]core.RestoredCollection, core.RestoreLogDigest, error) {
+	return nil, core.RestoreLogDigest{}, d.faults.fails(faultRestore, nil)
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+// defaultHistoryFile is where each restore run is recorded, on the
+// controller machine it's run on.
+const defaultHistoryFile = "/var/lib/juju/restore-history.jsonl"
+
+// HistoryEntry summarises one run of juju-restore, for looking back at
+// earlier restore attempts and how long they took.
+type HistoryEntry struct {
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished"`
+	Mode      string        `json:"mode"`
+	Source    string        `json:"source"`
+	BackupID  string        `json:"backup-id,omitempty"`
+	DryRun    bool          `json:"dry-run,omitempty"`
+	Phases    []phaseReport `json:"phases"`
+	Documents int           `json:"documents,omitempty"`
+	Outcome   string        `json:"outcome"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Outcomes recorded in the history.
+const (
+	outcomeSucceeded = "succeeded"
+	outcomeFailed    = "failed"
+)
+
+// Took returns how long the run took for display.
+func (e HistoryEntry) Took() time.Duration {
+	return e.Finished.Sub(e.Started).Round(time.Second)
+}
+
+// appendHistory adds the entry to the history file at path as a line
+// of JSON, creating the file if needed.
+func appendHistory(path string, entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
+
+// ReadHistory loads the entries in the history file at path, oldest
+// first. Lines that can't be read are skipped.
+func ReadHistory(path string) ([]HistoryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logger.Warningf("skipping line %d of %s: %v", line, path, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.Annotatef(scanner.Err(), "reading %s", path)
+}
+
+// historyEntry summarises the run for the history file.
+func (c *restoreCommand) historyEntry() HistoryEntry {
+	mode := "restore"
+	switch {
+	case c.restart:
+		mode = "restart agents"
+	case c.resume:
+		mode = "resume"
+	case c.copyController:
+		mode = "copy controller"
+	case c.targetDatabase != "":
+		mode = "restore to " + c.targetDatabase
+	}
+	entry := HistoryEntry{
+		Started:   c.started,
+		Finished:  time.Now().UTC(),
+		Mode:      mode,
+		Source:    c.sourceName(),
+		BackupID:  c.report.BackupID,
+		DryRun:    c.dryRun,
+		Phases:    c.report.Phases,
+		Documents: c.report.Documents(),
+		Outcome:   outcomeSucceeded,
+	}
+	if c.report.Error != "" {
+		entry.Outcome = outcomeFailed
+		entry.Error = c.report.Error
+	}
+	return entry
+}
+
+// recordHistory appends the run to the history file, if there is one.
+// Failing to is only logged, since it doesn't affect the restore.
+func (c *restoreCommand) recordHistory() {
+	if c.historyFile == "" {
+		return
+	}
+	if err := appendHistory(c.historyFile, c.historyEntry()); err != nil {
+		logger.Warningf("recording run in history: %v", err)
+	}
+}
+
+// NewHistoryCommand creates a cmd.Command that lists the runs of
+// juju-restore recorded on this machine.
+func NewHistoryCommand() cmd.Command {
+	return &historyCommand{}
+}
+
+type historyCommand struct {
+	cmd.CommandBase
+
+	historyFile string
+	limit       int
+}
+
+// Info is part of cmd.Command.
+func (c *historyCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore history",
+		Purpose: "List the restores run on this controller machine",
+		Doc:     historyDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *historyCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.historyFile, "history-file", defaultHistoryFile, "the history file juju-restore records runs in")
+	f.IntVar(&c.limit, "limit", 20, "how many of the most recent runs to list (0 lists them all)")
+}
+
+// Init is part of cmd.Command.
+func (c *historyCommand) Init(args []string) error {
+	if c.limit < 0 {
+		return errors.New("--limit can't be negative")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *historyCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	entries, err := ReadHistory(ctx.AbsPath(c.historyFile))
+	if os.IsNotExist(errors.Cause(err)) {
+		ui.Notify("No restores have been recorded.\n")
+		return nil
+	} else if err != nil {
+		return errors.Annotate(err, "reading history")
+	}
+	if c.limit > 0 && len(entries) > c.limit {
+		entries = entries[len(entries)-c.limit:]
+	}
+	ui.Notify(formatHistory(entries))
+	return nil
+}
+
+// formatHistory renders the entries as a table.
+func formatHistory(entries []HistoryEntry) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tMODE\tBACKUP\tOUTCOME\tTOOK\tPHASES")
+	for _, entry := range entries {
+		var phases []string
+		for _, phase := range entry.Phases {
+			mark := "✓"
+			if phase.Error != "" {
+				mark = "✗"
+			}
+			phases = append(phases, fmt.Sprintf("%s %s %s", phase.Name, mark, phase.Took()))
+		}
+		outcome := entry.Outcome
+		if entry.DryRun {
+			outcome += " (dry run)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Started.UTC().Format("2006-01-02 15:04:05"),
+			entry.Mode,
+			orDash(entry.BackupID),
+			outcome,
+			entry.Took(),
+			orDash(strings.Join(phases, ", ")),
+		)
+	}
+	w.Flush()
+	return buf.String()
+}
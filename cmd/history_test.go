@@ -0,0 +1,68 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+)
+
+type historySuite struct {
+	testing.IsolationSuite
+
+	path string
+}
+
+var _ = gc.Suite(&historySuite{})
+
+func (s *historySuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.path = filepath.Join(c.MkDir(), "restore-history.jsonl")
+	err := ioutil.WriteFile(s.path, []byte(`
+{"started":"2020-03-17T16:28:24Z","finished":"2020-03-17T16:29:00Z","mode":"restore","source":"backup.tar.gz","dry-run":true,"phases":[{"name":"pre-checks","started":"2020-03-17T16:28:24Z","seconds":36}],"outcome":"succeeded"}
+not json
+{"started":"2020-03-18T09:00:00Z","finished":"2020-03-18T09:20:05Z","mode":"restore","source":"backup.tar.gz","backup-id":"20200317-162824.how-bizarre","phases":[{"name":"pre-checks","started":"2020-03-18T09:00:00Z","seconds":35},{"name":"stop agents","started":"2020-03-18T09:00:35Z","seconds":10},{"name":"restore","started":"2020-03-18T09:00:45Z","seconds":1200,"error":"exit status 1"}],"documents":1000,"outcome":"failed","error":"restoring dump: exit status 1"}
+
+{"started":"2020-03-18T10:00:00Z","finished":"2020-03-18T10:01:00Z","mode":"resume","source":"backup.tar.gz","backup-id":"20200317-162824.how-bizarre","phases":[{"name":"start agents","started":"2020-03-18T10:00:00Z","seconds":60}],"outcome":"succeeded"}
+`[1:]), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *historySuite) TestHistory(c *gc.C) {
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewHistoryCommand(), "--history-file", s.path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+STARTED              MODE     BACKUP                       OUTCOME              TOOK   PHASES
+2020-03-17 16:28:24  restore  -                            succeeded (dry run)  36s    pre-checks ✓ 36s
+2020-03-18 09:00:00  restore  20200317-162824.how-bizarre  failed               20m5s  pre-checks ✓ 35s, stop agents ✓ 10s, restore ✗ 20m0s
+2020-03-18 10:00:00  resume   20200317-162824.how-bizarre  succeeded            1m0s   start agents ✓ 1m0s
+`[1:])
+}
+
+func (s *historySuite) TestHistoryLimit(c *gc.C) {
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewHistoryCommand(), "--history-file", s.path, "--limit", "1")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Matches, "STARTED .*\n2020-03-18 10:00:00  resume .*\n")
+}
+
+func (s *historySuite) TestHistoryEmpty(c *gc.C) {
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewHistoryCommand(), "--history-file", filepath.Join(c.MkDir(), "missing.jsonl"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "No restores have been recorded.\n")
+}
+
+func (s *historySuite) TestReadHistorySkipsBadLines(c *gc.C) {
+	entries, err := cmd.ReadHistory(s.path)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 3)
+	c.Assert(entries[1].Documents, gc.Equals, 1000)
+	c.Assert(entries[1].Error, gc.Equals, "restoring dump: exit status 1")
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// The points in a run where hook scripts are run. Scripts for pre-
+// hooks stop the run if they fail, failures of post- hooks are only
+// reported as warnings.
+const (
+	hookPrePrecheck     = "pre-precheck"
+	hookPostStopAgents  = "post-stop-agents"
+	hookPreRestore      = "pre-restore"
+	hookPostRestore     = "post-restore"
+	hookPostStartAgents = "post-start-agents"
+)
+
+// hookScripts returns the executables in dir for the hook point,
+// named either for the point or with the point and a dash as a
+// prefix, in name order.
+func hookScripts(dir, point string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var scripts []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != point && !strings.HasPrefix(name, point+"-") {
+			continue
+		}
+		if entry.IsDir() || entry.Mode()&0111 == 0 {
+			logger.Warningf("skipping hook %s: not an executable file", filepath.Join(dir, name))
+			continue
+		}
+		scripts = append(scripts, filepath.Join(dir, name))
+	}
+	sort.Strings(scripts)
+	return scripts, nil
+}
+
+// runHook runs the scripts in the hook directory for the point given.
+// Errors from pre- hooks are returned, errors from post- hooks are
+// reported and recorded in the run report.
+func (c *restoreCommand) runHook(point string) error {
+	if c.hookDir == "" {
+		return nil
+	}
+	scripts, err := hookScripts(c.hookDir, point)
+	if err != nil {
+		return errors.Annotatef(err, "finding %s hooks", point)
+	}
+	for _, script := range scripts {
+		if c.dryRun {
+			c.ui.Notify(fmt.Sprintf("\nDry run: not running %s hook %s.\n", point, filepath.Base(script)))
+			continue
+		}
+		c.ui.Progress(fmt.Sprintf("\nRunning %s hook %s...\n", point, filepath.Base(script)))
+		err := c.runHookScript(point, script)
+		if err == nil {
+			continue
+		}
+		if strings.HasPrefix(point, "pre-") {
+			return errors.Annotatef(err, "%s hook %s", point, filepath.Base(script))
+		}
+		warning := fmt.Sprintf("%s hook %s failed: %v", point, filepath.Base(script), err)
+		c.report.warn(warning)
+		c.ui.Notify("Warning: " + warning + "\n")
+	}
+	return nil
+}
+
+// runHookScript runs one hook script with the environment describing
+// the run, logging its output.
+func (c *restoreCommand) runHookScript(point, script string) error {
+	ctx := context.Background()
+	if c.commandTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.commandTimeout)
+		defer cancel()
+	}
+	command := exec.CommandContext(ctx, script)
+	command.Env = append(os.Environ(), c.hookEnvironment(point)...)
+	var out bytes.Buffer
+	command.Stdout = &out
+	command.Stderr = &out
+	err := command.Run()
+	output := strings.TrimSpace(out.String())
+	if output != "" {
+		logger.Debugf("%s hook %s output:\n%s", point, filepath.Base(script), output)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("timed out after %s", c.commandTimeout)
+	}
+	if err != nil && output != "" {
+		return errors.Errorf("%v: %s", err, lastLine(output))
+	}
+	return errors.Trace(err)
+}
+
+// hookEnvironment returns the variables describing the run that are
+// passed to hook scripts.
+func (c *restoreCommand) hookEnvironment(point string) []string {
+	backupFile, err := filepath.Abs(c.backupFile)
+	if err != nil {
+		backupFile = c.backupFile
+	}
+	env := []string{
+		"JUJU_RESTORE_HOOK=" + point,
+		"JUJU_RESTORE_BACKUP_FILE=" + backupFile,
+		"JUJU_RESTORE_RESTORE_LOG=" + c.restoreLog,
+		"JUJU_RESTORE_COPY_CONTROLLER=" + strconv.FormatBool(c.copyController),
+		"JUJU_RESTORE_MANUAL_AGENT_CONTROL=" + strconv.FormatBool(c.manualAgentControl),
+	}
+	if c.restorer != nil {
+		env = append(env, "JUJU_RESTORE_HA="+strconv.FormatBool(c.restorer.IsHA()))
+	}
+	return env
+}
+
+// lastLine returns the last line of the output passed in.
+func lastLine(output string) string {
+	lines := strings.Split(output, "\n")
+	return lines[len(lines)-1]
+}
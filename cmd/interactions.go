@@ -6,10 +6,13 @@ package cmd
 import (
 	"bufio"
 	"fmt"
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/juju/cmd/v3"
 	"github.com/juju/errors"
+	"github.com/mattn/go-isatty"
 )
 
 // This file contains helper functions for generic operations commonly needed
@@ -40,6 +43,72 @@ func NewUserInteractions(ctx *cmd.Context) *UserInteractions {
 type UserInteractions struct {
 	ctx     *cmd.Context
 	scanner *bufio.Scanner
+
+	// quiet suppresses progress messages.
+	quiet bool
+
+	mu sync.Mutex
+	// replay, if set, holds the answers used instead of user input.
+	replay Answers
+	// recorded, if set, collects the answers given by the user.
+	recorded Answers
+}
+
+// InterruptNotify sends interrupt signals to ch.
+func (ui *UserInteractions) InterruptNotify(ch chan<- os.Signal) {
+	ui.ctx.InterruptNotify(ch)
+}
+
+// StopInterruptNotify stops interrupt signals being sent to ch.
+func (ui *UserInteractions) StopInterruptNotify(ch chan<- os.Signal) {
+	ui.ctx.StopInterruptNotify(ch)
+}
+
+// SetQuiet determines whether progress messages are shown.
+func (ui *UserInteractions) SetQuiet(quiet bool) {
+	ui.quiet = quiet
+}
+
+// ReplayAnswers makes ConfirmYes use the answers passed in instead of
+// reading user input. Prompts without an answer are an error.
+func (ui *UserInteractions) ReplayAnswers(answers Answers) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.replay = answers
+}
+
+// RecordAnswers makes ConfirmYes record the answers the user gives,
+// returning the collection they're added to.
+func (ui *UserInteractions) RecordAnswers() Answers {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	ui.recorded = make(Answers)
+	return ui.recorded
+}
+
+// ConfirmYes asks for confirmation like UserConfirmYes, but uses the
+// replayed answer for the prompt if there is one, and records the
+// answer given if recording.
+func (ui *UserInteractions) ConfirmYes(prompt string) error {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if ui.replay != nil {
+		yes, ok := ui.replay[prompt]
+		if !ok {
+			return errors.Errorf("no answer for %q in answers file", prompt)
+		}
+		if !yes {
+			ui.Progress("n (from answers file)\n")
+			return errors.Trace(userAbortedError("aborted"))
+		}
+		ui.Progress("y (from answers file)\n")
+		return nil
+	}
+	err := ui.UserConfirmYes()
+	if ui.recorded != nil && (err == nil || IsUserAbortedError(err)) {
+		ui.recorded[prompt] = err == nil
+	}
+	return err
 }
 
 // UserConfirmYes returns an error if we do not read a "y" or "yes" from user
@@ -61,9 +130,48 @@ func (ui *UserInteractions) UserConfirmYes() error {
 	return errors.Errorf("no input")
 }
 
+// ReadPassword prompts for a password and reads it from user input.
+// If the input is a terminal the password isn't echoed.
+func (ui *UserInteractions) ReadPassword(prompt string) (string, error) {
+	ui.Notify(prompt)
+	if f, ok := ui.ctx.Stdin.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+		restore, err := disableEcho(int(f.Fd()))
+		if err != nil {
+			return "", errors.Annotate(err, "disabling echo")
+		}
+		defer func() {
+			restore()
+			// The newline typed wasn't echoed either.
+			ui.Notify("\n")
+		}()
+	}
+	return ui.ReadLine()
+}
+
+// ReadLine returns the next line of user input.
+func (ui *UserInteractions) ReadLine() (string, error) {
+	if ui.scanner.Scan() {
+		return ui.scanner.Text(), nil
+	}
+	if ui.scanner.Err() != nil {
+		return "", errors.Trace(ui.scanner.Err())
+	}
+	return "", errors.Errorf("no input")
+}
+
 // Notify will post message to an io.Writer of the given cmd.Context.
 // This ensures that all messages that require user attention
 // go consistently to the same writer.
 func (ui *UserInteractions) Notify(message string) {
-	fmt.Fprintf(ui.ctx.Stdout, message)
+	fmt.Fprint(ui.ctx.Stdout, message)
+}
+
+// Progress posts a message like Notify, unless quiet mode is on. It's
+// for messages that only report how the command is getting on, rather
+// than ones the user needs to act on.
+func (ui *UserInteractions) Progress(message string) {
+	if ui.quiet {
+		return
+	}
+	ui.Notify(message)
 }
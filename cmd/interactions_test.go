@@ -89,3 +89,42 @@ func (s *InteractionsSuite) TestNotify(c *gc.C) {
 	c.Assert(cmdtesting.Stderr(s.ctx), gc.Equals, "")
 	c.Assert(cmdtesting.Stdout(s.ctx), gc.Equals, "must be fun to be on stdout")
 }
+
+func (s *InteractionsSuite) TestConfirmReplay(c *gc.C) {
+	ui := cmd.NewUserInteractions(s.ctx)
+	ui.ReplayAnswers(cmd.Answers{"proceed": true, "manage-agents": false})
+	c.Assert(ui.ConfirmYes("proceed"), jc.ErrorIsNil)
+	c.Assert(ui.ConfirmYes("manage-agents"), jc.Satisfies, cmd.IsUserAbortedError)
+	c.Assert(ui.ConfirmYes("trust-host-key 10.0.0.5"), gc.ErrorMatches, `no answer for "trust-host-key 10.0.0.5" in answers file`)
+	c.Assert(cmdtesting.Stdout(s.ctx), gc.Equals, "y (from answers file)\nn (from answers file)\n")
+}
+
+func (s *InteractionsSuite) TestConfirmRecord(c *gc.C) {
+	s.ctx.Stdin = strings.NewReader("y\nn\n")
+	ui := cmd.NewUserInteractions(s.ctx)
+	recorded := ui.RecordAnswers()
+	c.Assert(ui.ConfirmYes("manage-agents"), jc.ErrorIsNil)
+	c.Assert(ui.ConfirmYes("proceed"), jc.Satisfies, cmd.IsUserAbortedError)
+	c.Assert(ui.ConfirmYes("trust-host-key 10.0.0.5"), gc.ErrorMatches, "no input")
+	c.Assert(recorded, gc.DeepEquals, cmd.Answers{"manage-agents": true, "proceed": false})
+}
+
+func (s *InteractionsSuite) TestQuietProgress(c *gc.C) {
+	ui := cmd.NewUserInteractions(s.ctx)
+	ui.Progress("working\n")
+	ui.SetQuiet(true)
+	ui.Progress("still working\n")
+	ui.Notify("look out\n")
+	c.Assert(cmdtesting.Stdout(s.ctx), gc.Equals, "working\nlook out\n")
+}
+
+func (s *InteractionsSuite) TestReadPassword(c *gc.C) {
+	s.ctx.Stdin = strings.NewReader("sekrit\n")
+	ui := cmd.NewUserInteractions(s.ctx)
+	password, err := ui.ReadPassword("Password: ")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(password, gc.Equals, "sekrit")
+	c.Assert(cmdtesting.Stdout(s.ctx), gc.Equals, "Password: ")
+	_, err = ui.ReadPassword("Password: ")
+	c.Assert(err, gc.ErrorMatches, "no input")
+}
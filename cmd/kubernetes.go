@@ -0,0 +1,49 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju-restore/machine"
+)
+
+// podAgentConfPattern matches the controller agent's config in the
+// api-server container.
+const podAgentConfPattern = "/var/lib/juju/agents/controller-*/agent.conf"
+
+// discoverKubernetesController finds the pods of the controller in
+// the specified namespace.
+func (c *restoreCommand) discoverKubernetesController() (*machine.KubernetesConfig, error) {
+	config := machine.DefaultKubernetesConfig(c.k8sNamespace)
+	config.Context = c.k8sContext
+	pods, err := machine.DiscoverControllerPods(config, machine.NewLocalRunner(c.commandTimeout, nil))
+	if err != nil {
+		return nil, errors.Annotate(err, "finding controller pods")
+	}
+	for _, pod := range pods {
+		logger.Debugf("found controller pod %s (%s)", pod.Name, pod.IP)
+	}
+	config.Pods = pods
+	return &config, nil
+}
+
+// readCredsFromPod loads the mongo connection details from the
+// agent.conf in the first controller pod.
+func (c *restoreCommand) readCredsFromPod(config machine.KubernetesConfig) (AgentConf, error) {
+	pod := config.Pods[0].Name
+	runner := machine.NewKubectlRunner(config, pod, c.commandTimeout)
+	out, err := runner.Run("sh", "-c", "ls -1 "+podAgentConfPattern)
+	if err != nil {
+		return AgentConf{}, errors.Annotatef(err, "finding agent.conf in pod %s", pod)
+	}
+	conf := strings.SplitN(strings.TrimSpace(out), "\n", 2)[0]
+	data, err := runner.Run("cat", conf)
+	if err != nil {
+		return AgentConf{}, errors.Annotatef(err, "reading %q in pod %s", conf, pod)
+	}
+	return parseAgentConf(conf, []byte(data))
+}
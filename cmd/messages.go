@@ -27,8 +27,340 @@ The target controller will be configured with these options from the source back
 - user controller and cloud permissions
 Note that when copying controller config across, the target controller name, login password,
 CA certificate remain unchanged. 
+--copy-settings-exclude keeps more settings (audit logging or API rate limits,
+say) as they are, and --copy-settings-include copies ones that would otherwise
+be kept; both take comma-separated keys. The summary lists every setting changed.
+--copy-agent-binaries also copies the backup's agent binaries that the target
+doesn't have into its blobstore, so models migrated later can find them.
+
+If the source controller is still running and its database can be reached,
+--copy-from host[:port] copies from it directly instead of a backup file, with
+--source-username and --source-password (or $JUJU_RESTORE_SOURCE_PASSWORD).
+
+Incremental backups made with juju-restore create-backup --incremental-from
+are applied after the backup by passing each one, in order, with --incremental.
+--until gives the point in time to stop at.
+
+Where restores need a second operator's sign-off, they run juju-restore
+approve on the backup file and hand over the approval file, which is passed
+with --approval. The restore stops before changing anything unless the
+approval is signed by one of the approver's keys in the --approvers allowed
+signers file (default /etc/juju-restore/allowed_signers), is for this
+backup, hasn't expired and came from another user. Once
+/etc/juju-restore/allowed_signers exists every restore needs an approval, and
+--require-approval does the same for a single run.
+`
+
+	credsDoc = `
+
+juju-restore creds shows the database credentials that juju-restore finds
+in the controller agents' agent.conf files, and the address and SSL settings
+it would use to connect with them, then checks that it can connect. If there
+is more than one agent.conf, the one for this machine's agent is used.
+`
+
+	controllerInfoDoc = `
+
+juju-restore controller-info connects to the controller database the same
+way as juju-restore creds and shows the controller details and replica set
+members the restore pre-checks use, without needing a backup file. It only
+reads from the database. Compare its output with a backup's details to see
+whether the backup can be restored to this controller.
+`
+
+	cleanupDoc = `
+
+juju-restore cleanup removes what a restore that failed or was killed left
+behind: the staging database (jujucontroller) that --copy-controller,
+--users-only, --clouds-only and --settings-only restore into, and the
+directories under --temp-root that backup files were unpacked into. It
+lists what it finds and asks before removing anything. Restores remove the
+staging database themselves when a copy fails, so this is only needed if
+that failed too or juju-restore was killed. Don't run it while a restore is
+running on this machine.
+`
+
+	cleanupTemplate = `
+Found:
+{{- if .Staging}}
+    the jujucontroller staging database
+{{- end}}
+{{- range .Dirs}}
+    {{.}}
+{{- end}}
+`
+
+	serveDoc = `
+
+juju-restore serve runs juju-restore as an HTTP service on the controller
+machine, so that restores can be started and monitored by remote tooling.
+Clients must send the token from --token-file in an "Authorization: Bearer"
+header. POST a JSON body like {"backup-file": "/path/to/backup.tar.gz"} to
+/restore to start a restore; it runs as if juju-restore had been run with
+--yes. GET /restore returns the state and output of the latest restore.
+`
+
+	pluginDoc = `
+
+juju restore-backup restores a backup without logging in to the controller
+machines. It uses the Juju client's credentials to find the controller
+machines, copies juju-restore and the backup file to the primary with
+juju scp, and runs juju-restore there with juju ssh. Options after -- are
+passed on to juju-restore, for example:
+
+    juju restore-backup backup.tar.gz -- --copy-controller
+
+When the controller is in HA, --machine must name the machine that is the
+MongoDB primary.
+`
+
+	rebuildDoc = `
+
+juju-restore rebuild is run from a Juju client machine to replace a lost
+controller. It bootstraps a new controller on the given cloud with the Juju
+version and series of the backup, waits for the controller machine to
+start, then copies juju-restore and the backup to it and restores with
+--copy-controller. Options after -- are passed on to juju-restore.
+
+The new controller gets the backed up controller's config, clouds,
+credentials, users and permissions, but keeps its own name, UUID and CA
+certificate, and workload models are not restored - they need to be
+migrated or redeployed.
+`
+
+	createBackupDoc = `
+
+juju-restore create-backup takes a backup of the controller it's run on, in
+the same format as juju create-backup, so that backup and restore tools can
+be kept together. It dumps the database with mongodump --oplog using the
+machine agent's credentials, collects the agent configuration and other
+files Juju backs up from /var/lib/juju, and writes them with the backup
+metadata to a tar.gz file. It must be run as root.
+
+With --incremental-from, only the oplog entries since the given backup
+are saved. Restore the full backup with each incremental after it passed
+to juju-restore --incremental, in order.
+`
+
+	verifyAllDoc = `
+
+juju-restore verify-all checks every backup file (*.tar.gz) in the --dir
+directory without touching a controller. Each backup is unpacked, its
+metadata read, and every BSON document in its database dump parsed, so
+truncated or corrupt archives are found before they're needed. A JSON
+report of which backups are restorable, with their controller UUIDs and
+Juju versions, is written to stdout or --report, and the command fails
+if any backup is corrupt. Sync backups kept in object storage to a local
+directory first.
+`
+
+	historyDoc = `
+
+juju-restore history lists the runs of juju-restore recorded on this machine,
+most recent last: when each started, what it did, the ID of the backup, whether
+it succeeded and how long it and each of its phases took. Each run is recorded
+in /var/lib/juju/restore-history.jsonl (or juju-restore's --history-file) as a
+line of JSON, which has the full details.
+`
+
+	watchDoc = `
+
+juju-restore watch follows a restore being run by someone else, so another
+operator can see its progress without being able to affect it. The restore
+has to be run with --event-socket; pass the same path to --events. Each
+phase, controller machine operation, change and warning is shown as it
+happens (the events so far are shown first), along with the replica set
+members' health, checked every --health-interval and shown when it changes.
+The database connection only reads the replica set status, and watch exits
+when the restore finishes, failing if the restore failed.
+`
+
+	approveDoc = `
+
+juju-restore approve records a second operator's approval of restoring a
+backup file, for organisations whose policy needs two people to agree to
+a controller restore. The approval names the backup by its SHA-256
+checksum, who approved it and when it expires (--valid-for, 24 hours by
+default), and is signed with the approver's ssh key (--key). Pass the
+approval file to juju-restore with --approval: the restore stops at the
+pre-checks, before anything is changed, if the approval isn't signed by
+one of the approver's keys in the --approvers allowed signers file, is
+for another backup, has expired, or was given by the user running the
+restore.
+`
+
+	sanitizeDoc = `
+
+juju-restore sanitize writes a copy of a backup file with the secrets it
+holds replaced, so that it can be shared with support or restored into a
+staging controller. Password hashes, cloud credentials, controller private
+keys, secret values and settings that look like secrets are replaced with
+hashes keyed by a random key, in the collections and in the oplog and
+transaction log copies of them. Values that were equal stay equal, but the
+originals can't be recovered. The database users and the controller's files
+(agent.conf and keys) are left out, and the CA private key is removed from
+the metadata. The original backup is not changed.
+`
+
+	exportDoc = `
+
+juju-restore export writes collections from a backup's juju database to
+files, without needing a database, for audits and for checking what a
+backup holds. Each collection in --collections (by default users, models,
+machines and settings) is written to <collection>.json or <collection>.csv
+in the --output directory. JSON files have a document per line; CSV files
+have a column for each top-level field, with nested documents and arrays
+written as JSON. The files can hold password hashes and credentials, so
+they're only readable by you. Existing files aren't overwritten.
+`
+
+	queryDoc = `
+
+juju-restore query prints the documents in one of a backup's collections
+that match a filter, reading the database dump directly so no database is
+needed. The collection is in the juju database unless it's given as
+<database>.<collection>. Each filter argument is one of field=value,
+field!=value, field~regexp (the value matches the regular expression) or
+field (the field is present), and a document must match them all. Fields
+are dotted paths into nested documents, and a field holding an array
+matches if any element does. Values are compared as text: numbers and
+booleans as written, object IDs in hex and times in RFC3339. Matching
+documents are written to stdout as JSON, a document per line.
+
+    juju-restore query backup.tar.gz machines series=focal life!=2
+`
+
+	diffDoc = `
+
+juju-restore diff compares two backup files - their metadata, the models
+in them, each collection's document count and the controller settings -
+and summarises what changed from A to B, without needing a database. Use
+it to choose which backup to restore and to see what would be lost by
+restoring the older one: the time between the backups is the window of
+changes that wouldn't come back. Only the collections and settings that
+differ are listed.
+
+    juju-restore diff juju-backup-monday.tar.gz juju-backup-tuesday.tar.gz
+`
+
+	repairDoc = `
+
+juju-restore repair recovers what it can from a backup file that can't be
+unpacked because it was truncated or corrupted. Every file read completely
+from the archive is kept, and each collection's documents are parsed;
+collections that were cut off or can't be parsed are dropped. The
+collections recovered and exactly what was lost are listed, and the
+recovered collections are written to a new backup file (--output) only
+once you confirm a partial restore is acceptable. Restore that file as
+usual. If the backup's metadata.json was lost, pass a copy of it with
+--metadata, otherwise the metadata will be inferred from the database dump
+when restoring. The original backup is not changed.
+`
+
+	repairReportTemplate = `
+{{- if .ArchiveError}}
+The archive is damaged: {{.ArchiveError}}
+{{- end}}
+Recovered {{len .Recovered}} collections.
+{{- if .Lost}}
+Lost:
+{{- range .Lost}}
+    {{.Name}}: {{.Reason}}
+{{- end}}
+{{- end}}
+`
+
+	diffTemplate = `
+A: {{.From}}
+B: {{.To}}
+Created: {{.Created.From}} → {{.Created.To}} ({{.Gap}})
+{{- if .Metadata}}
+Metadata:
+{{- range .Metadata}}
+    {{.Name}}: {{.From}} → {{.To}}
+{{- end}}
+{{- end}}
+{{- if .ModelsAdded}}
+Models only in B:
+{{- range .ModelsAdded}}
+    {{.}}
+{{- end}}
+{{- end}}
+{{- if .ModelsRemoved}}
+Models only in A:
+{{- range .ModelsRemoved}}
+    {{.}}
+{{- end}}
+{{- end}}
+{{- if .Collections}}
+Document counts:
+{{- range .Collections}}
+    {{.Name}}: {{.From}} → {{.To}}
+{{- end}}
+{{- end}}
+{{- if .Settings}}
+Controller settings:
+{{- range .Settings}}
+    {{.Name}}: {{.From}} → {{.To}}
+{{- end}}
+{{- end}}
+{{- if not (or .Metadata .ModelsAdded .ModelsRemoved .Collections .Settings)}}
+No differences apart from when the backups were created.
+{{- end}}
 `
 
+	repairMetadataInferred = `
+The backup's metadata.json was lost - restoring the repaired backup will infer
+the metadata from the database dump unless a copy is passed with --metadata.
+`
+
+	repairPartialRestore = `
+Restoring the repaired backup will only restore the recovered collections -
+the lost ones will keep whatever the controller has in them, which may
+leave it inconsistent.
+`
+
+	backupCreatedTemplate = `
+Backup written to {{.Path}}:
+    Controller:   {{.ControllerUUID}}
+    Machine:      {{.MachineID}}
+    Juju version: {{.JujuVersion}}
+    Models:       {{.Models}}
+{{- if .ParentID}}
+    Follows:      {{.ParentID}}
+{{- end}}
+`
+
+	credsTemplate = `
+Credentials from {{.Path}}:
+    Username: {{.Username}}
+    Password: {{if .Password}}set{{else}}missing{{end}}
+    CA cert:  {{if .CACert}}present{{else}}missing{{end}}
+Database:
+    Hostname: {{.Hostname.Value}} ({{.Hostname.Source}})
+    Port:     {{.Port.Value}} ({{.Port.Source}})
+    SSL:      {{if .SSL}}on{{else}}off{{end}}
+`
+
+	controllerInfoTemplate = `
+This controller:
+    Controller:   {{.ControllerUUID}}
+    Model:        {{.ControllerModelUUID}}
+    Juju version: {{.JujuVersion}}
+{{- if .Base}}
+    Base:         {{.Base}}
+{{- else}}
+    Series:       {{.Series}}
+{{- end}}
+    HA nodes:     {{.HANodes}}
+    Models:       {{.Models}}
+`
+
+	notControllerTemplate = `this does not look like a Juju controller machine:
+    machine agents:   {{range $i, $dir := .AgentDirs}}{{if $i}}, {{end}}{{$dir}}{{else}}none found in /var/lib/juju/agents{{end}}
+    juju-db service:  {{with .JujuDB}}{{.}}{{else}}not found{{end}}
+juju-restore must be run on the primary controller machine`
+
 	dbHealthComplete = `
 Replica set is healthy     ✓
 Running on primary HA node ✓
@@ -41,24 +373,124 @@ However on bigger systems the user might want to manage these agents manually.
 
 Do you want 'juju-restore' to manage these agents automatically? (y/N): `
 
+	confirmHostKeyTemplate = `
+The authenticity of host {{.Address}} can't be established.
+Host key fingerprints:
+{{range .Fingerprints}}    {{.}}
+{{end}}
+Do you want to trust these keys and add them to the known hosts file? (y/N): `
+
 	nodesTemplate = `{{range $k,$v := . }} 
     {{$k}} {{if $v}}✗ error: {{ $v }}{{else}}✓ {{end}}{{end}}
 `
 
+	inferredMachineIDsTemplate = `
+The replica set config has no juju-machine-id tag for some members.
+Machine IDs were found from the controller machines' addresses:
+{{range .}}    {{.Name}}: machine {{.JujuMachineID}}
+{{end}}`
+
+	clockSkewTemplate = `
+Warning: these controller machines' clocks differ from the primary's by
+more than {{.MaxSkew}}, which can break replica set elections and leases
+after the restore:
+{{range .Skewed}}    {{.Member.Name}} {{if .Err}}✗ error: {{.Err}}{{else}}{{.Skew}}{{end}}
+{{end}}`
+
+	activeOperationsTemplate = `
+Warning: the controller is busy, and changes made while the database is
+being restored can leave it inconsistent:
+{{range .Migrations}}    model migration: {{.}}
+{{end}}{{with .Backups}}    database backups running: {{.}}
+{{end}}{{with .ProvisioningMachines}}    machines being provisioned: {{.}}
+{{end}}{{with .ProvisioningUnits}}    units being provisioned: {{.}}
+{{end}}`
+
+	databaseVersionsTemplate = `
+Warning: the controller machines run different versions of the
+database, which can cause replication problems after the restore:
+{{range .}}    {{.Member.Name}}: {{.Status.DatabaseVersion}}
+{{end}}`
+
+	freeSpaceTemplate = `
+Warning: these controller machines may not have enough free disk space
+for the restored databases (about {{.Needed}}):
+{{range .Short}}    machine {{.Machine}} ({{.IP}}) has {{.Free}} free
+{{end}}`
+
+	agentLogProblemsTemplate = `
+Warning: the agent logs on these controller machines show problems:
+{{range .}}{{$name := .Member.Name}}{{range .Problems}}    {{$name}}: {{.Problem}}
+        {{.Line}}
+{{end}}{{end}}`
+
+	agentsNotStartedTemplate = `
+The database has been restored, but the agents on these controller
+machines aren't running:
+{{range .Nodes}}    {{.Node}}: {{.Error}}
+{{end}}
+To start them by hand run:
+{{range .Nodes}}    $ {{.Command}}
+{{end}}
+or once the problem is fixed, finish the restore with:
+    $ juju-restore --resume --state-file {{.StateFile}}
+`
+
+	nodeResultTemplate = `    {{.Node}} {{if .Error}}✗ error: {{.Error}}{{else}}✓{{end}}
+`
+
 	backupFileTemplate = `
 You are about to restore this backup:
     Created at:   {{.BackupDate}}
-    Controller:   {{.ControllerModelUUID}}
+    Controller:   {{.ControllerUUID}}
+    Model:        {{.ControllerModelUUID}}
+{{- if .ControllerMachineID}}
+    Machine:      {{.ControllerMachineID}}{{if .ControllerMachineInstanceID}} ({{.ControllerMachineInstanceID}}){{end}}
+{{- end}}
     Juju version: {{.BackupJujuVersion}}
     Models:       {{.ModelCount}}
+{{- if .Oplog.Present}}
+    Oplog:        {{.Oplog.Entries}} entries{{if .Oplog.Entries}}, {{.Oplog.First.Time}} to {{.Oplog.Last.Time}}{{end}}
+{{- else}}
+    Oplog:        none - the dump may not be point-in-time consistent
+{{- end}}
+{{- if .Incrementals}}
+    Incrementals: {{.Incrementals}}, restoring to {{.RestorePoint}}
+{{- end}}
+{{- if .MetadataInferred}}
+    Metadata:     inferred from the database dump
+{{- end}}
 `
 
 	backupFileControllerTemplate = `
 You are about to copy this controller:
     Created at:   {{.BackupDate}}
     Controller:   {{.ControllerUUID}}
+{{- if .ControllerMachineID}}
+    Machine:      {{.ControllerMachineID}}{{if .ControllerMachineInstanceID}} ({{.ControllerMachineInstanceID}}){{end}}
+{{- end}}
     Juju version: {{.BackupJujuVersion}}
     Clouds:       {{.CloudCount}}
+{{- if .MetadataInferred}}
+    Metadata:     inferred from the database dump
+{{- end}}
+`
+
+	copyTargetTemplate = `
+Into this controller:
+    Controller:      {{.TargetControllerUUID}}
+    Juju version:    {{.ControllerJujuVersion}}
+    Users:           {{.Copy.TargetUsers}}
+{{- with .Copy.UserCollisions}} - the backup's replace {{range $i, $name := .}}{{if $i}}, {{end}}{{$name}}{{end}}{{end}}
+    Clouds:          {{.Copy.TargetClouds}}
+{{- with .Copy.CloudCollisions}} - the backup's replace {{range $i, $name := .}}{{if $i}}, {{end}}{{$name}}{{end}}{{end}}
+    Workload models: none - no workloads are interrupted by copying
+`
+
+	inferredMetadataWarning = `
+The backup has no metadata.json, so its controller, Juju version, series and
+HA node count were inferred from the database dump, and the creation time is
+that of the last oplog entry. Check they're what you expect before restoring.
 `
 
 	preChecksCompleted = `
@@ -68,10 +500,187 @@ Restore cannot be cleanly aborted from here on.
 
 Are you sure you want to proceed? (y/N): `
 
+	summaryTemplate = `
+Restore summary{{if .DryRun}} (dry run - nothing was changed){{end}}:
+    Phases:
+{{range .Phases}}        {{.Name}} {{if .Error}}✗{{else}}✓{{end}} {{.Took}}
+{{end}}{{with .Nodes}}    Nodes:
+{{range .}}        {{.Node}} {{.Operation}} {{if .Error}}✗ error: {{.Error}}{{else}}✓{{end}}
+{{end}}{{end}}{{with .Collections}}    Collections restored: {{len .}} ({{$.Documents}} documents)
+{{end}}{{with .Merged}}    Users merged:
+{{range .}}        {{.Name}}: {{.Added}} added, {{.Replaced}} replaced, {{.Kept}} kept
+{{end}}{{end}}{{with .SettingsChanged}}    Controller settings restored: {{range $i, $name := .}}{{if $i}}, {{end}}{{$name}}{{end}}
+{{end}}{{with .Permissions}}{{with $.PermissionCounts}}    Permissions: {{.Copied}} copied ({{.Rewritten}} rewritten for this controller), {{.Skipped}} skipped
+{{end}}{{end}}{{with .AgentBinaries}}    Agent binaries copied: {{range $i, $name := .}}{{if $i}}, {{end}}{{$name}}{{end}}
+{{end}}{{with .CopySkipped}}    Skipped (copied by an earlier run): {{range $i, $name := .}}{{if $i}}, {{end}}{{$name}}{{end}}
+{{end}}{{with .Readiness}}    Migration readiness: {{if .Blockers}}{{.Blocked}} of {{.Models}} models blocked:
+{{range .Blockers}}        {{.Model}}: {{.Problem}}
+{{end}}{{else}}{{.Models}} models ready to migrate
+{{end}}{{end}}{{with .VersionChange}}    Juju version changed: {{.From}} → {{.To}}
+{{end}}{{with .Warnings}}    Warnings:
+{{range .}}        {{.}}
+{{end}}{{end}}{{if .Error}}{{with .Changes}}    Changed before the failure:
+{{range .}}        {{.Target}}: {{.Action}}{{if .Error}} ✗ error: {{.Error}}{{end}}
+{{end}}{{end}}{{end}}{{with .LogDigest}}    Restore log notes: {{.Warnings}} warnings, {{.Errors}} errors
+{{range .Lines}}        {{.Level}}: {{.Text}}{{if gt .Count 1}} (×{{.Count}}){{end}}
+{{end}}{{end}}{{with .RestoreLog}}    Restore log: {{.}}
+{{end}}`
+
+	ticketMarkdownTemplate = `# juju-restore run report
+
+**Outcome:** {{if .Error}}failed: {{.Error}}{{else if .DryRun}}dry run - nothing was changed{{else}}succeeded{{end}}
+
+## Phases
+
+| Phase | Result | Started | Took |
+|-------|--------|---------|------|
+{{range .Phases}}| {{.Name}} | {{if .Error}}failed: {{cell .Error}}{{else}}ok{{end}} | {{.Started.UTC.Format "2006-01-02 15:04:05"}} UTC | {{.Took}} |
+{{end}}
+## Decisions
+
+{{range .Decisions}}- {{.Prompt}}: {{if .Yes}}yes{{else}}no{{end}} ({{.By}})
+{{else}}None - nothing was asked.
+{{end}}{{with .Warnings}}
+## Warnings
+
+{{range .}}- {{.}}
+{{end}}{{end}}{{with .Nodes}}
+## Controller nodes
+
+| Node | Operation | Result |
+|------|-----------|--------|
+{{range .}}| {{.Node}} | {{.Operation}} | {{if .Error}}failed: {{cell .Error}}{{else}}ok{{end}} |
+{{end}}{{end}}{{with .Changes}}
+## Changes made
+
+| Time | Phase | Target | Action | Result |
+|------|-------|--------|--------|--------|
+{{range .}}| {{.Time.Format "15:04:05"}} | {{.Phase}} | {{cell .Target}} | {{cell .Action}} | {{if .Error}}failed: {{cell .Error}}{{else}}ok{{end}} |
+{{end}}{{end}}{{if or .Collections .VersionChange .RestoreLog}}
+## Restore
+
+{{with .Collections}}- Collections restored: {{len .}} ({{$.Documents}} documents)
+{{end}}{{with .VersionChange}}- Juju version changed: {{.From}} → {{.To}}
+{{end}}{{with .LogDigest}}- Restore log notes: {{.Warnings}} warnings, {{.Errors}} errors
+{{end}}{{with .RestoreLog}}- Restore log: {{.}}
+{{end}}{{end}}{{with .FinalHealth}}
+## Final health
+
+| Member | Machine | State | Healthy |
+|--------|---------|-------|---------|
+{{range .}}| {{.Member}} | {{.Machine}} | {{.State}} | {{if .Healthy}}yes{{else}}no{{end}} |
+{{end}}{{end}}`
+
+	ticketHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>juju-restore run report</title></head>
+<body>
+<h1>juju-restore run report</h1>
+<p><strong>Outcome:</strong> {{if .Error}}failed: {{.Error}}{{else if .DryRun}}dry run - nothing was changed{{else}}succeeded{{end}}</p>
+<h2>Phases</h2>
+<table>
+<tr><th>Phase</th><th>Result</th><th>Started</th><th>Took</th></tr>
+{{range .Phases}}<tr><td>{{.Name}}</td><td>{{if .Error}}failed: {{.Error}}{{else}}ok{{end}}</td><td>{{.Started.UTC.Format "2006-01-02 15:04:05"}} UTC</td><td>{{.Took}}</td></tr>
+{{end}}</table>
+<h2>Decisions</h2>
+{{with .Decisions}}<ul>
+{{range .}}<li>{{.Prompt}}: {{if .Yes}}yes{{else}}no{{end}} ({{.By}})</li>
+{{end}}</ul>{{else}}<p>None - nothing was asked.</p>{{end}}
+{{with .Warnings}}<h2>Warnings</h2>
+<ul>
+{{range .}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}{{with .Nodes}}<h2>Controller nodes</h2>
+<table>
+<tr><th>Node</th><th>Operation</th><th>Result</th></tr>
+{{range .}}<tr><td>{{.Node}}</td><td>{{.Operation}}</td><td>{{if .Error}}failed: {{.Error}}{{else}}ok{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{with .Changes}}<h2>Changes made</h2>
+<table>
+<tr><th>Time</th><th>Phase</th><th>Target</th><th>Action</th><th>Result</th></tr>
+{{range .}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Phase}}</td><td>{{.Target}}</td><td>{{.Action}}</td><td>{{if .Error}}failed: {{.Error}}{{else}}ok{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{if or .Collections .VersionChange .RestoreLog}}<h2>Restore</h2>
+<ul>
+{{with .Collections}}<li>Collections restored: {{len .}} ({{$.Documents}} documents)</li>
+{{end}}{{with .VersionChange}}<li>Juju version changed: {{.From}} → {{.To}}</li>
+{{end}}{{with .LogDigest}}<li>Restore log notes: {{.Warnings}} warnings, {{.Errors}} errors</li>
+{{end}}{{with .RestoreLog}}<li>Restore log: {{.}}</li>
+{{end}}</ul>
+{{end}}{{with .FinalHealth}}<h2>Final health</h2>
+<table>
+<tr><th>Member</th><th>Machine</th><th>State</th><th>Healthy</th></tr>
+{{range .}}<tr><td>{{.Member}}</td><td>{{.Machine}}</td><td>{{.State}}</td><td>{{if .Healthy}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`
+
+	approvalWrittenTemplate = `
+Approval written to {{.Path}}:
+    Backup:      {{.Backup}} (sha256 {{.BackupSHA256}})
+    Approved by: {{.ApprovedBy}}
+    Expires:     {{.Expires}}
+{{with .Note}}    Note:        {{.}}
+{{end}}`
+
+	approvedTemplate = `
+Restore approved by {{.ApprovedBy}} at {{.ApprovedAt}}{{with .Note}} ({{.}}){{end}}, valid until {{.Expires}}.
+`
+
+	interruptedMessage = `
+Interrupted: not waiting for the replica set to be healthy or retrying
+failed agent starts. The agents are still being started - interrupt
+again to stop juju-restore immediately. Check the replica set with
+'juju-restore controller-info' once the restore finishes.
+`
+
 	secondaryAgentsMustStop = `
 Juju agents on secondary controller machines must be stopped by this point.
 To stop the agents, login into each secondary controller and run:
     $ sudo systemctl stop jujud-machine-*
+`
+
+	previousCopyTemplate = `
+An earlier --copy-controller run copied this backup's controller and stopped part way.
+Already copied: {{range $i, $name := .Completed}}{{if $i}}, {{end}}{{$name}}{{end}}
+These will be skipped - pass --redo-copy to copy them again.
+`
+
+	finishedCopyTemplate = `this backup's controller was already copied into this controller, finishing at {{.Finished}} - pass --redo-copy to copy it again`
+
+	permissionPlanTemplate = `
+Copying the controller would do this with its permissions:
+{{range .}}    {{.}}
+{{else}}    (the source has none)
+{{end}}`
+
+	usersOnlyMessage = `
+Only the users, controller users and permissions will be restored. Users
+the controller has deleted are restored; the controller's other users and
+permissions are kept unless --overwrite-users was given.
+`
+
+	cloudsOnlyMessage = `
+Only the cloud definitions and credentials will be restored, replacing the
+controller's with the same names. Other clouds and credentials are kept.
+`
+
+	settingsOnlyMessage = `
+Only the controller settings will be restored. Settings fixed when the
+controller was created (its name, UUID, CA certificate and ports) are kept.
+`
+
+	perCollectionFailed = `
+Not every collection could be restored. The ones that were are recorded
+in %s - run the restore again with --per-collection and the
+same --completed-file to restore only the rest.
+`
+
+	targetDatabaseRestored = `
+
+The backup was restored into the %q database. The live juju
+database and the controller's agents haven't been changed.
 `
 )
 
@@ -0,0 +1,96 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// formatNodeStatuses renders the controller node statuses as a table
+// so that problems like a nearly-full disk or a stopped agent stand
+// out before the restore starts.
+func formatNodeStatuses(results []core.NodeStatusResult) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "    MACHINE\tIP\tROLE\tFREE\tDB SIZE\tJUJUD\tJUJU-DB")
+	for _, result := range results {
+		fmt.Fprintf(w, "    %s\t%s\t%s\t",
+			result.Member.JujuMachineID,
+			result.IP,
+			strings.ToLower(result.Member.State),
+		)
+		if result.Err != nil {
+			fmt.Fprintf(w, "✗ error: %v\n", result.Err)
+			continue
+		}
+		status := result.Status
+		free, size := "-", "-"
+		// Nodes that can't report disk usage leave both sizes empty.
+		if status.FreeSpace != 0 || status.DatabaseSize != 0 {
+			free, size = formatSize(status.FreeSpace), formatSize(status.DatabaseSize)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			free,
+			size,
+			orDash(status.AgentState),
+			orDash(status.DatabaseState),
+		)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// formatSize reports a number of bytes using binary units.
+func formatSize(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := uint64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// formatDumpSizes renders the size of each database in a backup's
+// dump, with its largest collection, so an operator can see what
+// the restore will write before it starts.
+func formatDumpSizes(databases []core.DatabaseSize) string {
+	var total int64
+	for _, database := range databases {
+		total += database.Bytes
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "\nDump size: %s\n", formatSize(uint64(total)))
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "    DATABASE\tSIZE\tLARGEST COLLECTION")
+	for _, database := range databases {
+		largest, largestSize := "", int64(-1)
+		for name, size := range database.Collections {
+			if size > largestSize || (size == largestSize && name < largest) {
+				largest, largestSize = name, size
+			}
+		}
+		if largest != "" {
+			largest = fmt.Sprintf("%s (%s)", largest, formatSize(uint64(largestSize)))
+		}
+		fmt.Fprintf(w, "    %s\t%s\t%s\n", database.Name, formatSize(uint64(database.Bytes)), orDash(largest))
+	}
+	w.Flush()
+	return buf.String()
+}
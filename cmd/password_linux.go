@@ -0,0 +1,31 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+//go:build linux
+// +build linux
+
+package cmd
+
+import (
+	"github.com/juju/errors"
+	"golang.org/x/sys/unix"
+)
+
+// disableEcho turns off echoing of input on the terminal, returning a
+// function to turn it back on.
+func disableEcho(fd int) (func(), error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	original := *termios
+	termios.Lflag &^= unix.ECHO
+	termios.Lflag |= unix.ICANON | unix.ISIG
+	termios.Iflag |= unix.ICRNL
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, &original)
+	}, nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+//go:build !linux
+// +build !linux
+
+package cmd
+
+import "github.com/juju/errors"
+
+// disableEcho isn't supported off Linux, where controllers don't run.
+func disableEcho(fd int) (func(), error) {
+	return nil, errors.NotSupportedf("reading a password without echo")
+}
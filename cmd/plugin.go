@@ -0,0 +1,239 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// PluginName is the name juju-restore runs as a Juju CLI plugin
+// under, so that it can be run as `juju restore-backup`.
+const PluginName = "juju-restore-backup"
+
+// RunJuju runs the juju CLI with the context's stdin, stdout and
+// stderr.
+func RunJuju(ctx *cmd.Context, args ...string) error {
+	command := exec.Command("juju", args...)
+	command.Stdin = ctx.Stdin
+	command.Stdout = ctx.Stdout
+	command.Stderr = ctx.Stderr
+	return command.Run()
+}
+
+// NewPluginCommand creates a cmd.Command that restores a backup from
+// a Juju client machine: it finds the controller machines using the
+// client's credentials, copies juju-restore and the backup to the
+// primary with juju scp and runs the restore there with juju ssh.
+// runJuju is used to run the juju CLI, and self is the path of the
+// juju-restore binary to copy.
+func NewPluginCommand(runJuju func(ctx *cmd.Context, args ...string) error, self string) cmd.Command {
+	return &pluginCommand{
+		remote: remoteRestore{
+			runJuju: runJuju,
+			self:    self,
+		},
+	}
+}
+
+type pluginCommand struct {
+	cmd.CommandBase
+
+	remote remoteRestore
+
+	controller  string
+	machine     string
+	description bool
+
+	backupFile  string
+	restoreArgs []string
+}
+
+// Info is part of cmd.Command.
+func (c *pluginCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju restore-backup",
+		Args:    "<backup file> [-- <juju-restore options>]",
+		Purpose: pluginPurpose,
+		Doc:     pluginDoc,
+	}
+}
+
+const pluginPurpose = "Restore a backup to a controller using juju-restore"
+
+// SetFlags is part of cmd.Command.
+func (c *pluginCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.controller, "c", "", "controller to restore to (default is the current controller)")
+	f.StringVar(&c.controller, "controller", "", "")
+	f.StringVar(&c.machine, "machine", "", "controller machine to restore on, needed if the controller is in HA (must be the MongoDB primary)")
+	// juju runs plugins with --description when listing them.
+	f.BoolVar(&c.description, "description", false, "show a short description of the plugin")
+}
+
+// Init is part of cmd.Command.
+func (c *pluginCommand) Init(args []string) error {
+	if c.description {
+		return nil
+	}
+	if len(args) == 0 {
+		return errors.New("missing backup file")
+	}
+	c.backupFile, c.restoreArgs = args[0], args[1:]
+	return nil
+}
+
+// Run is part of cmd.Command.
+func (c *pluginCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	if c.description {
+		ui.Notify(pluginPurpose + "\n")
+		return nil
+	}
+	model := "controller"
+	if c.controller != "" {
+		model = c.controller + ":controller"
+	}
+
+	ui.Notify("Finding controller machines... ")
+	machines, err := c.remote.controllerMachines(ctx, model)
+	if err != nil {
+		ui.Notify("✗\n")
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "finding controller machines"))
+	}
+	ui.Notify("✓\n")
+	target, err := c.chooseMachine(machines)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Not traced, so that an RcPassthroughError reaches cmd.Main.
+	return c.remote.run(ctx, model, target, c.backupFile, c.restoreArgs)
+}
+
+// remoteRestore runs juju-restore on a controller machine using the
+// juju CLI.
+type remoteRestore struct {
+	runJuju func(ctx *cmd.Context, args ...string) error
+	self    string
+}
+
+// run copies juju-restore and the backup to the target machine and
+// restores the backup there.
+func (r remoteRestore) run(ctx *cmd.Context, model string, target pluginMachine, backupFile string, restoreArgs []string) error {
+	ui := NewUserInteractions(ctx)
+	ui.Notify(fmt.Sprintf("Restoring on machine %s (%s).\n", target.ID, target.Address))
+
+	remoteBackup := path.Base(filepath.ToSlash(backupFile))
+	for _, upload := range []struct {
+		local, remote string
+	}{
+		{r.self, "juju-restore"},
+		{backupFile, remoteBackup},
+	} {
+		ui.Notify(fmt.Sprintf("Copying %s to machine %s...\n", upload.local, target.ID))
+		err := r.runJuju(ctx, "scp", "-m", model, upload.local, target.ID+":"+upload.remote)
+		if err != nil {
+			return core.NewFailure(core.ConnectivityFailure, errors.Annotatef(err, "copying %s", upload.local))
+		}
+	}
+
+	args := []string{"ssh", "-m", model, target.ID, "--", "sudo", "./juju-restore"}
+	args = append(args, restoreArgs...)
+	args = append(args, remoteBackup)
+	err := r.runJuju(ctx, args...)
+	if exitErr, ok := errors.Cause(err).(interface{ ExitCode() int }); ok && exitErr.ExitCode() > 0 {
+		// juju-restore has already reported the problem - exit
+		// with its code.
+		return cmd.NewRcPassthroughError(exitErr.ExitCode())
+	}
+	return errors.Trace(err)
+}
+
+// pluginMachine is a controller machine found by the plugin.
+type pluginMachine struct {
+	ID      string
+	Address string
+	// Status is the machine agent's status, e.g. started.
+	Status string
+}
+
+// controllerMachines lists the machines in the controller model that
+// are controllers.
+func (r remoteRestore) controllerMachines(ctx *cmd.Context, model string) ([]pluginMachine, error) {
+	var stdout, stderr bytes.Buffer
+	queryCtx := &cmd.Context{
+		Dir:    ctx.Dir,
+		Stdin:  strings.NewReader(""),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	if err := r.runJuju(queryCtx, "machines", "-m", model, "--format", "json"); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, errors.Errorf("%v: %s", err, message)
+		}
+		return nil, errors.Trace(err)
+	}
+	var status struct {
+		Machines map[string]struct {
+			DNSName    string `json:"dns-name"`
+			JujuStatus struct {
+				Current string `json:"current"`
+			} `json:"juju-status"`
+			ControllerMemberStatus string `json:"controller-member-status"`
+		} `json:"machines"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &status); err != nil {
+		return nil, errors.Annotate(err, "reading juju machines output")
+	}
+	var all, controllers []pluginMachine
+	for id, machine := range status.Machines {
+		m := pluginMachine{ID: id, Address: machine.DNSName, Status: machine.JujuStatus.Current}
+		all = append(all, m)
+		if machine.ControllerMemberStatus != "" {
+			controllers = append(controllers, m)
+		}
+	}
+	// Older versions of juju don't report the member status; the
+	// machines in the controller model are the controllers.
+	if len(controllers) == 0 {
+		controllers = all
+	}
+	if len(controllers) == 0 {
+		return nil, errors.Errorf("no machines in model %q", model)
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].ID < controllers[j].ID
+	})
+	return controllers, nil
+}
+
+// chooseMachine picks the machine to run juju-restore on.
+func (c *pluginCommand) chooseMachine(machines []pluginMachine) (pluginMachine, error) {
+	var ids []string
+	for _, m := range machines {
+		if c.machine == m.ID {
+			return m, nil
+		}
+		ids = append(ids, m.ID)
+	}
+	if c.machine != "" {
+		return pluginMachine{}, errors.Errorf("machine %q is not a controller machine (controllers: %s)", c.machine, strings.Join(ids, ", "))
+	}
+	if len(machines) > 1 {
+		return pluginMachine{}, errors.Errorf("controller is in HA (machines %s) - use --machine to pick the MongoDB primary", strings.Join(ids, ", "))
+	}
+	return machines[0], nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"fmt"
+	"os/exec"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+)
+
+type pluginSuite struct {
+	testing.IsolationSuite
+
+	calls    [][]string
+	machines string
+	errs     map[string]error
+}
+
+var _ = gc.Suite(&pluginSuite{})
+
+const singleController = `{"model": {"name": "controller"}, "machines": {
+	"0": {"dns-name": "10.0.0.1", "controller-member-status": "has-vote"}
+}}`
+
+const haController = `{"model": {"name": "controller"}, "machines": {
+	"0": {"dns-name": "10.0.0.1", "controller-member-status": "has-vote"},
+	"1": {"dns-name": "10.0.0.2", "controller-member-status": "has-vote"},
+	"2": {"dns-name": "10.0.0.3", "controller-member-status": "has-vote"}
+}}`
+
+func (s *pluginSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.calls = nil
+	s.machines = singleController
+	s.errs = make(map[string]error)
+}
+
+func (s *pluginSuite) runJuju(ctx *corecmd.Context, args ...string) error {
+	s.calls = append(s.calls, args)
+	if args[0] == "machines" {
+		fmt.Fprint(ctx.Stdout, s.machines)
+	}
+	return s.errs[args[0]]
+}
+
+func (s *pluginSuite) run(c *gc.C, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewPluginCommand(s.runJuju, "/usr/bin/juju-restore")
+	return cmdtesting.RunCommand(c, command, args...)
+}
+
+func (s *pluginSuite) TestRestore(c *gc.C) {
+	ctx, err := s.run(c, "/backups/backup.tar.gz", "--", "--copy-controller")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.calls, jc.DeepEquals, [][]string{
+		{"machines", "-m", "controller", "--format", "json"},
+		{"scp", "-m", "controller", "/usr/bin/juju-restore", "0:juju-restore"},
+		{"scp", "-m", "controller", "/backups/backup.tar.gz", "0:backup.tar.gz"},
+		{"ssh", "-m", "controller", "0", "--", "sudo", "./juju-restore", "--copy-controller", "backup.tar.gz"},
+	})
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Finding controller machines... ✓
+Restoring on machine 0 (10.0.0.1).
+Copying /usr/bin/juju-restore to machine 0...
+Copying /backups/backup.tar.gz to machine 0...
+`[1:])
+}
+
+func (s *pluginSuite) TestHAController(c *gc.C) {
+	s.machines = haController
+	_, err := s.run(c, "-c", "prod", "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, `controller is in HA \(machines 0, 1, 2\) - use --machine to pick the MongoDB primary`)
+
+	_, err = s.run(c, "-c", "prod", "--machine", "3", "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, `machine "3" is not a controller machine \(controllers: 0, 1, 2\)`)
+
+	s.calls = nil
+	_, err = s.run(c, "-c", "prod", "--machine", "1", "backup.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.calls[0], jc.DeepEquals, []string{"machines", "-m", "prod:controller", "--format", "json"})
+	c.Assert(s.calls[3], jc.DeepEquals, []string{"ssh", "-m", "prod:controller", "1", "--", "sudo", "./juju-restore", "backup.tar.gz"})
+}
+
+func (s *pluginSuite) TestDiscoveryFails(c *gc.C) {
+	s.errs["machines"] = errors.New("exit status 1")
+	_, err := s.run(c, "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, "finding controller machines: exit status 1")
+	c.Assert(err, jc.Satisfies, core.IsConnectivityError)
+}
+
+func (s *pluginSuite) TestRestoreExitCodePassedThrough(c *gc.C) {
+	s.errs["ssh"] = exec.Command("/bin/sh", "-c", "exit 3").Run()
+	_, err := s.run(c, "backup.tar.gz")
+	c.Assert(err, gc.DeepEquals, corecmd.NewRcPassthroughError(cmd.ExitPrecheckFailed))
+}
+
+func (s *pluginSuite) TestDescription(c *gc.C) {
+	ctx, err := s.run(c, "--description")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "Restore a backup to a controller using juju-restore\n")
+	c.Assert(s.calls, gc.HasLen, 0)
+}
+
+func (s *pluginSuite) TestMissingBackup(c *gc.C) {
+	_, err := s.run(c)
+	c.Assert(err, gc.ErrorMatches, "missing backup file")
+}
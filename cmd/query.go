@@ -0,0 +1,81 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/backup"
+)
+
+// NewQueryCommand creates a cmd.Command that prints the documents in
+// a backup's collection matching a filter with query.
+func NewQueryCommand(query func(path, tempRoot, collection string, filter backup.Filter, limit int, output io.Writer) (int, error)) cmd.Command {
+	return &queryCommand{query: query}
+}
+
+type queryCommand struct {
+	cmd.CommandBase
+
+	query func(path, tempRoot, collection string, filter backup.Filter, limit int, output io.Writer) (int, error)
+
+	limit      int
+	tempRoot   string
+	backupFile string
+	collection string
+	filter     backup.Filter
+}
+
+// Info is part of cmd.Command.
+func (c *queryCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore query",
+		Args:    "<backup file> <collection> [<filter>...]",
+		Purpose: "Print the documents in a backup's collection that match a filter",
+		Doc:     queryDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *queryCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.IntVar(&c.limit, "limit", 0, "stop after this many matching documents (0 prints them all)")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack the backup file while querying it")
+}
+
+// Init is part of cmd.Command.
+func (c *queryCommand) Init(args []string) error {
+	switch len(args) {
+	case 0:
+		return errors.New("missing backup file")
+	case 1:
+		return errors.New("missing collection")
+	}
+	if c.limit < 0 {
+		return errors.New("--limit can't be negative")
+	}
+	c.backupFile, c.collection = args[0], args[1]
+	filter, err := backup.ParseFilter(args[2:])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.filter = filter
+	return nil
+}
+
+// Run is part of cmd.Command.
+func (c *queryCommand) Run(ctx *cmd.Context) error {
+	// Only the documents go to stdout so they can be piped.
+	matched, err := c.query(ctx.AbsPath(c.backupFile), c.tempRoot, c.collection, c.filter, c.limit, ctx.Stdout)
+	if err != nil {
+		return errors.Annotate(err, "querying backup")
+	}
+	fmt.Fprintf(ctx.Stderr, "%d documents matched.\n", matched)
+	return nil
+}
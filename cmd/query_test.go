@@ -0,0 +1,87 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/cmd"
+)
+
+type querySuite struct {
+	testing.IsolationSuite
+
+	path       string
+	collection string
+	filter     backup.Filter
+	limit      int
+	err        error
+}
+
+var _ = gc.Suite(&querySuite{})
+
+func (s *querySuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.path, s.collection, s.filter, s.limit, s.err = "", "", nil, 0, nil
+}
+
+func (s *querySuite) query(path, tempRoot, collection string, filter backup.Filter, limit int, output io.Writer) (int, error) {
+	s.path, s.collection, s.filter, s.limit = path, collection, filter, limit
+	fmt.Fprintln(output, `{"_id":"uuid:0","series":"focal"}`)
+	return 1, s.err
+}
+
+func (s *querySuite) TestQuery(c *gc.C) {
+	dir := c.MkDir()
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewQueryCommand(s.query),
+		filepath.Join(dir, "backup.tar.gz"), "machines", "series=focal", "life!=2", "--limit", "5")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.path, gc.Equals, filepath.Join(dir, "backup.tar.gz"))
+	c.Assert(s.collection, gc.Equals, "machines")
+	c.Assert(s.limit, gc.Equals, 5)
+	c.Assert(s.filter, gc.HasLen, 2)
+	c.Assert(s.filter.Matches(bson.D{{Name: "series", Value: "focal"}, {Name: "life", Value: 0}}), jc.IsTrue)
+	c.Assert(s.filter.Matches(bson.D{{Name: "series", Value: "focal"}, {Name: "life", Value: 2}}), jc.IsFalse)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `{"_id":"uuid:0","series":"focal"}`+"\n")
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "1 documents matched.\n")
+}
+
+func (s *querySuite) TestQueryFails(c *gc.C) {
+	s.err = errors.New(`collection "juju.units" isn't in the backup`)
+	_, err := cmdtesting.RunCommand(c, cmd.NewQueryCommand(s.query), "backup.tar.gz", "units")
+	c.Assert(err, gc.ErrorMatches, `querying backup: collection "juju.units" isn't in the backup`)
+	c.Assert(s.filter, gc.HasLen, 0)
+}
+
+func (s *querySuite) TestInitErrors(c *gc.C) {
+	for i, test := range []struct {
+		args     []string
+		errMatch string
+	}{{
+		errMatch: "missing backup file",
+	}, {
+		args:     []string{"backup.tar.gz"},
+		errMatch: "missing collection",
+	}, {
+		args:     []string{"backup.tar.gz", "machines", "--limit", "-1"},
+		errMatch: "--limit can't be negative",
+	}, {
+		args:     []string{"backup.tar.gz", "machines", "=focal"},
+		errMatch: `invalid filter "=focal" .*`,
+	}} {
+		c.Logf("%d: %v", i, test.args)
+		_, err := cmdtesting.RunCommand(c, cmd.NewQueryCommand(s.query), test.args...)
+		c.Assert(err, gc.ErrorMatches, test.errMatch)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/core"
+)
+
+const (
+	defaultRebuildWait  = 15 * time.Minute
+	rebuildPollInterval = 10 * time.Second
+)
+
+// NewRebuildCommand creates a cmd.Command that bootstraps a
+// replacement controller and restores a backup to it, from a Juju
+// client machine. runJuju is used to run the juju CLI, openBackup to
+// read the backup's metadata, and self is the path of the
+// juju-restore binary to copy to the new controller.
+func NewRebuildCommand(
+	runJuju func(ctx *cmd.Context, args ...string) error,
+	openBackup func(path, tempRoot string) (core.BackupFile, error),
+	self string,
+) cmd.Command {
+	return &rebuildCommand{
+		remote: remoteRestore{
+			runJuju: runJuju,
+			self:    self,
+		},
+		openBackup: openBackup,
+	}
+}
+
+type rebuildCommand struct {
+	cmd.CommandBase
+
+	remote     remoteRestore
+	openBackup func(path, tempRoot string) (core.BackupFile, error)
+
+	credential       string
+	bootstrapOptions []string
+	wait             time.Duration
+	tempRoot         string
+
+	cloud       string
+	controller  string
+	backupFile  string
+	restoreArgs []string
+}
+
+// Info is part of cmd.Command.
+func (c *rebuildCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore rebuild",
+		Args:    "<cloud[/region]> <controller name> <backup file> [-- <juju-restore options>]",
+		Purpose: "Bootstrap a replacement controller and restore a backup to it",
+		Doc:     rebuildDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *rebuildCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.credential, "credential", "", "cloud credential to bootstrap with (default is the cloud's default credential)")
+	f.Var(cmd.NewAppendStringsValue(&c.bootstrapOptions), "bootstrap-option", "extra option passed to juju bootstrap, can be repeated (e.g. --bootstrap-option=--config=key=value)")
+	f.DurationVar(&c.wait, "wait", defaultRebuildWait, "how long to wait for the new controller machine to start after bootstrapping")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack the backup file while reading its details")
+}
+
+// Init is part of cmd.Command.
+func (c *rebuildCommand) Init(args []string) error {
+	if len(args) < 3 {
+		return errors.New("expected a cloud, a controller name and a backup file")
+	}
+	c.cloud, c.controller, c.backupFile = args[0], args[1], args[2]
+	c.restoreArgs = args[3:]
+	for _, arg := range c.restoreArgs {
+		if arg == "--copy-controller" {
+			return errors.New("--copy-controller is always used by rebuild")
+		}
+	}
+	return nil
+}
+
+// Run is part of cmd.Command.
+func (c *rebuildCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+
+	// The new controller needs to run the same Juju version and
+	// series as the backed up one for the backup to be restorable.
+	ui.Notify("Reading backup file... ")
+	backup, err := c.openBackup(c.backupFile, c.tempRoot)
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "opening backup")
+	}
+	metadata, err := backup.Metadata()
+	closeErr := backup.Close()
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "reading backup metadata")
+	}
+	if closeErr != nil {
+		logger.Warningf("removing unpacked backup: %v", closeErr)
+	}
+	ui.Notify("✓\n")
+
+	args := []string{"bootstrap", c.cloud, c.controller,
+		"--agent-version", metadata.JujuVersion.String(),
+		"--bootstrap-series", metadata.Series,
+	}
+	if c.credential != "" {
+		args = append(args, "--credential", c.credential)
+	}
+	args = append(args, c.bootstrapOptions...)
+	ui.Notify(fmt.Sprintf("Bootstrapping controller %s on %s with Juju %s (%s)...\n",
+		c.controller, c.cloud, metadata.JujuVersion, metadata.Series))
+	if err := c.remote.runJuju(ctx, args...); err != nil {
+		return errors.Annotate(err, "bootstrapping")
+	}
+
+	model := c.controller + ":controller"
+	target, err := c.waitForController(ctx, model)
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Trace(err))
+	}
+	restoreArgs := append([]string{"--copy-controller"}, c.restoreArgs...)
+	// Not traced, so that an RcPassthroughError reaches cmd.Main.
+	return c.remote.run(ctx, model, target, c.backupFile, restoreArgs)
+}
+
+// waitForController waits until the new controller's machine agent
+// has started.
+func (c *rebuildCommand) waitForController(ctx *cmd.Context, model string) (pluginMachine, error) {
+	ui := NewUserInteractions(ctx)
+	ui.Notify("Waiting for the controller machine to start... ")
+	deadline := time.Now().Add(c.wait)
+	for {
+		machines, err := c.remote.controllerMachines(ctx, model)
+		if err == nil && machines[0].Status == "started" {
+			ui.Notify("✓\n")
+			return machines[0], nil
+		}
+		if time.Now().After(deadline) {
+			ui.Notify("✗\n")
+			if err != nil {
+				return pluginMachine{}, errors.Annotate(err, "waiting for controller machine")
+			}
+			return pluginMachine{}, errors.Errorf("controller machine %s not started after %s (status %q)", machines[0].ID, c.wait, machines[0].Status)
+		}
+		if err != nil {
+			logger.Debugf("controller not ready: %v", err)
+		}
+		time.Sleep(rebuildPollInterval)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"fmt"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+)
+
+type rebuildSuite struct {
+	testing.IsolationSuite
+
+	calls    [][]string
+	status   string
+	errs     map[string]error
+	backup   *coretesting.BackupFile
+	openPath string
+}
+
+var _ = gc.Suite(&rebuildSuite{})
+
+func (s *rebuildSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.calls = nil
+	s.status = "started"
+	s.errs = make(map[string]error)
+	s.openPath = ""
+	s.backup = &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
+			return core.BackupMetadata{
+				JujuVersion: version.MustParse("2.9.37"),
+				Series:      "focal",
+			}, nil
+		},
+	}
+}
+
+func (s *rebuildSuite) runJuju(ctx *corecmd.Context, args ...string) error {
+	s.calls = append(s.calls, args)
+	if args[0] == "machines" {
+		fmt.Fprintf(ctx.Stdout, `{"machines": {"0": {"dns-name": "10.0.0.9", "juju-status": {"current": %q}}}}`, s.status)
+	}
+	return s.errs[args[0]]
+}
+
+func (s *rebuildSuite) run(c *gc.C, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewRebuildCommand(s.runJuju, func(path, tempRoot string) (core.BackupFile, error) {
+		s.openPath = path
+		return s.backup, nil
+	}, "/usr/bin/juju-restore")
+	return cmdtesting.RunCommand(c, command, args...)
+}
+
+func (s *rebuildSuite) TestRebuild(c *gc.C) {
+	ctx, err := s.run(c, "--credential", "ops", "--bootstrap-option", "--config=test-mode=true",
+		"aws/us-east-1", "replacement", "/backups/backup.tar.gz", "--", "--yes")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.openPath, gc.Equals, "/backups/backup.tar.gz")
+	s.backup.CheckCallNames(c, "Metadata", "Close")
+	c.Assert(s.calls, jc.DeepEquals, [][]string{
+		{"bootstrap", "aws/us-east-1", "replacement", "--agent-version", "2.9.37", "--bootstrap-series", "focal",
+			"--credential", "ops", "--config=test-mode=true"},
+		{"machines", "-m", "replacement:controller", "--format", "json"},
+		{"scp", "-m", "replacement:controller", "/usr/bin/juju-restore", "0:juju-restore"},
+		{"scp", "-m", "replacement:controller", "/backups/backup.tar.gz", "0:backup.tar.gz"},
+		{"ssh", "-m", "replacement:controller", "0", "--", "sudo", "./juju-restore", "--copy-controller", "--yes", "backup.tar.gz"},
+	})
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Reading backup file... ✓
+Bootstrapping controller replacement on aws/us-east-1 with Juju 2.9.37 (focal)...
+Waiting for the controller machine to start... ✓
+Restoring on machine 0 (10.0.0.9).
+Copying /usr/bin/juju-restore to machine 0...
+Copying /backups/backup.tar.gz to machine 0...
+`[1:])
+}
+
+func (s *rebuildSuite) TestBootstrapFails(c *gc.C) {
+	s.errs["bootstrap"] = errors.New("exit status 1")
+	_, err := s.run(c, "aws", "replacement", "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, "bootstrapping: exit status 1")
+	c.Assert(s.calls, gc.HasLen, 1)
+}
+
+func (s *rebuildSuite) TestControllerNotStarted(c *gc.C) {
+	s.status = "pending"
+	_, err := s.run(c, "--wait", "0s", "aws", "replacement", "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, `controller machine 0 not started after 0s \(status "pending"\)`)
+	c.Assert(err, jc.Satisfies, core.IsConnectivityError)
+}
+
+func (s *rebuildSuite) TestArgs(c *gc.C) {
+	_, err := s.run(c, "aws", "replacement")
+	c.Assert(err, gc.ErrorMatches, "expected a cloud, a controller name and a backup file")
+	_, err = s.run(c, "aws", "replacement", "backup.tar.gz", "--", "--copy-controller")
+	c.Assert(err, gc.ErrorMatches, "--copy-controller is always used by rebuild")
+}
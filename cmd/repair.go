@@ -0,0 +1,115 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/backup"
+)
+
+// NewRepairCommand creates a cmd.Command that recovers what it can
+// from a damaged backup file with salvage and, if the operator agrees,
+// writes the recovered collections to a new backup file.
+func NewRepairCommand(salvage func(path, tempRoot string) (backup.SalvagedBackup, error)) cmd.Command {
+	return &repairCommand{salvage: salvage}
+}
+
+type repairCommand struct {
+	cmd.CommandBase
+
+	salvage func(path, tempRoot string) (backup.SalvagedBackup, error)
+
+	output       string
+	metadataFile string
+	tempRoot     string
+	assumeYes    bool
+	backupFile   string
+}
+
+// Info is part of cmd.Command.
+func (c *repairCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore repair",
+		Args:    "<backup file>",
+		Purpose: "Recover the intact collections from a truncated or corrupt backup",
+		Doc:     repairDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *repairCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.output, "output", "", "file to write the repaired backup to (default <backup file>-repaired.tar.gz)")
+	f.StringVar(&c.metadataFile, "metadata", "", "metadata.json to use in the repaired backup (if the backup's was lost)")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack the backup file while repairing it")
+	f.BoolVar(&c.assumeYes, "yes", false, "write the repaired backup without asking, even if collections were lost")
+}
+
+// Init is part of cmd.Command.
+func (c *repairCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing backup file")
+	}
+	c.backupFile, args = args[0], args[1:]
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *repairCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	output := c.output
+	if output == "" {
+		output = strings.TrimSuffix(c.backupFile, ".tar.gz") + "-repaired.tar.gz"
+	}
+	output = ctx.AbsPath(output)
+	if _, err := os.Stat(output); err == nil {
+		return errors.Errorf("%s already exists", output)
+	}
+	metadataFile := c.metadataFile
+	if metadataFile != "" {
+		metadataFile = ctx.AbsPath(metadataFile)
+	}
+
+	ui.Notify("Recovering backup contents... ")
+	salvaged, err := c.salvage(ctx.AbsPath(c.backupFile), c.tempRoot)
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "repairing backup")
+	}
+	defer func() {
+		if err := salvaged.Close(); err != nil {
+			logger.Errorf("couldn't remove recovered files: %s", err)
+		}
+	}()
+	ui.Notify("✓\n")
+	report := salvaged.Report()
+	if report.Intact() {
+		ui.Notify("The backup file isn't damaged - there's nothing to repair.\n")
+		return nil
+	}
+	ui.Notify(populate(repairReportTemplate, report))
+	if report.MetadataLost && metadataFile == "" {
+		ui.Notify(repairMetadataInferred)
+	}
+
+	if !c.assumeYes {
+		ui.Notify(repairPartialRestore)
+		ui.Notify(fmt.Sprintf("\nWrite the recovered collections to %s? (y/N): ", output))
+		if err := ui.UserConfirmYes(); err != nil {
+			return errors.Annotate(err, "repair")
+		}
+	}
+	if err := salvaged.Write(output, metadataFile); err != nil {
+		return errors.Annotate(err, "writing repaired backup")
+	}
+	ui.Notify(fmt.Sprintf("Repaired backup written to %s (%d collections).\n", output, len(report.Recovered)))
+	return nil
+}
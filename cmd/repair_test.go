@@ -0,0 +1,153 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"path/filepath"
+	"strings"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/backup"
+	"github.com/juju/juju-restore/cmd"
+)
+
+type repairSuite struct {
+	testing.IsolationSuite
+
+	dir      string
+	salvaged *fakeSalvaged
+}
+
+var _ = gc.Suite(&repairSuite{})
+
+func (s *repairSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.dir = c.MkDir()
+	s.salvaged = &fakeSalvaged{report: backup.SalvageReport{
+		ArchiveError: "unexpected EOF in juju-backup/dump/juju/units.bson",
+		Recovered:    []string{"juju.clouds", "juju.models"},
+		Lost: []backup.LostItem{
+			{Name: "juju.units", Reason: "cut off"},
+			{Name: "root.tar", Reason: "missing"},
+		},
+	}}
+}
+
+func (s *repairSuite) salvage(path, tempRoot string) (backup.SalvagedBackup, error) {
+	s.salvaged.path = path
+	return s.salvaged, nil
+}
+
+func (s *repairSuite) run(c *gc.C, input string, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewRepairCommand(s.salvage)
+	err := cmdtesting.InitCommand(command, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx := cmdtesting.Context(c)
+	ctx.Dir = s.dir
+	ctx.Stdin = strings.NewReader(input)
+	return ctx, command.Run(ctx)
+}
+
+func (s *repairSuite) TestRepair(c *gc.C) {
+	ctx, err := s.run(c, "y\n", "backup.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	output := filepath.Join(s.dir, "backup-repaired.tar.gz")
+	c.Assert(s.salvaged.path, gc.Equals, filepath.Join(s.dir, "backup.tar.gz"))
+	c.Assert(s.salvaged.output, gc.Equals, output)
+	c.Assert(s.salvaged.closed, jc.IsTrue)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Recovering backup contents... ✓
+
+The archive is damaged: unexpected EOF in juju-backup/dump/juju/units.bson
+Recovered 2 collections.
+Lost:
+    juju.units: cut off
+    root.tar: missing
+
+Restoring the repaired backup will only restore the recovered collections -
+the lost ones will keep whatever the controller has in them, which may
+leave it inconsistent.
+
+Write the recovered collections to `[1:]+output+`? (y/N): Repaired backup written to `+output+` (2 collections).
+`)
+}
+
+func (s *repairSuite) TestRepairDeclined(c *gc.C) {
+	_, err := s.run(c, "n\n", "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, "repair: aborted")
+	c.Assert(s.salvaged.output, gc.Equals, "")
+	c.Assert(s.salvaged.closed, jc.IsTrue)
+}
+
+func (s *repairSuite) TestRepairYes(c *gc.C) {
+	_, err := s.run(c, "", "backup.tar.gz", "--yes", "--output", "/tmp/fixed.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.salvaged.output, gc.Equals, "/tmp/fixed.tar.gz")
+}
+
+func (s *repairSuite) TestIntact(c *gc.C) {
+	s.salvaged.report = backup.SalvageReport{Recovered: []string{"juju.models"}}
+	ctx, err := s.run(c, "", "backup.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Recovering backup contents... ✓
+The backup file isn't damaged - there's nothing to repair.
+`[1:])
+	c.Assert(s.salvaged.output, gc.Equals, "")
+}
+
+func (s *repairSuite) TestMetadataLost(c *gc.C) {
+	s.salvaged.report.MetadataLost = true
+	ctx, err := s.run(c, "y\n", "backup.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "restoring the repaired backup will infer\nthe metadata from the database dump")
+	c.Assert(s.salvaged.metadataPath, gc.Equals, "")
+
+	s.salvaged.output = ""
+	_, err = s.run(c, "y\n", "backup.tar.gz", "--metadata", "metadata.json", "--output", "other.tar.gz")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.salvaged.metadataPath, gc.Equals, filepath.Join(s.dir, "metadata.json"))
+}
+
+func (s *repairSuite) TestSalvageFails(c *gc.C) {
+	_, err := cmdtesting.RunCommand(c, cmd.NewRepairCommand(func(string, string) (backup.SalvagedBackup, error) {
+		return nil, errors.New("reading compressed backup: gzip: invalid header")
+	}), "backup.tar.gz")
+	c.Assert(err, gc.ErrorMatches, "repairing backup: reading compressed backup: gzip: invalid header")
+}
+
+func (s *repairSuite) TestMissingBackup(c *gc.C) {
+	_, err := s.run(c, "")
+	c.Assert(err, gc.ErrorMatches, "missing backup file")
+}
+
+type fakeSalvaged struct {
+	report       backup.SalvageReport
+	path         string
+	output       string
+	metadataPath string
+	closed       bool
+}
+
+func (f *fakeSalvaged) Report() backup.SalvageReport {
+	return f.report
+}
+
+func (f *fakeSalvaged) Write(output, metadataPath string) error {
+	f.output, f.metadataPath = output, metadataPath
+	return nil
+}
+
+func (f *fakeSalvaged) Close() error {
+	f.closed = true
+	return nil
+}
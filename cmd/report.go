@@ -0,0 +1,337 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// runReport records what a run of juju-restore did, so it can be
+// summarised at the end and written out as JSON with --report.
+type runReport struct {
+	BackupID        string                    `json:"backup-id,omitempty"`
+	Phases          []phaseReport             `json:"phases"`
+	Nodes           []nodeReport              `json:"nodes,omitempty"`
+	Changes         []changeReport            `json:"changes,omitempty"`
+	Collections     []core.RestoredCollection `json:"collections,omitempty"`
+	Merged          []core.MergedCollection   `json:"merged,omitempty"`
+	SettingsChanged []string                  `json:"settings-changed,omitempty"`
+	CopySkipped     []string                  `json:"copy-skipped,omitempty"`
+	Permissions     []core.PermissionRewrite  `json:"permissions,omitempty"`
+	AgentBinaries   []string                  `json:"agent-binaries-copied,omitempty"`
+	Readiness       *core.MigrationReadiness  `json:"migration-readiness,omitempty"`
+	VersionChange   *versionChange            `json:"version-change,omitempty"`
+	Warnings        []string                  `json:"warnings,omitempty"`
+	Decisions       []decisionReport          `json:"decisions,omitempty"`
+	FinalHealth     []memberHealth            `json:"final-health,omitempty"`
+	RestoreLog      string                    `json:"restore-log,omitempty"`
+	LogDigest       *core.RestoreLogDigest    `json:"restore-log-digest,omitempty"`
+	Error           string                    `json:"error,omitempty"`
+	DryRun          bool                      `json:"dry-run,omitempty"`
+
+	// current is the phase being run, used to label node results.
+	current string
+
+	// events, if set, is sent everything recorded as it happens.
+	events *eventStream
+
+	// expectedPhases is the number of phases in a complete run, used
+	// to report progress.
+	expectedPhases int
+
+	// path, if set, is where the report is saved each time a change
+	// is recorded, so that what was changed is known even if
+	// juju-restore doesn't get to finish.
+	path string
+
+	// mu guards the node results, changes and warnings, which are
+	// recorded as the nodes are operated on concurrently.
+	mu sync.Mutex
+}
+
+// phaseReport records how long one phase of the run took and whether
+// it failed.
+type phaseReport struct {
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+	Seconds float64   `json:"seconds"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Took returns the phase duration for display.
+func (p phaseReport) Took() time.Duration {
+	return time.Duration(p.Seconds * float64(time.Second)).Round(time.Second)
+}
+
+// nodeReport records the result of an operation on a controller node.
+type nodeReport struct {
+	Node      string `json:"node"`
+	Operation string `json:"operation"`
+	Error     string `json:"error,omitempty"`
+}
+
+// changeReport records an action that modified the controller.
+type changeReport struct {
+	Time   time.Time `json:"time"`
+	Phase  string    `json:"phase"`
+	Target string    `json:"target"`
+	Action string    `json:"action"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// decisionReport records the answer to a confirmation prompt and
+// where it came from: the operator, an answers file or a flag.
+type decisionReport struct {
+	Prompt string `json:"prompt"`
+	Yes    bool   `json:"yes"`
+	By     string `json:"by"`
+}
+
+// memberHealth records the state of a controller's replica set
+// member as last checked.
+type memberHealth struct {
+	Member  string `json:"member"`
+	Machine string `json:"machine,omitempty"`
+	State   string `json:"state"`
+	Healthy bool   `json:"healthy"`
+}
+
+// versionChange records the controller agents being moved to the
+// backup's Juju version.
+type versionChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// phase runs a phase of the restore, recording how long it took and
+// any error.
+func (r *runReport) phase(name string, run func() error) error {
+	started := time.Now()
+	r.current = name
+	r.send(runEvent{Type: eventPhaseStarted, Phase: name})
+	err := run()
+	r.current = ""
+	phase := phaseReport{
+		Name:    name,
+		Started: started,
+		Seconds: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		phase.Error = err.Error()
+	}
+	r.Phases = append(r.Phases, phase)
+	r.send(runEvent{Type: eventPhaseFinished, Phase: name, Error: phase.Error})
+	return err
+}
+
+// node records the result of the current phase's operation on a
+// controller node.
+func (r *runReport) node(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := nodeReport{Node: name, Operation: r.current}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.Nodes = append(r.Nodes, result)
+	r.send(runEvent{Type: eventNode, Phase: r.current, Node: name, Error: result.Error})
+}
+
+// changed records an action that modified the controller, saving the
+// report so far if it's being written to a file.
+func (r *runReport) changed(change core.Change) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := changeReport{
+		Time:   time.Now().UTC(),
+		Phase:  r.current,
+		Target: change.Target,
+		Action: change.Action,
+	}
+	if change.Err != nil {
+		result.Error = change.Err.Error()
+	}
+	r.Changes = append(r.Changes, result)
+	r.send(runEvent{Type: eventChange, Phase: r.current, Node: change.Target, Message: change.Action, Error: result.Error})
+	if r.path == "" {
+		return
+	}
+	if err := r.writeLocked(r.path); err != nil {
+		logger.Errorf("saving report: %v", err)
+	}
+}
+
+// scriptOutput sends a line of output from a script run on a
+// controller node to event stream clients.
+func (r *runReport) scriptOutput(node, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.send(runEvent{Type: eventOutput, Phase: r.current, Node: node, Message: line})
+}
+
+// warn records a warning shown to the user.
+func (r *runReport) warn(warning string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, warning)
+	r.send(runEvent{Type: eventWarning, Phase: r.current, Message: warning})
+}
+
+// decided records the answer to a confirmation prompt.
+func (r *runReport) decided(prompt string, yes bool, by string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Decisions = append(r.Decisions, decisionReport{Prompt: prompt, Yes: yes, By: by})
+}
+
+// health records the controller's replica set members as they were
+// last seen at the end of the run.
+func (r *runReport) health(members []core.ReplicaSetMember) {
+	r.FinalHealth = nil
+	for _, member := range members {
+		r.FinalHealth = append(r.FinalHealth, memberHealth{
+			Member:  member.Name,
+			Machine: member.JujuMachineID,
+			State:   member.State,
+			Healthy: member.Healthy,
+		})
+	}
+}
+
+// restored records the outcome of the database restore.
+func (r *runReport) restored(result *core.RestoreResult) {
+	r.Collections = result.Collections
+	r.Merged = result.Merged
+	r.SettingsChanged = result.SettingsChanged
+	r.CopySkipped = result.CopySkipped
+	r.Permissions = result.Permissions
+	r.AgentBinaries = result.AgentBinaries
+	r.Readiness = result.Readiness
+	if !result.LogDigest.Empty() {
+		r.LogDigest = &result.LogDigest
+	}
+	if result.JujuVersion != result.PreviousJujuVersion {
+		r.VersionChange = &versionChange{
+			From: result.PreviousJujuVersion.String(),
+			To:   result.JujuVersion.String(),
+		}
+	}
+}
+
+// finished records the end of the run.
+func (r *runReport) finished() {
+	r.send(runEvent{Type: eventFinished, Error: r.Error})
+}
+
+// send passes an event to the event stream, if there is one.
+func (r *runReport) send(event runEvent) {
+	if r.events == nil {
+		return
+	}
+	if r.expectedPhases > 0 {
+		event.Progress = len(r.Phases) * 100 / r.expectedPhases
+		if event.Progress > 100 {
+			event.Progress = 100
+		}
+	}
+	r.events.send(event)
+}
+
+// PermissionCounts totals what the controller copy did with the
+// source's permissions.
+func (r *runReport) PermissionCounts() core.PermissionCounts {
+	return core.CountPermissions(r.Permissions)
+}
+
+// Documents returns the total number of documents restored.
+func (r *runReport) Documents() int {
+	var total int
+	for _, collection := range r.Collections {
+		total += collection.Documents
+	}
+	return total
+}
+
+// started returns true if the run got past the pre-checks, so
+// something on the controller may have changed.
+func (r *runReport) started() bool {
+	for _, phase := range r.Phases {
+		if phase.Name != phasePreChecks {
+			return true
+		}
+	}
+	return false
+}
+
+// write saves the report as JSON to the specified path.
+func (r *runReport) write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeLocked(path)
+}
+
+func (r *runReport) writeLocked(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(path, append(data, '\n'), 0644))
+}
+
+// writeTicket saves the report in a form suited to attaching to
+// change tickets: HTML if path ends in .html or .htm, and markdown
+// otherwise.
+func (r *runReport) writeTicket(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var content bytes.Buffer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		t, err := htmltemplate.New("ticket").Parse(ticketHTMLTemplate)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = t.Execute(&content, r)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	default:
+		t, err := template.New("ticket").Funcs(template.FuncMap{
+			"cell": markdownCell,
+		}).Parse(ticketMarkdownTemplate)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = t.Execute(&content, r)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(ioutil.WriteFile(path, content.Bytes(), 0644))
+}
+
+// markdownCell escapes text so it can go in a markdown table cell.
+func markdownCell(text string) string {
+	text = strings.Replace(text, "|", "\\|", -1)
+	return strings.Replace(text, "\n", " ", -1)
+}
+
+const (
+	phasePreChecks   = "pre-checks"
+	phaseStopAgents  = "stop agents"
+	phaseRestore     = "restore"
+	phaseStartAgents = "start agents"
+)
@@ -6,10 +6,19 @@ package cmd
 import (
 	"bytes"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/juju/clock"
 	"github.com/juju/cmd/v3"
+	"github.com/juju/collections/set"
 	"github.com/juju/errors"
 	"github.com/juju/gnuflag"
 	"github.com/juju/loggo"
@@ -17,6 +26,7 @@ import (
 
 	"github.com/juju/juju-restore/core"
 	"github.com/juju/juju-restore/db"
+	"github.com/juju/juju-restore/machine"
 )
 
 var logger = loggo.GetLogger("juju-restore.cmd")
@@ -24,23 +34,33 @@ var logger = loggo.GetLogger("juju-restore.cmd")
 const (
 	defaultLogConfig = "<root>=INFO"
 	verboseLogConfig = "<root>=DEBUG"
+
+	defaultParallelism       = 4
+	defaultStartRetries      = 3
+	defaultCollectionRetries = 3
+	defaultMaxLag            = time.Minute
+	defaultMaxSkew           = 5 * time.Second
+	defaultHostname          = "localhost"
+	defaultPort              = "37017"
 )
 
 // NewRestoreCommand creates a cmd.Command to check the database and
 // restore the Juju backup.
 func NewRestoreCommand(
 	dbConnect func(info db.DialInfo) (core.Database, error),
-	openBackup func(path, tempRoot string) (core.BackupFile, error),
-	machineConverter func(member core.ReplicaSetMember) core.ControllerNode,
-	loadCreds func() (string, string, error),
+	openBackup func(path, tempRoot string, checkDump func(dumpSize int64) error) (core.BackupFile, error),
+	machineConverter func(config machine.Config) core.ControllerNodeFactory,
+	loadCreds func(agentConf string) ([]AgentConf, error),
+	detectController func() ControllerEvidence,
 	devMode bool,
 ) cmd.Command {
 	return &restoreCommand{
-		connect:    dbConnect,
-		openBackup: openBackup,
-		converter:  machineConverter,
-		loadCreds:  loadCreds,
-		devMode:    devMode,
+		connect:          dbConnect,
+		openBackup:       openBackup,
+		converter:        machineConverter,
+		loadCreds:        loadCreds,
+		detectController: detectController,
+		devMode:          devMode,
 	}
 }
 
@@ -48,12 +68,21 @@ type restoreCommand struct {
 	cmd.CommandBase
 
 	connect    func(info db.DialInfo) (core.Database, error)
-	openBackup func(path, tempRoot string) (core.BackupFile, error)
-	converter  func(member core.ReplicaSetMember) core.ControllerNode
-	loadCreds  func() (string, string, error)
+	openBackup func(path, tempRoot string, checkDump func(dumpSize int64) error) (core.BackupFile, error)
+	converter  func(config machine.Config) core.ControllerNodeFactory
+	loadCreds  func(agentConf string) ([]AgentConf, error)
+
+	// detectController gathers evidence of whether this is a
+	// controller machine.
+	detectController func() ControllerEvidence
 
-	allowDowngrade bool
-	devMode        bool
+	allowDowngrade         bool
+	acceptInferredMetadata bool
+	devMode                bool
+
+	// faults, read from $JUJU_RESTORE_INJECT_FAULTS, are operations
+	// made to fail on purpose, for rehearsing recovery.
+	faults faults
 
 	hostname string
 	port     string
@@ -61,14 +90,58 @@ type restoreCommand struct {
 	username string
 	password string
 
+	// agentConf, if set, is the agent.conf to get credentials from
+	// rather than searching for one.
+	agentConf string
+
+	// passwordStdin means the password is read from the first line
+	// of stdin.
+	passwordStdin bool
+
 	verbose              bool
+	quiet                bool
+	progress             string
 	loggingConfig        string
 	backupFile           string
 	tempRoot             string
+	snapDumpDir          string
 	restoreLog           string
 	includeStatusHistory bool
+	includeLogs          bool
+	logsMaxAge           time.Duration
 	copyController       bool
+	redoCopy             bool
+	copySettingsExclude  string
+	copySettingsInclude  string
+	copySettings         core.SettingsFilter
+	copyAgentBinaries    bool
+	targetDatabase       string
+	usersOnly            bool
+	cloudsOnly           bool
+	settingsOnly         bool
+	overwriteUsers       bool
+	perCollection        bool
+	collectionRetries    int
+	completedFile        string
 	assumeYes            bool
+	repairReplicaSetTags bool
+
+	// copyFrom, if set, is the address of a running controller's
+	// database to copy instead of a backup file, split into
+	// sourceHost and sourcePort by Init. It's connected to as
+	// sourceUsername.
+	copyFrom       string
+	sourceHost     string
+	sourcePort     string
+	sourceUsername string
+	sourcePassword string
+	sourceSSL      bool
+
+	// incrementals are incremental backup files applied in order
+	// after the backup, up to until if it's set.
+	incrementals []string
+	until        string
+	untilTime    time.Time
 
 	// manualAgentControl determines if 'juju-restore' or the operator
 	// manages - stops and starts juju and mongo agents - on
@@ -77,8 +150,146 @@ type restoreCommand struct {
 	// to other controller nodes.
 	manualAgentControl bool
 
+	// sshOptions holds the ssh settings used to reach secondary
+	// controller nodes, sshNodeConfig optionally names a YAML file
+	// of per-node overrides.
+	sshOptions         machine.SSHOptions
+	sshNodeConfig      string
+	sshNodes           NodeConfig
+	sshConfirmHostKeys bool
+
+	// hostKeyMu stops host key prompts for machines being reached
+	// concurrently from interleaving.
+	hostKeyMu sync.Mutex
+
+	// commandTimeout limits how long commands run on controller
+	// machines can take.
+	commandTimeout time.Duration
+
+	// noSudo and sudoCommand say how commands are run as root on
+	// the controller machines, giving sudo.
+	noSudo      bool
+	sudoCommand string
+	sudo        machine.Sudo
+
+	// manageServices lists the services stopped and started on the
+	// controller nodes, as given to --manage-services.
+	manageServices string
+	services       []core.Service
+
+	// stageTimeout, if set, starts the agents one node at a time,
+	// waiting up to this long for each to be healthy.
+	stageTimeout time.Duration
+
+	// waitForAgents, if set, is how long to wait after starting the
+	// agents for them all to report they're active.
+	waitForAgents time.Duration
+
+	// startRetries is how many more times to try starting the agents
+	// on a node that fails.
+	startRetries int
+
+	// stabiliseAttempts and stabiliseMaxWait control how long to
+	// wait for the replica set to be healthy before starting the
+	// agents.
+	stabiliseAttempts int
+	stabiliseMaxWait  time.Duration
+
+	// replicaSetName is the name the controller's replica set must
+	// have, so a restore can't land in some other mongod.
+	replicaSetName string
+
+	// dialMembers makes the pre-checks connect to each replica set
+	// member directly rather than trusting the primary's status.
+	dialMembers bool
+
+	// agentErrors holds the nodes whose agents couldn't be stopped or
+	// started by the last operation on them, and why.
+	agentErrors map[string]string
+
+	// stateFile is where the state of a restore whose agents couldn't
+	// all be started is saved, and resume is true to finish that
+	// restore from it.
+	stateFile string
+	resume    bool
+
+	// dryRun checks the controller and shows the commands that would
+	// change the controller machines without running them. The
+	// database isn't restored.
+	dryRun bool
+
+	// k8sNamespace and k8sContext identify a controller running in
+	// Kubernetes.
+	k8sNamespace string
+	k8sContext   string
+
+	// parallelism is how many secondary controller nodes can have
+	// their agents managed at once.
+	parallelism int
+
+	// allowActiveOperations lets the restore go ahead while the
+	// controller is migrating models or taking a backup.
+	allowActiveOperations bool
+
+	// maxReplicationLag is how far secondaries can be behind the
+	// primary before the pre-checks fail. Zero disables the check.
+	maxReplicationLag time.Duration
+
+	// maxClockSkew is how far controller clocks can differ from the
+	// primary's before a warning is shown. Zero disables the check.
+	maxClockSkew time.Duration
+
+	// eventSocket, if set, is the path of a Unix socket that
+	// clients can connect to for a stream of the run's events.
+	eventSocket string
+
+	// hookDir, if set, holds scripts run at points in the restore.
+	hookDir string
+
+	// reportFile, if set, is where a JSON report of the run is
+	// written.
+	reportFile string
+
+	// historyFile, if set, is where a summary of each run is
+	// appended.
+	historyFile string
+
+	// started is when the run started, for the history.
+	started time.Time
+
+	// ticketReportFile, if set, is where a markdown or HTML report
+	// of the run is written for attaching to change tickets.
+	ticketReportFile string
+
+	// answersFile, if set, holds answers to replay instead of
+	// prompting; recordAnswersFile is where the answers given
+	// interactively are saved.
+	answersFile       string
+	answers           Answers
+	recordAnswersFile string
+
+	// approvalFile, if set, holds another operator's approval of
+	// restoring the backup, written by juju-restore approve.
+	approvalFile string
+
+	// approversFile lists the ssh keys trusted to sign approvals.
+	approversFile string
+
+	// requireApproval makes a missing --approval fail the prechecks,
+	// as the approvers file existing at approvalPolicyFile does.
+	requireApproval bool
+
 	ui       *UserInteractions
 	restorer *core.Restorer
+	report   *runReport
+
+	// timeline, if set, shows each node's progress as a table
+	// updated in place, instead of a line as each node finishes.
+	timeline *nodeTimeline
+
+	// cancel is closed if the operator interrupts starting the
+	// agents, to stop the restorer waiting and retrying.
+	cancel chan struct{}
 
 	// To be used as an option during development to enable an easier
 	// way to re-start all agents in HA federation.
@@ -99,20 +310,86 @@ func (c *restoreCommand) Info() *cmd.Info {
 // SetFlags is part of cmd.Command.
 func (c *restoreCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.CommandBase.SetFlags(f)
-	f.StringVar(&c.hostname, "hostname", "localhost", "hostname of the Juju MongoDB server")
-	f.StringVar(&c.port, "port", "37017", "port of the Juju MongoDB server")
+	f.StringVar(&c.hostname, "hostname", "", "hostname of the Juju MongoDB server (default localhost, or the controller pod's address with --k8s-namespace)")
+	f.StringVar(&c.port, "port", "", "port of the Juju MongoDB server (default from agent.conf, or 37017)")
 	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB")
 	f.StringVar(&c.username, "username", "", "user for connecting to MongoDB (omit to get credentials from agent.conf)")
-	f.StringVar(&c.password, "password", "", "password for connecting to MongoDB")
+	f.StringVar(&c.password, "password", "", "password for connecting to MongoDB (visible in process listings - prefer $"+passwordEnvVar+" or --password-stdin)")
+	f.StringVar(&c.agentConf, "agent-conf", "", "agent.conf to get credentials from (default is the machine agent's for this controller machine)")
+	f.BoolVar(&c.passwordStdin, "password-stdin", false, "read the password for connecting to MongoDB from the first line of stdin")
 	f.StringVar(&c.loggingConfig, "logging-config", defaultLogConfig, "set logging levels")
 	f.BoolVar(&c.verbose, "verbose", false, "more output from restore (debug logging)")
+	f.BoolVar(&c.quiet, "quiet", false, "only show warnings, errors and the final summary (requires --yes or --answers)")
+	f.StringVar(&c.progress, "progress", progressAuto, "how to show progress on each controller node: live (a table updated in place), lines (a line as each node finishes) or auto (live on a terminal)")
 	f.BoolVar(&c.manualAgentControl, "manual-agent-control", false, "operator manages secondary controller nodes in HA, e.g stops/starts Juju and Mongo agents")
 	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack backup file")
+	f.StringVar(&c.snapDumpDir, "snap-dump-dir", "", "location the juju-db snap's mongorestore can read, where the dump is linked or copied (default is the snap's common dir for this user)")
 	f.StringVar(&c.restoreLog, "restore-log", "restore.log", "location to write mongorestore logging output")
+	f.StringVar(&c.eventSocket, "event-socket", "", "listen on a Unix socket at this path and stream the run's events to clients as JSON lines")
+	f.StringVar(&c.hookDir, "hook-dir", "", "directory of executable scripts run at points in the restore (pre-precheck, post-stop-agents, pre-restore, post-restore, post-start-agents)")
+	f.StringVar(&c.reportFile, "report", "", "write a JSON report of the phases, nodes and collections restored to this file")
+	f.StringVar(&c.historyFile, "history-file", defaultHistoryFile, "file to record a summary of the run in, listed by juju-restore history (\"\" doesn't record it)")
+	f.StringVar(&c.ticketReportFile, "ticket-report", "", "write a readable report of the run to this file, as HTML if it ends in .html and markdown otherwise")
 	f.BoolVar(&c.includeStatusHistory, "include-status-history", false, "restore status history for machines and units (can be large)")
+	f.BoolVar(&c.includeLogs, "include-logs", false, "restore the controller and model logs from the backup (can be large)")
+	f.DurationVar(&c.logsMaxAge, "logs-max-age", 0, "with --include-logs, only keep log entries written this long before the backup was created")
 	f.BoolVar(&c.copyController, "copy-controller", false, "set up the target controller to mirror the controller from the backup")
+	f.StringVar(&c.copyFrom, "copy-from", "", "host[:port] of a running controller's MongoDB to copy instead of a backup file (requires --copy-controller)")
+	f.StringVar(&c.sourceUsername, "source-username", "", "user for connecting to the --copy-from MongoDB")
+	f.StringVar(&c.sourcePassword, "source-password", "", "password for --source-username (visible in process listings - prefer $"+sourcePasswordEnvVar+")")
+	f.BoolVar(&c.sourceSSL, "source-ssl", true, "use SSL to connect to the --copy-from MongoDB")
+	f.BoolVar(&c.redoCopy, "redo-copy", false, "with --copy-controller, copy everything again, even if an earlier copy of the same backup finished or completed some of it")
+	f.StringVar(&c.copySettingsExclude, "copy-settings-exclude", "", "with --copy-controller, comma-separated controller settings to keep as they are on the target, as well as the read-only ones")
+	f.StringVar(&c.copySettingsInclude, "copy-settings-include", "", "with --copy-controller, comma-separated read-only controller settings to copy from the backup anyway")
+	f.BoolVar(&c.copyAgentBinaries, "copy-agent-binaries", false, "with --copy-controller, also copy the backup's agent binaries the target doesn't have, so migrated models can find them")
+	f.StringVar(&c.targetDatabase, "target-database", "", "restore the backup's juju database into this database instead, leaving the live database and agents alone")
+	f.BoolVar(&c.usersOnly, "users-only", false, "only restore the users, controller users and permissions, merging them into the controller's")
+	f.BoolVar(&c.cloudsOnly, "clouds-only", false, "only restore the cloud definitions and credentials, replacing the controller's with the same names")
+	f.BoolVar(&c.settingsOnly, "settings-only", false, "only restore the controller settings, apart from the read-only ones")
+	f.BoolVar(&c.overwriteUsers, "overwrite-users", false, "with --users-only, replace users and permissions the controller has with the backup's")
+	f.BoolVar(&c.perCollection, "per-collection", false, "restore the dump a collection at a time, retrying collections that fail with transient errors")
+	f.IntVar(&c.collectionRetries, "collection-retries", defaultCollectionRetries, "with --per-collection, number of times to retry a collection that fails with a transient error")
+	f.StringVar(&c.completedFile, "completed-file", "restore-completed.json", "with --per-collection, where to record the collections restored, so running the restore again only restores the ones that failed")
+	f.Var(cmd.NewAppendStringsValue(&c.incrementals), "incremental", "incremental backup file to apply after the backup, can be repeated in chain order")
+	f.StringVar(&c.until, "until", "", "RFC3339 time to stop applying incremental backups after (default is the end of the last one)")
 	f.BoolVar(&c.allowDowngrade, "allow-downgrade", false, "allow restoring a backup from an older Juju version")
+	f.BoolVar(&c.acceptInferredMetadata, "accept-inferred-metadata", false, "restore a backup without metadata.json using metadata inferred from its dump, without asking")
+	f.BoolVar(&c.repairReplicaSetTags, "repair-replicaset-tags", false, "add missing juju-machine-id tags to the replica set config")
 	f.BoolVar(&c.assumeYes, "yes", false, "answer 'yes' to confirmation prompts (non-interactive)")
+	f.StringVar(&c.answersFile, "answers", "", "YAML file of answers to confirmation prompts, recorded with --record-answers")
+	f.StringVar(&c.recordAnswersFile, "record-answers", "", "save the answers given to confirmation prompts to this file")
+	f.StringVar(&c.approvalFile, "approval", "", "approval of this restore by another operator, written by juju-restore approve; the restore stops before changing anything if it's missing, not signed by a key in --approvers, expired or for another backup")
+	f.StringVar(&c.approversFile, "approvers", approvalPolicyFile, "ssh allowed signers file with the keys trusted to sign --approval files; while "+approvalPolicyFile+" exists every restore needs an approval checked against it")
+	f.BoolVar(&c.requireApproval, "require-approval", false, "fail the prechecks if --approval isn't passed")
+	defaultSSH := machine.DefaultSSHOptions()
+	f.StringVar(&c.sshOptions.User, "ssh-user", defaultSSH.User, "user to log in as on secondary controller machines")
+	f.StringVar(&c.sshOptions.Port, "ssh-port", defaultSSH.Port, "ssh port on secondary controller machines (default is the ssh default)")
+	f.StringVar(&c.sshOptions.IdentityFile, "ssh-identity-file", defaultSSH.IdentityFile, "private key used to log in to secondary controller machines")
+	f.Var(cmd.NewAppendStringsValue(&c.sshOptions.Options), "ssh-option", "extra ssh option passed with -o, can be repeated")
+	f.IntVar(&c.sshOptions.Attempts, "ssh-attempts", defaultSSH.Attempts, "number of times to try a command on a secondary controller machine when the connection fails before it starts")
+	f.StringVar(&c.sshOptions.KnownHostsFile, "ssh-known-hosts", "", "known_hosts file used to verify secondary controller machines (default is no host key checking)")
+	f.BoolVar(&c.sshConfirmHostKeys, "ssh-confirm-host-keys", false, "prompt to accept host keys missing from --ssh-known-hosts and add them to it")
+	f.IntVar(&c.parallelism, "parallelism", defaultParallelism, "number of secondary controller machines to stop or start agents on at once")
+	f.StringVar(&c.replicaSetName, "replica-set", core.DefaultReplicaSetName, "name of the controller's replica set - restoring into a database in any other replica set is refused")
+	f.BoolVar(&c.dialMembers, "dial-members", false, "connect to each replica set member directly to check it's reachable and in the state the primary reports")
+	f.StringVar(&c.manageServices, "manage-services", string(core.MachineAgentService), "comma-separated services to manage on the controller nodes: machine-agent (stopped and started) and database (restarted before the agent starts)")
+	f.DurationVar(&c.stageTimeout, "staged-start", 0, "after the restore start the controller nodes one at a time, waiting up to this long for each to be healthy (0 starts them together)")
+	f.DurationVar(&c.waitForAgents, "wait-for-agents", 0, "after starting the agents wait up to this long for them all to be active, failing if they aren't (0 doesn't wait)")
+	f.IntVar(&c.startRetries, "start-retries", defaultStartRetries, "number of times to retry starting the agents on a controller machine that fails")
+	f.IntVar(&c.stabiliseAttempts, "stabilise-attempts", core.DefaultStabiliseAttempts, "number of times to check the replica set is healthy before starting the agents anyway")
+	f.DurationVar(&c.stabiliseMaxWait, "stabilise-max-wait", 0, "longest to wait between checks of the replica set before starting the agents (0 lets the wait keep growing)")
+	f.StringVar(&c.stateFile, "state-file", "restore-state.json", "where to save the state of a restore whose agents couldn't all be started, for --resume")
+	f.BoolVar(&c.dryRun, "dry-run", false, "run the pre-checks and show the commands that would be run on each controller machine, without changing anything")
+	f.BoolVar(&c.resume, "resume", false, "finish a restore whose agents couldn't all be started, using --state-file")
+	f.DurationVar(&c.commandTimeout, "command-timeout", machine.DefaultCommandTimeout, "kill commands run on controller machines that take longer than this (0 for no limit)")
+	f.BoolVar(&c.noSudo, "no-sudo", false, "run commands on the controller machines without sudo (for when they're reached as root)")
+	f.StringVar(&c.sudoCommand, "sudo-command", "", "command used to run commands as root on the controller machines (default sudo)")
+	f.DurationVar(&c.maxReplicationLag, "max-replication-lag", defaultMaxLag, "fail the pre-checks if a secondary is further behind the primary than this (0 to skip the check)")
+	f.BoolVar(&c.allowActiveOperations, "allow-active-operations", false, "go ahead even if the controller is migrating models or taking a backup")
+	f.DurationVar(&c.maxClockSkew, "max-clock-skew", defaultMaxSkew, "warn if a controller machine's clock differs from the primary's by more than this (0 to skip the check)")
+	f.StringVar(&c.k8sNamespace, "k8s-namespace", "", "namespace of a controller running in Kubernetes - agents are managed using kubectl")
+	f.StringVar(&c.k8sContext, "k8s-context", "", "kubectl context for --k8s-namespace (default is the current context)")
+	f.StringVar(&c.sshNodeConfig, "ssh-node-config", "", "YAML file of per-machine ssh overrides or LXD containers keyed by machine ID or IP address")
 	if c.devMode {
 		f.BoolVar(&c.restart, "rs", false, "just restart agents that were stopped (JUJU_RESTORE_DEV_MODE)")
 	}
@@ -120,23 +397,282 @@ func (c *restoreCommand) SetFlags(f *gnuflag.FlagSet) {
 
 // Init is part of cmd.Command.
 func (c *restoreCommand) Init(args []string) error {
-	if len(args) == 0 {
+	if c.dryRun && c.resume {
+		return errors.New("--dry-run incompatible with --resume")
+	}
+	if c.resume {
+		if err := c.initResume(); err != nil {
+			return errors.Trace(err)
+		}
+		if len(args) > 0 && args[0] == c.backupFile {
+			args = args[1:]
+		}
+	} else if c.copyFrom != "" {
+		if len(args) > 0 {
+			return errors.New("--copy-from incompatible with a backup file")
+		}
+	} else if len(args) == 0 {
 		return errors.New("missing backup file")
+	} else {
+		c.backupFile, args = args[0], args[1:]
+	}
+	if value := os.Getenv(faultsEnvVar); value != "" {
+		faults, err := parseFaults(value)
+		if err != nil {
+			return errors.Annotatef(err, "reading $%s", faultsEnvVar)
+		}
+		c.faults = faults
 	}
-	c.backupFile, args = args[0], args[1:]
 	if c.verbose && c.loggingConfig != defaultLogConfig {
 		return errors.New("verbose and logging-config conflict - use one or the other")
 	}
 	if c.verbose {
 		c.loggingConfig = verboseLogConfig
 	}
+	if c.agentConf != "" && c.username != "" {
+		return errors.New("--agent-conf incompatible with --username")
+	}
+	if c.passwordStdin {
+		if c.password != "" {
+			return errors.New("--password-stdin incompatible with --password")
+		}
+		if c.username == "" {
+			return errors.New("--password-stdin requires --username")
+		}
+	}
+	switch c.progress {
+	case progressAuto, progressLive, progressLines:
+	default:
+		return errors.Errorf("--progress must be %s, %s or %s", progressAuto, progressLive, progressLines)
+	}
+	if c.quiet && !c.assumeYes && c.answersFile == "" {
+		return errors.New("--quiet requires --yes or --answers - prompts can't be shown")
+	}
 	if c.copyController {
 		if c.includeStatusHistory {
 			return errors.New("--include-status-history incompatible with --copy-controller")
 		}
+		if c.includeLogs {
+			return errors.New("--include-logs incompatible with --copy-controller")
+		}
 		if c.allowDowngrade {
 			return errors.New("--allow-downgrade incompatible with --copy-controller")
 		}
+		if len(c.incrementals) > 0 {
+			return errors.New("--incremental incompatible with --copy-controller")
+		}
+	}
+	if c.targetDatabase != "" {
+		if err := checkTargetDatabase(c.targetDatabase); err != nil {
+			return errors.Annotate(err, "checking --target-database")
+		}
+		if c.copyController {
+			return errors.New("--target-database incompatible with --copy-controller")
+		}
+		if c.includeLogs {
+			return errors.New("--include-logs incompatible with --target-database")
+		}
+		if len(c.incrementals) > 0 {
+			return errors.New("--incremental incompatible with --target-database")
+		}
+	}
+	if c.perCollection {
+		if c.copyController {
+			return errors.New("--per-collection incompatible with --copy-controller")
+		}
+		if c.targetDatabase != "" {
+			return errors.New("--per-collection incompatible with --target-database")
+		}
+	}
+	if c.collectionRetries < 0 {
+		return errors.New("--collection-retries can't be negative")
+	}
+	if c.redoCopy && !c.copyController {
+		return errors.New("--redo-copy requires --copy-controller")
+	}
+	if c.copySettingsExclude != "" || c.copySettingsInclude != "" {
+		if !c.copyController {
+			return errors.New("--copy-settings-exclude and --copy-settings-include require --copy-controller")
+		}
+		c.copySettings = core.SettingsFilter{
+			Exclude: parseSettingsKeys(c.copySettingsExclude),
+			Include: parseSettingsKeys(c.copySettingsInclude),
+		}
+		include := set.NewStrings(c.copySettings.Include...)
+		for _, key := range c.copySettings.Exclude {
+			if include.Contains(key) {
+				return errors.Errorf("%q is in both --copy-settings-exclude and --copy-settings-include", key)
+			}
+		}
+	}
+	if c.copyAgentBinaries {
+		if !c.copyController {
+			return errors.New("--copy-agent-binaries requires --copy-controller")
+		}
+		if c.copyFrom != "" {
+			return errors.New("--copy-agent-binaries incompatible with --copy-from")
+		}
+	}
+	if c.approvalFile != "" && (c.copyFrom != "" || c.resume) {
+		return errors.New("--approval requires a backup file - it can't be used with --copy-from or --resume")
+	}
+	if c.copyFrom != "" {
+		if !c.copyController {
+			return errors.New("--copy-from requires --copy-controller")
+		}
+		if c.sourceUsername == "" {
+			return errors.New("--copy-from requires --source-username")
+		}
+		address := c.copyFrom
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, defaultPort)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || host == "" {
+			return errors.Errorf("--copy-from %q isn't host or host:port", c.copyFrom)
+		}
+		c.sourceHost, c.sourcePort = host, port
+	} else if c.sourceUsername != "" || c.sourcePassword != "" {
+		return errors.New("--source-username and --source-password require --copy-from")
+	}
+	if c.overwriteUsers && !c.usersOnly {
+		return errors.New("--overwrite-users requires --users-only")
+	}
+	var partials []string
+	for _, partial := range []struct {
+		set  bool
+		name string
+	}{
+		{c.usersOnly, "--users-only"},
+		{c.cloudsOnly, "--clouds-only"},
+		{c.settingsOnly, "--settings-only"},
+	} {
+		if !partial.set {
+			continue
+		}
+		if len(partials) > 0 {
+			return errors.Errorf("%s incompatible with %s", partials[0], partial.name)
+		}
+		partials = append(partials, partial.name)
+		for _, flag := range []struct {
+			set  bool
+			name string
+		}{
+			{c.copyController, "--copy-controller"},
+			{c.targetDatabase != "", "--target-database"},
+			{c.includeStatusHistory, "--include-status-history"},
+			{c.includeLogs, "--include-logs"},
+			{len(c.incrementals) > 0, "--incremental"},
+			{c.perCollection, "--per-collection"},
+		} {
+			if flag.set {
+				return errors.Errorf("%s incompatible with %s", flag.name, partial.name)
+			}
+		}
+	}
+	if c.logsMaxAge < 0 {
+		return errors.New("--logs-max-age can't be negative")
+	}
+	if c.logsMaxAge != 0 && !c.includeLogs {
+		return errors.New("--logs-max-age requires --include-logs")
+	}
+	if c.until != "" {
+		if len(c.incrementals) == 0 {
+			return errors.New("--until requires --incremental")
+		}
+		until, err := time.Parse(time.RFC3339, c.until)
+		if err != nil {
+			return errors.Annotate(err, "parsing --until")
+		}
+		c.untilTime = until
+	}
+	if c.k8sContext != "" && c.k8sNamespace == "" {
+		return errors.New("--k8s-context requires --k8s-namespace")
+	}
+	services, err := parseServices(c.manageServices)
+	if err != nil {
+		return errors.Annotate(err, "parsing --manage-services")
+	}
+	c.services = services
+	if c.k8sNamespace != "" && c.managesService(core.DatabaseService) {
+		return errors.New("--manage-services=database incompatible with --k8s-namespace - the database runs in its own container")
+	}
+	if c.parallelism < 1 {
+		return errors.New("--parallelism must be at least 1")
+	}
+	if c.commandTimeout < 0 {
+		return errors.New("--command-timeout can't be negative")
+	}
+	if c.noSudo && c.sudoCommand != "" {
+		return errors.New("--no-sudo incompatible with --sudo-command")
+	}
+	c.sudo = machine.DefaultSudo()
+	if c.noSudo {
+		c.sudo = nil
+	} else if c.sudoCommand != "" {
+		c.sudo = strings.Fields(c.sudoCommand)
+	}
+	if c.startRetries < 0 {
+		return errors.New("--start-retries can't be negative")
+	}
+	if c.stabiliseAttempts < 1 {
+		return errors.New("--stabilise-attempts must be at least 1")
+	}
+	if c.stabiliseMaxWait < 0 {
+		return errors.New("--stabilise-max-wait can't be negative")
+	}
+	if c.stageTimeout < 0 {
+		return errors.New("--staged-start can't be negative")
+	}
+	if c.waitForAgents < 0 {
+		return errors.New("--wait-for-agents can't be negative")
+	}
+	if c.waitForAgents > 0 && !c.managesService(core.MachineAgentService) {
+		return errors.New("--wait-for-agents requires --manage-services to include machine-agent")
+	}
+	if c.maxReplicationLag < 0 {
+		return errors.New("--max-replication-lag can't be negative")
+	}
+	if c.maxClockSkew < 0 {
+		return errors.New("--max-clock-skew can't be negative")
+	}
+	if c.sshOptions.Attempts < 1 {
+		return errors.New("--ssh-attempts must be at least 1")
+	}
+	if c.sshConfirmHostKeys && c.sshOptions.KnownHostsFile == "" {
+		return errors.New("--ssh-confirm-host-keys requires --ssh-known-hosts")
+	}
+	if c.answersFile != "" {
+		if c.assumeYes {
+			return errors.New("--answers incompatible with --yes")
+		}
+		if c.recordAnswersFile != "" {
+			return errors.New("--answers incompatible with --record-answers")
+		}
+		answers, err := ReadAnswers(c.answersFile)
+		if err != nil {
+			return errors.Annotate(err, "reading answers")
+		}
+		c.answers = answers
+	}
+	if c.recordAnswersFile != "" && c.assumeYes {
+		return errors.New("--record-answers incompatible with --yes")
+	}
+	if c.hookDir != "" {
+		info, err := os.Stat(c.hookDir)
+		if err != nil {
+			return errors.Annotate(err, "checking hook dir")
+		}
+		if !info.IsDir() {
+			return errors.Errorf("--hook-dir %q isn't a directory", c.hookDir)
+		}
+	}
+	if c.sshNodeConfig != "" {
+		nodes, err := ReadSSHNodeConfig(c.sshNodeConfig)
+		if err != nil {
+			return errors.Annotate(err, "reading ssh node config")
+		}
+		c.sshNodes = nodes
 	}
 	return c.CommandBase.Init(args)
 }
@@ -148,83 +684,352 @@ func (c *restoreCommand) Run(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
-	username := c.username
-	password := c.password
-	if c.username == "" {
-		username, password, err = c.loadCreds()
+	var k8sConfig *machine.KubernetesConfig
+	if c.k8sNamespace == "" {
+		if evidence := c.detectController(); !evidence.IsController() {
+			return core.NewFailure(core.PrecheckFailure, errors.New(populate(notControllerTemplate, evidence)))
+		}
+	} else {
+		k8sConfig, err = c.discoverKubernetesController()
 		if err != nil {
-			return errors.Annotate(err, "loading credentials")
+			return core.NewFailure(core.ConnectivityFailure, errors.Trace(err))
 		}
 	}
 
-	c.ui = NewUserInteractions(ctx)
-	c.ui.Notify("Connecting to database...\n")
-	database, err := c.connect(db.DialInfo{
+	var creds []AgentConf
+	if c.username == "" {
+		if k8sConfig != nil {
+			var conf AgentConf
+			conf, err = c.readCredsFromPod(*k8sConfig)
+			// The pod's agent.conf refers to the database as
+			// localhost, which isn't where we're running.
+			conf.Hostname = ""
+			creds = []AgentConf{conf}
+		} else {
+			creds, err = c.loadCreds(c.agentConf)
+		}
+		if err != nil {
+			return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "loading credentials"))
+		}
+	}
+	connection := connectionSettings{
 		Hostname: c.hostname,
 		Port:     c.port,
-		Username: username,
-		Password: password,
 		SSL:      c.ssl,
-	})
+	}
+	if c.snapDumpDir != "" {
+		connection.SnapDumpDir = ctx.AbsPath(c.snapDumpDir)
+	}
+	if k8sConfig != nil {
+		connection.DefaultHostname = k8sConfig.Pods[0].IP
+	}
+
+	c.ui = NewUserInteractions(ctx)
+	c.ui.SetQuiet(c.quiet)
+	live := c.progress == progressLive || c.progress == progressAuto && isTerminal(ctx.Stdout)
+	if live && !c.quiet {
+		c.timeline = newNodeTimeline(ctx.Stdout)
+	}
+	if c.username != "" {
+		password := c.password
+		if password == "" {
+			password, err = c.readPassword()
+			if err != nil {
+				return errors.Annotate(err, "reading password")
+			}
+		}
+		creds = []AgentConf{{Username: c.username, Password: password}}
+	}
+	if c.answers != nil {
+		c.ui.ReplayAnswers(c.answers)
+	}
+	if c.recordAnswersFile != "" {
+		recorded := c.ui.RecordAnswers()
+		defer func() {
+			if err := recorded.Write(c.recordAnswersFile); err != nil {
+				logger.Errorf("writing answers: %v", err)
+			}
+		}()
+	}
+	c.ui.Progress("Connecting to database...\n")
+	database, conf, err := connectWithCreds(c.connect, connection, creds)
 	if err != nil {
-		return errors.Trace(err)
+		return core.NewFailure(core.ConnectivityFailure, errors.Trace(err))
 	}
 	defer database.Close()
+	if conf.Path != "" {
+		c.ui.Progress(fmt.Sprintf("Using credentials from %s.\n", conf.Path))
+	}
 
-	backup, err := c.openBackup(c.backupFile, c.tempRoot)
-	if err != nil {
-		return errors.Annotatef(err, "unpacking backup file %q under %q", c.backupFile, c.tempRoot)
+	// Resuming only starts agents, so the backup isn't needed.
+	var backup core.BackupFile
+	if c.copyFrom != "" {
+		backup, err = c.dialSource()
+		if err != nil {
+			return core.NewFailure(core.ConnectivityFailure, errors.Annotatef(err, "connecting to source controller at %s", net.JoinHostPort(c.sourceHost, c.sourcePort)))
+		}
+		defer backup.Close()
+	} else if !c.resume {
+		// The snap dump dir is checked along with the temp root, so a
+		// lack of space there is found before extracting.
+		checkSnapDump := func(dumpSize int64) error {
+			return db.CheckSnapDumpSpace(c.tempRoot, connection.SnapDumpDir, dumpSize)
+		}
+		backup, err = c.openBackup(c.backupFile, c.tempRoot, checkSnapDump)
+		if err != nil {
+			return core.NewFailure(core.PrecheckFailure, errors.Annotatef(err, "unpacking backup file %q under %q", c.backupFile, c.tempRoot))
+		}
+		defer backup.Close()
+	}
+	var incrementals []core.BackupFile
+	for _, path := range c.incrementals {
+		incremental, err := c.openBackup(path, c.tempRoot, nil)
+		if err != nil {
+			return core.NewFailure(core.PrecheckFailure, errors.Annotatef(err, "unpacking incremental backup file %q under %q", path, c.tempRoot))
+		}
+		defer incremental.Close()
+		incrementals = append(incrementals, incremental)
 	}
-	defer backup.Close()
 
-	restorer, err := core.NewRestorer(database, backup, c.converter)
+	machineConfig := machine.Config{
+		SSH:            c.sshOptions,
+		NodeSSH:        c.sshNodes.SSH,
+		NodeLXD:        c.sshNodes.LXD,
+		CommandTimeout: c.commandTimeout,
+		Kubernetes:     k8sConfig,
+		Sudo:           c.sudo,
+	}
+	if c.sshConfirmHostKeys {
+		machineConfig.ConfirmHostKey = c.confirmHostKey
+	}
+	c.cancel = make(chan struct{})
+	c.report = &runReport{expectedPhases: 4, path: c.reportFile, DryRun: c.dryRun}
+	if c.restart || c.resume {
+		c.report.expectedPhases = 1
+	} else if c.targetDatabase != "" {
+		c.report.expectedPhases = 2
+	}
+	if c.eventSocket != "" {
+		events, err := newEventStream(c.eventSocket)
+		if err != nil {
+			return errors.Annotate(err, "starting event stream")
+		}
+		defer events.Close()
+		c.report.events = events
+		machineConfig.ScriptOutput = c.report.scriptOutput
+	}
+	if c.dryRun {
+		machineConfig.DryRun = c.showDryRunCommand
+	}
+	converter := c.converter(machineConfig)
+	if len(c.faults) > 0 {
+		warning := fmt.Sprintf("failures injected with $%s: %s", faultsEnvVar, c.faults)
+		c.ui.Notify(fmt.Sprintf("\nWarning: %s.\n", warning))
+		c.report.warn(warning)
+		converter = c.faults.wrapNodes(converter)
+		database = c.faults.wrapDatabase(database)
+	}
+	var nodeProgress func(core.NodeOperation)
+	if c.timeline != nil {
+		nodeProgress = c.timeline.update
+	}
+	var dialMember func(core.ReplicaSetMember) (core.Database, error)
+	if c.dialMembers {
+		dialMember = c.memberDialer(connection.dialInfo(conf))
+	}
+	changed := c.report.changed
+	if c.dryRun {
+		// Nothing is really changed.
+		changed = nil
+	}
+	restorer, err := core.NewRestorer(database, backup, converter, core.RestorerConfig{
+		Parallelism:       c.parallelism,
+		NodeDone:          c.notifyNodeDone,
+		Incrementals:      incrementals,
+		Until:             c.untilTime,
+		Services:          c.services,
+		StageTimeout:      c.stageTimeout,
+		StartRetries:      c.startRetries,
+		Changed:           changed,
+		Cancel:            c.cancel,
+		NodeProgress:      nodeProgress,
+		StabiliseAttempts: c.stabiliseAttempts,
+		StabiliseMaxWait:  c.stabiliseMaxWait,
+		ReplicaSetName:    c.replicaSetName,
+		DialMember:        dialMember,
+	})
 	if err != nil {
 		return errors.Trace(err)
 	}
 	c.restorer = restorer
 
+	c.started = time.Now().UTC()
+	err = c.runPhases()
+	c.finishReport(err)
+	c.recordHistory()
+	return errors.Trace(err)
+}
+
+// runPhases checks the controller, restores the backup and starts
+// the agents again, recording each phase in the report.
+func (c *restoreCommand) runPhases() error {
 	if c.restart {
-		return errors.Trace(c.runPostChecks())
+		return errors.Trace(c.report.phase(phaseStartAgents, c.runPostChecks))
+	}
+	if c.resume {
+		return errors.Trace(c.runResume())
 	}
 
 	// Pre-checks
-	if err := c.runPreChecks(); err != nil {
+	err := c.report.phase(phasePreChecks, func() error {
+		if err := c.runHook(hookPrePrecheck); err != nil {
+			return core.NewFailure(core.PrecheckFailure, errors.Trace(err))
+		}
+		return c.runPreChecks()
+	})
+	if err != nil {
 		return errors.Trace(err)
 	}
 	// Actual restore
 	if err := c.restore(); err != nil {
 		return errors.Trace(err)
 	}
+	if c.targetDatabase != "" {
+		// The agents were never stopped.
+		return errors.Trace(c.runHook(hookPostStartAgents))
+	}
 	// Post-checks
-	if err := c.runPostChecks(); err != nil {
+	if err := c.report.phase(phaseStartAgents, c.runPostChecks); err != nil {
+		c.saveResumeState()
 		return errors.Trace(err)
 	}
-	return nil
+	return errors.Trace(c.runHook(hookPostStartAgents))
+}
+
+// finishReport shows the summary of the run if anything on the
+// controller could have changed, and writes the report file if
+// requested.
+func (c *restoreCommand) finishReport(runErr error) {
+	if runErr != nil {
+		c.report.Error = runErr.Error()
+	}
+	if c.report.started() {
+		c.report.health(c.restorer.ControllerMembers())
+	}
+	c.report.finished()
+	if c.report.started() {
+		c.ui.Notify(populate(summaryTemplate, c.report))
+	}
+	if c.ticketReportFile != "" {
+		if err := c.report.writeTicket(c.ticketReportFile); err != nil {
+			logger.Errorf("writing ticket report: %v", err)
+		} else {
+			c.ui.Notify(fmt.Sprintf("Ticket report written to %s.\n", c.ticketReportFile))
+		}
+	}
+	if c.reportFile == "" {
+		return
+	}
+	if err := c.report.write(c.reportFile); err != nil {
+		logger.Errorf("writing report: %v", err)
+		return
+	}
+	c.ui.Notify(fmt.Sprintf("Report written to %s.\n", c.reportFile))
+}
+
+// confirm asks the operator to confirm, recording the answer in the
+// report.
+func (c *restoreCommand) confirm(prompt string) error {
+	err := c.ui.ConfirmYes(prompt)
+	if err == nil || IsUserAbortedError(err) {
+		by := "operator"
+		if c.answers != nil {
+			by = "answers file"
+		}
+		c.report.decided(prompt, err == nil, by)
+	}
+	return err
 }
 
 func (c *restoreCommand) runPreChecks() error {
-	c.ui.Notify("Checking database and replica set health...\n")
+	// Checking the backup against the controller doesn't depend on
+	// the replica set checks, so it runs while they do (and while the
+	// operator answers any prompts). It has to finish before the
+	// database is closed, even if a check fails first.
+	restorable := inBackground(func() (*core.PrecheckResult, error) {
+		if c.copyController {
+			return c.restorer.CheckCopyable(c.allowDowngrade)
+		}
+		return c.restorer.CheckRestorable(c.allowDowngrade)
+	})
+	defer restorable()
+
+	c.ui.Progress("Checking database and replica set health...\n")
 	if err := c.restorer.CheckDatabaseState(); err != nil {
 		return errors.Trace(err)
 	}
-	c.ui.Notify(dbHealthComplete)
+	c.ui.Progress(dbHealthComplete)
+	if c.maxReplicationLag != 0 {
+		if err := c.restorer.CheckReplicationLag(c.maxReplicationLag); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err := c.checkActiveOperations(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.checkMachineIDTags(); err != nil {
+		return errors.Trace(err)
+	}
 
-	precheckResult, err := c.restorer.CheckRestorable(c.allowDowngrade, c.copyController)
+	precheckResult, err := restorable()
 	if err != nil {
 		return errors.Annotate(err, "precheck")
 	}
+	c.report.BackupID = precheckResult.BackupID
 
 	if c.copyController {
-		c.ui.Notify(populate(backupFileControllerTemplate, precheckResult))
+		c.ui.Progress(populate(backupFileControllerTemplate, precheckResult))
+		c.ui.Progress(populate(copyTargetTemplate, precheckResult))
+		if !c.redoCopy {
+			previous, err := c.restorer.PreviousControllerCopy(precheckResult)
+			if err != nil {
+				return errors.Annotate(err, "precheck")
+			}
+			if previous != nil && !previous.Finished.IsZero() {
+				return errors.New(populate(finishedCopyTemplate, previous))
+			}
+			if previous != nil {
+				c.ui.Notify(populate(previousCopyTemplate, previous))
+			}
+		}
 	} else {
-		c.ui.Notify(populate(backupFileTemplate, precheckResult))
+		c.ui.Progress(populate(backupFileTemplate, precheckResult))
+	}
+	if len(precheckResult.Databases) > 0 {
+		c.ui.Progress(formatDumpSizes(precheckResult.Databases))
+	}
+	if c.usersOnly {
+		c.ui.Progress(usersOnlyMessage)
+	}
+	if c.cloudsOnly {
+		c.ui.Progress(cloudsOnlyMessage)
+	}
+	if c.settingsOnly {
+		c.ui.Progress(settingsOnlyMessage)
+	}
+	if precheckResult.MetadataInferred {
+		if err := c.confirmInferredMetadata(); err != nil {
+			return errors.Trace(err)
+		}
 	}
 
-	if c.restorer.IsHA() {
+	// Restoring into another database doesn't touch the agents, so
+	// there's no need to reach the secondary controller machines.
+	if c.restorer.IsHA() && c.targetDatabase == "" {
 		if !c.manualAgentControl {
 			if !c.assumeYes {
-				c.ui.Notify(releaseAgentsControl)
-				if err := c.ui.UserConfirmYes(); err != nil {
+				c.ui.Progress(releaseAgentsControl)
+				if err := c.confirm(promptManageAgents); err != nil {
 					if !IsUserAbortedError(err) {
 						return errors.Annotate(err, "releasing controller over agents")
 					}
@@ -233,13 +1038,15 @@ func (c *restoreCommand) runPreChecks() error {
 			}
 
 			if !c.manualAgentControl {
-				c.ui.Notify("\n\nChecking connectivity to secondary controller machines...\n")
+				c.ui.Progress("\n\nChecking connectivity to secondary controller machines...\n")
 				connections := c.restorer.CheckSecondaryControllerNodes()
-				c.ui.Notify(populate(nodesTemplate, connections))
+				if c.timeline == nil {
+					c.ui.Progress(populate(nodesTemplate, connections))
+				}
 				for _, e := range connections {
 					if e != nil {
 						// If even one connection failed, we cannot proceed.
-						return errors.Errorf("'juju-restore' could not connect to all controller machines: controllers' agents cannot be managed")
+						return core.NewFailure(core.ConnectivityFailure, errors.Errorf("'juju-restore' could not connect to all controller machines: controllers' agents cannot be managed"))
 					}
 				}
 			}
@@ -249,9 +1056,42 @@ func (c *restoreCommand) runPreChecks() error {
 
 	}
 
-	if !c.assumeYes {
-		c.ui.Notify(preChecksCompleted)
-		if err := c.ui.UserConfirmYes(); err != nil {
+	// Secondary nodes are only included if we can reach them.
+	includeSecondaries := c.restorer.IsHA() && !c.manualAgentControl && c.targetDatabase == ""
+	c.ui.Progress("\nController nodes:\n")
+	// The clocks are read while the node statuses are collected.
+	var skews []core.ClockSkew
+	var wg sync.WaitGroup
+	checkSkew := includeSecondaries && c.maxClockSkew != 0
+	if checkSkew {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			skews = c.restorer.ClockSkews(true)
+		}()
+	}
+	statuses := c.restorer.NodeStatuses(includeSecondaries)
+	wg.Wait()
+	c.ui.Progress(formatNodeStatuses(statuses))
+	if err := core.CheckNodeIdentities(statuses, precheckResult.TargetControllerUUID); err != nil {
+		return errors.Trace(err)
+	}
+	if !c.copyController && !c.usersOnly && !c.cloudsOnly && !c.settingsOnly {
+		c.checkFreeSpace(statuses, c.restoredSize(precheckResult.Databases))
+	}
+	if checkSkew {
+		c.checkClockSkew(skews)
+	}
+	c.checkDatabaseVersions(statuses)
+
+	if err := c.checkApproval(); err != nil {
+		return errors.Trace(err)
+	}
+	if c.assumeYes {
+		c.report.decided(promptProceed, true, "--yes")
+	} else {
+		c.ui.Progress(preChecksCompleted)
+		if err := c.confirm(promptProceed); err != nil {
 			return errors.Annotate(err, "restore operation")
 		}
 	}
@@ -259,92 +1099,660 @@ func (c *restoreCommand) runPreChecks() error {
 	return nil
 }
 
-func (c *restoreCommand) restore() error {
-	// Stop juju agents.
-	c.ui.Notify("\nStopping Juju agents...\n")
-	if err := c.manipulateAgents(c.restorer.StopAgents); err != nil {
-		return errors.Trace(err)
+// memberDialer returns a function that connects directly to a replica
+// set member, using the same credentials as the connection to the
+// primary. Members are dialled concurrently, so each dial works on its
+// own copy of info.
+func (c *restoreCommand) memberDialer(info db.DialInfo) func(core.ReplicaSetMember) (core.Database, error) {
+	return func(member core.ReplicaSetMember) (core.Database, error) {
+		host, port, err := net.SplitHostPort(member.Name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		memberInfo := info
+		memberInfo.Hostname, memberInfo.Port = host, port
+		return c.connect(memberInfo)
+	}
+}
+
+// inBackground starts check in its own goroutine and returns a
+// function that waits for it to finish and returns its result. The
+// function can be called more than once.
+func inBackground(check func() (*core.PrecheckResult, error)) func() (*core.PrecheckResult, error) {
+	var result *core.PrecheckResult
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result, err = check()
+	}()
+	return func() (*core.PrecheckResult, error) {
+		<-done
+		return result, err
 	}
-	c.ui.Notify("\nRunning restore...\n")
-	c.ui.Notify(fmt.Sprintf("Detailed mongorestore output in %s.\n", c.restoreLog))
-	if err := c.restorer.Restore(c.restoreLog, c.includeStatusHistory, c.copyController); err != nil {
+}
+
+// checkActiveOperations warns about work running on the controller
+// that keeps changing the database, and stops the restore if models
+// are being migrated or a backup is being taken, unless
+// --allow-active-operations is passed.
+func (c *restoreCommand) checkActiveOperations() error {
+	active, err := c.restorer.CheckActiveOperations(c.allowActiveOperations)
+	if !active.Any() {
 		return errors.Trace(err)
 	}
+	for _, migration := range active.Migrations {
+		c.report.warn("model migration running: " + migration)
+	}
+	if active.Backups > 0 {
+		c.report.warn(fmt.Sprintf("%d database backups running", active.Backups))
+	}
+	if active.ProvisioningMachines > 0 || active.ProvisioningUnits > 0 {
+		c.report.warn(fmt.Sprintf("%d machines and %d units being provisioned", active.ProvisioningMachines, active.ProvisioningUnits))
+	}
+	c.ui.Notify(populate(activeOperationsTemplate, active))
+	if err != nil {
+		c.ui.Notify("Wait for them to finish, or pass --allow-active-operations to go ahead anyway.\n")
+	}
+	return errors.Trace(err)
+}
+
+// confirmInferredMetadata makes sure the operator accepts restoring
+// a backup whose metadata had to be inferred from its dump. Unlike
+// the other prompts --yes doesn't answer this one.
+func (c *restoreCommand) confirmInferredMetadata() error {
+	c.report.warn("backup metadata was inferred from the database dump")
+	if c.acceptInferredMetadata {
+		c.ui.Notify(inferredMetadataWarning + "\n")
+		c.report.decided(promptInferredMetadata, true, "--accept-inferred-metadata")
+		return nil
+	}
+	if c.assumeYes {
+		return core.NewFailure(core.PrecheckFailure, errors.New("backup has no metadata.json - pass --accept-inferred-metadata to restore it using metadata inferred from the dump"))
+	}
+	c.ui.Notify(inferredMetadataWarning + "\nUse the inferred metadata? (y/N): ")
+	return errors.Annotate(c.confirm(promptInferredMetadata), "restore operation")
+}
+
+func (c *restoreCommand) managesService(service core.Service) bool {
+	for _, s := range c.services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
 
-	c.ui.Notify("\nDatabase restore complete.")
+// parseServices reads a comma-separated list of services.
+func parseServices(value string) ([]core.Service, error) {
+	var services []core.Service
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		service := core.Service(name)
+		known := false
+		for _, s := range core.AllServices {
+			known = known || s == service
+		}
+		if !known {
+			return nil, errors.Errorf("unknown service %q (expected machine-agent or database)", name)
+		}
+		services = append(services, service)
+	}
+	if len(services) == 0 {
+		return nil, errors.New("no services given")
+	}
+	return services, nil
+}
+
+// parseSettingsKeys splits a comma-separated list of controller
+// settings keys.
+func parseSettingsKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// reservedDatabases are the databases the controller uses, which
+// can't be restored into.
+var reservedDatabases = set.NewStrings("juju", "jujucontroller", "jujurestore", "logs", "blobstore", "admin", "local", "config")
+
+// validDatabaseName matches names mongo accepts on every platform.
+var validDatabaseName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// checkTargetDatabase makes sure the database the backup is restored
+// into won't clash with one the controller uses.
+func checkTargetDatabase(name string) error {
+	if !validDatabaseName.MatchString(name) {
+		return errors.Errorf("database name %q can only contain letters, digits, _ and -", name)
+	}
+	if reservedDatabases.Contains(name) {
+		return errors.Errorf("database %q is used by the controller", name)
+	}
+	return nil
+}
+
+// restoredSize returns how much of the dump will be restored: the
+// logs database and status history are only restored when asked for.
+func (c *restoreCommand) restoredSize(databases []core.DatabaseSize) uint64 {
+	var total int64
+	for _, database := range databases {
+		if database.Name == "logs" && !c.includeLogs {
+			continue
+		}
+		if c.targetDatabase != "" && database.Name != "juju" {
+			continue
+		}
+		total += database.Bytes
+		if database.Name == "juju" && !c.includeStatusHistory {
+			total -= database.Collections["statuseshistory"]
+		}
+	}
+	return uint64(total)
+}
+
+// checkFreeSpace warns about controller machines that don't have
+// room for the restored databases. It doesn't stop the restore since
+// the dump's size is only an estimate of what mongo will need.
+func (c *restoreCommand) checkFreeSpace(statuses []core.NodeStatusResult, needed uint64) {
+	type shortNode struct {
+		Machine, IP, Free string
+	}
+	var short []shortNode
+	for _, result := range statuses {
+		// Nodes that can't report disk usage have no free space.
+		if result.Err != nil || result.Status.FreeSpace == 0 || result.Status.FreeSpace >= needed {
+			continue
+		}
+		free := formatSize(result.Status.FreeSpace)
+		short = append(short, shortNode{Machine: result.Member.JujuMachineID, IP: result.IP, Free: free})
+		c.report.warn(fmt.Sprintf("machine %s has %s free but the restore needs about %s",
+			result.Member.JujuMachineID, free, formatSize(needed)))
+	}
+	if len(short) == 0 {
+		return
+	}
+	c.ui.Notify(populate(freeSpaceTemplate, struct {
+		Needed string
+		Short  []shortNode
+	}{formatSize(needed), short}))
+}
+
+// checkDatabaseVersions warns if the controller machines run
+// different versions of mongod (after a partial snap refresh, say),
+// since that can cause subtle replication problems after the restore.
+func (c *restoreCommand) checkDatabaseVersions(statuses []core.NodeStatusResult) {
+	var known []core.NodeStatusResult
+	versions := set.NewStrings()
+	for _, result := range statuses {
+		if result.Err != nil || result.Status.DatabaseVersion == "" {
+			continue
+		}
+		known = append(known, result)
+		versions.Add(result.Status.DatabaseVersion)
+	}
+	if versions.Size() < 2 {
+		return
+	}
+	c.report.warn(fmt.Sprintf("controller machines run different database versions: %s", strings.Join(versions.SortedValues(), ", ")))
+	c.ui.Notify(populate(databaseVersionsTemplate, known))
+}
+
+// checkClockSkew warns about controller machines whose clocks are
+// too far from the primary's, since that can break replica set
+// elections and leases once the agents are restarted.
+func (c *restoreCommand) checkClockSkew(skews []core.ClockSkew) {
+	var skewed []core.ClockSkew
+	for _, result := range skews {
+		skew := result.Skew
+		if skew < 0 {
+			skew = -skew
+		}
+		if result.Err != nil {
+			skewed = append(skewed, result)
+			c.report.warn(fmt.Sprintf("couldn't get the time on %s: %v", result.Member.Name, result.Err))
+		} else if skew > c.maxClockSkew {
+			skewed = append(skewed, result)
+			c.report.warn(fmt.Sprintf("clock on %s differs from the primary's by %s", result.Member.Name, result.Skew))
+		}
+	}
+	if len(skewed) == 0 {
+		return
+	}
+	c.ui.Notify(populate(clockSkewTemplate, struct {
+		MaxSkew time.Duration
+		Skewed  []core.ClockSkew
+	}{c.maxClockSkew, skewed}))
+}
+
+// checkMachineIDTags reports any replica set members whose machine
+// IDs had to be found from the controller machines, repairing the
+// tags if requested.
+func (c *restoreCommand) checkMachineIDTags() error {
+	inferred := c.restorer.InferredMachineIDs()
+	if len(inferred) == 0 {
+		return nil
+	}
+	c.ui.Notify(populate(inferredMachineIDsTemplate, inferred))
+	if !c.repairReplicaSetTags {
+		for _, member := range inferred {
+			c.report.warn(fmt.Sprintf("replica set member %s has no juju-machine-id tag", member.Name))
+		}
+		c.ui.Notify("Run with --repair-replicaset-tags to add them to the replica set config.\n")
+		return nil
+	}
+	if c.dryRun {
+		c.ui.Notify("Dry run: not updating the replica set tags.\n")
+		return nil
+	}
+	if err := c.restorer.RepairMachineIDTags(); err != nil {
+		return core.NewFailure(core.PrecheckFailure, errors.Trace(err))
+	}
+	c.ui.Progress("Replica set tags updated.\n")
 	return nil
 }
 
+func (c *restoreCommand) restore() error {
+	// Stop juju agents, unless the live database is left alone.
+	if c.targetDatabase == "" {
+		err := c.report.phase(phaseStopAgents, func() error {
+			c.ui.Progress("\nStopping Juju agents...\n")
+			err := c.manipulateAgents(c.restorer.StopAgents)
+			return core.NewFailure(core.ConnectivityFailure, err)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := c.runHook(hookPostStopAgents); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return c.report.phase(phaseRestore, func() error {
+		if err := c.runHook(hookPreRestore); err != nil {
+			return core.NewFailure(core.RestoreFailure, errors.Trace(err))
+		}
+		if c.dryRun {
+			c.ui.Notify(fmt.Sprintf("\nDry run: not restoring the database from %s.\n", c.sourceName()))
+			if c.copyController {
+				return errors.Trace(c.showPermissionPlan())
+			}
+			return nil
+		}
+		c.ui.Progress("\nRunning restore...\n")
+		if c.copyFrom == "" {
+			c.ui.Progress(fmt.Sprintf("Detailed mongorestore output in %s.\n", c.restoreLog))
+		}
+		c.report.RestoreLog = c.restoreLog
+		options := core.RestoreOptions{
+			LogFile:              c.restoreLog,
+			IncludeStatusHistory: c.includeStatusHistory,
+			IncludeLogs:          c.includeLogs,
+			LogsMaxAge:           c.logsMaxAge,
+			CopyController:       c.copyController,
+			RedoControllerCopy:   c.redoCopy,
+			CopySettings:         c.copySettings,
+			CopyAgentBinaries:    c.copyAgentBinaries,
+			TargetDatabase:       c.targetDatabase,
+			UsersOnly:            c.usersOnly,
+			OverwriteUsers:       c.overwriteUsers,
+			CloudsOnly:           c.cloudsOnly,
+			SettingsOnly:         c.settingsOnly,
+		}
+		if c.perCollection {
+			options.PerCollection = true
+			options.CollectionRetries = c.collectionRetries
+			options.CompletedFile = c.completedFile
+			c.ui.Progress(fmt.Sprintf("Restoring a collection at a time, recording the collections restored in %s.\n", c.completedFile))
+		}
+		result, err := c.restorer.Restore(options)
+		if err != nil {
+			if c.perCollection {
+				c.ui.Notify(fmt.Sprintf(perCollectionFailed, c.completedFile))
+			}
+			return errors.Trace(err)
+		}
+		c.report.restored(result)
+		if c.logsMaxAge > 0 {
+			c.ui.Progress(fmt.Sprintf("\nRemoved %d log entries older than %s before the backup.", result.LogsTrimmed, c.logsMaxAge))
+		}
+
+		c.ui.Progress("\nDatabase restore complete.")
+		if c.targetDatabase != "" {
+			c.ui.Notify(fmt.Sprintf(targetDatabaseRestored, c.targetDatabase))
+		}
+		return errors.Trace(c.runHook(hookPostRestore))
+	})
+}
+
 func (c *restoreCommand) runPostChecks() error {
-	c.ui.Notify("\nStarting Juju agents...\n")
+	defer c.cancelOnInterrupt()()
+	c.ui.Progress("\nStarting Juju agents...\n")
 	if err := c.manipulateAgents(c.restorer.StartAgents); err != nil {
-		return errors.Trace(err)
+		return core.NewFailure(core.PostcheckFailure, errors.Trace(err))
 	}
 
 	if c.restorer.IsHA() {
-		c.ui.Notify("Primary node may have shifted.\n")
+		c.ui.Progress("Primary node may have shifted.\n")
+	}
+	var err error
+	if c.waitForAgents > 0 {
+		err = c.waitForActiveAgents()
+	}
+	c.checkAgentLogs()
+	return errors.Trace(err)
+}
+
+// checkAgentLogs warns about any problems the started agents' logs
+// show, so the operator doesn't have to go looking through them.
+func (c *restoreCommand) checkAgentLogs() {
+	if c.dryRun {
+		return
+	}
+	includeSecondaries := c.restorer.IsHA() && !c.manualAgentControl
+	var problems []core.AgentLogResult
+	for _, result := range c.restorer.CheckAgentLogs(includeSecondaries) {
+		if result.Err != nil {
+			c.report.warn(fmt.Sprintf("couldn't read the agent log on %s: %v", result.Member.Name, result.Err))
+			continue
+		}
+		for _, problem := range result.Problems {
+			c.report.warn(fmt.Sprintf("agent log on %s shows %s", result.Member.Name, problem.Problem))
+		}
+		if len(result.Problems) > 0 {
+			problems = append(problems, result)
+		}
+	}
+	if len(problems) > 0 {
+		c.ui.Notify(populate(agentLogProblemsTemplate, problems))
+	}
+}
+
+// cancelOnInterrupt stops the restorer waiting for the replica set
+// and agents, and retrying failed starts, if the operator presses
+// Ctrl-C before the returned function is called. Interrupting again
+// kills juju-restore as usual.
+func (c *restoreCommand) cancelOnInterrupt() func() {
+	interrupted := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	c.ui.InterruptNotify(interrupted)
+	go func() {
+		select {
+		case <-interrupted:
+			c.ui.StopInterruptNotify(interrupted)
+			c.report.warn("waiting for the replica set and agents skipped by operator")
+			c.ui.Notify(interruptedMessage)
+			close(c.cancel)
+		case <-done:
+		}
+	}()
+	return func() {
+		c.ui.StopInterruptNotify(interrupted)
+		close(done)
+	}
+}
+
+// waitForActiveAgents waits for the agents that were started to
+// report they're active, showing each node's status if they don't.
+func (c *restoreCommand) waitForActiveAgents() error {
+	c.ui.Progress(fmt.Sprintf("\nWaiting up to %s for agents to be active...\n", c.waitForAgents))
+	includeSecondaries := c.restorer.IsHA() && !c.manualAgentControl
+	statuses, err := c.restorer.WaitForAgents(includeSecondaries, c.waitForAgents)
+	if err != nil {
+		c.agentErrors = make(map[string]string)
+		for _, status := range statuses {
+			if status.Err != nil {
+				c.agentErrors[memberHost(status.Member)] = status.Err.Error()
+			} else if status.Status.AgentState != "active" {
+				c.agentErrors[memberHost(status.Member)] = fmt.Sprintf("agent is %q", status.Status.AgentState)
+			}
+		}
+		c.ui.Notify("\nNot all agents are active:\n")
+		c.ui.Notify(formatNodeStatuses(statuses))
+		return errors.Trace(err)
 	}
+	c.ui.Progress("All agents are active.\n")
 	return nil
 }
 
 func (c *restoreCommand) manipulateAgents(operation func(bool) map[string]error) error {
+	// Results for each node are reported by notifyNodeDone as they
+	// complete.
 	connections := operation(!c.manualAgentControl)
-	c.ui.Notify(populate(nodesTemplate, connections))
-	for _, e := range connections {
+	c.agentErrors = make(map[string]string)
+	for node, e := range connections {
 		if e != nil {
-			// If even one connection failed, we cannot proceed.
-			return errors.Errorf("'juju-restore' could not manipulate all necessary agents: controllers' agents cannot be managed")
+			c.agentErrors[node] = e.Error()
 		}
 	}
+	if len(c.agentErrors) > 0 {
+		// If even one connection failed, we cannot proceed.
+		return errors.Errorf("'juju-restore' could not manipulate all necessary agents: controllers' agents cannot be managed")
+	}
+	return nil
+}
+
+func (c *restoreCommand) notifyNodeDone(node string, err error) {
+	c.report.node(node, err)
+	if c.timeline != nil {
+		// The node's result is shown in the timeline.
+		return
+	}
+	notify := c.ui.Notify
+	if err == nil {
+		notify = c.ui.Progress
+	}
+	notify(populate(nodeResultTemplate, struct {
+		Node  string
+		Error error
+	}{node, err}))
+}
+
+// showPermissionPlan lists what copying the controller would do with
+// each of the source's permissions, since a mistake there can lock
+// users out of this controller.
+func (c *restoreCommand) showPermissionPlan() error {
+	plan, err := c.restorer.PlanPermissionCopy()
+	if err != nil {
+		return core.NewFailure(core.RestoreFailure, errors.Trace(err))
+	}
+	c.report.Permissions = plan
+	c.ui.Notify(populate(permissionPlanTemplate, plan))
 	return nil
 }
 
+// showDryRunCommand shows a command that would have been run on a
+// controller machine.
+func (c *restoreCommand) showDryRunCommand(node, command string) {
+	command = strings.ReplaceAll(command, "\n", "\n        ")
+	c.ui.Notify(fmt.Sprintf("    [dry run] %s: %s\n", node, command))
+}
+
+// readPassword gets the password for --username if it wasn't passed
+// with --password, from stdin, the environment or a prompt. An
+// explicit --password-stdin wins over a variable that may have been
+// left exported.
+func (c *restoreCommand) readPassword() (string, error) {
+	if c.passwordStdin {
+		return c.ui.ReadLine()
+	}
+	if password := os.Getenv(passwordEnvVar); password != "" {
+		return password, nil
+	}
+	return c.ui.ReadPassword(fmt.Sprintf("Password for %s: ", c.username))
+}
+
+// passwordEnvVar can hold the password for --username, so it doesn't
+// need to be on the command line.
+const passwordEnvVar = "JUJU_RESTORE_PASSWORD"
+
+// sourcePasswordEnvVar can hold the password for --source-username.
+const sourcePasswordEnvVar = "JUJU_RESTORE_SOURCE_PASSWORD"
+
+// dialSource connects to the running controller given with
+// --copy-from, asking for the password if it isn't given.
+func (c *restoreCommand) dialSource() (core.BackupFile, error) {
+	password := c.sourcePassword
+	if password == "" {
+		password = os.Getenv(sourcePasswordEnvVar)
+	}
+	if password == "" {
+		var err error
+		password, err = c.ui.ReadPassword(fmt.Sprintf("Password for %s on %s: ", c.sourceUsername, c.sourceHost))
+		if err != nil {
+			return nil, errors.Annotate(err, "reading source password")
+		}
+	}
+	c.ui.Progress(fmt.Sprintf("Connecting to source controller at %s...\n", net.JoinHostPort(c.sourceHost, c.sourcePort)))
+	source, err := c.connect(db.DialInfo{
+		Hostname: c.sourceHost,
+		Port:     c.sourcePort,
+		Username: c.sourceUsername,
+		Password: password,
+		SSL:      c.sourceSSL,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return core.NewLiveSource(source, clock.WallClock), nil
+}
+
+// sourceName describes what's being restored or copied.
+func (c *restoreCommand) sourceName() string {
+	if c.copyFrom != "" {
+		return "the controller at " + net.JoinHostPort(c.sourceHost, c.sourcePort)
+	}
+	return c.backupFile
+}
+
 const agentConfPattern = "/var/lib/juju/agents/machine-*/agent.conf"
 
-// ReadCredsFromAgentConf tries to load a mongo username and password
-// from the standard agent.conf location on a controller machine.
-func ReadCredsFromAgentConf() (string, string, error) {
-	return ReadCredsFromPattern(agentConfPattern, readFileWithSudo)
+// AgentConf holds the database connection details read from a
+// controller agent's config.
+type AgentConf struct {
+	// Path is the agent.conf the details were read from.
+	Path string
+
+	Username string
+	Password string
+
+	// Hostname and Port are where the agent connects to the
+	// database. They're empty if agent.conf doesn't record them.
+	Hostname string
+	Port     string
+
+	// CACert is the controller's CA certificate in PEM format, used
+	// to verify the database's certificate.
+	CACert string
+}
+
+// ReadCredsFromAgentConf loads the mongo connection details from the
+// agent.conf specified, or if that's empty from each agent.conf in the
+// standard location on a controller machine.
+func ReadCredsFromAgentConf(agentConf string) ([]AgentConf, error) {
+	if agentConf == "" {
+		return ReadCredsFromPattern(agentConfPattern, readFileWithSudo)
+	}
+	conf, err := readCredsFromFile(agentConf, readFileWithSudo)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return []AgentConf{conf}, nil
 }
 
-// ReadCredsFromPattern tries to load a mongo username and password
-// from the first file it finds matching the pattern passed in.
-func ReadCredsFromPattern(pattern string, readFile func(string) ([]byte, error)) (string, string, error) {
+// ReadCredsFromPattern loads the mongo connection details from each
+// file matching the pattern passed in. Files that can't be read are
+// skipped, unless none of them can be.
+func ReadCredsFromPattern(pattern string, readFile func(string) ([]byte, error)) ([]AgentConf, error) {
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
-		return "", "", errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	if len(matches) == 0 {
-		return "", "", errors.Errorf("couldn't find an agent.conf - please specify username and password")
+		return nil, errors.Errorf("couldn't find an agent.conf - please specify username and password")
 	}
-	conf := matches[0]
-
-	var creds struct {
-		Username string `yaml:"tag"`
-		Password string `yaml:"statepassword"`
+	var (
+		result   []AgentConf
+		firstErr error
+	)
+	for _, path := range matches {
+		conf, err := readCredsFromFile(path, readFile)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			logger.Warningf("skipping %s: %v", path, err)
+			continue
+		}
+		result = append(result, conf)
+	}
+	if len(result) == 0 {
+		return nil, errors.Trace(firstErr)
 	}
+	return result, nil
+}
 
-	data, err := readFile(conf)
+// readCredsFromFile loads the mongo connection details from the
+// agent.conf at the path given.
+func readCredsFromFile(path string, readFile func(string) ([]byte, error)) (AgentConf, error) {
+	data, err := readFile(path)
 	if err != nil {
-		return "", "", errors.Annotatef(err, "reading %q with sudo", conf)
+		return AgentConf{}, errors.Annotatef(err, "reading %q with sudo", path)
+	}
+	return parseAgentConf(path, data)
+}
+
+// parseAgentConf extracts the mongo connection details from the
+// contents of the agent.conf at the path given.
+func parseAgentConf(conf string, data []byte) (AgentConf, error) {
+	var fields struct {
+		Username       string   `yaml:"tag"`
+		Password       string   `yaml:"statepassword"`
+		StatePort      int      `yaml:"stateport"`
+		StateAddresses []string `yaml:"stateaddresses"`
+		CACert         string   `yaml:"cacert"`
 	}
-	err = yaml.Unmarshal(data, &creds)
+	err := yaml.Unmarshal(data, &fields)
 	if err != nil {
-		return "", "", errors.Annotatef(err, "unmarshalling %q", conf)
+		return AgentConf{}, errors.Annotatef(err, "unmarshalling %q", conf)
 	}
 
-	if creds.Username == "" {
-		return "", "", errors.Errorf("no username found in %q - tag field is missing or blank", conf)
+	if fields.Username == "" {
+		return AgentConf{}, errors.Errorf("no username found in %q - tag field is missing or blank", conf)
 	}
-	if creds.Password == "" {
-		return "", "", errors.Errorf("no password found in %q - statepassword field is missing or blank", conf)
+	if fields.Password == "" {
+		return AgentConf{}, errors.Errorf("no password found in %q - statepassword field is missing or blank", conf)
 	}
 
-	return creds.Username, creds.Password, nil
+	result := AgentConf{
+		Path:     conf,
+		Username: fields.Username,
+		Password: fields.Password,
+		CACert:   fields.CACert,
+	}
+	if len(fields.StateAddresses) > 0 {
+		host, port, err := net.SplitHostPort(fields.StateAddresses[0])
+		if err != nil {
+			return AgentConf{}, errors.Annotatef(err, "parsing state address in %q", conf)
+		}
+		result.Hostname, result.Port = host, port
+	}
+	if fields.StatePort != 0 {
+		result.Port = strconv.Itoa(fields.StatePort)
+	}
+	return result, nil
 }
 
 func readFileWithSudo(path string) ([]byte, error) {
 	command := exec.Command("sudo", "cat", path)
+	if os.Geteuid() == 0 {
+		command = exec.Command("cat", path)
+	}
 	var out, cmdErr bytes.Buffer
 	command.Stdout = &out
 	command.Stderr = &cmdErr
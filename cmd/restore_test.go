@@ -4,14 +4,24 @@
 package cmd_test
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	corecmd "github.com/juju/cmd/v3"
 	"github.com/juju/cmd/v3/cmdtesting"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
 	"github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	"github.com/juju/version/v2"
@@ -19,6 +29,7 @@ import (
 
 	"github.com/juju/juju-restore/cmd"
 	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
 	"github.com/juju/juju-restore/db"
 	"github.com/juju/juju-restore/machine"
 )
@@ -26,23 +37,31 @@ import (
 type restoreSuite struct {
 	testing.IsolationSuite
 
-	database  *testDatabase
-	backup    *fakeBackup
+	database  *coretesting.Database
+	backup    *coretesting.BackupFile
 	connectF  func(db.DialInfo) (core.Database, error)
-	openF     func(string, string) (core.BackupFile, error)
+	openF     func(string, string, func(int64) error) (core.BackupFile, error)
 	converter func(member core.ReplicaSetMember) core.ControllerNode
-	loadCreds func() (string, string, error)
+	loadCreds func(string) ([]cmd.AgentConf, error)
+	evidence  cmd.ControllerEvidence
 	devMode   bool
+
+	machineConfig    machine.Config
+	hostKeyConfirmed bool
+	historyFile      string
 }
 
 var _ = gc.Suite(&restoreSuite{})
 
 func (s *restoreSuite) SetUpTest(c *gc.C) {
 	s.IsolationSuite.SetUpTest(c)
-	s.database = &testDatabase{
-		Stub: &testing.Stub{},
-		replicaSetF: func() (core.ReplicaSet, error) {
+	s.PatchValue(cmd.ApprovalPolicyFile, filepath.Join(c.MkDir(), "allowed_signers"))
+	s.historyFile = filepath.Join(c.MkDir(), "restore-history.jsonl")
+	s.hostKeyConfirmed = false
+	s.database = &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            1,
@@ -53,7 +72,7 @@ func (s *restoreSuite) SetUpTest(c *gc.C) {
 				}},
 			}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				ControllerModelUUID: "how-bizarre",
 				JujuVersion:         version.MustParse("2.9.37.2"),
@@ -61,11 +80,15 @@ func (s *restoreSuite) SetUpTest(c *gc.C) {
 				HANodes:             1,
 			}, nil
 		},
+		Collections: []core.RestoredCollection{
+			{Name: "juju.machines", Documents: 3},
+			{Name: "juju.models", Documents: 2},
+		},
 	}
 	created, err := time.Parse(time.RFC3339, "2020-03-17T16:28:24Z")
 	c.Assert(err, jc.ErrorIsNil)
-	s.backup = &fakeBackup{
-		metadataF: func() (core.BackupMetadata, error) {
+	s.backup = &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
 			return core.BackupMetadata{
 				FormatVersion:       1,
 				ControllerUUID:      "dawkins-rules",
@@ -80,15 +103,21 @@ func (s *restoreSuite) SetUpTest(c *gc.C) {
 				CloudCount:          666,
 			}, nil
 		},
-		dumpDirF: func() string {
+		DumpDirectoryF: func() string {
 			return "dump-directory"
 		},
 	}
 	s.connectF = func(db.DialInfo) (core.Database, error) { return s.database, nil }
-	s.openF = func(string, string) (core.BackupFile, error) { return s.backup, nil }
-	s.converter = machine.ControllerNodeForReplicaSetMember
-	s.loadCreds = func() (string, string, error) {
-		return "", "", errors.Errorf("loading those creds")
+	s.openF = func(string, string, func(int64) error) (core.BackupFile, error) { return s.backup, nil }
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.loadCreds = func(string) ([]cmd.AgentConf, error) {
+		return nil, errors.Errorf("loading those creds")
+	}
+	s.evidence = cmd.ControllerEvidence{
+		AgentDirs: []string{"/var/lib/juju/agents/machine-2"},
+		JujuDB:    "/var/snap/juju-db/common",
 	}
 
 }
@@ -109,6 +138,301 @@ var commandArgsTests = []restoreCommandTestData{
 		title: "just file",
 		args:  []string{"backup.file"},
 	},
+	{
+		title:    "missing ssh node config",
+		args:     []string{"backup.file", "--ssh-node-config", "/no/such/file.yaml"},
+		errMatch: "reading ssh node config: open /no/such/file.yaml: no such file or directory",
+	},
+	{
+		title:    "invalid parallelism",
+		args:     []string{"backup.file", "--parallelism", "0"},
+		errMatch: "--parallelism must be at least 1",
+	},
+	{
+		title:    "negative command timeout",
+		args:     []string{"backup.file", "--command-timeout", "-1s"},
+		errMatch: "--command-timeout can't be negative",
+	},
+	{
+		title:    "negative max replication lag",
+		args:     []string{"backup.file", "--max-replication-lag", "-1s"},
+		errMatch: "--max-replication-lag can't be negative",
+	},
+	{
+		title:    "negative max clock skew",
+		args:     []string{"backup.file", "--max-clock-skew", "-1s"},
+		errMatch: "--max-clock-skew can't be negative",
+	},
+	{
+		title:    "missing hook dir",
+		args:     []string{"backup.file", "--hook-dir", "/no/such/hooks"},
+		errMatch: "checking hook dir: stat /no/such/hooks: no such file or directory",
+	},
+	{
+		title:    "agent conf with username",
+		args:     []string{"backup.file", "--agent-conf", "agent.conf", "--username", "admin"},
+		errMatch: "--agent-conf incompatible with --username",
+	},
+	{
+		title:    "password stdin with password",
+		args:     []string{"backup.file", "--password-stdin", "--password", "secret"},
+		errMatch: "--password-stdin incompatible with --password",
+	},
+	{
+		title:    "password stdin without username",
+		args:     []string{"backup.file", "--password-stdin"},
+		errMatch: "--password-stdin requires --username",
+	},
+	{
+		title:    "quiet without yes",
+		args:     []string{"backup.file", "--quiet"},
+		errMatch: "--quiet requires --yes or --answers - prompts can't be shown",
+	},
+	{
+		title:    "answers with yes",
+		args:     []string{"backup.file", "--answers", "answers.yaml", "--yes"},
+		errMatch: "--answers incompatible with --yes",
+	},
+	{
+		title:    "record answers with yes",
+		args:     []string{"backup.file", "--record-answers", "answers.yaml", "--yes"},
+		errMatch: "--record-answers incompatible with --yes",
+	},
+	{
+		title:    "missing answers file",
+		args:     []string{"backup.file", "--answers", "/no/such/answers.yaml"},
+		errMatch: "reading answers: open /no/such/answers.yaml: no such file or directory",
+	},
+	{
+		title:    "invalid ssh attempts",
+		args:     []string{"backup.file", "--ssh-attempts", "0"},
+		errMatch: "--ssh-attempts must be at least 1",
+	},
+	{
+		title:    "confirm host keys without known hosts",
+		args:     []string{"backup.file", "--ssh-confirm-host-keys"},
+		errMatch: "--ssh-confirm-host-keys requires --ssh-known-hosts",
+	},
+	{
+		title:    "k8s context without namespace",
+		args:     []string{"backup.file", "--k8s-context", "microk8s"},
+		errMatch: "--k8s-context requires --k8s-namespace",
+	},
+	{
+		title:    "target database with copy controller",
+		args:     []string{"backup.file", "--target-database", "juju_restored", "--copy-controller"},
+		errMatch: "--target-database incompatible with --copy-controller",
+	},
+	{
+		title:    "live target database",
+		args:     []string{"backup.file", "--target-database", "juju"},
+		errMatch: `checking --target-database: database "juju" is used by the controller`,
+	},
+	{
+		title:    "invalid target database",
+		args:     []string{"backup.file", "--target-database", "juju.restored"},
+		errMatch: `checking --target-database: database name "juju.restored" can only contain letters, digits, _ and -`,
+	},
+	{
+		title:    "overwrite users without users only",
+		args:     []string{"backup.file", "--overwrite-users"},
+		errMatch: "--overwrite-users requires --users-only",
+	},
+	{
+		title:    "users only with copy controller",
+		args:     []string{"backup.file", "--users-only", "--copy-controller"},
+		errMatch: "--copy-controller incompatible with --users-only",
+	},
+	{
+		title:    "users only with include logs",
+		args:     []string{"backup.file", "--users-only", "--include-logs"},
+		errMatch: "--include-logs incompatible with --users-only",
+	},
+	{
+		title:    "users only with clouds only",
+		args:     []string{"backup.file", "--users-only", "--clouds-only"},
+		errMatch: "--users-only incompatible with --clouds-only",
+	},
+	{
+		title:    "clouds only with target database",
+		args:     []string{"backup.file", "--clouds-only", "--target-database", "juju_restored"},
+		errMatch: "--target-database incompatible with --clouds-only",
+	},
+	{
+		title:    "settings only with users only",
+		args:     []string{"backup.file", "--users-only", "--settings-only"},
+		errMatch: "--users-only incompatible with --settings-only",
+	},
+	{
+		title:    "per collection with copy controller",
+		args:     []string{"backup.file", "--per-collection", "--copy-controller"},
+		errMatch: "--per-collection incompatible with --copy-controller",
+	},
+	{
+		title:    "per collection with target database",
+		args:     []string{"backup.file", "--per-collection", "--target-database", "juju_restored"},
+		errMatch: "--per-collection incompatible with --target-database",
+	},
+	{
+		title:    "per collection with clouds only",
+		args:     []string{"backup.file", "--per-collection", "--clouds-only"},
+		errMatch: "--per-collection incompatible with --clouds-only",
+	},
+	{
+		title:    "negative collection retries",
+		args:     []string{"backup.file", "--per-collection", "--collection-retries", "-1"},
+		errMatch: "--collection-retries can't be negative",
+	},
+	{
+		title:    "redo copy without copy controller",
+		args:     []string{"backup.file", "--redo-copy"},
+		errMatch: "--redo-copy requires --copy-controller",
+	},
+	{
+		title:    "copy settings without copy controller",
+		args:     []string{"backup.file", "--copy-settings-exclude", "audit-log-max-size"},
+		errMatch: "--copy-settings-exclude and --copy-settings-include require --copy-controller",
+	},
+	{
+		title:    "copy settings excluded and included",
+		args:     []string{"backup.file", "--copy-controller", "--copy-settings-exclude", "api-port, audit-log-max-size", "--copy-settings-include", "audit-log-max-size"},
+		errMatch: `"audit-log-max-size" is in both --copy-settings-exclude and --copy-settings-include`,
+	},
+	{
+		title:    "copy agent binaries without copy controller",
+		args:     []string{"backup.file", "--copy-agent-binaries"},
+		errMatch: "--copy-agent-binaries requires --copy-controller",
+	},
+	{
+		title:    "copy agent binaries from a running controller",
+		args:     []string{"--copy-controller", "--copy-agent-binaries", "--copy-from", "10.0.0.1", "--source-username", "machine-0"},
+		errMatch: "--copy-agent-binaries incompatible with --copy-from",
+	},
+	{
+		title:    "approval when copying from a running controller",
+		args:     []string{"--copy-controller", "--approval", "approval.yaml", "--copy-from", "10.0.0.1", "--source-username", "machine-0"},
+		errMatch: "--approval requires a backup file - it can't be used with --copy-from or --resume",
+	},
+	{
+		title:    "copy from without copy controller",
+		args:     []string{"--copy-from", "old-controller", "--source-username", "machine-0"},
+		errMatch: "--copy-from requires --copy-controller",
+	},
+	{
+		title:    "copy from without source username",
+		args:     []string{"--copy-controller", "--copy-from", "old-controller"},
+		errMatch: "--copy-from requires --source-username",
+	},
+	{
+		title:    "copy from with backup file",
+		args:     []string{"backup.file", "--copy-controller", "--copy-from", "old-controller", "--source-username", "machine-0"},
+		errMatch: "--copy-from incompatible with a backup file",
+	},
+	{
+		title:    "bad copy from address",
+		args:     []string{"--copy-controller", "--copy-from", ":37017", "--source-username", "machine-0"},
+		errMatch: `--copy-from ":37017" isn't host or host:port`,
+	},
+	{
+		title:    "source username without copy from",
+		args:     []string{"backup.file", "--source-username", "machine-0"},
+		errMatch: "--source-username and --source-password require --copy-from",
+	},
+	{
+		title:    "until without incremental",
+		args:     []string{"backup.file", "--until", "2020-03-17T17:00:00Z"},
+		errMatch: "--until requires --incremental",
+	},
+	{
+		title:    "invalid until",
+		args:     []string{"backup.file", "--incremental", "inc.file", "--until", "5pm"},
+		errMatch: `parsing --until: parsing time "5pm".*`,
+	},
+	{
+		title:    "target database with incremental",
+		args:     []string{"backup.file", "--target-database", "juju_restored", "--incremental", "inc.file"},
+		errMatch: "--incremental incompatible with --target-database",
+	},
+	{
+		title:    "incremental with copy controller",
+		args:     []string{"backup.file", "--incremental", "inc.file", "--copy-controller"},
+		errMatch: "--incremental incompatible with --copy-controller",
+	},
+	{
+		title:    "include logs with copy controller",
+		args:     []string{"backup.file", "--include-logs", "--copy-controller"},
+		errMatch: "--include-logs incompatible with --copy-controller",
+	},
+	{
+		title:    "logs max age without include logs",
+		args:     []string{"backup.file", "--logs-max-age", "72h"},
+		errMatch: "--logs-max-age requires --include-logs",
+	},
+	{
+		title:    "negative logs max age",
+		args:     []string{"backup.file", "--include-logs", "--logs-max-age", "-1h"},
+		errMatch: "--logs-max-age can't be negative",
+	},
+	{
+		title:    "negative start retries",
+		args:     []string{"backup.file", "--start-retries", "-1"},
+		errMatch: "--start-retries can't be negative",
+	},
+	{
+		title:    "dry run resume",
+		args:     []string{"--dry-run", "--resume"},
+		errMatch: "--dry-run incompatible with --resume",
+	},
+	{
+		title:    "unknown progress",
+		args:     []string{"backup.file", "--progress", "fancy"},
+		errMatch: "--progress must be auto, live or lines",
+	},
+	{
+		title:    "no stabilise attempts",
+		args:     []string{"backup.file", "--stabilise-attempts", "0"},
+		errMatch: "--stabilise-attempts must be at least 1",
+	},
+	{
+		title:    "negative stabilise max wait",
+		args:     []string{"backup.file", "--stabilise-max-wait", "-1s"},
+		errMatch: "--stabilise-max-wait can't be negative",
+	},
+	{
+		title:    "no sudo with sudo command",
+		args:     []string{"backup.file", "--no-sudo", "--sudo-command", "doas"},
+		errMatch: "--no-sudo incompatible with --sudo-command",
+	},
+	{
+		title:    "negative staged start",
+		args:     []string{"backup.file", "--staged-start", "-1m"},
+		errMatch: "--staged-start can't be negative",
+	},
+	{
+		title:    "negative wait for agents",
+		args:     []string{"backup.file", "--wait-for-agents", "-1m"},
+		errMatch: "--wait-for-agents can't be negative",
+	},
+	{
+		title:    "wait for unmanaged agents",
+		args:     []string{"backup.file", "--wait-for-agents", "5m", "--manage-services", "database"},
+		errMatch: "--wait-for-agents requires --manage-services to include machine-agent",
+	},
+	{
+		title:    "unknown service",
+		args:     []string{"backup.file", "--manage-services", "machine-agent,jujud"},
+		errMatch: `parsing --manage-services: unknown service "jujud" \(expected machine-agent or database\)`,
+	},
+	{
+		title:    "no services",
+		args:     []string{"backup.file", "--manage-services", ","},
+		errMatch: "parsing --manage-services: no services given",
+	},
+	{
+		title:    "database service in kubernetes",
+		args:     []string{"backup.file", "--manage-services", "machine-agent,database", "--k8s-namespace", "controller-kube"},
+		errMatch: "--manage-services=database incompatible with --k8s-namespace - the database runs in its own container",
+	},
 	{
 		title:    "verbose and logging-config conflict",
 		args:     []string{"backup.file", "--logging-config", "<root>=TRACE", "--verbose"},
@@ -120,8 +444,9 @@ func (s *restoreSuite) TestArgParsing(c *gc.C) {
 	command := cmd.NewRestoreCommand(
 		s.connectF,
 		s.openF,
-		s.converter,
+		s.nodeFactory,
 		s.loadCreds,
+		s.detectController,
 		s.devMode,
 	)
 	for i, test := range commandArgsTests {
@@ -150,9 +475,15 @@ Running on primary HA node ✓
 
 You are about to restore this backup:
     Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
+    Controller:   dawkins-rules
+    Model:        how-bizarre
     Juju version: 2.9.37
     Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   active  active
 
 All restore pre-checks are completed.
 
@@ -162,7 +493,7 @@ Are you sure you want to proceed? (y/N): `[1:])
 }
 
 func (s *restoreSuite) TestPrecheckFailed(c *gc.C) {
-	s.database.controllerInfoF = func() (core.ControllerInfo, error) {
+	s.database.ControllerInfoF = func() (core.ControllerInfo, error) {
 		return core.ControllerInfo{
 			ControllerModelUUID: "how-bizarre",
 			JujuVersion:         version.MustParse("2.9.37"),
@@ -184,9 +515,86 @@ Running on primary HA node ✓
 `[1:])
 }
 
+func (s *restoreSuite) TestReplicaSetName(c *gc.C) {
+	_, err := s.runCmd(c, "", "--replica-set", "other", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `connected to replica set "juju", not "other" - .*`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.database.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "Close")
+}
+
+func (s *restoreSuite) TestReplicationLagFailed(c *gc.C) {
+	s.setupHA()
+	replicaSet := s.database.ReplicaSetF
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		rs, err := replicaSet()
+		rs.Members[1].Lag = 90 * time.Second
+		rs.OplogWindow = 12 * time.Hour
+		return rs, err
+	}
+	_, err := s.runCmd(c, "\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `replica set members more than 1m0s behind the primary: 2 "two:node" \(juju machine 1\) lagging by 1m30s \(oplog window 12h0m0s\)`)
+
+	_, err = s.runCmd(c, "y\n\n", "backup.file", "--max-replication-lag", "2m")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+}
+
+func (s *restoreSuite) setupInferredMachineID() {
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		return core.ReplicaSet{
+			Name: "juju",
+			Members: []core.ReplicaSetMember{{
+				Healthy:           true,
+				ID:                1,
+				Name:              "one-node",
+				State:             "PRIMARY",
+				Self:              true,
+				JujuMachineID:     "2",
+				MachineIDInferred: true,
+			}},
+		}, nil
+	}
+}
+
+func (s *restoreSuite) TestInferredMachineIDs(c *gc.C) {
+	s.setupInferredMachineID()
+	ctx, err := s.runCmd(c, "\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Running on primary HA node ✓
+
+The replica set config has no juju-machine-id tag for some members.
+Machine IDs were found from the controller machines' addresses:
+    one-node: machine 2
+Run with --repair-replicaset-tags to add them to the replica set config.
+`)
+	for _, call := range s.database.Calls() {
+		c.Assert(call.FuncName, gc.Not(gc.Equals), "SetMachineIDTags")
+	}
+}
+
+func (s *restoreSuite) TestRepairReplicaSetTags(c *gc.C) {
+	s.setupInferredMachineID()
+	ctx, err := s.runCmd(c, "\n", "backup.file", "--repair-replicaset-tags")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    one-node: machine 2
+Replica set tags updated.
+`)
+	// The controller info is read concurrently, so the tags may be
+	// set before or after it.
+	var tagged bool
+	for _, call := range s.database.Calls() {
+		if call.FuncName == "SetMachineIDTags" {
+			c.Assert(call.Args, jc.DeepEquals, []interface{}{map[int]string{1: "2"}})
+			tagged = true
+		}
+	}
+	c.Assert(tagged, jc.IsTrue)
+}
+
 func (s *restoreSuite) TestRestoreProceed(c *gc.C) {
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
+		node := newFakeNode(member.Name)
 		return node
 	}
 	ctx, err := s.runCmd(c, "y\n", "backup.file")
@@ -203,9 +611,15 @@ Running on primary HA node ✓
 
 You are about to restore this backup:
     Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
+    Controller:   dawkins-rules
+    Model:        how-bizarre
     Juju version: 2.9.37
     Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   active  active
 
 All restore pre-checks are completed.
 
@@ -213,24 +627,54 @@ Restore cannot be cleanly aborted from here on.
 
 Are you sure you want to proceed? (y/N): 
 Stopping Juju agents...
- 
-    one-node ✓ 
+    one-node ✓
 
 Running restore...
 Detailed mongorestore output in restore.log.
 
 Database restore complete.
 Starting Juju agents...
- 
-    one-node ✓ 
+    one-node ✓
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        one-node stop agents ✓
+        one-node start agents ✓
+    Collections restored: 2 (5 documents)
+    Juju version changed: 2.9.37.2 → 2.9.37
+    Restore log: restore.log
 `[1:])
 }
 
 func (s *restoreSuite) TestRestoreCopyController(c *gc.C) {
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
+		node := newFakeNode(member.Name)
 		return node
 	}
+	s.database.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{
+			ControllerUUID:       "sunny-day-real",
+			ControllerModelUUID:  "kiss-me",
+			ControllerModelCloud: "lxd",
+			JujuVersion:          version.MustParse("2.9.37.2"),
+			Series:               "focal",
+			HANodes:              3,
+			Models:               1,
+		}, nil
+	}
+	s.database.Entities = core.ControllerEntities{
+		Users:  []string{"admin", "bob"},
+		Clouds: []string{"lxd"},
+	}
+	s.backup.BackupEntities = core.ControllerEntities{
+		Users:  []string{"admin", "bob", "mary"},
+		Clouds: []string{"aws", "lxd"},
+	}
 	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller")
 	c.Assert(err, jc.ErrorIsNil)
 
@@ -249,95 +693,232 @@ You are about to copy this controller:
     Juju version: 2.9.37
     Clouds:       666
 
+Into this controller:
+    Controller:      sunny-day-real
+    Juju version:    2.9.37.2
+    Users:           2 - the backup's replace bob
+    Clouds:          1
+    Workload models: none - no workloads are interrupted by copying
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   active  active
+
 All restore pre-checks are completed.
 
 Restore cannot be cleanly aborted from here on.
 
 Are you sure you want to proceed? (y/N): 
 Stopping Juju agents...
- 
-    one-node ✓ 
+    one-node ✓
 
 Running restore...
 Detailed mongorestore output in restore.log.
 
 Database restore complete.
 Starting Juju agents...
- 
-    one-node ✓ 
+    one-node ✓
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        one-node stop agents ✓
+        one-node start agents ✓
+    Collections restored: 2 (5 documents)
+    Migration readiness: 0 models ready to migrate
+    Restore log: restore.log
 `[1:])
+	// The controller info is read concurrently with the check for an
+	// earlier copy, so find the restore call by name.
+	c.Assert(findCall(c, s.database.Calls(), "RestoreFromDump").Args, jc.DeepEquals, []interface{}{
+		"dump-directory", core.RestoreOptions{
+			LogFile:        "restore.log",
+			CopyController: true,
+		},
+	})
 }
 
-func (s *restoreSuite) TestRestoreProceedYes(c *gc.C) {
+func (s *restoreSuite) TestRestoreCopyControllerMigrationBlocked(c *gc.C) {
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
-		return node
+		return newFakeNode(member.Name)
 	}
-	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	s.backup.BackupModels = []core.ModelSummary{
+		{Name: "admin/default", Cloud: "lxd", CloudType: "lxd"},
+		{Name: "mary/prod", Cloud: "aws", CloudType: "ec2", Credential: "aws#mary#main"},
+	}
+	s.database.Target = core.MigrationTarget{
+		Clouds: map[string]string{"lxd": "lxd"},
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller")
 	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Migration readiness: 1 of 2 models blocked:
+        mary/prod: cloud "aws" isn't on the controller
+        mary/prod: credential "aws#mary#main" isn't on the controller
+    Restore log: restore.log
+`)
+}
 
-	assertLastCallIsClose(c, s.database.Calls())
-	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
-	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
-Connecting to database...
-Checking database and replica set health...
+func (s *restoreSuite) TestRestoreCopyControllerAgain(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.database.PreviousCopy = &core.ControllerCopy{
+		Source:    "dawkins-rules",
+		Backup:    "2020-03-17T16:28:24Z",
+		Completed: []string{"settings", "users"},
+	}
+	s.database.CopySkipped = []string{"settings", "users"}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+An earlier --copy-controller run copied this backup's controller and stopped part way.
+Already copied: settings, users
+These will be skipped - pass --redo-copy to copy them again.
+`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Skipped (copied by an earlier run): settings, users\n")
+	call := findCall(c, s.database.Calls(), "CopyController")
+	c.Assert(call.Args[1], gc.Equals, "dawkins-rules")
+	c.Assert(call.Args[3].(core.RestoreOptions).RedoControllerCopy, gc.Equals, false)
+}
 
-Replica set is healthy     ✓
-Running on primary HA node ✓
+func (s *restoreSuite) TestRestoreCopyControllerFinishedNeedsRedo(c *gc.C) {
+	s.database.PreviousCopy = &core.ControllerCopy{
+		Source:    "dawkins-rules",
+		Backup:    "2020-03-17T16:28:24Z",
+		Completed: []string{"settings", "users"},
+		Finished:  time.Date(2020, 3, 18, 9, 0, 0, 0, time.UTC),
+	}
+	_, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller")
+	c.Assert(err, gc.ErrorMatches, "this backup's controller was already copied into this controller, finishing at 2020-03-18 09:00:00 \\+0000 UTC - pass --redo-copy to copy it again")
+	for _, call := range s.database.Calls() {
+		c.Assert(call.FuncName, gc.Not(gc.Equals), "CopyController")
+	}
+}
 
-You are about to restore this backup:
-    Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
-    Juju version: 2.9.37
-    Models:       3
+func (s *restoreSuite) TestRestoreCopyControllerOtherBackup(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	// An earlier copy of an older backup of the same controller
+	// isn't resumed.
+	s.database.PreviousCopy = &core.ControllerCopy{
+		Source:    "dawkins-rules",
+		Backup:    "2020-03-10T10:00:00Z",
+		Completed: []string{"settings", "users"},
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "An earlier --copy-controller run")
+	call := findCall(c, s.database.Calls(), "CopyController")
+	c.Assert(call.Args[2], gc.Equals, "2020-03-17T16:28:24Z")
+}
 
-Stopping Juju agents...
- 
-    one-node ✓ 
+func (s *restoreSuite) TestRestoreCopyFrom(c *gc.C) {
+	source := &coretesting.Database{
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				ControllerUUID:      "paranoid",
+				ControllerModelUUID: "iron-man",
+				JujuVersion:         version.MustParse("2.9.37"),
+				HANodes:             3,
+				Models:              4,
+			}, nil
+		},
+		Entities: core.ControllerEntities{Clouds: []string{"aws", "lxd"}},
+	}
+	var sourceInfo db.DialInfo
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		if info.Hostname == "old-controller" {
+			sourceInfo = info
+			return source, nil
+		}
+		return s.database, nil
+	}
+	s.openF = func(string, string, func(int64) error) (core.BackupFile, error) {
+		return nil, errors.New("no backup file should be opened")
+	}
+	ctx, err := s.runCmd(c, "y\n", "--copy-controller", "--copy-from", "old-controller", "--source-username", "machine-0", "--source-password", "sabbath")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(sourceInfo, jc.DeepEquals, db.DialInfo{
+		Hostname: "old-controller",
+		Port:     "37017",
+		Username: "machine-0",
+		Password: "sabbath",
+		SSL:      true,
+	})
+	stdout := cmdtesting.Stdout(ctx)
+	c.Assert(stdout, jc.Contains, "Connecting to source controller at old-controller:37017...\n")
+	c.Assert(stdout, jc.Contains, "    Controller:   paranoid\n")
+	c.Assert(stdout, jc.Contains, "    Clouds:       2\n")
+	c.Assert(stdout, gc.Not(jc.Contains), "mongorestore")
+	c.Assert(findCall(c, s.database.Calls(), "StageFrom").Args, jc.DeepEquals, []interface{}{source})
+	call := findCall(c, s.database.Calls(), "CopyController")
+	c.Assert(call.Args[1], gc.Equals, "paranoid")
+	c.Assert(call.Args[3].(core.RestoreOptions).RedoControllerCopy, gc.Equals, false)
+	for _, call := range s.database.Calls() {
+		c.Assert(call.FuncName, gc.Not(gc.Equals), "RestoreFromDump")
+	}
+	assertLastCallIsClose(c, source.Calls())
+}
 
-Running restore...
-Detailed mongorestore output in restore.log.
+func (s *restoreSuite) TestRestoreRedoCopy(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.database.PreviousCopy = &core.ControllerCopy{
+		Source:    "dawkins-rules",
+		Backup:    "2020-03-17T16:28:24Z",
+		Completed: []string{"settings"},
+		Finished:  time.Date(2020, 3, 18, 9, 0, 0, 0, time.UTC),
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller", "--redo-copy")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "An earlier --copy-controller run")
+	call := findCall(c, s.database.Calls(), "CopyController")
+	c.Assert(call.Args[1], gc.Equals, "dawkins-rules")
+	c.Assert(call.Args[3].(core.RestoreOptions).RedoControllerCopy, gc.Equals, true)
+}
 
-Database restore complete.
-Starting Juju agents...
- 
-    one-node ✓ 
-`[1:])
+func (s *restoreSuite) TestRestoreCopySettings(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.database.SettingsChanged = []string{"audit-log-capture-args", "controller-name"}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller",
+		"--copy-settings-exclude", "audit-log-max-size, api-rate-limit", "--copy-settings-include", "controller-name")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(findCall(c, s.database.Calls(), "CopyController").Args[3].(core.RestoreOptions).CopySettings, jc.DeepEquals, core.SettingsFilter{
+		Exclude: []string{"audit-log-max-size", "api-rate-limit"},
+		Include: []string{"controller-name"},
+	})
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Controller settings restored: audit-log-capture-args, controller-name\n")
 }
 
-func (s *restoreSuite) setupHA() {
-	s.database.replicaSetF = func() (core.ReplicaSet, error) {
-		return core.ReplicaSet{
-			Members: []core.ReplicaSetMember{
-				{
-					Healthy:       true,
-					ID:            1,
-					Name:          "one:node",
-					State:         "PRIMARY",
-					Self:          true,
-					JujuMachineID: "2",
-				},
-				{
-					Healthy:       true,
-					ID:            2,
-					Name:          "two:node",
-					State:         "SECONDARY",
-					JujuMachineID: "1",
-				},
-			},
-		}, nil
+func (s *restoreSuite) TestRestoreCopyAgentBinaries(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
 	}
+	s.database.AgentBinaries = []string{"2.9.37-focal-amd64", "2.9.37-jammy-arm64"}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--copy-controller", "--copy-agent-binaries")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(findCall(c, s.database.Calls(), "CopyController").Args[3].(core.RestoreOptions).CopyAgentBinaries, jc.IsTrue)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Agent binaries copied: 2.9.37-focal-amd64, 2.9.37-jammy-arm64\n")
 }
 
-func (s *restoreSuite) TestRestoreHAConnectionFail(c *gc.C) {
-	s.setupHA()
+func (s *restoreSuite) TestRestoreTargetDatabase(c *gc.C) {
+	var nodes []*coretesting.ControllerNode
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
-		node.SetErrors(errors.New("kaboom"))
+		node := newFakeNode(member.Name)
+		nodes = append(nodes, node)
 		return node
 	}
-	ctx, err := s.runCmd(c, "y\n", "backup.file")
-	c.Assert(err, gc.ErrorMatches, `'juju-restore' could not connect to all controller machines: controllers' agents cannot be managed`)
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--target-database", "juju_restored")
+	c.Assert(err, jc.ErrorIsNil)
 
 	assertLastCallIsClose(c, s.database.Calls())
 	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
@@ -350,13 +931,1221 @@ Running on primary HA node ✓
 
 You are about to restore this backup:
     Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
+    Controller:   dawkins-rules
+    Model:        how-bizarre
     Juju version: 2.9.37
     Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
 
-This controller is in HA and to restore into it successfully, 'juju-restore' 
-needs to manage Juju and Mongo agents on secondary controller nodes.
-However on bigger systems the user might want to manage these agents manually.
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   active  active
+
+All restore pre-checks are completed.
+
+Restore cannot be cleanly aborted from here on.
+
+Are you sure you want to proceed? (y/N): 
+Running restore...
+Detailed mongorestore output in restore.log.
+
+Database restore complete.
+
+The backup was restored into the "juju_restored" database. The live juju
+database and the controller's agents haven't been changed.
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        restore ✓ 0s
+    Collections restored: 2 (5 documents)
+    Restore log: restore.log
+`[1:])
+	s.database.CheckCall(c, 4, "RestoreFromDump", "dump-directory", core.RestoreOptions{
+		LogFile:        "restore.log",
+		TargetDatabase: "juju_restored",
+	})
+	for _, node := range nodes {
+		for _, call := range node.Calls() {
+			c.Assert(call.FuncName, gc.Not(gc.Matches), "(Stop|Start)Agent")
+		}
+	}
+}
+
+func (s *restoreSuite) TestRestoreUsersOnly(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.database.Merged = []core.MergedCollection{
+		{Name: "juju.users", Added: 2, Kept: 1},
+		{Name: "juju.controllerusers", Added: 2},
+		{Name: "juju.permissions", Added: 5, Kept: 3},
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--users-only")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+Checking database and replica set health...
+
+Replica set is healthy     ✓
+Running on primary HA node ✓
+
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+Only the users, controller users and permissions will be restored. Users
+the controller has deleted are restored; the controller's other users and
+permissions are kept unless --overwrite-users was given.
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   active  active
+
+All restore pre-checks are completed.
+
+Restore cannot be cleanly aborted from here on.
+
+Are you sure you want to proceed? (y/N): 
+Stopping Juju agents...
+    one-node ✓
+
+Running restore...
+Detailed mongorestore output in restore.log.
+
+Database restore complete.
+Starting Juju agents...
+    one-node ✓
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        one-node stop agents ✓
+        one-node start agents ✓
+    Collections restored: 2 (5 documents)
+    Users merged:
+        juju.users: 2 added, 0 replaced, 1 kept
+        juju.controllerusers: 2 added, 0 replaced, 0 kept
+        juju.permissions: 5 added, 0 replaced, 3 kept
+    Restore log: restore.log
+`[1:])
+	s.database.CheckCall(c, 4, "RestoreFromDump", "dump-directory", core.RestoreOptions{
+		LogFile:   "restore.log",
+		UsersOnly: true,
+	})
+	s.database.CheckCall(c, 5, "MergeUsers", false)
+}
+
+func (s *restoreSuite) TestRestoreCloudsOnly(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--clouds-only")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Only the cloud definitions and credentials will be restored, replacing the
+controller's with the same names. Other clouds and credentials are kept.
+`)
+	s.database.CheckCall(c, 4, "RestoreFromDump", "dump-directory", core.RestoreOptions{
+		LogFile:    "restore.log",
+		CloudsOnly: true,
+	})
+	s.database.CheckCall(c, 5, "CopyClouds")
+}
+
+func (s *restoreSuite) TestRestoreSettingsOnly(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.database.SettingsChanged = []string{"audit-log-max-backups", "max-debug-log-duration"}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--settings-only")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	stdout := cmdtesting.Stdout(ctx)
+	c.Assert(stdout, jc.Contains, `
+Only the controller settings will be restored. Settings fixed when the
+controller was created (its name, UUID, CA certificate and ports) are kept.
+`)
+	c.Assert(stdout, jc.Contains, `
+    Collections restored: 2 (5 documents)
+    Controller settings restored: audit-log-max-backups, max-debug-log-duration
+    Restore log: restore.log
+`)
+	s.database.CheckCall(c, 4, "RestoreFromDump", "dump-directory", core.RestoreOptions{
+		LogFile:      "restore.log",
+		SettingsOnly: true,
+	})
+	s.database.CheckCall(c, 5, "CopySettings")
+}
+
+func (s *restoreSuite) TestRestorePerCollection(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--per-collection", "--collection-retries", "5", "--completed-file", "done.json")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "Restoring a collection at a time, recording the collections restored in done.json.\n")
+	s.database.CheckCall(c, 4, "RestoreFromDump", "dump-directory", core.RestoreOptions{
+		LogFile:           "restore.log",
+		PerCollection:     true,
+		CollectionRetries: 5,
+		CompletedFile:     "done.json",
+	})
+}
+
+func (s *restoreSuite) TestRestorePerCollectionFails(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.database.SetErrors(nil, errors.New("restoring juju.txns: running mongorestore: exit status 1"))
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--per-collection")
+	c.Assert(err, gc.ErrorMatches, `restoring dump from "dump-directory": restoring juju.txns: .*`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Not every collection could be restored. The ones that were are recorded
+in restore-completed.json - run the restore again with --per-collection and the
+same --completed-file to restore only the rest.
+`)
+}
+
+func (s *restoreSuite) TestRestoreProceedYes(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		return node
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+Checking database and replica set health...
+
+Replica set is healthy     ✓
+Running on primary HA node ✓
+
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   active  active
+
+Stopping Juju agents...
+    one-node ✓
+
+Running restore...
+Detailed mongorestore output in restore.log.
+
+Database restore complete.
+Starting Juju agents...
+    one-node ✓
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        one-node stop agents ✓
+        one-node start agents ✓
+    Collections restored: 2 (5 documents)
+    Juju version changed: 2.9.37.2 → 2.9.37
+    Restore log: restore.log
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreIncrementals(c *gc.C) {
+	base := s.backup.MetadataF
+	endOf := func(hour int) core.OplogPosition {
+		return core.NewOplogPosition(time.Date(2020, 3, 17, hour, 0, 0, 0, time.UTC), 1)
+	}
+	s.backup.MetadataF = func() (core.BackupMetadata, error) {
+		metadata, err := base()
+		metadata.ID = "full"
+		metadata.OplogEnd = endOf(16)
+		return metadata, err
+	}
+	var opened []string
+	s.openF = func(path, _ string, _ func(int64) error) (core.BackupFile, error) {
+		opened = append(opened, path)
+		if path == "backup.file" {
+			return s.backup, nil
+		}
+		return &coretesting.BackupFile{
+			MetadataF: func() (core.BackupMetadata, error) {
+				metadata, err := base()
+				metadata.ID = path
+				metadata.ParentID = "full"
+				metadata.OplogStart = endOf(16)
+				metadata.OplogEnd = endOf(18)
+				return metadata, err
+			},
+			DumpDirectoryF: func() string {
+				return path + "-dump"
+			},
+		}, nil
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "--incremental", "inc.file", "--until", "2020-03-17T17:30:00Z", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(opened, jc.DeepEquals, []string{"backup.file", "inc.file"})
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+    Incrementals: 1, restoring to 2020-03-17 17:30:00 +0000 UTC
+`)
+	limit := core.NewOplogPosition(time.Date(2020, 3, 17, 17, 30, 1, 0, time.UTC), 0)
+	var replayed []string
+	for _, call := range s.database.Calls() {
+		if call.FuncName == "ReplayOplog" {
+			c.Assert(call.Args[2], gc.Equals, limit)
+			replayed = append(replayed, call.Args[0].(string))
+		}
+	}
+	c.Assert(replayed, jc.DeepEquals, []string{"dump-directory/oplog.bson", "inc.file-dump/oplog.bson"})
+}
+
+func (s *restoreSuite) TestRestoreChecksSnapDumpSpaceBeforeExtracting(c *gc.C) {
+	s.openF = func(path, _ string, checkDump func(int64) error) (core.BackupFile, error) {
+		c.Assert(checkDump, gc.NotNil)
+		return nil, errors.New("not enough space to copy the dump")
+	}
+	_, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `unpacking backup file "backup.file" under ".*": not enough space to copy the dump`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.database.CheckCallNames(c, "Close")
+}
+
+func (s *restoreSuite) TestRestoreShowsControllerMachine(c *gc.C) {
+	base := s.backup.MetadataF
+	s.backup.MetadataF = func() (core.BackupMetadata, error) {
+		metadata, err := base()
+		metadata.ControllerMachineID = "2"
+		metadata.ControllerMachineInstanceID = "juju-b23b53-2"
+		return metadata, err
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Machine:      2 (juju-b23b53-2)
+    Juju version: 2.9.37
+`)
+}
+
+func (s *restoreSuite) TestRestoreShowsOplog(c *gc.C) {
+	base := s.backup.MetadataF
+	s.backup.MetadataF = func() (core.BackupMetadata, error) {
+		metadata, err := base()
+		metadata.Oplog = core.DumpOplog{
+			Present: true,
+			Entries: 12,
+			First:   core.NewOplogPosition(time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC), 1),
+			Last:    core.NewOplogPosition(time.Date(2020, 3, 17, 16, 29, 2, 0, time.UTC), 4),
+		}
+		return metadata, err
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Models:       3
+    Oplog:        12 entries, 2020-03-17 16:28:24 +0000 UTC to 2020-03-17 16:29:02 +0000 UTC
+`)
+}
+
+func (s *restoreSuite) setupDumpSizes() {
+	base := s.backup.MetadataF
+	s.backup.MetadataF = func() (core.BackupMetadata, error) {
+		metadata, err := base()
+		metadata.Databases = []core.DatabaseSize{{
+			Name:  "juju",
+			Bytes: 12 << 30,
+			Collections: map[string]int64{
+				"models":          8 << 30,
+				"statuseshistory": 4 << 30,
+			},
+		}, {
+			Name:        "logs",
+			Bytes:       3 << 20,
+			Collections: map[string]int64{"logs.how-bizarre": 3 << 20},
+		}}
+		return metadata, err
+	}
+}
+
+func (s *restoreSuite) TestRestoreShowsDumpSizes(c *gc.C) {
+	s.setupDumpSizes()
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Dump size: 12.0GiB
+    DATABASE  SIZE     LARGEST COLLECTION
+    juju      12.0GiB  models (8.0GiB)
+    logs      3.0MiB   logs.how-bizarre (3.0MiB)
+`)
+	// Without status history the restored databases fit.
+	c.Assert(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "free disk space")
+}
+
+func (s *restoreSuite) TestRestoreWarnsAboutFreeSpace(c *gc.C) {
+	s.setupDumpSizes()
+	ctx, err := s.runCmd(c, "", "--yes", "--include-status-history", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Warning: these controller machines may not have enough free disk space
+for the restored databases (about 12.0GiB):
+    machine 2 (one-node) has 10.0GiB free
+`)
+}
+
+func (s *restoreSuite) TestRestoreChecksNodeIdentity(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.NodeStatus.MachineTag = "machine-7"
+		return node
+	}
+	_, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `controller nodes aren't the machines the replica set names \(stale members with reused addresses\?\): one-node is machine-7, not machine-2`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.database.CheckCallNames(c, "ReplicaSet", "ActiveOperations", "ControllerInfo", "Close")
+}
+
+func (s *restoreSuite) TestRestoreReportsAgentLogProblems(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.Log = "ERROR juju.worker.apicaller invalid entity name or password\n"
+		return node
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Warning: the agent logs on these controller machines show problems:
+    one-node: bad password
+        ERROR juju.worker.apicaller invalid entity name or password
+`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Warnings:\n        agent log on one-node shows bad password\n")
+}
+
+func (s *restoreSuite) TestRestoreBlockedByActiveOperations(c *gc.C) {
+	s.database.Active = core.ActiveOperations{
+		Migrations:           []string{"bob/foo (exporting)"},
+		ProvisioningMachines: 2,
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `the controller is running model migrations \(bob/foo \(exporting\)\)`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Warning: the controller is busy, and changes made while the database is
+being restored can leave it inconsistent:
+    model migration: bob/foo (exporting)
+    machines being provisioned: 2
+Wait for them to finish, or pass --allow-active-operations to go ahead anyway.
+`)
+	s.database.CheckCallNames(c, "ReplicaSet", "ActiveOperations", "ControllerInfo", "Close")
+}
+
+func (s *restoreSuite) TestRestoreAllowActiveOperations(c *gc.C) {
+	s.database.Active = core.ActiveOperations{Backups: 1}
+	ctx, err := s.runCmd(c, "", "--yes", "--allow-active-operations", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Warning: the controller is busy, and changes made while the database is
+being restored can leave it inconsistent:
+    database backups running: 1
+`)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "--allow-active-operations")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Warnings:\n        1 database backups running\n")
+	findCall(c, s.database.Calls(), "RestoreFromDump")
+}
+
+func (s *restoreSuite) TestRestoreIncludeLogs(c *gc.C) {
+	ctx, err := s.runCmd(c, "", "--yes", "--include-logs", "--logs-max-age", "72h", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	s.database.CheckCall(c, 4, "RestoreFromDump", "dump-directory", core.RestoreOptions{
+		LogFile:     "restore.log",
+		IncludeLogs: true,
+		LogsMaxAge:  72 * time.Hour,
+	})
+	s.database.CheckCallNames(c, "ReplicaSet", "ActiveOperations", "ControllerInfo", "ControllerInfo", "RestoreFromDump", "TrimLogs", "ReplicaSet", "Close")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "\nRemoved 0 log entries older than 72h0m0s before the backup.")
+}
+
+func (s *restoreSuite) setupInferredMetadata() {
+	base := s.backup.MetadataF
+	s.backup.MetadataF = func() (core.BackupMetadata, error) {
+		metadata, err := base()
+		metadata.Inferred = true
+		return metadata, err
+	}
+}
+
+func (s *restoreSuite) TestInferredMetadataConfirmed(c *gc.C) {
+	s.setupInferredMetadata()
+	ctx, err := s.runCmd(c, "y\ny\n", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+    Metadata:     inferred from the database dump
+`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "Check they're what you expect before restoring.\n\nUse the inferred metadata? (y/N): ")
+	s.database.CheckCallNames(c, "ReplicaSet", "ActiveOperations", "ControllerInfo", "ControllerInfo", "RestoreFromDump", "ReplicaSet", "Close")
+}
+
+func (s *restoreSuite) TestInferredMetadataDeclined(c *gc.C) {
+	s.setupInferredMetadata()
+	_, err := s.runCmd(c, "n\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, ".*restore operation: aborted")
+	s.database.CheckCallNames(c, "ReplicaSet", "ActiveOperations", "ControllerInfo", "Close")
+}
+
+func (s *restoreSuite) TestInferredMetadataNeedsExplicitAccept(c *gc.C) {
+	s.setupInferredMetadata()
+	_, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, ".*backup has no metadata.json - pass --accept-inferred-metadata .*")
+
+	ctx, err := s.runCmd(c, "", "--yes", "--accept-inferred-metadata", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "Use the inferred metadata?")
+}
+
+// writeHook writes an executable hook script into dir.
+func writeHook(c *gc.C, dir, name, script string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *restoreSuite) TestRestoreHooks(c *gc.C) {
+	hookDir := c.MkDir()
+	logPath := filepath.Join(c.MkDir(), "hooks.log")
+	for _, point := range []string{"pre-precheck", "post-stop-agents", "pre-restore", "post-restore", "post-start-agents"} {
+		writeHook(c, hookDir, point, `echo "$JUJU_RESTORE_HOOK ha=$JUJU_RESTORE_HA" >> `+logPath+"\n")
+	}
+	// Only executables are run.
+	err := ioutil.WriteFile(filepath.Join(hookDir, "pre-restore-notes"), []byte("not a script"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	writeHook(c, hookDir, "pre-restore-notify", `echo "$JUJU_RESTORE_HOOK notify" >> `+logPath+"\n")
+
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file", "--hook-dir", hookDir)
+	c.Assert(err, jc.ErrorIsNil)
+	data, err := ioutil.ReadFile(logPath)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals, `
+pre-precheck ha=false
+post-stop-agents ha=false
+pre-restore ha=false
+pre-restore notify
+post-restore ha=false
+post-start-agents ha=false
+`[1:])
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Running pre-restore hook pre-restore-notify...
+
+Running restore...
+`)
+}
+
+func (s *restoreSuite) TestRestoreHookFailures(c *gc.C) {
+	hookDir := c.MkDir()
+	writeHook(c, hookDir, "post-restore", "echo oops\nexit 1\n")
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file", "--hook-dir", hookDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Running post-restore hook post-restore...
+Warning: post-restore hook post-restore failed: exit status 1: oops
+`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Warnings:
+        post-restore hook post-restore failed: exit status 1: oops
+`)
+
+	writeHook(c, hookDir, "pre-precheck", "echo not now\nexit 2\n")
+	_, err = s.runCmd(c, "", "--yes", "backup.file", "--hook-dir", hookDir)
+	c.Assert(err, gc.ErrorMatches, "pre-precheck hook pre-precheck: exit status 2: not now")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+}
+
+func (s *restoreSuite) TestRestoreEventSocket(c *gc.C) {
+	socketPath := filepath.Join(c.MkDir(), "events.sock")
+	lines := make(chan []string, 1)
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.AgentF = func() {
+			if node.Stub.Calls()[len(node.Stub.Calls())-1].FuncName != "StopAgent" {
+				return
+			}
+			// Connect part way through - events so far are replayed.
+			conn, err := net.Dial("unix", socketPath)
+			c.Assert(err, jc.ErrorIsNil)
+			// Wait for the replay so the client is registered.
+			scanner := bufio.NewScanner(conn)
+			c.Assert(scanner.Scan(), jc.IsTrue)
+			read := []string{scanner.Text()}
+			go func() {
+				defer conn.Close()
+				for scanner.Scan() {
+					read = append(read, scanner.Text())
+				}
+				lines <- read
+			}()
+		}
+		return node
+	}
+	_, err := s.runCmd(c, "", "--yes", "backup.file", "--event-socket", socketPath)
+	c.Assert(err, jc.ErrorIsNil)
+
+	var read []string
+	select {
+	case read = <-lines:
+	case <-time.After(testing.LongWait):
+		c.Fatalf("timed out waiting for events")
+	}
+	var summary []string
+	for _, line := range read {
+		var event struct {
+			Type     string `json:"type"`
+			Phase    string `json:"phase"`
+			Node     string `json:"node"`
+			Progress int    `json:"progress"`
+		}
+		c.Assert(json.Unmarshal([]byte(line), &event), jc.ErrorIsNil)
+		summary = append(summary, fmt.Sprintf("%s %s %s %d", event.Type, event.Phase, event.Node, event.Progress))
+	}
+	c.Check(summary, jc.DeepEquals, []string{
+		"phase-started pre-checks  0",
+		"phase-finished pre-checks  25",
+		"phase-started stop agents  25",
+		"change stop agents one-node 25",
+		"node stop agents one-node 25",
+		"phase-finished stop agents  50",
+		"phase-started restore  50",
+		"change restore juju.machines 50",
+		"change restore juju.models 50",
+		"change restore one-node 50",
+		"phase-finished restore  75",
+		"phase-started start agents  75",
+		"change start agents one-node 75",
+		"node start agents one-node 75",
+		"phase-finished start agents  100",
+		"finished   100",
+	})
+	_, err = os.Stat(socketPath)
+	c.Assert(err, jc.Satisfies, os.IsNotExist)
+}
+
+func (s *restoreSuite) TestRestoreReport(c *gc.C) {
+	s.setupInferredMachineID()
+	reportPath := filepath.Join(c.MkDir(), "report.json")
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file", "--report", reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Warnings:
+        replica set member one-node has no juju-machine-id tag
+    Restore log: restore.log
+Report written to `+reportPath+`.
+`)
+
+	data, err := ioutil.ReadFile(reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	var report struct {
+		Phases []struct {
+			Name  string `json:"name"`
+			Error string `json:"error"`
+		} `json:"phases"`
+		Nodes   []map[string]string `json:"nodes"`
+		Changes []struct {
+			Phase  string `json:"phase"`
+			Target string `json:"target"`
+			Action string `json:"action"`
+			Error  string `json:"error"`
+		} `json:"changes"`
+		Collections   []core.RestoredCollection `json:"collections"`
+		VersionChange map[string]string         `json:"version-change"`
+		Warnings      []string                  `json:"warnings"`
+		RestoreLog    string                    `json:"restore-log"`
+	}
+	c.Assert(json.Unmarshal(data, &report), jc.ErrorIsNil)
+	var phases []string
+	for _, phase := range report.Phases {
+		c.Check(phase.Error, gc.Equals, "")
+		phases = append(phases, phase.Name)
+	}
+	c.Assert(phases, jc.DeepEquals, []string{"pre-checks", "stop agents", "restore", "start agents"})
+	c.Assert(report.Nodes, jc.DeepEquals, []map[string]string{
+		{"node": "one-node", "operation": "stop agents"},
+		{"node": "one-node", "operation": "start agents"},
+	})
+	var changes []string
+	for _, change := range report.Changes {
+		c.Check(change.Error, gc.Equals, "")
+		changes = append(changes, fmt.Sprintf("%s: %s: %s", change.Phase, change.Target, change.Action))
+	}
+	c.Assert(changes, jc.DeepEquals, []string{
+		"stop agents: one-node: stopped machine-agent",
+		"restore: juju.machines: replaced with 3 documents",
+		"restore: juju.models: replaced with 2 documents",
+		"restore: one-node: updated agent version to 2.9.37",
+		"start agents: one-node: started machine-agent",
+	})
+	c.Assert(report.Collections, jc.DeepEquals, []core.RestoredCollection{
+		{Name: "juju.machines", Documents: 3},
+		{Name: "juju.models", Documents: 2},
+	})
+	c.Assert(report.VersionChange, jc.DeepEquals, map[string]string{"from": "2.9.37.2", "to": "2.9.37"})
+	c.Assert(report.Warnings, jc.DeepEquals, []string{"replica set member one-node has no juju-machine-id tag"})
+	c.Assert(report.RestoreLog, gc.Equals, "restore.log")
+}
+
+func (s *restoreSuite) TestRestoreRecordsHistory(c *gc.C) {
+	base := s.backup.MetadataF
+	s.backup.MetadataF = func() (core.BackupMetadata, error) {
+		metadata, err := base()
+		metadata.ID = "20200317-162824.how-bizarre"
+		return metadata, err
+	}
+	_, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	s.database.SetErrors(nil, errors.New("restore exploded"))
+	_, err = s.runCmd(c, "", "--yes", "--dry-run", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, ".*restore exploded")
+
+	entries, err := cmd.ReadHistory(s.historyFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 3)
+	var phases []string
+	for _, phase := range entries[0].Phases {
+		phases = append(phases, phase.Name)
+	}
+	c.Assert(phases, jc.DeepEquals, []string{"pre-checks", "stop agents", "restore", "start agents"})
+	c.Assert(entries[0].Mode, gc.Equals, "restore")
+	c.Assert(entries[0].Source, gc.Equals, "backup.file")
+	c.Assert(entries[0].BackupID, gc.Equals, "20200317-162824.how-bizarre")
+	c.Assert(entries[0].Documents, gc.Equals, 5)
+	c.Assert(entries[0].Outcome, gc.Equals, "succeeded")
+	c.Assert(entries[0].Finished.Before(entries[0].Started), jc.IsFalse)
+	c.Assert(entries[1].DryRun, jc.IsTrue)
+	c.Assert(entries[2].Outcome, gc.Equals, "failed")
+	c.Assert(entries[2].Error, gc.Matches, ".*restore exploded")
+}
+
+func (s *restoreSuite) TestRestoreHistoryDisabled(c *gc.C) {
+	_, err := s.runCmd(c, "", "--yes", "--history-file", "", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = os.Stat(s.historyFile)
+	c.Assert(os.IsNotExist(err), jc.IsTrue)
+}
+
+func (s *restoreSuite) TestRestoreInjectedRestoreFailure(c *gc.C) {
+	s.PatchEnvironment("JUJU_RESTORE_INJECT_FAULTS", "restore")
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `restoring dump from "dump-directory": injected restore failure \(JUJU_RESTORE_INJECT_FAULTS\)`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasPrefix, `
+Connecting to database...
+
+Warning: failures injected with $JUJU_RESTORE_INJECT_FAULTS: restore.
+`[1:])
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "    Warnings:\n        failures injected with $JUJU_RESTORE_INJECT_FAULTS: restore\n")
+	for _, call := range s.database.Calls() {
+		c.Check(call.FuncName, gc.Not(gc.Equals), "RestoreFromDump")
+	}
+}
+
+func (s *restoreSuite) TestRestoreInjectedNodeFailure(c *gc.C) {
+	var nodes []*coretesting.ControllerNode
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		nodes = append(nodes, node)
+		return node
+	}
+	s.PatchEnvironment("JUJU_RESTORE_INJECT_FAULTS", "stop-agent:one-node,start-agent:other-node")
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, ".*could not manipulate all necessary agents.*")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "one-node stop agents ✗ error: injected stop-agent failure (JUJU_RESTORE_INJECT_FAULTS)\n")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "Warning: failures injected with $JUJU_RESTORE_INJECT_FAULTS: stop-agent on one-node, start-agent on other-node.\n")
+	for _, node := range nodes {
+		for _, call := range node.Calls() {
+			c.Check(call.FuncName, gc.Not(gc.Equals), "StopAgent")
+		}
+	}
+}
+
+func (s *restoreSuite) TestRestoreInjectedFaultsInvalid(c *gc.C) {
+	s.PatchEnvironment("JUJU_RESTORE_INJECT_FAULTS", "stop-agent,explode")
+	_, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `reading \$JUJU_RESTORE_INJECT_FAULTS: unknown fault "explode" \(expected stop-agent, start-agent, restart-database, update-version or restore\)`)
+	s.PatchEnvironment("JUJU_RESTORE_INJECT_FAULTS", "restore:one-node")
+	_, err = s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `reading \$JUJU_RESTORE_INJECT_FAULTS: restore fault can't be limited to a node`)
+}
+
+// writeApproval writes a backup file and an approval of it signed by
+// approvedBy, returning their paths and an allowed signers file
+// trusting the key it was signed with.
+func (s *restoreSuite) writeApproval(c *gc.C, approvedBy string) (string, string, string) {
+	keyFile, allowedSigners := newSigningKey(c, s, approvedBy)
+	backupFile := writeBackupFile(c)
+	approvedAt := time.Now().UTC().Round(time.Second)
+	approval := cmd.Approval{
+		Backup:       backupFile,
+		BackupSHA256: backupChecksum,
+		ApprovedBy:   approvedBy,
+		ApprovedAt:   approvedAt,
+		Expires:      approvedAt.Add(time.Hour),
+		Note:         "CHG-1234",
+	}
+	approval, err := approval.Sign(keyFile)
+	c.Assert(err, jc.ErrorIsNil)
+	approvalFile := filepath.Join(c.MkDir(), "approval.yaml")
+	c.Assert(approval.Write(approvalFile), jc.ErrorIsNil)
+	return backupFile, approvalFile, allowedSigners
+}
+
+func (s *restoreSuite) TestRestoreApproved(c *gc.C) {
+	backupFile, approvalFile, approvers := s.writeApproval(c, "someone-else")
+	reportPath := filepath.Join(c.MkDir(), "restore.md")
+	ctx, err := s.runCmd(c, "", "--yes", "--approval", approvalFile, "--approvers", approvers, "--ticket-report", reportPath, backupFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Matches, `(?s).*
+Restore approved by someone-else at .* \(CHG-1234\), valid until [^\n]*\.
+
+Stopping Juju agents.*`)
+	findCall(c, s.database.Calls(), "RestoreFromDump")
+	data, err := ioutil.ReadFile(reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), jc.Contains, "- approval: yes (someone-else (approval file))\n- proceed: yes (--yes)\n")
+}
+
+func (s *restoreSuite) TestRestoreApprovalFromSameUser(c *gc.C) {
+	current, err := user.Current()
+	c.Assert(err, jc.ErrorIsNil)
+	backupFile, approvalFile, approvers := s.writeApproval(c, current.Username)
+	_, err = s.runCmd(c, "", "--yes", "--approval", approvalFile, "--approvers", approvers, backupFile)
+	c.Assert(err, gc.ErrorMatches, "approval was given by .*, who is running the restore - it has to come from someone else")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.assertNotRestored(c)
+}
+
+func (s *restoreSuite) TestRestoreApprovalForAnotherBackup(c *gc.C) {
+	_, approvalFile, approvers := s.writeApproval(c, "someone-else")
+	otherBackup := filepath.Join(c.MkDir(), "other.tar.gz")
+	c.Assert(ioutil.WriteFile(otherBackup, []byte("other contents"), 0600), jc.ErrorIsNil)
+	_, err := s.runCmd(c, "", "--yes", "--approval", approvalFile, "--approvers", approvers, otherBackup)
+	c.Assert(err, gc.ErrorMatches, `approval is for a different backup .*`)
+}
+
+func (s *restoreSuite) TestRestoreApprovalEdited(c *gc.C) {
+	// The operator running the restore can't take an approval they
+	// gave themselves and change who it's from.
+	current, err := user.Current()
+	c.Assert(err, jc.ErrorIsNil)
+	backupFile, approvalFile, approvers := s.writeApproval(c, current.Username)
+	approval, err := cmd.ReadApproval(approvalFile)
+	c.Assert(err, jc.ErrorIsNil)
+	approval.ApprovedBy = "someone-else"
+	c.Assert(approval.Write(approvalFile), jc.ErrorIsNil)
+	_, err = s.runCmd(c, "", "--yes", "--approval", approvalFile, "--approvers", approvers, backupFile)
+	c.Assert(err, gc.ErrorMatches, "approval signature isn't from a key of someone-else's in .*")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.assertNotRestored(c)
+}
+
+func (s *restoreSuite) assertNotRestored(c *gc.C) {
+	for _, call := range s.database.Calls() {
+		c.Check(call.FuncName, gc.Not(gc.Equals), "RestoreFromDump")
+	}
+}
+
+func (s *restoreSuite) TestRestoreApprovalRequiredByPolicy(c *gc.C) {
+	backupFile, approvalFile, approvers := s.writeApproval(c, "someone-else")
+	s.PatchValue(cmd.ApprovalPolicyFile, approvers)
+
+	_, err := s.runCmd(c, "", "--yes", backupFile)
+	c.Assert(err, gc.ErrorMatches, "restores need an approval from another operator \\(required by "+approvers+"\\) - pass --approval with one written by juju-restore approve")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.assertNotRestored(c)
+
+	// The operator can't trust their own keys instead.
+	otherApprovers := filepath.Join(c.MkDir(), "allowed_signers")
+	c.Assert(ioutil.WriteFile(otherApprovers, nil, 0644), jc.ErrorIsNil)
+	_, err = s.runCmd(c, "", "--yes", "--approval", approvalFile, "--approvers", otherApprovers, backupFile)
+	c.Assert(err, gc.ErrorMatches, "approvals are required by "+approvers+", so --approvers can't be another file")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.assertNotRestored(c)
+
+	// The policy file is the default --approvers.
+	_, err = s.runCmd(c, "", "--yes", "--approval", approvalFile, backupFile)
+	c.Assert(err, jc.ErrorIsNil)
+	findCall(c, s.database.Calls(), "RestoreFromDump")
+}
+
+func (s *restoreSuite) TestRestoreRequireApproval(c *gc.C) {
+	_, err := s.runCmd(c, "", "--yes", "--require-approval", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restores need an approval from another operator \\(required by --require-approval\\) - .*")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	s.assertNotRestored(c)
+}
+
+func (s *restoreSuite) TestRestoreApprovalRequiredCopyFrom(c *gc.C) {
+	s.PatchValue(cmd.ApprovalPolicyFile, s.historyFile)
+	c.Assert(ioutil.WriteFile(s.historyFile, nil, 0644), jc.ErrorIsNil)
+	source := &coretesting.Database{
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{JujuVersion: version.MustParse("2.9.37")}, nil
+		},
+	}
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		if info.Hostname == "old-controller" {
+			return source, nil
+		}
+		return s.database, nil
+	}
+	_, err := s.runCmd(c, "", "--yes", "--copy-controller", "--copy-from", "old-controller", "--source-username", "machine-0", "--source-password", "sabbath")
+	c.Assert(err, gc.ErrorMatches, "restores need an approval \\(required by .*\\), and --copy-from restores can't be approved - restore from a backup file instead")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	for _, call := range s.database.Calls() {
+		c.Check(call.FuncName, gc.Not(gc.Equals), "CopyController")
+	}
+}
+
+// presetCommand is a restore command with some flags set before
+// its arguments are parsed, as runCmd passes them.
+type presetCommand struct {
+	corecmd.Command
+	flags map[string]string
+}
+
+func (p presetCommand) SetFlags(f *gnuflag.FlagSet) {
+	p.Command.SetFlags(f)
+	for name, value := range p.flags {
+		_ = f.Set(name, value)
+	}
+}
+
+func (s *restoreSuite) TestServeApprovalRequired(c *gc.C) {
+	backupFile, approvalFile, approvers := s.writeApproval(c, "someone-else")
+	s.PatchValue(cmd.ApprovalPolicyFile, approvers)
+	service := cmd.NewRestoreService(func() corecmd.Command {
+		return presetCommand{
+			Command: cmd.NewRestoreCommand(s.connectF, s.openF, s.nodeFactory, s.loadCreds, s.detectController, s.devMode),
+			flags: map[string]string{
+				"history-file": s.historyFile,
+				"username":     "admin",
+				"password":     "secret",
+			},
+		}
+	}, "sekrit")
+	server := httptest.NewServer(service)
+	defer server.Close()
+	post := func(body string) {
+		req, err := http.NewRequest("POST", server.URL+"/restore", strings.NewReader(body))
+		c.Assert(err, jc.ErrorIsNil)
+		req.Header.Set("Authorization", "Bearer sekrit")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, jc.ErrorIsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusAccepted)
+		service.Wait()
+	}
+
+	post(fmt.Sprintf(`{"backup-file": %q}`, backupFile))
+	status := service.Status()
+	c.Assert(status.State, gc.Equals, cmd.RestoreFailed)
+	c.Assert(status.ExitCode, gc.Equals, cmd.ExitPrecheckFailed)
+	c.Assert(status.Error, gc.Matches, "restores need an approval from another operator .*")
+	s.assertNotRestored(c)
+
+	post(fmt.Sprintf(`{"backup-file": %q, "approval": %q}`, backupFile, approvalFile))
+	status = service.Status()
+	c.Assert(status.Error, gc.Equals, "")
+	c.Assert(status.State, gc.Equals, cmd.RestoreSucceeded)
+	findCall(c, s.database.Calls(), "RestoreFromDump")
+}
+
+func (s *restoreSuite) TestRestoreTicketReportMarkdown(c *gc.C) {
+	reportPath := filepath.Join(c.MkDir(), "restore.md")
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--ticket-report", reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, "Ticket report written to "+reportPath+".\n")
+
+	data, err := ioutil.ReadFile(reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	report := string(data)
+	c.Assert(report, jc.HasPrefix, "# juju-restore run report\n\n**Outcome:** succeeded\n")
+	c.Assert(report, gc.Matches, `(?s).*\| pre-checks \| ok \| [-0-9: ]+ UTC \| 0s \|\n.*`)
+	c.Assert(report, jc.Contains, `
+## Decisions
+
+- proceed: yes (operator)
+`)
+	c.Assert(report, jc.Contains, "| one-node | stop agents | ok |\n")
+	c.Assert(report, jc.Contains, "| restore | juju.models | replaced with 2 documents | ok |\n")
+	c.Assert(report, jc.Contains, "- Collections restored: 2 (5 documents)\n")
+	c.Assert(report, jc.Contains, `
+## Final health
+
+| Member | Machine | State | Healthy |
+|--------|---------|-------|---------|
+| one-node | 2 | PRIMARY | yes |
+`)
+}
+
+func (s *restoreSuite) TestRestoreTicketReportHTML(c *gc.C) {
+	reportPath := filepath.Join(c.MkDir(), "restore.html")
+	s.database.SetErrors(nil, errors.New("disk <full>"))
+	_, err := s.runCmd(c, "", "--yes", "backup.file", "--ticket-report", reportPath)
+	c.Assert(err, gc.ErrorMatches, ".*disk <full>")
+
+	data, err := ioutil.ReadFile(reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	report := string(data)
+	c.Assert(report, jc.HasPrefix, "<!DOCTYPE html>\n")
+	c.Assert(report, jc.Contains, "disk &lt;full&gt;</p>\n")
+	c.Assert(report, jc.Contains, "<li>proceed: yes (--yes)</li>\n")
+	c.Assert(report, jc.Contains, "<tr><td>one-node</td><td>stop agents</td><td>ok</td></tr>\n")
+}
+
+func (s *restoreSuite) TestRestoreQuiet(c *gc.C) {
+	ctx, err := s.runCmd(c, "", "--yes", "--quiet", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        one-node stop agents ✓
+        one-node start agents ✓
+    Collections restored: 2 (5 documents)
+    Juju version changed: 2.9.37.2 → 2.9.37
+    Restore log: restore.log
+`)
+}
+
+func (s *restoreSuite) TestRestoreLogDigest(c *gc.C) {
+	s.database.LogDigest = core.RestoreLogDigest{
+		Warnings: 3,
+		Errors:   1,
+		Lines: []core.RestoreLogLine{
+			{Level: core.RestoreLogWarning, Text: "continuing through error: E11000 duplicate key error", Count: 3},
+			{Level: core.RestoreLogError, Text: "finished restoring juju.txns (10 documents, 1 failure)", Count: 1},
+		},
+	}
+	reportPath := filepath.Join(c.MkDir(), "report.json")
+	ctx, err := s.runCmd(c, "", "--yes", "--quiet", "--report", reportPath, "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    Collections restored: 2 (5 documents)
+    Juju version changed: 2.9.37.2 → 2.9.37
+    Restore log notes: 3 warnings, 1 errors
+        warning: continuing through error: E11000 duplicate key error (×3)
+        error: finished restoring juju.txns (10 documents, 1 failure)
+    Restore log: restore.log
+`)
+	data, err := ioutil.ReadFile(reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	var report struct {
+		LogDigest core.RestoreLogDigest `json:"restore-log-digest"`
+	}
+	c.Assert(json.Unmarshal(data, &report), jc.ErrorIsNil)
+	c.Assert(report.LogDigest, jc.DeepEquals, s.database.LogDigest)
+}
+
+func (s *restoreSuite) TestRecordAndReplayAnswers(c *gc.C) {
+	s.setupHA()
+	answersPath := filepath.Join(c.MkDir(), "answers.yaml")
+	_, err := s.runCmd(c, "y\n\n", "backup.file", "--record-answers", answersPath)
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	answers, err := cmd.ReadAnswers(answersPath)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(answers, gc.DeepEquals, cmd.Answers{"manage-agents": true, "proceed": false})
+
+	ctx, err := s.runCmd(c, "", "backup.file", "--answers", answersPath)
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Do you want 'juju-restore' to manage these agents automatically? (y/N): y (from answers file)
+`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasSuffix, "Are you sure you want to proceed? (y/N): n (from answers file)\n")
+}
+
+func (s *restoreSuite) setupHA() {
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		return core.ReplicaSet{
+			Name: "juju",
+			Members: []core.ReplicaSetMember{
+				{
+					Healthy:       true,
+					ID:            1,
+					Name:          "one:node",
+					State:         "PRIMARY",
+					Self:          true,
+					JujuMachineID: "2",
+				},
+				{
+					Healthy:       true,
+					ID:            2,
+					Name:          "two:node",
+					State:         "SECONDARY",
+					JujuMachineID: "1",
+				},
+			},
+		}, nil
+	}
+}
+
+func (s *restoreSuite) TestRestoreHADialMembers(c *gc.C) {
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		return core.ReplicaSet{
+			Name: "juju",
+			Members: []core.ReplicaSetMember{
+				{Healthy: true, ID: 1, Name: "one:37017", State: "PRIMARY", Self: true, JujuMachineID: "0"},
+				{Healthy: true, ID: 2, Name: "two:37018", State: "SECONDARY", JujuMachineID: "1"},
+				{Healthy: true, ID: 3, Name: "three:37019", State: "SECONDARY", JujuMachineID: "2"},
+				{Healthy: true, ID: 4, Name: "four:37020", State: "SECONDARY", JujuMachineID: "3"},
+			},
+		}, nil
+	}
+	// Each member reports its own state; two is RECOVERING even though
+	// the primary sees it as SECONDARY.
+	states := map[string]string{
+		"two:37018":   "RECOVERING",
+		"three:37019": "SECONDARY",
+		"four:37020":  "SECONDARY",
+	}
+	members := make(map[string]*coretesting.Database)
+	for name, state := range states {
+		name, state := name, state
+		members[name] = &coretesting.Database{
+			ReplicaSetF: func() (core.ReplicaSet, error) {
+				return core.ReplicaSet{
+					Name:    "juju",
+					Members: []core.ReplicaSetMember{{Name: name, State: state, Self: true}},
+				}, nil
+			},
+		}
+	}
+
+	// Hold each member dial until all of them have started, so they
+	// really do run at the same time.
+	var (
+		mu     sync.Mutex
+		dialed []db.DialInfo
+	)
+	var arrived sync.WaitGroup
+	arrived.Add(len(members))
+	allArrived := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(allArrived)
+	}()
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		address := net.JoinHostPort(info.Hostname, info.Port)
+		member, ok := members[address]
+		if !ok {
+			return s.database, nil
+		}
+		mu.Lock()
+		dialed = append(dialed, info)
+		mu.Unlock()
+		arrived.Done()
+		select {
+		case <-allArrived:
+		case <-time.After(testing.LongWait):
+			c.Errorf("members weren't dialled concurrently")
+		}
+		return member, nil
+	}
+	_, err := s.runCmd(c, "", "--dial-members", "--username", "admin", "--password", "secret", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "replica set members don't match the primary's status: two:37018 reports itself RECOVERING but the primary sees it as SECONDARY")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+
+	var addresses []string
+	for _, info := range dialed {
+		addresses = append(addresses, net.JoinHostPort(info.Hostname, info.Port))
+		c.Check(info.Username, gc.Equals, "admin")
+	}
+	c.Assert(addresses, jc.SameContents, []string{"two:37018", "three:37019", "four:37020"})
+	for _, member := range members {
+		member.CheckCallNames(c, "ReplicaSet", "Close")
+	}
+}
+
+func (s *restoreSuite) TestRestoreSnapDumpDir(c *gc.C) {
+	var dialed db.DialInfo
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		dialed = info
+		return s.database, nil
+	}
+	ctx, err := s.runCmd(c, "\n", "--snap-dump-dir", "staging", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialed.SnapDumpDir, gc.Equals, filepath.Join(ctx.Dir, "staging"))
+}
+
+func (s *restoreSuite) TestRestoreHAConnectionFail(c *gc.C) {
+	s.setupHA()
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.SetErrors(errors.New("kaboom"))
+		return node
+	}
+	ctx, err := s.runCmd(c, "y\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `'juju-restore' could not connect to all controller machines: controllers' agents cannot be managed`)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+Checking database and replica set health...
+
+Replica set is healthy     ✓
+Running on primary HA node ✓
+
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+This controller is in HA and to restore into it successfully, 'juju-restore' 
+needs to manage Juju and Mongo agents on secondary controller nodes.
+However on bigger systems the user might want to manage these agents manually.
 
 Do you want 'juju-restore' to manage these agents automatically? (y/N): 
 
@@ -369,7 +2158,7 @@ Checking connectivity to secondary controller machines...
 func (s *restoreSuite) TestRestoreHAConnectionOk(c *gc.C) {
 	s.setupHA()
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		return &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
+		return newFakeNode(member.Name)
 	}
 	ctx, err := s.runCmd(c, "y\n\n", "backup.file")
 	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
@@ -385,9 +2174,11 @@ Running on primary HA node ✓
 
 You are about to restore this backup:
     Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
+    Controller:   dawkins-rules
+    Model:        how-bizarre
     Juju version: 2.9.37
     Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
 
 This controller is in HA and to restore into it successfully, 'juju-restore' 
 needs to manage Juju and Mongo agents on secondary controller nodes.
@@ -399,6 +2190,11 @@ Checking connectivity to secondary controller machines...
  
     two:node ✓ 
 
+Controller nodes:
+    MACHINE  IP        ROLE       FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one:node  primary    10.0GiB  1.5GiB   active  active
+    1        two:node  secondary  10.0GiB  1.5GiB   active  active
+
 All restore pre-checks are completed.
 
 Restore cannot be cleanly aborted from here on.
@@ -406,6 +2202,50 @@ Restore cannot be cleanly aborted from here on.
 Are you sure you want to proceed? (y/N): `[1:])
 }
 
+func (s *restoreSuite) TestRestoreHAClockSkew(c *gc.C) {
+	s.setupHA()
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		if !member.Self {
+			node.CurrentTime = node.CurrentTime.Add(-time.Minute)
+		}
+		return node
+	}
+	ctx, err := s.runCmd(c, "y\n\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Matches, `(?s).*
+Warning: these controller machines' clocks differ from the primary's by
+more than 5s, which can break replica set elections and leases
+after the restore:
+    two:node -(59|1m0)(\.\d+)?m?s
+
+All restore pre-checks are completed\..*`)
+
+	ctx, err = s.runCmd(c, "y\n\n", "backup.file", "--max-clock-skew", "2m")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "Warning")
+}
+
+func (s *restoreSuite) TestRestoreHADatabaseVersions(c *gc.C) {
+	s.setupHA()
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.NodeStatus.DatabaseVersion = "4.4.18 (rev 160)"
+		if !member.Self {
+			node.NodeStatus.DatabaseVersion = "4.4.11 (rev 145)"
+		}
+		return node
+	}
+	ctx, err := s.runCmd(c, "y\n\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Warning: the controller machines run different versions of the
+database, which can cause replication problems after the restore:
+    one:node: 4.4.18 (rev 160)
+    two:node: 4.4.11 (rev 145)
+`)
+}
+
 func (s *restoreSuite) TestRestoreHAChoseManual(c *gc.C) {
 	s.setupHA()
 	ctx, err := s.runCmd(c, "\n\n", "backup.file")
@@ -422,15 +2262,21 @@ Running on primary HA node ✓
 
 You are about to restore this backup:
     Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
+    Controller:   dawkins-rules
+    Model:        how-bizarre
     Juju version: 2.9.37
     Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
 
 This controller is in HA and to restore into it successfully, 'juju-restore' 
 needs to manage Juju and Mongo agents on secondary controller nodes.
 However on bigger systems the user might want to manage these agents manually.
 
 Do you want 'juju-restore' to manage these agents automatically? (y/N): 
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one:node  primary  10.0GiB  1.5GiB   active  active
+
 All restore pre-checks are completed.
 
 Restore cannot be cleanly aborted from here on.
@@ -441,7 +2287,7 @@ Are you sure you want to proceed? (y/N): `[1:])
 func (s *restoreSuite) TestRestoreHAManualControlOption(c *gc.C) {
 	s.setupHA()
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
+		node := newFakeNode(member.Name)
 		return node
 	}
 	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--manual-agent-control")
@@ -457,159 +2303,655 @@ Running on primary HA node ✓
 
 You are about to restore this backup:
     Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+Juju agents on secondary controller machines must be stopped by this point.
+To stop the agents, login into each secondary controller and run:
+    $ sudo systemctl stop jujud-machine-*
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one:node  primary  10.0GiB  1.5GiB   active  active
+
+All restore pre-checks are completed.
+
+Restore cannot be cleanly aborted from here on.
+
+Are you sure you want to proceed? (y/N): 
+Stopping Juju agents...
+    one:node ✓
+
+Running restore...
+Detailed mongorestore output in restore.log.
+
+Database restore complete.
+Starting Juju agents...
+    one:node ✓
+Primary node may have shifted.
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        one:node stop agents ✓
+        one:node start agents ✓
+    Collections restored: 2 (5 documents)
+    Juju version changed: 2.9.37.2 → 2.9.37
+    Restore log: restore.log
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreHAYes(c *gc.C) {
+	s.setupHA()
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		return node
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+Checking database and replica set health...
+
+Replica set is healthy     ✓
+Running on primary HA node ✓
+
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
+    Juju version: 2.9.37
+    Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+
+Checking connectivity to secondary controller machines...
+ 
+    two:node ✓ 
+
+Controller nodes:
+    MACHINE  IP        ROLE       FREE     DB SIZE  JUJUD   JUJU-DB
+    2        one:node  primary    10.0GiB  1.5GiB   active  active
+    1        two:node  secondary  10.0GiB  1.5GiB   active  active
+
+Stopping Juju agents...
+    two:node ✓
+    one:node ✓
+
+Running restore...
+Detailed mongorestore output in restore.log.
+
+Database restore complete.
+Starting Juju agents...
+    one:node ✓
+    two:node ✓
+Primary node may have shifted.
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✓ 0s
+        restore ✓ 0s
+        start agents ✓ 0s
+    Nodes:
+        two:node stop agents ✓
+        one:node stop agents ✓
+        one:node start agents ✓
+        two:node start agents ✓
+    Collections restored: 2 (5 documents)
+    Juju version changed: 2.9.37.2 → 2.9.37
+    Restore log: restore.log
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreAgentStopFail(c *gc.C) {
+	s.setupHA()
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.SetErrors(errors.New("kaboom"))
+		return node
+	}
+	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--manual-agent-control")
+	c.Assert(err, gc.ErrorMatches, "'juju-restore' could not manipulate all necessary agents: controllers' agents cannot be managed")
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+Checking database and replica set health...
+
+Replica set is healthy     ✓
+Running on primary HA node ✓
+
+You are about to restore this backup:
+    Created at:   2020-03-17 16:28:24 +0000 UTC
+    Controller:   dawkins-rules
+    Model:        how-bizarre
     Juju version: 2.9.37
     Models:       3
+    Oplog:        none - the dump may not be point-in-time consistent
+
+Juju agents on secondary controller machines must be stopped by this point.
+To stop the agents, login into each secondary controller and run:
+    $ sudo systemctl stop jujud-machine-*
+
+Controller nodes:
+    MACHINE  IP        ROLE     FREE  DB SIZE  JUJUD  JUJU-DB
+    2        one:node  primary  ✗ error: kaboom
+
+All restore pre-checks are completed.
+
+Restore cannot be cleanly aborted from here on.
+
+Are you sure you want to proceed? (y/N): 
+Stopping Juju agents...
+    one:node ✗ error: kaboom
+
+Restore summary:
+    Phases:
+        pre-checks ✓ 0s
+        stop agents ✗ 0s
+    Nodes:
+        one:node stop agents ✗ error: kaboom
+    Changed before the failure:
+        one:node: stopped machine-agent ✗ error: kaboom
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreStartAgents(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		return node
+	}
+	s.devMode = true
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--rs")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+
+Starting Juju agents...
+    one-node ✓
+
+Restore summary:
+    Phases:
+        start agents ✓ 0s
+    Nodes:
+        one-node start agents ✓
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreManageServices(c *gc.C) {
+	var nodes []*coretesting.ControllerNode
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		nodes = append(nodes, node)
+		return node
+	}
+	s.devMode = true
+	_, err := s.runCmd(c, "y\n", "backup.file", "--rs", "--manage-services", "database, machine-agent")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(nodes, gc.HasLen, 2)
+	nodes[0].CheckCallNames(c, "Name", "RestartDatabase", "Name", "StartAgent", "Name")
+	nodes[1].CheckCall(c, 0, "AgentLog", 100)
+}
+
+func (s *restoreSuite) TestRestoreStartAgentsInHA(c *gc.C) {
+	s.setupHA()
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		return node
+	}
+	s.devMode = true
+	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--rs")
+	c.Assert(err, jc.ErrorIsNil)
+
+	assertLastCallIsClose(c, s.database.Calls())
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+
+Starting Juju agents...
+    one:node ✓
+    two:node ✓
+Primary node may have shifted.
+
+Restore summary:
+    Phases:
+        start agents ✓ 0s
+    Nodes:
+        one:node start agents ✓
+        two:node start agents ✓
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreStartAgentsInterrupted(c *gc.C) {
+	s.setupHA()
+	healthy := s.database.ReplicaSetF
+	calls := 0
+	s.database.ReplicaSetF = func() (core.ReplicaSet, error) {
+		calls++
+		replicaSet, err := healthy()
+		if calls == 1 {
+			return replicaSet, err
+		}
+		// The replica set never stabilises, so the operator gives up
+		// waiting.
+		if calls == 2 {
+			process, err := os.FindProcess(os.Getpid())
+			c.Assert(err, jc.ErrorIsNil)
+			c.Assert(process.Signal(os.Interrupt), jc.ErrorIsNil)
+		}
+		replicaSet.Members[1].Healthy = false
+		return replicaSet, err
+	}
+	s.devMode = true
+	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--rs")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(calls, gc.Equals, 2)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Connecting to database...
+
+Starting Juju agents...
+
+Interrupted: not waiting for the replica set to be healthy or retrying
+failed agent starts. The agents are still being started - interrupt
+again to stop juju-restore immediately. Check the replica set with
+'juju-restore controller-info' once the restore finishes.
+    one:node ✓
+    two:node ✓
+Primary node may have shifted.
+
+Restore summary:
+    Phases:
+        start agents ✓ 0s
+    Nodes:
+        one:node start agents ✓
+        two:node start agents ✓
+    Warnings:
+        waiting for the replica set and agents skipped by operator
+`[1:])
+}
+
+func (s *restoreSuite) TestRestoreLiveProgress(c *gc.C) {
+	s.setupHA()
+	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--progress", "live")
+	c.Assert(err, jc.ErrorIsNil)
+	stdout := cmdtesting.Stdout(ctx)
+	// Each table is redrawn in place as the nodes progress.
+	c.Assert(stdout, jc.Contains, `
+Checking connectivity to secondary controller machines...
+`+"\x1b[2K"+`    two:node  check connectivity  · pending
+`+"\x1b[1A\x1b[2K"+`    two:node  check connectivity  … running  0s
+`+"\x1b[1A\x1b[2K"+`    two:node  check connectivity  ✓ done  0s
+
+Controller nodes:
+`)
+	c.Assert(stdout, jc.Contains, "\x1b[2A"+`
+`[1:]+"\x1b[2K"+`    one:node  stop agents  ✓ done  0s
+`+"\x1b[2K"+`    two:node  stop agents  ✓ done  0s
+
+Running restore...
+`)
+	c.Assert(stdout, jc.Contains, "\x1b[2K    two:node  update agent version  ✓ done  0s\n")
+	c.Assert(stdout, jc.Contains, "\x1b[2K    two:node  start agents  ✓ done  0s\nPrimary node may have shifted.\n")
+	// The results aren't also shown a line at a time.
+	c.Assert(stdout, gc.Not(jc.Contains), "    one:node ✓\n")
+}
+
+func (s *restoreSuite) TestRestoreStartAgentsStaged(c *gc.C) {
+	s.setupHA()
+	var nodes []*coretesting.ControllerNode
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		nodes = append(nodes, node)
+		return node
+	}
+	s.devMode = true
+	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--rs", "--staged-start", "1m")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Starting Juju agents...
+    one:node ✓
+    two:node ✓
+`)
+	// Each node's agent is checked once it's started, and then the
+	// agent logs are read.
+	started := nodes[len(nodes)-4 : len(nodes)-2]
+	for _, node := range started {
+		node.CheckCallNames(c, "Name", "StartAgent", "Name", "Status")
+	}
+}
+
+func (s *restoreSuite) TestRestoreWaitForAgents(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return newFakeNode(member.Name)
+	}
+	s.devMode = true
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--rs", "--wait-for-agents", "5m")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Waiting up to 5m0s for agents to be active...
+All agents are active.
+`)
+}
+
+func (s *restoreSuite) TestRestoreWaitForAgentsTimeout(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := newFakeNode(member.Name)
+		node.NodeStatus.AgentState = "activating"
+		return node
+	}
+	s.devMode = true
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--rs", "--wait-for-agents", "1ms")
+	c.Assert(err, gc.ErrorMatches, "agents not active after 1ms on one-node")
+	c.Assert(err, jc.Satisfies, core.IsPostcheckError)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Not all agents are active:
+    MACHINE  IP        ROLE     FREE     DB SIZE  JUJUD       JUJU-DB
+    2        one-node  primary  10.0GiB  1.5GiB   activating  active
+`)
+}
 
-Juju agents on secondary controller machines must be stopped by this point.
-To stop the agents, login into each secondary controller and run:
-    $ sudo systemctl stop jujud-machine-*
+// startFailingNode is a controller node whose agent can't be started.
+// dryRunNode reports its agent commands to the machine config's
+// DryRun, as machine nodes do.
+type dryRunNode struct {
+	*coretesting.ControllerNode
+	report func(node, command string)
+}
 
-All restore pre-checks are completed.
+func (n *dryRunNode) StopAgent() error {
+	n.report(n.Name(), "sudo systemctl stop jujud-machine-2")
+	return nil
+}
 
-Restore cannot be cleanly aborted from here on.
+func (n *dryRunNode) StartAgent() error {
+	n.report(n.Name(), "sudo systemctl start jujud-machine-2")
+	return nil
+}
 
-Are you sure you want to proceed? (y/N): 
+func (s *restoreSuite) TestRestoreDryRun(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return &dryRunNode{newFakeNode(member.Name), s.machineConfig.DryRun}
+	}
+	ctx, err := s.runCmd(c, "", "--yes", "--dry-run", "backup.file")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.machineConfig.DryRun, gc.NotNil)
+	stdout := cmdtesting.Stdout(ctx)
+	c.Assert(stdout, jc.Contains, `
 Stopping Juju agents...
- 
-    one:node ✓ 
+    [dry run] one-node: sudo systemctl stop jujud-machine-2
+    one-node ✓
 
-Running restore...
-Detailed mongorestore output in restore.log.
+Dry run: not restoring the database from backup.file.
 
-Database restore complete.
 Starting Juju agents...
- 
-    one:node ✓ 
-Primary node may have shifted.
-`[1:])
+    [dry run] one-node: sudo systemctl start jujud-machine-2
+    one-node ✓
+`)
+	c.Assert(stdout, jc.Contains, "\nRestore summary (dry run - nothing was changed):\n")
+	for _, call := range s.database.Calls() {
+		c.Check(call.FuncName, gc.Not(gc.Equals), "RestoreFromDump")
+	}
 }
 
-func (s *restoreSuite) TestRestoreHAYes(c *gc.C) {
-	s.setupHA()
+func (s *restoreSuite) TestRestoreDryRunCopyControllerPermissions(c *gc.C) {
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
-		return node
+		return &dryRunNode{newFakeNode(member.Name), s.machineConfig.DryRun}
 	}
-	ctx, err := s.runCmd(c, "", "--yes", "backup.file")
+	s.database.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{
+			ControllerUUID:      "sunny-day-real",
+			ControllerModelUUID: "kiss-me",
+			JujuVersion:         version.MustParse("2.9.37"),
+			HANodes:             1,
+		}, nil
+	}
+	s.backup.BackupPermissions = []core.PermissionDoc{
+		{ID: "c#dawkins-rules#us#bob", ObjectGlobalKey: "c#dawkins-rules"},
+		{ID: "e#old-model#us#admin", ObjectGlobalKey: "e#old-model"},
+	}
+	reportFile := filepath.Join(c.MkDir(), "report.json")
+	ctx, err := s.runCmd(c, "", "--yes", "--dry-run", "--copy-controller", "--report", reportFile, "backup.file")
 	c.Assert(err, jc.ErrorIsNil)
-	assertLastCallIsClose(c, s.database.Calls())
-	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
-	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
-Connecting to database...
-Checking database and replica set health...
-
-Replica set is healthy     ✓
-Running on primary HA node ✓
-
-You are about to restore this backup:
-    Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
-    Juju version: 2.9.37
-    Models:       3
-
+	stdout := cmdtesting.Stdout(ctx)
+	c.Assert(stdout, jc.Contains, `
+Dry run: not restoring the database from backup.file.
+
+Copying the controller would do this with its permissions:
+    c#dawkins-rules#us#bob → c#sunny-day-real#us#bob
+    e#old-model#us#admin skipped: the target's admin permissions are kept
+`)
+	c.Assert(stdout, jc.Contains, "    Permissions: 1 copied (1 rewritten for this controller), 1 skipped\n")
+	for _, call := range s.database.Calls() {
+		c.Check(call.FuncName, gc.Not(gc.Equals), "CopyController")
+	}
 
-Checking connectivity to secondary controller machines...
- 
-    two:node ✓ 
+	data, err := ioutil.ReadFile(reportFile)
+	c.Assert(err, jc.ErrorIsNil)
+	var report map[string]interface{}
+	c.Assert(json.Unmarshal(data, &report), jc.ErrorIsNil)
+	c.Assert(report["permissions"], jc.DeepEquals, []interface{}{
+		map[string]interface{}{
+			"id":                    "c#dawkins-rules#us#bob",
+			"new-id":                "c#sunny-day-real#us#bob",
+			"new-object-global-key": "c#sunny-day-real",
+		},
+		map[string]interface{}{
+			"id":      "e#old-model#us#admin",
+			"skipped": "the target's admin permissions are kept",
+		},
+	})
+}
 
-Stopping Juju agents...
- 
-    one:node ✓  
-    two:node ✓ 
+type startFailingNode struct {
+	*coretesting.ControllerNode
+}
 
-Running restore...
-Detailed mongorestore output in restore.log.
+func (n startFailingNode) StartAgent() error {
+	n.Stub.MethodCall(n, "StartAgent")
+	return errors.New("kaboom")
+}
 
-Database restore complete.
-Starting Juju agents...
- 
-    one:node ✓  
-    two:node ✓ 
-Primary node may have shifted.
-`[1:])
+func (s *restoreSuite) TestRestoreStartAgentsFailed(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return startFailingNode{newFakeNode(member.Name)}
+	}
+	stateFile := filepath.Join(c.MkDir(), "state.json")
+	ctx, err := s.runCmd(c, "y\n", "backup.file", "--start-retries", "0", "--state-file", stateFile)
+	c.Assert(err, gc.ErrorMatches, "'juju-restore' could not manipulate all necessary agents: controllers' agents cannot be managed")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+The database has been restored, but the agents on these controller
+machines aren't running:
+    one-node: kaboom
+
+To start them by hand run:
+    $ sudo systemctl start jujud-machine-2
+
+or once the problem is fixed, finish the restore with:
+    $ juju-restore --resume --state-file `+stateFile+`
+`)
+	data, err := ioutil.ReadFile(stateFile)
+	c.Assert(err, jc.ErrorIsNil)
+	var state map[string]interface{}
+	c.Assert(json.Unmarshal(data, &state), jc.ErrorIsNil)
+	c.Assert(state["backup-file"], gc.Equals, "backup.file")
+	c.Assert(state["failed-nodes"], jc.DeepEquals, map[string]interface{}{"one-node": "kaboom"})
 }
 
-func (s *restoreSuite) TestRestoreAgentStopFail(c *gc.C) {
-	s.setupHA()
+func (s *restoreSuite) TestRestoreResume(c *gc.C) {
+	var nodes []*coretesting.ControllerNode
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
-		node.SetErrors(errors.New("kaboom"))
+		node := newFakeNode(member.Name)
+		nodes = append(nodes, node)
 		return node
 	}
-	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--manual-agent-control")
-	c.Assert(err, gc.ErrorMatches, "'juju-restore' could not manipulate all necessary agents: controllers' agents cannot be managed")
-	assertLastCallIsClose(c, s.database.Calls())
-	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
-	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
-Connecting to database...
-Checking database and replica set health...
+	stateFile := filepath.Join(c.MkDir(), "state.json")
+	err := ioutil.WriteFile(stateFile, []byte(`{"backup-file": "backup.file", "failed-nodes": {"one-node": "kaboom"}}`), 0600)
+	c.Assert(err, jc.ErrorIsNil)
+	ctx, err := s.runCmd(c, "", "--resume", "--state-file", stateFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Resuming the restore of backup.file from `+stateFile+`.
 
-Replica set is healthy     ✓
-Running on primary HA node ✓
+Starting Juju agents...
+    one-node ✓
+`)
+	nodes[0].CheckCallNames(c, "Name", "StartAgent", "Name")
+	_, err = os.Stat(stateFile)
+	c.Assert(err, jc.Satisfies, os.IsNotExist)
+}
 
-You are about to restore this backup:
-    Created at:   2020-03-17 16:28:24 +0000 UTC
-    Controller:   how-bizarre
-    Juju version: 2.9.37
-    Models:       3
+func (s *restoreSuite) TestRestoreResumeNoState(c *gc.C) {
+	stateFile := filepath.Join(c.MkDir(), "state.json")
+	_, err := s.runCmd(c, "", "--resume", "--state-file", stateFile)
+	c.Assert(err, gc.ErrorMatches, "no restore to resume: .*state.json not found")
+}
 
-Juju agents on secondary controller machines must be stopped by this point.
-To stop the agents, login into each secondary controller and run:
-    $ sudo systemctl stop jujud-machine-*
+func (s *restoreSuite) TestSSHOptions(c *gc.C) {
+	confPath := filepath.Join(c.MkDir(), "nodes.yaml")
+	err := ioutil.WriteFile(confPath, []byte(sshNodeConfContents), 0644)
+	c.Assert(err, jc.ErrorIsNil)
 
-All restore pre-checks are completed.
+	_, err = s.runCmd(c, "\n", "backup.file",
+		"--ssh-user", "admin",
+		"--ssh-port", "2222",
+		"--ssh-identity-file", "/root/.ssh/id_ed25519",
+		"--ssh-option", "ConnectTimeout=10",
+		"--ssh-option", "ProxyJump=bastion",
+		"--ssh-known-hosts", "/root/.ssh/known_hosts",
+		"--ssh-attempts", "5",
+		"--command-timeout", "90s",
+		"--ssh-node-config", confPath,
+		"--sudo-command", "sudo -n",
+	)
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(s.machineConfig, gc.DeepEquals, machine.Config{
+		SSH: machine.SSHOptions{
+			User:           "admin",
+			Port:           "2222",
+			IdentityFile:   "/root/.ssh/id_ed25519",
+			KnownHostsFile: "/root/.ssh/known_hosts",
+			Options:        []string{"ConnectTimeout=10", "ProxyJump=bastion"},
+			Attempts:       5,
+		},
+		CommandTimeout: 90 * time.Second,
+		NodeSSH: map[string]machine.SSHOptions{
+			"1": {
+				User: "operator",
+				Port: "22",
+			},
+			"10.0.0.5": {
+				IdentityFile: "/root/.ssh/other",
+				Options:      []string{"ProxyJump=other-bastion"},
+			},
+		},
+		NodeLXD: map[string]machine.LXDContainer{
+			"2": {Name: "juju-abc-2", Remote: "node3"},
+		},
+		Sudo: machine.Sudo{"sudo", "-n"},
+	})
+}
 
-Restore cannot be cleanly aborted from here on.
+func (s *restoreSuite) TestSSHOptionsDefaults(c *gc.C) {
+	_, err := s.runCmd(c, "\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(s.machineConfig, gc.DeepEquals, machine.DefaultConfig())
+}
 
-Are you sure you want to proceed? (y/N): 
-Stopping Juju agents...
- 
-    one:node ✗ error: kaboom
-`[1:])
+func (s *restoreSuite) TestNoSudo(c *gc.C) {
+	_, err := s.runCmd(c, "\n", "backup.file", "--no-sudo")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(s.machineConfig.Sudo, gc.IsNil)
 }
 
-func (s *restoreSuite) TestRestoreStartAgents(c *gc.C) {
-	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
-		return node
+func (s *restoreSuite) confirmHostKeyConverter(member core.ReplicaSetMember) core.ControllerNode {
+	node := newFakeNode(member.Name)
+	if !member.Self && !s.hostKeyConfirmed {
+		// The real remote runner asks for confirmation the first
+		// time it connects to an unknown host.
+		err := s.machineConfig.ConfirmHostKey(member.Name, []string{"256 SHA256:c2Vjb25k two:node (ED25519)"})
+		s.hostKeyConfirmed = err == nil
+		node.SetErrors(err)
 	}
-	s.devMode = true
-	ctx, err := s.runCmd(c, "y\n", "backup.file", "--rs")
-	c.Assert(err, jc.ErrorIsNil)
+	return node
+}
 
-	assertLastCallIsClose(c, s.database.Calls())
-	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
-	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
-Connecting to database...
+func (s *restoreSuite) TestRestoreHAConfirmHostKey(c *gc.C) {
+	s.setupHA()
+	s.converter = s.confirmHostKeyConverter
+	ctx, err := s.runCmd(c, "y\ny\n\n", "backup.file", "--ssh-known-hosts", "known_hosts", "--ssh-confirm-host-keys")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+Checking connectivity to secondary controller machines...
 
-Starting Juju agents...
- 
-    one-node ✓ 
-`[1:])
+The authenticity of host two:node can't be established.
+Host key fingerprints:
+    256 SHA256:c2Vjb25k two:node (ED25519)
+
+Do you want to trust these keys and add them to the known hosts file? (y/N):  
+    two:node ✓ 
+`)
 }
 
-func (s *restoreSuite) TestRestoreStartAgentsInHA(c *gc.C) {
+func (s *restoreSuite) TestRestoreHAConfirmHostKeyRejected(c *gc.C) {
 	s.setupHA()
-	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{Stub: &testing.Stub{}, ip: member.Name}
-		return node
-	}
-	s.devMode = true
-	ctx, err := s.runCmd(c, "y\ny\n", "backup.file", "--rs")
+	s.converter = s.confirmHostKeyConverter
+	ctx, err := s.runCmd(c, "y\nn\n", "backup.file", "--ssh-known-hosts", "known_hosts", "--ssh-confirm-host-keys")
+	c.Assert(err, gc.ErrorMatches, `'juju-restore' could not connect to all controller machines: controllers' agents cannot be managed`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    two:node ✗ error: aborted
+`)
+}
+
+func (s *restoreSuite) TestRestoreHAConfirmHostKeyYes(c *gc.C) {
+	s.setupHA()
+	s.converter = s.confirmHostKeyConverter
+	ctx, err := s.runCmd(c, "", "--yes", "backup.file", "--ssh-known-hosts", "known_hosts", "--ssh-confirm-host-keys")
+	c.Assert(err, gc.ErrorMatches, `'juju-restore' could not connect to all controller machines: controllers' agents cannot be managed`)
+	c.Assert(cmdtesting.Stdout(ctx), jc.Contains, `
+    two:node ✗ error: unknown host two:node - add its keys to known_hosts or run without --yes to confirm them
+`)
+}
+
+func (s *restoreSuite) TestReadSSHNodeConfigInvalid(c *gc.C) {
+	confPath := filepath.Join(c.MkDir(), "nodes.yaml")
+	err := ioutil.WriteFile(confPath, []byte("\"1\":\n  username: admin\n"), 0644)
 	c.Assert(err, jc.ErrorIsNil)
 
-	assertLastCallIsClose(c, s.database.Calls())
-	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "")
-	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
-Connecting to database...
+	_, err = cmd.ReadSSHNodeConfig(confPath)
+	c.Assert(err, gc.ErrorMatches, `unmarshalling ".*/nodes\.yaml": yaml: unmarshal errors:\n.*field username not found.*`)
+}
 
-Starting Juju agents...
- 
-    one:node ✓  
-    two:node ✓ 
-Primary node may have shifted.
-`[1:])
+func (s *restoreSuite) TestReadSSHNodeConfigLXDConflicts(c *gc.C) {
+	for _, test := range []struct {
+		contents string
+		err      string
+	}{{
+		contents: "\"1\":\n  lxd-container: juju-abc-1\n  user: admin\n",
+		err:      `node "1": ssh settings can't be used with lxd-container`,
+	}, {
+		contents: "\"1\":\n  lxd-remote: node3\n",
+		err:      `node "1": lxd-remote requires lxd-container`,
+	}} {
+		confPath := filepath.Join(c.MkDir(), "nodes.yaml")
+		err := ioutil.WriteFile(confPath, []byte(test.contents), 0644)
+		c.Assert(err, jc.ErrorIsNil)
+
+		_, err = cmd.ReadSSHNodeConfig(confPath)
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
 }
 
 func (s *restoreSuite) TestLoadsCredsIfNoUsername(c *gc.C) {
@@ -632,13 +2974,203 @@ func (s *restoreSuite) TestReadCredsFromPattern(c *gc.C) {
 	err := ioutil.WriteFile(confPath, nil, 0777)
 	c.Assert(err, jc.ErrorIsNil)
 
-	username, password, err := cmd.ReadCredsFromPattern(
+	confs, err := cmd.ReadCredsFromPattern(
 		filepath.Join(dir, "*.conf"),
 		makeFakeReader(c, confPath, []byte(agentConfContents)),
 	)
 	c.Assert(err, jc.ErrorIsNil)
-	c.Assert(username, gc.Equals, "porridge-radio")
-	c.Assert(password, gc.Equals, "lilac")
+	c.Assert(confs, gc.DeepEquals, []cmd.AgentConf{{
+		Path:     confPath,
+		Username: "porridge-radio",
+		Password: "lilac",
+	}})
+}
+
+func (s *restoreSuite) TestReadCredsConnectionDetails(c *gc.C) {
+	dir := c.MkDir()
+	confPath := filepath.Join(dir, "agent.conf")
+	err := ioutil.WriteFile(confPath, nil, 0777)
+	c.Assert(err, jc.ErrorIsNil)
+
+	confs, err := cmd.ReadCredsFromPattern(
+		filepath.Join(dir, "*.conf"),
+		makeFakeReader(c, confPath, []byte(agentConfContents+connectionDetailsConf)),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(confs, gc.HasLen, 1)
+	c.Assert(confs[0], gc.DeepEquals, cmd.AgentConf{
+		Path:     confPath,
+		Username: "porridge-radio",
+		Password: "lilac",
+		Hostname: "localhost",
+		Port:     "27017",
+		CACert:   "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	})
+}
+
+func (s *restoreSuite) TestConnectionDetailsFromAgentConf(c *gc.C) {
+	var dialInfo db.DialInfo
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		dialInfo = info
+		return s.database, nil
+	}
+	s.loadCreds = func(string) ([]cmd.AgentConf, error) {
+		return []cmd.AgentConf{{
+			Username: "machine-0",
+			Password: "secret",
+			Hostname: "127.0.0.1",
+			Port:     "27017",
+			CACert:   "ca cert",
+		}}, nil
+	}
+	_, err := s.runCmdNoUser(c, "\n", "backup.file")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo, gc.DeepEquals, db.DialInfo{
+		Hostname: "127.0.0.1",
+		Port:     "27017",
+		Username: "machine-0",
+		Password: "secret",
+		SSL:      true,
+		CACert:   "ca cert",
+	})
+
+	// Options override agent.conf.
+	_, err = s.runCmdNoUser(c, "\n", "backup.file", "--hostname", "db.local", "--port", "37018")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo.Hostname, gc.Equals, "db.local")
+	c.Assert(dialInfo.Port, gc.Equals, "37018")
+}
+
+func (s *restoreSuite) TestPasswordForUsername(c *gc.C) {
+	var dialInfo db.DialInfo
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		dialInfo = info
+		return s.database, nil
+	}
+	ctx, err := s.runCmdNoUser(c, "hunter2\n\n", "backup.file", "--username", "admin")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo.Password, gc.Equals, "hunter2")
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasPrefix, "Password for admin: Connecting to database...\n")
+
+	_, err = s.runCmdNoUser(c, "hunter2\n\n", "backup.file", "--username", "admin", "--password-stdin")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo.Password, gc.Equals, "hunter2")
+
+	s.PatchEnvironment("JUJU_RESTORE_PASSWORD", "correct-horse")
+	_, err = s.runCmdNoUser(c, "\n", "backup.file", "--username", "admin")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo.Password, gc.Equals, "correct-horse")
+
+	// --password-stdin is honoured even with the variable set.
+	_, err = s.runCmdNoUser(c, "hunter2\n\n", "backup.file", "--username", "admin", "--password-stdin")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo.Password, gc.Equals, "hunter2")
+
+	_, err = s.runCmdNoUser(c, "\n", "backup.file", "--username", "admin", "--password", "battery")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(dialInfo.Password, gc.Equals, "battery")
+}
+
+func (s *restoreSuite) TestPasswordMissingInput(c *gc.C) {
+	_, err := s.runCmdNoUser(c, "", "backup.file", "--username", "admin")
+	c.Assert(err, gc.ErrorMatches, "reading password: no input")
+}
+
+func (s *restoreSuite) TestNotController(c *gc.C) {
+	s.evidence = cmd.ControllerEvidence{}
+	ctx, err := s.runCmd(c, "", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `
+this does not look like a Juju controller machine:
+    machine agents:   none found in /var/lib/juju/agents
+    juju-db service:  not found
+juju-restore must be run on the primary controller machine`[1:])
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "")
+	s.database.CheckNoCalls(c)
+
+	s.evidence.JujuDB = "/var/snap/juju-db/common"
+	_, err = s.runCmd(c, "", "backup.file")
+	c.Assert(err, gc.ErrorMatches, `(?s)this does not look like a Juju controller machine:.*
+    juju-db service:  /var/snap/juju-db/common
+.*`)
+}
+
+func (s *restoreSuite) TestExitCodes(c *gc.C) {
+	s.connectF = func(db.DialInfo) (core.Database, error) {
+		return nil, errors.New("auth failed")
+	}
+	command := cmd.WithExitCodes(cmd.NewRestoreCommand(s.connectF, s.openF, s.nodeFactory, s.loadCreds, s.detectController, s.devMode))
+	ctx := cmdtesting.Context(c)
+	code := corecmd.Main(command, ctx, []string{"--username=admin", "--password=secret", "backup.file"})
+	c.Assert(code, gc.Equals, cmd.ExitConnectivityFailed)
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "ERROR auth failed\n")
+
+	s.evidence = cmd.ControllerEvidence{}
+	ctx = cmdtesting.Context(c)
+	code = corecmd.Main(command, ctx, []string{"--username=admin", "--password=secret", "backup.file"})
+	c.Assert(code, gc.Equals, cmd.ExitPrecheckFailed)
+
+	s.evidence = cmd.ControllerEvidence{
+		AgentDirs: []string{"/var/lib/juju/agents/machine-2"},
+		JujuDB:    "/var/snap/juju-db/common",
+	}
+	s.connectF = func(db.DialInfo) (core.Database, error) { return s.database, nil }
+	command = cmd.WithExitCodes(cmd.NewRestoreCommand(s.connectF, s.openF, s.nodeFactory, s.loadCreds, s.detectController, s.devMode))
+	ctx = cmdtesting.Context(c)
+	ctx.Stdin = strings.NewReader("n\n")
+	code = corecmd.Main(command, ctx, []string{"--username=admin", "--password=secret", "--history-file", s.historyFile, "backup.file"})
+	c.Assert(code, gc.Equals, cmd.ExitUserAborted)
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, "ERROR restore operation: aborted\n")
+}
+
+func (s *restoreSuite) TestCredsForLocalMachineAgent(c *gc.C) {
+	var (
+		dialInfo  db.DialInfo
+		agentConf string
+	)
+	s.connectF = func(info db.DialInfo) (core.Database, error) {
+		dialInfo = info
+		return s.database, nil
+	}
+	s.loadCreds = func(path string) ([]cmd.AgentConf, error) {
+		agentConf = path
+		return []cmd.AgentConf{{
+			Path:     "/var/lib/juju/agents/machine-0/agent.conf",
+			Username: "machine-0",
+			Password: "stale",
+		}, {
+			Path:     "/var/lib/juju/agents/machine-2/agent.conf",
+			Username: "machine-2",
+			Password: "secret",
+		}}, nil
+	}
+	ctx, err := s.runCmdNoUser(c, "\n", "backup.file", "--agent-conf", "agent.conf")
+	c.Assert(err, gc.ErrorMatches, "restore operation: aborted")
+	c.Assert(agentConf, gc.Equals, "agent.conf")
+	c.Assert(dialInfo.Username, gc.Equals, "machine-2")
+	c.Assert(cmdtesting.Stdout(ctx), jc.HasPrefix, `
+Connecting to database...
+Using credentials from /var/lib/juju/agents/machine-2/agent.conf.
+`[1:])
+}
+
+func (s *restoreSuite) TestReadCredsSkipsBadFiles(c *gc.C) {
+	dir := c.MkDir()
+	for _, name := range []string{"a.conf", "b.conf"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0777)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	confs, err := cmd.ReadCredsFromPattern(
+		filepath.Join(dir, "*.conf"),
+		func(path string) ([]byte, error) {
+			if filepath.Base(path) == "a.conf" {
+				return []byte(missingTagConf), nil
+			}
+			return []byte(agentConfContents), nil
+		},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(confs, gc.HasLen, 1)
+	c.Assert(confs[0].Path, gc.Equals, filepath.Join(dir, "b.conf"))
 }
 
 func (s *restoreSuite) TestReadCredsMissingUsername(c *gc.C) {
@@ -647,7 +3179,7 @@ func (s *restoreSuite) TestReadCredsMissingUsername(c *gc.C) {
 	err := ioutil.WriteFile(confPath, nil, 0777)
 	c.Assert(err, jc.ErrorIsNil)
 
-	_, _, err = cmd.ReadCredsFromPattern(
+	_, err = cmd.ReadCredsFromPattern(
 		filepath.Join(dir, "*.conf"),
 		makeFakeReader(c, confPath, []byte(missingTagConf)),
 	)
@@ -660,7 +3192,7 @@ func (s *restoreSuite) TestReadCredsMissingPassword(c *gc.C) {
 	err := ioutil.WriteFile(confPath, nil, 0777)
 	c.Assert(err, jc.ErrorIsNil)
 
-	_, _, err = cmd.ReadCredsFromPattern(
+	_, err = cmd.ReadCredsFromPattern(
 		filepath.Join(dir, "*.conf"),
 		makeFakeReader(c, confPath, []byte(missingPasswordConf)),
 	)
@@ -677,6 +3209,16 @@ other: value
 statepassword: lilac
 `[1:]
 
+	connectionDetailsConf = `
+stateport: 27017
+stateaddresses:
+- localhost:37017
+cacert: |
+  -----BEGIN CERTIFICATE-----
+  MIIB
+  -----END CERTIFICATE-----
+`[1:]
+
 	missingTagConf = `
 # format: 2.0
 some-field:
@@ -685,6 +3227,18 @@ other: value
 statepassword: lilac
 `[1:]
 
+	sshNodeConfContents = `
+"1":
+  user: operator
+  port: 22
+10.0.0.5:
+  identity-file: /root/.ssh/other
+  options: ["ProxyJump=other-bastion"]
+"2":
+  lxd-container: juju-abc-2
+  lxd-remote: node3
+`[1:]
+
 	missingPasswordConf = `
 # format: 2.0
 some-field:
@@ -695,12 +3249,13 @@ other: value
 )
 
 func (s *restoreSuite) runCmd(c *gc.C, input string, args ...string) (*corecmd.Context, error) {
-	args = append([]string{"--username=admin"}, args...)
+	args = append([]string{"--username=admin", "--password=secret"}, args...)
 	return s.runCmdNoUser(c, input, args...)
 }
 
 func (s *restoreSuite) runCmdNoUser(c *gc.C, input string, args ...string) (*corecmd.Context, error) {
-	command := cmd.NewRestoreCommand(s.connectF, s.openF, s.converter, s.loadCreds, s.devMode)
+	command := cmd.NewRestoreCommand(s.connectF, s.openF, s.nodeFactory, s.loadCreds, s.detectController, s.devMode)
+	args = append([]string{"--history-file", s.historyFile}, args...)
 	err := cmdtesting.InitCommand(command, args)
 	if err != nil {
 		return nil, err
@@ -710,90 +3265,43 @@ func (s *restoreSuite) runCmdNoUser(c *gc.C, input string, args ...string) (*cor
 	return ctx, command.Run(ctx)
 }
 
-func assertLastCallIsClose(c *gc.C, calls []testing.StubCall) {
-	if len(calls) == 0 {
-		c.Fatalf("not closed because there were no calls")
-	}
-	c.Assert(calls[len(calls)-1].FuncName, gc.Equals, "Close")
-}
-
-type testDatabase struct {
-	*testing.Stub
-	replicaSetF     func() (core.ReplicaSet, error)
-	controllerInfoF func() (core.ControllerInfo, error)
+func (s *restoreSuite) detectController() cmd.ControllerEvidence {
+	return s.evidence
 }
 
-func (d *testDatabase) ReplicaSet() (core.ReplicaSet, error) {
-	d.AddCall("ReplicaSet")
-	return d.replicaSetF()
+func (s *restoreSuite) nodeFactory(config machine.Config) core.ControllerNodeFactory {
+	s.machineConfig = config
+	return s.converter
 }
 
-func (d *testDatabase) ControllerInfo() (core.ControllerInfo, error) {
-	d.AddCall("ControllerInfo")
-	return d.controllerInfoF()
-}
-
-func (d *testDatabase) CopyController(controller core.ControllerInfo) error {
-	d.AddCall("CopyController", controller)
-	return nil
-}
-
-func (d *testDatabase) RestoreFromDump(dumpDir, logFile string, includeStatusHistory, copyController bool) error {
-	d.Stub.MethodCall(d, "RestoreFromDump", dumpDir, logFile, includeStatusHistory)
-	return d.Stub.NextErr()
-}
-
-func (d *testDatabase) Close() {
-	d.AddCall("Close")
-}
-
-type fakeControllerNode struct {
-	*testing.Stub
-	ip string
-}
-
-func (f *fakeControllerNode) IP() string {
-	f.Stub.MethodCall(f, "IP")
-	return f.ip
-}
-
-func (f *fakeControllerNode) Ping() error {
-	f.Stub.MethodCall(f, "Ping")
-	return f.NextErr()
-}
-
-func (f *fakeControllerNode) StopAgent() error {
-	f.Stub.MethodCall(f, "StopAgent")
-	return f.NextErr()
-}
-
-func (f *fakeControllerNode) StartAgent() error {
-	f.Stub.MethodCall(f, "StartAgent")
-	return f.NextErr()
-}
-
-func (f *fakeControllerNode) UpdateAgentVersion(target version.Number) error {
-	f.Stub.MethodCall(f, "UpdateAgentVersion", target)
-	return f.NextErr()
-}
-
-type fakeBackup struct {
-	testing.Stub
-	metadataF func() (core.BackupMetadata, error)
-	dumpDirF  func() string
-}
-
-func (b *fakeBackup) Metadata() (core.BackupMetadata, error) {
-	b.Stub.MethodCall(b, "Metadata")
-	return b.metadataF()
+func findCall(c *gc.C, calls []testing.StubCall, name string) testing.StubCall {
+	for _, call := range calls {
+		if call.FuncName == name {
+			return call
+		}
+	}
+	c.Fatalf("no %s call in %v", name, calls)
+	return testing.StubCall{}
 }
 
-func (b *fakeBackup) DumpDirectory() string {
-	b.Stub.MethodCall(b, "DumpDirectory")
-	return b.dumpDirF()
+func assertLastCallIsClose(c *gc.C, calls []testing.StubCall) {
+	if len(calls) == 0 {
+		c.Fatalf("not closed because there were no calls")
+	}
+	c.Assert(calls[len(calls)-1].FuncName, gc.Equals, "Close")
 }
 
-func (b *fakeBackup) Close() error {
-	b.Stub.MethodCall(b, "Close")
-	return b.Stub.NextErr()
+// newFakeNode returns a controller node with plenty of space and its
+// agents running.
+func newFakeNode(address string) *coretesting.ControllerNode {
+	return &coretesting.ControllerNode{
+		Address: address,
+		NodeStatus: core.NodeStatus{
+			FreeSpace:     10 << 30,
+			DatabaseSize:  1536 << 20,
+			AgentState:    "active",
+			DatabaseState: "active",
+		},
+		CurrentTime: time.Now(),
+	}
 }
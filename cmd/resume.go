@@ -0,0 +1,179 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// resumeState records a restore whose agents couldn't all be started
+// again, so that running with --resume can finish it.
+type resumeState struct {
+	BackupFile         string            `json:"backup-file"`
+	Written            time.Time         `json:"written"`
+	FailedNodes        map[string]string `json:"failed-nodes"`
+	ManualAgentControl bool              `json:"manual-agent-control,omitempty"`
+	Services           []core.Service    `json:"services"`
+}
+
+// readResumeState reads the state written by a restore that didn't
+// finish.
+func readResumeState(path string) (resumeState, error) {
+	var state resumeState
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, errors.Errorf("no restore to resume: %s not found", path)
+	} else if err != nil {
+		return state, errors.Trace(err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Annotatef(err, "reading %s", path)
+	}
+	return state, nil
+}
+
+// write saves the state to path.
+func (s resumeState) write(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(path, append(data, '\n'), 0600))
+}
+
+// recoveryCommand is the command an operator can run to start the
+// agents on a node by hand.
+type recoveryCommand struct {
+	Node    string
+	Error   string
+	Command string
+}
+
+// recoveryCommands returns the command to start the agents on each
+// failed node, in name order. The primary's agents are started
+// locally and the secondaries' over ssh with the options the restore
+// used.
+func (c *restoreCommand) recoveryCommands(failed map[string]string) []recoveryCommand {
+	members := make(map[string]core.ReplicaSetMember)
+	for _, member := range c.restorer.ControllerMembers() {
+		members[memberHost(member)] = member
+		members[member.Name] = member
+	}
+	var result []recoveryCommand
+	for node, nodeErr := range failed {
+		member, ok := members[node]
+		command := "systemctl start 'jujud-machine-*'"
+		if ok && member.JujuMachineID != "" {
+			command = "systemctl start jujud-machine-" + member.JujuMachineID
+		}
+		if len(c.sudo) > 0 {
+			command = strings.Join(c.sudo, " ") + " " + command
+		}
+		if !ok || !member.Self {
+			command = c.sshCommand(node) + " " + command
+		}
+		result = append(result, recoveryCommand{Node: node, Error: nodeErr, Command: command})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Node < result[j].Node
+	})
+	return result
+}
+
+// memberHost returns the host of a replica set member, which is how
+// controller nodes are named.
+func memberHost(member core.ReplicaSetMember) string {
+	host, _, err := net.SplitHostPort(member.Name)
+	if err != nil {
+		return member.Name
+	}
+	return host
+}
+
+// sshCommand returns the ssh command line for reaching a secondary
+// controller machine.
+func (c *restoreCommand) sshCommand(host string) string {
+	args := []string{"ssh"}
+	if c.sshOptions.IdentityFile != "" {
+		args = append(args, "-i", c.sshOptions.IdentityFile)
+	}
+	if c.sshOptions.Port != "" {
+		args = append(args, "-p", c.sshOptions.Port)
+	}
+	target := host
+	if c.sshOptions.User != "" {
+		target = c.sshOptions.User + "@" + host
+	}
+	return strings.Join(append(args, target), " ")
+}
+
+// saveResumeState records which nodes' agents couldn't be started and
+// tells the operator how to finish the restore.
+func (c *restoreCommand) saveResumeState() {
+	if len(c.agentErrors) == 0 {
+		return
+	}
+	state := resumeState{
+		BackupFile:         c.backupFile,
+		Written:            time.Now().UTC(),
+		FailedNodes:        c.agentErrors,
+		ManualAgentControl: c.manualAgentControl,
+		Services:           c.services,
+	}
+	err := state.write(c.stateFile)
+	c.report.changed(core.Change{Target: c.stateFile, Action: "wrote resume state", Err: err})
+	if err != nil {
+		logger.Errorf("writing resume state: %v", err)
+		return
+	}
+	c.ui.Notify(populate(agentsNotStartedTemplate, struct {
+		Nodes     []recoveryCommand
+		StateFile string
+	}{c.recoveryCommands(c.agentErrors), c.stateFile}))
+}
+
+// initResume loads the options of the restore being resumed from the
+// state file.
+func (c *restoreCommand) initResume() error {
+	state, err := readResumeState(c.stateFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.backupFile = state.BackupFile
+	c.manualAgentControl = state.ManualAgentControl
+	if len(state.Services) > 0 {
+		names := make([]string, len(state.Services))
+		for i, service := range state.Services {
+			names[i] = string(service)
+		}
+		c.manageServices = strings.Join(names, ",")
+	}
+	return nil
+}
+
+// runResume starts the agents again after a restore that couldn't
+// start them all, removing the state file once it succeeds. Agents
+// that are already running are unaffected by being started again.
+func (c *restoreCommand) runResume() error {
+	c.ui.Progress(fmt.Sprintf("Resuming the restore of %s from %s.\n", c.backupFile, c.stateFile))
+	if err := c.report.phase(phaseStartAgents, c.runPostChecks); err != nil {
+		c.saveResumeState()
+		return errors.Trace(err)
+	}
+	if err := os.Remove(c.stateFile); err != nil {
+		logger.Warningf("couldn't remove %s: %v", c.stateFile, err)
+	}
+	return errors.Trace(c.runHook(hookPostStartAgents))
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+// NewSanitizeCommand creates a cmd.Command that writes a copy of a
+// backup file with its secrets replaced, using sanitize.
+func NewSanitizeCommand(sanitize func(path, output, tempRoot string) (int, error)) cmd.Command {
+	return &sanitizeCommand{sanitize: sanitize}
+}
+
+type sanitizeCommand struct {
+	cmd.CommandBase
+
+	sanitize func(path, output, tempRoot string) (int, error)
+
+	output     string
+	tempRoot   string
+	backupFile string
+}
+
+// Info is part of cmd.Command.
+func (c *sanitizeCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore sanitize",
+		Args:    "<backup file>",
+		Purpose: "Write a copy of a backup with its secrets replaced, for sharing",
+		Doc:     sanitizeDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *sanitizeCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.output, "output", "", "file to write the sanitized backup to (default <backup file>-sanitized.tar.gz)")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack the backup file while sanitizing it")
+}
+
+// Init is part of cmd.Command.
+func (c *sanitizeCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing backup file")
+	}
+	c.backupFile, args = args[0], args[1:]
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *sanitizeCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	output := c.output
+	if output == "" {
+		output = strings.TrimSuffix(c.backupFile, ".tar.gz") + "-sanitized.tar.gz"
+	}
+	output = ctx.AbsPath(output)
+	// Check before unpacking, which can take a while.
+	if _, err := os.Stat(output); err == nil {
+		return errors.Errorf("%s already exists", output)
+	}
+
+	ui.Notify("Sanitizing backup... ")
+	count, err := c.sanitize(ctx.AbsPath(c.backupFile), output, c.tempRoot)
+	if err != nil {
+		ui.Notify("✗\n")
+		return errors.Annotate(err, "sanitizing backup")
+	}
+	ui.Notify("✓\n")
+	ui.Notify(fmt.Sprintf("Sanitized backup written to %s (%d values replaced).\n", output, count))
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+)
+
+type sanitizeSuite struct {
+	testing.IsolationSuite
+
+	path   string
+	output string
+	err    error
+}
+
+var _ = gc.Suite(&sanitizeSuite{})
+
+func (s *sanitizeSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.path, s.output, s.err = "", "", nil
+}
+
+func (s *sanitizeSuite) sanitize(path, output, tempRoot string) (int, error) {
+	s.path, s.output = path, output
+	return 12, s.err
+}
+
+func (s *sanitizeSuite) TestSanitize(c *gc.C) {
+	dir := c.MkDir()
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewSanitizeCommand(s.sanitize), filepath.Join(dir, "backup.tar.gz"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(s.path, gc.Equals, filepath.Join(dir, "backup.tar.gz"))
+	c.Assert(s.output, gc.Equals, filepath.Join(dir, "backup-sanitized.tar.gz"))
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, `
+Sanitizing backup... ✓
+Sanitized backup written to `[1:]+s.output+` (12 values replaced).
+`)
+}
+
+func (s *sanitizeSuite) TestSanitizeFails(c *gc.C) {
+	s.err = errors.New("sanitizing dump: unexpected EOF")
+	_, err := cmdtesting.RunCommand(c, cmd.NewSanitizeCommand(s.sanitize), "backup.tar.gz", "--output", "/tmp/shared.tar.gz")
+	c.Assert(err, gc.ErrorMatches, "sanitizing backup: sanitizing dump: unexpected EOF")
+	c.Assert(s.output, gc.Equals, "/tmp/shared.tar.gz")
+}
+
+func (s *sanitizeSuite) TestOutputExists(c *gc.C) {
+	output := filepath.Join(c.MkDir(), "shared.tar.gz")
+	err := ioutil.WriteFile(output, []byte("precious"), 0600)
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = cmdtesting.RunCommand(c, cmd.NewSanitizeCommand(s.sanitize), "backup.tar.gz", "--output", output)
+	c.Assert(err, gc.ErrorMatches, ".*shared.tar.gz already exists")
+	c.Assert(s.path, gc.Equals, "")
+}
+
+func (s *sanitizeSuite) TestMissingBackup(c *gc.C) {
+	_, err := cmdtesting.RunCommand(c, cmd.NewSanitizeCommand(s.sanitize))
+	c.Assert(err, gc.ErrorMatches, "missing backup file")
+}
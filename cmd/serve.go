@@ -0,0 +1,353 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const defaultListenAddress = "localhost:17079"
+
+// Restore states reported by the service.
+const (
+	RestoreIdle      = "idle"
+	RestoreRunning   = "running"
+	RestoreSucceeded = "succeeded"
+	RestoreFailed    = "failed"
+)
+
+// NewServeCommand creates a cmd.Command that runs juju-restore as an
+// HTTP service, so that restores can be started and monitored
+// remotely. newRestore is called to create the command for each
+// restore requested.
+func NewServeCommand(newRestore func() cmd.Command) cmd.Command {
+	return &serveCommand{newRestore: newRestore}
+}
+
+type serveCommand struct {
+	cmd.CommandBase
+
+	newRestore func() cmd.Command
+
+	listen    string
+	tokenFile string
+	tlsCert   string
+	tlsKey    string
+}
+
+// Info is part of cmd.Command.
+func (c *serveCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore serve",
+		Purpose: "Accept restore requests over HTTP",
+		Doc:     serveDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *serveCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.listen, "listen", defaultListenAddress, "address to listen on")
+	f.StringVar(&c.tokenFile, "token-file", "", "file holding the bearer token clients must send")
+	f.StringVar(&c.tlsCert, "tls-cert", "", "certificate to serve HTTPS with (requires --tls-key)")
+	f.StringVar(&c.tlsKey, "tls-key", "", "private key for --tls-cert")
+}
+
+// Init is part of cmd.Command.
+func (c *serveCommand) Init(args []string) error {
+	if c.tokenFile == "" {
+		return errors.New("--token-file is required")
+	}
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		return errors.New("--tls-cert and --tls-key must be used together")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *serveCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	data, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return errors.Annotate(err, "reading token")
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return errors.Errorf("token file %s is empty", c.tokenFile)
+	}
+
+	listener, err := net.Listen("tcp", c.listen)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	service := NewRestoreService(c.newRestore, token)
+	server := &http.Server{Handler: service}
+
+	interrupted := make(chan os.Signal, 1)
+	ctx.InterruptNotify(interrupted)
+	defer ctx.StopInterruptNotify(interrupted)
+	go func() {
+		<-interrupted
+		ui.Notify("Shutting down - waiting for any restore to finish.\n")
+		_ = server.Shutdown(context.Background())
+	}()
+
+	if c.tlsCert == "" {
+		ui.Notify("Warning: serving without TLS - the token is sent in the clear.\n")
+		ui.Notify(fmt.Sprintf("Listening on http://%s.\n", listener.Addr()))
+		err = server.Serve(listener)
+	} else {
+		ui.Notify(fmt.Sprintf("Listening on https://%s.\n", listener.Addr()))
+		err = server.ServeTLS(listener, c.tlsCert, c.tlsKey)
+	}
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	// Don't exit part way through a restore.
+	service.Wait()
+	return errors.Trace(err)
+}
+
+// RestoreRequest holds the backup to restore and the options to
+// restore it with, and is posted to the service to start a restore.
+type RestoreRequest struct {
+	// BackupFile is the path of the backup on the controller
+	// machine, which must be absolute.
+	BackupFile string `json:"backup-file"`
+
+	IncludeStatusHistory bool `json:"include-status-history,omitempty"`
+	IncludeLogs          bool `json:"include-logs,omitempty"`
+	CopyController       bool `json:"copy-controller,omitempty"`
+	AllowDowngrade       bool `json:"allow-downgrade,omitempty"`
+	ManualAgentControl   bool `json:"manual-agent-control,omitempty"`
+	RepairReplicaSetTags bool `json:"repair-replicaset-tags,omitempty"`
+
+	// LogsMaxAge is passed as --logs-max-age, for example "72h".
+	LogsMaxAge string `json:"logs-max-age,omitempty"`
+
+	// Approval is passed as --approval: the path of an approval of
+	// the backup on the controller machine, which must be absolute.
+	// Restores where approvals are required fail without it.
+	Approval string `json:"approval,omitempty"`
+}
+
+// args returns the restore command's arguments for the request.
+func (r RestoreRequest) args() []string {
+	args := []string{"--yes"}
+	for _, option := range []struct {
+		set  bool
+		flag string
+	}{
+		{r.IncludeStatusHistory, "--include-status-history"},
+		{r.IncludeLogs, "--include-logs"},
+		{r.CopyController, "--copy-controller"},
+		{r.AllowDowngrade, "--allow-downgrade"},
+		{r.ManualAgentControl, "--manual-agent-control"},
+		{r.RepairReplicaSetTags, "--repair-replicaset-tags"},
+	} {
+		if option.set {
+			args = append(args, option.flag)
+		}
+	}
+	if r.LogsMaxAge != "" {
+		args = append(args, "--logs-max-age", r.LogsMaxAge)
+	}
+	if r.Approval != "" {
+		args = append(args, "--approval", r.Approval)
+	}
+	return append(args, r.BackupFile)
+}
+
+// RestoreStatus is the state of the latest restore, returned by the
+// service.
+type RestoreStatus struct {
+	State      string     `json:"state"`
+	BackupFile string     `json:"backup-file,omitempty"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+
+	// ExitCode is the code juju-restore would have exited with,
+	// set once the restore has finished.
+	ExitCode int    `json:"exit-code"`
+	Error    string `json:"error,omitempty"`
+
+	// Output is what the restore has printed so far.
+	Output string `json:"output"`
+}
+
+// RestoreService is an http.Handler that runs restores on request.
+// Requests must send the token as a bearer token. It serves /restore:
+// GET returns the RestoreStatus of the latest restore, and POST
+// starts a restore with the RestoreRequest in the body. Only one
+// restore can run at a time.
+type RestoreService struct {
+	newRestore func() cmd.Command
+	token      []byte
+
+	mu      sync.Mutex
+	status  RestoreStatus
+	output  bytes.Buffer
+	running sync.WaitGroup
+}
+
+// NewRestoreService returns a RestoreService that uses newRestore to
+// create the command for each restore.
+func NewRestoreService(newRestore func() cmd.Command, token string) *RestoreService {
+	return &RestoreService{
+		newRestore: newRestore,
+		token:      []byte(token),
+		status:     RestoreStatus{State: RestoreIdle},
+	}
+}
+
+// ServeHTTP is part of http.Handler.
+func (s *RestoreService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeServiceError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if req.URL.Path != "/restore" {
+		writeServiceError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writeServiceJSON(w, http.StatusOK, s.Status())
+	case http.MethodPost:
+		var request RestoreRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			writeServiceError(w, http.StatusBadRequest, fmt.Sprintf("reading request: %v", err))
+			return
+		}
+		if !filepath.IsAbs(request.BackupFile) {
+			writeServiceError(w, http.StatusBadRequest, "backup-file must be an absolute path")
+			return
+		}
+		if request.Approval != "" && !filepath.IsAbs(request.Approval) {
+			writeServiceError(w, http.StatusBadRequest, "approval must be an absolute path")
+			return
+		}
+		if !s.start(request) {
+			writeServiceError(w, http.StatusConflict, "a restore is already running")
+			return
+		}
+		writeServiceJSON(w, http.StatusAccepted, s.Status())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeServiceError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *RestoreService) authorized(req *http.Request) bool {
+	header := req.Header.Get("Authorization")
+	if len(s.token) == 0 || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), s.token) == 1
+}
+
+// Status returns the state of the latest restore.
+func (s *RestoreService) Status() RestoreStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Output = s.output.String()
+	return status
+}
+
+// Wait blocks until any running restore has finished.
+func (s *RestoreService) Wait() {
+	s.running.Wait()
+}
+
+// start begins a restore in the background, unless one is already
+// running.
+func (s *RestoreService) start(request RestoreRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.State == RestoreRunning {
+		return false
+	}
+	started := time.Now().UTC()
+	s.status = RestoreStatus{
+		State:      RestoreRunning,
+		BackupFile: request.BackupFile,
+		Started:    &started,
+	}
+	s.output.Reset()
+	s.running.Add(1)
+	go s.run(request)
+	return true
+}
+
+func (s *RestoreService) run(request RestoreRequest) {
+	defer s.running.Done()
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "/"
+	}
+	var stderr bytes.Buffer
+	ctx := &cmd.Context{
+		Dir:    dir,
+		Stdin:  strings.NewReader(""),
+		Stdout: serviceOutput{s},
+		Stderr: &stderr,
+	}
+	logger.Infof("starting restore of %s", request.BackupFile)
+	code := cmd.Main(WithExitCodes(s.newRestore()), ctx, request.args())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	s.status.Finished = &finished
+	s.status.ExitCode = code
+	s.status.State = RestoreSucceeded
+	if code != 0 {
+		s.status.State = RestoreFailed
+		s.status.Error = strings.TrimSpace(strings.TrimPrefix(stderr.String(), "ERROR "))
+	}
+	logger.Infof("restore of %s %s", request.BackupFile, s.status.State)
+}
+
+// serviceOutput collects the restore's output so it can be returned
+// while the restore is still running.
+type serviceOutput struct {
+	s *RestoreService
+}
+
+func (o serviceOutput) Write(data []byte) (int, error) {
+	o.s.mu.Lock()
+	defer o.s.mu.Unlock()
+	return o.s.output.Write(data)
+}
+
+func writeServiceJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Debugf("writing response: %v", err)
+	}
+}
+
+func writeServiceError(w http.ResponseWriter, code int, message string) {
+	writeServiceJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+)
+
+type serveSuite struct {
+	testing.IsolationSuite
+
+	args    [][]string
+	release chan struct{}
+	runErr  error
+	service *cmd.RestoreService
+	server  *httptest.Server
+}
+
+var _ = gc.Suite(&serveSuite{})
+
+func (s *serveSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.args = nil
+	s.release = make(chan struct{})
+	s.runErr = nil
+	s.service = cmd.NewRestoreService(func() corecmd.Command {
+		return &fakeRestoreCommand{suite: s}
+	}, "sekrit")
+	s.server = httptest.NewServer(s.service)
+	s.AddCleanup(func(*gc.C) { s.server.Close() })
+}
+
+func (s *serveSuite) do(c *gc.C, method, token, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, s.server.URL+"/restore", strings.NewReader(body))
+	c.Assert(err, jc.ErrorIsNil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, jc.ErrorIsNil)
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&result), jc.ErrorIsNil)
+	return resp.StatusCode, result
+}
+
+func (s *serveSuite) TestUnauthorized(c *gc.C) {
+	code, result := s.do(c, "GET", "", "")
+	c.Assert(code, gc.Equals, http.StatusUnauthorized)
+	c.Assert(result["error"], gc.Equals, "unauthorized")
+	code, _ = s.do(c, "POST", "wrong", `{"backup-file": "/backup.tar.gz"}`)
+	c.Assert(code, gc.Equals, http.StatusUnauthorized)
+	c.Assert(s.args, gc.HasLen, 0)
+}
+
+func (s *serveSuite) TestIdle(c *gc.C) {
+	code, result := s.do(c, "GET", "sekrit", "")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(result["state"], gc.Equals, "idle")
+}
+
+func (s *serveSuite) TestBadRequest(c *gc.C) {
+	code, result := s.do(c, "POST", "sekrit", `{"backup-file": "backup.tar.gz"}`)
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+	c.Assert(result["error"], gc.Equals, "backup-file must be an absolute path")
+	code, result = s.do(c, "POST", "sekrit", `{"backup-file": "/backup.tar.gz", "approval": "approval.yaml"}`)
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+	c.Assert(result["error"], gc.Equals, "approval must be an absolute path")
+	code, _ = s.do(c, "POST", "sekrit", `{`)
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+	code, _ = s.do(c, "DELETE", "sekrit", "")
+	c.Assert(code, gc.Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *serveSuite) TestRestore(c *gc.C) {
+	code, result := s.do(c, "POST", "sekrit", `{"backup-file": "/backup.tar.gz", "copy-controller": true}`)
+	c.Assert(code, gc.Equals, http.StatusAccepted)
+	c.Assert(result["state"], gc.Equals, "running")
+	c.Assert(result["backup-file"], gc.Equals, "/backup.tar.gz")
+
+	// Only one restore at a time.
+	code, result = s.do(c, "POST", "sekrit", `{"backup-file": "/other.tar.gz"}`)
+	c.Assert(code, gc.Equals, http.StatusConflict)
+	c.Assert(result["error"], gc.Equals, "a restore is already running")
+
+	close(s.release)
+	s.service.Wait()
+	code, result = s.do(c, "GET", "sekrit", "")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(result["state"], gc.Equals, "succeeded")
+	c.Assert(result["exit-code"], gc.Equals, float64(0))
+	c.Assert(result["output"], gc.Equals, "restoring /backup.tar.gz\n")
+	c.Assert(result["finished"], gc.NotNil)
+	c.Assert(s.args, jc.DeepEquals, [][]string{{"yes=true", "copy-controller=true", "/backup.tar.gz"}})
+}
+
+func (s *serveSuite) TestRestoreWithApproval(c *gc.C) {
+	close(s.release)
+	code, _ := s.do(c, "POST", "sekrit", `{"backup-file": "/backup.tar.gz", "approval": "/approval.yaml"}`)
+	c.Assert(code, gc.Equals, http.StatusAccepted)
+	s.service.Wait()
+	c.Assert(s.args, jc.DeepEquals, [][]string{{"yes=true", "copy-controller=false", "approval=/approval.yaml", "/backup.tar.gz"}})
+}
+
+func (s *serveSuite) TestRestoreFailed(c *gc.C) {
+	s.runErr = core.NewFailure(core.PrecheckFailure, errors.New("unhealthy"))
+	close(s.release)
+	code, _ := s.do(c, "POST", "sekrit", `{"backup-file": "/backup.tar.gz"}`)
+	c.Assert(code, gc.Equals, http.StatusAccepted)
+	s.service.Wait()
+	_, result := s.do(c, "GET", "sekrit", "")
+	c.Assert(result["state"], gc.Equals, "failed")
+	c.Assert(result["exit-code"], gc.Equals, float64(cmd.ExitPrecheckFailed))
+	c.Assert(result["error"], gc.Equals, "unhealthy")
+
+	// Another restore can be started once it's finished.
+	s.runErr = nil
+	code, _ = s.do(c, "POST", "sekrit", `{"backup-file": "/backup.tar.gz"}`)
+	c.Assert(code, gc.Equals, http.StatusAccepted)
+	s.service.Wait()
+	_, result = s.do(c, "GET", "sekrit", "")
+	c.Assert(result["state"], gc.Equals, "succeeded")
+	c.Assert(result["error"], gc.IsNil)
+}
+
+func (s *serveSuite) TestServeCommandArgs(c *gc.C) {
+	newServe := func() corecmd.Command {
+		return cmd.NewServeCommand(func() corecmd.Command { return nil })
+	}
+	_, err := cmdtesting.RunCommand(c, newServe())
+	c.Assert(err, gc.ErrorMatches, "--token-file is required")
+	_, err = cmdtesting.RunCommand(c, newServe(), "--token-file", "token", "--tls-cert", "cert.pem")
+	c.Assert(err, gc.ErrorMatches, "--tls-cert and --tls-key must be used together")
+
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(ioutil.WriteFile(tokenFile, []byte("\n"), 0600), jc.ErrorIsNil)
+	_, err = cmdtesting.RunCommand(c, newServe(), "--token-file", tokenFile)
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf("token file %s is empty", tokenFile))
+}
+
+// fakeRestoreCommand records its arguments and waits to be released
+// before finishing.
+type fakeRestoreCommand struct {
+	corecmd.CommandBase
+	suite          *serveSuite
+	yes            bool
+	copyController bool
+	approval       string
+	backupFile     string
+}
+
+func (f *fakeRestoreCommand) Info() *corecmd.Info {
+	return &corecmd.Info{Name: "juju-restore"}
+}
+
+func (f *fakeRestoreCommand) SetFlags(fs *gnuflag.FlagSet) {
+	fs.BoolVar(&f.yes, "yes", false, "")
+	fs.BoolVar(&f.copyController, "copy-controller", false, "")
+	fs.StringVar(&f.approval, "approval", "", "")
+}
+
+func (f *fakeRestoreCommand) Init(args []string) error {
+	f.backupFile = args[0]
+	got := []string{
+		fmt.Sprintf("yes=%v", f.yes),
+		fmt.Sprintf("copy-controller=%v", f.copyController),
+	}
+	if f.approval != "" {
+		got = append(got, "approval="+f.approval)
+	}
+	f.suite.args = append(f.suite.args, append(got, f.backupFile))
+	return nil
+}
+
+func (f *fakeRestoreCommand) Run(ctx *corecmd.Context) error {
+	fmt.Fprintf(ctx.Stdout, "restoring %s\n", f.backupFile)
+	<-f.suite.release
+	return f.suite.runErr
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/juju/juju-restore/machine"
+)
+
+// sshNodeOptions is the YAML representation of the settings for
+// reaching a single controller machine.
+type sshNodeOptions struct {
+	User           string   `yaml:"user"`
+	Port           string   `yaml:"port"`
+	IdentityFile   string   `yaml:"identity-file"`
+	KnownHostsFile string   `yaml:"known-hosts-file"`
+	Options        []string `yaml:"options"`
+	LXDContainer   string   `yaml:"lxd-container"`
+	LXDRemote      string   `yaml:"lxd-remote"`
+}
+
+func (o sshNodeOptions) hasSSHSettings() bool {
+	return o.User != "" || o.Port != "" || o.IdentityFile != "" || o.KnownHostsFile != "" || len(o.Options) > 0
+}
+
+// NodeConfig holds the per-machine settings read from the node
+// config file.
+type NodeConfig struct {
+	// SSH holds ssh overrides keyed by machine ID or IP address.
+	SSH map[string]machine.SSHOptions
+
+	// LXD holds the containers of machines that should be reached
+	// with lxc exec, keyed by machine ID or IP address.
+	LXD map[string]machine.LXDContainer
+}
+
+// ReadSSHNodeConfig loads per-machine overrides from the YAML file at
+// path. The file maps Juju machine IDs or IP addresses to the
+// settings for that machine, for example:
+//
+//	"1":
+//	  user: admin
+//	  port: 2222
+//	10.0.0.5:
+//	  identity-file: /root/.ssh/controller
+//	  options: ["ProxyJump=bastion"]
+//	"2":
+//	  lxd-container: juju-2f4c1e-2
+//	  lxd-remote: maas-node-3
+//
+// Machines with an lxd-container are managed with lxc exec instead
+// of ssh, so they can't have ssh settings as well.
+func ReadSSHNodeConfig(path string) (NodeConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return NodeConfig{}, errors.Trace(err)
+	}
+	var nodes map[string]sshNodeOptions
+	if err := yaml.UnmarshalStrict(data, &nodes); err != nil {
+		return NodeConfig{}, errors.Annotatef(err, "unmarshalling %q", path)
+	}
+	result := NodeConfig{
+		SSH: make(map[string]machine.SSHOptions),
+		LXD: make(map[string]machine.LXDContainer),
+	}
+	for key, node := range nodes {
+		if node.LXDContainer != "" {
+			if node.hasSSHSettings() {
+				return NodeConfig{}, errors.Errorf("node %q: ssh settings can't be used with lxd-container", key)
+			}
+			result.LXD[key] = machine.LXDContainer{
+				Name:   node.LXDContainer,
+				Remote: node.LXDRemote,
+			}
+			continue
+		}
+		if node.LXDRemote != "" {
+			return NodeConfig{}, errors.Errorf("node %q: lxd-remote requires lxd-container", key)
+		}
+		result.SSH[key] = machine.SSHOptions{
+			User:           node.User,
+			Port:           node.Port,
+			IdentityFile:   node.IdentityFile,
+			KnownHostsFile: node.KnownHostsFile,
+			Options:        node.Options,
+		}
+	}
+	return result, nil
+}
+
+// confirmHostKey asks the user whether to trust the host keys of a
+// controller machine that isn't in the known hosts file.
+func (c *restoreCommand) confirmHostKey(address string, fingerprints []string) error {
+	// Machines are reached concurrently, so only ask about one at a
+	// time.
+	c.hostKeyMu.Lock()
+	defer c.hostKeyMu.Unlock()
+	if c.assumeYes {
+		return errors.Errorf("unknown host %s - add its keys to %s or run without --yes to confirm them", address, c.sshOptions.KnownHostsFile)
+	}
+	c.ui.Progress(populate(confirmHostKeyTemplate, struct {
+		Address      string
+		Fingerprints []string
+	}{address, fingerprints}))
+	return errors.Trace(c.confirm(promptHostKey + address))
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattn/go-isatty"
+
+	"github.com/juju/juju-restore/core"
+)
+
+const (
+	progressAuto  = "auto"
+	progressLive  = "live"
+	progressLines = "lines"
+)
+
+// timelineRefresh is how often the timeline is redrawn while nodes
+// are running, so their durations keep counting up.
+const timelineRefresh = time.Second
+
+// isTerminal returns whether w writes to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && isatty.IsTerminal(f.Fd())
+}
+
+// nodeTimeline shows the state of each controller node during an
+// operation as a table that's redrawn in place, so that on a large
+// controller it's clear which nodes are still being worked on.
+type nodeTimeline struct {
+	out io.Writer
+	now func() time.Time
+
+	mu        sync.Mutex
+	operation string
+	nodes     []*timelineNode
+	// drawn is how many lines of the table are on screen.
+	drawn int
+	// ticking is closed to stop the refresh ticker.
+	ticking chan struct{}
+}
+
+type timelineNode struct {
+	name     string
+	state    core.NodeState
+	started  time.Time
+	finished time.Time
+	err      error
+}
+
+func newNodeTimeline(out io.Writer) *nodeTimeline {
+	return &nodeTimeline{out: out, now: time.Now}
+}
+
+// update records progress on a node and redraws the table. Progress
+// for a different operation starts a new table below the last one.
+func (t *nodeTimeline) update(op core.NodeOperation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if op.Operation != t.operation {
+		t.operation = op.Operation
+		t.nodes = nil
+		t.drawn = 0
+	}
+	node := t.node(op.Node)
+	node.state = op.State
+	node.err = op.Err
+	switch op.State {
+	case core.NodeRunning:
+		node.started = t.now()
+	case core.NodeDone, core.NodeFailed:
+		node.finished = t.now()
+	}
+	t.draw()
+
+	running := t.running()
+	if running && t.ticking == nil {
+		t.ticking = make(chan struct{})
+		go t.tick(t.ticking)
+	} else if !running && t.ticking != nil {
+		close(t.ticking)
+		t.ticking = nil
+	}
+}
+
+func (t *nodeTimeline) node(name string) *timelineNode {
+	for _, node := range t.nodes {
+		if node.name == name {
+			return node
+		}
+	}
+	node := &timelineNode{name: name, state: core.NodePending}
+	t.nodes = append(t.nodes, node)
+	return node
+}
+
+func (t *nodeTimeline) running() bool {
+	for _, node := range t.nodes {
+		if node.state == core.NodeRunning {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *nodeTimeline) tick(stop chan struct{}) {
+	ticker := time.NewTicker(timelineRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			t.draw()
+			t.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// draw writes the table over the one drawn before.
+func (t *nodeTimeline) draw() {
+	var table bytes.Buffer
+	w := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+	now := t.now()
+	for _, node := range t.nodes {
+		var took string
+		switch node.state {
+		case core.NodeRunning:
+			took = now.Sub(node.started).Round(time.Second).String()
+		case core.NodeDone, core.NodeFailed:
+			took = node.finished.Sub(node.started).Round(time.Second).String()
+		}
+		if node.started.IsZero() {
+			// Skipped without being started.
+			took = ""
+		}
+		var detail string
+		if node.err != nil {
+			detail = "error: " + node.err.Error()
+		}
+		fmt.Fprintf(w, "    %s\t%s\t%s %s\t%s\t%s\n", node.name, t.operation, stateSymbol(node.state), node.state, took, detail)
+	}
+	w.Flush()
+
+	var buf bytes.Buffer
+	if t.drawn > 0 {
+		fmt.Fprintf(&buf, "\x1b[%dA", t.drawn)
+	}
+	lines := strings.SplitAfter(table.String(), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		buf.WriteString("\x1b[2K" + strings.TrimRight(line, " \n") + "\n")
+	}
+	t.drawn = len(lines) - 1
+	t.out.Write(buf.Bytes())
+}
+
+func stateSymbol(state core.NodeState) string {
+	switch state {
+	case core.NodeRunning:
+		return "…"
+	case core.NodeDone:
+		return "✓"
+	case core.NodeFailed:
+		return "✗"
+	}
+	return "·"
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/version/v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// NewVerifyAllCommand creates a cmd.Command that checks every backup
+// file in a directory with verify and reports which are restorable.
+func NewVerifyAllCommand(verify func(path, tempRoot string) (core.BackupMetadata, int, error)) cmd.Command {
+	return &verifyAllCommand{verify: verify}
+}
+
+type verifyAllCommand struct {
+	cmd.CommandBase
+
+	verify func(path, tempRoot string) (core.BackupMetadata, int, error)
+
+	dir        string
+	tempRoot   string
+	reportFile string
+}
+
+// verifyReport is the JSON report of a verify-all run.
+type verifyReport struct {
+	Dir        string               `json:"dir"`
+	Checked    time.Time            `json:"checked"`
+	Restorable int                  `json:"restorable"`
+	Corrupt    int                  `json:"corrupt"`
+	Backups    []backupVerification `json:"backups"`
+}
+
+// backupVerification records the result of verifying one backup file.
+type backupVerification struct {
+	File                string           `json:"file"`
+	Restorable          bool             `json:"restorable"`
+	Error               string           `json:"error,omitempty"`
+	ID                  string           `json:"id,omitempty"`
+	ParentID            string           `json:"parent-id,omitempty"`
+	ControllerUUID      string           `json:"controller-uuid,omitempty"`
+	ControllerModelUUID string           `json:"controller-model-uuid,omitempty"`
+	JujuVersion         string           `json:"juju-version,omitempty"`
+	Series              string           `json:"series,omitempty"`
+	Created             time.Time        `json:"created"`
+	MetadataInferred    bool             `json:"metadata-inferred,omitempty"`
+	Oplog               *oplogRange      `json:"oplog,omitempty"`
+	Databases           map[string]int64 `json:"databases,omitempty"`
+	Documents           int              `json:"documents"`
+}
+
+// oplogRange reports the oplog entries in a backup's dump.
+type oplogRange struct {
+	Entries int       `json:"entries"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+}
+
+// Info is part of cmd.Command.
+func (c *verifyAllCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore verify-all",
+		Purpose: "Check that every backup file in a directory could be restored",
+		Doc:     verifyAllDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *verifyAllCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.dir, "dir", "", "directory of backup files (*.tar.gz) to check")
+	f.StringVar(&c.tempRoot, "temp-root", "/tmp", "location to unpack each backup file while checking it")
+	f.StringVar(&c.reportFile, "report", "", "write the JSON report to this file instead of stdout")
+}
+
+// Init is part of cmd.Command.
+func (c *verifyAllCommand) Init(args []string) error {
+	if c.dir == "" {
+		return errors.New("--dir is required")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *verifyAllCommand) Run(ctx *cmd.Context) error {
+	dir := ctx.AbsPath(c.dir)
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	report := verifyReport{
+		Dir:     dir,
+		Checked: time.Now().UTC(),
+		Backups: []backupVerification{},
+	}
+	// Progress goes to stderr so the report can be piped.
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".tar.gz") {
+			continue
+		}
+		fmt.Fprintf(ctx.Stderr, "Verifying %s... ", item.Name())
+		result := c.verifyFile(filepath.Join(dir, item.Name()))
+		if result.Restorable {
+			report.Restorable++
+			fmt.Fprintf(ctx.Stderr, "✓\n")
+		} else {
+			report.Corrupt++
+			fmt.Fprintf(ctx.Stderr, "✗\n    %s\n", result.Error)
+		}
+		report.Backups = append(report.Backups, result)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data = append(data, '\n')
+	if c.reportFile == "" {
+		_, err = ctx.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(ctx.AbsPath(c.reportFile), data, 0644)
+	}
+	if err != nil {
+		return errors.Annotate(err, "writing report")
+	}
+
+	if report.Corrupt > 0 {
+		return errors.Errorf("%d of %d backups failed verification", report.Corrupt, len(report.Backups))
+	}
+	return nil
+}
+
+func (c *verifyAllCommand) verifyFile(path string) backupVerification {
+	result := backupVerification{File: filepath.Base(path)}
+	metadata, documents, err := c.verify(path, c.tempRoot)
+	result.Documents = documents
+	// The metadata is reported even if a later check failed, to help
+	// identify the backup.
+	result.ID = metadata.ID
+	result.ParentID = metadata.ParentID
+	result.ControllerUUID = metadata.ControllerUUID
+	result.ControllerModelUUID = metadata.ControllerModelUUID
+	if metadata.JujuVersion != version.Zero {
+		result.JujuVersion = metadata.JujuVersion.String()
+	}
+	result.Series = metadata.Series
+	result.Created = metadata.BackupCreated
+	result.MetadataInferred = metadata.Inferred
+	if metadata.Oplog.Present {
+		result.Oplog = &oplogRange{Entries: metadata.Oplog.Entries}
+		if metadata.Oplog.Entries > 0 {
+			result.Oplog.First = metadata.Oplog.First.Time()
+			result.Oplog.Last = metadata.Oplog.Last.Time()
+		}
+	}
+	if len(metadata.Databases) > 0 {
+		result.Databases = make(map[string]int64)
+		for _, database := range metadata.Databases {
+			result.Databases[database.Name] = database.Bytes
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Restorable = true
+	return result
+}
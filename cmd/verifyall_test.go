@@ -0,0 +1,145 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+)
+
+type verifyAllSuite struct {
+	testing.IsolationSuite
+
+	dir      string
+	verified []string
+}
+
+var _ = gc.Suite(&verifyAllSuite{})
+
+func (s *verifyAllSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.dir = c.MkDir()
+	s.verified = nil
+	for _, name := range []string{"good.tar.gz", "corrupt.tar.gz", "notes.txt"} {
+		err := ioutil.WriteFile(filepath.Join(s.dir, name), nil, 0644)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	err := os.Mkdir(filepath.Join(s.dir, "old.tar.gz"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *verifyAllSuite) verify(path, tempRoot string) (core.BackupMetadata, int, error) {
+	s.verified = append(s.verified, filepath.Base(path))
+	metadata := core.BackupMetadata{
+		ID:                  "20200317-162824.how-bizarre",
+		ControllerUUID:      "dawkins-rules",
+		ControllerModelUUID: "how-bizarre",
+		JujuVersion:         version.MustParse("2.9.37"),
+		Series:              "focal",
+		BackupCreated:       time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC),
+	}
+	if filepath.Base(path) == "corrupt.tar.gz" {
+		return metadata, 10, errors.New("checking juju/machines.bson: unexpected EOF")
+	}
+	metadata.Oplog = core.DumpOplog{
+		Present: true,
+		Entries: 3,
+		First:   core.NewOplogPosition(time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC), 1),
+		Last:    core.NewOplogPosition(time.Date(2020, 3, 17, 16, 28, 30, 0, time.UTC), 2),
+	}
+	metadata.Databases = []core.DatabaseSize{
+		{Name: "juju", Bytes: 7098, Collections: map[string]int64{"models": 7098}},
+		{Name: "logs", Bytes: 512, Collections: map[string]int64{"logs.how-bizarre": 512}},
+	}
+	return metadata, 42, nil
+}
+
+func (s *verifyAllSuite) TestVerifyAll(c *gc.C) {
+	reportPath := filepath.Join(c.MkDir(), "report.json")
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewVerifyAllCommand(s.verify), "--dir", s.dir, "--report", reportPath)
+	c.Assert(err, gc.ErrorMatches, "1 of 2 backups failed verification")
+	c.Assert(s.verified, jc.DeepEquals, []string{"corrupt.tar.gz", "good.tar.gz"})
+	c.Assert(cmdtesting.Stderr(ctx), gc.Equals, `
+Verifying corrupt.tar.gz... ✗
+    checking juju/machines.bson: unexpected EOF
+Verifying good.tar.gz... ✓
+`[1:])
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "")
+
+	data, err := ioutil.ReadFile(reportPath)
+	c.Assert(err, jc.ErrorIsNil)
+	var report map[string]interface{}
+	err = json.Unmarshal(data, &report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(report["dir"], gc.Equals, s.dir)
+	c.Assert(report["restorable"], gc.Equals, 1.0)
+	c.Assert(report["corrupt"], gc.Equals, 1.0)
+	c.Assert(report["backups"], jc.DeepEquals, []interface{}{
+		map[string]interface{}{
+			"file":                  "corrupt.tar.gz",
+			"restorable":            false,
+			"error":                 "checking juju/machines.bson: unexpected EOF",
+			"id":                    "20200317-162824.how-bizarre",
+			"controller-uuid":       "dawkins-rules",
+			"controller-model-uuid": "how-bizarre",
+			"juju-version":          "2.9.37",
+			"series":                "focal",
+			"created":               "2020-03-17T16:28:24Z",
+			"documents":             10.0,
+		},
+		map[string]interface{}{
+			"file":                  "good.tar.gz",
+			"restorable":            true,
+			"id":                    "20200317-162824.how-bizarre",
+			"controller-uuid":       "dawkins-rules",
+			"controller-model-uuid": "how-bizarre",
+			"juju-version":          "2.9.37",
+			"series":                "focal",
+			"created":               "2020-03-17T16:28:24Z",
+			"oplog": map[string]interface{}{
+				"entries": 3.0,
+				"first":   "2020-03-17T16:28:24Z",
+				"last":    "2020-03-17T16:28:30Z",
+			},
+			"databases": map[string]interface{}{
+				"juju": 7098.0,
+				"logs": 512.0,
+			},
+			"documents": 42.0,
+		},
+	})
+}
+
+func (s *verifyAllSuite) TestVerifyAllStdout(c *gc.C) {
+	err := os.Remove(filepath.Join(s.dir, "corrupt.tar.gz"))
+	c.Assert(err, jc.ErrorIsNil)
+	ctx, err := cmdtesting.RunCommand(c, cmd.NewVerifyAllCommand(s.verify), "--dir", s.dir)
+	c.Assert(err, jc.ErrorIsNil)
+	var report struct {
+		Restorable int `json:"restorable"`
+		Corrupt    int `json:"corrupt"`
+	}
+	err = json.Unmarshal([]byte(cmdtesting.Stdout(ctx)), &report)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(report.Restorable, gc.Equals, 1)
+	c.Assert(report.Corrupt, gc.Equals, 0)
+}
+
+func (s *verifyAllSuite) TestDirRequired(c *gc.C) {
+	_, err := cmdtesting.RunCommand(c, cmd.NewVerifyAllCommand(s.verify))
+	c.Assert(err, gc.ErrorMatches, "--dir is required")
+}
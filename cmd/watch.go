@@ -0,0 +1,233 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd/v3"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/db"
+)
+
+// NewWatchCommand creates a cmd.Command that follows a restore run by
+// someone else, from its event socket, along with the replica set's
+// health. It never changes anything.
+func NewWatchCommand(
+	dbConnect func(info db.DialInfo) (core.Database, error),
+	loadCreds func(agentConf string) ([]AgentConf, error),
+) cmd.Command {
+	return &watchCommand{
+		connect:   dbConnect,
+		loadCreds: loadCreds,
+	}
+}
+
+type watchCommand struct {
+	cmd.CommandBase
+
+	connect   func(info db.DialInfo) (core.Database, error)
+	loadCreds func(agentConf string) ([]AgentConf, error)
+
+	eventSocket    string
+	healthInterval time.Duration
+	agentConf      string
+	hostname       string
+	port           string
+	ssl            bool
+}
+
+// Info is part of cmd.Command.
+func (c *watchCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "juju-restore watch",
+		Purpose: "Follow a running restore and the replica set's health, read-only",
+		Doc:     watchDoc,
+	}
+}
+
+// SetFlags is part of cmd.Command.
+func (c *watchCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.CommandBase.SetFlags(f)
+	f.StringVar(&c.eventSocket, "events", "", "the --event-socket of the restore to follow")
+	f.DurationVar(&c.healthInterval, "health-interval", 10*time.Second, "how often to check the replica set's health (0 doesn't connect to the database)")
+	f.StringVar(&c.agentConf, "agent-conf", "", "agent.conf to get credentials from (default is to try each machine agent's)")
+	f.StringVar(&c.hostname, "hostname", "", "hostname of the Juju MongoDB server (default from agent.conf, or localhost)")
+	f.StringVar(&c.port, "port", "", "port of the Juju MongoDB server (default from agent.conf, or 37017)")
+	f.BoolVar(&c.ssl, "ssl", true, "use SSL to connect to MongoDB")
+}
+
+// Init is part of cmd.Command.
+func (c *watchCommand) Init(args []string) error {
+	if c.eventSocket == "" {
+		return errors.New("--events is required")
+	}
+	if c.healthInterval < 0 {
+		return errors.New("--health-interval can't be negative")
+	}
+	return c.CommandBase.Init(args)
+}
+
+// Run is part of cmd.Command.
+func (c *watchCommand) Run(ctx *cmd.Context) error {
+	ui := NewUserInteractions(ctx)
+	conn, err := net.Dial("unix", ctx.AbsPath(c.eventSocket))
+	if err != nil {
+		return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "connecting to event socket"))
+	}
+	defer conn.Close()
+
+	var database core.Database
+	if c.healthInterval > 0 {
+		creds, err := c.loadCreds(c.agentConf)
+		if err != nil {
+			return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "loading credentials"))
+		}
+		settings := connectionSettings{
+			Hostname: c.hostname,
+			Port:     c.port,
+			SSL:      c.ssl,
+		}
+		database, _, err = connectWithCreds(c.connect, settings, creds)
+		if err != nil {
+			return core.NewFailure(core.ConnectivityFailure, errors.Annotate(err, "connecting to database"))
+		}
+		defer database.Close()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	events := readEvents(conn, done)
+
+	// The health is only shown when it changes, so the output isn't
+	// swamped while nothing's happening.
+	var lastHealth string
+	checkHealth := func() {
+		if database == nil {
+			return
+		}
+		health := describeHealth(database)
+		if health != lastHealth {
+			ui.Notify(fmt.Sprintf("[%s] %s\n", time.Now().UTC().Format("15:04:05"), health))
+			lastHealth = health
+		}
+	}
+	checkHealth()
+	var tick <-chan time.Time
+	if database != nil {
+		ticker := time.NewTicker(c.healthInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return errors.New("the restore stopped sending events before it finished")
+			}
+			ui.Notify(formatEvent(event))
+			if event.Type == eventFinished {
+				checkHealth()
+				if event.Error != "" {
+					return errors.Errorf("restore failed: %s", event.Error)
+				}
+				return nil
+			}
+		case <-tick:
+			checkHealth()
+		}
+	}
+}
+
+// readEvents sends the events read from conn on the channel returned,
+// closing it when the connection is closed.
+func readEvents(conn net.Conn, done <-chan struct{}) <-chan runEvent {
+	events := make(chan runEvent)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var event runEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				logger.Warningf("ignoring event %q: %v", scanner.Text(), err)
+				continue
+			}
+			select {
+			case events <- event:
+			case <-done:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Debugf("reading events: %v", err)
+		}
+	}()
+	return events
+}
+
+// formatEvent describes an event from a restore's event stream as a
+// line of output.
+func formatEvent(event runEvent) string {
+	var text string
+	switch event.Type {
+	case eventPhaseStarted:
+		text = fmt.Sprintf("%s started (%d%%)", event.Phase, event.Progress)
+	case eventPhaseFinished:
+		text = fmt.Sprintf("%s %s (%d%%)", event.Phase, resultMark(event.Error), event.Progress)
+	case eventNode:
+		text = fmt.Sprintf("%s %s %s", event.Node, event.Phase, resultMark(event.Error))
+	case eventWarning:
+		text = "warning: " + event.Message
+	case eventChange:
+		text = fmt.Sprintf("%s: %s", event.Node, event.Message)
+		if event.Error != "" {
+			text += " " + resultMark(event.Error)
+		}
+	case eventOutput:
+		text = fmt.Sprintf("%s | %s", event.Node, event.Message)
+	case eventFinished:
+		if event.Error != "" {
+			text = "restore failed: " + event.Error
+		} else {
+			text = "restore finished ✓"
+		}
+	default:
+		text = fmt.Sprintf("%s %s", event.Type, event.Message)
+	}
+	return fmt.Sprintf("[%s] %s\n", event.Time.UTC().Format("15:04:05"), text)
+}
+
+// resultMark shows whether something succeeded, with the error if not.
+func resultMark(err string) string {
+	if err != "" {
+		return "✗ error: " + err
+	}
+	return "✓"
+}
+
+// describeHealth summarises the replica set members' states on one
+// line.
+func describeHealth(database core.Database) string {
+	replicaSet, err := database.ReplicaSet()
+	if err != nil {
+		return fmt.Sprintf("replica set unavailable: %v", err)
+	}
+	var members []string
+	for _, member := range replicaSet.Members {
+		healthy := "✗"
+		if member.Healthy {
+			healthy = "✓"
+		}
+		members = append(members, fmt.Sprintf("%s %s %s", member.Name, strings.ToLower(member.State), healthy))
+	}
+	return "replica set: " + strings.Join(members, ", ")
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package cmd_test
+
+import (
+	"net"
+	"path/filepath"
+
+	corecmd "github.com/juju/cmd/v3"
+	"github.com/juju/cmd/v3/cmdtesting"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/cmd"
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+	"github.com/juju/juju-restore/db"
+)
+
+type watchSuite struct {
+	testing.IsolationSuite
+
+	database *coretesting.Database
+	socket   string
+}
+
+var _ = gc.Suite(&watchSuite{})
+
+func (s *watchSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.database = &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{
+				Name: "juju",
+				Members: []core.ReplicaSetMember{{
+					Healthy: true,
+					Name:    "10.0.0.1:37017",
+					State:   "PRIMARY",
+				}, {
+					Name:  "10.0.0.2:37017",
+					State: "RECOVERING",
+				}},
+			}, nil
+		},
+	}
+	s.socket = filepath.Join(c.MkDir(), "events.sock")
+}
+
+// serveEvents sends the lines to the first client to connect to the
+// socket, then closes the connection.
+func (s *watchSuite) serveEvents(c *gc.C, lines ...string) {
+	listener, err := net.Listen("unix", s.socket)
+	c.Assert(err, jc.ErrorIsNil)
+	s.AddCleanup(func(*gc.C) { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, line := range lines {
+			if _, err := conn.Write([]byte(line + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (s *watchSuite) runCmd(c *gc.C, args ...string) (*corecmd.Context, error) {
+	command := cmd.NewWatchCommand(
+		func(info db.DialInfo) (core.Database, error) {
+			return s.database, nil
+		},
+		func(string) ([]cmd.AgentConf, error) {
+			return []cmd.AgentConf{{Username: "machine-0", Password: "secret"}}, nil
+		},
+	)
+	return cmdtesting.RunCommand(c, command, args...)
+}
+
+func (s *watchSuite) TestWatch(c *gc.C) {
+	s.serveEvents(c,
+		`{"time":"2020-03-17T16:28:24Z","type":"phase-started","phase":"pre-checks","progress":0}`,
+		`{"time":"2020-03-17T16:28:30Z","type":"warning","phase":"pre-checks","message":"clock skew on 10.0.0.2","progress":0}`,
+		`{"time":"2020-03-17T16:28:31Z","type":"phase-finished","phase":"pre-checks","progress":25}`,
+		`{"time":"2020-03-17T16:28:32Z","type":"node","phase":"stop agents","node":"10.0.0.2","error":"timed out","progress":25}`,
+		`{"time":"2020-03-17T16:28:33Z","type":"change","phase":"restore","node":"juju.models","message":"replaced with 2 documents","progress":50}`,
+		`not an event`,
+		`{"time":"2020-03-17T16:30:00Z","type":"finished","progress":100}`,
+	)
+	ctx, err := s.runCmd(c, "--events", s.socket)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(cmdtesting.Stdout(ctx), gc.Matches, `
+\[\d\d:\d\d:\d\d\] replica set: 10.0.0.1:37017 primary ✓, 10.0.0.2:37017 recovering ✗
+\[16:28:24\] pre-checks started \(0%\)
+\[16:28:30\] warning: clock skew on 10.0.0.2
+\[16:28:31\] pre-checks ✓ \(25%\)
+\[16:28:32\] 10.0.0.2 stop agents ✗ error: timed out
+\[16:28:33\] juju.models: replaced with 2 documents
+\[16:30:00\] restore finished ✓
+`[1:])
+	s.database.CheckCallNames(c, "ReplicaSet", "ReplicaSet", "Close")
+}
+
+func (s *watchSuite) TestWatchRestoreFailed(c *gc.C) {
+	s.serveEvents(c,
+		`{"time":"2020-03-17T16:30:00Z","type":"finished","error":"restoring dump: exit status 1","progress":75}`,
+	)
+	ctx, err := s.runCmd(c, "--events", s.socket, "--health-interval", "0")
+	c.Assert(err, gc.ErrorMatches, "restore failed: restoring dump: exit status 1")
+	c.Assert(cmdtesting.Stdout(ctx), gc.Equals, "[16:30:00] restore failed: restoring dump: exit status 1\n")
+	s.database.CheckNoCalls(c)
+}
+
+func (s *watchSuite) TestWatchStreamClosed(c *gc.C) {
+	s.serveEvents(c,
+		`{"time":"2020-03-17T16:28:24Z","type":"phase-started","phase":"pre-checks","progress":0}`,
+	)
+	_, err := s.runCmd(c, "--events", s.socket, "--health-interval", "0")
+	c.Assert(err, gc.ErrorMatches, "the restore stopped sending events before it finished")
+}
+
+func (s *watchSuite) TestWatchNoSocket(c *gc.C) {
+	_, err := s.runCmd(c, "--events", s.socket)
+	c.Assert(err, gc.ErrorMatches, "connecting to event socket: .*")
+	c.Assert(err, jc.Satisfies, core.IsConnectivityError)
+}
+
+func (s *watchSuite) TestWatchRequiresEvents(c *gc.C) {
+	_, err := s.runCmd(c)
+	c.Assert(err, gc.ErrorMatches, "--events is required")
+}
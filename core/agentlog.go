@@ -0,0 +1,64 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core
+
+import (
+	"strings"
+)
+
+// agentLogLines is how much of each agent's log is checked for
+// problems after the agents are started.
+const agentLogLines = 100
+
+// agentLogPatterns map text that shows up in the agent's log when it
+// can't start properly to a description of the problem.
+var agentLogPatterns = []struct {
+	text    string
+	problem string
+}{
+	{"invalid entity name or password", "bad password"},
+	{"unauthorized access", "bad password"},
+	{"version mismatch", "agent version mismatch"},
+	{"no reachable servers", "database unreachable"},
+	{"unable to connect to mongo", "database unreachable"},
+}
+
+// CheckAgentLogs reads the recent log of the agent on the primary
+// node and (if includeSecondaries is true) the other controller nodes
+// after they've been started, and reports any lines showing the agent
+// can't start properly, in replica set order.
+func (r *Restorer) CheckAgentLogs(includeSecondaries bool) []AgentLogResult {
+	members := r.selectMembers(includeSecondaries)
+	results := make([]AgentLogResult, len(members))
+	r.runForMembers(members, func(i int, n ControllerNode) {
+		results[i].Member = members[i]
+		log, err := n.AgentLog(agentLogLines)
+		if err != nil {
+			results[i].Err = err
+			return
+		}
+		results[i].Problems = scanAgentLog(log)
+	})
+	return results
+}
+
+// scanAgentLog returns the first line of the log showing each problem.
+func scanAgentLog(log string) []AgentLogProblem {
+	var problems []AgentLogProblem
+	found := make(map[string]bool)
+	for _, line := range strings.Split(log, "\n") {
+		lower := strings.ToLower(line)
+		for _, pattern := range agentLogPatterns {
+			if found[pattern.problem] || !strings.Contains(lower, pattern.text) {
+				continue
+			}
+			found[pattern.problem] = true
+			problems = append(problems, AgentLogProblem{
+				Problem: pattern.problem,
+				Line:    strings.TrimSpace(line),
+			})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package core holds the logic for checking a controller and
+// restoring a Juju backup into it, independent of how the database,
+// backup file and controller machines are reached.
+//
+// A Restorer is created with NewRestorer from implementations of
+// Database (see db.Dial), BackupFile (see backup.Open) and a
+// ControllerNodeFactory (see machine.NewControllerNodeFactory). The
+// juju-restore command is one user of it; other tools can drive a
+// restore the same way. The interfaces still grow as juju-restore
+// gains features, so code outside this repository that implements
+// them should expect to be updated alongside it. Package coretesting
+// has fakes of the interfaces for testing code that uses a Restorer.
+package core
@@ -6,6 +6,7 @@ package core
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/juju/errors"
 )
@@ -35,3 +36,132 @@ func IsUnhealthyMembersError(err error) bool {
 	_, ok := errors.Cause(err).(*unhealthyMembersError)
 	return ok
 }
+
+// NewLaggedMembersError returns an error reporting the replica set
+// members that are too far behind the primary.
+func NewLaggedMembersError(members []ReplicaSetMember, maxLag, oplogWindow time.Duration) error {
+	return &laggedMembersError{
+		members:     members,
+		maxLag:      maxLag,
+		oplogWindow: oplogWindow,
+	}
+}
+
+type laggedMembersError struct {
+	members     []ReplicaSetMember
+	maxLag      time.Duration
+	oplogWindow time.Duration
+}
+
+// Error is part of error.
+func (e *laggedMembersError) Error() string {
+	var parts []string
+	for _, m := range e.members {
+		parts = append(parts, fmt.Sprintf("%s lagging by %s", m, m.Lag))
+	}
+	message := fmt.Sprintf("replica set members more than %s behind the primary: %s", e.maxLag, strings.Join(parts, ", "))
+	if e.oplogWindow != 0 {
+		message += fmt.Sprintf(" (oplog window %s)", e.oplogWindow)
+	}
+	return message
+}
+
+// IsLaggedMembersError returns whether the cause of this error is
+// that replica set members are too far behind the primary.
+func IsLaggedMembersError(err error) bool {
+	_, ok := errors.Cause(err).(*laggedMembersError)
+	return ok
+}
+
+// FailureKind classifies why a restore failed, so callers can tell
+// the kinds of failure apart without matching error messages.
+type FailureKind string
+
+const (
+	// PrecheckFailure means the database, controller or backup
+	// aren't in a state that can be restored into.
+	PrecheckFailure FailureKind = "precheck"
+
+	// ConnectivityFailure means the database or controller machines
+	// couldn't be reached or managed.
+	ConnectivityFailure FailureKind = "connectivity"
+
+	// RestoreFailure means restoring the database failed.
+	RestoreFailure FailureKind = "restore"
+
+	// PostcheckFailure means bringing the controller back up after
+	// the database was restored failed.
+	PostcheckFailure FailureKind = "postcheck"
+)
+
+// NewFailure marks err as a failure of the given kind. The error's
+// message and cause are unchanged, so existing checks like
+// IsUnhealthyMembersError still work.
+func NewFailure(kind FailureKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &failureError{kind: kind, err: err}
+}
+
+type failureError struct {
+	kind FailureKind
+	err  error
+}
+
+// Error is part of error.
+func (e *failureError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the cause of the marked error, for errors.Cause.
+func (e *failureError) Cause() error {
+	return errors.Cause(e.err)
+}
+
+// Underlying returns the marked error, so the failure can be found
+// under any annotations added to it.
+func (e *failureError) Underlying() error {
+	return e.err
+}
+
+// Message is part of the wrapper interface errors.ErrorStack uses.
+func (e *failureError) Message() string {
+	return ""
+}
+
+// FailureKindOf returns the kind of failure err was marked as, or ""
+// if it wasn't marked.
+func FailureKindOf(err error) FailureKind {
+	for err != nil {
+		if failure, ok := err.(*failureError); ok {
+			return failure.kind
+		}
+		wrapper, ok := err.(interface{ Underlying() error })
+		if !ok {
+			return ""
+		}
+		err = wrapper.Underlying()
+	}
+	return ""
+}
+
+// IsPrecheckError returns whether err is a precheck failure.
+func IsPrecheckError(err error) bool {
+	return FailureKindOf(err) == PrecheckFailure
+}
+
+// IsConnectivityError returns whether err is a connectivity failure.
+func IsConnectivityError(err error) bool {
+	return FailureKindOf(err) == ConnectivityFailure
+}
+
+// IsRestoreError returns whether err is a restore failure.
+func IsRestoreError(err error) bool {
+	return FailureKindOf(err) == RestoreFailure
+}
+
+// IsPostcheckError returns whether err is a postcheck failure.
+func IsPostcheckError(err error) bool {
+	return FailureKindOf(err) == PostcheckFailure
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core_test
+
+import (
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+)
+
+type errorsSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&errorsSuite{})
+
+func (s *errorsSuite) TestFailureKind(c *gc.C) {
+	c.Assert(core.NewFailure(core.RestoreFailure, nil), jc.ErrorIsNil)
+	c.Assert(core.FailureKindOf(errors.New("boom")), gc.Equals, core.FailureKind(""))
+
+	err := core.NewFailure(core.PostcheckFailure, errors.New("boom"))
+	c.Assert(err, gc.ErrorMatches, "boom")
+	c.Assert(core.FailureKindOf(err), gc.Equals, core.PostcheckFailure)
+	c.Assert(err, jc.Satisfies, core.IsPostcheckError)
+	c.Assert(err, gc.Not(jc.Satisfies), core.IsPrecheckError)
+
+	// The kind is found under annotations.
+	err = errors.Annotate(errors.Trace(err), "starting agents")
+	c.Assert(err, gc.ErrorMatches, "starting agents: boom")
+	c.Assert(err, jc.Satisfies, core.IsPostcheckError)
+}
+
+func (s *errorsSuite) TestFailureKeepsCause(c *gc.C) {
+	unhealthy := core.NewUnhealthyMembersError(nil)
+	err := errors.Annotate(core.NewFailure(core.PrecheckFailure, errors.Trace(unhealthy)), "precheck")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	c.Assert(err, jc.Satisfies, core.IsUnhealthyMembersError)
+	c.Assert(errors.Cause(err), gc.Equals, unhealthy)
+}
@@ -20,14 +20,102 @@ type Database interface {
 	// can compare to the backup file.
 	ControllerInfo() (ControllerInfo, error)
 
+	// ControllerEntities returns the names of the controller's users
+	// and clouds.
+	ControllerEntities() (ControllerEntities, error)
+
 	// CopyController copies the core controller data from the backup
-	// file so that the target controller looks like the source controller.
-	CopyController(controller ControllerInfo) error
+	// file so that the target controller looks like the source
+	// controller. backup identifies what's being copied (see
+	// ControllerCopy.Backup). Its progress is recorded, and the steps
+	// an earlier copy of the same backup completed are skipped if
+	// that copy stopped part way, unless options.RedoControllerCopy
+	// is set. A copy that finished is never resumed.
+	// options.CopySettings picks the controller settings copied, and
+	// the agent binaries are copied too if options.CopyAgentBinaries
+	// is set. What was done is returned even if the copy fails part
+	// way.
+	CopyController(controller ControllerInfo, source, backup string, options RestoreOptions) (ControllerCopyResult, error)
+
+	// Permissions returns the _id and object-global-key of the
+	// permission documents in the juju database, for planning a copy
+	// from this controller.
+	Permissions() ([]PermissionDoc, error)
+
+	// ControllerCopy returns the record of the last CopyController
+	// run on this database, or nil if there hasn't been one.
+	ControllerCopy() (*ControllerCopy, error)
+
+	// MergeUsers copies the users, controller users and permissions
+	// restored to the staging database into the controller's,
+	// replacing documents that already exist only if overwrite is
+	// set, and drops the staging database.
+	MergeUsers(overwrite bool) ([]MergedCollection, error)
+
+	// CopyClouds copies the clouds and cloud credentials restored to
+	// the staging database into the controller's, replacing those
+	// with the same names, and drops the staging database.
+	CopyClouds() error
+
+	// CopySettings replaces the controller settings with those
+	// restored to the staging database, except the read-only ones,
+	// returning the names of the settings that changed, and drops
+	// the staging database.
+	CopySettings() ([]string, error)
+
+	// HasStagingDatabase returns whether the staging database the
+	// copy and merge operations restore to is there - left behind
+	// by one that failed part way.
+	HasStagingDatabase() (bool, error)
+
+	// DropStagingDatabase removes the staging database if it's
+	// there, returning whether it was.
+	DropStagingDatabase() (bool, error)
+
+	// SetMachineIDTags sets the juju-machine-id tags of the replica
+	// set members with the IDs given (the map values are the Juju
+	// machine IDs).
+	SetMachineIDTags(ids map[int]string) error
 
 	// RestoreFromDump restores the database dump in the directory
-	// passed in to the database and writes progress logging to the
-	// specified path.
-	RestoreFromDump(dumpDir string, logFile string, includeStatusHistory, copyController bool) error
+	// passed in to the database, as the options describe, and writes
+	// progress logging to the options' log file. It returns the
+	// collections restored - even if it fails, since the collections
+	// restored before the failure have been replaced - and a digest
+	// of the warnings and errors in the log.
+	RestoreFromDump(dumpDir string, options RestoreOptions) ([]RestoredCollection, RestoreLogDigest, error)
+
+	// StageFrom copies the collections CopyController uses from the
+	// juju database of source, a running controller, into the
+	// staging database, replacing any there. Like RestoreFromDump it
+	// returns the collections copied even if it fails.
+	StageFrom(source Database) ([]RestoredCollection, error)
+
+	// Models describes the controller's hosted models - all but the
+	// controller model.
+	Models() ([]ModelSummary, error)
+
+	// MigrationTarget describes the clouds and credentials the
+	// controller has for models migrated into it.
+	MigrationTarget() (MigrationTarget, error)
+
+	// ActiveOperations reports work in progress on the controller
+	// that changes its database while it runs.
+	ActiveOperations() (ActiveOperations, error)
+
+	// TrimLogs removes the restored log entries written before the
+	// time passed in, returning how many were removed.
+	TrimLogs(before time.Time) (int, error)
+
+	// LatestOplogPosition returns the position of the newest entry
+	// in the oplog.
+	LatestOplogPosition() (OplogPosition, error)
+
+	// ReplayOplog applies the oplog entries in the file passed in
+	// (in mongodump's oplog.bson format) to the database, stopping
+	// before the limit position if it's not zero. Output is appended
+	// to the specified log file.
+	ReplayOplog(oplogFile string, logFile string, limit OplogPosition) error
 
 	// Close terminates the database connection.
 	Close()
@@ -42,6 +130,107 @@ type ReplicaSet struct {
 
 	// Members lists the nodes that make up the set.
 	Members []ReplicaSetMember
+
+	// OplogWindow is the time between the oldest and newest entries
+	// in the primary's oplog. A secondary lagging further behind
+	// than this can't catch up without a full resync. It's zero if
+	// the oplog couldn't be read.
+	OplogWindow time.Duration
+}
+
+// ControllerEntities names the users and clouds in a controller or a
+// backup, by their document IDs.
+type ControllerEntities struct {
+	Users  []string
+	Clouds []string
+}
+
+// ModelSummary describes a model, for checking whether it could be
+// migrated to another controller.
+type ModelSummary struct {
+	// Name is the model's owner and name, as owner/name.
+	Name string
+
+	// Cloud is the name of the model's cloud and CloudType is its
+	// type, as the model's controller has it.
+	Cloud     string
+	CloudType string
+
+	// Credential is the ID of the model's cloud credential, as
+	// cloud#owner#name, or empty if it has none.
+	Credential string
+
+	// AgentVersion is the model's agent version.
+	AgentVersion version.Number
+}
+
+// MigrationTarget describes what a controller has for models migrated
+// into it.
+type MigrationTarget struct {
+	// Clouds maps the names of the controller's clouds to their
+	// types.
+	Clouds map[string]string
+
+	// Credentials maps the IDs of the controller's cloud credentials
+	// to whether they're valid.
+	Credentials map[string]bool
+}
+
+// MigrationReadiness reports whether models could be migrated into a
+// controller.
+type MigrationReadiness struct {
+	// Models is the number of models checked.
+	Models int `json:"models"`
+
+	// Blockers lists the problems that would stop models migrating,
+	// in model order.
+	Blockers []MigrationBlocker `json:"blockers,omitempty"`
+}
+
+// Blocked returns the number of models that couldn't be migrated.
+func (r MigrationReadiness) Blocked() int {
+	models := make(map[string]bool)
+	for _, blocker := range r.Blockers {
+		models[blocker.Model] = true
+	}
+	return len(models)
+}
+
+// MigrationBlocker is something that would stop a model migrating.
+type MigrationBlocker struct {
+	Model   string `json:"model"`
+	Problem string `json:"problem"`
+}
+
+// ActiveOperations describes work running on a controller that keeps
+// changing its database, so restoring or copying into it at the same
+// time would leave inconsistent data.
+type ActiveOperations struct {
+	// Migrations lists the models being migrated into or out of the
+	// controller, with the direction, for example
+	// "admin/prod (importing)".
+	Migrations []string `json:"migrations,omitempty"`
+
+	// Backups is the number of database dumps running, from Juju's
+	// backups or juju-restore create-backup.
+	Backups int `json:"backups,omitempty"`
+
+	// ProvisioningMachines and ProvisioningUnits count the machines
+	// and units still being provisioned.
+	ProvisioningMachines int `json:"provisioning-machines,omitempty"`
+	ProvisioningUnits    int `json:"provisioning-units,omitempty"`
+}
+
+// Any returns true if anything is running.
+func (a ActiveOperations) Any() bool {
+	return a.Blocking() || a.ProvisioningMachines > 0 || a.ProvisioningUnits > 0
+}
+
+// Blocking returns true if something is running that stops a restore
+// unless the operator allows it. Provisioning only warrants a
+// warning, since it settles down once the agents are stopped.
+func (a ActiveOperations) Blocking() bool {
+	return len(a.Migrations) > 0 || a.Backups > 0
 }
 
 // ControllerInfo holds identifying information about a Juju controller.
@@ -63,9 +252,14 @@ type ControllerInfo struct {
 
 	// Series is the OS series the controller is deployed on. Ths
 	// determines what version of mongo is installed and whether we
-	// can restore a given backup.
+	// can restore a given backup. It's empty for Juju 3.x
+	// controllers, which record Base instead.
 	Series string
 
+	// Base is the OS base (for example ubuntu@22.04) a Juju 3.x
+	// controller is deployed on.
+	Base string
+
 	// HANodes is the count of controller machines.
 	HANodes int
 
@@ -99,6 +293,34 @@ type ReplicaSetMember struct {
 	// This information is needed when trying to manage Juju agents,
 	// their config or any other artifacts created by Juju.
 	JujuMachineID string
+
+	// MachineIDInferred is true if the member's replica set config
+	// had no juju-machine-id tag, and JujuMachineID was found by
+	// matching its address to a controller machine instead.
+	MachineIDInferred bool
+
+	// Arbiter is true if the member only votes in elections and
+	// holds no data.
+	Arbiter bool
+
+	// Hidden is true if the member is hidden from clients, for
+	// example a member kept for taking backups.
+	Hidden bool
+
+	// Delay is how far behind the primary a delayed member is
+	// configured to stay.
+	Delay time.Duration
+
+	// Lag is how far the last operation applied by this member is
+	// behind the primary's. It's zero for the primary and arbiters.
+	Lag time.Duration
+}
+
+// IsAuxiliary returns true if the member is an arbiter, hidden or
+// delayed member. These are added by operators rather than Juju, so
+// they don't run controller agents.
+func (m ReplicaSetMember) IsAuxiliary() bool {
+	return m.Arbiter || m.Hidden || m.Delay > 0
 }
 
 // String is part of Stringer.
@@ -108,7 +330,11 @@ func (m ReplicaSetMember) String() string {
 
 // ControllerNode defines behavior for a controller node machine.
 type ControllerNode interface {
-	// IP returns IP address of the machine.
+	// Name returns the host of the node as given in the replica set
+	// config - this is used to identify the node to the user.
+	Name() string
+
+	// IP returns the address used to connect to the node.
 	IP() string
 
 	// Ping checks connection to the controller machine.
@@ -120,13 +346,404 @@ type ControllerNode interface {
 	// StartAgent starts jujud-machine-* service on the controller node.
 	StartAgent() error
 
+	// RestartDatabase restarts the juju-db service on the controller
+	// node.
+	RestartDatabase() error
+
 	// UpdateAgentVersion changes the tools symlink and agent.conf for
 	// this machine to match the specified version.
 	UpdateAgentVersion(version.Number) error
+
+	// Status reports the disk space and service states on the node.
+	Status() (NodeStatus, error)
+
+	// Time returns the current time on the node's system clock.
+	Time() (time.Time, error)
+
+	// AgentLog returns the last lines of the machine agent's log on
+	// the node.
+	AgentLog(lines int) (string, error)
+}
+
+// Service is a Juju service on the controller nodes that the restore
+// can manage.
+type Service string
+
+const (
+	// MachineAgentService is the jujud machine agent, which is
+	// stopped before the restore and started after it.
+	MachineAgentService Service = "machine-agent"
+
+	// DatabaseService is juju-db. It has to keep running through the
+	// restore, so it's restarted before the machine agent is started.
+	DatabaseService Service = "database"
+)
+
+// AllServices lists the services the restore can manage.
+var AllServices = []Service{MachineAgentService, DatabaseService}
+
+// NodeStatus holds information about a controller node that's useful
+// to check before restoring.
+type NodeStatus struct {
+	// FreeSpace is the space available to the database, in bytes.
+	FreeSpace uint64
+
+	// DatabaseSize is the size of the database files, in bytes.
+	DatabaseSize uint64
+
+	// AgentState is the state of the jujud service, as reported by
+	// the service manager, for example "active" or "inactive".
+	AgentState string
+
+	// DatabaseState is the state of the juju-db service.
+	DatabaseState string
+
+	// DatabaseVersion is the version of mongod installed, with the
+	// revision if it's from the juju-db snap. It's empty if it
+	// couldn't be found.
+	DatabaseVersion string
+
+	// MachineTag and ControllerUUID are read from the machine agent's
+	// agent.conf, to check the node is the machine it's expected to
+	// be. They're empty if the node's agent.conf couldn't be read.
+	MachineTag     string
+	ControllerUUID string
+}
+
+// NodeStatusResult holds the status of a replica set member, or the
+// error from trying to get it.
+type NodeStatusResult struct {
+	Member ReplicaSetMember
+	IP     string
+	Status NodeStatus
+	Err    error
+}
+
+// AgentLogProblem is a line in an agent's log showing why the agent
+// can't start properly.
+type AgentLogProblem struct {
+	// Problem describes what's wrong, for example "bad password".
+	Problem string
+
+	// Line is the log line showing the problem.
+	Line string
+}
+
+// AgentLogResult holds the problems found in the recent log of a
+// replica set member's agent, or the error from trying to read it.
+type AgentLogResult struct {
+	Member   ReplicaSetMember
+	Problems []AgentLogProblem
+	Err      error
+}
+
+// ClockSkew holds how far a replica set member's clock is ahead of
+// the primary's (negative if it's behind), or the error from trying
+// to get it.
+type ClockSkew struct {
+	Member ReplicaSetMember
+	Skew   time.Duration
+	Err    error
+}
+
+// RestoredCollection reports how many documents were restored into a
+// collection.
+type RestoredCollection struct {
+	// Name is the collection's namespace, for example juju.machines.
+	Name string `json:"name"`
+
+	// Documents is the number of documents restored.
+	Documents int `json:"documents"`
+}
+
+// The levels of the notable lines in a restore log.
+const (
+	RestoreLogWarning = "warning"
+	RestoreLogError   = "error"
+)
+
+// RestoreLogLine is a notable line from the mongorestore output.
+type RestoreLogLine struct {
+	// Level is RestoreLogWarning or RestoreLogError.
+	Level string `json:"level"`
+
+	// Text is the line without its timestamp.
+	Text string `json:"text"`
+
+	// Count is the number of times the line appeared.
+	Count int `json:"count"`
+}
+
+// RestoreLogDigest summarises the warnings and errors in the
+// mongorestore output, so they can be reported without reading the
+// whole (very verbose) log.
+type RestoreLogDigest struct {
+	// Warnings and Errors are the number of lines at each level.
+	Warnings int `json:"warnings"`
+	Errors   int `json:"errors"`
+
+	// Lines holds the distinct notable lines in the order they first
+	// appeared, up to a limit - the rest are only in the log.
+	Lines []RestoreLogLine `json:"lines,omitempty"`
+}
+
+// Empty returns true if the log had no warnings or errors.
+func (d RestoreLogDigest) Empty() bool {
+	return d.Warnings == 0 && d.Errors == 0
+}
+
+// ControllerCopy records the progress of copying a backup's
+// controller data into this controller with CopyController.
+type ControllerCopy struct {
+	// Source is the UUID of the controller the backup was taken from.
+	Source string
+
+	// Backup identifies what was copied: the backup's ID, or when it
+	// was made for a backup without one. A copy straight from a
+	// running controller is dated when it's read, so it never
+	// matches an earlier one.
+	Backup string
+
+	// Completed lists the copy steps finished, in order.
+	Completed []string
+
+	// Started is when the copy started, and Finished when it
+	// finished - zero if it stopped part way.
+	Started  time.Time
+	Finished time.Time
+}
+
+// ControllerCopyResult reports what CopyController did.
+type ControllerCopyResult struct {
+	// Skipped lists the steps skipped because an earlier copy
+	// completed them.
+	Skipped []string
+
+	// SettingsChanged lists the controller settings the copy
+	// changed.
+	SettingsChanged []string
+
+	// Permissions records what was done with each of the source's
+	// permission documents.
+	Permissions []PermissionRewrite
+
+	// AgentBinaries lists the agent binary versions copied into the
+	// controller's blobstore, for example 2.9.37-focal-amd64.
+	AgentBinaries []string
+}
+
+// SettingsFilter adjusts which controller settings CopyController
+// copies. The read-only settings (the controller's name, UUID, CA
+// certificate, ports and so on) are always kept unless they're in
+// Include; the ones in Exclude are kept as well.
+type SettingsFilter struct {
+	Exclude []string
+	Include []string
+}
+
+// MergedCollection reports what happened to the documents from the
+// backup merged into a collection.
+type MergedCollection struct {
+	// Name is the collection's namespace, for example juju.users.
+	Name string `json:"name"`
+
+	// Added is the number of documents the controller didn't have.
+	Added int `json:"added"`
+
+	// Replaced is the number of the controller's documents replaced
+	// by the backup's.
+	Replaced int `json:"replaced"`
+
+	// Kept is the number of the controller's documents kept instead
+	// of the backup's.
+	Kept int `json:"kept"`
+}
+
+// RestoreResult contains information about a completed restore.
+type RestoreResult struct {
+	// Collections lists the collections restored from the dump.
+	Collections []RestoredCollection
+
+	// PreviousJujuVersion is the agent version of the controller
+	// before the restore.
+	PreviousJujuVersion version.Number
+
+	// JujuVersion is the agent version of the controller after the
+	// restore. It differs from PreviousJujuVersion if the agents
+	// were updated to match the backup.
+	JujuVersion version.Number
+
+	// LogsTrimmed is the number of restored log entries removed for
+	// being older than RestoreOptions.LogsMaxAge.
+	LogsTrimmed int
+
+	// Merged lists the collections the backup's users were merged
+	// into, if RestoreOptions.UsersOnly was set.
+	Merged []MergedCollection
+
+	// SettingsChanged lists the controller settings changed, if
+	// RestoreOptions.SettingsOnly or CopyController was set.
+	SettingsChanged []string
+
+	// CopySkipped lists the controller copy steps skipped because an
+	// earlier run completed them, if RestoreOptions.CopyController
+	// was set.
+	CopySkipped []string
+
+	// Permissions records what was done with each of the copied
+	// controller's permission documents, if
+	// RestoreOptions.CopyController was set.
+	Permissions []PermissionRewrite
+
+	// AgentBinaries lists the agent binary versions copied, if
+	// RestoreOptions.CopyAgentBinaries was set.
+	AgentBinaries []string
+
+	// Readiness reports whether the copied controller's models could
+	// be migrated into the controller, if RestoreOptions.CopyController
+	// was set. It's nil if the checks couldn't be run.
+	Readiness *MigrationReadiness
+
+	// LogDigest summarises the warnings and errors mongorestore
+	// logged while restoring the dump.
+	LogDigest RestoreLogDigest
+}
+
+// NodeState is how far an operation on a controller node has got.
+type NodeState string
+
+const (
+	// NodePending means the operation hasn't started on the node.
+	NodePending NodeState = "pending"
+	// NodeRunning means the operation is in progress on the node.
+	NodeRunning NodeState = "running"
+	// NodeDone means the operation succeeded on the node.
+	NodeDone NodeState = "done"
+	// NodeFailed means the operation failed on the node.
+	NodeFailed NodeState = "failed"
+)
+
+// NodeOperation reports the progress of an operation on one
+// controller node.
+type NodeOperation struct {
+	// Node is the name of the controller node.
+	Node string
+
+	// Operation is what's being done: "check connectivity", "stop
+	// agents", "start agents" or "update agent version".
+	Operation string
+
+	// State is how far the operation has got.
+	State NodeState
+
+	// Err is why the operation failed, when State is NodeFailed.
+	Err error
+}
+
+// Change records an action that modified the controller, so that
+// what a restore changed can be reported if it fails part way.
+type Change struct {
+	// Target is what was changed: a controller node, a collection
+	// (as db.collection), the replica set or the database as a whole.
+	Target string
+
+	// Action describes the change, for example "stopped
+	// machine-agent".
+	Action string
+
+	// Err is set if the action failed after it may have changed the
+	// target.
+	Err error
+}
+
+// RestoreOptions describes how a backup is restored: where progress
+// is logged, which of the optional data in its dump is restored, and
+// whether it's copied into a different controller. New options are
+// added here rather than as arguments to Restore and RestoreFromDump.
+type RestoreOptions struct {
+	// LogFile is where the detailed output of the restore is written.
+	LogFile string
+
+	// IncludeStatusHistory restores the status history of machines
+	// and units, which can be large.
+	IncludeStatusHistory bool
+
+	// IncludeLogs restores the logs database, keeping the controller
+	// and model logs from before the backup.
+	IncludeLogs bool
+
+	// LogsMaxAge, if set, limits the restored logs to the entries
+	// written this long before the backup was created.
+	LogsMaxAge time.Duration
+
+	// CopyController restores only the controller's core data into a
+	// staging database, to be copied into a different controller,
+	// instead of replacing the whole database.
+	CopyController bool
+
+	// RedoControllerCopy makes CopyController copy everything again,
+	// rather than skipping what an earlier copy completed.
+	RedoControllerCopy bool
+
+	// CopySettings picks the controller settings CopyController
+	// copies.
+	CopySettings SettingsFilter
+
+	// CopyAgentBinaries makes CopyController also copy the backup's
+	// agent binaries the controller doesn't have into its
+	// blobstore, so models migrated from the source controller can
+	// find them.
+	CopyAgentBinaries bool
+
+	// TargetDatabase, if set, restores the backup's juju database
+	// into a database with this name instead, leaving the live
+	// database and the agents alone so the restored data can be
+	// inspected alongside it. Other databases aren't restored.
+	TargetDatabase string
+
+	// UsersOnly restores only the users, controller users and
+	// permissions, merging them into the controller's. Users and
+	// permissions the controller still has are kept unless
+	// OverwriteUsers is set.
+	UsersOnly      bool
+	OverwriteUsers bool
+
+	// CloudsOnly restores only the cloud definitions and cloud
+	// credentials, replacing the controller's with the same names
+	// and leaving the rest of the database alone.
+	CloudsOnly bool
+
+	// SettingsOnly restores only the controller settings (apart from
+	// the read-only ones the controller was created with), for
+	// undoing a bad controller config change.
+	SettingsOnly bool
+
+	// PerCollection restores the dump a collection at a time instead
+	// of in one run, retrying each collection up to CollectionRetries
+	// times if it fails with a transient error (such as a lost
+	// connection or a replica set election). Collections that still
+	// fail don't stop the rest being restored.
+	PerCollection     bool
+	CollectionRetries int
+
+	// CompletedFile, if set with PerCollection, records the
+	// collections restored so that running the restore again only
+	// restores the ones that failed. It's removed once every
+	// collection has been restored.
+	CompletedFile string
+}
+
+// usesStaging returns whether the options restore to the staging
+// database and copy from it afterwards.
+func (o RestoreOptions) usesStaging() bool {
+	return o.CopyController || o.UsersOnly || o.CloudsOnly || o.SettingsOnly
 }
 
 // PrecheckResult contains the results of a pre-check run.
 type PrecheckResult struct {
+	// BackupID identifies the backup.
+	BackupID string
+
 	// BackupDate is the date the backup was finished.
 	BackupDate time.Time
 
@@ -138,6 +755,15 @@ type PrecheckResult struct {
 	// backup was taken.
 	ControllerUUID string
 
+	// TargetControllerUUID is the UUID of the controller we're
+	// restoring into.
+	TargetControllerUUID string
+
+	// ControllerMachineID and ControllerMachineInstanceID identify
+	// the controller machine the backup was taken on.
+	ControllerMachineID         string
+	ControllerMachineInstanceID string
+
 	// BackupJujuVersion is the Juju version of the controller from which backup was taken.
 	BackupJujuVersion version.Number
 
@@ -152,11 +778,51 @@ type PrecheckResult struct {
 
 	// CloudCount is the count of clouds that this backup contains.
 	CloudCount int
+
+	// Incrementals is the number of incremental backups that will be
+	// applied after the backup.
+	Incrementals int
+
+	// RestorePoint is the time the restored data will reflect when
+	// incremental backups are applied, otherwise it's zero.
+	RestorePoint time.Time
+
+	// MetadataInferred is true if the backup's metadata was worked
+	// out from its database dump rather than read from the backup.
+	MetadataInferred bool
+
+	// Oplog describes the oplog entries in the backup's dump.
+	Oplog DumpOplog
+
+	// Databases lists the size of each database in the backup's
+	// dump.
+	Databases []DatabaseSize
+
+	// Copy describes what copying the backup's controller will do to
+	// the target. It's only set by CheckCopyable.
+	Copy *CopyPrecheck
+}
+
+// CopyPrecheck describes the target controller a backup's controller
+// is being copied into.
+type CopyPrecheck struct {
+	// TargetUsers and TargetClouds are how many users and clouds the
+	// target controller has.
+	TargetUsers  int
+	TargetClouds int
+
+	// UserCollisions and CloudCollisions name the target's users and
+	// clouds that the backup's will replace. The target's admin user
+	// and its controller model's cloud are kept, so they're never
+	// included.
+	UserCollisions  []string
+	CloudCollisions []string
 }
 
 const (
 	statePrimary   = "PRIMARY"
 	stateSecondary = "SECONDARY"
+	stateArbiter   = "ARBITER"
 )
 
 // BackupFile represents a specific backup file and provides methods
@@ -170,6 +836,18 @@ type BackupFile interface {
 	// restored.
 	DumpDirectory() string
 
+	// Entities returns the names of the users and clouds in the
+	// backup.
+	Entities() (ControllerEntities, error)
+
+	// Models describes the backup's hosted models - all but the
+	// controller model.
+	Models() ([]ModelSummary, error)
+
+	// Permissions returns the _id and object-global-key of the
+	// backup's permission documents.
+	Permissions() ([]PermissionDoc, error)
+
 	// Close indicates the backup file is not needed anymore so any
 	// temp space used can be freed.
 	Close() error
@@ -205,6 +883,17 @@ type BackupMetadata struct {
 	// backup.
 	Hostname string
 
+	// ControllerMachineID and ControllerMachineInstanceID identify
+	// the controller machine the backup was taken on, and its
+	// instance in the cloud. They're empty if the backup doesn't
+	// record them.
+	ControllerMachineID         string
+	ControllerMachineInstanceID string
+
+	// CACert is the controller's CA certificate, if the backup
+	// records it.
+	CACert string
+
 	// ContainsLogs will be true if this backup includes log
 	// collections.
 	ContainsLogs bool
@@ -218,4 +907,90 @@ type BackupMetadata struct {
 	// HANodes is the number of machines in the controller that was
 	// backed up.
 	HANodes int
+
+	// ID identifies the backup.
+	ID string
+
+	// ParentID is the ID of the backup an incremental backup follows
+	// on from. It's empty for full backups.
+	ParentID string
+
+	// OplogStart and OplogEnd are the positions of the first and last
+	// oplog entries the backup covers. An incremental backup
+	// continuing the chain starts at the OplogEnd of its parent.
+	// They're zero if the backup doesn't record them.
+	OplogStart OplogPosition
+	OplogEnd   OplogPosition
+
+	// Oplog describes the oplog entries captured in the backup's
+	// dump.
+	Oplog DumpOplog
+
+	// Databases lists the size of each database in the backup's
+	// dump, in name order. It's empty for incremental backups.
+	Databases []DatabaseSize
+
+	// Inferred is true if the backup has no metadata file, so the
+	// metadata was worked out from its database dump. The creation
+	// time is the last oplog entry's and the hostname is unknown.
+	Inferred bool
+}
+
+// Incremental returns whether the backup only holds the oplog entries
+// since its parent backup, rather than a full database dump.
+func (m BackupMetadata) Incremental() bool {
+	return m.ParentID != ""
+}
+
+// DatabaseSize is the on-disk size of a database in a dump.
+type DatabaseSize struct {
+	// Name is the name of the database, for example "juju", "logs"
+	// or "blobstore".
+	Name string
+
+	// Bytes is the total size of the database's collection dumps.
+	Bytes int64
+
+	// Collections maps each collection in the database to the size
+	// of its dump.
+	Collections map[string]int64
+}
+
+// DumpOplog describes the oplog captured in a database dump.
+type DumpOplog struct {
+	// Present is true if the dump includes an oplog. Without one a
+	// backup can't be the base for a point-in-time restore.
+	Present bool
+
+	// Entries is the number of oplog entries in the dump.
+	Entries int
+
+	// First and Last are the positions of the first and last
+	// entries, so the dump covers the writes made between them.
+	// They're zero if there are no entries.
+	First OplogPosition
+	Last  OplogPosition
+}
+
+// OplogPosition identifies an entry in the MongoDB oplog. As in a
+// MongoDB timestamp, the high 32 bits are seconds since the epoch and
+// the low 32 bits order the operations within that second.
+type OplogPosition int64
+
+// NewOplogPosition returns the position of the ordinal'th operation in
+// the second t falls in.
+func NewOplogPosition(t time.Time, ordinal uint32) OplogPosition {
+	return OplogPosition(t.Unix()<<32 | int64(ordinal))
+}
+
+// Time returns the time of the operation at this position, to the
+// second.
+func (p OplogPosition) Time() time.Time {
+	return time.Unix(int64(p>>32), 0).UTC()
+}
+
+// String returns the position in the <seconds>:<ordinal> form
+// mongorestore's --oplogLimit takes.
+func (p OplogPosition) String() string {
+	return fmt.Sprintf("%d:%d", int64(p>>32), uint32(p))
 }
@@ -0,0 +1,76 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core
+
+import (
+	"github.com/juju/clock"
+	"github.com/juju/errors"
+)
+
+// NewLiveSource returns a BackupFile for a running controller, so its
+// data can be copied into another controller without taking a backup
+// and moving it across first. It can only be used to copy a
+// controller: there's no dump, so the restore copies the source's
+// collections straight from its database into the staging database.
+// Closing it closes source.
+func NewLiveSource(source Database, clock clock.Clock) BackupFile {
+	return &liveSource{db: source, clock: clock}
+}
+
+type liveSource struct {
+	db    Database
+	clock clock.Clock
+}
+
+// Metadata is part of BackupFile. The source's data is read when
+// it's copied, so it's dated now.
+func (s *liveSource) Metadata() (BackupMetadata, error) {
+	controller, err := s.db.ControllerInfo()
+	if err != nil {
+		return BackupMetadata{}, errors.Annotate(err, "getting source controller info")
+	}
+	entities, err := s.db.ControllerEntities()
+	if err != nil {
+		return BackupMetadata{}, errors.Annotate(err, "reading source users and clouds")
+	}
+	return BackupMetadata{
+		ControllerUUID:      controller.ControllerUUID,
+		ControllerModelUUID: controller.ControllerModelUUID,
+		JujuVersion:         controller.JujuVersion,
+		Series:              controller.Series,
+		BackupCreated:       s.clock.Now().UTC(),
+		ModelCount:          controller.Models,
+		CloudCount:          len(entities.Clouds),
+		HANodes:             controller.HANodes,
+	}, nil
+}
+
+// DumpDirectory is part of BackupFile. A live source has no dump.
+func (s *liveSource) DumpDirectory() string {
+	return ""
+}
+
+// Entities is part of BackupFile.
+func (s *liveSource) Entities() (ControllerEntities, error) {
+	entities, err := s.db.ControllerEntities()
+	return entities, errors.Trace(err)
+}
+
+// Models is part of BackupFile.
+func (s *liveSource) Models() ([]ModelSummary, error) {
+	models, err := s.db.Models()
+	return models, errors.Trace(err)
+}
+
+// Permissions is part of BackupFile.
+func (s *liveSource) Permissions() ([]PermissionDoc, error) {
+	docs, err := s.db.Permissions()
+	return docs, errors.Trace(err)
+}
+
+// Close is part of BackupFile.
+func (s *liveSource) Close() error {
+	s.db.Close()
+	return nil
+}
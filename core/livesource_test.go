@@ -0,0 +1,152 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core_test
+
+import (
+	"time"
+
+	"github.com/juju/clock/testclock"
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
+)
+
+type liveSourceSuite struct {
+	testing.IsolationSuite
+
+	source *coretesting.Database
+	target *coretesting.Database
+	now    time.Time
+}
+
+var _ = gc.Suite(&liveSourceSuite{})
+
+func (s *liveSourceSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.now = time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	s.source = &coretesting.Database{
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				ControllerUUID:      "strange days",
+				ControllerModelUUID: "people are strange",
+				JujuVersion:         version.MustParse("2.9.42"),
+				Series:              "focal",
+				HANodes:             3,
+				Models:              5,
+			}, nil
+		},
+		Entities: core.ControllerEntities{
+			Users:  []string{"admin", "jim"},
+			Clouds: []string{"aws", "lxd"},
+		},
+	}
+	s.target = &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{}, nil
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				ControllerUUID:      "riders on the storm",
+				ControllerModelUUID: "the end",
+				JujuVersion:         version.MustParse("3.1.0"),
+				HANodes:             1,
+				Models:              1,
+			}, nil
+		},
+		Collections: []core.RestoredCollection{{Name: "jujucontroller.users", Documents: 2}},
+	}
+}
+
+func (s *liveSourceSuite) restorer(c *gc.C) *core.Restorer {
+	source := core.NewLiveSource(s.source, testclock.NewClock(s.now))
+	r, err := core.NewRestorer(s.target, source, nil, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	return r
+}
+
+func (s *liveSourceSuite) TestMetadata(c *gc.C) {
+	source := core.NewLiveSource(s.source, testclock.NewClock(s.now))
+	metadata, err := source.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(metadata, jc.DeepEquals, core.BackupMetadata{
+		ControllerUUID:      "strange days",
+		ControllerModelUUID: "people are strange",
+		JujuVersion:         version.MustParse("2.9.42"),
+		Series:              "focal",
+		BackupCreated:       s.now,
+		ModelCount:          5,
+		CloudCount:          2,
+		HANodes:             3,
+	})
+	c.Assert(source.DumpDirectory(), gc.Equals, "")
+
+	entities, err := source.Entities()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entities, jc.DeepEquals, s.source.Entities)
+
+	c.Assert(source.Close(), jc.ErrorIsNil)
+	s.source.CheckCallNames(c, "ControllerInfo", "ControllerEntities", "ControllerEntities", "Close")
+}
+
+func (s *liveSourceSuite) TestMetadataError(c *gc.C) {
+	s.source.SetErrors(errors.New("no reachable servers"))
+	_, err := core.NewLiveSource(s.source, testclock.NewClock(s.now)).Metadata()
+	c.Assert(err, gc.ErrorMatches, "reading source users and clouds: no reachable servers")
+}
+
+func (s *liveSourceSuite) TestCheckCopyable(c *gc.C) {
+	result, err := s.restorer(c).CheckCopyable(false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.ControllerUUID, gc.Equals, "strange days")
+	c.Assert(result.BackupDate, gc.Equals, s.now)
+	c.Assert(result.Copy, jc.DeepEquals, &core.CopyPrecheck{})
+}
+
+func (s *liveSourceSuite) TestRestoreStagesFromSource(c *gc.C) {
+	var changes []core.Change
+	source := core.NewLiveSource(s.source, testclock.NewClock(s.now))
+	r, err := core.NewRestorer(s.target, source, nil, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	result, err := r.Restore(core.RestoreOptions{CopyController: true})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.Collections, jc.DeepEquals, s.target.Collections)
+	c.Assert(result.Readiness, jc.DeepEquals, &core.MigrationReadiness{})
+	s.target.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "StageFrom", "CopyController", "MigrationTarget")
+	s.target.CheckCall(c, 2, "StageFrom", s.source)
+	c.Assert(s.target.Calls()[3].Args[1], gc.Equals, "strange days")
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "jujucontroller.users", Action: "replaced with 2 documents"},
+		{Target: "database", Action: "copied the backup's controller data"},
+	})
+}
+
+func (s *liveSourceSuite) TestRestoreOnlyCopies(c *gc.C) {
+	_, err := s.restorer(c).Restore(core.RestoreOptions{})
+	c.Assert(err, gc.ErrorMatches, "a running controller can only be copied, not restored")
+	s.target.CheckCallNames(c, "ReplicaSet", "ControllerInfo")
+}
+
+func (s *liveSourceSuite) TestRestoreStageErrorDropsStaging(c *gc.C) {
+	s.target.Staging = true
+	s.target.SetErrors(errors.New("no reachable servers"))
+	_, err := s.restorer(c).Restore(core.RestoreOptions{CopyController: true})
+	c.Assert(err, gc.ErrorMatches, "copying from the source controller: no reachable servers")
+	c.Assert(err, jc.Satisfies, core.IsRestoreError)
+	s.target.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "StageFrom", "DropStagingDatabase")
+}
+
+func (s *liveSourceSuite) TestRestoreAgentBinariesNeedBackup(c *gc.C) {
+	_, err := s.restorer(c).Restore(core.RestoreOptions{CopyController: true, CopyAgentBinaries: true})
+	c.Assert(err, gc.ErrorMatches, "agent binaries can only be copied from a backup file")
+	s.target.CheckCallNames(c, "ReplicaSet", "ControllerInfo")
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PermissionDoc identifies a permission document being copied from
+// another controller.
+type PermissionDoc struct {
+	// ID is the document's _id, for example
+	// e#<model uuid>#us#bob.
+	ID string
+
+	// ObjectGlobalKey is the key of what the permission is on, for
+	// example e#<model uuid>.
+	ObjectGlobalKey string
+}
+
+// PermissionRewrite records what copying a controller does with one
+// of the source's permission documents: it's copied as it is, copied
+// with its _id and object-global-key rewritten for the target, or
+// skipped.
+type PermissionRewrite struct {
+	ID                 string `json:"id"`
+	NewID              string `json:"new-id,omitempty"`
+	NewObjectGlobalKey string `json:"new-object-global-key,omitempty"`
+	Skipped            string `json:"skipped,omitempty"`
+}
+
+// Rewritten returns true if the document's _id changes.
+func (p PermissionRewrite) Rewritten() bool {
+	return p.Skipped == "" && p.NewID != p.ID
+}
+
+// String describes what happens to the document.
+func (p PermissionRewrite) String() string {
+	switch {
+	case p.Skipped != "":
+		return fmt.Sprintf("%s skipped: %s", p.ID, p.Skipped)
+	case p.Rewritten():
+		return fmt.Sprintf("%s → %s", p.ID, p.NewID)
+	default:
+		return p.ID + " copied as it is"
+	}
+}
+
+// PermissionCounts totals what a controller copy does with the
+// source's permission documents. Copied includes those Rewritten.
+type PermissionCounts struct {
+	Copied    int
+	Rewritten int
+	Skipped   int
+}
+
+// CountPermissions totals the rewrites.
+func CountPermissions(rewrites []PermissionRewrite) PermissionCounts {
+	var counts PermissionCounts
+	for _, rewrite := range rewrites {
+		switch {
+		case rewrite.Skipped != "":
+			counts.Skipped++
+		case rewrite.Rewritten():
+			counts.Rewritten++
+			counts.Copied++
+		default:
+			counts.Copied++
+		}
+	}
+	return counts
+}
+
+// PlanPermissionCopy works out what copying the source controller's
+// permission documents into the controller does with each one.
+// Controller and controller model permissions are moved onto the
+// target's controller and controller model, cloud permissions are
+// copied as they are, and the rest are skipped - the target's admin
+// permissions are kept, and offer permissions aren't copied.
+func PlanPermissionCopy(docs []PermissionDoc, controller ControllerInfo) []PermissionRewrite {
+	rewrites := make([]PermissionRewrite, 0, len(docs))
+	for _, doc := range docs {
+		rewrite := PermissionRewrite{ID: doc.ID}
+		var newKey string
+		switch {
+		case strings.HasPrefix(doc.ID, "ao#"):
+			// We don't currently copy cross model artefacts.
+			rewrite.Skipped = "offer permissions aren't copied"
+		case strings.HasPrefix(doc.ID, "cloud#"):
+			rewrite.NewID = doc.ID
+		case strings.HasPrefix(doc.ID, "c#"):
+			newKey = "c#" + controller.ControllerUUID
+		case strings.HasPrefix(doc.ID, "e#"):
+			newKey = "e#" + controller.ControllerModelUUID
+		default:
+			rewrite.Skipped = "not a cloud, controller or model permission"
+		}
+		if newKey != "" {
+			switch {
+			case strings.HasSuffix(doc.ID, "#admin"):
+				rewrite.Skipped = "the target's admin permissions are kept"
+			case doc.ObjectGlobalKey == "":
+				rewrite.Skipped = "it has no object-global-key"
+			default:
+				rewrite.NewID = strings.Replace(doc.ID, doc.ObjectGlobalKey, newKey, 1)
+				rewrite.NewObjectGlobalKey = newKey
+			}
+		}
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites
+}
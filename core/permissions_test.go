@@ -0,0 +1,58 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core_test
+
+import (
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+)
+
+type permissionsSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&permissionsSuite{})
+
+func (s *permissionsSuite) TestPlanPermissionCopy(c *gc.C) {
+	docs := []core.PermissionDoc{
+		{ID: "cloud#aws#us#bob", ObjectGlobalKey: "cloud#aws"},
+		{ID: "c#old-controller#us#bob", ObjectGlobalKey: "c#old-controller"},
+		{ID: "c#old-controller#us#admin", ObjectGlobalKey: "c#old-controller"},
+		{ID: "e#old-model#us#mary", ObjectGlobalKey: "e#old-model"},
+		{ID: "e#other-model#us#mary"},
+		{ID: "ao#offer-uuid#us#bob", ObjectGlobalKey: "ao#offer-uuid"},
+		{ID: "mystery"},
+	}
+	plan := core.PlanPermissionCopy(docs, core.ControllerInfo{
+		ControllerUUID:      "new-controller",
+		ControllerModelUUID: "new-model",
+	})
+	c.Assert(plan, jc.DeepEquals, []core.PermissionRewrite{
+		{ID: "cloud#aws#us#bob", NewID: "cloud#aws#us#bob"},
+		{ID: "c#old-controller#us#bob", NewID: "c#new-controller#us#bob", NewObjectGlobalKey: "c#new-controller"},
+		{ID: "c#old-controller#us#admin", Skipped: "the target's admin permissions are kept"},
+		{ID: "e#old-model#us#mary", NewID: "e#new-model#us#mary", NewObjectGlobalKey: "e#new-model"},
+		{ID: "e#other-model#us#mary", Skipped: "it has no object-global-key"},
+		{ID: "ao#offer-uuid#us#bob", Skipped: "offer permissions aren't copied"},
+		{ID: "mystery", Skipped: "not a cloud, controller or model permission"},
+	})
+	c.Assert(core.CountPermissions(plan), gc.Equals, core.PermissionCounts{
+		Copied:    3,
+		Rewritten: 2,
+		Skipped:   4,
+	})
+
+	var described []string
+	for _, rewrite := range plan[:3] {
+		described = append(described, rewrite.String())
+	}
+	c.Assert(described, jc.DeepEquals, []string{
+		"cloud#aws#us#bob copied as it is",
+		"c#old-controller#us#bob → c#new-controller#us#bob",
+		"c#old-controller#us#admin skipped: the target's admin permissions are kept",
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/juju/version/v2"
+)
+
+// checkMigrationReadiness checks whether the backup's models could be
+// migrated into the controller, once its controller has been copied:
+// each model's cloud has to be there with the same type, its
+// credential has to be there and valid, and its agent version has to
+// be one the controller accepts.
+func (r *Restorer) checkMigrationReadiness(controller ControllerInfo) (*MigrationReadiness, error) {
+	models, err := r.backup.Models()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading backup models")
+	}
+	target, err := r.db.MigrationTarget()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading controller clouds and credentials")
+	}
+	controllerVersion := controller.JujuVersion
+	controllerVersion.Build = 0
+	result := &MigrationReadiness{Models: len(models)}
+	for _, model := range models {
+		for _, problem := range migrationProblems(model, target, controllerVersion) {
+			result.Blockers = append(result.Blockers, MigrationBlocker{
+				Model:   model.Name,
+				Problem: problem,
+			})
+		}
+	}
+	return result, nil
+}
+
+// migrationProblems returns what would stop the model migrating into
+// the target controller.
+func migrationProblems(model ModelSummary, target MigrationTarget, controllerVersion version.Number) []string {
+	var problems []string
+	if cloudType, ok := target.Clouds[model.Cloud]; !ok {
+		problems = append(problems, fmt.Sprintf("cloud %q isn't on the controller", model.Cloud))
+	} else if model.CloudType != "" && cloudType != model.CloudType {
+		problems = append(problems, fmt.Sprintf("cloud %q is %s on the controller, not %s", model.Cloud, cloudType, model.CloudType))
+	}
+	if model.Credential != "" {
+		if valid, ok := target.Credentials[model.Credential]; !ok {
+			problems = append(problems, fmt.Sprintf("credential %q isn't on the controller", model.Credential))
+		} else if !valid {
+			problems = append(problems, fmt.Sprintf("credential %q is marked invalid on the controller", model.Credential))
+		}
+	}
+	// Models whose version couldn't be read aren't checked.
+	if model.AgentVersion == version.Zero {
+		return problems
+	}
+	agentVersion := model.AgentVersion
+	agentVersion.Build = 0
+	switch {
+	case agentVersion.Compare(controllerVersion) == 1:
+		problems = append(problems, fmt.Sprintf("agent version %s is newer than the controller's %s", agentVersion, controllerVersion))
+	case controllerVersion.Major > agentVersion.Major+1:
+		problems = append(problems, fmt.Sprintf("agent version %s is more than one major version behind the controller's %s", agentVersion, controllerVersion))
+	case controllerVersion.Major > agentVersion.Major && agentVersion.Compare(version.MustParse("2.9.0")) == -1:
+		problems = append(problems, fmt.Sprintf("agent version %s has to be upgraded to 2.9 before migrating to a %d.x controller", agentVersion, controllerVersion.Major))
+	}
+	return problems
+}
@@ -4,8 +4,11 @@
 package core
 
 import (
+	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/clock"
@@ -18,13 +21,159 @@ import (
 
 var logger = loggo.GetLogger("juju-restore.core")
 
+// oplogFileName is the file in a database dump holding the oplog
+// entries to replay.
+const oplogFileName = "oplog.bson"
+
 // ControllerNodeFactory gets a controller node machine from a
 // replicaset member.
 type ControllerNodeFactory func(member ReplicaSetMember) ControllerNode
 
+// RestorerConfig holds settings that control how a Restorer operates
+// on the controller nodes and what it restores. The zero value
+// operates on one node at a time with no progress reporting, and
+// restores only the backup.
+type RestorerConfig struct {
+	// Parallelism is the maximum number of secondary nodes to
+	// operate on at the same time.
+	Parallelism int
+
+	// ReplicaSetName is the name the controller's replica set must
+	// have for the database to be restored into. If empty,
+	// DefaultReplicaSetName is expected.
+	ReplicaSetName string
+
+	// DialMember, if set, connects directly to a replica set member
+	// so CheckDatabaseState can confirm each member is reachable and
+	// in the state the primary reports, rather than relying on the
+	// primary's view alone.
+	DialMember func(member ReplicaSetMember) (Database, error)
+
+	// NodeDone, if set, is called as agents on each node finish
+	// stopping or starting.
+	NodeDone func(node string, err error)
+
+	// Clock is used to compare the controller nodes' clocks and to
+	// wait between health checks. If nil, the wall clock is used.
+	Clock clock.Clock
+
+	// Incrementals are incremental backups applied in order after
+	// the backup is restored, each following on from the one before.
+	Incrementals []BackupFile
+
+	// Until, if set, stops applying the incrementals after the
+	// operations made in this second.
+	Until time.Time
+
+	// Services lists the services StopAgents and StartAgents manage
+	// on each node. If it's empty only the machine agent is managed.
+	Services []Service
+
+	// StageTimeout, if set, makes StartAgents start the nodes one at
+	// a time, primary first, waiting up to this long after each for
+	// the replica set and the node's agent to be healthy. A node that
+	// doesn't become healthy stops the rest from being started.
+	StageTimeout time.Duration
+
+	// StartRetries is how many more times StartAgents tries to start
+	// a node's agents after a failure, waiting twice as long before
+	// each attempt.
+	StartRetries int
+
+	// Changed, if set, is called after each action that modifies the
+	// controller. It may be called from more than one goroutine at
+	// once.
+	Changed func(Change)
+
+	// StabiliseAttempts is how many times StartAgents checks whether
+	// the replica set is healthy before starting the agents anyway.
+	// If it's zero, DefaultStabiliseAttempts is used.
+	StabiliseAttempts int
+
+	// StabiliseMaxWait, if set, limits how long StartAgents waits
+	// between checks of the replica set. Otherwise the wait starts at
+	// 5 seconds and grows by 1.6 times after each check.
+	StabiliseMaxWait time.Duration
+
+	// NodeProgress, if set, is called as each node becomes pending,
+	// starts and finishes while connectivity to the secondaries is
+	// checked, agents are stopped and started, and agent versions are
+	// updated. It may be called from more than one goroutine at once.
+	NodeProgress func(NodeOperation)
+
+	// Cancel, if set, is closed to stop StartAgents and WaitForAgents
+	// waiting: the replica set isn't waited for before the agents are
+	// started, failed starts aren't retried and staged starts don't
+	// wait for each node to be healthy. Every node's agents are still
+	// started once.
+	Cancel <-chan struct{}
+}
+
+// startRetryDelay is how long StartAgents waits before first retrying
+// a node whose agents failed to start.
+const startRetryDelay = 5 * time.Second
+
+// DefaultStabiliseAttempts is how many times StartAgents checks the
+// replica set is healthy if RestorerConfig.StabiliseAttempts isn't
+// set.
+const DefaultStabiliseAttempts = 20
+
+// stabiliseDelay is how long StartAgents first waits before checking
+// the replica set again.
+const stabiliseDelay = 5 * time.Second
+
+// stagePollInterval is how often a staged start checks whether the
+// node just started is healthy.
+const stagePollInterval = 5 * time.Second
+
+// changed reports a change to the controller, if anyone's listening.
+func (c RestorerConfig) changed(target, action string, err error) {
+	if c.Changed != nil {
+		c.Changed(Change{Target: target, Action: action, Err: err})
+	}
+}
+
+// nodeChanged reports a change to a controller node. The node's name
+// is only looked up if anyone's listening.
+func (c RestorerConfig) nodeChanged(n ControllerNode, action string, err error) {
+	if c.Changed != nil {
+		c.changed(n.Name(), action, err)
+	}
+}
+
+// progress reports the progress of an operation on a node, if anyone's
+// listening.
+func (c RestorerConfig) progress(node, operation string, state NodeState, err error) {
+	if c.NodeProgress != nil {
+		c.NodeProgress(NodeOperation{Node: node, Operation: operation, State: state, Err: err})
+	}
+}
+
+// progressDone reports an operation on a node finishing.
+func (c RestorerConfig) progressDone(node, operation string, err error) {
+	state := NodeDone
+	if err != nil {
+		state = NodeFailed
+	}
+	c.progress(node, operation, state, err)
+}
+
+// manages returns whether the restorer stops and starts the service.
+func (c RestorerConfig) manages(service Service) bool {
+	if len(c.Services) == 0 {
+		return service == MachineAgentService
+	}
+	for _, s := range c.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
 // NewRestorer returns a new restorer for a specific database and
 // backup.
-func NewRestorer(db Database, backup BackupFile, convert ControllerNodeFactory) (*Restorer, error) {
+func NewRestorer(db Database, backup BackupFile, convert ControllerNodeFactory, config RestorerConfig) (*Restorer, error) {
 	replicaSet, err := db.ReplicaSet()
 	if err != nil {
 		return nil, errors.Annotate(err, "getting database replica set")
@@ -34,25 +183,141 @@ func NewRestorer(db Database, backup BackupFile, convert ControllerNodeFactory)
 		backup:                  backup,
 		replicaSet:              replicaSet,
 		convertToControllerNode: convert,
+		config:                  config,
 	}, nil
 }
 
 // Restorer checks the database health and backup file state and
-// restores the backup file.
+// restores the backup file. Its methods can be called concurrently:
+// each operation works on its own copy of the replica set, which is
+// only replaced once a refreshed one has been fetched.
 type Restorer struct {
 	db                      Database
 	backup                  BackupFile
-	replicaSet              ReplicaSet
 	convertToControllerNode ControllerNodeFactory
+	config                  RestorerConfig
+
+	// mu guards replicaSet.
+	mu         sync.Mutex
+	replicaSet ReplicaSet
+}
+
+// currentReplicaSet returns a copy of the replica set as last fetched.
+func (r *Restorer) currentReplicaSet() ReplicaSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replicaSet := r.replicaSet
+	replicaSet.Members = append([]ReplicaSetMember(nil), r.replicaSet.Members...)
+	return replicaSet
+}
+
+// refreshReplicaSet fetches the replica set from the database and
+// records it for later operations.
+func (r *Restorer) refreshReplicaSet() (ReplicaSet, error) {
+	replicaSet, err := r.db.ReplicaSet()
+	if err != nil {
+		return ReplicaSet{}, errors.Annotate(err, "getting database replica set")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicaSet = replicaSet
+	return replicaSet, nil
 }
 
+// DefaultReplicaSetName is the name of the replica set Juju creates.
+const DefaultReplicaSetName = "juju"
+
 // CheckDatabaseState determines whether this database is appropriate
-// for restoring into.
+// for restoring into. Errors are precheck failures.
 func (r *Restorer) CheckDatabaseState() error {
-	logger.Debugf("replicaset status: %s", pretty.Sprint(r.replicaSet))
+	replicaSet := r.currentReplicaSet()
+	if err := checkReplicaSetName(replicaSet, r.config.ReplicaSetName); err != nil {
+		return NewFailure(PrecheckFailure, err)
+	}
+	if err := checkDatabaseState(replicaSet); err != nil {
+		return NewFailure(PrecheckFailure, err)
+	}
+	if r.config.DialMember == nil {
+		return nil
+	}
+	return NewFailure(PrecheckFailure, r.checkMembersDirectly(replicaSet))
+}
+
+// checkMembersDirectly connects to each of the other data-bearing
+// members to make sure they're reachable and see themselves the way
+// the primary sees them - the primary's status can lag behind when the
+// network is flapping. Arbiters hold no users, so they're skipped.
+func (r *Restorer) checkMembersDirectly(replicaSet ReplicaSet) error {
+	var others []ReplicaSetMember
+	for _, member := range replicaSet.Members {
+		if !member.Self && !member.Arbiter {
+			others = append(others, member)
+		}
+	}
+	problems := make([]string, len(others))
+	var wg sync.WaitGroup
+	for i, member := range others {
+		wg.Add(1)
+		go func(i int, member ReplicaSetMember) {
+			defer wg.Done()
+			if err := r.checkMemberDirectly(member); err != nil {
+				problems[i] = fmt.Sprintf("%s %v", member.Name, err)
+			}
+		}(i, member)
+	}
+	wg.Wait()
+	var found []string
+	for _, problem := range problems {
+		if problem != "" {
+			found = append(found, problem)
+		}
+	}
+	if len(found) > 0 {
+		return errors.Errorf("replica set members don't match the primary's status: %s", strings.Join(found, ", "))
+	}
+	return nil
+}
+
+func (r *Restorer) checkMemberDirectly(member ReplicaSetMember) error {
+	database, err := r.config.DialMember(member)
+	if err != nil {
+		return errors.Annotate(err, "can't be reached")
+	}
+	defer database.Close()
+	replicaSet, err := database.ReplicaSet()
+	if err != nil {
+		return errors.Annotate(err, "can't report its status")
+	}
+	for _, self := range replicaSet.Members {
+		if !self.Self {
+			continue
+		}
+		logger.Debugf("%s reports itself %s", member.Name, self.State)
+		if self.State != member.State {
+			return errors.Errorf("reports itself %s but the primary sees it as %s", self.State, member.State)
+		}
+		return nil
+	}
+	return errors.New("isn't in its own replica set status")
+}
+
+// checkReplicaSetName makes sure we're connected to the controller's
+// replica set rather than some other mongod on the machine.
+func checkReplicaSetName(replicaSet ReplicaSet, expected string) error {
+	if expected == "" {
+		expected = DefaultReplicaSetName
+	}
+	if replicaSet.Name != expected {
+		return errors.Errorf("connected to replica set %q, not %q - this may not be the Juju database (pass --replica-set if the controller's replica set has a different name)", replicaSet.Name, expected)
+	}
+	return nil
+}
+
+func checkDatabaseState(replicaSet ReplicaSet) error {
+	logger.Debugf("replicaset status: %s", pretty.Sprint(replicaSet))
 	var primary *ReplicaSetMember
 	var unhealthyMembers []ReplicaSetMember
-	for _, member := range r.replicaSet.Members {
+	for _, member := range replicaSet.Members {
 		if member.State == statePrimary {
 			// We need to put member into a new variable, otherwise
 			// the value pointed at by primary will be overwritten the
@@ -61,7 +326,13 @@ func (r *Restorer) CheckDatabaseState() error {
 			primary = &saved
 		}
 		validState := member.State == statePrimary || member.State == stateSecondary
-		if !validState || !member.Healthy || member.JujuMachineID == "" {
+		if member.Arbiter {
+			validState = member.State == stateArbiter
+		}
+		// Auxiliary members aren't Juju controllers so they don't
+		// need a machine ID.
+		missingID := member.JujuMachineID == "" && !member.IsAuxiliary()
+		if !validState || !member.Healthy || missingID {
 			unhealthyMembers = append(unhealthyMembers, member)
 		}
 	}
@@ -78,22 +349,136 @@ func (r *Restorer) CheckDatabaseState() error {
 	return nil
 }
 
-// IsHA returns true of there is more than one member in replica set.
+// CheckReplicationLag returns an error if any data-bearing member of
+// the replica set is more than maxLag behind the primary (on top of
+// its configured delay), since bouncing the database with a lagged
+// secondary risks a rollback. A member lagging by more than the oplog
+// window is always reported.
+func (r *Restorer) CheckReplicationLag(maxLag time.Duration) error {
+	replicaSet := r.currentReplicaSet()
+	window := replicaSet.OplogWindow
+	var lagged []ReplicaSetMember
+	for _, member := range replicaSet.Members {
+		if member.Arbiter {
+			continue
+		}
+		lag := member.Lag - member.Delay
+		if lag > maxLag || (window != 0 && member.Lag > window) {
+			lagged = append(lagged, member)
+		}
+	}
+	if len(lagged) != 0 {
+		return NewFailure(PrecheckFailure, errors.Trace(NewLaggedMembersError(lagged, maxLag, window)))
+	}
+	return nil
+}
+
+// CheckActiveOperations looks for work running on the controller that
+// keeps changing the database, which would leave a restore or copy
+// inconsistent. Running migrations or backups are a precheck failure
+// unless allow is set; the operations found are returned either way.
+func (r *Restorer) CheckActiveOperations(allow bool) (ActiveOperations, error) {
+	active, err := r.db.ActiveOperations()
+	if err != nil {
+		return ActiveOperations{}, NewFailure(PrecheckFailure, errors.Annotate(err, "checking for running operations"))
+	}
+	if !active.Blocking() || allow {
+		return active, nil
+	}
+	var running []string
+	if len(active.Migrations) > 0 {
+		running = append(running, fmt.Sprintf("model migrations (%s)", strings.Join(active.Migrations, ", ")))
+	}
+	if active.Backups > 0 {
+		running = append(running, fmt.Sprintf("%d database backups", active.Backups))
+	}
+	return active, NewFailure(PrecheckFailure, errors.Errorf("the controller is running %s", strings.Join(running, " and ")))
+}
+
+// InferredMachineIDs returns the replica set members whose Juju
+// machine IDs were missing from the replica set config and had to be
+// found from the controller machines.
+func (r *Restorer) InferredMachineIDs() []ReplicaSetMember {
+	var result []ReplicaSetMember
+	for _, member := range r.currentReplicaSet().Members {
+		if member.MachineIDInferred {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// RepairMachineIDTags adds the inferred machine IDs to the replica
+// set config so that Juju and later restores can find them.
+func (r *Restorer) RepairMachineIDTags() error {
+	ids := make(map[int]string)
+	for _, member := range r.InferredMachineIDs() {
+		ids[member.ID] = member.JujuMachineID
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := r.db.SetMachineIDTags(ids); err != nil {
+		return errors.Annotate(err, "updating replica set tags")
+	}
+	r.config.changed("replica set", fmt.Sprintf("set juju-machine-id tags on %d members", len(ids)), nil)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.replicaSet.Members {
+		r.replicaSet.Members[i].MachineIDInferred = false
+	}
+	return nil
+}
+
+// IsHA returns true if there is more than one controller in the
+// replica set. Auxiliary members aren't counted.
 func (r *Restorer) IsHA() bool {
-	return len(r.replicaSet.Members) > 1
+	return len(r.controllerMembers()) > 1
+}
+
+// ControllerMembers returns the replica set members running on
+// controller nodes, leaving out arbiters and other auxiliary members.
+func (r *Restorer) ControllerMembers() []ReplicaSetMember {
+	return r.controllerMembers()
+}
+
+// controllerMembers returns the replica set members that are Juju
+// controllers, excluding arbiter, hidden and delayed members.
+func (r *Restorer) controllerMembers() []ReplicaSetMember {
+	var result []ReplicaSetMember
+	for _, member := range r.currentReplicaSet().Members {
+		if member.IsAuxiliary() {
+			logger.Debugf("skipping auxiliary replica set member %s", member)
+			continue
+		}
+		result = append(result, member)
+	}
+	return result
 }
 
 // CheckSecondaryControllerNodes determines whether secondary controller nodes can be reached.
+// The nodes are checked concurrently up to the configured parallelism.
 func (r *Restorer) CheckSecondaryControllerNodes() map[string]error {
-	reachable := map[string]error{}
-	for _, member := range r.replicaSet.Members {
+	var secondaries []ControllerNode
+	for _, member := range r.controllerMembers() {
 		if member.Self {
 			// We are already on this machine, so no need to check connectivity.
 			continue
 		}
-		memberMachine := r.convertToControllerNode(member)
-		reachable[memberMachine.IP()] = memberMachine.Ping()
+		secondaries = append(secondaries, r.convertToControllerNode(member))
 	}
+	const operation = "check connectivity"
+	names := r.pendingNodes(secondaries, operation)
+	var mu sync.Mutex
+	reachable := map[string]error{}
+	r.runConcurrently(secondaries, func(n ControllerNode) {
+		r.config.progress(names[n], operation, NodeRunning, nil)
+		err := n.Ping()
+		r.config.progressDone(names[n], operation, err)
+		mu.Lock()
+		defer mu.Unlock()
+		reachable[names[n]] = err
+	})
 	return reachable
 }
 
@@ -104,49 +489,223 @@ func (r *Restorer) CheckSecondaryControllerNodes() map[string]error {
 func (r *Restorer) StopAgents(stopSecondaries bool) map[string]error {
 	// When stopping agents we want to stop primary last in an attempt to
 	// avoid re-election now - we are stopping anyway.
-	return r.manageAgents(stopSecondaries, false, func(n ControllerNode) error {
-		return n.StopAgent()
+	return r.manageAgents("stop agents", stopSecondaries, false, r.config.NodeDone, func(n ControllerNode) error {
+		if !r.config.manages(MachineAgentService) {
+			return nil
+		}
+		// A failed stop may still have stopped some of the agents.
+		err := n.StopAgent()
+		r.config.nodeChanged(n, "stopped "+string(MachineAgentService), err)
+		return err
 	})
 }
 
 // StartAgents starts controller agents, jujud-machine-*.
 // If stopSecondaries is true, these agents on other controller nodes will be started
 // as well.
-// The agents on the primary node are always started first.
+// The agents on the primary node are always started first. If the
+// database is one of the configured services, juju-db is restarted on
+// each node before its agent is started. With a stage timeout the
+// nodes are started one at a time, see startAgentsStaged.
 func (r *Restorer) StartAgents(startSecondaries bool) map[string]error {
 	// Check replicaset is healthy before restarting agents.
 	r.replicaSetStabilised()
+	start := func(n ControllerNode) error {
+		// The database is restarted first so the agent doesn't lose
+		// its connection to it straight after starting.
+		if r.config.manages(DatabaseService) {
+			err := n.RestartDatabase()
+			r.config.nodeChanged(n, "restarted "+string(DatabaseService), err)
+			if err != nil {
+				return errors.Annotate(err, "restarting database")
+			}
+		}
+		if !r.config.manages(MachineAgentService) {
+			return nil
+		}
+		err := n.StartAgent()
+		if err == nil {
+			r.config.nodeChanged(n, "started "+string(MachineAgentService), nil)
+		}
+		return err
+	}
+	start = r.retrying(start)
+	if r.config.StageTimeout > 0 {
+		return r.startAgentsStaged(startSecondaries, start)
+	}
 	// When starting agents we want to start primary first in an attempt to
 	// preserve it being a primary.
-	return r.manageAgents(startSecondaries, true, func(n ControllerNode) error {
-		return n.StartAgent()
-	})
+	return r.manageAgents("start agents", startSecondaries, true, r.config.NodeDone, start)
 }
 
-func (r *Restorer) replicaSetStabilised() {
-	// keep a copy of replicaset, in case all exponential attempts fail.
-	pre := r.replicaSet
+// retrying returns an operation that runs the one passed in, trying
+// again with exponential backoff up to the configured number of
+// retries if it fails.
+func (r *Restorer) retrying(operation func(ControllerNode) error) func(ControllerNode) error {
+	return func(n ControllerNode) error {
+		attempt := retry.StartWithCancel(
+			retry.LimitCount(r.config.StartRetries+1, retry.Exponential{
+				Initial: startRetryDelay,
+				Factor:  2,
+			}),
+			r.clock(),
+			r.config.Cancel,
+		)
+		var err error
+		for attempt.Next() {
+			err = operation(n)
+			if err == nil {
+				break
+			}
+			if attempt.More() {
+				logger.Warningf("starting agents on %s failed (retrying, attempt %v): %v", n.Name(), attempt.Count(), err)
+			}
+		}
+		if attempt.Stopped() && attempt.Count() == 0 {
+			// Cancelled before the first attempt - the agents are
+			// still started, just not retried.
+			return operation(n)
+		}
+		return err
+	}
+}
 
+// startAgentsStaged starts the primary and then each secondary in
+// turn, waiting for each node to be healthy before starting the next
+// so the nodes don't all rejoin the replica set at once and force
+// elections. If a node fails, the nodes after it aren't started and
+// are reported as skipped.
+func (r *Restorer) startAgentsStaged(all bool, start func(ControllerNode) error) map[string]error {
+	var nodes []ControllerNode
+	for _, member := range r.controllerMembers() {
+		node := r.convertToControllerNode(member)
+		if member.Self {
+			nodes = append([]ControllerNode{node}, nodes...)
+		} else if all {
+			nodes = append(nodes, node)
+		}
+	}
+	const operation = "start agents"
+	names := r.pendingNodes(nodes, operation)
+	result := map[string]error{}
+	var failed string
+	for _, n := range nodes {
+		name := names[n]
+		var err error
+		if failed != "" {
+			err = errors.Errorf("not started - %s failed", failed)
+		} else {
+			r.config.progress(name, operation, NodeRunning, nil)
+			if err = start(n); err == nil {
+				err = r.waitForHealthyNode(n)
+			}
+		}
+		r.config.progressDone(name, operation, err)
+		if err != nil && failed == "" {
+			failed = name
+		}
+		result[name] = err
+		if r.config.NodeDone != nil {
+			r.config.NodeDone(name, err)
+		}
+	}
+	return result
+}
+
+// waitForHealthyNode polls the replica set and the node's agent until
+// they're healthy or the stage timeout passes.
+func (r *Restorer) waitForHealthyNode(n ControllerNode) error {
+	clk := r.clock()
+	deadline := clk.Now().Add(r.config.StageTimeout)
+	for {
+		err := r.checkNodeHealthy(n)
+		if err == nil {
+			return nil
+		}
+		remaining := deadline.Sub(clk.Now())
+		if remaining <= 0 {
+			return errors.Annotatef(err, "not healthy after %s", r.config.StageTimeout)
+		}
+		logger.Debugf("waiting for %s to be healthy: %v", n.Name(), err)
+		wait := stagePollInterval
+		if remaining < wait {
+			wait = remaining
+		}
+		if !r.wait(wait) {
+			logger.Warningf("stopped waiting for %s to be healthy: %v", n.Name(), err)
+			return nil
+		}
+	}
+}
+
+// wait waits for the duration, returning false if it's cancelled
+// first.
+func (r *Restorer) wait(d time.Duration) bool {
+	select {
+	case <-r.clock().After(d):
+		return true
+	case <-r.config.Cancel:
+		return false
+	}
+}
+
+func (r *Restorer) checkNodeHealthy(n ControllerNode) error {
+	replicaSet, err := r.refreshReplicaSet()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkDatabaseState(replicaSet); err != nil {
+		return errors.Annotate(err, "replicaset is sick")
+	}
+	if !r.config.manages(MachineAgentService) {
+		return nil
+	}
+	status, err := n.Status()
+	if err != nil {
+		return errors.Annotate(err, "getting agent status")
+	}
+	if status.AgentState != "active" {
+		return errors.Errorf("agent is %q", status.AgentState)
+	}
+	return nil
+}
+
+func (r *Restorer) replicaSetStabilised() {
+	// The replica set is only refreshed once it's healthy, so if all
+	// the attempts fail the last healthy one is kept.
+	var lastSeen ReplicaSet
 	checkReplicaset := func() error {
 		replicaSet, err := r.db.ReplicaSet()
 		if err != nil {
 			return errors.Annotate(err, "getting database replica set")
 		}
-		// We want to refresh replicaset as we go...
-		r.replicaSet = replicaSet
-		err = r.CheckDatabaseState()
+		lastSeen = replicaSet
+		err = checkDatabaseState(replicaSet)
 		if err != nil {
 			return errors.Annotate(err, "replicaset is sick")
 		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.replicaSet = replicaSet
 		return nil
 	}
 
-	attempt := retry.Start(
-		retry.LimitCount(20, retry.Exponential{
-			Initial: 5 * time.Second,
-			Factor:  1.6,
+	attempts := r.config.StabiliseAttempts
+	if attempts <= 0 {
+		attempts = DefaultStabiliseAttempts
+	}
+	initial := stabiliseDelay
+	if maxWait := r.config.StabiliseMaxWait; maxWait > 0 && maxWait < initial {
+		initial = maxWait
+	}
+	attempt := retry.StartWithCancel(
+		retry.LimitCount(attempts, retry.Exponential{
+			Initial:  initial,
+			Factor:   1.6,
+			MaxDelay: r.config.StabiliseMaxWait,
 		}),
 		clock.WallClock,
+		r.config.Cancel,
 	)
 
 	var err error
@@ -160,17 +719,25 @@ func (r *Restorer) replicaSetStabilised() {
 			logger.Debugf("replicaset is sick (retrying, attempt %v): %v", attempt.Count(), err)
 		}
 	}
-	if err != nil {
-		r.replicaSet = pre
-		logger.Errorf("Could not finish waiting for healthy replicaset")
+	if attempt.Stopped() {
+		logger.Warningf("replicaset stabilisation skipped by operator")
+	} else if err != nil {
+		logger.Errorf("Could not finish waiting for healthy replicaset after %d attempts: %v", attempts, err)
+		for _, member := range lastSeen.Members {
+			logger.Errorf("    %s: %s, healthy: %t", member, strings.ToLower(member.State), member.Healthy)
+		}
 	}
 }
 
-func (r *Restorer) manageAgents(all bool, primaryFirst bool, operation func(n ControllerNode) error) map[string]error {
+// manageAgents runs the operation on the primary node and (if all is
+// true) the secondaries, reporting progress under the operation's
+// name. The primary is handled on its own either before or after the
+// secondaries, which are operated on concurrently up to the configured
+// parallelism. If done is non-nil it's called as each node finishes.
+func (r *Restorer) manageAgents(name string, all bool, primaryFirst bool, done func(string, error), operation func(n ControllerNode) error) map[string]error {
 	var primary ControllerNode
-	result := map[string]error{}
 	secondaries := []ControllerNode{}
-	for _, member := range r.replicaSet.Members {
+	for _, member := range r.controllerMembers() {
 		memberMachine := r.convertToControllerNode(member)
 		if member.Self {
 			primary = memberMachine
@@ -180,28 +747,268 @@ func (r *Restorer) manageAgents(all bool, primaryFirst bool, operation func(n Co
 			secondaries = append(secondaries, memberMachine)
 		}
 	}
-	if primaryFirst {
-		result[primary.IP()] = operation(primary)
+
+	nodes := append([]ControllerNode{primary}, secondaries...)
+	names := r.pendingNodes(nodes, name)
+	var mu sync.Mutex
+	result := map[string]error{}
+	run := func(n ControllerNode) {
+		r.config.progress(names[n], name, NodeRunning, nil)
+		err := operation(n)
+		r.config.progressDone(names[n], name, err)
+		mu.Lock()
+		defer mu.Unlock()
+		result[names[n]] = err
+		if done != nil {
+			done(names[n], err)
+		}
 	}
-	for _, n := range secondaries {
-		result[n.IP()] = operation(n)
+
+	if primaryFirst {
+		run(primary)
 	}
+	r.runConcurrently(secondaries, run)
 	if !primaryFirst {
-		result[primary.IP()] = operation(primary)
+		run(primary)
 	}
 	return result
 }
 
+// pendingNodes looks up the names of the nodes, reporting each one as
+// pending the operation.
+func (r *Restorer) pendingNodes(nodes []ControllerNode, operation string) map[ControllerNode]string {
+	names := make(map[ControllerNode]string)
+	for _, n := range nodes {
+		names[n] = n.Name()
+		r.config.progress(names[n], operation, NodePending, nil)
+	}
+	return names
+}
+
+// NodeStatuses gets the status of the primary node and (if
+// includeSecondaries is true) the other controller nodes, in replica
+// set order.
+func (r *Restorer) NodeStatuses(includeSecondaries bool) []NodeStatusResult {
+	members := r.selectMembers(includeSecondaries)
+	results := make([]NodeStatusResult, len(members))
+	r.runForMembers(members, func(i int, n ControllerNode) {
+		status, err := n.Status()
+		results[i] = NodeStatusResult{
+			Member: members[i],
+			IP:     n.IP(),
+			Status: status,
+			Err:    err,
+		}
+	})
+	return results
+}
+
+// CheckNodeIdentities returns an error if any node's agent.conf shows
+// it isn't the controller machine its replica set member names, or
+// belongs to a different controller - a stale replica set entry
+// whose address has been reused by another machine would otherwise
+// have its agents stopped. Nodes whose identity couldn't be read are
+// skipped.
+func CheckNodeIdentities(statuses []NodeStatusResult, controllerUUID string) error {
+	var problems []string
+	for _, result := range statuses {
+		if result.Err != nil {
+			continue
+		}
+		name := result.Member.Name
+		tag := result.Status.MachineTag
+		expectedTag := "machine-" + result.Member.JujuMachineID
+		if tag == "" {
+			logger.Debugf("couldn't read the machine tag of %s", name)
+		} else if result.Member.JujuMachineID != "" && tag != expectedTag {
+			problems = append(problems, fmt.Sprintf("%s is %s, not %s", name, tag, expectedTag))
+		}
+		uuid := result.Status.ControllerUUID
+		if uuid != "" && controllerUUID != "" && uuid != controllerUUID {
+			problems = append(problems, fmt.Sprintf("%s belongs to controller %s, not %s", name, uuid, controllerUUID))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return NewFailure(PrecheckFailure, errors.Errorf(
+		"controller nodes aren't the machines the replica set names (stale members with reused addresses?): %s",
+		strings.Join(problems, ", "),
+	))
+}
+
+// WaitForAgents polls the status of the primary node and (if
+// includeSecondaries is true) the other controller nodes until every
+// machine agent is active or the timeout passes. It returns the last
+// status of each node, so the nodes whose agents didn't come up can be
+// reported. Errors are postcheck failures.
+func (r *Restorer) WaitForAgents(includeSecondaries bool, timeout time.Duration) ([]NodeStatusResult, error) {
+	clk := r.clock()
+	deadline := clk.Now().Add(timeout)
+	for {
+		results := r.NodeStatuses(includeSecondaries)
+		var waiting []string
+		for _, result := range results {
+			if result.Err != nil || result.Status.AgentState != "active" {
+				waiting = append(waiting, result.Member.Name)
+			}
+		}
+		if len(waiting) == 0 {
+			return results, nil
+		}
+		remaining := deadline.Sub(clk.Now())
+		if remaining <= 0 {
+			err := errors.Errorf("agents not active after %s on %s", timeout, strings.Join(waiting, ", "))
+			return results, NewFailure(PostcheckFailure, err)
+		}
+		logger.Debugf("waiting for agents on %s", strings.Join(waiting, ", "))
+		wait := stagePollInterval
+		if remaining < wait {
+			wait = remaining
+		}
+		if !r.wait(wait) {
+			err := errors.Errorf("stopped waiting for agents on %s", strings.Join(waiting, ", "))
+			return results, NewFailure(PostcheckFailure, err)
+		}
+	}
+}
+
+// ClockSkews gets the time on the primary node and (if
+// includeSecondaries is true) the other controller nodes, and reports
+// how far each clock is from the primary's, in replica set order. Each
+// node's time is compared to the local clock at the midpoint of the
+// call to allow for the time taken to reach it.
+func (r *Restorer) ClockSkews(includeSecondaries bool) []ClockSkew {
+	clk := r.clock()
+	members := r.selectMembers(includeSecondaries)
+	results := make([]ClockSkew, len(members))
+	r.runForMembers(members, func(i int, n ControllerNode) {
+		results[i].Member = members[i]
+		before := clk.Now()
+		nodeTime, err := n.Time()
+		if err != nil {
+			results[i].Err = err
+			return
+		}
+		after := clk.Now()
+		results[i].Skew = nodeTime.Sub(before.Add(after.Sub(before) / 2))
+	})
+	// Make the offsets from the local clock relative to the primary,
+	// if we could get its time.
+	for _, result := range results {
+		if result.Member.Self && result.Err == nil {
+			primarySkew := result.Skew
+			for i := range results {
+				results[i].Skew -= primarySkew
+			}
+			break
+		}
+	}
+	return results
+}
+
+// selectMembers returns the primary and (if includeSecondaries is
+// true) the other controller members, in replica set order.
+func (r *Restorer) selectMembers(includeSecondaries bool) []ReplicaSetMember {
+	var result []ReplicaSetMember
+	for _, member := range r.controllerMembers() {
+		if member.Self || includeSecondaries {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// runForMembers calls run concurrently for the controller node of
+// each member, passing the member's index. Each call should only
+// write to its own result.
+func (r *Restorer) runForMembers(members []ReplicaSetMember, run func(int, ControllerNode)) {
+	nodes := make([]ControllerNode, len(members))
+	index := make(map[ControllerNode]int)
+	for i, member := range members {
+		nodes[i] = r.convertToControllerNode(member)
+		index[nodes[i]] = i
+	}
+	r.runConcurrently(nodes, func(n ControllerNode) {
+		run(index[n], n)
+	})
+}
+
+func (r *Restorer) clock() clock.Clock {
+	if r.config.Clock == nil {
+		return clock.WallClock
+	}
+	return r.config.Clock
+}
+
+// runConcurrently calls run for each of the nodes, with no more than
+// the configured parallelism running at once, and waits for them all
+// to finish.
+func (r *Restorer) runConcurrently(nodes []ControllerNode, run func(ControllerNode)) {
+	parallelism := r.config.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(n ControllerNode) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			run(n)
+		}(n)
+	}
+	wg.Wait()
+}
+
 // CheckRestorable checks whether the backup file can be restored into
-// the target database.
-func (r *Restorer) CheckRestorable(allowDowngrade, copyController bool) (*PrecheckResult, error) {
+// the target database. Errors are precheck failures.
+func (r *Restorer) CheckRestorable(allowDowngrade bool) (*PrecheckResult, error) {
+	result, err := r.checkRestorable(allowDowngrade)
+	return result, NewFailure(PrecheckFailure, err)
+}
+
+// CheckCopyable checks whether the backup's controller can be copied
+// into the target controller. A copy's UUIDs, HA node count and series
+// are expected to differ from the backup's, so instead of comparing
+// them it checks the versions are ones copying supports and that the
+// target hosts no workload models, and reports which of the target's
+// users and clouds the backup's will replace. Errors are precheck
+// failures.
+func (r *Restorer) CheckCopyable(allowDowngrade bool) (*PrecheckResult, error) {
+	result, err := r.checkCopyable(allowDowngrade)
+	return result, NewFailure(PrecheckFailure, err)
+}
+
+// readBackupAndController returns the backup's metadata and the
+// controller's info. They don't depend on each other, so they're
+// fetched together.
+func (r *Restorer) readBackupAndController() (BackupMetadata, ControllerInfo, error) {
+	var controller ControllerInfo
+	var controllerErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		controller, controllerErr = r.db.ControllerInfo()
+	}()
 	backup, err := r.backup.Metadata()
+	wg.Wait()
 	if err != nil {
-		return nil, errors.Annotate(err, "getting backup metadata")
+		return BackupMetadata{}, ControllerInfo{}, errors.Annotate(err, "getting backup metadata")
 	}
-	controller, err := r.db.ControllerInfo()
+	if controllerErr != nil {
+		return BackupMetadata{}, ControllerInfo{}, errors.Annotate(controllerErr, "getting controller info")
+	}
+	return backup, controller, nil
+}
+
+func (r *Restorer) checkRestorable(allowDowngrade bool) (*PrecheckResult, error) {
+	backup, controller, err := r.readBackupAndController()
 	if err != nil {
-		return nil, errors.Annotate(err, "getting controller info")
+		return nil, errors.Trace(err)
 	}
 
 	// Disregard differences in build numbers - we don't want to
@@ -219,95 +1026,449 @@ func (r *Restorer) CheckRestorable(allowDowngrade, copyController bool) (*Preche
 			)
 
 		}
-	} else {
-		if copyController {
-			if backupVersion.Compare(controllerVersion) == 1 {
-				return nil, errors.Errorf("when copying a controller, backup version %q must be less than or equal to target controller %q", backupVersion, controllerVersion)
-			}
-			if backupVersion.Compare(version.MustParse("2.9.37")) == -1 {
-				return nil, errors.New("when copying a controller, backup version must be at least 2.9.37")
-			}
-			if controllerVersion.Major > backupVersion.Major+1 {
-				return nil, errors.New("when copying a controller, backup version must not be older than one major version less")
-			}
-		} else if backupVersion.Compare(controllerVersion) == -1 {
-			return nil, errors.Errorf("restoring backup would downgrade from juju %q to %q - pass --allow-downgrade if this is intended", controllerVersion, backupVersion)
-		} else if controllerVersion != backupVersion {
-			return nil, errors.Errorf("juju versions don't match - backup: %q, controller: %q",
-				backup.JujuVersion,
-				controller.JujuVersion,
-			)
-		}
+	} else if backupVersion.Compare(controllerVersion) == -1 {
+		return nil, errors.Errorf("restoring backup would downgrade from juju %q to %q - pass --allow-downgrade if this is intended", controllerVersion, backupVersion)
+	} else if controllerVersion != backupVersion {
+		return nil, errors.Errorf("juju versions don't match - backup: %q, controller: %q",
+			backup.JujuVersion,
+			controller.JujuVersion,
+		)
 	}
 
-	if !copyController && backup.ControllerModelUUID != controller.ControllerModelUUID {
+	if backup.ControllerModelUUID != controller.ControllerModelUUID {
 		return nil, errors.Errorf("controller model uuids don't match - backup: %q, controller: %q",
 			backup.ControllerModelUUID,
 			controller.ControllerModelUUID,
 		)
 	}
-	if copyController && controller.Models > 1 {
-		return nil, errors.Errorf("cannot copy controller when target controller hosts %d workload model(s)", controller.Models-1)
-	}
 
-	if !copyController && backup.HANodes != controller.HANodes {
+	if backup.HANodes != controller.HANodes {
 		return nil, errors.Errorf("controller HA node counts don't match - backup: %d, controller: %d",
 			backup.HANodes,
 			controller.HANodes,
 		)
 	}
 
-	if !copyController && backup.Series != controller.Series {
+	// Juju 3.x controllers have a base rather than a series, so
+	// there's nothing to compare.
+	if controller.Series != "" && backup.Series != controller.Series {
 		return nil, errors.Errorf("controller series don't match - backup: %q, controller: %q",
 			backup.Series,
 			controller.Series,
 		)
 	}
 
+	restorePoint, err := r.checkIncrementals(backup)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return r.precheckResult(backup, controller, restorePoint), nil
+}
+
+func (r *Restorer) checkCopyable(allowDowngrade bool) (*PrecheckResult, error) {
+	backup, controller, err := r.readBackupAndController()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(r.config.Incrementals) > 0 {
+		return nil, errors.New("incremental backups can't be applied when copying a controller")
+	}
+
+	controllerVersion := controller.JujuVersion
+	controllerVersion.Build = 0
+	backupVersion := backup.JujuVersion
+	backupVersion.Build = 0
+
+	if allowDowngrade {
+		if backupVersion.Compare(controllerVersion) == 1 {
+			return nil, errors.Errorf("backup juju version %q is greater than controller version %q",
+				backup.JujuVersion,
+				controller.JujuVersion,
+			)
+		}
+	} else {
+		if backupVersion.Compare(controllerVersion) == 1 {
+			return nil, errors.Errorf("when copying a controller, backup version %q must be less than or equal to target controller %q", backupVersion, controllerVersion)
+		}
+		if backupVersion.Compare(version.MustParse("2.9.37")) == -1 {
+			return nil, errors.New("when copying a controller, backup version must be at least 2.9.37")
+		}
+		if controllerVersion.Major > backupVersion.Major+1 {
+			return nil, errors.New("when copying a controller, backup version must not be older than one major version less")
+		}
+	}
+
+	if controller.Models > 1 {
+		return nil, errors.Errorf("cannot copy controller when target controller hosts %d workload model(s)", controller.Models-1)
+	}
+
+	backupEntities, err := r.backup.Entities()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading backup users and clouds")
+	}
+	targetEntities, err := r.db.ControllerEntities()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading controller users and clouds")
+	}
+	result := r.precheckResult(backup, controller, time.Time{})
+	result.Copy = &CopyPrecheck{
+		TargetUsers:  len(targetEntities.Users),
+		TargetClouds: len(targetEntities.Clouds),
+		// Copying keeps the target's admin user and the cloud its
+		// controller model is on.
+		UserCollisions:  collisions(backupEntities.Users, targetEntities.Users, "admin"),
+		CloudCollisions: collisions(backupEntities.Clouds, targetEntities.Clouds, controller.ControllerModelCloud),
+	}
+	return result, nil
+}
+
+// precheckResult describes restoring or copying the backup into the
+// controller.
+func (r *Restorer) precheckResult(backup BackupMetadata, controller ControllerInfo, restorePoint time.Time) *PrecheckResult {
 	return &PrecheckResult{
-		BackupDate:            backup.BackupCreated,
-		ControllerUUID:        backup.ControllerUUID,
-		ControllerModelUUID:   backup.ControllerModelUUID,
-		BackupJujuVersion:     backup.JujuVersion,
-		ControllerJujuVersion: controller.JujuVersion,
-		ModelCount:            backup.ModelCount,
-		CloudCount:            backup.CloudCount,
-	}, nil
+		Incrementals:                len(r.config.Incrementals),
+		RestorePoint:                restorePoint,
+		BackupID:                    backup.ID,
+		BackupDate:                  backup.BackupCreated,
+		ControllerUUID:              backup.ControllerUUID,
+		TargetControllerUUID:        controller.ControllerUUID,
+		ControllerModelUUID:         backup.ControllerModelUUID,
+		ControllerMachineID:         backup.ControllerMachineID,
+		ControllerMachineInstanceID: backup.ControllerMachineInstanceID,
+		BackupJujuVersion:           backup.JujuVersion,
+		ControllerJujuVersion:       controller.JujuVersion,
+		ModelCount:                  backup.ModelCount,
+		CloudCount:                  backup.CloudCount,
+		MetadataInferred:            backup.Inferred,
+		Oplog:                       backup.Oplog,
+		Databases:                   backup.Databases,
+	}
+}
+
+// collisions returns the names in both backup and target, apart from
+// kept, sorted.
+func collisions(backup, target []string, kept string) []string {
+	inTarget := make(map[string]bool)
+	for _, name := range target {
+		inTarget[name] = true
+	}
+	var result []string
+	for _, name := range backup {
+		if name != kept && inTarget[name] {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// checkIncrementals checks that the incremental backups form a chain
+// from the backup and returns the time the restored data will reflect
+// once they're applied.
+func (r *Restorer) checkIncrementals(base BackupMetadata) (time.Time, error) {
+	if base.Incremental() {
+		return time.Time{}, errors.Errorf("backup %q is incremental - restore the full backup it follows from with the incrementals after it", base.ID)
+	}
+	if len(r.config.Incrementals) == 0 {
+		if !r.config.Until.IsZero() {
+			return time.Time{}, errors.New("a restore point can only be given when applying incremental backups")
+		}
+		return time.Time{}, nil
+	}
+	if base.OplogEnd == 0 {
+		return time.Time{}, errors.Errorf("backup %q doesn't record its oplog position so incrementals can't be applied to it", base.ID)
+	}
+	if !r.config.Until.IsZero() && r.config.Until.Before(base.OplogEnd.Time()) {
+		return time.Time{}, errors.Errorf("restore point %s is before the end of backup %q (%s)",
+			r.config.Until.UTC(), base.ID, base.OplogEnd.Time())
+	}
+	previous := base
+	for _, incremental := range r.config.Incrementals {
+		metadata, err := incremental.Metadata()
+		if err != nil {
+			return time.Time{}, errors.Annotate(err, "getting incremental backup metadata")
+		}
+		if !metadata.Incremental() {
+			return time.Time{}, errors.Errorf("backup %q isn't incremental", metadata.ID)
+		}
+		if metadata.ControllerModelUUID != base.ControllerModelUUID {
+			return time.Time{}, errors.Errorf("incremental backup %q is from a different controller model (%q, not %q)",
+				metadata.ID, metadata.ControllerModelUUID, base.ControllerModelUUID)
+		}
+		if metadata.ParentID != previous.ID {
+			return time.Time{}, errors.Errorf("incremental backup %q follows %q, not %q", metadata.ID, metadata.ParentID, previous.ID)
+		}
+		// Replaying an operation twice is harmless, missing one isn't.
+		if metadata.OplogStart > previous.OplogEnd {
+			return time.Time{}, errors.Errorf("incremental backup %q starts at %s, after %q ends at %s",
+				metadata.ID, metadata.OplogStart.Time(), previous.ID, previous.OplogEnd.Time())
+		}
+		previous = metadata
+	}
+	restorePoint := previous.OplogEnd.Time()
+	if until := r.config.Until.UTC().Truncate(time.Second); !until.IsZero() && until.Before(restorePoint) {
+		restorePoint = until
+	}
+	return restorePoint, nil
 }
 
 // Restore replaces the database's contents with the data from the
-// backup's database dump.
-func (r *Restorer) Restore(logPath string, includeStatusHistory, copyController bool) error {
+// backup's database dump. Errors are restore failures.
+func (r *Restorer) Restore(options RestoreOptions) (*RestoreResult, error) {
+	result, err := r.restore(options)
+	return result, NewFailure(RestoreFailure, err)
+}
+
+// PreviousControllerCopy returns the record of an earlier copy of
+// the prechecked backup's controller data into this one, or nil if
+// there wasn't one.
+func (r *Restorer) PreviousControllerCopy(precheck *PrecheckResult) (*ControllerCopy, error) {
+	previous, err := r.db.ControllerCopy()
+	if err != nil {
+		return nil, errors.Annotate(err, "checking for an earlier controller copy")
+	}
+	if previous == nil || previous.Source != precheck.ControllerUUID || previous.Backup != copyKey(precheck.BackupID, precheck.BackupDate) {
+		return nil, nil
+	}
+	return previous, nil
+}
+
+// copyKey identifies a backup for recording the progress of copying
+// it: its ID if it has one, otherwise when it was made.
+func copyKey(id string, created time.Time) string {
+	if id != "" {
+		return id
+	}
+	return created.UTC().Format(time.RFC3339Nano)
+}
+
+// PlanPermissionCopy returns what copying the source controller's
+// data would do with each of its permission documents, without
+// changing anything.
+func (r *Restorer) PlanPermissionCopy() ([]PermissionRewrite, error) {
+	controller, err := r.db.ControllerInfo()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting controller info")
+	}
+	docs, err := r.backup.Permissions()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading source permissions")
+	}
+	return PlanPermissionCopy(docs, controller), nil
+}
+
+// dropStaging removes the staging database left by a copy or merge
+// that failed. It only holds part of the backup, and restoring again
+// recreates it.
+func (r *Restorer) dropStaging() {
+	dropped, err := r.db.DropStagingDatabase()
+	if err != nil {
+		logger.Warningf("couldn't remove the staging database, run juju-restore cleanup to remove it: %v", err)
+		r.config.changed("database", "couldn't remove the staging database (run juju-restore cleanup)", err)
+	} else if dropped {
+		r.config.changed("database", "removed the partly copied staging database", nil)
+	}
+}
+
+func (r *Restorer) restore(options RestoreOptions) (*RestoreResult, error) {
 	controller, err := r.db.ControllerInfo()
 	if err != nil {
-		return errors.Annotate(err, "getting controller info")
+		return nil, errors.Annotate(err, "getting controller info")
 	}
 	metadata, err := r.backup.Metadata()
 	if err != nil {
-		return errors.Annotatef(err, "getting backup metadata")
+		return nil, errors.Annotatef(err, "getting backup metadata")
+	}
+	// Replaying an oplog would change the live database.
+	if options.TargetDatabase != "" && len(r.config.Incrementals) > 0 {
+		return nil, errors.New("incremental backups can't be applied when restoring into another database")
+	}
+	if (options.UsersOnly || options.CloudsOnly || options.SettingsOnly) && len(r.config.Incrementals) > 0 {
+		return nil, errors.New("incremental backups can't be applied when restoring only some collections")
+	}
+	source, live := r.backup.(*liveSource)
+	if live && !options.CopyController {
+		return nil, errors.New("a running controller can only be copied, not restored")
+	}
+	if live && options.CopyAgentBinaries {
+		return nil, errors.New("agent binaries can only be copied from a backup file")
+	}
+	var collections []RestoredCollection
+	var digest RestoreLogDigest
+	if live {
+		logger.Debugf("copying from the source controller")
+		collections, err = r.db.StageFrom(source.db)
+	} else {
+		logger.Debugf("restoring dump")
+		collections, digest, err = r.db.RestoreFromDump(r.backup.DumpDirectory(), options)
+	}
+	// Collections restored before a failure have still been replaced.
+	for _, collection := range collections {
+		r.config.changed(collection.Name, fmt.Sprintf("replaced with %d documents", collection.Documents), nil)
+	}
+	if live && err != nil {
+		r.config.changed("database", "copying from the source controller stopped part way", err)
+		r.dropStaging()
+		return nil, errors.Annotate(err, "copying from the source controller")
 	}
-	logger.Debugf("restoring dump")
-	err = r.db.RestoreFromDump(r.backup.DumpDirectory(), logPath, includeStatusHistory, copyController)
 	if err != nil {
-		return errors.Annotatef(err, "restoring dump from %q", r.backup.DumpDirectory())
+		r.config.changed("database", "restore from dump stopped part way", err)
+		if options.usesStaging() {
+			r.dropStaging()
+		}
+		return nil, errors.Annotatef(err, "restoring dump from %q", r.backup.DumpDirectory())
+	}
+	if options.TargetDatabase != "" {
+		// The controller is still running on the live database, so
+		// its agents' versions are left as they are.
+		return &RestoreResult{
+			Collections:         collections,
+			PreviousJujuVersion: controller.JujuVersion,
+			JujuVersion:         controller.JujuVersion,
+			LogDigest:           digest,
+		}, nil
+	}
+	if err := r.applyIncrementals(options.LogFile); err != nil {
+		return nil, errors.Trace(err)
+	}
+	result := &RestoreResult{
+		Collections:         collections,
+		PreviousJujuVersion: controller.JujuVersion,
+		JujuVersion:         controller.JujuVersion,
+		LogDigest:           digest,
+	}
+	if options.IncludeLogs && options.LogsMaxAge > 0 {
+		before := metadata.BackupCreated.Add(-options.LogsMaxAge)
+		logger.Debugf("removing log entries from before %s", before)
+		result.LogsTrimmed, err = r.db.TrimLogs(before)
+		if err != nil {
+			r.config.changed("logs", "removing old log entries stopped part way", err)
+			return nil, errors.Annotate(err, "trimming restored logs")
+		}
+		r.config.changed("logs", fmt.Sprintf("removed %d log entries", result.LogsTrimmed), nil)
 	}
 
-	if copyController {
-		if err := r.db.CopyController(controller); err != nil {
-			return errors.Annotate(err, "problems copying source controller info")
+	if options.UsersOnly {
+		result.Merged, err = r.db.MergeUsers(options.OverwriteUsers)
+		for _, merged := range result.Merged {
+			r.config.changed(merged.Name, fmt.Sprintf("merged users: %d added, %d replaced, %d kept", merged.Added, merged.Replaced, merged.Kept), nil)
 		}
-		return nil
+		if err != nil {
+			r.config.changed("database", "merging users stopped part way", err)
+			r.dropStaging()
+			return nil, errors.Annotate(err, "merging users")
+		}
+		return result, nil
+	}
+
+	if options.CloudsOnly {
+		err := r.db.CopyClouds()
+		r.config.changed("database", "copied the backup's clouds and credentials", err)
+		if err != nil {
+			r.dropStaging()
+			return nil, errors.Annotate(err, "copying clouds")
+		}
+		return result, nil
+	}
+
+	if options.SettingsOnly {
+		result.SettingsChanged, err = r.db.CopySettings()
+		if err != nil {
+			r.config.changed("controller settings", "restoring settings stopped part way", err)
+			r.dropStaging()
+			return nil, errors.Annotate(err, "copying controller settings")
+		}
+		if len(result.SettingsChanged) > 0 {
+			r.config.changed("controller settings", "restored "+strings.Join(result.SettingsChanged, ", "), nil)
+		}
+		return result, nil
+	}
+
+	if options.CopyController {
+		var copied ControllerCopyResult
+		copied, err = r.db.CopyController(controller, metadata.ControllerUUID, copyKey(metadata.ID, metadata.BackupCreated), options)
+		result.CopySkipped = copied.Skipped
+		result.SettingsChanged = copied.SettingsChanged
+		result.Permissions = copied.Permissions
+		result.AgentBinaries = copied.AgentBinaries
+		for _, permission := range copied.Permissions {
+			logger.Debugf("permission %s", permission)
+		}
+		if len(copied.Permissions) > 0 {
+			counts := CountPermissions(copied.Permissions)
+			r.config.changed("permissions", fmt.Sprintf("copied %d, %d of them rewritten for this controller, skipped %d",
+				counts.Copied, counts.Rewritten, counts.Skipped), nil)
+		}
+		if len(result.CopySkipped) > 0 {
+			r.config.changed("database", "skipped what an earlier copy completed: "+strings.Join(result.CopySkipped, ", "), nil)
+		}
+		if len(result.SettingsChanged) > 0 {
+			r.config.changed("controller settings", "copied "+strings.Join(result.SettingsChanged, ", "), nil)
+		}
+		if len(result.AgentBinaries) > 0 {
+			r.config.changed("blobstore", "copied agent binaries "+strings.Join(result.AgentBinaries, ", "), nil)
+		}
+		r.config.changed("database", "copied the backup's controller data", err)
+		if err != nil {
+			r.dropStaging()
+			return nil, errors.Annotate(err, "problems copying source controller info")
+		}
+		// The copy has worked, so not being able to check is only
+		// worth a warning.
+		result.Readiness, err = r.checkMigrationReadiness(controller)
+		if err != nil {
+			logger.Warningf("couldn't check the models can be migrated: %v", err)
+		}
+		return result, nil
 	}
 
 	if controller.JujuVersion != metadata.JujuVersion {
 		logger.Debugf("updating controller agent versions to %s", metadata.JujuVersion)
-		results := r.manageAgents(true, true, func(n ControllerNode) error {
+		results := r.manageAgents("update agent version", true, true, nil, func(n ControllerNode) error {
 			logger.Debugf("    %s", n)
 			err := n.UpdateAgentVersion(metadata.JujuVersion)
+			r.config.nodeChanged(n, "updated agent version to "+metadata.JujuVersion.String(), err)
 			return errors.Annotatef(err, "updating %s", n)
 		})
 		if err := collectMachineErrors(results); err != nil {
-			return errors.Annotatef(err, "problems updating controllers to version %q", metadata.JujuVersion)
+			return nil, errors.Annotatef(err, "problems updating controllers to version %q", metadata.JujuVersion)
+		}
+		result.JujuVersion = metadata.JujuVersion
+	}
+	return result, nil
+}
+
+// applyIncrementals replays the backup's oplog, which brings the
+// restored data up to the end of the backup, and then the oplog of
+// each incremental backup in turn.
+func (r *Restorer) applyIncrementals(logPath string) error {
+	if len(r.config.Incrementals) == 0 {
+		return nil
+	}
+	// The limit is exclusive, so stop at the start of the next
+	// second to include all the operations in the Until second.
+	var limit OplogPosition
+	if !r.config.Until.IsZero() {
+		limit = NewOplogPosition(r.config.Until.Truncate(time.Second).Add(time.Second), 0)
+	}
+	backups := append([]BackupFile{r.backup}, r.config.Incrementals...)
+	for i, backup := range backups {
+		metadata, err := backup.Metadata()
+		if err != nil {
+			return errors.Annotate(err, "getting backup metadata")
+		}
+		if limit != 0 && metadata.OplogStart >= limit {
+			logger.Debugf("skipping %q and later incrementals - after restore point", metadata.ID)
+			break
+		}
+		if i > 0 {
+			logger.Debugf("applying incremental backup %q", metadata.ID)
+		}
+		oplogFile := filepath.Join(backup.DumpDirectory(), oplogFileName)
+		err = r.db.ReplayOplog(oplogFile, logPath, limit)
+		r.config.changed("database", fmt.Sprintf("replayed oplog from %q", metadata.ID), err)
+		if err != nil {
+			return errors.Annotatef(err, "replaying oplog from %q", metadata.ID)
 		}
 	}
 	return nil
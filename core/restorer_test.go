@@ -4,9 +4,13 @@
 package core_test
 
 import (
+	"fmt"
 	"regexp"
+	"sync"
 	"time"
 
+	"github.com/juju/clock"
+	"github.com/juju/clock/testclock"
 	"github.com/juju/errors"
 	"github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
@@ -14,12 +18,16 @@ import (
 	gc "gopkg.in/check.v1"
 
 	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/coretesting"
 	"github.com/juju/juju-restore/machine"
 )
 
 type restorerSuite struct {
 	testing.IsolationSuite
 	converter func(member core.ReplicaSetMember) core.ControllerNode
+
+	// services is used in the restorer config by checkManagedAgents.
+	services []core.Service
 }
 
 var _ = gc.Suite(&restorerSuite{})
@@ -27,12 +35,14 @@ var _ = gc.Suite(&restorerSuite{})
 func (s *restorerSuite) SetUpTest(c *gc.C) {
 	s.IsolationSuite.SetUpTest(c)
 	s.converter = machine.ControllerNodeForReplicaSetMember
+	s.services = nil
 }
 
 func (s *restorerSuite) TestCheckDatabaseStateUnhealthyMembers(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       false,
 					ID:            1,
@@ -54,17 +64,53 @@ func (s *restorerSuite) TestCheckDatabaseStateUnhealthyMembers(c *gc.C) {
 				}},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	err = r.CheckDatabaseState()
 	c.Assert(err, jc.Satisfies, core.IsUnhealthyMembersError)
 	c.Assert(err, gc.ErrorMatches, regexp.QuoteMeta(`unhealthy replica set members: 1 "kaira-ba" (juju machine 0), 3 "bibi" (juju machine 2)`))
 }
 
+func (s *restorerSuite) TestRepairMachineIDTags(c *gc.C) {
+	db := &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{
+				Name: "juju",
+				Members: []core.ReplicaSetMember{{
+					ID:            1,
+					Name:          "djula",
+					JujuMachineID: "0",
+				}, {
+					ID:                2,
+					Name:              "kaira-ba",
+					JujuMachineID:     "1",
+					MachineIDInferred: true,
+				}},
+			}, nil
+		},
+	}
+	r, err := core.NewRestorer(db, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	inferred := r.InferredMachineIDs()
+	c.Assert(inferred, gc.HasLen, 1)
+	c.Assert(inferred[0].Name, gc.Equals, "kaira-ba")
+
+	err = r.RepairMachineIDTags()
+	c.Assert(err, jc.ErrorIsNil)
+	db.CheckCall(c, 1, "SetMachineIDTags", map[int]string{2: "1"})
+	c.Assert(r.InferredMachineIDs(), gc.HasLen, 0)
+
+	// Nothing left to repair.
+	err = r.RepairMachineIDTags()
+	c.Assert(err, jc.ErrorIsNil)
+	db.CheckCallNames(c, "ReplicaSet", "SetMachineIDTags")
+}
+
 func (s *restorerSuite) TestCheckDatabaseStateNoPrimary(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            1,
@@ -86,16 +132,113 @@ func (s *restorerSuite) TestCheckDatabaseStateNoPrimary(c *gc.C) {
 				}},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	err = r.CheckDatabaseState()
 	c.Assert(err, gc.ErrorMatches, "no primary found in replica set")
 }
 
+func (s *restorerSuite) TestCheckDatabaseStateReplicaSetName(c *gc.C) {
+	database := &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{
+				Name: "appdb",
+				Members: []core.ReplicaSetMember{{
+					Healthy:       true,
+					ID:            1,
+					Name:          "djula",
+					State:         "PRIMARY",
+					Self:          true,
+					JujuMachineID: "0",
+				}},
+			}, nil
+		},
+	}
+	r, err := core.NewRestorer(database, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	err = r.CheckDatabaseState()
+	c.Assert(err, gc.ErrorMatches, `connected to replica set "appdb", not "juju" - this may not be the Juju database .*`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+
+	r, err = core.NewRestorer(database, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		ReplicaSetName: "appdb",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.CheckDatabaseState(), jc.ErrorIsNil)
+}
+
+func (s *restorerSuite) TestCheckDatabaseStateDialsMembers(c *gc.C) {
+	members := []core.ReplicaSetMember{{
+		Healthy:       true,
+		ID:            1,
+		Name:          "djula:37017",
+		State:         "PRIMARY",
+		Self:          true,
+		JujuMachineID: "0",
+	}, {
+		Healthy:       true,
+		ID:            2,
+		Name:          "wot:37017",
+		State:         "SECONDARY",
+		JujuMachineID: "1",
+	}, {
+		Healthy:       true,
+		ID:            3,
+		Name:          "bibi:37017",
+		State:         "SECONDARY",
+		JujuMachineID: "2",
+	}, {
+		Healthy: true,
+		ID:      4,
+		Name:    "kaira-ba:37017",
+		State:   "ARBITER",
+		Arbiter: true,
+	}}
+	// Each member sees itself as it's configured here.
+	states := map[string]string{"wot:37017": "SECONDARY", "bibi:37017": "SECONDARY"}
+	var dialed []string
+	var mu sync.Mutex
+	dial := func(member core.ReplicaSetMember) (core.Database, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, member.Name)
+		state, ok := states[member.Name]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+		return &coretesting.Database{
+			ReplicaSetF: func() (core.ReplicaSet, error) {
+				return core.ReplicaSet{
+					Name:    "juju",
+					Members: []core.ReplicaSetMember{{Name: member.Name, State: state, Self: true}},
+				}, nil
+			},
+		}, nil
+	}
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{Name: "juju", Members: members}, nil
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{DialMember: dial})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.CheckDatabaseState(), jc.ErrorIsNil)
+	// The primary and arbiter aren't dialled.
+	c.Assert(dialed, jc.SameContents, []string{"wot:37017", "bibi:37017"})
+
+	states["wot:37017"] = "RECOVERING"
+	delete(states, "bibi:37017")
+	err = r.CheckDatabaseState()
+	c.Assert(err, gc.ErrorMatches, "replica set members don't match the primary's status: "+
+		"wot:37017 reports itself RECOVERING but the primary sees it as SECONDARY, "+
+		"bibi:37017 can't be reached: connection refused")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+}
+
 func (s *restorerSuite) TestCheckDatabaseStateNotPrimary(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            1,
@@ -118,16 +261,17 @@ func (s *restorerSuite) TestCheckDatabaseStateNotPrimary(c *gc.C) {
 				}},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	err = r.CheckDatabaseState()
 	c.Assert(err, gc.ErrorMatches, regexp.QuoteMeta(`not running on primary replica set member, primary is 2 "djula" (juju machine 2)`))
 }
 
 func (s *restorerSuite) TestCheckDatabaseStateAllGood(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            1,
@@ -150,7 +294,7 @@ func (s *restorerSuite) TestCheckDatabaseStateAllGood(c *gc.C) {
 				}},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	err = r.CheckDatabaseState()
 	c.Assert(err, jc.ErrorIsNil)
@@ -158,9 +302,10 @@ func (s *restorerSuite) TestCheckDatabaseStateAllGood(c *gc.C) {
 }
 
 func (s *restorerSuite) TestCheckDatabaseStateOneMember(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            2,
@@ -171,7 +316,7 @@ func (s *restorerSuite) TestCheckDatabaseStateOneMember(c *gc.C) {
 				}},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	err = r.CheckDatabaseState()
 	c.Assert(err, jc.ErrorIsNil)
@@ -179,9 +324,10 @@ func (s *restorerSuite) TestCheckDatabaseStateOneMember(c *gc.C) {
 }
 
 func (s *restorerSuite) TestCheckDatabaseStateMissingJujuID(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy: true,
 					ID:      2,
@@ -191,16 +337,121 @@ func (s *restorerSuite) TestCheckDatabaseStateMissingJujuID(c *gc.C) {
 				}},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	err = r.CheckDatabaseState()
 	c.Assert(err, gc.ErrorMatches, regexp.QuoteMeta(`unhealthy replica set members: 2 "djula" (juju machine )`))
 }
 
+func laggedReplicaSet() (core.ReplicaSet, error) {
+	return core.ReplicaSet{
+		Name: "juju",
+		Members: []core.ReplicaSetMember{{
+			Healthy:       true,
+			ID:            1,
+			Name:          "djula",
+			State:         "PRIMARY",
+			Self:          true,
+			JujuMachineID: "0",
+		}, {
+			Healthy:       true,
+			ID:            2,
+			Name:          "kaira-ba",
+			State:         "SECONDARY",
+			JujuMachineID: "1",
+			Lag:           2 * time.Second,
+		}, {
+			Healthy:       true,
+			ID:            3,
+			Name:          "bibi",
+			State:         "SECONDARY",
+			JujuMachineID: "2",
+			Lag:           5 * time.Minute,
+		}, {
+			Healthy: true,
+			ID:      4,
+			Name:    "backups",
+			State:   "SECONDARY",
+			Hidden:  true,
+			Delay:   time.Hour,
+			Lag:     time.Hour + time.Second,
+		}},
+		OplogWindow: 48 * time.Hour,
+	}, nil
+}
+
+func (s *restorerSuite) TestCheckReplicationLag(c *gc.C) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: laggedReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	err = r.CheckReplicationLag(time.Minute)
+	c.Assert(err, jc.Satisfies, core.IsLaggedMembersError)
+	c.Assert(err, gc.ErrorMatches, regexp.QuoteMeta(`replica set members more than 1m0s behind the primary: 3 "bibi" (juju machine 2) lagging by 5m0s (oplog window 48h0m0s)`))
+	c.Assert(r.CheckReplicationLag(10*time.Minute), jc.ErrorIsNil)
+}
+
+func (s *restorerSuite) TestCheckReplicationLagBeyondOplogWindow(c *gc.C) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			rs, _ := laggedReplicaSet()
+			rs.OplogWindow = 3 * time.Minute
+			return rs, nil
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	err = r.CheckReplicationLag(10 * time.Minute)
+	c.Assert(err, gc.ErrorMatches, `replica set members more than 10m0s behind the primary: 3 "bibi" .* lagging by 5m0s, 4 "backups" .* lagging by 1h0m1s \(oplog window 3m0s\)`)
+}
+
+func (s *restorerSuite) TestCheckActiveOperations(c *gc.C) {
+	db := &coretesting.Database{
+		ReplicaSetF: controllerNodesReplicaSet,
+		Active: core.ActiveOperations{
+			Migrations:           []string{"bob/foo (exporting)", "mary/bar (importing)"},
+			Backups:              1,
+			ProvisioningMachines: 2,
+		},
+	}
+	r, err := core.NewRestorer(db, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	active, err := r.CheckActiveOperations(false)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	c.Assert(err, gc.ErrorMatches, regexp.QuoteMeta(`the controller is running model migrations (bob/foo (exporting), mary/bar (importing)) and 1 database backups`))
+	c.Assert(active, jc.DeepEquals, db.Active)
+
+	active, err = r.CheckActiveOperations(true)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(active, jc.DeepEquals, db.Active)
+}
+
+func (s *restorerSuite) TestCheckActiveOperationsProvisioningOnly(c *gc.C) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: controllerNodesReplicaSet,
+		Active:      core.ActiveOperations{ProvisioningUnits: 3},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	active, err := r.CheckActiveOperations(false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(active.Any(), jc.IsTrue)
+	c.Assert(active.Blocking(), jc.IsFalse)
+}
+
+func (s *restorerSuite) TestCheckActiveOperationsError(c *gc.C) {
+	db := &coretesting.Database{ReplicaSetF: controllerNodesReplicaSet}
+	db.SetErrors(errors.New("currentOp unauthorized"))
+	r, err := core.NewRestorer(db, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = r.CheckActiveOperations(false)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	c.Assert(err, gc.ErrorMatches, "checking for running operations: currentOp unauthorized")
+}
+
 func (s *restorerSuite) TestCheckSecondaryControllerNodesSkipsSelf(c *gc.C) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{
 					{
 						Healthy:       true,
@@ -213,15 +464,16 @@ func (s *restorerSuite) TestCheckSecondaryControllerNodesSkipsSelf(c *gc.C) {
 				},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	c.Assert(r.CheckSecondaryControllerNodes(), gc.DeepEquals, map[string]error{})
 }
 
 func (s *restorerSuite) checkSecondaryControllerNodes(c *gc.C, expected map[string]error) {
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{
 					{
 						Healthy:       true,
@@ -241,14 +493,14 @@ func (s *restorerSuite) checkSecondaryControllerNodes(c *gc.C, expected map[stri
 				},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 	c.Assert(r.CheckSecondaryControllerNodes(), gc.DeepEquals, expected)
 }
 
 func (s *restorerSuite) TestCheckSecondaryControllerNodesOk(c *gc.C) {
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		return &fakeControllerNode{ip: member.Name}
+		return &coretesting.ControllerNode{Address: member.Name}
 	}
 	s.checkSecondaryControllerNodes(c, map[string]error{"wot": nil})
 }
@@ -256,13 +508,80 @@ func (s *restorerSuite) TestCheckSecondaryControllerNodesOk(c *gc.C) {
 func (s *restorerSuite) TestCheckSecondaryControllerNodesFail(c *gc.C) {
 	err := errors.New("boom")
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{ip: member.Name}
+		node := &coretesting.ControllerNode{Address: member.Name}
 		node.SetErrors(err)
 		return node
 	}
 	s.checkSecondaryControllerNodes(c, map[string]error{"wot": err})
 }
 
+func auxiliaryReplicaSet() (core.ReplicaSet, error) {
+	return core.ReplicaSet{
+		Name: "juju",
+		Members: []core.ReplicaSetMember{{
+			Healthy:       true,
+			ID:            1,
+			Name:          "djula",
+			State:         "PRIMARY",
+			Self:          true,
+			JujuMachineID: "0",
+		}, {
+			Healthy: true,
+			ID:      2,
+			Name:    "arbiter",
+			State:   "ARBITER",
+			Arbiter: true,
+		}, {
+			Healthy: true,
+			ID:      3,
+			Name:    "backups",
+			State:   "SECONDARY",
+			Hidden:  true,
+			Delay:   time.Hour,
+		}},
+	}, nil
+}
+
+func (s *restorerSuite) TestCheckDatabaseStateAuxiliaryMembers(c *gc.C) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: auxiliaryReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.CheckDatabaseState(), jc.ErrorIsNil)
+	c.Assert(r.IsHA(), jc.IsFalse)
+}
+
+func (s *restorerSuite) TestCheckDatabaseStateArbiterInWrongState(c *gc.C) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			rs, _ := auxiliaryReplicaSet()
+			rs.Members[1].State = "SECONDARY"
+			return rs, nil
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	err = r.CheckDatabaseState()
+	c.Assert(err, jc.Satisfies, core.IsUnhealthyMembersError)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+	c.Assert(err, gc.ErrorMatches, `unhealthy replica set members: 2 "arbiter" \(juju machine \)`)
+}
+
+func (s *restorerSuite) TestAuxiliaryMembersNotManaged(c *gc.C) {
+	var nodes []string
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		nodes = append(nodes, member.Name)
+		return &coretesting.ControllerNode{Address: member.Name}
+	}
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: auxiliaryReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(r.CheckSecondaryControllerNodes(), gc.HasLen, 0)
+	c.Assert(r.StopAgents(true), gc.DeepEquals, map[string]error{"djula": nil})
+	c.Assert(r.StartAgents(true), gc.DeepEquals, map[string]error{"djula": nil})
+	c.Assert(nodes, jc.DeepEquals, []string{"djula", "djula"})
+}
+
 type agentMgmtTest struct {
 	mgmtFunc    func(*core.Restorer, bool) map[string]error
 	secondaries bool
@@ -270,10 +589,10 @@ type agentMgmtTest struct {
 	nodeErrs    map[string]string
 }
 
-func (s *restorerSuite) checkManagedAgents(c *gc.C, t agentMgmtTest) []*fakeControllerNode {
-	nodes := []*fakeControllerNode{}
+func (s *restorerSuite) checkManagedAgents(c *gc.C, t agentMgmtTest) []*coretesting.ControllerNode {
+	nodes := []*coretesting.ControllerNode{}
 	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
-		node := &fakeControllerNode{ip: member.Name}
+		node := &coretesting.ControllerNode{Address: member.Name}
 		nodes = append(nodes, node)
 		if e := t.nodeErrs[member.Name]; e != "" {
 			node.SetErrors(errors.New(e))
@@ -281,9 +600,10 @@ func (s *restorerSuite) checkManagedAgents(c *gc.C, t agentMgmtTest) []*fakeCont
 		return node
 	}
 
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{
 					{
 						Healthy:       true,
@@ -303,7 +623,7 @@ func (s *restorerSuite) checkManagedAgents(c *gc.C, t agentMgmtTest) []*fakeCont
 				},
 			}, nil
 		},
-	}, &fakeBackup{}, s.converter)
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{Services: s.services})
 	c.Assert(err, jc.ErrorIsNil)
 
 	result := t.mgmtFunc(r, t.secondaries)
@@ -330,7 +650,7 @@ func (s *restorerSuite) TestStopAgentsWithSecondaries(c *gc.C) {
 	})
 	c.Assert(nodes, gc.HasLen, 2)
 	for _, n := range nodes {
-		n.CheckCallNames(c, "IP", "StopAgent")
+		n.CheckCallNames(c, "Name", "StopAgent")
 	}
 }
 
@@ -347,7 +667,7 @@ func (s *restorerSuite) TestStopAgentsNoSecondaries(c *gc.C) {
 	for _, n := range nodes {
 		// When no secondaries are requested, only primary node will be run
 		if n.IP() == "djula" {
-			n.CheckCallNames(c, "IP", "StopAgent", "IP")
+			n.CheckCallNames(c, "Name", "StopAgent", "IP")
 		} else {
 			n.CheckCallNames(c, "IP")
 		}
@@ -378,7 +698,7 @@ func (s *restorerSuite) TestStartAgentsWithSecondaries(c *gc.C) {
 	})
 	c.Assert(nodes, gc.HasLen, 2)
 	for _, n := range nodes {
-		n.CheckCallNames(c, "IP", "StartAgent")
+		n.CheckCallNames(c, "Name", "StartAgent")
 	}
 }
 
@@ -395,7 +715,7 @@ func (s *restorerSuite) TestStartAgentsNoSecondaries(c *gc.C) {
 	for _, n := range nodes {
 		// When no secondaries are requested, only primary node will be run
 		if n.IP() == "djula" {
-			n.CheckCallNames(c, "IP", "StartAgent", "IP")
+			n.CheckCallNames(c, "Name", "StartAgent", "IP")
 		} else {
 			n.CheckCallNames(c, "IP")
 		}
@@ -414,14 +734,566 @@ func (s *restorerSuite) TestStartAgentFail(c *gc.C) {
 	})
 }
 
+func (s *restorerSuite) TestStartAgentsRetries(c *gc.C) {
+	var nodes []*coretesting.ControllerNode
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{Address: member.Name}
+		if member.Name == "wot" {
+			node.SetErrors(errors.New("kaboom"), errors.New("kaboom again"))
+		}
+		nodes = append(nodes, node)
+		return node
+	}
+	clk := testclock.NewClock(time.Now())
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: controllerNodesReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		Parallelism:  2,
+		Clock:        clk,
+		StartRetries: 2,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	go func() {
+		c.Check(clk.WaitAdvance(5*time.Second, time.Second, 1), jc.ErrorIsNil)
+		c.Check(clk.WaitAdvance(10*time.Second, time.Second, 1), jc.ErrorIsNil)
+	}()
+	result := r.StartAgents(true)
+	c.Assert(result, jc.DeepEquals, map[string]error{"djula": nil, "wot": nil, "bibi": nil})
+	for _, n := range nodes {
+		if n.Address == "wot" {
+			n.CheckCallNames(c, "Name", "StartAgent", "Name", "StartAgent", "Name", "StartAgent")
+		}
+	}
+}
+
+func (s *restorerSuite) TestStartAgentsCancelled(c *gc.C) {
+	var nodes []*coretesting.ControllerNode
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{Address: member.Name}
+		if member.Name == "wot" {
+			node.SetErrors(errors.New("kaboom"))
+		}
+		nodes = append(nodes, node)
+		return node
+	}
+	replicaSetCalls := 0
+	cancel := make(chan struct{})
+	close(cancel)
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			replicaSetCalls++
+			rs, err := controllerNodesReplicaSet()
+			if replicaSetCalls > 1 {
+				// Never stabilises.
+				rs.Members[1].Healthy = false
+			}
+			return rs, err
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		Parallelism:  2,
+		StartRetries: 2,
+		Cancel:       cancel,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	// Every node is still started once, without waiting for the
+	// replica set or retrying.
+	result := r.StartAgents(true)
+	c.Assert(result, gc.HasLen, 3)
+	c.Assert(result["wot"], gc.ErrorMatches, "kaboom")
+	c.Assert(result["bibi"], jc.ErrorIsNil)
+	c.Assert(replicaSetCalls, gc.Equals, 1)
+	for _, n := range nodes {
+		n.CheckCallNames(c, "Name", "StartAgent")
+	}
+}
+
+func (s *restorerSuite) TestStartAgentsReplicaSetNotStabilised(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return &coretesting.ControllerNode{Address: member.Name}
+	}
+	replicaSetCalls := 0
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			replicaSetCalls++
+			rs, err := controllerNodesReplicaSet()
+			if replicaSetCalls > 1 {
+				rs.Members[1].Healthy = false
+			}
+			return rs, err
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		StabiliseAttempts: 3,
+		StabiliseMaxWait:  time.Millisecond,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	result := r.StartAgents(true)
+	c.Assert(result, jc.DeepEquals, map[string]error{"djula": nil, "wot": nil, "bibi": nil})
+	c.Assert(replicaSetCalls, gc.Equals, 4)
+	c.Assert(c.GetTestLog(), jc.Contains, "Could not finish waiting for healthy replicaset after 3 attempts")
+	c.Assert(c.GetTestLog(), jc.Contains, `2 "arbiter" (juju machine ): arbiter, healthy: false`)
+}
+
+func (s *restorerSuite) TestStopAgentsReportsProgress(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{Address: member.Name}
+		if member.Name == "wot" {
+			node.SetErrors(errors.New("kaboom"))
+		}
+		return node
+	}
+	var mu sync.Mutex
+	progress := map[string][]string{}
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: controllerNodesReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		Parallelism: 2,
+		NodeProgress: func(op core.NodeOperation) {
+			mu.Lock()
+			defer mu.Unlock()
+			c.Check(op.Operation, gc.Equals, "stop agents")
+			state := string(op.State)
+			if op.Err != nil {
+				state += ": " + op.Err.Error()
+			}
+			progress[op.Node] = append(progress[op.Node], state)
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	r.StopAgents(true)
+	c.Assert(progress, jc.DeepEquals, map[string][]string{
+		"djula": {"pending", "running", "done"},
+		"wot":   {"pending", "running", "failed: kaboom"},
+		"bibi":  {"pending", "running", "done"},
+	})
+}
+
+func (s *restorerSuite) TestStartAgentsRestartsDatabase(c *gc.C) {
+	s.services = []core.Service{core.MachineAgentService, core.DatabaseService}
+	nodes := s.checkManagedAgents(c, agentMgmtTest{
+		func(r *core.Restorer, s bool) map[string]error { return r.StartAgents(s) },
+		true,
+		map[string]error{
+			"wot":   nil,
+			"djula": nil,
+		},
+		map[string]string{},
+	})
+	c.Assert(nodes, gc.HasLen, 2)
+	for _, n := range nodes {
+		n.CheckCallNames(c, "Name", "RestartDatabase", "StartAgent")
+	}
+}
+
+func (s *restorerSuite) TestStartAgentsRestartDatabaseFail(c *gc.C) {
+	s.services = []core.Service{core.MachineAgentService, core.DatabaseService}
+	s.checkManagedAgents(c, agentMgmtTest{
+		func(r *core.Restorer, s bool) map[string]error { return r.StartAgents(s) },
+		true,
+		map[string]error{
+			"djula": errors.New("restarting database: kaboom"),
+			"wot":   nil,
+		},
+		map[string]string{"djula": "kaboom"},
+	})
+}
+
+func (s *restorerSuite) TestAgentsNotManaged(c *gc.C) {
+	s.services = []core.Service{core.DatabaseService}
+	nodes := s.checkManagedAgents(c, agentMgmtTest{
+		func(r *core.Restorer, s bool) map[string]error { return r.StopAgents(s) },
+		true,
+		map[string]error{
+			"wot":   nil,
+			"djula": nil,
+		},
+		map[string]string{},
+	})
+	for _, n := range nodes {
+		n.CheckCallNames(c, "Name")
+	}
+}
+
+func (s *restorerSuite) checkParallelAgents(c *gc.C, mgmtFunc func(*core.Restorer) map[string]error) []string {
+	var (
+		mu    sync.Mutex
+		order []string
+		done  []string
+	)
+	// The secondaries can only finish once they've all started, so
+	// this would time out if they were run one at a time.
+	var started sync.WaitGroup
+	started.Add(3)
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{Address: member.Name}
+		node.AgentF = func() {
+			mu.Lock()
+			order = append(order, member.Name)
+			mu.Unlock()
+			if member.Self {
+				return
+			}
+			started.Done()
+			waited := make(chan struct{})
+			go func() {
+				started.Wait()
+				close(waited)
+			}()
+			select {
+			case <-waited:
+			case <-time.After(testing.LongWait):
+				c.Errorf("secondaries not run concurrently")
+			}
+		}
+		return node
+	}
+	members := []core.ReplicaSetMember{{
+		Healthy:       true,
+		ID:            1,
+		Name:          "primary",
+		State:         "PRIMARY",
+		Self:          true,
+		JujuMachineID: "1",
+	}}
+	for i := 2; i <= 4; i++ {
+		members = append(members, core.ReplicaSetMember{
+			Healthy:       true,
+			ID:            i,
+			Name:          fmt.Sprintf("secondary-%d", i),
+			State:         "SECONDARY",
+			JujuMachineID: fmt.Sprint(i),
+		})
+	}
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{Members: members}, nil
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		Parallelism: 3,
+		NodeDone: func(node string, err error) {
+			c.Check(err, jc.ErrorIsNil)
+			done = append(done, node)
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	result := mgmtFunc(r)
+	c.Assert(result, gc.DeepEquals, map[string]error{
+		"primary":     nil,
+		"secondary-2": nil,
+		"secondary-3": nil,
+		"secondary-4": nil,
+	})
+	c.Assert(done, jc.SameContents, []string{"primary", "secondary-2", "secondary-3", "secondary-4"})
+	c.Assert(order, gc.HasLen, 4)
+	return order
+}
+
+func (s *restorerSuite) TestStopAgentsParallelPrimaryLast(c *gc.C) {
+	order := s.checkParallelAgents(c, func(r *core.Restorer) map[string]error {
+		return r.StopAgents(true)
+	})
+	c.Assert(order[3], gc.Equals, "primary")
+}
+
+func (s *restorerSuite) TestStartAgentsParallelPrimaryFirst(c *gc.C) {
+	order := s.checkParallelAgents(c, func(r *core.Restorer) map[string]error {
+		return r.StartAgents(true)
+	})
+	c.Assert(order[0], gc.Equals, "primary")
+}
+
+// stagedRestorer returns a restorer that starts agents in stages,
+// with nodes whose agents report agentStates[name] once started.
+func (s *restorerSuite) stagedRestorer(c *gc.C, timeout time.Duration, agentStates map[string]string) (*core.Restorer, *[]string) {
+	var events []string
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{Address: member.Name}
+		node.AgentF = func() {
+			events = append(events, "start "+member.Name)
+			node.NodeStatus.AgentState = agentStates[member.Name]
+		}
+		return node
+	}
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			events = append(events, "check replica set")
+			return core.ReplicaSet{Members: []core.ReplicaSetMember{
+				{Healthy: true, ID: 1, Name: "djula", State: "PRIMARY", Self: true, JujuMachineID: "0"},
+				{Healthy: true, ID: 2, Name: "wot", State: "SECONDARY", JujuMachineID: "1"},
+				{Healthy: true, ID: 3, Name: "bibi", State: "SECONDARY", JujuMachineID: "2"},
+			}}, nil
+		},
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		Parallelism:  3,
+		StageTimeout: timeout,
+		NodeDone: func(node string, err error) {
+			events = append(events, "done "+node)
+		},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	events = nil
+	return r, &events
+}
+
+func (s *restorerSuite) TestStartAgentsStaged(c *gc.C) {
+	r, events := s.stagedRestorer(c, time.Minute, map[string]string{
+		"djula": "active",
+		"wot":   "active",
+		"bibi":  "active",
+	})
+	result := r.StartAgents(true)
+	c.Assert(result, jc.DeepEquals, map[string]error{"djula": nil, "wot": nil, "bibi": nil})
+	// Each node is only started once the one before it is healthy.
+	c.Assert(*events, jc.DeepEquals, []string{
+		"check replica set",
+		"start djula", "check replica set", "done djula",
+		"start wot", "check replica set", "done wot",
+		"start bibi", "check replica set", "done bibi",
+	})
+}
+
+func (s *restorerSuite) TestStartAgentsStagedUnhealthy(c *gc.C) {
+	r, events := s.stagedRestorer(c, time.Millisecond, map[string]string{
+		"djula": "active",
+		"wot":   "failed",
+		"bibi":  "active",
+	})
+	result := r.StartAgents(true)
+	c.Assert(result["djula"], jc.ErrorIsNil)
+	c.Assert(result["wot"], gc.ErrorMatches, `not healthy after 1ms: agent is "failed"`)
+	c.Assert(result["bibi"], gc.ErrorMatches, "not started - wot failed")
+	// bibi isn't started, but is still reported.
+	c.Assert((*events)[len(*events)-3:], jc.DeepEquals, []string{"check replica set", "done wot", "done bibi"})
+}
+
+func (s *restorerSuite) controllerNodesRestorer(c *gc.C, clk clock.Clock) *core.Restorer {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: controllerNodesReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{
+		Parallelism: 2,
+		Clock:       clk,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return r
+}
+
+func controllerNodesReplicaSet() (core.ReplicaSet, error) {
+	rs, _ := auxiliaryReplicaSet()
+	rs.Members = append(rs.Members, core.ReplicaSetMember{
+		Healthy:       true,
+		ID:            4,
+		Name:          "wot",
+		State:         "SECONDARY",
+		JujuMachineID: "1",
+	}, core.ReplicaSetMember{
+		Healthy:       true,
+		ID:            5,
+		Name:          "bibi",
+		State:         "SECONDARY",
+		JujuMachineID: "2",
+	})
+	return rs, nil
+}
+
+func (s *restorerSuite) setNodeStatusConverter() {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{
+			Address: member.Name,
+			NodeStatus: core.NodeStatus{
+				FreeSpace:     uint64(member.ID) * 1000,
+				DatabaseSize:  500,
+				AgentState:    "active",
+				DatabaseState: "active",
+			},
+		}
+		if member.Name == "wot" {
+			node.SetErrors(errors.New("kaboom"))
+		}
+		return node
+	}
+}
+
+func (s *restorerSuite) TestNodeStatuses(c *gc.C) {
+	s.setNodeStatusConverter()
+	r := s.controllerNodesRestorer(c, nil)
+	results := r.NodeStatuses(true)
+	c.Assert(results, gc.HasLen, 3)
+	c.Assert(results[0].Member.Name, gc.Equals, "djula")
+	c.Assert(results[0].IP, gc.Equals, "djula")
+	c.Assert(results[0].Err, jc.ErrorIsNil)
+	c.Assert(results[0].Status, gc.Equals, core.NodeStatus{
+		FreeSpace:     1000,
+		DatabaseSize:  500,
+		AgentState:    "active",
+		DatabaseState: "active",
+	})
+	c.Assert(results[1].Member.Name, gc.Equals, "wot")
+	c.Assert(results[1].Err, gc.ErrorMatches, "kaboom")
+	c.Assert(results[2].Member.Name, gc.Equals, "bibi")
+	c.Assert(results[2].Err, jc.ErrorIsNil)
+	c.Assert(results[2].Status.FreeSpace, gc.Equals, uint64(5000))
+}
+
+func (s *restorerSuite) TestNodeStatusesPrimaryOnly(c *gc.C) {
+	s.setNodeStatusConverter()
+	r := s.controllerNodesRestorer(c, nil)
+	results := r.NodeStatuses(false)
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].Member.Name, gc.Equals, "djula")
+	c.Assert(results[0].Err, jc.ErrorIsNil)
+}
+
+func (s *restorerSuite) TestCheckAgentLogs(c *gc.C) {
+	s.setNodeStatusConverter()
+	base := s.converter
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := base(member).(*coretesting.ControllerNode)
+		if member.Name == "bibi" {
+			node.Log = "starting\n" +
+				"ERROR juju.worker.apicaller invalid entity name or password (unauthorized access)\n" +
+				"ERROR juju.worker.peergrouper no reachable servers\n" +
+				"ERROR juju.worker.peergrouper no reachable servers\n"
+		}
+		return node
+	}
+	r := s.controllerNodesRestorer(c, nil)
+	results := r.CheckAgentLogs(true)
+	c.Assert(results, gc.HasLen, 3)
+	c.Assert(results[0].Member.Name, gc.Equals, "djula")
+	c.Assert(results[0].Err, jc.ErrorIsNil)
+	c.Assert(results[0].Problems, gc.HasLen, 0)
+	c.Assert(results[1].Err, gc.ErrorMatches, "kaboom")
+	c.Assert(results[2].Err, jc.ErrorIsNil)
+	c.Assert(results[2].Problems, jc.DeepEquals, []core.AgentLogProblem{{
+		Problem: "bad password",
+		Line:    "ERROR juju.worker.apicaller invalid entity name or password (unauthorized access)",
+	}, {
+		Problem: "database unreachable",
+		Line:    "ERROR juju.worker.peergrouper no reachable servers",
+	}})
+}
+
+func (s *restorerSuite) TestCheckNodeIdentities(c *gc.C) {
+	statuses := []core.NodeStatusResult{{
+		Member: core.ReplicaSetMember{Name: "djula", JujuMachineID: "0"},
+		Status: core.NodeStatus{MachineTag: "machine-0", ControllerUUID: "uuid"},
+	}, {
+		// The identity couldn't be read.
+		Member: core.ReplicaSetMember{Name: "wot", JujuMachineID: "1"},
+	}, {
+		Member: core.ReplicaSetMember{Name: "bibi", JujuMachineID: "2"},
+		Err:    errors.New("kaboom"),
+	}}
+	c.Assert(core.CheckNodeIdentities(statuses, "uuid"), jc.ErrorIsNil)
+
+	statuses[1].Status = core.NodeStatus{MachineTag: "machine-5", ControllerUUID: "other"}
+	err := core.CheckNodeIdentities(statuses, "uuid")
+	c.Assert(err, gc.ErrorMatches, `controller nodes aren't the machines the replica set names \(stale members with reused addresses\?\): wot is machine-5, not machine-1, wot belongs to controller other, not uuid`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+}
+
+func (s *restorerSuite) TestWaitForAgents(c *gc.C) {
+	s.setNodeStatusConverter()
+	r := s.controllerNodesRestorer(c, nil)
+	results, err := r.WaitForAgents(false, time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].Status.AgentState, gc.Equals, "active")
+}
+
+func (s *restorerSuite) TestWaitForAgentsTimeout(c *gc.C) {
+	s.setNodeStatusConverter()
+	r := s.controllerNodesRestorer(c, nil)
+	results, err := r.WaitForAgents(true, time.Millisecond)
+	c.Assert(err, gc.ErrorMatches, "agents not active after 1ms on wot")
+	c.Assert(err, jc.Satisfies, core.IsPostcheckError)
+	c.Assert(results, gc.HasLen, 3)
+	c.Assert(results[1].Err, gc.ErrorMatches, "kaboom")
+}
+
+func (s *restorerSuite) TestWaitForAgentsCancelled(c *gc.C) {
+	s.setNodeStatusConverter()
+	cancel := make(chan struct{})
+	close(cancel)
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: controllerNodesReplicaSet,
+	}, &coretesting.BackupFile{}, s.converter, core.RestorerConfig{Cancel: cancel})
+	c.Assert(err, jc.ErrorIsNil)
+	results, err := r.WaitForAgents(true, time.Hour)
+	c.Assert(err, gc.ErrorMatches, "stopped waiting for agents on wot")
+	c.Assert(err, jc.Satisfies, core.IsPostcheckError)
+	c.Assert(results, gc.HasLen, 3)
+}
+
+func (s *restorerSuite) TestConcurrentUse(c *gc.C) {
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		return &coretesting.ControllerNode{
+			Address:    member.Name,
+			NodeStatus: core.NodeStatus{AgentState: "active"},
+		}
+	}
+	r := s.controllerNodesRestorer(c, nil)
+	// Starting the agents refreshes the replica set while the other
+	// operations read it.
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		c.Check(r.StartAgents(true), gc.HasLen, 3)
+	}()
+	go func() {
+		defer wg.Done()
+		c.Check(r.CheckDatabaseState(), jc.ErrorIsNil)
+	}()
+	go func() {
+		defer wg.Done()
+		c.Check(r.NodeStatuses(true), gc.HasLen, 3)
+	}()
+	go func() {
+		defer wg.Done()
+		c.Check(r.CheckSecondaryControllerNodes(), gc.DeepEquals, map[string]error{"wot": nil, "bibi": nil})
+	}()
+	wg.Wait()
+}
+
+func (s *restorerSuite) TestClockSkews(c *gc.C) {
+	now := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	offsets := map[string]time.Duration{
+		"djula": 2 * time.Second,
+		"wot":   -3 * time.Second,
+		"bibi":  14 * time.Second,
+	}
+	s.converter = func(member core.ReplicaSetMember) core.ControllerNode {
+		node := &coretesting.ControllerNode{
+			Address:     member.Name,
+			CurrentTime: now.Add(offsets[member.Name]),
+		}
+		if member.Name == "wot" {
+			node.SetErrors(errors.New("kaboom"))
+		}
+		return node
+	}
+	r := s.controllerNodesRestorer(c, testclock.NewClock(now))
+	results := r.ClockSkews(true)
+	c.Assert(results, gc.HasLen, 3)
+	c.Assert(results[0].Member.Name, gc.Equals, "djula")
+	c.Assert(results[0].Err, jc.ErrorIsNil)
+	c.Assert(results[0].Skew, gc.Equals, time.Duration(0))
+	c.Assert(results[1].Member.Name, gc.Equals, "wot")
+	c.Assert(results[1].Err, gc.ErrorMatches, "kaboom")
+	c.Assert(results[2].Member.Name, gc.Equals, "bibi")
+	c.Assert(results[2].Err, jc.ErrorIsNil)
+	c.Assert(results[2].Skew, gc.Equals, 12*time.Second)
+}
+
 func (s *restorerSuite) TestCheckRestorable(c *gc.C) {
 	created, err := time.Parse(time.RFC3339, "2020-03-17T12:24:30Z")
 	c.Assert(err, jc.ErrorIsNil)
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				ControllerModelUUID: "alex the astronaut",
 				JujuVersion:         version.MustParse("2.8-beta5.6"),
@@ -429,8 +1301,8 @@ func (s *restorerSuite) TestCheckRestorable(c *gc.C) {
 				Series:              "eoan",
 			}, nil
 		},
-	}, &fakeBackup{
-		metadataF: func() (core.BackupMetadata, error) {
+	}, &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
 			return core.BackupMetadata{
 				ControllerModelUUID: "alex the astronaut",
 				JujuVersion:         version.MustParse("2.8-beta5.3"),
@@ -440,10 +1312,10 @@ func (s *restorerSuite) TestCheckRestorable(c *gc.C) {
 				HANodes:             5,
 			}, nil
 		},
-	}, nil)
+	}, nil, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 
-	result, err := r.CheckRestorable(false, false)
+	result, err := r.CheckRestorable(false)
 	c.Assert(err, jc.ErrorIsNil)
 
 	c.Assert(result, gc.DeepEquals, &core.PrecheckResult{
@@ -458,11 +1330,11 @@ func (s *restorerSuite) TestCheckRestorable(c *gc.C) {
 func (s *restorerSuite) TestCheckRestorableAllowDowngrade(c *gc.C) {
 	created, err := time.Parse(time.RFC3339, "2020-03-17T12:24:30Z")
 	c.Assert(err, jc.ErrorIsNil)
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				ControllerModelUUID: "alex the astronaut",
 				JujuVersion:         version.MustParse("2.8-beta5.6"),
@@ -470,8 +1342,8 @@ func (s *restorerSuite) TestCheckRestorableAllowDowngrade(c *gc.C) {
 				Series:              "eoan",
 			}, nil
 		},
-	}, &fakeBackup{
-		metadataF: func() (core.BackupMetadata, error) {
+	}, &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
 			return core.BackupMetadata{
 				ControllerModelUUID: "alex the astronaut",
 				JujuVersion:         version.MustParse("2.7.6.3"),
@@ -481,10 +1353,10 @@ func (s *restorerSuite) TestCheckRestorableAllowDowngrade(c *gc.C) {
 				HANodes:             5,
 			}, nil
 		},
-	}, nil)
+	}, nil, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 
-	result, err := r.CheckRestorable(true, false)
+	result, err := r.CheckRestorable(true)
 	c.Assert(err, jc.ErrorIsNil)
 
 	c.Assert(result, gc.DeepEquals, &core.PrecheckResult{
@@ -500,11 +1372,11 @@ func (s *restorerSuite) TestCheckRestorableWithAllowDowngradeButUpgrading(c *gc.
 	created, err := time.Parse(time.RFC3339, "2020-03-17T12:24:30Z")
 	c.Assert(err, jc.ErrorIsNil)
 
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				ControllerModelUUID: "porridge radio",
 				JujuVersion:         version.MustParse("2.7.6"),
@@ -512,8 +1384,8 @@ func (s *restorerSuite) TestCheckRestorableWithAllowDowngradeButUpgrading(c *gc.
 				Series:              "eoan",
 			}, nil
 		},
-	}, &fakeBackup{
-		metadataF: func() (core.BackupMetadata, error) {
+	}, &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
 			return core.BackupMetadata{
 				ControllerModelUUID: "porridge radio",
 				JujuVersion:         version.MustParse("2.8-beta5.3"),
@@ -523,10 +1395,10 @@ func (s *restorerSuite) TestCheckRestorableWithAllowDowngradeButUpgrading(c *gc.
 				HANodes:             5,
 			}, nil
 		},
-	}, nil)
+	}, nil, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 
-	result, err := r.CheckRestorable(true, false)
+	result, err := r.CheckRestorable(true)
 	c.Assert(err, gc.ErrorMatches, `backup juju version "2.8-beta5.3" is greater than controller version "2.7.6"`)
 	c.Assert(result, gc.IsNil)
 }
@@ -543,15 +1415,15 @@ func (s *restorerSuite) checkRestorableMismatch(c *gc.C, expectErr string, tweak
 	}
 	tweak(&controllerInfo)
 
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return controllerInfo, nil
 		},
-	}, &fakeBackup{
-		metadataF: func() (core.BackupMetadata, error) {
+	}, &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
 			return core.BackupMetadata{
 				ControllerModelUUID: "porridge radio",
 				JujuVersion:         version.MustParse("2.8-beta5.3"),
@@ -561,10 +1433,10 @@ func (s *restorerSuite) checkRestorableMismatch(c *gc.C, expectErr string, tweak
 				HANodes:             5,
 			}, nil
 		},
-	}, nil)
+	}, nil, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 
-	result, err := r.CheckRestorable(false, false)
+	result, err := r.CheckRestorable(false)
 	c.Assert(err, gc.ErrorMatches, expectErr)
 	c.Assert(result, gc.IsNil)
 }
@@ -601,6 +1473,36 @@ func (s *restorerSuite) TestCheckRestorableMismatchSeries(c *gc.C) {
 	)
 }
 
+func (s *restorerSuite) TestCheckRestorableControllerWithBase(c *gc.C) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{}, nil
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				ControllerModelUUID: "porridge radio",
+				JujuVersion:         version.MustParse("3.1.6"),
+				HANodes:             3,
+				Base:                "ubuntu@22.04",
+			}, nil
+		},
+	}, &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
+			return core.BackupMetadata{
+				ControllerModelUUID: "porridge radio",
+				JujuVersion:         version.MustParse("3.1.6"),
+				Series:              "jammy",
+				HANodes:             3,
+			}, nil
+		},
+	}, nil, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// A Juju 3.x controller has no series to compare.
+	_, err = r.CheckRestorable(false)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
 func (s *restorerSuite) checkCopyControllerMismatch(c *gc.C, expectErr string, backupVers string, tweak func(*core.ControllerInfo)) {
 	created, err := time.Parse(time.RFC3339, "2020-03-17T12:24:30Z")
 	c.Assert(err, jc.ErrorIsNil)
@@ -612,15 +1514,15 @@ func (s *restorerSuite) checkCopyControllerMismatch(c *gc.C, expectErr string, b
 	}
 	tweak(&controllerInfo)
 
-	r, err := core.NewRestorer(&fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	r, err := core.NewRestorer(&coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return controllerInfo, nil
 		},
-	}, &fakeBackup{
-		metadataF: func() (core.BackupMetadata, error) {
+	}, &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
 			return core.BackupMetadata{
 				ControllerModelUUID: "porridge radio",
 				JujuVersion:         version.MustParse(backupVers),
@@ -628,10 +1530,10 @@ func (s *restorerSuite) checkCopyControllerMismatch(c *gc.C, expectErr string, b
 				ModelCount:          3,
 			}, nil
 		},
-	}, nil)
+	}, nil, core.RestorerConfig{})
 	c.Assert(err, jc.ErrorIsNil)
 
-	result, err := r.CheckRestorable(false, true)
+	result, err := r.CheckCopyable(false)
 	c.Assert(err, gc.ErrorMatches, expectErr)
 	c.Assert(result, gc.IsNil)
 }
@@ -672,10 +1574,77 @@ func (s *restorerSuite) TestCheckCopyControllerMismatchOldBackup(c *gc.C) {
 	)
 }
 
+func (s *restorerSuite) TestCheckCopyable(c *gc.C) {
+	db := &coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{}, nil
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			// The UUIDs, HA node count and series all differ from
+			// the backup's, which doesn't matter when copying.
+			return core.ControllerInfo{
+				ControllerUUID:       "blue monday",
+				ControllerModelUUID:  "temptation",
+				ControllerModelCloud: "maas",
+				JujuVersion:          version.MustParse("3.1.0"),
+				HANodes:              1,
+				Models:               1,
+			}, nil
+		},
+		Entities: core.ControllerEntities{
+			Users:  []string{"admin", "bernard", "peter"},
+			Clouds: []string{"maas", "openstack"},
+		},
+	}
+	backup := &coretesting.BackupFile{
+		MetadataF: func() (core.BackupMetadata, error) {
+			return core.BackupMetadata{
+				ControllerUUID:      "true faith",
+				ControllerModelUUID: "regret",
+				JujuVersion:         version.MustParse("2.9.42"),
+				Series:              "focal",
+				HANodes:             3,
+				CloudCount:          3,
+			}, nil
+		},
+		BackupEntities: core.ControllerEntities{
+			Users:  []string{"admin", "gillian", "peter"},
+			Clouds: []string{"aws", "maas", "openstack"},
+		},
+	}
+	r, err := core.NewRestorer(db, backup, nil, core.RestorerConfig{})
+	c.Assert(err, jc.ErrorIsNil)
+
+	result, err := r.CheckCopyable(false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.ControllerUUID, gc.Equals, "true faith")
+	c.Assert(result.TargetControllerUUID, gc.Equals, "blue monday")
+	c.Assert(result.Copy, jc.DeepEquals, &core.CopyPrecheck{
+		TargetUsers:     3,
+		TargetClouds:    2,
+		UserCollisions:  []string{"peter"},
+		CloudCollisions: []string{"openstack"},
+	})
+
+	// Restoring the same backup fails on the differences.
+	_, err = r.CheckRestorable(true)
+	c.Assert(err, gc.ErrorMatches, `controller model uuids don't match - backup: "regret", controller: "temptation"`)
+}
+
+func (s *restorerSuite) TestCheckCopyableEntitiesError(c *gc.C) {
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, copiedBackup(c), core.RestorerConfig{})
+	db.SetErrors(errors.New("no reachable servers"))
+	_, err := r.CheckCopyable(true)
+	c.Assert(err, gc.ErrorMatches, "reading controller users and clouds: no reachable servers")
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+}
+
 func (s *restorerSuite) TestRestoreSameVersion(c *gc.C) {
-	db := fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	db := coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{
 					{
 						Healthy:       true,
@@ -688,7 +1657,7 @@ func (s *restorerSuite) TestRestoreSameVersion(c *gc.C) {
 				},
 			}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				JujuVersion: version.MustParse("2.7.6"),
 			}, nil
@@ -696,38 +1665,41 @@ func (s *restorerSuite) TestRestoreSameVersion(c *gc.C) {
 	}
 	r, err := core.NewRestorer(
 		&db,
-		&fakeBackup{
-			dumpDirF: func() string {
+		&coretesting.BackupFile{
+			DumpDirectoryF: func() string {
 				return "the dump dir!"
 			},
-			metadataF: func() (core.BackupMetadata, error) {
+			MetadataF: func() (core.BackupMetadata, error) {
 				return core.BackupMetadata{
 					JujuVersion: version.MustParse("2.7.6"),
 				}, nil
 			},
 		},
 		s.converter,
+		core.RestorerConfig{},
 	)
 	c.Assert(err, jc.ErrorIsNil)
 	db.SetErrors(errors.Errorf("bad!"))
-	err = r.Restore("log path", true, false)
+	_, err = r.Restore(core.RestoreOptions{LogFile: "log path", IncludeStatusHistory: true})
 	c.Assert(err, gc.ErrorMatches, `restoring dump from "the dump dir!": bad!`)
+	c.Assert(err, jc.Satisfies, core.IsRestoreError)
 
 	c.Assert(db.Calls(), gc.HasLen, 3)
-	db.CheckCall(c, 2, "RestoreFromDump", "the dump dir!", "log path", true, false)
+	db.CheckCall(c, 2, "RestoreFromDump", "the dump dir!", core.RestoreOptions{LogFile: "log path", IncludeStatusHistory: true})
 }
 
 func (s *restorerSuite) TestRestoreDowngrade(c *gc.C) {
-	machines := []fakeControllerNode{
-		{ip: "1.1.1.1"},
-		{ip: "1.1.1.2"},
+	machines := []coretesting.ControllerNode{
+		{Address: "1.1.1.1"},
+		{Address: "1.1.1.2"},
 	}
 	convertToMachine := func(member core.ReplicaSetMember) core.ControllerNode {
 		return &machines[member.ID]
 	}
-	db := fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	db := coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            0,
@@ -745,7 +1717,11 @@ func (s *restorerSuite) TestRestoreDowngrade(c *gc.C) {
 				}},
 			}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		Collections: []core.RestoredCollection{
+			{Name: "juju.machines", Documents: 2},
+			{Name: "juju.models", Documents: 1},
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				JujuVersion: version.MustParse("2.8-beta1"),
 			}, nil
@@ -753,43 +1729,51 @@ func (s *restorerSuite) TestRestoreDowngrade(c *gc.C) {
 	}
 	r, err := core.NewRestorer(
 		&db,
-		&fakeBackup{
-			dumpDirF: func() string {
+		&coretesting.BackupFile{
+			DumpDirectoryF: func() string {
 				return "the dump dir!"
 			},
-			metadataF: func() (core.BackupMetadata, error) {
+			MetadataF: func() (core.BackupMetadata, error) {
 				return core.BackupMetadata{
 					JujuVersion: version.MustParse("2.7.6"),
 				}, nil
 			},
 		},
 		convertToMachine,
+		core.RestorerConfig{},
 	)
 	c.Assert(err, jc.ErrorIsNil)
-	err = r.Restore("log path", true, false)
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", IncludeStatusHistory: true})
 	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result, jc.DeepEquals, &core.RestoreResult{
+		Collections:         db.Collections,
+		PreviousJujuVersion: version.MustParse("2.8-beta1"),
+		JujuVersion:         version.MustParse("2.7.6"),
+	})
 
 	c.Assert(db.Calls(), gc.HasLen, 3)
-	db.CheckCall(c, 2, "RestoreFromDump", "the dump dir!", "log path", true, false)
+	db.CheckCall(c, 2, "RestoreFromDump", "the dump dir!", core.RestoreOptions{LogFile: "log path", IncludeStatusHistory: true})
 
-	for i, machine := range machines {
+	for i := range machines {
+		machine := &machines[i]
 		c.Logf("machine %d", i)
-		machine.CheckCallNames(c, "IP", "UpdateAgentVersion")
+		machine.CheckCallNames(c, "Name", "UpdateAgentVersion")
 		machine.CheckCall(c, 1, "UpdateAgentVersion", version.MustParse("2.7.6"))
 	}
 }
 
 func (s *restorerSuite) TestRestoreDowngradeError(c *gc.C) {
-	machines := []fakeControllerNode{
-		{ip: "1.1.1.1"},
-		{ip: "1.1.1.2"},
+	machines := []coretesting.ControllerNode{
+		{Address: "1.1.1.1"},
+		{Address: "1.1.1.2"},
 	}
 	convertToMachine := func(member core.ReplicaSetMember) core.ControllerNode {
 		return &machines[member.ID]
 	}
-	db := fakeDatabase{
-		replicaSetF: func() (core.ReplicaSet, error) {
+	db := coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
 			return core.ReplicaSet{
+				Name: "juju",
 				Members: []core.ReplicaSetMember{{
 					Healthy:       true,
 					ID:            0,
@@ -807,7 +1791,7 @@ func (s *restorerSuite) TestRestoreDowngradeError(c *gc.C) {
 				}},
 			}, nil
 		},
-		controllerInfoF: func() (core.ControllerInfo, error) {
+		ControllerInfoF: func() (core.ControllerInfo, error) {
 			return core.ControllerInfo{
 				JujuVersion: version.MustParse("2.8-beta1"),
 			}, nil
@@ -815,110 +1799,738 @@ func (s *restorerSuite) TestRestoreDowngradeError(c *gc.C) {
 	}
 	r, err := core.NewRestorer(
 		&db,
-		&fakeBackup{
-			dumpDirF: func() string {
+		&coretesting.BackupFile{
+			DumpDirectoryF: func() string {
 				return "the dump dir!"
 			},
-			metadataF: func() (core.BackupMetadata, error) {
+			MetadataF: func() (core.BackupMetadata, error) {
 				return core.BackupMetadata{
 					JujuVersion: version.MustParse("2.7.6"),
 				}, nil
 			},
 		},
 		convertToMachine,
+		core.RestorerConfig{},
 	)
 	c.Assert(err, jc.ErrorIsNil)
 
 	machines[0].SetErrors(errors.New("stuff went bad"))
 	machines[1].SetErrors(errors.New("oopsy daisy"))
 
-	err = r.Restore("log path", true, false)
+	_, err = r.Restore(core.RestoreOptions{LogFile: "log path", IncludeStatusHistory: true})
 	c.Assert(err, gc.ErrorMatches, `
 problems updating controllers to version "2.7.6": updating node 1.1.1.1: stuff went bad
 updating node 1.1.1.2: oopsy daisy`[1:])
 }
 
-type fakeDatabase struct {
-	testing.Stub
-	replicaSetF     func() (core.ReplicaSet, error)
-	controllerInfoF func() (core.ControllerInfo, error)
+func backupWithMetadata(metadata core.BackupMetadata, dumpDir string) *coretesting.BackupFile {
+	return &coretesting.BackupFile{
+		DumpDirectoryF: func() string {
+			return dumpDir
+		},
+		MetadataF: func() (core.BackupMetadata, error) {
+			return metadata, nil
+		},
+	}
+}
+
+// backupChain returns a full backup ending at 12:00 and incrementals
+// following it ending at 13:00 and 14:00.
+func backupChain() (*coretesting.BackupFile, []core.BackupFile) {
+	at := func(hour int) core.OplogPosition {
+		return core.NewOplogPosition(time.Date(2020, 3, 17, hour, 0, 0, 0, time.UTC), 1)
+	}
+	base := core.BackupMetadata{
+		ControllerModelUUID: "alex the astronaut",
+		JujuVersion:         version.MustParse("2.8.0"),
+		Series:              "eoan",
+		HANodes:             1,
+		ID:                  "full",
+		OplogStart:          at(11),
+		OplogEnd:            at(12),
+	}
+	first := base
+	first.ID, first.ParentID, first.OplogStart, first.OplogEnd = "inc-1", "full", at(12), at(13)
+	second := base
+	second.ID, second.ParentID, second.OplogStart, second.OplogEnd = "inc-2", "inc-1", at(13), at(14)
+	return backupWithMetadata(base, "/full/dump"), []core.BackupFile{
+		backupWithMetadata(first, "/inc-1/dump"),
+		backupWithMetadata(second, "/inc-2/dump"),
+	}
+}
+
+func (s *restorerSuite) chainRestorer(c *gc.C, db *coretesting.Database, backup core.BackupFile, config core.RestorerConfig) *core.Restorer {
+	db.ReplicaSetF = func() (core.ReplicaSet, error) {
+		return core.ReplicaSet{}, nil
+	}
+	db.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{
+			ControllerModelUUID: "alex the astronaut",
+			JujuVersion:         version.MustParse("2.8.0"),
+			HANodes:             1,
+			Series:              "eoan",
+		}, nil
+	}
+	r, err := core.NewRestorer(db, backup, s.converter, config)
+	c.Assert(err, jc.ErrorIsNil)
+	return r
+}
+
+func (s *restorerSuite) TestCheckRestorableIncrementals(c *gc.C) {
+	base, incrementals := backupChain()
+	until := time.Date(2020, 3, 17, 13, 30, 15, 500, time.UTC)
+	r := s.chainRestorer(c, &coretesting.Database{}, base, core.RestorerConfig{
+		Incrementals: incrementals,
+		Until:        until,
+	})
+	result, err := r.CheckRestorable(false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.Incrementals, gc.Equals, 2)
+	c.Assert(result.RestorePoint, gc.Equals, time.Date(2020, 3, 17, 13, 30, 15, 0, time.UTC))
+
+	// Without a restore point the chain is applied to the end.
+	r = s.chainRestorer(c, &coretesting.Database{}, base, core.RestorerConfig{Incrementals: incrementals})
+	result, err = r.CheckRestorable(false)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.RestorePoint, gc.Equals, time.Date(2020, 3, 17, 14, 0, 0, 0, time.UTC))
+
+	_, err = r.CheckCopyable(false)
+	c.Assert(err, gc.ErrorMatches, "incremental backups can't be applied when copying a controller")
+}
+
+func (s *restorerSuite) TestCheckRestorableBrokenChain(c *gc.C) {
+	base, incrementals := backupChain()
+	r := s.chainRestorer(c, &coretesting.Database{}, base, core.RestorerConfig{
+		Incrementals: []core.BackupFile{incrementals[1]},
+	})
+	_, err := r.CheckRestorable(false)
+	c.Assert(err, gc.ErrorMatches, `incremental backup "inc-2" follows "inc-1", not "full"`)
+	c.Assert(err, jc.Satisfies, core.IsPrecheckError)
+
+	r = s.chainRestorer(c, &coretesting.Database{}, incrementals[0], core.RestorerConfig{})
+	_, err = r.CheckRestorable(false)
+	c.Assert(err, gc.ErrorMatches, `backup "inc-1" is incremental - restore the full backup .*`)
+
+	r = s.chainRestorer(c, &coretesting.Database{}, base, core.RestorerConfig{
+		Incrementals: incrementals,
+		Until:        time.Date(2020, 3, 17, 11, 0, 0, 0, time.UTC),
+	})
+	_, err = r.CheckRestorable(false)
+	c.Assert(err, gc.ErrorMatches, `restore point 2020-03-17 11:00:00 \+0000 UTC is before the end of backup "full" .*`)
+
+	r = s.chainRestorer(c, &coretesting.Database{}, base, core.RestorerConfig{
+		Until: time.Date(2020, 3, 17, 13, 0, 0, 0, time.UTC),
+	})
+	_, err = r.CheckRestorable(false)
+	c.Assert(err, gc.ErrorMatches, "a restore point can only be given when applying incremental backups")
+}
+
+func (s *restorerSuite) TestCheckRestorableChainGap(c *gc.C) {
+	base, incrementals := backupChain()
+	metadata, err := incrementals[1].Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	metadata.ParentID = "full"
+	r := s.chainRestorer(c, &coretesting.Database{}, base, core.RestorerConfig{
+		Incrementals: []core.BackupFile{backupWithMetadata(metadata, "/inc-2/dump")},
+	})
+	_, err = r.CheckRestorable(false)
+	c.Assert(err, gc.ErrorMatches, `incremental backup "inc-2" starts at 2020-03-17 13:00:00 \+0000 UTC, after "full" ends at 2020-03-17 12:00:00 \+0000 UTC`)
+}
+
+func (s *restorerSuite) TestRestoreIncrementals(c *gc.C) {
+	base, incrementals := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Incrementals: incrementals,
+		Until:        time.Date(2020, 3, 17, 12, 30, 15, 0, time.UTC),
+	})
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The second incremental starts after the restore point so isn't
+	// replayed.
+	limit := core.NewOplogPosition(time.Date(2020, 3, 17, 12, 30, 16, 0, time.UTC), 0)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "ReplayOplog", "ReplayOplog")
+	db.CheckCall(c, 3, "ReplayOplog", "/full/dump/oplog.bson", "log path", limit)
+	db.CheckCall(c, 4, "ReplayOplog", "/inc-1/dump/oplog.bson", "log path", limit)
+}
+
+func (s *restorerSuite) TestRestoreIncrementalsReplayError(c *gc.C) {
+	base, incrementals := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{Incrementals: incrementals})
+	db.SetErrors(nil, nil, errors.New("oplog entry conflict"))
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path"})
+	c.Assert(err, gc.ErrorMatches, `replaying oplog from "inc-1": oplog entry conflict`)
+	c.Assert(err, jc.Satisfies, core.IsRestoreError)
+	db.CheckCall(c, 4, "ReplayOplog", "/inc-1/dump/oplog.bson", "log path", core.OplogPosition(0))
+}
+
+func (s *restorerSuite) TestRestoreTargetDatabase(c *gc.C) {
+	machines := []coretesting.ControllerNode{
+		{Address: "1.1.1.1"},
+		{Address: "1.1.1.2"},
+	}
+	convertToMachine := func(member core.ReplicaSetMember) core.ControllerNode {
+		return &machines[member.ID]
+	}
+	db := coretesting.Database{
+		ReplicaSetF: func() (core.ReplicaSet, error) {
+			return core.ReplicaSet{
+				Name: "juju",
+				Members: []core.ReplicaSetMember{{
+					Healthy: true,
+					ID:      0,
+					Name:    "djula",
+					State:   "PRIMARY",
+					Self:    true,
+				}, {
+					Healthy: true,
+					ID:      1,
+					Name:    "cosmonauts",
+					State:   "SECONDARY",
+				}},
+			}, nil
+		},
+		Collections: []core.RestoredCollection{
+			{Name: "juju_restored.machines", Documents: 2},
+		},
+		ControllerInfoF: func() (core.ControllerInfo, error) {
+			return core.ControllerInfo{
+				JujuVersion: version.MustParse("2.8-beta1"),
+			}, nil
+		},
+	}
+	r, err := core.NewRestorer(
+		&db,
+		&coretesting.BackupFile{
+			DumpDirectoryF: func() string {
+				return "the dump dir!"
+			},
+			MetadataF: func() (core.BackupMetadata, error) {
+				return core.BackupMetadata{
+					JujuVersion: version.MustParse("2.7.6"),
+				}, nil
+			},
+		},
+		convertToMachine,
+		core.RestorerConfig{},
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	options := core.RestoreOptions{LogFile: "log path", TargetDatabase: "juju_restored"}
+	result, err := r.Restore(options)
+	c.Assert(err, jc.ErrorIsNil)
+	// The live controller's agents aren't touched.
+	c.Assert(result, jc.DeepEquals, &core.RestoreResult{
+		Collections:         db.Collections,
+		PreviousJujuVersion: version.MustParse("2.8-beta1"),
+		JujuVersion:         version.MustParse("2.8-beta1"),
+	})
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump")
+	db.CheckCall(c, 2, "RestoreFromDump", "the dump dir!", options)
+	for i := range machines {
+		machines[i].CheckNoCalls(c)
+	}
+}
+
+func (s *restorerSuite) TestRestoreTargetDatabaseIncrementals(c *gc.C) {
+	base, incrementals := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{Incrementals: incrementals})
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", TargetDatabase: "juju_restored"})
+	c.Assert(err, gc.ErrorMatches, "incremental backups can't be applied when restoring into another database")
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo")
 }
 
-func (db *fakeDatabase) ReplicaSet() (core.ReplicaSet, error) {
-	db.Stub.MethodCall(db, "ReplicaSet")
-	return db.replicaSetF()
+func (s *restorerSuite) TestRestoreLogDigest(c *gc.C) {
+	base, _ := backupChain()
+	digest := core.RestoreLogDigest{
+		Warnings: 2,
+		Lines: []core.RestoreLogLine{{
+			Level: core.RestoreLogWarning,
+			Text:  "continuing through error: E11000 duplicate key error collection: juju.txns.log",
+			Count: 2,
+		}},
+	}
+	db := &coretesting.Database{LogDigest: digest}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.LogDigest, jc.DeepEquals, digest)
 }
 
-func (db *fakeDatabase) ControllerInfo() (core.ControllerInfo, error) {
-	db.Stub.MethodCall(db, "ControllerInfo")
-	return db.controllerInfoF()
+func (s *restorerSuite) TestRestoreUsersOnly(c *gc.C) {
+	base, _ := backupChain()
+	merged := []core.MergedCollection{
+		{Name: "juju.users", Added: 3, Kept: 1},
+		{Name: "juju.controllerusers", Added: 3, Replaced: 1},
+	}
+	db := &coretesting.Database{Merged: merged}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	options := core.RestoreOptions{LogFile: "log path", UsersOnly: true, OverwriteUsers: true}
+	result, err := r.Restore(options)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.Merged, jc.DeepEquals, merged)
+	// The agents' versions aren't touched.
+	c.Assert(result.JujuVersion, gc.Equals, result.PreviousJujuVersion)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "MergeUsers")
+	db.CheckCall(c, 2, "RestoreFromDump", "/full/dump", options)
+	db.CheckCall(c, 3, "MergeUsers", true)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "juju.users", Action: "merged users: 3 added, 0 replaced, 1 kept"},
+		{Target: "juju.controllerusers", Action: "merged users: 3 added, 1 replaced, 0 kept"},
+	})
 }
 
-func (d *fakeDatabase) CopyController(controller core.ControllerInfo) error {
-	d.AddCall("CopyController", controller)
-	return nil
+func (s *restorerSuite) TestRestoreUsersOnlyMergeError(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.SetErrors(nil, errors.New("writing target permissions: no reachable servers"))
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", UsersOnly: true})
+	c.Assert(err, gc.ErrorMatches, "merging users: writing target permissions: no reachable servers")
+	c.Assert(err, jc.Satisfies, core.IsRestoreError)
 }
 
-func (db *fakeDatabase) RestoreFromDump(dumpDir, logFile string, includeStatusHistory, copyController bool) error {
-	db.Stub.MethodCall(db, "RestoreFromDump", dumpDir, logFile, includeStatusHistory, copyController)
-	return db.Stub.NextErr()
+func (s *restorerSuite) TestRestoreCopyControllerErrorDropsStaging(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{Staging: true}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	copyErr := errors.New("no reachable servers")
+	db.SetErrors(nil, copyErr)
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true})
+	c.Assert(err, gc.ErrorMatches, "problems copying source controller info: no reachable servers")
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "CopyController", "DropStagingDatabase")
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "database", Action: "copied the backup's controller data", Err: copyErr},
+		{Target: "database", Action: "removed the partly copied staging database"},
+	})
 }
 
-func (db *fakeDatabase) Close() {
-	db.Stub.MethodCall(db, "Close")
+// copiedBackup returns the full backup from backupChain with a
+// controller UUID for copying.
+func copiedBackup(c *gc.C) core.BackupFile {
+	base, _ := backupChain()
+	metadata, err := base.Metadata()
+	c.Assert(err, jc.ErrorIsNil)
+	metadata.ControllerUUID = "paper aeroplane"
+	return backupWithMetadata(metadata, "/full/dump")
 }
 
-type fakeControllerNode struct {
-	testing.Stub
-	ip string
+func (s *restorerSuite) TestRestoreCopyControllerSkipsEarlierCopy(c *gc.C) {
+	base := copiedBackup(c)
+	db := &coretesting.Database{CopySkipped: []string{"settings", "users"}}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.CopySkipped, jc.DeepEquals, []string{"settings", "users"})
+	db.CheckCall(c, 3, "CopyController", core.ControllerInfo{
+		ControllerModelUUID: "alex the astronaut",
+		JujuVersion:         version.MustParse("2.8.0"),
+		HANodes:             1,
+		Series:              "eoan",
+	}, "paper aeroplane", "full", core.RestoreOptions{LogFile: "log path", CopyController: true})
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "database", Action: "skipped what an earlier copy completed: settings, users"},
+		{Target: "database", Action: "copied the backup's controller data"},
+	})
 }
 
-func (f *fakeControllerNode) String() string {
-	return "node " + f.ip
+func (s *restorerSuite) TestRestoreRedoControllerCopy(c *gc.C) {
+	base := copiedBackup(c)
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true, RedoControllerCopy: true})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.CopySkipped, gc.HasLen, 0)
+	c.Assert(db.Calls()[3].Args[1:], jc.DeepEquals, []interface{}{"paper aeroplane", "full", core.RestoreOptions{LogFile: "log path", CopyController: true, RedoControllerCopy: true}})
 }
 
-func (f *fakeControllerNode) IP() string {
-	f.Stub.MethodCall(f, "IP")
-	return f.ip
+func (s *restorerSuite) TestPreviousControllerCopy(c *gc.C) {
+	base, _ := backupChain()
+	previous := &core.ControllerCopy{Source: "paper aeroplane", Backup: "full", Completed: []string{"settings"}}
+	db := &coretesting.Database{PreviousCopy: previous}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+
+	precheck := &core.PrecheckResult{ControllerUUID: "paper aeroplane", BackupID: "full"}
+	found, err := r.PreviousControllerCopy(precheck)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.Equals, previous)
+
+	// A copy from a different controller doesn't count.
+	found, err = r.PreviousControllerCopy(&core.PrecheckResult{ControllerUUID: "screaming jets", BackupID: "full"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.IsNil)
+
+	// Nor does a copy of a different backup of the same controller.
+	found, err = r.PreviousControllerCopy(&core.PrecheckResult{ControllerUUID: "paper aeroplane", BackupID: "newer"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.IsNil)
+
+	db.SetErrors(errors.New("no reachable servers"))
+	_, err = r.PreviousControllerCopy(precheck)
+	c.Assert(err, gc.ErrorMatches, "checking for an earlier controller copy: no reachable servers")
 }
 
-func (f *fakeControllerNode) Ping() error {
-	f.Stub.MethodCall(f, "Ping")
-	return f.NextErr()
+func (s *restorerSuite) TestPreviousControllerCopyWithoutBackupID(c *gc.C) {
+	base, _ := backupChain()
+	created := time.Date(2020, 3, 17, 16, 28, 24, 0, time.UTC)
+	previous := &core.ControllerCopy{Source: "paper aeroplane", Backup: "2020-03-17T16:28:24Z"}
+	db := &coretesting.Database{PreviousCopy: previous}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+
+	found, err := r.PreviousControllerCopy(&core.PrecheckResult{ControllerUUID: "paper aeroplane", BackupDate: created})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.Equals, previous)
+
+	// A live source read later is a different copy.
+	found, err = r.PreviousControllerCopy(&core.PrecheckResult{ControllerUUID: "paper aeroplane", BackupDate: created.Add(time.Minute)})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(found, gc.IsNil)
 }
 
-func (f *fakeControllerNode) StopAgent() error {
-	f.Stub.MethodCall(f, "StopAgent")
-	return f.NextErr()
+func (s *restorerSuite) TestRestoreDumpErrorDropsStaging(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{Staging: true}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.SetErrors(errors.New("disk full"))
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", CloudsOnly: true})
+	c.Assert(err, gc.ErrorMatches, `restoring dump from "/full/dump": disk full`)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "DropStagingDatabase")
 }
 
-func (f *fakeControllerNode) StartAgent() error {
-	f.Stub.MethodCall(f, "StartAgent")
-	return f.NextErr()
+func (s *restorerSuite) TestRestoreStagingDropError(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	dropErr := errors.New("not authorized")
+	db.SetErrors(nil, errors.New("reading source settings: not found"), dropErr)
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", SettingsOnly: true})
+	c.Assert(err, gc.ErrorMatches, "copying controller settings: reading source settings: not found")
+	c.Assert(changes[len(changes)-1], jc.DeepEquals, core.Change{
+		Target: "database",
+		Action: "couldn't remove the staging database (run juju-restore cleanup)",
+		Err:    dropErr,
+	})
 }
 
-func (f *fakeControllerNode) UpdateAgentVersion(target version.Number) error {
-	f.Stub.MethodCall(f, "UpdateAgentVersion", target)
-	return f.NextErr()
+func (s *restorerSuite) TestRestoreCloudsOnly(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	options := core.RestoreOptions{LogFile: "log path", CloudsOnly: true}
+	result, err := r.Restore(options)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.JujuVersion, gc.Equals, result.PreviousJujuVersion)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "CopyClouds")
+	db.CheckCall(c, 2, "RestoreFromDump", "/full/dump", options)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "database", Action: "copied the backup's clouds and credentials"},
+	})
 }
 
-type fakeBackup struct {
-	testing.Stub
-	metadataF func() (core.BackupMetadata, error)
-	dumpDirF  func() string
+func (s *restorerSuite) TestRestoreCloudsOnlyIncrementals(c *gc.C) {
+	base, incrementals := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{Incrementals: incrementals})
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", CloudsOnly: true})
+	c.Assert(err, gc.ErrorMatches, "incremental backups can't be applied when restoring only some collections")
 }
 
-func (b *fakeBackup) Metadata() (core.BackupMetadata, error) {
-	b.Stub.MethodCall(b, "Metadata")
-	return b.metadataF()
+func (s *restorerSuite) TestRestoreSettingsOnly(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{SettingsChanged: []string{"audit-log-max-backups", "features"}}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	options := core.RestoreOptions{LogFile: "log path", SettingsOnly: true}
+	result, err := r.Restore(options)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.SettingsChanged, jc.DeepEquals, []string{"audit-log-max-backups", "features"})
+	c.Assert(result.JujuVersion, gc.Equals, result.PreviousJujuVersion)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "CopySettings")
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "controller settings", Action: "restored audit-log-max-backups, features"},
+	})
 }
 
-func (b *fakeBackup) DumpDirectory() string {
-	b.Stub.MethodCall(b, "DumpDirectory")
-	return b.dumpDirF()
+func (s *restorerSuite) TestRestoreSettingsOnlyError(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.SetErrors(nil, errors.New("reading source settings: not found"))
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", SettingsOnly: true})
+	c.Assert(err, gc.ErrorMatches, "copying controller settings: reading source settings: not found")
+	c.Assert(err, jc.Satisfies, core.IsRestoreError)
+}
+
+func (s *restorerSuite) TestRestoreTrimsLogs(c *gc.C) {
+	metadata := core.BackupMetadata{
+		ControllerModelUUID: "alex the astronaut",
+		JujuVersion:         version.MustParse("2.8.0"),
+		BackupCreated:       time.Date(2020, 3, 17, 12, 0, 0, 0, time.UTC),
+	}
+	db := &coretesting.Database{LogsTrimmed: 42}
+	r := s.chainRestorer(c, db, backupWithMetadata(metadata, "/full/dump"), core.RestorerConfig{})
+	options := core.RestoreOptions{LogFile: "log path", IncludeLogs: true, LogsMaxAge: 3 * time.Hour}
+	result, err := r.Restore(options)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.LogsTrimmed, gc.Equals, 42)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "TrimLogs")
+	db.CheckCall(c, 2, "RestoreFromDump", "/full/dump", options)
+	db.CheckCall(c, 3, "TrimLogs", time.Date(2020, 3, 17, 9, 0, 0, 0, time.UTC))
+}
+
+func (s *restorerSuite) TestRestoreTrimLogsError(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.SetErrors(nil, errors.New("no logs for you"))
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path", IncludeLogs: true, LogsMaxAge: time.Hour})
+	c.Assert(err, gc.ErrorMatches, "trimming restored logs: no logs for you")
+	c.Assert(err, jc.Satisfies, core.IsRestoreError)
+}
+
+func (s *restorerSuite) TestRestoreRecordsChanges(c *gc.C) {
+	base, incrementals := backupChain()
+	db := &coretesting.Database{
+		Collections: []core.RestoredCollection{{Name: "juju.machines", Documents: 3}},
+	}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Incrementals: incrementals[:1],
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path"})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "juju.machines", Action: "replaced with 3 documents"},
+		{Target: "database", Action: `replayed oplog from "full"`},
+		{Target: "database", Action: `replayed oplog from "inc-1"`},
+	})
+}
+
+func (s *restorerSuite) TestRestoreRecordsPartialRestore(c *gc.C) {
+	base, _ := backupChain()
+	db := &coretesting.Database{
+		Collections: []core.RestoredCollection{{Name: "juju.machines", Documents: 3}},
+	}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	restoreErr := errors.New("mongorestore died")
+	db.SetErrors(restoreErr)
+	_, err := r.Restore(core.RestoreOptions{LogFile: "log path"})
+	c.Assert(err, gc.ErrorMatches, `restoring dump from "/full/dump": mongorestore died`)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "juju.machines", Action: "replaced with 3 documents"},
+		{Target: "database", Action: "restore from dump stopped part way", Err: restoreErr},
+	})
+}
+
+func (s *restorerSuite) TestRestoreCopyControllerMigrationReadiness(c *gc.C) {
+	base := copiedBackup(c).(*coretesting.BackupFile)
+	base.BackupModels = []core.ModelSummary{{
+		Name:         "admin/ready",
+		Cloud:        "aws",
+		CloudType:    "ec2",
+		Credential:   "aws#admin#default",
+		AgentVersion: version.MustParse("2.9.42"),
+	}, {
+		Name:         "admin/elsewhere",
+		Cloud:        "azure",
+		CloudType:    "azure",
+		Credential:   "azure#admin#default",
+		AgentVersion: version.MustParse("2.9.42"),
+	}, {
+		Name:         "bob/mismatched",
+		Cloud:        "lxd",
+		CloudType:    "lxd",
+		Credential:   "lxd#bob#stale",
+		AgentVersion: version.MustParse("2.8.9"),
+	}, {
+		Name:         "bob/ancient",
+		Cloud:        "aws",
+		CloudType:    "ec2",
+		AgentVersion: version.MustParse("1.25.6"),
+	}, {
+		Name:         "bob/newer",
+		Cloud:        "aws",
+		CloudType:    "ec2",
+		AgentVersion: version.MustParse("3.2.0"),
+	}, {
+		// Models whose version couldn't be read aren't version checked.
+		Name:      "bob/unknown",
+		Cloud:     "aws",
+		CloudType: "ec2",
+	}}
+	db := &coretesting.Database{Target: core.MigrationTarget{
+		Clouds:      map[string]string{"aws": "ec2", "lxd": "maas"},
+		Credentials: map[string]bool{"aws#admin#default": true, "lxd#bob#stale": false},
+	}}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{
+			ControllerModelUUID: "alex the astronaut",
+			JujuVersion:         version.MustParse("3.1.0.1"),
+			HANodes:             1,
+		}, nil
+	}
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.Readiness, jc.DeepEquals, &core.MigrationReadiness{
+		Models: 6,
+		Blockers: []core.MigrationBlocker{
+			{Model: "admin/elsewhere", Problem: `cloud "azure" isn't on the controller`},
+			{Model: "admin/elsewhere", Problem: `credential "azure#admin#default" isn't on the controller`},
+			{Model: "bob/mismatched", Problem: `cloud "lxd" is maas on the controller, not lxd`},
+			{Model: "bob/mismatched", Problem: `credential "lxd#bob#stale" is marked invalid on the controller`},
+			{Model: "bob/mismatched", Problem: "agent version 2.8.9 has to be upgraded to 2.9 before migrating to a 3.x controller"},
+			{Model: "bob/ancient", Problem: "agent version 1.25.6 is more than one major version behind the controller's 3.1.0"},
+			{Model: "bob/newer", Problem: "agent version 3.2.0 is newer than the controller's 3.1.0"},
+		},
+	})
+	c.Assert(result.Readiness.Blocked(), gc.Equals, 4)
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo", "RestoreFromDump", "CopyController", "MigrationTarget")
 }
 
-func (b *fakeBackup) Close() error {
-	b.Stub.MethodCall(b, "Close")
-	return b.Stub.NextErr()
+func (s *restorerSuite) TestRestoreCopyControllerMigrationReadinessError(c *gc.C) {
+	base := copiedBackup(c)
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.SetErrors(nil, nil, errors.New("no reachable servers"))
+	// The copy still counts as done.
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.Readiness, gc.IsNil)
+	c.Assert(c.GetTestLog(), jc.Contains, "couldn't check the models can be migrated: reading controller clouds and credentials: no reachable servers")
+}
+
+func (s *restorerSuite) TestRestoreCopyControllerSettings(c *gc.C) {
+	base := copiedBackup(c)
+	db := &coretesting.Database{SettingsChanged: []string{"audit-log-max-backups", "controller-name"}}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	filter := core.SettingsFilter{
+		Exclude: []string{"api-rate-limit"},
+		Include: []string{"controller-name"},
+	}
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true, CopySettings: filter})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.SettingsChanged, jc.DeepEquals, []string{"audit-log-max-backups", "controller-name"})
+	c.Assert(db.Calls()[3].Args[3].(core.RestoreOptions).CopySettings, jc.DeepEquals, filter)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "controller settings", Action: "copied audit-log-max-backups, controller-name"},
+		{Target: "database", Action: "copied the backup's controller data"},
+	})
+}
+
+func (s *restorerSuite) TestRestoreCopyControllerPermissions(c *gc.C) {
+	base := copiedBackup(c)
+	rewrites := []core.PermissionRewrite{
+		{ID: "cloud#aws#us#bob", NewID: "cloud#aws#us#bob"},
+		{ID: "e#old#us#bob", NewID: "e#new#us#bob", NewObjectGlobalKey: "e#new"},
+		{ID: "ao#offer#us#bob", Skipped: "offer permissions aren't copied"},
+	}
+	db := &coretesting.Database{PermissionRewrites: rewrites}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	result, err := r.Restore(core.RestoreOptions{LogFile: "log path", CopyController: true})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.Permissions, jc.DeepEquals, rewrites)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "permissions", Action: "copied 2, 1 of them rewritten for this controller, skipped 1"},
+		{Target: "database", Action: "copied the backup's controller data"},
+	})
+	c.Assert(c.GetTestLog(), jc.Contains, "permission e#old#us#bob → e#new#us#bob")
+}
+
+func (s *restorerSuite) TestPlanPermissionCopy(c *gc.C) {
+	base := copiedBackup(c).(*coretesting.BackupFile)
+	base.BackupPermissions = []core.PermissionDoc{
+		{ID: "c#paper aeroplane#us#bob", ObjectGlobalKey: "c#paper aeroplane"},
+		{ID: "e#old#us#mary", ObjectGlobalKey: "e#old"},
+	}
+	db := &coretesting.Database{}
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{})
+	db.ControllerInfoF = func() (core.ControllerInfo, error) {
+		return core.ControllerInfo{
+			ControllerUUID:      "crowded house",
+			ControllerModelUUID: "alex the astronaut",
+		}, nil
+	}
+	plan, err := r.PlanPermissionCopy()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(plan, jc.DeepEquals, []core.PermissionRewrite{
+		{ID: "c#paper aeroplane#us#bob", NewID: "c#crowded house#us#bob", NewObjectGlobalKey: "c#crowded house"},
+		{ID: "e#old#us#mary", NewID: "e#alex the astronaut#us#mary", NewObjectGlobalKey: "e#alex the astronaut"},
+	})
+	// Nothing is changed.
+	db.CheckCallNames(c, "ReplicaSet", "ControllerInfo")
+
+	base.SetErrors(errors.New("bad record"))
+	_, err = r.PlanPermissionCopy()
+	c.Assert(err, gc.ErrorMatches, "reading source permissions: bad record")
+}
+
+func (s *restorerSuite) TestRestoreCopyControllerAgentBinaries(c *gc.C) {
+	base := copiedBackup(c)
+	db := &coretesting.Database{AgentBinaries: []string{"2.9.37-focal-amd64", "2.9.37-jammy-amd64"}}
+	var changes []core.Change
+	r := s.chainRestorer(c, db, base, core.RestorerConfig{
+		Changed: func(change core.Change) {
+			changes = append(changes, change)
+		},
+	})
+	options := core.RestoreOptions{LogFile: "log path", CopyController: true, CopyAgentBinaries: true}
+	result, err := r.Restore(options)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(result.AgentBinaries, jc.DeepEquals, []string{"2.9.37-focal-amd64", "2.9.37-jammy-amd64"})
+	db.CheckCall(c, 2, "RestoreFromDump", "/full/dump", options)
+	c.Assert(db.Calls()[3].Args[3], jc.DeepEquals, options)
+	c.Assert(changes, jc.DeepEquals, []core.Change{
+		{Target: "blobstore", Action: "copied agent binaries 2.9.37-focal-amd64, 2.9.37-jammy-amd64"},
+		{Target: "database", Action: "copied the backup's controller data"},
+	})
 }
@@ -0,0 +1,352 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package coretesting provides fake implementations of the core
+// interfaces for testing code that uses a core.Restorer.
+package coretesting
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	"github.com/juju/version/v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// Database is a fake core.Database that records the calls made to it.
+// Errors set on the stub are returned from the methods that can fail.
+type Database struct {
+	testing.Stub
+
+	// ReplicaSetF and ControllerInfoF are called to get the results
+	// of ReplicaSet and ControllerInfo.
+	ReplicaSetF     func() (core.ReplicaSet, error)
+	ControllerInfoF func() (core.ControllerInfo, error)
+
+	// Collections and LogDigest are returned from RestoreFromDump,
+	// and Collections from StageFrom.
+	Collections []core.RestoredCollection
+	LogDigest   core.RestoreLogDigest
+
+	// OplogPosition is returned from LatestOplogPosition.
+	OplogPosition core.OplogPosition
+
+	// LogsTrimmed is returned from TrimLogs.
+	LogsTrimmed int
+
+	// Merged is returned from MergeUsers.
+	Merged []core.MergedCollection
+
+	// SettingsChanged is returned from CopySettings and
+	// CopyController.
+	SettingsChanged []string
+
+	// Staging is returned from HasStagingDatabase and
+	// DropStagingDatabase.
+	Staging bool
+
+	// CopySkipped, PermissionRewrites and AgentBinaries are
+	// returned from CopyController, and PreviousCopy from
+	// ControllerCopy.
+	CopySkipped        []string
+	PermissionRewrites []core.PermissionRewrite
+	AgentBinaries      []string
+	PreviousCopy       *core.ControllerCopy
+
+	// PermissionDocs is returned from Permissions.
+	PermissionDocs []core.PermissionDoc
+
+	// Entities is returned from ControllerEntities.
+	Entities core.ControllerEntities
+
+	// HostedModels is returned from Models, and Target from
+	// MigrationTarget.
+	HostedModels []core.ModelSummary
+	Target       core.MigrationTarget
+
+	// Active is returned from ActiveOperations.
+	Active core.ActiveOperations
+}
+
+// ReplicaSet is part of core.Database.
+func (d *Database) ReplicaSet() (core.ReplicaSet, error) {
+	d.Stub.MethodCall(d, "ReplicaSet")
+	return d.ReplicaSetF()
+}
+
+// ControllerInfo is part of core.Database.
+func (d *Database) ControllerInfo() (core.ControllerInfo, error) {
+	d.Stub.MethodCall(d, "ControllerInfo")
+	return d.ControllerInfoF()
+}
+
+// ControllerEntities is part of core.Database.
+func (d *Database) ControllerEntities() (core.ControllerEntities, error) {
+	d.Stub.MethodCall(d, "ControllerEntities")
+	return d.Entities, d.Stub.NextErr()
+}
+
+// CopyController is part of core.Database.
+func (d *Database) CopyController(controller core.ControllerInfo, source, backup string, options core.RestoreOptions) (core.ControllerCopyResult, error) {
+	d.Stub.MethodCall(d, "CopyController", controller, source, backup, options)
+	return core.ControllerCopyResult{
+		Skipped:         d.CopySkipped,
+		SettingsChanged: d.SettingsChanged,
+		Permissions:     d.PermissionRewrites,
+		AgentBinaries:   d.AgentBinaries,
+	}, d.Stub.NextErr()
+}
+
+// Permissions is part of core.Database.
+func (d *Database) Permissions() ([]core.PermissionDoc, error) {
+	d.Stub.MethodCall(d, "Permissions")
+	return d.PermissionDocs, d.Stub.NextErr()
+}
+
+// ControllerCopy is part of core.Database.
+func (d *Database) ControllerCopy() (*core.ControllerCopy, error) {
+	d.Stub.MethodCall(d, "ControllerCopy")
+	return d.PreviousCopy, d.Stub.NextErr()
+}
+
+// MergeUsers is part of core.Database.
+func (d *Database) MergeUsers(overwrite bool) ([]core.MergedCollection, error) {
+	d.Stub.MethodCall(d, "MergeUsers", overwrite)
+	return d.Merged, d.Stub.NextErr()
+}
+
+// CopyClouds is part of core.Database.
+func (d *Database) CopyClouds() error {
+	d.Stub.MethodCall(d, "CopyClouds")
+	return d.Stub.NextErr()
+}
+
+// CopySettings is part of core.Database.
+func (d *Database) CopySettings() ([]string, error) {
+	d.Stub.MethodCall(d, "CopySettings")
+	return d.SettingsChanged, d.Stub.NextErr()
+}
+
+// HasStagingDatabase is part of core.Database.
+func (d *Database) HasStagingDatabase() (bool, error) {
+	d.Stub.MethodCall(d, "HasStagingDatabase")
+	return d.Staging, d.Stub.NextErr()
+}
+
+// DropStagingDatabase is part of core.Database.
+func (d *Database) DropStagingDatabase() (bool, error) {
+	d.Stub.MethodCall(d, "DropStagingDatabase")
+	return d.Staging, d.Stub.NextErr()
+}
+
+// SetMachineIDTags is part of core.Database.
+func (d *Database) SetMachineIDTags(ids map[int]string) error {
+	d.Stub.MethodCall(d, "SetMachineIDTags", ids)
+	return d.Stub.NextErr()
+}
+
+// RestoreFromDump is part of core.Database.
+func (d *Database) RestoreFromDump(dumpDir string, options core.RestoreOptions) ([]core.RestoredCollection, core.RestoreLogDigest, error) {
+	d.Stub.MethodCall(d, "RestoreFromDump", dumpDir, options)
+	return d.Collections, d.LogDigest, d.Stub.NextErr()
+}
+
+// Models is part of core.Database.
+func (d *Database) Models() ([]core.ModelSummary, error) {
+	d.Stub.MethodCall(d, "Models")
+	return d.HostedModels, d.Stub.NextErr()
+}
+
+// ActiveOperations is part of core.Database.
+func (d *Database) ActiveOperations() (core.ActiveOperations, error) {
+	d.Stub.MethodCall(d, "ActiveOperations")
+	return d.Active, d.Stub.NextErr()
+}
+
+// MigrationTarget is part of core.Database.
+func (d *Database) MigrationTarget() (core.MigrationTarget, error) {
+	d.Stub.MethodCall(d, "MigrationTarget")
+	return d.Target, d.Stub.NextErr()
+}
+
+// StageFrom is part of core.Database.
+func (d *Database) StageFrom(source core.Database) ([]core.RestoredCollection, error) {
+	d.Stub.MethodCall(d, "StageFrom", source)
+	return d.Collections, d.Stub.NextErr()
+}
+
+// TrimLogs is part of core.Database.
+func (d *Database) TrimLogs(before time.Time) (int, error) {
+	d.Stub.MethodCall(d, "TrimLogs", before)
+	return d.LogsTrimmed, d.Stub.NextErr()
+}
+
+// LatestOplogPosition is part of core.Database.
+func (d *Database) LatestOplogPosition() (core.OplogPosition, error) {
+	d.Stub.MethodCall(d, "LatestOplogPosition")
+	return d.OplogPosition, d.Stub.NextErr()
+}
+
+// ReplayOplog is part of core.Database.
+func (d *Database) ReplayOplog(oplogFile, logFile string, limit core.OplogPosition) error {
+	d.Stub.MethodCall(d, "ReplayOplog", oplogFile, logFile, limit)
+	return d.Stub.NextErr()
+}
+
+// Close is part of core.Database.
+func (d *Database) Close() {
+	d.Stub.MethodCall(d, "Close")
+}
+
+// ControllerNode is a fake core.ControllerNode that records the calls
+// made to it. Errors set on the stub are returned from the methods
+// that can fail.
+type ControllerNode struct {
+	testing.Stub
+
+	// Address is returned as the node's name and IP address.
+	Address string
+
+	// AgentF, if set, is called when stopping or starting the agent.
+	AgentF func()
+
+	// NodeStatus is returned from Status.
+	NodeStatus core.NodeStatus
+
+	// CurrentTime is returned from Time.
+	CurrentTime time.Time
+
+	// Log is returned from AgentLog.
+	Log string
+}
+
+// String is part of fmt.Stringer.
+func (n *ControllerNode) String() string {
+	return "node " + n.Address
+}
+
+// Name is part of core.ControllerNode.
+func (n *ControllerNode) Name() string {
+	n.Stub.MethodCall(n, "Name")
+	return n.Address
+}
+
+// IP is part of core.ControllerNode.
+func (n *ControllerNode) IP() string {
+	n.Stub.MethodCall(n, "IP")
+	return n.Address
+}
+
+// Ping is part of core.ControllerNode.
+func (n *ControllerNode) Ping() error {
+	n.Stub.MethodCall(n, "Ping")
+	return n.NextErr()
+}
+
+// StopAgent is part of core.ControllerNode.
+func (n *ControllerNode) StopAgent() error {
+	n.Stub.MethodCall(n, "StopAgent")
+	if n.AgentF != nil {
+		n.AgentF()
+	}
+	return n.NextErr()
+}
+
+// StartAgent is part of core.ControllerNode.
+func (n *ControllerNode) StartAgent() error {
+	n.Stub.MethodCall(n, "StartAgent")
+	if n.AgentF != nil {
+		n.AgentF()
+	}
+	return n.NextErr()
+}
+
+// RestartDatabase is part of core.ControllerNode.
+func (n *ControllerNode) RestartDatabase() error {
+	n.Stub.MethodCall(n, "RestartDatabase")
+	return n.NextErr()
+}
+
+// UpdateAgentVersion is part of core.ControllerNode.
+func (n *ControllerNode) UpdateAgentVersion(target version.Number) error {
+	n.Stub.MethodCall(n, "UpdateAgentVersion", target)
+	return n.NextErr()
+}
+
+// Status is part of core.ControllerNode.
+func (n *ControllerNode) Status() (core.NodeStatus, error) {
+	n.Stub.MethodCall(n, "Status")
+	return n.NodeStatus, n.NextErr()
+}
+
+// Time is part of core.ControllerNode.
+func (n *ControllerNode) Time() (time.Time, error) {
+	n.Stub.MethodCall(n, "Time")
+	return n.CurrentTime, n.NextErr()
+}
+
+// AgentLog is part of core.ControllerNode.
+func (n *ControllerNode) AgentLog(lines int) (string, error) {
+	n.Stub.MethodCall(n, "AgentLog", lines)
+	return n.Log, n.NextErr()
+}
+
+// BackupFile is a fake core.BackupFile that records the calls made to
+// it.
+type BackupFile struct {
+	testing.Stub
+
+	// MetadataF and DumpDirectoryF are called to get the results of
+	// Metadata and DumpDirectory.
+	MetadataF      func() (core.BackupMetadata, error)
+	DumpDirectoryF func() string
+
+	// BackupEntities is returned from Entities, BackupModels from
+	// Models and BackupPermissions from Permissions.
+	BackupEntities    core.ControllerEntities
+	BackupModels      []core.ModelSummary
+	BackupPermissions []core.PermissionDoc
+}
+
+// Metadata is part of core.BackupFile.
+func (b *BackupFile) Metadata() (core.BackupMetadata, error) {
+	b.Stub.MethodCall(b, "Metadata")
+	return b.MetadataF()
+}
+
+// DumpDirectory is part of core.BackupFile.
+func (b *BackupFile) DumpDirectory() string {
+	b.Stub.MethodCall(b, "DumpDirectory")
+	return b.DumpDirectoryF()
+}
+
+// Entities is part of core.BackupFile.
+func (b *BackupFile) Entities() (core.ControllerEntities, error) {
+	b.Stub.MethodCall(b, "Entities")
+	return b.BackupEntities, b.Stub.NextErr()
+}
+
+// Models is part of core.BackupFile.
+func (b *BackupFile) Models() ([]core.ModelSummary, error) {
+	b.Stub.MethodCall(b, "Models")
+	return b.BackupModels, b.Stub.NextErr()
+}
+
+// Permissions is part of core.BackupFile.
+func (b *BackupFile) Permissions() ([]core.PermissionDoc, error) {
+	b.Stub.MethodCall(b, "Permissions")
+	return b.BackupPermissions, b.Stub.NextErr()
+}
+
+// Close is part of core.BackupFile.
+func (b *BackupFile) Close() error {
+	b.Stub.MethodCall(b, "Close")
+	return b.Stub.NextErr()
+}
+
+var (
+	_ core.Database       = (*Database)(nil)
+	_ core.ControllerNode = (*ControllerNode)(nil)
+	_ core.BackupFile     = (*BackupFile)(nil)
+)
@@ -0,0 +1,161 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2"
+	"github.com/juju/mgo/v2/bson"
+
+	"github.com/juju/juju-restore/core"
+)
+
+const (
+	// blobstoreDBName holds the controller's stored files, including
+	// agent binaries, in GridFS. Its catalog maps each bucket's paths
+	// to a stored resource, which names the GridFS file.
+	blobstoreDBName         = "blobstore"
+	blobstoreGridFS         = "blobstore"
+	managedResourcesColl    = "managedStoredResources"
+	storedResourcesColl     = "storedResources"
+	toolsMetadataCollection = "toolsmetadata"
+
+	// stagedBlobstorePrefix is the prefix the backup's blobstore
+	// collections are given when they're restored into the staging
+	// database alongside the juju collections.
+	stagedBlobstorePrefix = "blobstore."
+)
+
+// buildAgentBinaryRestoreArgs adds restoring the backup's agent
+// binary metadata and blobstore into the staging database to the
+// controller copy's mongorestore arguments.
+func buildAgentBinaryRestoreArgs(args []string) []string {
+	last := len(args) - 1
+	result := append([]string{}, args[:last]...)
+	result = append(result,
+		"--nsFrom="+blobstoreDBName+".*",
+		"--nsTo="+jujuControllerDBName+"."+stagedBlobstorePrefix+"*",
+		"--nsInclude="+jujuDBName+"."+toolsMetadataCollection,
+		"--nsInclude="+blobstoreDBName+".*",
+	)
+	return append(result, args[last])
+}
+
+// copyAgentBinaries copies the agent binaries staged from the backup
+// that the controller doesn't have into its blobstore, under the
+// controller model's bucket, and adds their metadata. It returns the
+// versions copied.
+func (db *database) copyAgentBinaries(controller core.ControllerInfo) ([]string, error) {
+	staging := db.session.DB(jujuControllerDBName)
+	var sourceTools []bson.M
+	if err := staging.C(toolsMetadataCollection).Find(nil).All(&sourceTools); err != nil {
+		return nil, errors.Annotate(err, "reading backup agent binary metadata")
+	}
+	targetTools := db.session.DB(jujuDBName).C(toolsMetadataCollection)
+	var copied []string
+	for _, tools := range sourceTools {
+		version, _ := tools["_id"].(string)
+		path, _ := tools["path"].(string)
+		if version == "" || path == "" {
+			continue
+		}
+		count, err := targetTools.FindId(version).Count()
+		if err != nil {
+			return copied, errors.Annotatef(err, "checking for agent binaries %s", version)
+		}
+		if count > 0 {
+			logger.Debugf("controller already has agent binaries %s", version)
+			continue
+		}
+		if err := db.copyManagedResource(path, controller.ControllerModelUUID); err != nil {
+			return copied, errors.Annotatef(err, "copying agent binaries %s", version)
+		}
+		if err := targetTools.Insert(tools); err != nil {
+			return copied, errors.Annotatef(err, "writing agent binary metadata for %s", version)
+		}
+		copied = append(copied, version)
+	}
+	sort.Strings(copied)
+	return copied, nil
+}
+
+// copyManagedResource copies the staged blobstore entry for path into
+// the controller's blobstore, in the given bucket. The file itself is
+// only copied if the controller doesn't already store one with the
+// same contents.
+func (db *database) copyManagedResource(path, bucketUUID string) error {
+	staging := db.session.DB(jujuControllerDBName)
+	var managed bson.M
+	err := staging.C(stagedBlobstorePrefix + managedResourcesColl).Find(bson.M{
+		"path": bson.M{"$regex": "/" + regexp.QuoteMeta(path) + "$"},
+	}).One(&managed)
+	if err == mgo.ErrNotFound {
+		return errors.Errorf("backup blobstore has no %s", path)
+	} else if err != nil {
+		return errors.Annotate(err, "reading backup blobstore catalog")
+	}
+	resourceID := managed["resourceid"]
+	var stored bson.M
+	err = staging.C(stagedBlobstorePrefix + storedResourcesColl).FindId(resourceID).One(&stored)
+	if err != nil {
+		return errors.Annotatef(err, "reading backup stored resource %v", resourceID)
+	}
+
+	blobstore := db.session.DB(blobstoreDBName)
+	existing, err := blobstore.C(storedResourcesColl).FindId(resourceID).Count()
+	if err != nil {
+		return errors.Annotate(err, "checking the blobstore")
+	}
+	if existing > 0 {
+		err = blobstore.C(storedResourcesColl).UpdateId(resourceID, bson.M{"$inc": bson.M{"refcount": 1}})
+		if err != nil {
+			return errors.Annotate(err, "updating stored resource")
+		}
+	} else {
+		name, _ := stored["path"].(string)
+		if err := copyGridFile(staging.GridFS(stagedBlobstorePrefix+blobstoreGridFS), blobstore.GridFS(blobstoreGridFS), name); err != nil {
+			return errors.Trace(err)
+		}
+		stored["refcount"] = 1
+		if err := blobstore.C(storedResourcesColl).Insert(stored); err != nil {
+			return errors.Annotate(err, "writing stored resource")
+		}
+	}
+
+	// The catalog entry is keyed by the bucket, which is the source
+	// controller model's.
+	sourceBucket, _ := managed["bucketuuid"].(string)
+	for _, field := range []string{"_id", "path"} {
+		if value, ok := managed[field].(string); ok && sourceBucket != "" {
+			managed[field] = strings.Replace(value, sourceBucket, bucketUUID, 1)
+		}
+	}
+	managed["bucketuuid"] = bucketUUID
+	_, err = blobstore.C(managedResourcesColl).UpsertId(managed["_id"], managed)
+	return errors.Annotate(err, "writing blobstore catalog")
+}
+
+// copyGridFile copies the named GridFS file from source to target.
+func copyGridFile(source, target *mgo.GridFS, name string) error {
+	in, err := source.Open(name)
+	if err != nil {
+		return errors.Annotatef(err, "opening backup blob %s", name)
+	}
+	defer in.Close()
+	out, err := target.Create(name)
+	if err != nil {
+		return errors.Annotatef(err, "creating blob %s", name)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Abort()
+		out.Close()
+		return errors.Annotatef(err, "copying blob %s", name)
+	}
+	return errors.Annotatef(out.Close(), "writing blob %s", name)
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db_test
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/db"
+)
+
+type controllerCopySuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&controllerCopySuite{})
+
+func (s *controllerCopySuite) TestResumable(c *gc.C) {
+	partial := core.ControllerCopy{
+		Source:    "dawkins-rules",
+		Backup:    "20200317-162824.a1b2c3",
+		Completed: []string{"settings", "users"},
+	}
+	finished := partial
+	finished.Finished = time.Date(2020, 3, 18, 9, 0, 0, 0, time.UTC)
+	for i, test := range []struct {
+		about     string
+		previous  *core.ControllerCopy
+		source    string
+		backup    string
+		resumable bool
+	}{{
+		about:     "same backup, stopped part way",
+		previous:  &partial,
+		source:    "dawkins-rules",
+		backup:    "20200317-162824.a1b2c3",
+		resumable: true,
+	}, {
+		about:    "same backup, finished",
+		previous: &finished,
+		source:   "dawkins-rules",
+		backup:   "20200317-162824.a1b2c3",
+	}, {
+		about:    "newer backup of the same controller",
+		previous: &partial,
+		source:   "dawkins-rules",
+		backup:   "20200320-090000.d4e5f6",
+	}, {
+		about:    "another controller",
+		previous: &partial,
+		source:   "screaming-jets",
+		backup:   "20200317-162824.a1b2c3",
+	}, {
+		about:  "no earlier copy",
+		source: "dawkins-rules",
+		backup: "20200317-162824.a1b2c3",
+	}} {
+		c.Logf("%d: %s", i, test.about)
+		c.Check(db.Resumable(test.previous, test.source, test.backup), gc.Equals, test.resumable)
+	}
+}
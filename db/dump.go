@@ -0,0 +1,209 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/mgo/v2/bson"
+
+	"github.com/juju/juju-restore/core"
+)
+
+const (
+	dumpBinary     = "mongodump"
+	snapDumpBinary = "juju-db.mongodump"
+)
+
+// ignoredDatabases aren't included in backups, matching Juju's own
+// backups.
+var ignoredDatabases = []string{"backups", "presence"}
+
+// Dump uses mongodump to write a dump of the database, including the
+// oplog so the dump is consistent, to dumpDir, which mustn't exist.
+// The mongodump output is written to logFile.
+func Dump(info DialInfo, dumpDir, logFile string) error {
+	return runDump(dumpDir, logFile, info.SnapDumpDir, func(outDir string) []string {
+		return buildDumpArgs(info, outDir)
+	}, func(outDir string) error {
+		for _, name := range ignoredDatabases {
+			if err := os.RemoveAll(filepath.Join(outDir, name)); err != nil {
+				return errors.Annotatef(err, "removing %s database from dump", name)
+			}
+		}
+		return nil
+	})
+}
+
+// DumpOplog uses mongodump to write the oplog entries from the since
+// position onwards to oplog.bson in dumpDir, which mustn't exist. This
+// is the dump for an incremental backup. It's an error if the entry
+// at since is no longer in the oplog, since there would be a gap
+// between the incremental and the backup it follows.
+func DumpOplog(info DialInfo, dumpDir, logFile string, since core.OplogPosition) error {
+	return runDump(dumpDir, logFile, info.SnapDumpDir, func(outDir string) []string {
+		return buildOplogDumpArgs(info, outDir, since)
+	}, func(outDir string) error {
+		oplogFile := filepath.Join(outDir, "oplog.bson")
+		if err := os.Rename(filepath.Join(outDir, "local", "oplog.rs.bson"), oplogFile); err != nil {
+			return errors.Annotate(err, "moving oplog dump")
+		}
+		if err := os.RemoveAll(filepath.Join(outDir, "local")); err != nil {
+			return errors.Trace(err)
+		}
+		first, err := firstOplogPosition(oplogFile)
+		if err != nil {
+			return errors.Annotate(err, "reading oplog dump")
+		}
+		if first != since {
+			return errors.Errorf("the oplog no longer goes back to %s - take a full backup instead", since.Time())
+		}
+		return nil
+	})
+}
+
+// runDump runs mongodump with the arguments returned by args for the
+// output directory, calls finish to tidy up the output and moves it
+// to dumpDir. snapDir is the configured snap dump dir, if any.
+func runDump(dumpDir, logFile, snapDir string, args func(outDir string) []string, finish func(outDir string) error) error {
+	binary, isSnap, err := getDumpBinary()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Snap mongodump can only write to certain directories, so dump
+	// under the snap dump dir and move the dump into place after.
+	outDir := dumpDir
+	if isSnap {
+		parent, err := snapDumpDir(snapDir, binary)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return errors.Annotate(err, "creating snap dump parent")
+		}
+		tempDir, err := ioutil.TempDir(parent, "juju-restore-dump")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer func() {
+			if err := os.RemoveAll(tempDir); err != nil {
+				logger.Warningf("error removing snap dump dir: %v", err)
+			}
+		}()
+		outDir = filepath.Join(tempDir, "dump")
+	}
+
+	command := exec.Command(binary, args(outDir)...)
+	logger.Debugf("running dump command: %s", strings.Join(command.Args, " "))
+	output, err := command.CombinedOutput()
+	if writeErr := ioutil.WriteFile(logFile, output, 0664); writeErr != nil {
+		logger.Debugf("%s output:\n%s", binary, output)
+		if err == nil {
+			return errors.Annotatef(writeErr, "writing output to %s", logFile)
+		}
+	}
+	if err != nil {
+		return errors.Annotatef(err, "running %s", binary)
+	}
+
+	if err := finish(outDir); err != nil {
+		return errors.Trace(err)
+	}
+	if outDir == dumpDir {
+		return nil
+	}
+	if err := os.Rename(outDir, dumpDir); err == nil {
+		return nil
+	}
+	logger.Debugf("copying %q to %q", outDir, dumpDir)
+	return errors.Annotate(copyTree(outDir, dumpDir, copyFile), "moving dump out of snap dir")
+}
+
+func buildDumpArgs(info DialInfo, outDir string) []string {
+	args := []string{
+		"--host", info.Hostname,
+		"--port", info.Port,
+		"--authenticationDatabase=admin",
+		"--username", info.Username,
+		"--password", info.Password,
+		"--oplog",
+		"--out", outDir,
+	}
+	if info.SSL {
+		args = append(args, "--ssl", "--sslAllowInvalidCertificates")
+	}
+	return args
+}
+
+func buildOplogDumpArgs(info DialInfo, outDir string, since core.OplogPosition) []string {
+	args := []string{
+		"--host", info.Hostname,
+		"--port", info.Port,
+		"--authenticationDatabase=admin",
+		"--username", info.Username,
+		"--password", info.Password,
+		"--db=local",
+		"--collection=oplog.rs",
+		"--query", fmt.Sprintf(`{"ts": {"$gte": {"$timestamp": {"t": %d, "i": %d}}}}`, int64(since>>32), uint32(since)),
+		"--out", outDir,
+	}
+	if info.SSL {
+		args = append(args, "--ssl", "--sslAllowInvalidCertificates")
+	}
+	return args
+}
+
+// firstOplogPosition reads the position of the first entry in a dumped
+// oplog, returning zero if there are no entries.
+func firstOplogPosition(path string) (core.OplogPosition, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer source.Close()
+	// Each bson document starts with a 32-bit little-endian size.
+	var size int32
+	if err := binary.Read(source, binary.LittleEndian, &size); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Trace(err)
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data, uint32(size))
+	if _, err := io.ReadFull(source, data[4:]); err != nil {
+		return 0, errors.Trace(err)
+	}
+	var entry struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+	if err := bson.Unmarshal(data, &entry); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return core.OplogPosition(entry.Timestamp), nil
+}
+
+// getDumpBinary returns the mongodump to use: the juju-db snap's if
+// it's installed, or one on the PATH.
+func getDumpBinary() (binary string, isSnap bool, err error) {
+	if tools, ok := findSnapTools(); ok && tools.dump != "" {
+		return tools.dump, true, nil
+	}
+	if _, err := exec.LookPath(snapDumpBinary); err == nil {
+		return snapDumpBinary, true, nil
+	}
+	if _, err := exec.LookPath(dumpBinary); err == nil {
+		return dumpBinary, false, nil
+	}
+	return "", false, errors.Errorf("couldn't find %s or %s in PATH (%s)",
+		snapDumpBinary, dumpBinary, os.Getenv("PATH"))
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+type restoreErrorKind string
+
+const (
+	restoreAuthFailed      restoreErrorKind = "authentication failed"
+	restoreDiskFull        restoreErrorKind = "database disk full"
+	restoreIndexKeyTooLong restoreErrorKind = "index key too long"
+	restoreFCVMismatch     restoreErrorKind = "feature compatibility version mismatch"
+	restoreConnectionLost  restoreErrorKind = "database connection lost"
+	restorePrimaryChanged  restoreErrorKind = "replica set primary changed"
+)
+
+// restoreSignature recognises a kind of mongorestore failure from
+// the lines it logs, with what to do about it.
+type restoreSignature struct {
+	kind     restoreErrorKind
+	messages []string
+	hint     string
+}
+
+// restoreSignatures are checked in order, so more specific failures
+// come before ones (like a lost connection) that can follow them.
+var restoreSignatures = []restoreSignature{{
+	kind: restoreAuthFailed,
+	messages: []string{
+		"Authentication failed",
+		"AuthenticationFailed",
+		"not authorized",
+		"Unauthorized",
+	},
+	hint: "check the credentials passed with --username and --password, or the ones in agent.conf",
+}, {
+	kind: restoreDiskFull,
+	messages: []string{
+		"No space left on device",
+		"OutOfDiskSpace",
+		"disk full",
+		"Insufficient free space",
+	},
+	hint: "free space on the database volume and run the restore again",
+}, {
+	kind: restoreIndexKeyTooLong,
+	messages: []string{
+		"key too large to index",
+		"KeyTooLong",
+		"Index key too large",
+	},
+	hint: "the backup has index keys longer than this mongo allows - restore onto the mongo version the backup was taken with",
+}, {
+	kind: restoreFCVMismatch,
+	messages: []string{
+		"featureCompatibilityVersion",
+		"feature compatibility version",
+		"UnsupportedFormat",
+	},
+	hint: "set the database's featureCompatibilityVersion to match the mongo version the backup was taken with",
+}, {
+	kind: restoreConnectionLost,
+	messages: []string{
+		"connection reset by peer",
+		"connection refused",
+		"no reachable servers",
+		"server selection error",
+		"broken pipe",
+		"i/o timeout",
+	},
+	hint: "check juju-db is running and the replica set is healthy, then run the restore again",
+}, {
+	kind: restorePrimaryChanged,
+	messages: []string{
+		"not master",
+		"NotWritablePrimary",
+		"PrimarySteppedDown",
+		"InterruptedDueToReplStateChange",
+	},
+	hint: "wait for the replica set to elect a primary and run the restore again",
+}}
+
+type restoreError struct {
+	binary string
+	kind   restoreErrorKind
+	line   string
+	hint   string
+	err    error
+}
+
+// Error is part of error.
+func (e *restoreError) Error() string {
+	return fmt.Sprintf("running %s: %s: %s - %s", e.binary, e.kind, e.line, e.hint)
+}
+
+// Unwrap returns the error from running mongorestore.
+func (e *restoreError) Unwrap() error {
+	return e.err
+}
+
+// classifyRestoreError works out why a mongorestore invocation
+// failed from its output, returning nil if the failure isn't one it
+// recognises.
+func classifyRestoreError(binary string, output []byte, err error) error {
+	lines := strings.Split(string(output), "\n")
+	for _, signature := range restoreSignatures {
+		for _, message := range signature.messages {
+			for _, line := range lines {
+				if !strings.Contains(strings.ToLower(line), strings.ToLower(message)) {
+					continue
+				}
+				return &restoreError{
+					binary: binary,
+					kind:   signature.kind,
+					line:   strings.TrimSpace(logTimestampRE.ReplaceAllString(line, "")),
+					hint:   signature.hint,
+					err:    err,
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isRestoreErrorKind(err error, kind restoreErrorKind) bool {
+	e, ok := errors.Cause(err).(*restoreError)
+	return ok && e.kind == kind
+}
+
+// IsRestoreAuthError returns whether err was caused by mongorestore
+// failing to authenticate to the database.
+func IsRestoreAuthError(err error) bool {
+	return isRestoreErrorKind(err, restoreAuthFailed)
+}
+
+// IsDiskFullError returns whether err was caused by the database
+// running out of disk space during a restore.
+func IsDiskFullError(err error) bool {
+	return isRestoreErrorKind(err, restoreDiskFull)
+}
+
+// IsIndexKeyTooLongError returns whether err was caused by the
+// backup having index keys too long for the database's mongo.
+func IsIndexKeyTooLongError(err error) bool {
+	return isRestoreErrorKind(err, restoreIndexKeyTooLong)
+}
+
+// IsFCVMismatchError returns whether err was caused by the database's
+// feature compatibility version not suiting the backup.
+func IsFCVMismatchError(err error) bool {
+	return isRestoreErrorKind(err, restoreFCVMismatch)
+}
+
+// IsConnectionLostError returns whether err was caused by mongorestore
+// losing its connection to the database.
+func IsConnectionLostError(err error) bool {
+	return isRestoreErrorKind(err, restoreConnectionLost)
+}
+
+// IsPrimaryChangedError returns whether err was caused by a replica
+// set election while mongorestore was writing.
+func IsPrimaryChangedError(err error) bool {
+	return isRestoreErrorKind(err, restorePrimaryChanged)
+}
+
+// isTransientRestoreError returns whether a restore that failed with
+// err might succeed if it's tried again.
+func isTransientRestoreError(err error) bool {
+	return IsConnectionLostError(err) || IsPrimaryChangedError(err)
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db_test
+
+import (
+	stderrors "errors"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/db"
+)
+
+type errorsSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&errorsSuite{})
+
+func (s *errorsSuite) TestClassifyRestoreError(c *gc.C) {
+	for i, test := range []struct {
+		about   string
+		output  string
+		message string
+		check   func(error) bool
+	}{{
+		about: "auth failure",
+		output: `2022-02-08T03:12:44.318+0000	error connecting to host: could not connect to server: connection() error occured during connection handshake: auth error: sasl conversation error: unable to authenticate using mechanism "SCRAM-SHA-1": (AuthenticationFailed) Authentication failed.
+`,
+		message: `running mongorestore: authentication failed: error connecting to host: .*\(AuthenticationFailed\) Authentication failed\. - check the credentials .*`,
+		check:   db.IsRestoreAuthError,
+	}, {
+		about: "not authorized",
+		output: `2022-02-08T03:12:44.318+0000	preparing collections to restore from
+2022-02-08T03:12:44.321+0000	Failed: juju.machines: error dropping collection: (Unauthorized) not authorized on juju to execute command { drop: "machines" }
+`,
+		message: `running mongorestore: authentication failed: Failed: juju.machines: error dropping collection: \(Unauthorized\) .* - .*`,
+		check:   db.IsRestoreAuthError,
+	}, {
+		about: "disk full",
+		output: `2022-02-08T03:15:02.001+0000	restoring juju.statuseshistory from /tmp/dump/juju/statuseshistory.bson
+2022-02-08T03:15:09.774+0000	Failed: juju.statuseshistory: error restoring from /tmp/dump/juju/statuseshistory.bson: (OutOfDiskSpace) Failed to write to journal: No space left on device
+`,
+		message: `running mongorestore: database disk full: Failed: juju.statuseshistory: .*No space left on device - free space on the database volume and run the restore again`,
+		check:   db.IsDiskFullError,
+	}, {
+		about: "disk full before the connection drops",
+		output: `2022-02-08T03:15:09.774+0000	WiredTiger error (28) [1644290109:774021][1234:0x7f], file:collection-42.wt, WT_SESSION.create: No space left on device
+2022-02-08T03:15:09.790+0000	Failed: juju.txns: error restoring from archive: connection(localhost:37017[-3]) incomplete read of message header: read tcp 127.0.0.1:52044->127.0.0.1:37017: read: connection reset by peer
+`,
+		message: `running mongorestore: database disk full: WiredTiger error \(28\) .*`,
+		check:   db.IsDiskFullError,
+	}, {
+		about: "index key too long",
+		output: `2022-02-08T03:16:20.512+0000	Failed: juju.settings: error creating indexes for juju.settings: createIndex error: (KeyTooLong) Btree::insert: key too large to index, failing juju.settings.$_id_ 1041 { : "..." }
+`,
+		message: `running mongorestore: index key too long: Failed: juju.settings: .*`,
+		check:   db.IsIndexKeyTooLongError,
+	}, {
+		about: "fcv mismatch",
+		output: `2022-02-08T03:17:41.006+0000	Failed: juju.leases: error creating collection juju.leases: error running create command: (UnsupportedFormat) The featureCompatibilityVersion must be 4.2 to create a collection with this option
+`,
+		message: `running mongorestore: feature compatibility version mismatch: .*`,
+		check:   db.IsFCVMismatchError,
+	}, {
+		about: "connection lost",
+		output: `2022-02-08T03:18:55.240+0000	Failed: juju.txns: error restoring from archive: connection(localhost:37017[-3]) incomplete read of message header: read tcp 127.0.0.1:52044->127.0.0.1:37017: read: connection reset by peer
+`,
+		message: `running mongorestore: database connection lost: Failed: juju.txns: .*connection reset by peer - check juju-db is running .*`,
+		check:   db.IsConnectionLostError,
+	}, {
+		about: "primary stepped down",
+		output: `2022-02-08T03:19:03.417+0000	Failed: juju.units: error restoring from /tmp/dump/juju/units.bson: (NotWritablePrimary) not primary
+`,
+		message: `running mongorestore: replica set primary changed: Failed: juju.units: .*`,
+		check:   db.IsPrimaryChangedError,
+	}} {
+		c.Logf("%d: %s", i, test.about)
+		runErr := errors.New("exit status 1")
+		err := db.ClassifyRestoreError("mongorestore", []byte(test.output), runErr)
+		c.Assert(err, gc.NotNil)
+		c.Check(err, gc.ErrorMatches, test.message)
+		c.Check(test.check(errors.Annotate(err, "restoring")), jc.IsTrue)
+		c.Check(stderrors.Unwrap(err), gc.Equals, runErr)
+	}
+}
+
+func (s *errorsSuite) TestClassifyRestoreErrorUnrecognised(c *gc.C) {
+	// Duplicate keys are reported as the first error rather than as a
+	// kind of their own.
+	output := `2022-02-08T03:20:11.902+0000	continuing through error: E11000 duplicate key error collection: juju.machines index: _id_ dup key: { _id: "c1a1b2c3:0" }
+2022-02-08T03:20:12.010+0000	Failed: juju.machines: error restoring from /tmp/dump/juju/machines.bson: 1 failure
+`
+	err := db.ClassifyRestoreError("mongorestore", []byte(output), errors.New("exit status 1"))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *errorsSuite) TestTransientRestoreErrors(c *gc.C) {
+	for i, test := range []struct {
+		output    string
+		transient bool
+	}{
+		{"read: connection reset by peer", true},
+		{"(NotWritablePrimary) not primary", true},
+		{"(InterruptedDueToReplStateChange) operation was interrupted", true},
+		{"No space left on device", false},
+		{"(AuthenticationFailed) Authentication failed.", false},
+	} {
+		c.Logf("%d: %s", i, test.output)
+		err := db.ClassifyRestoreError("mongorestore", []byte(test.output), errors.New("exit status 1"))
+		c.Check(db.IsTransientRestoreError(err), gc.Equals, test.transient)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+var (
+	ClassifyRestoreError    = classifyRestoreError
+	IsTransientRestoreError = isTransientRestoreError
+)
+
+var (
+	SameFilesystem = &sameFilesystem
+	Resumable      = resumable
+)
+
+// LinkToHomeSnap stages dumpDir under snapDumpDir as a restore with
+// snap mongorestore would.
+func LinkToHomeSnap(snapDumpDir, dumpDir string) (string, error) {
+	db := &database{info: DialInfo{SnapDumpDir: snapDumpDir}}
+	return db.linkToHomeSnap("juju-db.mongorestore", dumpDir)
+}
@@ -1,16 +1,25 @@
 // Copyright 2020 Canonical Ltd.
 // Licensed under the AGPLv3, see LICENCE file for details.
 
+// Package db provides a concrete implementation of core.Database
+// backed by the controller's MongoDB.
 package db
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/juju/collections/set"
 	"github.com/juju/errors"
@@ -32,6 +41,15 @@ type DialInfo struct {
 	Username string
 	Password string
 	SSL      bool
+
+	// CACert, if set, is the PEM-encoded CA certificate used to
+	// verify the server's certificate when connecting with SSL.
+	CACert string
+
+	// SnapDumpDir, if set, is where dumps are staged for the juju-db
+	// snap's mongodump and mongorestore, which can only use certain
+	// directories. By default it's found from the snap.
+	SnapDumpDir string
 }
 
 // Dial creates a new connection to the specified database.
@@ -44,7 +62,13 @@ func Dial(args DialInfo) (core.Database, error) {
 		Direct:   true,
 	}
 	if args.SSL {
-		info.DialServer = dialSSL
+		tlsConfig, err := newTLSConfig(args.CACert)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return dialSSL(addr, tlsConfig)
+		}
 	}
 	session, err := mgo.DialWithInfo(&info)
 	if err != nil {
@@ -87,37 +111,213 @@ func (db *database) ReplicaSet() (core.ReplicaSet, error) {
 		return t
 	}
 
+	optimes, err := db.memberOptimes()
+	if err != nil {
+		return core.ReplicaSet{}, errors.Trace(err)
+	}
+	var primaryOptime time.Time
+	for _, m := range status.Members {
+		if m.State == replicaset.PrimaryState {
+			primaryOptime = optimes[m.Id]
+		}
+	}
+
 	result := core.ReplicaSet{
 		Name:    status.Name,
 		Members: make([]core.ReplicaSetMember, len(status.Members)),
 	}
+	result.OplogWindow, err = db.oplogWindow()
+	if err != nil {
+		// The window is only used to explain lag, so don't fail
+		// the health check if we can't read it.
+		logger.Warningf("couldn't get oplog window: %v", err)
+	}
+	var controllerAddresses map[string]string
 	for i, m := range status.Members {
+		config := mapped[m.Id]
 		result.Members[i] = core.ReplicaSetMember{
 			ID:            m.Id,
 			Name:          m.Address,
 			Self:          m.Self,
 			Healthy:       m.Healthy,
 			State:         m.State.String(),
-			JujuMachineID: machineID(mapped[m.Id]),
+			JujuMachineID: machineID(config),
+			Arbiter:       config.Arbiter != nil && *config.Arbiter,
+			Hidden:        config.Hidden != nil && *config.Hidden,
+		}
+		if optime := optimes[m.Id]; !optime.IsZero() && !primaryOptime.IsZero() && optime.Before(primaryOptime) {
+			result.Members[i].Lag = primaryOptime.Sub(optime)
+		}
+		if config.SlaveDelay != nil {
+			// The config stores the delay in seconds, but it's
+			// unmarshalled directly into a time.Duration.
+			result.Members[i].Delay = *config.SlaveDelay * time.Second
+		}
+		if result.Members[i].IsAuxiliary() {
+			continue
+		}
+		if result.Members[i].JujuMachineID != "" {
+			continue
+		}
+		// The tags can be lost if the replica set has been repaired
+		// by hand - fall back to finding the controller machine
+		// with the member's address.
+		if controllerAddresses == nil {
+			controllerAddresses, err = db.controllerMachineAddresses()
+			if err != nil {
+				return core.ReplicaSet{}, errors.Annotate(err, "finding controller machine IDs")
+			}
+		}
+		host, _, err := net.SplitHostPort(m.Address)
+		if err != nil {
+			host = m.Address
+		}
+		if id, ok := controllerAddresses[host]; ok {
+			logger.Debugf("replica set member %q has no juju-machine-id tag, found machine %s", m.Address, id)
+			result.Members[i].JujuMachineID = id
+			result.Members[i].MachineIDInferred = true
 		}
 	}
 	return result, nil
 
 }
 
+// memberOptimes gets the time of the last operation applied by each
+// replica set member, keyed by member ID. The replicaset package
+// doesn't expose these. Arbiters hold no data so they're left out.
+func (db *database) memberOptimes() (map[int]time.Time, error) {
+	var status struct {
+		Members []struct {
+			ID         int       `bson:"_id"`
+			OptimeDate time.Time `bson:"optimeDate"`
+		} `bson:"members"`
+	}
+	if err := db.session.Run("replSetGetStatus", &status); err != nil {
+		return nil, errors.Annotate(err, "getting replica set optimes")
+	}
+	result := make(map[int]time.Time)
+	for _, m := range status.Members {
+		if !m.OptimeDate.IsZero() {
+			result[m.ID] = m.OptimeDate
+		}
+	}
+	return result, nil
+}
+
+// oplogWindow returns the time between the first and last entries in
+// the oplog of the member we're connected to.
+func (db *database) oplogWindow() (time.Duration, error) {
+	var first, last struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+	oplog := db.session.DB("local").C("oplog.rs")
+	if err := oplog.Find(nil).Sort("$natural").One(&first); err != nil {
+		return 0, errors.Annotate(err, "reading oldest oplog entry")
+	}
+	if err := oplog.Find(nil).Sort("-$natural").One(&last); err != nil {
+		return 0, errors.Annotate(err, "reading newest oplog entry")
+	}
+	// The high 32 bits of a timestamp are seconds since the epoch.
+	seconds := int64(last.Timestamp>>32) - int64(first.Timestamp>>32)
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// LatestOplogPosition is part of core.Database.
+func (db *database) LatestOplogPosition() (core.OplogPosition, error) {
+	var last struct {
+		Timestamp bson.MongoTimestamp `bson:"ts"`
+	}
+	oplog := db.session.DB("local").C("oplog.rs")
+	if err := oplog.Find(nil).Sort("-$natural").One(&last); err != nil {
+		return 0, errors.Annotate(err, "reading newest oplog entry")
+	}
+	return core.OplogPosition(last.Timestamp), nil
+}
+
+// controllerMachineAddresses maps the addresses of all controller
+// machines to their machine IDs.
+func (db *database) controllerMachineAddresses() (map[string]string, error) {
+	type address struct {
+		Value string `bson:"value"`
+	}
+	var machineDoc struct {
+		MachineID        string    `bson:"machineid"`
+		Addresses        []address `bson:"addresses"`
+		MachineAddresses []address `bson:"machineaddresses"`
+	}
+	query := bson.M{
+		"jobs": bson.M{"$in": []int{jobManageModel}},
+		"life": alive,
+	}
+	result := make(map[string]string)
+	iter := db.session.DB(jujuDBName).C("machines").Find(query).Iter()
+	for iter.Next(&machineDoc) {
+		for _, addr := range append(machineDoc.Addresses, machineDoc.MachineAddresses...) {
+			result[addr.Value] = machineDoc.MachineID
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// SetMachineIDTags is part of core.Database.
+func (db *database) SetMachineIDTags(ids map[int]string) error {
+	members, err := replicaset.CurrentMembers(db.session)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for i, member := range members {
+		id, ok := ids[member.Id]
+		if !ok {
+			continue
+		}
+		if member.Tags == nil {
+			members[i].Tags = make(map[string]string)
+		}
+		members[i].Tags["juju-machine-id"] = id
+	}
+	return errors.Trace(replicaset.Set(db.session, members))
+}
+
 const jobManageModel = 2
 const alive = 0
 
 const (
 	jujuDBName           = "juju"
 	jujuControllerDBName = "jujucontroller"
+	logsDBName           = "logs"
+
+	// restoreStateDBName is where juju-restore records its own
+	// progress, such as how far a controller copy got.
+	restoreStateDBName = "jujurestore"
+	controllerCopyID   = "copy-controller"
 )
 
+// jujuCollections are collections every Juju controller database has,
+// used to make sure we're not connected to some other database.
+var jujuCollections = []string{"controllers", "machines", "models", "settings"}
+
 // ControllerInfo is part of core.Database.
 func (db *database) ControllerInfo() (core.ControllerInfo, error) {
 	var result core.ControllerInfo
 
 	jujuDB := db.session.DB(jujuDBName)
+	names, err := jujuDB.CollectionNames()
+	if err != nil {
+		return core.ControllerInfo{}, errors.Annotate(err, "listing juju collections")
+	}
+	present := set.NewStrings(names...)
+	var missing []string
+	for _, name := range jujuCollections {
+		if !present.Contains(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return core.ControllerInfo{}, errors.Errorf("this doesn't look like a Juju controller database: no %s collections in the juju database", strings.Join(missing, ", "))
+	}
 	num, err := jujuDB.C("models").Find(nil).Count()
 	if err != nil {
 		return core.ControllerInfo{}, errors.Annotate(err, "getting model count")
@@ -160,31 +360,250 @@ func (db *database) ControllerInfo() (core.ControllerInfo, error) {
 		return core.ControllerInfo{}, errors.Trace(err)
 	}
 
+	if result.JujuVersion.Major >= 3 {
+		result.HANodes, result.Base, err = db.controllerBase(modelDoc.ID)
+	} else {
+		result.HANodes, result.Series, err = db.controllerSeries(modelDoc.ID)
+	}
+	if err != nil {
+		return core.ControllerInfo{}, errors.Trace(err)
+	}
+	return result, nil
+}
+
+// ControllerEntities is part of core.Database.
+func (db *database) ControllerEntities() (core.ControllerEntities, error) {
+	var result core.ControllerEntities
+	jujuDB := db.session.DB(jujuDBName)
+	for _, entities := range []struct {
+		collection string
+		ids        *[]string
+	}{
+		{"users", &result.Users},
+		{"clouds", &result.Clouds},
+	} {
+		var docs []struct {
+			ID string `bson:"_id"`
+		}
+		err := jujuDB.C(entities.collection).Find(nil).Select(bson.M{"_id": 1}).All(&docs)
+		if err != nil {
+			return core.ControllerEntities{}, errors.Annotatef(err, "reading %s", entities.collection)
+		}
+		for _, doc := range docs {
+			*entities.ids = append(*entities.ids, doc.ID)
+		}
+		sort.Strings(*entities.ids)
+	}
+	return result, nil
+}
+
+// Models is part of core.Database. The controller model is the one
+// named controller, as in ControllerInfo.
+func (db *database) Models() ([]core.ModelSummary, error) {
+	jujuDB := db.session.DB(jujuDBName)
+	var modelDocs []struct {
+		ID              string `bson:"_id"`
+		Name            string `bson:"name"`
+		Owner           string `bson:"owner"`
+		Cloud           string `bson:"cloud"`
+		CloudCredential string `bson:"cloud-credential"`
+	}
+	err := jujuDB.C("models").Find(bson.M{"name": bson.M{"$ne": "controller"}}).Sort("owner", "name").All(&modelDocs)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading models")
+	}
+	target, err := db.MigrationTarget()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result []core.ModelSummary
+	for _, doc := range modelDocs {
+		model := core.ModelSummary{
+			Name:       doc.Owner + "/" + doc.Name,
+			Cloud:      doc.Cloud,
+			CloudType:  target.Clouds[doc.Cloud],
+			Credential: strings.Replace(doc.CloudCredential, "/", "#", -1),
+		}
+		var settingsDoc struct {
+			Settings map[string]interface{} `bson:"settings"`
+		}
+		err := jujuDB.C("settings").FindId(doc.ID + ":e").One(&settingsDoc)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, errors.Annotatef(err, "reading settings for model %s", model.Name)
+		}
+		// A version that can't be read is left for the checks to skip.
+		if versionStr, ok := settingsDoc.Settings["agent-version"].(string); ok {
+			model.AgentVersion, _ = version.Parse(versionStr)
+		}
+		result = append(result, model)
+	}
+	return result, nil
+}
+
+// MigrationTarget is part of core.Database.
+func (db *database) MigrationTarget() (core.MigrationTarget, error) {
+	jujuDB := db.session.DB(jujuDBName)
+	var cloudDocs []struct {
+		ID   string `bson:"_id"`
+		Type string `bson:"type"`
+	}
+	err := jujuDB.C("clouds").Find(nil).Select(bson.M{"type": 1}).All(&cloudDocs)
+	if err != nil {
+		return core.MigrationTarget{}, errors.Annotate(err, "reading clouds")
+	}
+	var credentialDocs []struct {
+		ID      string `bson:"_id"`
+		Invalid bool   `bson:"invalid"`
+	}
+	err = jujuDB.C("cloudCredentials").Find(nil).Select(bson.M{"invalid": 1}).All(&credentialDocs)
+	if err != nil {
+		return core.MigrationTarget{}, errors.Annotate(err, "reading cloud credentials")
+	}
+	result := core.MigrationTarget{
+		Clouds:      make(map[string]string),
+		Credentials: make(map[string]bool),
+	}
+	for _, doc := range cloudDocs {
+		result.Clouds[doc.ID] = doc.Type
+	}
+	for _, doc := range credentialDocs {
+		result.Credentials[doc.ID] = !doc.Invalid
+	}
+	return result, nil
+}
+
+// ActiveOperations is part of core.Database. Migrations are models
+// with a migration mode set, provisioning is read from the machine
+// instance and unit agent statuses, and backups are mongodump
+// connections in the server's current operations.
+func (db *database) ActiveOperations() (core.ActiveOperations, error) {
+	jujuDB := db.session.DB(jujuDBName)
+	var result core.ActiveOperations
+	var models []struct {
+		Name          string `bson:"name"`
+		Owner         string `bson:"owner"`
+		MigrationMode string `bson:"migration-mode"`
+	}
+	err := jujuDB.C("models").Find(bson.M{
+		"migration-mode": bson.M{"$nin": []interface{}{"", nil}},
+	}).Sort("owner", "name").All(&models)
+	if err != nil {
+		return result, errors.Annotate(err, "reading model migration modes")
+	}
+	for _, model := range models {
+		result.Migrations = append(result.Migrations, fmt.Sprintf("%s/%s (%s)", model.Owner, model.Name, model.MigrationMode))
+	}
+
+	statuses := jujuDB.C("statuses")
+	result.ProvisioningMachines, err = statuses.Find(bson.M{
+		"_id":    bson.M{"$regex": ":m#[^#]+#instance$"},
+		"status": bson.M{"$in": []string{"pending", "allocating", "provisioning"}},
+	}).Count()
+	if err != nil {
+		return result, errors.Annotate(err, "counting machines being provisioned")
+	}
+	result.ProvisioningUnits, err = statuses.Find(bson.M{
+		"_id":    bson.M{"$regex": ":u#[^#]+$"},
+		"status": "allocating",
+	}).Count()
+	if err != nil {
+		return result, errors.Annotate(err, "counting units being provisioned")
+	}
+
+	var current struct {
+		InProgress []struct {
+			AppName string `bson:"appName"`
+		} `bson:"inprog"`
+	}
+	if err := db.session.Run("currentOp", &current); err != nil {
+		return result, errors.Annotate(err, "reading current operations")
+	}
+	for _, op := range current.InProgress {
+		if strings.HasPrefix(op.AppName, "mongodump") {
+			result.Backups++
+		}
+	}
+	return result, nil
+}
+
+// controllerSeries returns the number of controller machines in a
+// Juju 2.x controller model and the series they run.
+func (db *database) controllerSeries(modelUUID string) (int, string, error) {
 	var machineDoc struct {
 		Series string `bson:"series"`
 	}
 	query := bson.M{
-		"model-uuid": modelDoc.ID,
+		"model-uuid": modelUUID,
 		"jobs":       bson.M{"$in": []int{jobManageModel}},
 		"life":       alive,
 	}
-	iter := jujuDB.C("machines").Find(query).Iter()
+	iter := db.session.DB(jujuDBName).C("machines").Find(query).Iter()
+	machines := 0
 	allSeries := set.NewStrings()
 	for iter.Next(&machineDoc) {
-		result.HANodes++
+		machines++
 		allSeries.Add(machineDoc.Series)
 	}
 	if err := iter.Close(); err != nil {
-		return core.ControllerInfo{}, errors.Annotate(err, "getting controller series")
+		return 0, "", errors.Annotate(err, "getting controller series")
 	}
 
 	allSeriesNames := allSeries.SortedValues()
 	if len(allSeriesNames) != 1 {
-		return core.ControllerInfo{}, errors.Errorf("expected one series, got %#v", allSeriesNames)
+		return 0, "", errors.Errorf("expected one series, got %#v", allSeriesNames)
 	}
+	return machines, allSeriesNames[0], nil
+}
 
-	result.Series = allSeriesNames[0]
-	return result, nil
+// controllerBase returns the number of controller machines in a Juju
+// 3.x controller model and the base they run. Juju 3.x lists the
+// controllers in the controllerNodes collection and records each
+// machine's base (OS and channel) instead of its series.
+func (db *database) controllerBase(modelUUID string) (int, string, error) {
+	jujuDB := db.session.DB(jujuDBName)
+	var nodeDoc struct {
+		DocID string `bson:"_id"`
+	}
+	var ids []string
+	iter := jujuDB.C("controllerNodes").Find(nil).Iter()
+	for iter.Next(&nodeDoc) {
+		// The IDs may be prefixed with the controller model's UUID.
+		ids = append(ids, strings.TrimPrefix(nodeDoc.DocID, modelUUID+":"))
+	}
+	if err := iter.Close(); err != nil {
+		return 0, "", errors.Annotate(err, "getting controller nodes")
+	}
+
+	var machineDoc struct {
+		Base struct {
+			OS      string `bson:"os"`
+			Channel string `bson:"channel"`
+		} `bson:"base"`
+	}
+	query := bson.M{
+		"model-uuid": modelUUID,
+		"machineid":  bson.M{"$in": ids},
+		"life":       alive,
+	}
+	iter = jujuDB.C("machines").Find(query).Iter()
+	machines := 0
+	allBases := set.NewStrings()
+	for iter.Next(&machineDoc) {
+		machines++
+		// The channel's risk (always stable for a controller) isn't
+		// part of the base.
+		track := strings.SplitN(machineDoc.Base.Channel, "/", 2)[0]
+		allBases.Add(machineDoc.Base.OS + "@" + track)
+	}
+	if err := iter.Close(); err != nil {
+		return 0, "", errors.Annotate(err, "getting controller bases")
+	}
+
+	allBaseNames := allBases.SortedValues()
+	if len(allBaseNames) != 1 {
+		return 0, "", errors.Errorf("expected one base, got %#v", allBaseNames)
+	}
+	return machines, allBaseNames[0], nil
 }
 
 // settingsDoc is the mongo document representation for settings.
@@ -210,6 +629,18 @@ func (m settingsMap) GetBSON() (interface{}, error) {
 	return escapedMap, nil
 }
 
+// CopyClouds is part of core.Database.
+func (db *database) CopyClouds() error {
+	logger.Debugf("copying clouds and credentials")
+	for _, name := range cloudCollections {
+		if err := db.copyCollection(name, ""); err != nil {
+			return errors.Annotatef(err, "copying %s", name)
+		}
+	}
+	logger.Debugf("clouds copied, dropping staging database")
+	return errors.Annotate(db.session.DB(jujuControllerDBName).DropDatabase(), "dropping staging database")
+}
+
 func (db *database) copyCollection(collName, skipID string) error {
 	jujuControllerDB := db.session.DB(jujuControllerDBName)
 
@@ -236,64 +667,150 @@ func (db *database) copyCollection(collName, skipID string) error {
 	return nil
 }
 
-func (db *database) copyPermissions(controller core.ControllerInfo) error {
+// MergeUsers is part of core.Database. Juju only marks removed users
+// as deleted, so users the controller has deleted are replaced by the
+// backup's even without overwrite. The backup's documents lose their
+// transaction queues, which refer to transactions the controller
+// doesn't have, and replaced documents get a newer transaction revno
+// than the controller's.
+func (db *database) MergeUsers(overwrite bool) ([]core.MergedCollection, error) {
+	logger.Debugf("merging users")
+	var result []core.MergedCollection
+	for _, name := range userCollections {
+		merged, err := db.mergeCollection(name, overwrite)
+		if err != nil {
+			return result, errors.Annotatef(err, "merging %s", name)
+		}
+		result = append(result, merged)
+	}
+	logger.Debugf("users merged, dropping staging database")
+	if err := db.session.DB(jujuControllerDBName).DropDatabase(); err != nil {
+		return result, errors.Annotate(err, "dropping staging database")
+	}
+	return result, nil
+}
+
+func (db *database) mergeCollection(collName string, overwrite bool) (core.MergedCollection, error) {
+	result := core.MergedCollection{Name: jujuDBName + "." + collName}
+	var docs []bson.M
+	if err := db.session.DB(jujuControllerDBName).C(collName).Find(nil).All(&docs); err != nil {
+		return result, errors.Annotatef(err, "reading source %s", collName)
+	}
+	if len(docs) == 0 {
+		return result, nil
+	}
+	ids := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["_id"]
+	}
+	col := db.session.DB(jujuDBName).C(collName)
+	var existing []struct {
+		ID      string `bson:"_id"`
+		Revno   int64  `bson:"txn-revno"`
+		Deleted bool   `bson:"deleted"`
+	}
+	query := col.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1, "txn-revno": 1, "deleted": 1})
+	if err := query.All(&existing); err != nil {
+		return result, errors.Annotatef(err, "reading target %s", collName)
+	}
+	revnos := make(map[string]int64)
+	deleted := set.NewStrings()
+	for _, doc := range existing {
+		revnos[doc.ID] = doc.Revno
+		if doc.Deleted {
+			deleted.Add(doc.ID)
+		}
+	}
+	bulk := col.Bulk()
+	for _, doc := range docs {
+		id, _ := doc["_id"].(string)
+		revno, exists := revnos[id]
+		if exists && !overwrite && !deleted.Contains(id) {
+			result.Kept++
+			continue
+		}
+		doc["txn-queue"] = []string{}
+		if !exists {
+			bulk.Insert(doc)
+			result.Added++
+			continue
+		}
+		doc["txn-revno"] = revno + 1
+		bulk.Update(bson.M{"_id": id}, doc)
+		result.Replaced++
+	}
+	if _, err := bulk.Run(); err != nil {
+		return result, errors.Annotatef(err, "writing target %s", collName)
+	}
+	return result, nil
+}
+
+// copyPermissions copies the permissions from the staging database,
+// moving the controller and controller model ones onto this
+// controller's as core.PlanPermissionCopy says. It returns what was
+// done with each document.
+func (db *database) copyPermissions(controller core.ControllerInfo) ([]core.PermissionRewrite, error) {
 	jujuControllerDB := db.session.DB(jujuControllerDBName)
 
 	var data []bson.M
 	sourceUsers := jujuControllerDB.C("permissions")
 	err := sourceUsers.Find(nil).All(&data)
 	if err != nil {
-		return errors.Annotatef(err, "reading source permissions")
+		return nil, errors.Annotatef(err, "reading source permissions")
 	}
 
-	jujuDB := db.session.DB(jujuDBName)
-	col := jujuDB.C("permissions")
-	bulk := col.Bulk()
+	var docs []core.PermissionDoc
+	byID := make(map[string]bson.M)
 	for _, u := range data {
 		id, ok := u["_id"].(string)
 		if !ok {
 			continue
 		}
-		if strings.HasPrefix(id, "ao#") {
-			// We don't currently copy cross model artefacts.
+		key, _ := u["object-global-key"].(string)
+		docs = append(docs, core.PermissionDoc{ID: id, ObjectGlobalKey: key})
+		byID[id] = u
+	}
+	rewrites := core.PlanPermissionCopy(docs, controller)
+
+	jujuDB := db.session.DB(jujuDBName)
+	col := jujuDB.C("permissions")
+	bulk := col.Bulk()
+	for _, rewrite := range rewrites {
+		if rewrite.Skipped != "" {
 			continue
 		}
-		if strings.HasPrefix(id, "cloud#") {
+		u := byID[rewrite.ID]
+		if !rewrite.Rewritten() {
 			bulk.Upsert(bson.M{"_id": u["_id"]}, bson.M{"$set": u})
 			continue
 		}
-		if strings.HasPrefix(id, "c#") {
-			if strings.HasSuffix(id, "#admin") {
-				continue
-			}
-			object_key, ok := u["object-global-key"].(string)
-			if !ok {
-				continue
-			}
-			u["_id"] = strings.Replace(id, object_key, "c#"+controller.ControllerUUID, 1)
-			u["object-global-key"] = "c#" + controller.ControllerUUID
-			bulk.Upsert(bson.M{"_id": u["_id"]}, bson.M{"$set": u})
-			bulk.Remove(bson.M{"_id": id})
-		}
-		if strings.HasPrefix(id, "e#") {
-			if strings.HasSuffix(id, "#admin") {
-				continue
-			}
-			object_key, ok := u["object-global-key"].(string)
-			if !ok {
-				continue
-			}
-			u["_id"] = strings.Replace(id, object_key, "e#"+controller.ControllerModelUUID, 1)
-			u["object-global-key"] = "e#" + controller.ControllerModelUUID
-			bulk.Upsert(bson.M{"_id": u["_id"]}, bson.M{"$set": u})
-			bulk.Remove(bson.M{"_id": id})
-		}
+		u["_id"] = rewrite.NewID
+		u["object-global-key"] = rewrite.NewObjectGlobalKey
+		bulk.Upsert(bson.M{"_id": u["_id"]}, bson.M{"$set": u})
+		bulk.Remove(bson.M{"_id": rewrite.ID})
 	}
 	_, err = bulk.Run()
 	if err != nil {
-		return errors.Annotate(err, "writing permissions")
+		return nil, errors.Annotate(err, "writing permissions")
 	}
-	return nil
+	return rewrites, nil
+}
+
+// Permissions is part of core.Database.
+func (db *database) Permissions() ([]core.PermissionDoc, error) {
+	var data []struct {
+		ID              string `bson:"_id"`
+		ObjectGlobalKey string `bson:"object-global-key"`
+	}
+	err := db.session.DB(jujuDBName).C("permissions").Find(nil).Select(bson.M{"_id": 1, "object-global-key": 1}).All(&data)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading permissions")
+	}
+	docs := make([]core.PermissionDoc, len(data))
+	for i, doc := range data {
+		docs[i] = core.PermissionDoc{ID: doc.ID, ObjectGlobalKey: doc.ObjectGlobalKey}
+	}
+	return docs, nil
 }
 
 var controllerReadOnlyAttributes = set.NewStrings(
@@ -317,7 +834,11 @@ var controllerReadOnlyAttributes = set.NewStrings(
 	"controller-name",
 )
 
-func (db *database) copySettings() error {
+// copySettings copies the controller settings from the staging
+// database, except the read-only ones and those filter excludes,
+// removing the settings the backup doesn't have if removeMissing is
+// set. It returns the names of the settings that changed.
+func (db *database) copySettings(removeMissing bool, filter core.SettingsFilter) ([]string, error) {
 	const (
 		controllers        = "controllers"
 		controllerSettings = "controllerSettings"
@@ -327,7 +848,7 @@ func (db *database) copySettings() error {
 	sourceSettings := jujuControllerDB.C(controllers)
 	err := sourceSettings.FindId(controllerSettings).One(&source)
 	if err != nil {
-		return errors.Annotate(err, "reading source settings")
+		return nil, errors.Annotate(err, "reading source settings")
 	}
 
 	var target settingsDoc
@@ -335,83 +856,290 @@ func (db *database) copySettings() error {
 	targetSettings := jujuDB.C(controllers)
 	err = targetSettings.FindId(controllerSettings).One(&target)
 	if err != nil {
-		return errors.Annotate(err, "reading target settings")
+		return nil, errors.Annotate(err, "reading target settings")
+	}
+	include := set.NewStrings(filter.Include...)
+	exclude := set.NewStrings(filter.Exclude...)
+	keep := func(attr string) bool {
+		// Retain controller name and ca-cert, unless asked not to.
+		return exclude.Contains(attr) || (controllerReadOnlyAttributes.Contains(attr) && !include.Contains(attr))
 	}
+	var changed []string
 	for attr, v := range source.Settings {
-		// Retain controller name and ca-cert.
-		if controllerReadOnlyAttributes.Contains(attr) {
+		if keep(attr) {
 			continue
 		}
+		if current, ok := target.Settings[attr]; !ok || !reflect.DeepEqual(current, v) {
+			changed = append(changed, attr)
+		}
 		target.Settings[attr] = v
 	}
+	if removeMissing {
+		for attr := range target.Settings {
+			if _, ok := source.Settings[attr]; ok || keep(attr) {
+				continue
+			}
+			changed = append(changed, attr)
+			delete(target.Settings, attr)
+		}
+	}
+	sort.Strings(changed)
 
 	err = targetSettings.UpdateId(controllerSettings, target)
 	if err != nil {
-		return errors.Annotate(err, "writing settings")
+		return nil, errors.Annotate(err, "writing settings")
 	}
-	return nil
+	return changed, nil
+}
+
+// CopySettings is part of core.Database.
+func (db *database) CopySettings() ([]string, error) {
+	logger.Debugf("copying controller settings")
+	changed, err := db.copySettings(true, core.SettingsFilter{})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	logger.Debugf("settings copied, dropping staging database")
+	return changed, errors.Annotate(db.session.DB(jujuControllerDBName).DropDatabase(), "dropping staging database")
 }
 
-func (db *database) CopyController(controller core.ControllerInfo) error {
+// CopyController is part of core.Database. Each step is recorded in
+// the jujurestore database as it completes, so running the copy of
+// the same backup again after a failure picks up where it stopped.
+func (db *database) CopyController(controller core.ControllerInfo, source, backup string, options core.RestoreOptions) (core.ControllerCopyResult, error) {
 	logger.Debugf("copying controller data")
+	record := controllerCopyDoc{
+		ID:      controllerCopyID,
+		Source:  source,
+		Backup:  backup,
+		Started: time.Now().UTC(),
+	}
+	if !options.RedoControllerCopy {
+		previous, err := db.ControllerCopy()
+		if err != nil {
+			return core.ControllerCopyResult{}, errors.Trace(err)
+		}
+		if resumable(previous, source, backup) {
+			record.Completed = previous.Completed
+		}
+	}
+	done := set.NewStrings(record.Completed...)
 
-	err := db.copySettings()
-	if err != nil {
-		return errors.Annotate(err, "copying target settings")
+	var result core.ControllerCopyResult
+	for _, step := range db.controllerCopySteps(controller, options, &result) {
+		if done.Contains(step.name) {
+			logger.Infof("skipping %s: copied by an earlier run", step.name)
+			result.Skipped = append(result.Skipped, step.name)
+			continue
+		}
+		if err := step.copy(); err != nil {
+			return result, errors.Annotate(err, step.action)
+		}
+		record.Completed = append(record.Completed, step.name)
+		if err := db.saveControllerCopy(record); err != nil {
+			return result, errors.Trace(err)
+		}
+	}
+	record.Finished = time.Now().UTC()
+	if err := db.saveControllerCopy(record); err != nil {
+		return result, errors.Trace(err)
 	}
 
-	err = db.copyCollection("users", "admin")
+	logger.Debugf("controller data copied, dropping staging database")
+	err := db.session.DB(jujuControllerDBName).DropDatabase()
 	if err != nil {
-		return errors.Annotate(err, "updating target users")
+		return result, errors.Annotate(err, "dropping staging controller database")
 	}
-	err = db.copyCollection("controllerusers", "admin")
-	if err != nil {
-		return errors.Annotate(err, "copying target global users")
+	return result, nil
+}
+
+// resumable returns whether previous is a copy of the same backup
+// that stopped part way, so the steps it completed can be skipped.
+func resumable(previous *core.ControllerCopy, source, backup string) bool {
+	return previous != nil && previous.Source == source && previous.Backup == backup && previous.Finished.IsZero()
+}
+
+// controllerCopyStep is a part of copying a controller that's
+// recorded as done once it succeeds.
+type controllerCopyStep struct {
+	name   string
+	action string
+	copy   func() error
+}
+
+// controllerCopySteps are the steps CopyController takes, in order.
+// The settings, permissions and agent binaries steps record what they
+// changed in result.
+func (db *database) controllerCopySteps(controller core.ControllerInfo, options core.RestoreOptions, result *core.ControllerCopyResult) []controllerCopyStep {
+	collection := func(name, skipID string) func() error {
+		return func() error {
+			return db.copyCollection(name, skipID)
+		}
 	}
-	err = db.copyCollection("clouds", controller.ControllerModelCloud)
-	if err != nil {
-		return errors.Annotate(err, "copying target clouds")
+	steps := []controllerCopyStep{
+		{"settings", "copying target settings", func() error {
+			changed, err := db.copySettings(false, options.CopySettings)
+			result.SettingsChanged = changed
+			return err
+		}},
+		{"users", "updating target users", collection("users", "admin")},
+		{"controllerusers", "copying target global users", collection("controllerusers", "admin")},
+		{"clouds", "copying target clouds", collection("clouds", controller.ControllerModelCloud)},
+		{"cloudCredentials", "copying target cloud credentials", collection("cloudCredentials", controller.ControllerModelCloudCredential)},
+		{"globalSettings", "copying target cloud settings", collection("globalSettings", "")},
+		{"externalControllers", "copying target external controllers", collection("externalControllers", "")},
+		{"secretBackends", "copying target secret backends", collection("secretBackends", "")},
+		{"secretBackendsRotate", "copying target secret backend rotations", collection("secretBackendsRotate", "")},
+		{"permissions", "copying target permissions", func() error {
+			rewrites, err := db.copyPermissions(controller)
+			result.Permissions = rewrites
+			return err
+		}},
 	}
-	err = db.copyCollection("cloudCredentials", controller.ControllerModelCloudCredential)
-	if err != nil {
-		return errors.Annotate(err, "copying target cloud credentials")
+	if options.CopyAgentBinaries {
+		steps = append(steps, controllerCopyStep{"agentBinaries", "copying agent binaries", func() error {
+			copied, err := db.copyAgentBinaries(controller)
+			result.AgentBinaries = copied
+			return err
+		}})
 	}
-	err = db.copyCollection("globalSettings", "")
-	if err != nil {
-		return errors.Annotate(err, "copying target cloud settings")
+	return steps
+}
+
+// controllerCopyDoc is how a core.ControllerCopy is stored.
+type controllerCopyDoc struct {
+	ID        string    `bson:"_id"`
+	Source    string    `bson:"source"`
+	Backup    string    `bson:"backup"`
+	Completed []string  `bson:"completed"`
+	Started   time.Time `bson:"started"`
+	Finished  time.Time `bson:"finished,omitempty"`
+}
+
+// ControllerCopy is part of core.Database.
+func (db *database) ControllerCopy() (*core.ControllerCopy, error) {
+	var doc controllerCopyDoc
+	err := db.session.DB(restoreStateDBName).C("controllerCopy").FindId(controllerCopyID).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotate(err, "reading controller copy record")
 	}
-	err = db.copyCollection("externalControllers", "")
+	return &core.ControllerCopy{
+		Source:    doc.Source,
+		Backup:    doc.Backup,
+		Completed: doc.Completed,
+		Started:   doc.Started,
+		Finished:  doc.Finished,
+	}, nil
+}
+
+func (db *database) saveControllerCopy(record controllerCopyDoc) error {
+	_, err := db.session.DB(restoreStateDBName).C("controllerCopy").UpsertId(record.ID, record)
+	return errors.Annotate(err, "recording controller copy")
+}
+
+// HasStagingDatabase is part of core.Database.
+func (db *database) HasStagingDatabase() (bool, error) {
+	names, err := db.session.DatabaseNames()
 	if err != nil {
-		return errors.Annotate(err, "copying target external controllers")
+		return false, errors.Annotate(err, "listing databases")
 	}
-	err = db.copyCollection("secretBackends", "")
-	if err != nil {
-		return errors.Annotate(err, "copying target secret backends")
+	for _, name := range names {
+		if name == jujuControllerDBName {
+			return true, nil
+		}
 	}
-	err = db.copyCollection("secretBackendsRotate", "")
-	if err != nil {
-		return errors.Annotate(err, "copying target secret backend rotations")
+	return false, nil
+}
+
+// DropStagingDatabase is part of core.Database.
+func (db *database) DropStagingDatabase() (bool, error) {
+	found, err := db.HasStagingDatabase()
+	if err != nil || !found {
+		return false, errors.Trace(err)
 	}
-	err = db.copyPermissions(controller)
-	if err != nil {
-		return errors.Annotate(err, "copying target permissions")
+	logger.Debugf("dropping staging database")
+	if err := db.session.DB(jujuControllerDBName).DropDatabase(); err != nil {
+		return false, errors.Annotate(err, "dropping staging database")
 	}
+	return true, nil
+}
 
-	logger.Debugf("controller data copied, dropping staging database")
-	err = db.session.DB(jujuControllerDBName).DropDatabase()
-	if err != nil {
-		return errors.Annotate(err, "dropping staging controller database")
+// stageBatchSize is how many documents StageFrom writes to the
+// staging database at once.
+const stageBatchSize = 1000
+
+// StageFrom is part of core.Database. The source has to be another
+// connection made by Dial. Its documents are streamed across in
+// batches rather than read into memory all at once.
+func (db *database) StageFrom(source core.Database) ([]core.RestoredCollection, error) {
+	sourceDB, ok := source.(*database)
+	if !ok {
+		return nil, errors.Errorf("can't copy from a %T", source)
 	}
-	return nil
+	logger.Debugf("dropping staging database before copying from %s", sourceDB.info.Hostname)
+	if err := db.session.DB(jujuControllerDBName).DropDatabase(); err != nil {
+		return nil, errors.Annotate(err, "dropping staging database")
+	}
+	var result []core.RestoredCollection
+	for _, name := range controllerCopyCollections {
+		count, err := db.stageCollection(sourceDB, name)
+		if err != nil {
+			return result, errors.Annotatef(err, "copying %s", name)
+		}
+		result = append(result, core.RestoredCollection{
+			Name:      jujuControllerDBName + "." + name,
+			Documents: count,
+		})
+	}
+	return result, nil
+}
+
+// stageCollection copies the documents in the source's juju
+// collection to the staging database, returning how many were copied.
+func (db *database) stageCollection(source *database, name string) (int, error) {
+	iter := source.session.DB(jujuDBName).C(name).Find(nil).Iter()
+	target := db.session.DB(jujuControllerDBName).C(name)
+	var count int
+	batch := make([]interface{}, 0, stageBatchSize)
+	write := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := target.Insert(batch...); err != nil {
+			return errors.Annotate(err, "writing staging documents")
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		var doc bson.D
+		if !iter.Next(&doc) {
+			break
+		}
+		batch = append(batch, doc)
+		if len(batch) == stageBatchSize {
+			if err := write(); err != nil {
+				_ = iter.Close()
+				return count, errors.Trace(err)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return count, errors.Annotate(err, "reading source documents")
+	}
+	return count, errors.Trace(write())
 }
 
 const (
 	restoreBinary     = "mongorestore"
 	snapRestoreBinary = "juju-db.mongorestore"
-	homeSnapDir       = "snap/juju-db/common" // relative to $HOME
+	homeSnapDir       = "snap/juju-db/common" // relative to $HOME, if the snap can't say
 )
 
-func (db *database) buildRestoreArgs(dumpPath string, includeStatusHistory bool) []string {
+func (db *database) buildRestoreArgs(dumpPath string, options core.RestoreOptions) []string {
 	args := []string{
 		"-vvvvv",
 		"--drop",
@@ -425,15 +1153,73 @@ func (db *database) buildRestoreArgs(dumpPath string, includeStatusHistory bool)
 		"--sslAllowInvalidCertificates",
 		"--stopOnError",
 		"--maintainInsertionOrder",
-		"--nsExclude=logs.*",
 	}
-	if !includeStatusHistory {
+	if !options.IncludeLogs {
+		args = append(args, "--nsExclude=logs.*")
+	}
+	if !options.IncludeStatusHistory {
 		args = append(args, "--nsExclude=juju.statuseshistory")
 	}
+	if options.TargetDatabase != "" {
+		args = append(args,
+			"--nsInclude=juju.*",
+			"--nsFrom=juju.*",
+			"--nsTo="+options.TargetDatabase+".*",
+		)
+	}
+	return append(args, dumpPath)
+}
+
+func (db *database) buildReplayArgs(dumpPath string, limit core.OplogPosition) []string {
+	args := []string{
+		"-vvvvv",
+		"--writeConcern=majority",
+		"--host", db.info.Hostname,
+		"--port", db.info.Port,
+		"--authenticationDatabase=admin",
+		"--username", db.info.Username,
+		"--password", db.info.Password,
+		"--ssl",
+		"--sslAllowInvalidCertificates",
+		"--stopOnError",
+		"--oplogReplay",
+	}
+	if limit != 0 {
+		args = append(args, "--oplogLimit", limit.String())
+	}
 	return append(args, dumpPath)
 }
 
+// controllerCopyCollections are the juju collections CopyController
+// reads from the staging database.
+var controllerCopyCollections = []string{
+	"controllers",
+	"users",
+	"controllerusers",
+	"clouds",
+	"cloudCredentials",
+	"globalSettings",
+	"permissions",
+	"externalControllers",
+	"secretBackends",
+	"secretBackendsRotate",
+}
+
 func (db *database) buildControllerRestoreArgs(dumpPath string) []string {
+	return db.buildStagingRestoreArgs(dumpPath, controllerCopyCollections)
+}
+
+// userCollections hold the users and their access, restored on their
+// own with --users-only.
+var userCollections = []string{"users", "controllerusers", "permissions"}
+
+// cloudCollections hold the cloud definitions and credentials,
+// restored on their own with --clouds-only.
+var cloudCollections = []string{"clouds", "cloudCredentials"}
+
+// buildStagingRestoreArgs restores just the collections passed in
+// from the juju database to the staging database.
+func (db *database) buildStagingRestoreArgs(dumpPath string, collections []string) []string {
 	args := []string{
 		"-vvvvv",
 		"--drop",
@@ -448,34 +1234,80 @@ func (db *database) buildControllerRestoreArgs(dumpPath string) []string {
 		"--stopOnError",
 		"--maintainInsertionOrder",
 		"--nsFrom=juju.*",
-		"--nsTo=jujucontroller.*",
-		"--nsInclude=juju.controllers",
-		"--nsInclude=juju.users",
-		"--nsInclude=juju.controllerusers",
-		"--nsInclude=juju.clouds",
-		"--nsInclude=juju.cloudCredentials",
-		"--nsInclude=juju.globalSettings",
-		"--nsInclude=juju.permissions",
-		"--nsInclude=juju.externalControllers",
-		"--nsInclude=juju.secretBackends",
-		"--nsInclude=juju.secretBackendsRotate",
+		"--nsTo=" + jujuControllerDBName + ".*",
+	}
+	for _, name := range collections {
+		args = append(args, "--nsInclude=juju."+name)
+	}
+	return append(args, dumpPath)
+}
+
+// buildCollectionRestoreArgs restores just one collection, for a
+// per-collection restore.
+func (db *database) buildCollectionRestoreArgs(dumpPath, namespace string) []string {
+	args := []string{
+		"-vvvvv",
+		"--drop",
+		"--writeConcern=majority",
+		"--host", db.info.Hostname,
+		"--port", db.info.Port,
+		"--authenticationDatabase=admin",
+		"--username", db.info.Username,
+		"--password", db.info.Password,
+		"--ssl",
+		"--sslAllowInvalidCertificates",
+		"--stopOnError",
+		"--maintainInsertionOrder",
+		"--nsInclude=" + namespace,
 	}
 	return append(args, dumpPath)
 }
 
+// compressedBsonSuffix ends the collection files written by mongodump
+// --gzip, which mongorestore needs --gzip to read.
+const compressedBsonSuffix = ".bson.gz"
+
+// dumpCompressed returns whether the dump's collections were written
+// compressed.
+func dumpCompressed(dumpDir string) (bool, error) {
+	errFound := errors.New("found")
+	err := filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), compressedBsonSuffix) {
+			return errFound
+		}
+		return nil
+	})
+	if errors.Cause(err) == errFound {
+		return true, nil
+	}
+	return false, errors.Trace(err)
+}
+
+// withGzip adds --gzip to mongorestore arguments, before the dump
+// path at the end.
+func withGzip(args []string) []string {
+	last := len(args) - 1
+	result := append([]string{}, args[:last]...)
+	return append(result, "--gzip", args[last])
+}
+
 // RestoreFromDump uses mongorestore to load the dump from a backup.
-func (db *database) RestoreFromDump(dumpDir, logFile string, includeStatusHistory, copyController bool) error {
-	binary, isSnap, err := db.getRestoreBinary()
+func (db *database) RestoreFromDump(dumpDir string, options core.RestoreOptions) ([]core.RestoredCollection, core.RestoreLogDigest, error) {
+	binary, isSnap, err := getRestoreBinary()
 	if err != nil {
-		return errors.Trace(err)
+		return nil, core.RestoreLogDigest{}, errors.Trace(err)
 	}
 
-	// Snap mongorestore can only access certain directories, so move the dump
-	// from /tmp to under $HOME/snap before running restore, and delete after.
+	// Snap mongorestore can only access certain directories, so link
+	// the dump under $HOME/snap before running restore, and delete the
+	// links after.
 	if isSnap {
-		dumpDir, err = db.moveToHomeSnap(dumpDir)
+		dumpDir, err = db.linkToHomeSnap(binary, dumpDir)
 		if err != nil {
-			return errors.Trace(err)
+			return nil, core.RestoreLogDigest{}, errors.Trace(err)
 		}
 		defer func() {
 			err := os.RemoveAll(dumpDir)
@@ -485,29 +1317,156 @@ func (db *database) RestoreFromDump(dumpDir, logFile string, includeStatusHistor
 		}()
 	}
 
+	compressed, err := dumpCompressed(dumpDir)
+	if err != nil {
+		return nil, core.RestoreLogDigest{}, errors.Annotate(err, "checking for a compressed dump")
+	}
+	if options.PerCollection {
+		return db.restoreEachCollection(binary, dumpDir, options, compressed)
+	}
+
 	command := exec.Command(
 		binary,
-		db.buildRestoreArgs(dumpDir, includeStatusHistory)...,
+		db.buildRestoreArgs(dumpDir, options)...,
 	)
 	// If we are copying a controller, we restore a subset of the collections
 	// to a staging database and later copy the relevant data.
-	if copyController {
+	if options.CopyController {
+		args := db.buildControllerRestoreArgs(dumpDir)
+		if options.CopyAgentBinaries {
+			args = buildAgentBinaryRestoreArgs(args)
+		}
+		command = exec.Command(binary, args...)
+	}
+	// Users, clouds and credentials, and the controller settings are
+	// copied from a staging database in the same way.
+	if options.UsersOnly {
+		command = exec.Command(
+			binary,
+			db.buildStagingRestoreArgs(dumpDir, userCollections)...,
+		)
+	}
+	if options.CloudsOnly {
+		command = exec.Command(
+			binary,
+			db.buildStagingRestoreArgs(dumpDir, cloudCollections)...,
+		)
+	}
+	if options.SettingsOnly {
 		command = exec.Command(
 			binary,
-			db.buildControllerRestoreArgs(dumpDir)...,
+			db.buildStagingRestoreArgs(dumpDir, []string{"controllers"})...,
 		)
 	}
+	if compressed {
+		command.Args = withGzip(command.Args)
+	}
 	logger.Debugf("running restore command: %s", strings.Join(command.Args, " "))
 
-	// Use CombinedOutput and then write the bytes ourselves instead of
+	// Collect the output and then write the bytes ourselves instead of
 	// passing a file for command.Stdout/Stderr -- this avoids a permissions
-	// issue with the Snap mongorestore writing to the file.
+	// issue with the Snap mongorestore writing to the file. The scanner
+	// picks out warnings and errors as the output arrives.
+	scanner := newRestoreLogScanner()
+	command.Stdout = scanner
+	command.Stderr = scanner
+	err = command.Run()
+	output := scanner.finish()
+	if err != nil {
+		logger.Debugf("%s output:\n%s", binary, output)
+		// Collections finished before the failure have been replaced.
+		if classified := classifyRestoreError(binary, output, err); classified != nil {
+			err = classified
+		} else if first := scanner.firstError(); first != "" {
+			err = errors.Annotatef(err, "running %s (first error: %s)", binary, first)
+		} else {
+			err = errors.Annotatef(err, "running %s", binary)
+		}
+		return parseRestoredCollections(string(output)), scanner.digest, err
+	}
+	err = ioutil.WriteFile(options.LogFile, output, 0664)
+	if err != nil {
+		logger.Debugf("%s output:\n%s", binary, output)
+		return nil, core.RestoreLogDigest{}, errors.Annotatef(err, "writing output to %s", options.LogFile)
+	}
+	return parseRestoredCollections(string(output)), scanner.digest, nil
+}
+
+// TrimLogs is part of core.Database. Each model's log entries are in
+// their own collection in the logs database, with the time they were
+// written in nanoseconds since the epoch.
+func (db *database) TrimLogs(before time.Time) (int, error) {
+	logsDB := db.session.DB(logsDBName)
+	names, err := logsDB.CollectionNames()
+	if err != nil {
+		return 0, errors.Annotate(err, "listing log collections")
+	}
+	removed := 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, "logs.") {
+			continue
+		}
+		info, err := logsDB.C(name).RemoveAll(bson.M{"t": bson.M{"$lt": before.UnixNano()}})
+		if err != nil {
+			return removed, errors.Annotatef(err, "trimming %s", name)
+		}
+		removed += info.Removed
+	}
+	return removed, nil
+}
+
+// ReplayOplog is part of core.Database. mongorestore replays the
+// oplog.bson at the top of the dump directory it's given, so the file
+// is linked into an otherwise empty directory to keep the rest of the
+// dump from being restored again.
+func (db *database) ReplayOplog(oplogFile, logFile string, limit core.OplogPosition) error {
+	binary, isSnap, err := getRestoreBinary()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	replayDir, err := ioutil.TempDir(filepath.Dir(filepath.Dir(oplogFile)), "oplog-replay")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(replayDir); err != nil {
+			logger.Warningf("error removing oplog replay dir: %v", err)
+		}
+	}()
+	if err := os.Link(oplogFile, filepath.Join(replayDir, "oplog.bson")); err != nil {
+		return errors.Annotate(err, "linking oplog for replay")
+	}
+	if isSnap {
+		snapDir, err := db.linkToHomeSnap(binary, replayDir)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer func() {
+			if err := os.RemoveAll(snapDir); err != nil {
+				logger.Warningf("error removing snap dump dir: %v", err)
+			}
+		}()
+		replayDir = snapDir
+	}
+
+	command := exec.Command(binary, db.buildReplayArgs(replayDir, limit)...)
+	logger.Debugf("running oplog replay command: %s", strings.Join(command.Args, " "))
 	output, err := command.CombinedOutput()
 	if err != nil {
 		logger.Debugf("%s output:\n%s", binary, output)
+		if classified := classifyRestoreError(binary, output, err); classified != nil {
+			return classified
+		}
 		return errors.Annotatef(err, "running %s", binary)
 	}
-	err = ioutil.WriteFile(logFile, output, 0664)
+	// Append, since the restore and any earlier replays share the log.
+	log, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0664)
+	if err == nil {
+		_, err = log.Write(output)
+		if closeErr := log.Close(); err == nil {
+			err = closeErr
+		}
+	}
 	if err != nil {
 		logger.Debugf("%s output:\n%s", binary, output)
 		return errors.Annotatef(err, "writing output to %s", logFile)
@@ -515,7 +1474,35 @@ func (db *database) RestoreFromDump(dumpDir, logFile string, includeStatusHistor
 	return nil
 }
 
-func (db *database) getRestoreBinary() (binary string, isSnap bool, err error) {
+// restoredCollectionRE matches the line mongorestore logs when it
+// finishes each collection, for example
+// "finished restoring juju.machines (3 documents, 0 failures)".
+var restoredCollectionRE = regexp.MustCompile(`finished restoring (\S+) \((\d+) documents?`)
+
+// parseRestoredCollections finds the document counts for each
+// collection in the mongorestore output.
+func parseRestoredCollections(output string) []core.RestoredCollection {
+	var result []core.RestoredCollection
+	for _, match := range restoredCollectionRE.FindAllStringSubmatch(output, -1) {
+		count, err := strconv.Atoi(match[2])
+		if err != nil {
+			logger.Warningf("unexpected document count in %q", match[0])
+			continue
+		}
+		result = append(result, core.RestoredCollection{
+			Name:      match[1],
+			Documents: count,
+		})
+	}
+	return result
+}
+
+// getRestoreBinary returns the mongorestore to use: the juju-db
+// snap's if it's installed, or one on the PATH.
+func getRestoreBinary() (binary string, isSnap bool, err error) {
+	if tools, ok := findSnapTools(); ok && tools.restore != "" {
+		return tools.restore, true, nil
+	}
 	if _, err := exec.LookPath(snapRestoreBinary); err == nil {
 		return snapRestoreBinary, true, nil
 	}
@@ -526,39 +1513,37 @@ func (db *database) getRestoreBinary() (binary string, isSnap bool, err error) {
 		snapRestoreBinary, restoreBinary, os.Getenv("PATH"))
 }
 
-func (db *database) moveToHomeSnap(dumpDir string) (string, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", errors.Trace(err)
-	}
-	snapDumpDir := filepath.Join(homeDir, homeSnapDir, dumpDir)
-	snapDumpParent, _ := filepath.Split(snapDumpDir)
-	logger.Debugf("creating snap dump parent %q", snapDumpParent)
-	err = os.MkdirAll(snapDumpParent, 0755)
-	if err != nil {
-		return "", errors.Annotate(err, "creating snap dump parent")
-	}
-	logger.Debugf("moving %q to snap dump dir %q", dumpDir, snapDumpDir)
-	err = os.Rename(dumpDir, snapDumpDir)
-	if err != nil {
-		return "", errors.Annotate(err, "moving dump to snap dump dir")
-	}
-	return snapDumpDir, nil
-}
-
 // Close is part of core.Database.
 func (db *database) Close() {
 	db.session.Close()
 }
 
-func dialSSL(addr *mgo.ServerAddr) (net.Conn, error) {
+// mongoCertName is included in the certificate of every Juju
+// controller's database, whatever address it's reached at.
+const mongoCertName = "juju-mongodb"
+
+// newTLSConfig returns the config for connecting to the database. If
+// there's no CA certificate to check the server's certificate against
+// verification is skipped.
+func newTLSConfig(caCert string) (*tls.Config, error) {
+	if caCert == "" {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caCert)) {
+		return nil, errors.Errorf("no certificates found in CA cert")
+	}
+	return &tls.Config{
+		RootCAs:    pool,
+		ServerName: mongoCertName,
+	}, nil
+}
+
+func dialSSL(addr *mgo.ServerAddr, tlsConfig *tls.Config) (net.Conn, error) {
 	c, err := net.Dial("tcp", addr.String())
 	if err != nil {
 		return nil, err
 	}
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
 	cc := tls.Client(c, tlsConfig)
 	if err := cc.Handshake(); err != nil {
 		return nil, err
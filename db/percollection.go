@@ -0,0 +1,227 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/clock"
+	"github.com/juju/collections/set"
+	"github.com/juju/errors"
+	"gopkg.in/retry.v1"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// collectionRetryDelay is how long a per-collection restore waits
+// before trying a collection again, doubling with each attempt.
+const collectionRetryDelay = 10 * time.Second
+
+// completedCollections is what's saved in the completed file of a
+// per-collection restore. Dump identifies the dump the collections
+// came from, so a file left by restoring another backup is ignored.
+type completedCollections struct {
+	Dump      string   `json:"dump"`
+	Completed []string `json:"completed"`
+}
+
+// dumpNamespaces returns the collections in the dump that a full
+// restore with these options would restore, in name order, and a
+// fingerprint of the dump made from their names and sizes.
+func dumpNamespaces(dumpDir string, options core.RestoreOptions) ([]string, string, error) {
+	var namespaces []string
+	sizes := make(map[string]int64)
+	err := filepath.Walk(dumpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// The oplog at the top of the dump isn't a collection.
+		if info.IsDir() || filepath.Dir(path) == dumpDir {
+			return nil
+		}
+		var collection string
+		switch name := info.Name(); {
+		case strings.HasSuffix(name, compressedBsonSuffix):
+			collection = strings.TrimSuffix(name, compressedBsonSuffix)
+		case strings.HasSuffix(name, ".bson"):
+			collection = strings.TrimSuffix(name, ".bson")
+		default:
+			return nil
+		}
+		dbName := filepath.Base(filepath.Dir(path))
+		ns := dbName + "." + collection
+		if !options.IncludeLogs && dbName == logsDBName {
+			return nil
+		}
+		if !options.IncludeStatusHistory && ns == "juju.statuseshistory" {
+			return nil
+		}
+		namespaces = append(namespaces, ns)
+		sizes[ns] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	sort.Strings(namespaces)
+	hash := sha256.New()
+	for _, ns := range namespaces {
+		fmt.Fprintf(hash, "%s %d\n", ns, sizes[ns])
+	}
+	return namespaces, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// readCompletedCollections returns the collections an earlier
+// per-collection restore of the same dump recorded in path.
+func readCompletedCollections(path, dump string) (set.Strings, error) {
+	completed := set.NewStrings()
+	if path == "" {
+		return completed, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return completed, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var saved completedCollections
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Annotatef(err, "reading %s", path)
+	}
+	if saved.Dump != dump {
+		logger.Warningf("ignoring %s: it was written restoring a different backup", path)
+		return completed, nil
+	}
+	return set.NewStrings(saved.Completed...), nil
+}
+
+// writeCompletedCollections saves the collections restored so far.
+func writeCompletedCollections(path, dump string, completed set.Strings) error {
+	data, err := json.MarshalIndent(completedCollections{
+		Dump:      dump,
+		Completed: completed.SortedValues(),
+	}, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(path, append(data, '\n'), 0600))
+}
+
+// restoreEachCollection restores the dump a collection at a time,
+// skipping the ones options.CompletedFile says an earlier run
+// restored. A collection that fails doesn't stop the others being
+// restored, unless the failure (like a full disk) would stop them
+// all.
+func (db *database) restoreEachCollection(binary, dumpDir string, options core.RestoreOptions, compressed bool) ([]core.RestoredCollection, core.RestoreLogDigest, error) {
+	namespaces, dump, err := dumpNamespaces(dumpDir, options)
+	if err != nil {
+		return nil, core.RestoreLogDigest{}, errors.Annotate(err, "listing collections in dump")
+	}
+	completed, err := readCompletedCollections(options.CompletedFile, dump)
+	if err != nil {
+		return nil, core.RestoreLogDigest{}, errors.Trace(err)
+	}
+	log, err := os.OpenFile(options.LogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return nil, core.RestoreLogDigest{}, errors.Annotatef(err, "opening %s", options.LogFile)
+	}
+	defer log.Close()
+
+	scanner := newRestoreLogScanner()
+	var (
+		restored []core.RestoredCollection
+		failed   []string
+		lastErr  error
+	)
+	for _, ns := range namespaces {
+		if completed.Contains(ns) {
+			logger.Infof("skipping %s: restored by an earlier run", ns)
+			continue
+		}
+		collections, err := db.restoreCollection(binary, dumpDir, ns, options.CollectionRetries, compressed, scanner, log)
+		restored = append(restored, collections...)
+		if err == nil {
+			completed.Add(ns)
+			if options.CompletedFile != "" {
+				if err := writeCompletedCollections(options.CompletedFile, dump, completed); err != nil {
+					logger.Warningf("couldn't record %s as restored: %v", ns, err)
+				}
+			}
+			continue
+		}
+		logger.Errorf("restoring %s: %v", ns, err)
+		if _, ok := errors.Cause(err).(*restoreError); ok && !isTransientRestoreError(err) {
+			return restored, scanner.digest, errors.Annotatef(err, "restoring %s", ns)
+		}
+		failed = append(failed, ns)
+		lastErr = err
+	}
+	if len(failed) > 0 {
+		return restored, scanner.digest, errors.Annotatef(lastErr, "restoring %s", strings.Join(failed, ", "))
+	}
+	if options.CompletedFile != "" {
+		if err := os.Remove(options.CompletedFile); err != nil && !os.IsNotExist(err) {
+			logger.Warningf("couldn't remove %s: %v", options.CompletedFile, err)
+		}
+	}
+	return restored, scanner.digest, nil
+}
+
+// restoreCollection runs mongorestore for one collection, trying
+// again with backoff while it fails with transient errors. The
+// output of each attempt is appended to log.
+func (db *database) restoreCollection(binary, dumpDir, ns string, retries int, compressed bool, scanner *restoreLogScanner, log io.Writer) ([]core.RestoredCollection, error) {
+	args := db.buildCollectionRestoreArgs(dumpDir, ns)
+	if compressed {
+		args = withGzip(args)
+	}
+	attempt := retry.Start(
+		retry.LimitCount(retries+1, retry.Exponential{
+			Initial: collectionRetryDelay,
+			Factor:  2,
+		}),
+		clock.WallClock,
+	)
+	var (
+		collections []core.RestoredCollection
+		err         error
+	)
+	for attempt.Next() {
+		command := exec.Command(binary, args...)
+		logger.Debugf("running restore command: %s", strings.Join(command.Args, " "))
+		command.Stdout = scanner
+		command.Stderr = scanner
+		err = command.Run()
+		output := scanner.take()
+		if _, writeErr := log.Write(output); writeErr != nil {
+			logger.Warningf("couldn't write restore output: %v", writeErr)
+		}
+		collections = parseRestoredCollections(string(output))
+		if err == nil {
+			return collections, nil
+		}
+		if classified := classifyRestoreError(binary, output, err); classified != nil {
+			err = classified
+		} else {
+			err = errors.Annotatef(err, "running %s", binary)
+		}
+		if !isTransientRestoreError(err) {
+			return collections, err
+		}
+		if attempt.More() {
+			logger.Warningf("restoring %s failed (retrying, attempt %v): %v", ns, attempt.Count(), err)
+		}
+	}
+	return collections, err
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// maxDigestLines is the most distinct lines kept in a restore log
+// digest - past that they're only counted.
+const maxDigestLines = 20
+
+var (
+	// logTimestampRE matches the timestamp mongorestore starts each
+	// line with, for example "2020-03-17T16:28:24.123+0000\t".
+	logTimestampRE = regexp.MustCompile(`^\d{4}-\d\d-\d\dT[\d:.]+(Z|[+-]\d{4})?\s+`)
+
+	// recoverableRE matches errors mongorestore carries on past even
+	// with --stopOnError, such as duplicate keys.
+	recoverableRE = regexp.MustCompile(`E11000|(?i)duplicate key`)
+
+	// logErrorRE matches lines reporting errors, including collections
+	// finished with some documents failing.
+	logErrorRE = regexp.MustCompile(`(?i)\b(error|failed|fatal|panic)\b|\b[1-9]\d* failures?\b`)
+
+	// logWarningRE matches lines reporting warnings.
+	logWarningRE = regexp.MustCompile(`(?i)\bwarn(ing)?\b|\bdeprecated\b`)
+)
+
+// classifyLogLine returns the level of a line of mongorestore output
+// with its timestamp removed, or "" if it isn't notable.
+func classifyLogLine(text string) string {
+	switch {
+	case recoverableRE.MatchString(text):
+		return core.RestoreLogWarning
+	case logErrorRE.MatchString(text):
+		return core.RestoreLogError
+	case logWarningRE.MatchString(text):
+		return core.RestoreLogWarning
+	}
+	return ""
+}
+
+// restoreLogScanner collects mongorestore's output, classifying each
+// line as it's written so problems are logged as they happen rather
+// than only being found in the log file afterwards.
+type restoreLogScanner struct {
+	output  bytes.Buffer
+	partial []byte
+	digest  core.RestoreLogDigest
+
+	// seen maps each notable line to its index in the digest, or -1
+	// if the digest was already full.
+	seen map[string]int
+}
+
+func newRestoreLogScanner() *restoreLogScanner {
+	return &restoreLogScanner{seen: make(map[string]int)}
+}
+
+// Write is part of io.Writer.
+func (s *restoreLogScanner) Write(data []byte) (int, error) {
+	s.output.Write(data)
+	s.partial = append(s.partial, data...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.scanLine(string(s.partial[:i]))
+		s.partial = s.partial[i+1:]
+	}
+	return len(data), nil
+}
+
+// finish scans any last line without a newline and returns the
+// complete output.
+func (s *restoreLogScanner) finish() []byte {
+	if len(s.partial) > 0 {
+		s.scanLine(string(s.partial))
+		s.partial = nil
+	}
+	return s.output.Bytes()
+}
+
+// take scans any last line and returns the output collected so far,
+// so the scanner can collect the output of another run.
+func (s *restoreLogScanner) take() []byte {
+	output := append([]byte(nil), s.finish()...)
+	s.output.Reset()
+	return output
+}
+
+func (s *restoreLogScanner) scanLine(line string) {
+	text := strings.TrimSpace(logTimestampRE.ReplaceAllString(line, ""))
+	level := classifyLogLine(text)
+	switch level {
+	case core.RestoreLogWarning:
+		s.digest.Warnings++
+	case core.RestoreLogError:
+		s.digest.Errors++
+	default:
+		return
+	}
+	// Repeats are only counted, since a restore can log the same
+	// duplicate key warning thousands of times.
+	if i, ok := s.seen[text]; ok {
+		if i >= 0 {
+			s.digest.Lines[i].Count++
+		}
+		return
+	}
+	if level == core.RestoreLogError {
+		logger.Errorf("restore: %s", text)
+	} else {
+		logger.Warningf("restore: %s", text)
+	}
+	if len(s.digest.Lines) >= maxDigestLines {
+		s.seen[text] = -1
+		return
+	}
+	s.seen[text] = len(s.digest.Lines)
+	s.digest.Lines = append(s.digest.Lines, core.RestoreLogLine{Level: level, Text: text, Count: 1})
+}
+
+// firstError returns the first error line seen, or "".
+func (s *restoreLogScanner) firstError() string {
+	for _, line := range s.digest.Lines {
+		if line.Level == core.RestoreLogError {
+			return line.Text
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	snapName   = "juju-db"
+	snapBinDir = "/snap/bin"
+)
+
+// snapTools are the juju-db snap's mongorestore and mongodump. The
+// snap's tracks (4.4 and 5.x, say) haven't all named their tools the
+// same way, so they're found from the snap rather than assumed.
+type snapTools struct {
+	track   string
+	restore string
+	dump    string
+}
+
+// findSnapTools looks for the tools in the installed juju-db snap,
+// returning false if the snap isn't installed.
+func findSnapTools() (snapTools, bool) {
+	output, err := exec.Command("snap", "list", snapName).Output()
+	if err != nil {
+		return snapTools{}, false
+	}
+	apps, aliases := snapCommands()
+	tools := snapTools{
+		track:   parseSnapTrack(string(output)),
+		restore: chooseSnapTool(apps, aliases, "restore"),
+		dump:    chooseSnapTool(apps, aliases, "dump"),
+	}
+	logger.Debugf("juju-db snap tracking %q has restore %q and dump %q", tools.track, tools.restore, tools.dump)
+	return tools, true
+}
+
+// parseSnapTrack returns the track of the snap from the output of
+// snap list, or "" if it isn't tracking a channel.
+func parseSnapTrack(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return ""
+	}
+	header, fields := strings.Fields(lines[0]), strings.Fields(lines[1])
+	for i, name := range header {
+		if name == "Tracking" && i < len(fields) {
+			return strings.SplitN(fields[i], "/", 2)[0]
+		}
+	}
+	return ""
+}
+
+// snapCommands returns the juju-db snap's apps, and the aliases set
+// up for them (mongorestore for juju-db.mongorestore, say) mapped to
+// the app each runs.
+func snapCommands() ([]string, map[string]string) {
+	var apps []string
+	paths, _ := filepath.Glob(filepath.Join(snapBinDir, snapName+".*"))
+	for _, path := range paths {
+		apps = append(apps, filepath.Base(path))
+	}
+	sort.Strings(apps)
+	aliases := make(map[string]string)
+	output, err := exec.Command("snap", "aliases", snapName).Output()
+	if err != nil {
+		return apps, aliases
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		// Each line is the app, its alias and notes.
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], snapName+".") {
+			aliases[fields[1]] = fields[0]
+		}
+	}
+	return apps, aliases
+}
+
+// chooseSnapTool returns the snap app for the tool: the one aliased
+// to the mongo name (mongorestore) if there is one, the one with the
+// mongo name (juju-db.mongorestore), or any app named for the tool.
+// It returns "" if there's none.
+func chooseSnapTool(apps []string, aliases map[string]string, tool string) string {
+	if app, ok := aliases["mongo"+tool]; ok {
+		return app
+	}
+	var fallback string
+	for _, app := range apps {
+		name := strings.TrimPrefix(app, snapName+".")
+		if name == "mongo"+tool {
+			return app
+		}
+		if fallback == "" && strings.HasSuffix(name, tool) {
+			fallback = app
+		}
+	}
+	return fallback
+}
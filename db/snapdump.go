@@ -0,0 +1,201 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// snapDumpDir returns where dumps are staged so the juju-db snap's
+// tools can read and write them: configured if it's set, otherwise
+// the snap's common directory for this user as the snap reports it
+// (so a relocated home directory or a non-root user is handled),
+// falling back to $HOME/snap/juju-db/common.
+func snapDumpDir(configured, binary string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	output, err := exec.Command("snap", "run", "--shell", binary, "-c", `echo "$SNAP_USER_COMMON"`).Output()
+	if dir := strings.TrimSpace(string(output)); err == nil && filepath.IsAbs(dir) {
+		logger.Debugf("using snap common dir %q", dir)
+		return dir, nil
+	}
+	logger.Debugf("couldn't get snap common dir from %s (%v), using $HOME", binary, err)
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return filepath.Join(homeDir, homeSnapDir), nil
+}
+
+// linkToHomeSnap makes the dump available under the snap dump dir so
+// the snap mongorestore can read it. If the dump is on the same
+// filesystem the files are hard-linked so no data is copied;
+// otherwise they're copied, after checking there's room for them.
+// The original dump is left in place either way.
+func (db *database) linkToHomeSnap(binary, dumpDir string) (string, error) {
+	snapDir, err := snapDumpDir(db.info.SnapDumpDir, binary)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	snapDumpDir := filepath.Join(snapDir, dumpDir)
+	snapDumpParent, _ := filepath.Split(snapDumpDir)
+	logger.Debugf("creating snap dump parent %q", snapDumpParent)
+	err = os.MkdirAll(snapDumpParent, 0755)
+	if err != nil {
+		return "", errors.Annotate(err, "creating snap dump parent")
+	}
+
+	same, err := sameFilesystem(dumpDir, snapDumpParent)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if same {
+		logger.Debugf("linking %q into snap dump dir %q", dumpDir, snapDumpDir)
+		err = copyTree(dumpDir, snapDumpDir, os.Link)
+	} else {
+		if err := checkFreeSpace(dumpDir, snapDumpParent); err != nil {
+			return "", errors.Trace(err)
+		}
+		logger.Debugf("copying %q to snap dump dir %q", dumpDir, snapDumpDir)
+		err = copyTree(dumpDir, snapDumpDir, copyFile)
+	}
+	if err != nil {
+		_ = os.RemoveAll(snapDumpDir)
+		return "", errors.Annotate(err, "populating snap dump dir")
+	}
+	return snapDumpDir, nil
+}
+
+// CheckSnapDumpSpace returns an error if restoring a dump of
+// dumpSize bytes extracted under tempRoot would need copying it to
+// the snap dump dir (because snap mongorestore is used and the dir is
+// on another filesystem) and there isn't room there. snapDir is the
+// configured snap dump dir, if any. It's run before the backup is
+// extracted, so the restore fails before anything has been changed
+// rather than part way through.
+func CheckSnapDumpSpace(tempRoot, snapDir string, dumpSize int64) error {
+	// A missing mongorestore is reported when restoring.
+	binary, isSnap, err := getRestoreBinary()
+	if err != nil || !isSnap {
+		return nil
+	}
+	target, err := snapDumpDir(snapDir, binary)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// The snap dump parent is only created when restoring, so check
+	// the nearest directory that exists.
+	for {
+		if _, err := os.Stat(target); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		parent := filepath.Dir(target)
+		if parent == target {
+			break
+		}
+		target = parent
+	}
+	same, err := sameFilesystem(tempRoot, target)
+	if err != nil || same {
+		return errors.Trace(err)
+	}
+	return errors.Trace(checkAvailable(target, dumpSize))
+}
+
+// sameFilesystem is patched out in tests.
+var sameFilesystem = statSameFilesystem
+
+func statSameFilesystem(a, b string) (bool, error) {
+	var statA, statB syscall.Stat_t
+	if err := syscall.Stat(a, &statA); err != nil {
+		return false, errors.Annotatef(err, "checking %q", a)
+	}
+	if err := syscall.Stat(b, &statB); err != nil {
+		return false, errors.Annotatef(err, "checking %q", b)
+	}
+	return statA.Dev == statB.Dev, nil
+}
+
+// checkFreeSpace returns an error if the files under src wouldn't
+// fit in the filesystem containing dest.
+func checkFreeSpace(src, dest string) error {
+	var needed int64
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			needed += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Annotatef(err, "measuring %q", src)
+	}
+	return errors.Trace(checkAvailable(dest, needed))
+}
+
+// checkAvailable returns an error if the filesystem containing dest
+// doesn't have needed bytes free for a copy of the dump.
+func checkAvailable(dest string, needed int64) error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dest, &fs); err != nil {
+		return errors.Annotatef(err, "checking free space in %q", dest)
+	}
+	available := int64(fs.Bavail) * int64(fs.Bsize)
+	if needed > available {
+		return errors.Errorf("not enough space to copy the dump to %q: need %d bytes, %d available (%d bytes short) - use --temp-root on the same filesystem to avoid copying", dest, needed, available, needed-available)
+	}
+	return nil
+}
+
+// copyTree recreates the directories under src in dest, using
+// populate to create each file.
+func copyTree(src, dest string, populate func(src, dest string) error) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		return populate(path, target)
+	})
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package db_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/db"
+)
+
+type snapDumpSuite struct {
+	testing.IsolationSuite
+
+	dumpDir string
+	snapDir string
+}
+
+var _ = gc.Suite(&snapDumpSuite{})
+
+func (s *snapDumpSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.dumpDir = filepath.Join(c.MkDir(), "juju-restore-1234", "dump")
+	s.snapDir = c.MkDir()
+	s.writeFile(c, "oplog.bson", "oplog")
+	s.writeFile(c, "juju/machines.bson", "machines")
+	s.writeFile(c, "juju/machines.metadata.json", "{}")
+	s.writeFile(c, "admin/system.users.bson", "users")
+}
+
+func (s *snapDumpSuite) writeFile(c *gc.C, name, content string) {
+	path := filepath.Join(s.dumpDir, name)
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), jc.ErrorIsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), jc.ErrorIsNil)
+}
+
+func (s *snapDumpSuite) checkStaged(c *gc.C, staged string, linked bool) {
+	c.Assert(staged, gc.Equals, filepath.Join(s.snapDir, s.dumpDir))
+	for _, name := range []string{
+		"oplog.bson",
+		"juju/machines.bson",
+		"juju/machines.metadata.json",
+		"admin/system.users.bson",
+	} {
+		original, err := os.Stat(filepath.Join(s.dumpDir, name))
+		c.Assert(err, jc.ErrorIsNil)
+		copied, err := os.Stat(filepath.Join(staged, name))
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(os.SameFile(original, copied), gc.Equals, linked, gc.Commentf(name))
+		expected, err := ioutil.ReadFile(filepath.Join(s.dumpDir, name))
+		c.Assert(err, jc.ErrorIsNil)
+		data, err := ioutil.ReadFile(filepath.Join(staged, name))
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(string(data), gc.Equals, string(expected))
+	}
+}
+
+func (s *snapDumpSuite) TestLinksOnSameFilesystem(c *gc.C) {
+	staged, err := db.LinkToHomeSnap(s.snapDir, s.dumpDir)
+	c.Assert(err, jc.ErrorIsNil)
+	s.checkStaged(c, staged, true)
+}
+
+func (s *snapDumpSuite) TestCopiesAcrossFilesystems(c *gc.C) {
+	s.PatchValue(db.SameFilesystem, func(a, b string) (bool, error) {
+		return false, nil
+	})
+	staged, err := db.LinkToHomeSnap(s.snapDir, s.dumpDir)
+	c.Assert(err, jc.ErrorIsNil)
+	s.checkStaged(c, staged, false)
+
+	// The original dump is left alone.
+	_, err = os.Stat(filepath.Join(s.dumpDir, "juju", "machines.bson"))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *snapDumpSuite) TestPartialCopyCleanedUp(c *gc.C) {
+	s.PatchValue(db.SameFilesystem, func(a, b string) (bool, error) {
+		return false, nil
+	})
+	// A file left in the way stops the copy part-way through.
+	staged := filepath.Join(s.snapDir, s.dumpDir)
+	blocker := filepath.Join(staged, "juju", "machines.metadata.json")
+	c.Assert(os.MkdirAll(filepath.Dir(blocker), 0755), jc.ErrorIsNil)
+	c.Assert(ioutil.WriteFile(blocker, []byte("stale"), 0644), jc.ErrorIsNil)
+
+	_, err := db.LinkToHomeSnap(s.snapDir, s.dumpDir)
+	c.Assert(err, gc.ErrorMatches, "populating snap dump dir: .*file exists")
+	_, err = os.Stat(staged)
+	c.Assert(os.IsNotExist(err), jc.IsTrue)
+	// Only the staged copy is removed.
+	_, err = os.Stat(filepath.Join(s.dumpDir, "juju", "machines.bson"))
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *snapDumpSuite) TestPartialLinkCleanedUp(c *gc.C) {
+	staged := filepath.Join(s.snapDir, s.dumpDir)
+	blocker := filepath.Join(staged, "oplog.bson")
+	c.Assert(os.MkdirAll(filepath.Dir(blocker), 0755), jc.ErrorIsNil)
+	c.Assert(ioutil.WriteFile(blocker, []byte("stale"), 0644), jc.ErrorIsNil)
+
+	_, err := db.LinkToHomeSnap(s.snapDir, s.dumpDir)
+	c.Assert(err, gc.ErrorMatches, "populating snap dump dir: .*file exists")
+	_, err = os.Stat(staged)
+	c.Assert(os.IsNotExist(err), jc.IsTrue)
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/juju/ansiterm"
 	"github.com/juju/loggo"
@@ -17,9 +18,13 @@ type colorWriter struct {
 }
 
 // NewColorWriter will write out colored severity levels if the writer is
-// outputting to a terminal.
+// outputting to a terminal, unless NO_COLOR is set (see no-color.org).
 func NewColorWriter(writer io.Writer) loggo.Writer {
-	return &colorWriter{ansiterm.NewWriter(writer)}
+	w := ansiterm.NewWriter(writer)
+	if os.Getenv("NO_COLOR") != "" {
+		w.SetColorCapable(false)
+	}
+	return &colorWriter{w}
 }
 
 // Write implements Writer. Output is prefixed with log level (colored
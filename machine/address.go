@@ -0,0 +1,55 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"net"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// lookupHost is patched out in tests.
+var lookupHost = net.LookupHost
+
+// splitMemberHost returns the host part of a replica set member
+// name, which is usually <host>:<mongo port>. The host can be an
+// IPv4 address, a bracketed IPv6 address or a hostname, and the port
+// may be missing.
+func splitMemberHost(name string) (string, error) {
+	if name == "" {
+		return "", errors.NotValidf("empty replica set member name")
+	}
+	host, _, err := net.SplitHostPort(name)
+	if err == nil {
+		return host, nil
+	}
+	// There's no port - strip any brackets around an IPv6 address.
+	host = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", errors.NotValidf("replica set member name %q", name)
+	}
+	return host, nil
+}
+
+// resolveHost returns the address to use when connecting to host. IP
+// addresses are returned as they are; hostnames are resolved,
+// preferring IPv4 addresses. If a hostname can't be resolved it's
+// returned unchanged so that ssh can try to resolve it itself.
+func resolveHost(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	addrs, err := lookupHost(host)
+	if err != nil || len(addrs) == 0 {
+		logger.Warningf("couldn't resolve %q: %v", host, err)
+		return host
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr
+		}
+	}
+	return addrs[0]
+}
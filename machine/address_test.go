@@ -0,0 +1,78 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine_test
+
+import (
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/machine"
+)
+
+type addressSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&addressSuite{})
+
+func (s *addressSuite) TestSplitMemberHost(c *gc.C) {
+	for _, test := range []struct {
+		name string
+		host string
+		err  string
+	}{
+		{name: "10.0.0.1:37017", host: "10.0.0.1"},
+		{name: "10.0.0.1", host: "10.0.0.1"},
+		{name: "[fd42:5e1f::1]:37017", host: "fd42:5e1f::1"},
+		{name: "[fd42:5e1f::1]", host: "fd42:5e1f::1"},
+		{name: "fd42:5e1f::1", host: "fd42:5e1f::1"},
+		{name: "controller-1.maas:37017", host: "controller-1.maas"},
+		{name: "controller-1.maas", host: "controller-1.maas"},
+		{name: "", err: "empty replica set member name not valid"},
+		{name: "what:is:this", err: `replica set member name "what:is:this" not valid`},
+	} {
+		host, err := machine.SplitMemberHost(test.name)
+		if test.err != "" {
+			c.Check(err, gc.ErrorMatches, test.err, gc.Commentf(test.name))
+			continue
+		}
+		c.Check(err, jc.ErrorIsNil, gc.Commentf(test.name))
+		c.Check(host, gc.Equals, test.host, gc.Commentf(test.name))
+	}
+}
+
+func (s *addressSuite) TestResolveHost(c *gc.C) {
+	s.PatchValue(machine.LookupHost, func(host string) ([]string, error) {
+		switch host {
+		case "controller-1.maas":
+			return []string{"fd42::5", "10.0.0.5"}, nil
+		case "controller-2.maas":
+			return []string{"fd42::6"}, nil
+		}
+		return nil, errors.NotFoundf(host)
+	})
+	c.Check(machine.ResolveHost("10.0.0.1"), gc.Equals, "10.0.0.1")
+	c.Check(machine.ResolveHost("fd42::1"), gc.Equals, "fd42::1")
+	c.Check(machine.ResolveHost("controller-1.maas"), gc.Equals, "10.0.0.5")
+	c.Check(machine.ResolveHost("controller-2.maas"), gc.Equals, "fd42::6")
+	c.Check(machine.ResolveHost("unknown.maas"), gc.Equals, "unknown.maas")
+}
+
+func (s *addressSuite) TestFactoryNameAndAddress(c *gc.C) {
+	s.PatchValue(machine.LookupHost, func(host string) ([]string, error) {
+		return []string{"10.0.0.5"}, nil
+	})
+	factory := machine.NewControllerNodeFactory(machine.DefaultConfig())
+
+	node := factory(core.ReplicaSetMember{Name: "controller-1.maas:37017", JujuMachineID: "1"})
+	c.Assert(node.Name(), gc.Equals, "controller-1.maas")
+	c.Assert(node.IP(), gc.Equals, "10.0.0.5")
+
+	node = factory(core.ReplicaSetMember{Name: "[fd42::2]:37017", JujuMachineID: "2"})
+	c.Assert(node.Name(), gc.Equals, "fd42::2")
+	c.Assert(node.IP(), gc.Equals, "fd42::2")
+}
@@ -6,14 +6,14 @@ package machine
 import (
 	"bytes"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/juju/clock"
 	"github.com/juju/errors"
+	"gopkg.in/retry.v1"
 )
 
 // CommandRunner defines what is needed to run a command on a machine.
@@ -26,102 +26,374 @@ type CommandRunner interface {
 	RunScript(script string, args ...string) (string, error)
 }
 
-type localRunner struct{}
+// StreamingRunner is a CommandRunner that can pass on the output of a
+// script as it's written, so long-running scripts can show progress.
+type StreamingRunner interface {
+	CommandRunner
 
-// NewLocalRunner constructs a command runner that runs commands locally.
-func NewLocalRunner() CommandRunner {
-	return &localRunner{}
+	// RunScriptStreaming is like RunScript, but also calls output with
+	// each line the script writes to stdout or stderr as soon as the
+	// line is complete.
+	RunScriptStreaming(output func(line string), script string, args ...string) (string, error)
+}
+
+type localRunner struct {
+	timeout time.Duration
+	sudo    Sudo
+}
+
+// NewLocalRunner constructs a command runner that runs commands
+// locally. If timeout is non-zero, commands that take longer are
+// killed along with any processes they started. Scripts are run as
+// root using sudo.
+func NewLocalRunner(timeout time.Duration, sudo Sudo) CommandRunner {
+	return &localRunner{timeout: timeout, sudo: sudo}
 }
 
 // Run implements CommandRunner.Run.
 func (r *localRunner) Run(commands ...string) (string, error) {
-	customSSH := exec.Command(commands[0], commands[1:]...)
-	var out, cmdErr bytes.Buffer
-	customSSH.Stdout = &out
-	customSSH.Stderr = &cmdErr
-	if err := customSSH.Run(); err != nil {
-		if cmdErr.Len() > 0 {
-			// Remove trailing newlines from the output.
-			return "", errors.New(strings.TrimSpace(cmdErr.String()))
+	return r.runStreaming(nil, commands...)
+}
+
+// runStreaming runs the command, passing each line of its output to
+// output if it's set.
+func (r *localRunner) runStreaming(output func(string), commands ...string) (string, error) {
+	out, stderr, err := r.run("", output, commands...)
+	if err != nil {
+		if stderr != "" {
+			return "", errors.New(stderr)
 		}
 		return "", err
 	}
-	return out.String(), nil
+	return out, nil
+}
+
+// run executes the command, returning its output and any error
+// output with trailing newlines removed. The command reads input from
+// stdin if it's not empty. If output is set it's called with each
+// line written to either as the command runs.
+func (r *localRunner) run(input string, output func(string), commands ...string) (string, string, error) {
+	customSSH := exec.Command(commands[0], commands[1:]...)
+	if input != "" {
+		customSSH.Stdin = strings.NewReader(input)
+	}
+	var mu sync.Mutex
+	out := &lineWriter{output: output, mu: &mu}
+	cmdErr := &lineWriter{output: output, mu: &mu}
+	customSSH.Stdout = out
+	customSSH.Stderr = cmdErr
+	var err error
+	if r.timeout == 0 {
+		err = customSSH.Run()
+	} else {
+		err = runWithTimeout(customSSH, r.timeout)
+	}
+	out.flush()
+	cmdErr.flush()
+	return out.String(), strings.TrimSpace(cmdErr.String()), err
 }
 
 // RunScript for a local machine can still just run the string
 // directly.
 func (r *localRunner) RunScript(script string, args ...string) (string, error) {
-	fullArgs := []string{"sudo", "bash", "-c", script, "local-script"}
+	return r.RunScriptStreaming(nil, script, args...)
+}
+
+// RunScriptStreaming implements StreamingRunner.RunScriptStreaming.
+func (r *localRunner) RunScriptStreaming(output func(string), script string, args ...string) (string, error) {
+	fullArgs := r.sudo.command("bash", "-c", script, "local-script")
 	fullArgs = append(fullArgs, args...)
-	return r.Run(fullArgs...)
+	return r.runStreaming(output, fullArgs...)
+}
+
+// lineWriter collects what's written to it, passing each complete
+// line to output if it's set. The stdout and stderr writers of a
+// command share a mutex, since they're written concurrently. The
+// buffer isn't embedded so that io.Copy can't bypass Write with the
+// buffer's ReadFrom.
+type lineWriter struct {
+	buf     bytes.Buffer
+	output  func(string)
+	mu      *sync.Mutex
+	partial []byte
+}
+
+// Write is part of io.Writer.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.output != nil {
+		w.partial = append(w.partial, p...)
+		for {
+			i := bytes.IndexByte(w.partial, '\n')
+			if i < 0 {
+				break
+			}
+			w.output(string(w.partial[:i]))
+			w.partial = w.partial[i+1:]
+		}
+	}
+	return w.buf.Write(p)
+}
+
+// String returns everything written so far.
+func (w *lineWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// flush passes on any last line that didn't end with a newline.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.output != nil && len(w.partial) > 0 {
+		w.output(string(w.partial))
+		w.partial = nil
+	}
+}
+
+const (
+	defaultSSHUser         = "ubuntu"
+	defaultSSHIdentityFile = "/var/lib/juju/system-identity"
+	defaultSSHAttempts     = 3
+)
+
+// sshRetryDelay is how long to wait before the first retry of a
+// failed connection, doubling on each subsequent attempt.
+var sshRetryDelay = 2 * time.Second
+
+// SSHOptions holds the settings used to connect to a remote
+// controller machine.
+type SSHOptions struct {
+	// User is the user to log in as on the remote machine.
+	User string
+
+	// Port is the port sshd listens on. If empty the ssh default
+	// is used.
+	Port string
+
+	// IdentityFile is the path of the private key used to
+	// authenticate.
+	IdentityFile string
+
+	// KnownHostsFile is the path of a known_hosts file used to
+	// verify the remote machine's host key. If empty, host key
+	// checking is disabled.
+	KnownHostsFile string
+
+	// Options holds extra settings passed to ssh and scp with -o,
+	// for example "ProxyJump=bastion".
+	Options []string
+
+	// Attempts is the number of times to try a command when the
+	// connection fails with a transient error before the command
+	// starts. Once it has started the command isn't tried again,
+	// since not all of the commands juju-restore runs are safe to
+	// repeat.
+	Attempts int
+}
+
+// DefaultSSHOptions returns the settings that work for a standard
+// Juju controller, logging in as ubuntu with the controller's system
+// identity.
+func DefaultSSHOptions() SSHOptions {
+	return SSHOptions{
+		User:         defaultSSHUser,
+		IdentityFile: defaultSSHIdentityFile,
+		Attempts:     defaultSSHAttempts,
+	}
+}
+
+// Merge returns a copy of these options with any values set in
+// override taking precedence. Extra options are appended.
+func (o SSHOptions) Merge(override SSHOptions) SSHOptions {
+	result := o
+	if override.User != "" {
+		result.User = override.User
+	}
+	if override.Port != "" {
+		result.Port = override.Port
+	}
+	if override.IdentityFile != "" {
+		result.IdentityFile = override.IdentityFile
+	}
+	if override.KnownHostsFile != "" {
+		result.KnownHostsFile = override.KnownHostsFile
+	}
+	result.Options = append(append([]string(nil), o.Options...), override.Options...)
+	return result
+}
+
+// args returns the common arguments for ssh or scp - they only
+// differ in the flag used to specify the port.
+func (o SSHOptions) args(portFlag string) []string {
+	args := []string{"-o", "StrictHostKeyChecking no"}
+	if o.KnownHostsFile != "" {
+		args = []string{
+			"-o", "StrictHostKeyChecking yes",
+			"-o", "UserKnownHostsFile " + o.KnownHostsFile,
+		}
+	}
+	args = append(args, "-i", o.IdentityFile)
+	if o.Port != "" {
+		args = append(args, portFlag, o.Port)
+	}
+	for _, option := range o.Options {
+		args = append(args, "-o", option)
+	}
+	return args
+}
+
+// RemoteRunnerParams holds the information needed to run commands
+// on a remote machine.
+type RemoteRunnerParams struct {
+	// IP is the address of the remote machine.
+	IP string
+
+	// SSH holds the settings used to connect to the machine.
+	SSH SSHOptions
+
+	// ConfirmHostKey is called with the host keys of the machine if
+	// it is missing from SSH.KnownHostsFile. If it accepts them they
+	// are added to the file. If nil, unknown hosts fail to connect.
+	ConfirmHostKey HostKeyConfirmer
+
+	// Timeout is how long each command may run before being killed.
+	// Zero means no limit.
+	Timeout time.Duration
+
+	// Sudo is used to run scripts as root on the remote machine.
+	Sudo Sudo
+
+	// LocalSudo is used to run ssh and scp on this machine, so they
+	// can read the identity file.
+	LocalSudo Sudo
 }
 
 type remoteRunner struct {
 	*localRunner
-	ip string
+	ip   string
+	ssh  SSHOptions
+	sudo Sudo
+
+	confirmHostKey HostKeyConfirmer
+	hostKnown      bool
 }
 
-// NewRemoteRunner constructs a command runner that runs commands remotely using ssh.
-func NewRemoteRunner(ip string) CommandRunner {
-	return &remoteRunner{&localRunner{}, ip}
+// NewRemoteRunner constructs a command runner that runs commands
+// remotely using ssh.
+func NewRemoteRunner(params RemoteRunnerParams) CommandRunner {
+	return &remoteRunner{
+		localRunner:    &localRunner{timeout: params.Timeout, sudo: params.LocalSudo},
+		ip:             params.IP,
+		ssh:            params.SSH,
+		sudo:           params.Sudo,
+		confirmHostKey: params.ConfirmHostKey,
+	}
 }
 
 // Run implements CommandRunner.Run.
 func (r *remoteRunner) Run(commands ...string) (string, error) {
-	// Since we are logged in as a 'ubuntu' user,
-	// we need to run in sudo to read the identity file.
-	args := []string{
-		"sudo",
-		"ssh",
-		"-o", "StrictHostKeyChecking no",
-		"-i", "/var/lib/juju/system-identity",
-		fmt.Sprintf("ubuntu@%v", r.ip),
-		strings.Join(commands, " "), // The commands should be sent to the target as one string.
+	return r.runStreaming(nil, commands...)
+}
+
+// runStreaming runs the commands over ssh, passing each line of their
+// output to output if it's set.
+func (r *remoteRunner) runStreaming(output func(string), commands ...string) (string, error) {
+	return r.runInput("", output, commands...)
+}
+
+// runInput runs the commands over ssh with input sent to their stdin.
+func (r *remoteRunner) runInput(input string, output func(string), commands ...string) (string, error) {
+	if err := r.ensureHostKnown(); err != nil {
+		return "", errors.Trace(err)
 	}
-	return r.localRunner.Run(args...)
+	// Unless we're running as root, ssh needs sudo to read the
+	// identity file.
+	args := append(r.localRunner.sudo.command("ssh"), r.ssh.args("-p")...)
+	args = append(args,
+		fmt.Sprintf("%v@%v", r.ssh.User, r.ip),
+		// The commands should be sent to the target as one string,
+		// after marking that the connection has been made.
+		"echo "+startedMarker+" >&2; "+strings.Join(commands, " "),
+	)
+	return r.runWithRetries(input, output, args)
 }
 
-// RunScript on a remote machine needs to scp the script over and then
-// run it.
-func (r *remoteRunner) RunScript(script string, args ...string) (string, error) {
-	scriptFile, err := ioutil.TempFile("/tmp", "juju-restore-script")
-	if err != nil {
-		return "", errors.Annotate(err, "creating tempfile")
+// startedMarker is written to stderr on the remote machine before the
+// command runs, so failures in ssh can be told apart from the
+// command's own.
+const startedMarker = "juju-restore-remote-command-started"
+
+// removeStartedMarker returns stderr without the started marker, and
+// whether it was there.
+func removeStartedMarker(stderr string) (string, bool) {
+	i := strings.Index(stderr, startedMarker)
+	if i < 0 {
+		return stderr, false
 	}
-	defer func() {
-		_ = scriptFile.Close()
-		_ = os.Remove(scriptFile.Name())
-	}()
-	_, err = io.WriteString(scriptFile, script)
-	if err != nil {
-		return "", errors.Trace(err)
+	return strings.TrimSpace(stderr[:i] + stderr[i+len(startedMarker):]), true
+}
+
+// runWithRetries runs the ssh command, retrying with backoff if the
+// connection fails before the command starts. The input is sent
+// again on each attempt.
+func (r *remoteRunner) runWithRetries(input string, output func(string), args []string) (string, error) {
+	if output != nil {
+		streamed := output
+		output = func(line string) {
+			if line != startedMarker {
+				streamed(line)
+			}
+		}
 	}
-	err = scriptFile.Close()
-	if err != nil {
-		return "", errors.Trace(err)
+	attempts := r.ssh.Attempts
+	if attempts < 1 {
+		attempts = 1
 	}
-	err = r.scpTempScript(filepath.Base(scriptFile.Name()))
-	if err != nil {
-		return "", errors.Annotatef(err, "scping script to %s", r.ip)
+	attempt := retry.Start(
+		retry.LimitCount(attempts, retry.Exponential{
+			Initial: sshRetryDelay,
+			Factor:  2,
+		}),
+		clock.WallClock,
+	)
+	var (
+		out string
+		err error
+	)
+	for attempt.Next() {
+		var stderr string
+		out, stderr, err = r.localRunner.run(input, output, args...)
+		if err == nil {
+			return out, nil
+		}
+		if IsCommandTimeoutError(err) {
+			return "", errors.Trace(err)
+		}
+		stderr, started := removeStartedMarker(stderr)
+		err = classifySSHError(stderr, started, err)
+		if !IsConnectionError(err) {
+			return "", errors.Trace(err)
+		}
+		if attempt.More() {
+			logger.Debugf("connecting to %s failed (retrying, attempt %v): %v", r.ip, attempt.Count(), err)
+		}
 	}
-	fullArgs := []string{"sudo", "bash", scriptFile.Name()}
+	return "", errors.Trace(err)
+}
+
+// RunScript on a remote machine sends the script to bash over the
+// ssh session, so nothing needs to be copied to the machine or
+// cleaned up afterwards.
+func (r *remoteRunner) RunScript(script string, args ...string) (string, error) {
+	return r.RunScriptStreaming(nil, script, args...)
+}
+
+// RunScriptStreaming implements StreamingRunner.RunScriptStreaming.
+func (r *remoteRunner) RunScriptStreaming(output func(string), script string, args ...string) (string, error) {
+	fullArgs := r.sudo.command("bash", "-s", "--")
 	fullArgs = append(fullArgs, args...)
-	return r.Run(fullArgs...)
-}
-
-// copyTempScript copies a script file from /tmp locally to /tmp on
-// the target.
-func (r *remoteRunner) scpTempScript(name string) error {
-	path := filepath.Join("/tmp", name)
-	args := []string{
-		"sudo",
-		"scp",
-		"-o", "StrictHostKeyChecking no",
-		"-i", "/var/lib/juju/system-identity",
-		path,
-		fmt.Sprintf("ubuntu@%s:%s", r.ip, path),
-	}
-	_, err := r.localRunner.Run(args...)
-	return errors.Trace(err)
+	return r.runInput(script, output, fullArgs...)
 }
@@ -0,0 +1,184 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/machine"
+)
+
+type commandRunnerSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&commandRunnerSuite{})
+
+func (s *commandRunnerSuite) TestLocalRun(c *gc.C) {
+	out, err := machine.NewLocalRunner(time.Minute, nil).Run("/bin/echo", "hi:D")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "hi:D\n")
+}
+
+func (s *commandRunnerSuite) TestLocalRunError(c *gc.C) {
+	_, err := machine.NewLocalRunner(0, nil).Run("/bin/sh", "-c", "echo bad things >&2; exit 1")
+	c.Assert(err, gc.ErrorMatches, "bad things")
+}
+
+func (s *commandRunnerSuite) TestLocalRunTimeout(c *gc.C) {
+	start := time.Now()
+	_, err := machine.NewLocalRunner(100*time.Millisecond, nil).Run("/bin/sh", "-c", "/bin/sleep 10; echo done")
+	c.Assert(err, jc.Satisfies, machine.IsCommandTimeoutError)
+	c.Assert(err, gc.ErrorMatches, `command timed out: "/bin/sh -c /bin/sleep 10; echo done" didn't finish within 100ms`)
+	// The sleep started by the shell is killed along with it.
+	c.Assert(time.Since(start) < 5*time.Second, jc.IsTrue)
+}
+
+func (s *commandRunnerSuite) TestLocalRunScriptSudo(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "doas"), []byte("#!/bin/sh\necho doas \"$@\"\n"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	s.PatchEnvironment("PATH", dir)
+
+	runner := machine.NewLocalRunner(time.Minute, machine.Sudo{"doas", "-n"})
+	out, err := runner.RunScript("echo $1", "arg")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "doas -n bash -c echo $1 local-script arg\n")
+}
+
+func (s *commandRunnerSuite) TestRemoteRunScriptUsesStdin(c *gc.C) {
+	dir := c.MkDir()
+	// Record the arguments and run the remote command locally.
+	fakeSSH := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\nfor last; do :; done\nexec sh -c \"$last\"\n"
+	err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(fakeSSH), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	s.PatchEnvironment("PATH", dir+":/bin:/usr/bin")
+
+	runner := machine.NewRemoteRunner(machine.RemoteRunnerParams{
+		IP:  "10.0.0.2",
+		SSH: machine.SSHOptions{User: "ubuntu", IdentityFile: "/id"},
+	})
+	out, err := runner.RunScript("echo \"$1-$2\"", "a", "b")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "a-b\n")
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(args), gc.Equals, "-o StrictHostKeyChecking no -i /id ubuntu@10.0.0.2 echo juju-restore-remote-command-started >&2; bash -s -- a b\n")
+}
+
+// fakeSSH installs an ssh that counts its runs and then runs script,
+// which can exit 255 itself (as ssh does when it can't connect) or
+// run the remote command in "$last".
+func (s *commandRunnerSuite) fakeSSH(c *gc.C, script string) (countPath string) {
+	dir := c.MkDir()
+	countPath = filepath.Join(dir, "count")
+	fakeSSH := "#!/bin/sh\necho run >> " + countPath + "\nfor last; do :; done\n" + script
+	err := ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(fakeSSH), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	s.PatchEnvironment("PATH", dir+":/bin:/usr/bin")
+	s.PatchValue(machine.SSHRetryDelay, time.Millisecond)
+	return countPath
+}
+
+func (s *commandRunnerSuite) checkRuns(c *gc.C, countPath string, expected int) {
+	data, err := ioutil.ReadFile(countPath)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(strings.Count(string(data), "run"), gc.Equals, expected)
+}
+
+func (s *commandRunnerSuite) remoteRunner() machine.CommandRunner {
+	return machine.NewRemoteRunner(machine.RemoteRunnerParams{
+		IP:  "10.0.0.2",
+		SSH: machine.SSHOptions{User: "ubuntu", IdentityFile: "/id", Attempts: 3},
+	})
+}
+
+func (s *commandRunnerSuite) TestRemoteRetriesConnectionFailure(c *gc.C) {
+	countPath := s.fakeSSH(c, "echo 'ssh: connect to host 10.0.0.2 port 22: Connection refused' >&2\nexit 255\n")
+	_, err := s.remoteRunner().Run("sudo", "systemctl", "stop", "juju-db")
+	c.Assert(err, gc.ErrorMatches, "ssh connection failed: ssh: connect to host 10.0.0.2 port 22: Connection refused")
+	c.Assert(err, jc.Satisfies, machine.IsConnectionError)
+	s.checkRuns(c, countPath, 3)
+}
+
+func (s *commandRunnerSuite) TestRemoteCommandOutputNotRetried(c *gc.C) {
+	countPath := s.fakeSSH(c, "exec sh -c \"$last\"\n")
+	_, err := s.remoteRunner().RunScript("echo 'Connection refused' >&2; exit 1")
+	c.Assert(err, gc.ErrorMatches, "command failed: Connection refused")
+	c.Assert(err, jc.Satisfies, machine.IsCommandError)
+	s.checkRuns(c, countPath, 1)
+}
+
+func (s *commandRunnerSuite) TestRemoteCommandExit255NotRetried(c *gc.C) {
+	countPath := s.fakeSSH(c, "exec sh -c \"$last\"\n")
+	_, err := s.remoteRunner().RunScript("exit 255")
+	c.Assert(err, gc.ErrorMatches, "command failed: exit status 255")
+	c.Assert(err, jc.Satisfies, machine.IsCommandError)
+	s.checkRuns(c, countPath, 1)
+}
+
+func (s *commandRunnerSuite) TestRemoteDisconnectWhileRunningNotRetried(c *gc.C) {
+	countPath := s.fakeSSH(c, "sh -c \"$last\"\necho 'Connection to 10.0.0.2 closed by remote host.' >&2\nexit 255\n")
+	_, err := s.remoteRunner().Run("true")
+	c.Assert(err, gc.ErrorMatches, "ssh connection lost while the command was running: Connection to 10.0.0.2 closed by remote host.")
+	c.Assert(err, gc.Not(jc.Satisfies), machine.IsConnectionError)
+	s.checkRuns(c, countPath, 1)
+}
+
+func (s *commandRunnerSuite) TestRemoteStreamingHidesMarker(c *gc.C) {
+	s.fakeSSH(c, "exec sh -c \"$last\"\n")
+	streaming, ok := s.remoteRunner().(machine.StreamingRunner)
+	c.Assert(ok, jc.IsTrue)
+	var lines []string
+	out, err := streaming.RunScriptStreaming(func(line string) {
+		lines = append(lines, line)
+	}, "echo one; echo two >&2")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "one\n")
+	c.Assert(lines, jc.SameContents, []string{"one", "two"})
+}
+
+func (s *commandRunnerSuite) TestLXDRun(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "lxc"), []byte("#!/bin/sh\necho \"$@\"\n"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	s.PatchEnvironment("PATH", dir)
+
+	runner := machine.NewLXDRunner(machine.LXDContainer{Name: "juju-abc-1", Remote: "node3"}, time.Minute)
+	out, err := runner.Run("sudo", "systemctl", "stop", "jujud-machine-1")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "exec node3:juju-abc-1 -- sudo systemctl stop jujud-machine-1\n")
+
+	runner = machine.NewLXDRunner(machine.LXDContainer{Name: "juju-abc-1"}, time.Minute)
+	out, err = runner.RunScript("echo $1", "arg")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "exec juju-abc-1 -- bash -c echo $1 lxd-script arg\n")
+}
+
+func (s *commandRunnerSuite) TestLXDRunScriptStreaming(c *gc.C) {
+	dir := c.MkDir()
+	// Drop "exec juju-abc-1 --" and run the rest.
+	err := ioutil.WriteFile(filepath.Join(dir, "lxc"), []byte("#!/bin/sh\nshift 3\nexec \"$@\"\n"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	s.PatchEnvironment("PATH", dir+":/bin:/usr/bin")
+
+	runner := machine.NewLXDRunner(machine.LXDContainer{Name: "juju-abc-1"}, time.Minute)
+	streaming, ok := runner.(machine.StreamingRunner)
+	c.Assert(ok, jc.IsTrue)
+	var lines []string
+	out, err := streaming.RunScriptStreaming(func(line string) {
+		lines = append(lines, line)
+	}, "echo one; echo two >&2; printf three")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "one\nthree")
+	// The partial last line is passed on once the script finishes.
+	c.Assert(lines, jc.SameContents, []string{"one", "two", "three"})
+}
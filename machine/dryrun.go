@@ -0,0 +1,52 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type dryRunRunner struct {
+	sudo   Sudo
+	report func(command string)
+}
+
+// NewDryRunRunner constructs a command runner that passes each command
+// to report instead of running it, as it would be typed into a shell
+// on the machine. Commands produce no output and always succeed.
+// Scripts are shown being run as root with sudo.
+func NewDryRunRunner(sudo Sudo, report func(command string)) CommandRunner {
+	return &dryRunRunner{sudo: sudo, report: report}
+}
+
+// Run implements CommandRunner.Run.
+func (r *dryRunRunner) Run(commands ...string) (string, error) {
+	r.report(shellJoin(commands))
+	return "", nil
+}
+
+// RunScript implements CommandRunner.RunScript.
+func (r *dryRunRunner) RunScript(script string, args ...string) (string, error) {
+	command := append(r.sudo.command("bash", "-s", "--"), args...)
+	r.report(fmt.Sprintf("%s <<'EOF'\n%s\nEOF", shellJoin(command), strings.TrimSpace(script)))
+	return "", nil
+}
+
+var shellSafe = regexp.MustCompile(`^[a-zA-Z0-9_./:=@%+,-]+$`)
+
+// shellJoin quotes the arguments where needed so the command can be
+// pasted into a shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+type errorKind string
+
+const (
+	sshAuthFailed    errorKind = "ssh authentication failed"
+	sshTimedOut      errorKind = "ssh connection timed out"
+	sshConnectFailed errorKind = "ssh connection failed"
+	sshDisconnected  errorKind = "ssh connection lost while the command was running"
+	commandFailed    errorKind = "command failed"
+	commandTimedOut  errorKind = "command timed out"
+)
+
+// sshExitCode is the status ssh exits with when the failure is in
+// ssh itself rather than the remote command.
+const sshExitCode = 255
+
+var (
+	authFailureMessages = []string{
+		"Permission denied",
+		"Host key verification failed",
+		"Too many authentication failures",
+	}
+	timeoutMessages = []string{
+		"timed out",
+	}
+	connectionFailureMessages = []string{
+		"Connection refused",
+		"Connection reset",
+		"Connection closed",
+		"No route to host",
+		"Network is unreachable",
+		"Could not resolve hostname",
+		"lost connection",
+		"Broken pipe",
+		"kex_exchange_identification",
+		"closed by remote host",
+	}
+)
+
+type runError struct {
+	kind    errorKind
+	message string
+}
+
+// Error is part of error.
+func (e *runError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind, e.message)
+}
+
+// classifySSHError works out why an ssh invocation failed from
+// its error output and exit status. started says whether the remote
+// command had begun running: once it has, its own output and exit
+// status can look like ssh's, and it may have made changes, so the
+// failure is never treated as a (retryable) connection error.
+func classifySSHError(stderr string, started bool, err error) error {
+	message := stderr
+	if message == "" {
+		message = err.Error()
+	}
+	contains := func(candidates []string) bool {
+		for _, candidate := range candidates {
+			if strings.Contains(stderr, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	sshFailed := ok && exitErr.ExitCode() == sshExitCode
+	kind := commandFailed
+	switch {
+	case started:
+		if sshFailed && contains(connectionFailureMessages) {
+			kind = sshDisconnected
+		}
+	case contains(authFailureMessages):
+		kind = sshAuthFailed
+	case contains(timeoutMessages):
+		kind = sshTimedOut
+	case contains(connectionFailureMessages):
+		kind = sshConnectFailed
+	case sshFailed:
+		kind = sshConnectFailed
+	}
+	return &runError{kind: kind, message: message}
+}
+
+func isErrorKind(err error, kinds ...errorKind) bool {
+	e, ok := errors.Cause(err).(*runError)
+	if !ok {
+		return false
+	}
+	for _, kind := range kinds {
+		if e.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAuthenticationError returns whether err was caused by ssh
+// failing to authenticate to a remote machine.
+func IsAuthenticationError(err error) bool {
+	return isErrorKind(err, sshAuthFailed)
+}
+
+// IsTimeoutError returns whether err was caused by an ssh connection
+// timing out.
+func IsTimeoutError(err error) bool {
+	return isErrorKind(err, sshTimedOut)
+}
+
+// IsConnectionError returns whether err was caused by a failure to
+// connect to (or staying connected to) a remote machine, including
+// timeouts. These are considered transient and are retried.
+func IsConnectionError(err error) bool {
+	return isErrorKind(err, sshTimedOut, sshConnectFailed)
+}
+
+// IsCommandError returns whether err was caused by the command
+// failing on the remote machine. A connection dropped while the
+// command was running isn't a command error or a connection error,
+// since the command may or may not have finished.
+func IsCommandError(err error) bool {
+	return isErrorKind(err, commandFailed)
+}
+
+// IsCommandTimeoutError returns whether err was caused by a command
+// being killed because it didn't finish in time.
+func IsCommandTimeoutError(err error) bool {
+	return isErrorKind(err, commandTimedOut)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine_test
+
+import (
+	"os/exec"
+	"regexp"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/machine"
+)
+
+type errorsSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&errorsSuite{})
+
+func exitError(c *gc.C, code string) error {
+	err := exec.Command("/bin/sh", "-c", "exit "+code).Run()
+	c.Assert(err, gc.FitsTypeOf, &exec.ExitError{})
+	return err
+}
+
+func (s *errorsSuite) TestClassifySSHError(c *gc.C) {
+	for i, test := range []struct {
+		stderr     string
+		code       string
+		started    bool
+		message    string
+		auth       bool
+		timeout    bool
+		connection bool
+		command    bool
+	}{{
+		stderr:  "ubuntu@10.0.0.2: Permission denied (publickey).",
+		code:    "255",
+		message: "ssh authentication failed: ubuntu@10.0.0.2: Permission denied (publickey).",
+		auth:    true,
+	}, {
+		stderr:     "ssh: connect to host 10.0.0.2 port 22: Connection timed out",
+		code:       "255",
+		message:    "ssh connection timed out: ssh: connect to host 10.0.0.2 port 22: Connection timed out",
+		timeout:    true,
+		connection: true,
+	}, {
+		stderr:     "ssh: connect to host 10.0.0.2 port 22: Connection refused",
+		code:       "255",
+		message:    "ssh connection failed: ssh: connect to host 10.0.0.2 port 22: Connection refused",
+		connection: true,
+	}, {
+		stderr:     "",
+		code:       "255",
+		message:    "ssh connection failed: exit status 255",
+		connection: true,
+	}, {
+		stderr:  "Failed to stop jujud-machine-1.service: Unit jujud-machine-1.service not loaded.",
+		code:    "5",
+		started: true,
+		message: "command failed: Failed to stop jujud-machine-1.service: Unit jujud-machine-1.service not loaded.",
+		command: true,
+	}, {
+		// The remote command's own output isn't mistaken for ssh's.
+		stderr:  "mongo: connect to 127.0.0.1:37017: Connection refused",
+		code:    "1",
+		started: true,
+		message: "command failed: mongo: connect to 127.0.0.1:37017: Connection refused",
+		command: true,
+	}, {
+		stderr:  "rm: cannot remove '/var/lib/juju/tools': Permission denied",
+		code:    "1",
+		started: true,
+		message: "command failed: rm: cannot remove '/var/lib/juju/tools': Permission denied",
+		command: true,
+	}, {
+		// Nor is its exit status.
+		stderr:  "",
+		code:    "255",
+		started: true,
+		message: "command failed: exit status 255",
+		command: true,
+	}, {
+		stderr:  "Connection to 10.0.0.2 closed by remote host.",
+		code:    "255",
+		started: true,
+		message: "ssh connection lost while the command was running: Connection to 10.0.0.2 closed by remote host.",
+	}} {
+		c.Logf("%d: %s", i, test.stderr)
+		err := machine.ClassifySSHError(test.stderr, test.started, exitError(c, test.code))
+		err = errors.Annotate(err, "wrapped")
+		c.Check(err, gc.ErrorMatches, "wrapped: "+regexp.QuoteMeta(test.message))
+		c.Check(machine.IsAuthenticationError(err), gc.Equals, test.auth)
+		c.Check(machine.IsTimeoutError(err), gc.Equals, test.timeout)
+		c.Check(machine.IsConnectionError(err), gc.Equals, test.connection)
+		c.Check(machine.IsCommandError(err), gc.Equals, test.command)
+	}
+}
+
+func (s *errorsSuite) TestOtherErrors(c *gc.C) {
+	err := errors.New("boom")
+	c.Assert(machine.IsAuthenticationError(err), jc.IsFalse)
+	c.Assert(machine.IsConnectionError(err), jc.IsFalse)
+	c.Assert(machine.IsCommandError(err), jc.IsFalse)
+}
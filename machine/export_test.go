@@ -0,0 +1,21 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+var (
+	ClassifySSHError = classifySSHError
+	SSHRetryDelay    = &sshRetryDelay
+)
+
+var ParsePods = parsePods
+
+func PodFor(config KubernetesConfig, host string) (PodInfo, bool) {
+	return config.podFor(host)
+}
+
+var (
+	SplitMemberHost = splitMemberHost
+	ResolveHost     = resolveHost
+	LookupHost      = &lookupHost
+)
@@ -0,0 +1,113 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// HostKeyConfirmer is called with the address and key fingerprints of
+// a machine that isn't in the known hosts file yet. Returning nil
+// accepts the keys so they are added to the file.
+type HostKeyConfirmer func(address string, fingerprints []string) error
+
+// knownHostsName returns the name used for the machine in a
+// known_hosts file - hosts on non-standard ports are written as
+// [ip]:port.
+func (r *remoteRunner) knownHostsName() string {
+	if r.ssh.Port == "" || r.ssh.Port == "22" {
+		return r.ip
+	}
+	return fmt.Sprintf("[%s]:%s", r.ip, r.ssh.Port)
+}
+
+// ensureHostKnown checks that the target machine is in the known
+// hosts file, collecting its keys and asking for confirmation if it
+// isn't.
+func (r *remoteRunner) ensureHostKnown() error {
+	if r.hostKnown || r.ssh.KnownHostsFile == "" || r.confirmHostKey == nil {
+		return nil
+	}
+	known, err := r.isHostKnown()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !known {
+		if err := r.addHostKeys(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	r.hostKnown = true
+	return nil
+}
+
+func (r *remoteRunner) isHostKnown() (bool, error) {
+	_, err := os.Stat(r.ssh.KnownHostsFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	// ssh-keygen -F exits with an error and no output if the host
+	// isn't found.
+	out, err := r.localRunner.Run("ssh-keygen", "-F", r.knownHostsName(), "-f", r.ssh.KnownHostsFile)
+	return err == nil && out != "", nil
+}
+
+func (r *remoteRunner) addHostKeys() error {
+	scanArgs := []string{"ssh-keyscan"}
+	if r.ssh.Port != "" {
+		scanArgs = append(scanArgs, "-p", r.ssh.Port)
+	}
+	keys, err := r.localRunner.Run(append(scanArgs, r.ip)...)
+	if err != nil {
+		return errors.Annotatef(err, "scanning host keys for %s", r.ip)
+	}
+	if strings.TrimSpace(keys) == "" {
+		return errors.Errorf("no host keys found for %s", r.ip)
+	}
+	fingerprints, err := r.fingerprints(keys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := r.confirmHostKey(r.knownHostsName(), fingerprints); err != nil {
+		return errors.Annotatef(err, "host keys for %s not accepted", r.ip)
+	}
+	knownHosts, err := os.OpenFile(r.ssh.KnownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Annotate(err, "opening known hosts file")
+	}
+	defer knownHosts.Close()
+	if _, err := knownHosts.WriteString(keys); err != nil {
+		return errors.Annotate(err, "adding host keys")
+	}
+	return errors.Trace(knownHosts.Close())
+}
+
+func (r *remoteRunner) fingerprints(keys string) ([]string, error) {
+	keysFile, err := ioutil.TempFile("", "juju-restore-host-keys")
+	if err != nil {
+		return nil, errors.Annotate(err, "creating tempfile")
+	}
+	defer func() {
+		_ = keysFile.Close()
+		_ = os.Remove(keysFile.Name())
+	}()
+	if _, err := keysFile.WriteString(keys); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := keysFile.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	out, err := r.localRunner.Run("ssh-keygen", "-l", "-f", keysFile.Name())
+	if err != nil {
+		return nil, errors.Annotatef(err, "fingerprinting host keys for %s", r.ip)
+	}
+	return strings.Split(strings.TrimSpace(out), "\n"), nil
+}
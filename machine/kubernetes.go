@@ -0,0 +1,253 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/version/v2"
+
+	"github.com/juju/juju-restore/core"
+)
+
+const (
+	defaultPodSelector    = "app.kubernetes.io/name=controller"
+	defaultAgentContainer = "api-server"
+	defaultPebbleCommand  = "/opt/pebble"
+	defaultAgentService   = "jujud"
+)
+
+// KubernetesConfig holds the settings needed to manage a controller
+// running in Kubernetes, where jujud and mongod run in containers of
+// the controller pods (managed by pebble) instead of under systemd.
+type KubernetesConfig struct {
+	// Namespace is the namespace the controller is deployed in,
+	// usually controller-<controller name>.
+	Namespace string
+
+	// Context is the kubectl context to use. If empty, the current
+	// context is used.
+	Context string
+
+	// PodSelector is the label selector matching controller pods.
+	PodSelector string
+
+	// Container is the name of the container running jujud.
+	Container string
+
+	// PebbleCommand is the path of pebble in Container.
+	PebbleCommand string
+
+	// AgentService is the name of the pebble service running jujud.
+	AgentService string
+
+	// Pods lists the controller pods, as found by
+	// DiscoverControllerPods.
+	Pods []PodInfo
+}
+
+// DefaultKubernetesConfig returns the config for a standard Juju
+// controller in the specified namespace.
+func DefaultKubernetesConfig(namespace string) KubernetesConfig {
+	return KubernetesConfig{
+		Namespace:     namespace,
+		PodSelector:   defaultPodSelector,
+		Container:     defaultAgentContainer,
+		PebbleCommand: defaultPebbleCommand,
+		AgentService:  defaultAgentService,
+	}
+}
+
+// kubectlArgs returns the kubectl command and global options.
+func (c KubernetesConfig) kubectlArgs() []string {
+	args := []string{"kubectl"}
+	if c.Context != "" {
+		args = append(args, "--context", c.Context)
+	}
+	return append(args, "--namespace", c.Namespace)
+}
+
+// PodInfo identifies a controller pod.
+type PodInfo struct {
+	// Name is the pod name, for example controller-0.
+	Name string
+
+	// IP is the pod's cluster address.
+	IP string
+}
+
+// podFor returns the pod for the replica set member host, which
+// could be either the pod's IP address or a DNS name starting with
+// the pod name.
+func (c KubernetesConfig) podFor(host string) (PodInfo, bool) {
+	for _, pod := range c.Pods {
+		if pod.IP == host {
+			return pod, true
+		}
+	}
+	if net.ParseIP(host) == nil {
+		name := strings.SplitN(host, ".", 2)[0]
+		for _, pod := range c.Pods {
+			if pod.Name == name {
+				return pod, true
+			}
+		}
+	}
+	return PodInfo{}, false
+}
+
+// DiscoverControllerPods finds the controller pods and their
+// addresses using kubectl.
+func DiscoverControllerPods(config KubernetesConfig, runner CommandRunner) ([]PodInfo, error) {
+	args := append(config.kubectlArgs(), "get", "pods", "--selector", config.PodSelector, "--output", "json")
+	out, err := runner.Run(args...)
+	if err != nil {
+		return nil, errors.Annotate(err, "listing controller pods")
+	}
+	pods, err := parsePods(out)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(pods) == 0 {
+		return nil, errors.Errorf("no controller pods matching %q in namespace %q", config.PodSelector, config.Namespace)
+	}
+	return pods, nil
+}
+
+func parsePods(data string) ([]PodInfo, error) {
+	var podList struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				PodIP string `json:"podIP"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(data), &podList); err != nil {
+		return nil, errors.Annotate(err, "unmarshalling pod list")
+	}
+	var pods []PodInfo
+	for _, item := range podList.Items {
+		if item.Status.PodIP == "" {
+			logger.Warningf("skipping pod %s with no address", item.Metadata.Name)
+			continue
+		}
+		pods = append(pods, PodInfo{
+			Name: item.Metadata.Name,
+			IP:   item.Status.PodIP,
+		})
+	}
+	return pods, nil
+}
+
+type kubectlRunner struct {
+	*localRunner
+	config KubernetesConfig
+	pod    string
+}
+
+// NewKubectlRunner constructs a command runner that runs commands in
+// the agent container of the specified pod using kubectl exec.
+func NewKubectlRunner(config KubernetesConfig, pod string, timeout time.Duration) CommandRunner {
+	return &kubectlRunner{
+		localRunner: &localRunner{timeout: timeout},
+		config:      config,
+		pod:         pod,
+	}
+}
+
+// Run implements CommandRunner.Run.
+func (r *kubectlRunner) Run(commands ...string) (string, error) {
+	return r.runStreaming(nil, commands...)
+}
+
+func (r *kubectlRunner) runStreaming(output func(string), commands ...string) (string, error) {
+	args := append(r.config.kubectlArgs(), "exec", r.pod, "--container", r.config.Container, "--")
+	return r.localRunner.runStreaming(output, append(args, commands...)...)
+}
+
+// RunScript implements CommandRunner.RunScript. Containers run as
+// the agent user so there's no need for sudo.
+func (r *kubectlRunner) RunScript(script string, args ...string) (string, error) {
+	return r.RunScriptStreaming(nil, script, args...)
+}
+
+// RunScriptStreaming implements StreamingRunner.RunScriptStreaming.
+func (r *kubectlRunner) RunScriptStreaming(output func(string), script string, args ...string) (string, error) {
+	fullArgs := append([]string{"bash", "-c", script, "pod-script"}, args...)
+	return r.runStreaming(output, fullArgs...)
+}
+
+// Pod represents a controller running in a Kubernetes pod. It
+// satisfies core.ControllerNode.
+type Pod struct {
+	*Machine
+	name    string
+	service string
+	pebble  string
+}
+
+// NewPod returns a pod that satisfies core.ControllerNode.
+func NewPod(info PodInfo, jujuID string, config KubernetesConfig, runner CommandRunner) *Pod {
+	m := New(info.IP, jujuID, runner)
+	// kubectl exec runs commands as root.
+	m.SetSudo(nil)
+	return &Pod{
+		Machine: m,
+		name:    info.Name,
+		service: config.AgentService,
+		pebble:  config.PebbleCommand,
+	}
+}
+
+// String reports "pod name (ip)".
+func (p *Pod) String() string {
+	return fmt.Sprintf("pod %s (%s)", p.name, p.ip)
+}
+
+// StopAgent implements ControllerNode.StopAgent.
+func (p *Pod) StopAgent() error {
+	_, err := p.changes.Run(p.pebble, "stop", p.service)
+	return errors.Trace(err)
+}
+
+// StartAgent implements ControllerNode.StartAgent.
+func (p *Pod) StartAgent() error {
+	_, err := p.changes.Run(p.pebble, "start", p.service)
+	return errors.Trace(err)
+}
+
+// RestartDatabase implements ControllerNode.RestartDatabase. The
+// database runs in a separate container of the pod, which juju-restore
+// doesn't manage.
+func (p *Pod) RestartDatabase() error {
+	return errors.NotSupportedf("restarting the database of %s (restart the pod's mongodb container instead)", p)
+}
+
+// UpdateAgentVersion implements ControllerNode.UpdateAgentVersion.
+// The agent binaries are part of the pod's image, so the version
+// can't be changed in place.
+func (p *Pod) UpdateAgentVersion(targetVersion version.Number) error {
+	return errors.NotSupportedf("changing the agent version of %s to %s in place (update the controller image instead)", p, targetVersion)
+}
+
+func newKubernetesNode(config Config, member core.ReplicaSetMember, host string) *Pod {
+	k8s := *config.Kubernetes
+	pod, ok := k8s.podFor(host)
+	if !ok {
+		// Fall back to addressing the pod by the member host - any
+		// commands will fail and report the problem.
+		logger.Warningf("no controller pod found for replica set member %s", member)
+		pod = PodInfo{Name: host, IP: host}
+	}
+	runner := NewKubectlRunner(k8s, pod.Name, config.CommandTimeout)
+	return NewPod(pod, member.JujuMachineID, k8s, runner)
+}
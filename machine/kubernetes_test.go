@@ -0,0 +1,141 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine_test
+
+import (
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/machine"
+)
+
+type kubernetesSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&kubernetesSuite{})
+
+const podList = `{
+  "items": [
+    {"metadata": {"name": "controller-0"}, "status": {"podIP": "10.1.0.5"}},
+    {"metadata": {"name": "controller-1"}, "status": {}},
+    {"metadata": {"name": "controller-2"}, "status": {"podIP": "10.1.0.7"}}
+  ]
+}`
+
+func (s *kubernetesSuite) TestParsePods(c *gc.C) {
+	pods, err := machine.ParsePods(podList)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(pods, gc.DeepEquals, []machine.PodInfo{
+		{Name: "controller-0", IP: "10.1.0.5"},
+		{Name: "controller-2", IP: "10.1.0.7"},
+	})
+}
+
+func (s *kubernetesSuite) TestParsePodsInvalid(c *gc.C) {
+	_, err := machine.ParsePods("not json")
+	c.Assert(err, gc.ErrorMatches, "unmarshalling pod list: .*")
+}
+
+func (s *kubernetesSuite) TestDiscoverControllerPods(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}, out: podList}
+	config := machine.DefaultKubernetesConfig("controller-kontroll")
+	config.Context = "microk8s"
+	pods, err := machine.DiscoverControllerPods(config, runner)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(pods, gc.HasLen, 2)
+	runner.CheckCall(c, 0, "Run", []string{
+		"kubectl", "--context", "microk8s", "--namespace", "controller-kontroll",
+		"get", "pods", "--selector", "app.kubernetes.io/name=controller", "--output", "json",
+	})
+}
+
+func (s *kubernetesSuite) TestDiscoverControllerPodsNone(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}, out: `{"items": []}`}
+	_, err := machine.DiscoverControllerPods(machine.DefaultKubernetesConfig("ns"), runner)
+	c.Assert(err, gc.ErrorMatches, `no controller pods matching "app.kubernetes.io/name=controller" in namespace "ns"`)
+}
+
+func (s *kubernetesSuite) TestPodFor(c *gc.C) {
+	config := machine.DefaultKubernetesConfig("ns")
+	config.Pods = []machine.PodInfo{
+		{Name: "controller-0", IP: "10.1.0.5"},
+		{Name: "controller-1", IP: "10.1.0.6"},
+	}
+	for _, test := range []struct {
+		host string
+		pod  string
+	}{
+		{host: "10.1.0.6", pod: "controller-1"},
+		{host: "controller-0.controller-endpoints.ns.svc.cluster.local", pod: "controller-0"},
+		{host: "controller-1", pod: "controller-1"},
+		{host: "10.1.0.9"},
+	} {
+		pod, ok := machine.PodFor(config, test.host)
+		c.Check(ok, gc.Equals, test.pod != "", gc.Commentf(test.host))
+		c.Check(pod.Name, gc.Equals, test.pod, gc.Commentf(test.host))
+	}
+}
+
+func (s *kubernetesSuite) TestPodAgents(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}}
+	pod := machine.NewPod(machine.PodInfo{Name: "controller-0", IP: "10.1.0.5"}, "0", machine.DefaultKubernetesConfig("ns"), runner)
+	c.Assert(pod.String(), gc.Equals, "pod controller-0 (10.1.0.5)")
+	c.Assert(pod.StopAgent(), jc.ErrorIsNil)
+	c.Assert(pod.StartAgent(), jc.ErrorIsNil)
+	runner.CheckCalls(c, []testing.StubCall{
+		{FuncName: "Run", Args: []interface{}{[]string{"/opt/pebble", "stop", "jujud"}}},
+		{FuncName: "Run", Args: []interface{}{[]string{"/opt/pebble", "start", "jujud"}}},
+	})
+}
+
+func (s *kubernetesSuite) TestPodRestartDatabase(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}}
+	pod := machine.NewPod(machine.PodInfo{Name: "controller-0", IP: "10.1.0.5"}, "0", machine.DefaultKubernetesConfig("ns"), runner)
+	err := pod.RestartDatabase()
+	c.Assert(err, jc.Satisfies, errors.IsNotSupported)
+	runner.CheckNoCalls(c)
+}
+
+func (s *kubernetesSuite) TestPodStatus(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		out:  "Service  Startup  Current  Since\njujud    enabled  active   today at 10:42 UTC\n",
+	}
+	pod := machine.NewPod(machine.PodInfo{Name: "controller-0", IP: "10.1.0.5"}, "0", machine.DefaultKubernetesConfig("ns"), runner)
+	status, err := pod.Status()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(status, gc.Equals, core.NodeStatus{AgentState: "active"})
+	runner.CheckCall(c, 0, "Run", []string{"/opt/pebble", "services", "jujud"})
+}
+
+type fakeRunner struct {
+	*testing.Stub
+	out string
+
+	// outs, if set, holds the output for each call in turn.
+	outs []string
+}
+
+func (r *fakeRunner) output() string {
+	if len(r.outs) == 0 {
+		return r.out
+	}
+	out := r.outs[0]
+	r.outs = r.outs[1:]
+	return out
+}
+
+func (r *fakeRunner) Run(commands ...string) (string, error) {
+	r.Stub.MethodCall(r, "Run", commands)
+	return r.output(), r.NextErr()
+}
+
+func (r *fakeRunner) RunScript(script string, args ...string) (string, error) {
+	r.Stub.MethodCall(r, "RunScript", script, args)
+	return r.output(), r.NextErr()
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"time"
+)
+
+// LXDContainer identifies the LXD container a controller machine
+// runs in, so commands can be run with lxc exec when the machine
+// can't be reached over ssh.
+type LXDContainer struct {
+	// Name is the container name, for example juju-2f4c1e-1.
+	Name string
+
+	// Remote is the lxc remote hosting the container. If empty, the
+	// default remote is used.
+	Remote string
+}
+
+// target returns the container name in the form lxc expects.
+func (c LXDContainer) target() string {
+	if c.Remote == "" {
+		return c.Name
+	}
+	return c.Remote + ":" + c.Name
+}
+
+type lxdRunner struct {
+	*localRunner
+	container LXDContainer
+}
+
+// NewLXDRunner constructs a command runner that runs commands in the
+// specified container using lxc exec.
+func NewLXDRunner(container LXDContainer, timeout time.Duration) CommandRunner {
+	return &lxdRunner{
+		localRunner: &localRunner{timeout: timeout},
+		container:   container,
+	}
+}
+
+// Run implements CommandRunner.Run.
+func (r *lxdRunner) Run(commands ...string) (string, error) {
+	return r.runStreaming(nil, commands...)
+}
+
+func (r *lxdRunner) runStreaming(output func(string), commands ...string) (string, error) {
+	args := append([]string{"lxc", "exec", r.container.target(), "--"}, commands...)
+	return r.localRunner.runStreaming(output, args...)
+}
+
+// RunScript implements CommandRunner.RunScript. lxc exec runs
+// commands as root so there's no need for sudo.
+func (r *lxdRunner) RunScript(script string, args ...string) (string, error) {
+	return r.RunScriptStreaming(nil, script, args...)
+}
+
+// RunScriptStreaming implements StreamingRunner.RunScriptStreaming.
+func (r *lxdRunner) RunScriptStreaming(output func(string), script string, args ...string) (string, error) {
+	fullArgs := append([]string{"bash", "-c", script, "lxd-script"}, args...)
+	return r.runStreaming(output, fullArgs...)
+}
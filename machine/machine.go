@@ -1,11 +1,14 @@
 // Copyright 2020 Canonical Ltd.
 // Licensed under the AGPLv3, see LICENCE file for details.
 
+// Package machine provides core.ControllerNode implementations that
+// manage the agents on controller machines over ssh, in LXD
+// containers or in Kubernetes pods.
 package machine
 
 import (
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
@@ -16,30 +19,234 @@ import (
 
 var logger = loggo.GetLogger("juju-restore.machine")
 
-// ControllerNodeForReplicaSetMember returns ControllerNode for ReplicaSetMember.
-func ControllerNodeForReplicaSetMember(member core.ReplicaSetMember) core.ControllerNode {
-	//	Replica set member name is in the form <machine IP>:<Mongo port>.
-	ip := member.Name[:strings.Index(member.Name, ":")]
-	runner := NewLocalRunner()
-	if !member.Self {
-		runner = NewRemoteRunner(ip)
+// Config holds the settings used to reach controller machines.
+type Config struct {
+	// SSH holds the ssh settings used for all remote machines.
+	SSH SSHOptions
+
+	// NodeSSH holds per-machine overrides of the ssh settings, keyed
+	// by Juju machine ID or IP address.
+	NodeSSH map[string]SSHOptions
+
+	// NodeLXD maps Juju machine IDs or IP addresses to the LXD
+	// containers those machines run in. Commands for these machines
+	// are run with lxc exec instead of ssh.
+	NodeLXD map[string]LXDContainer
+
+	// ConfirmHostKey, if set, is called for machines that aren't in
+	// the known hosts file, so their keys can be added on first use.
+	ConfirmHostKey HostKeyConfirmer
+
+	// CommandTimeout limits how long any command run on a machine
+	// can take. Zero means no limit.
+	CommandTimeout time.Duration
+
+	// Kubernetes is set when the controller runs in Kubernetes pods
+	// rather than on machines.
+	Kubernetes *KubernetesConfig
+
+	// DryRun, if set, is called with each command that would stop,
+	// start or restart a service or change the agent on a machine,
+	// instead of the command being run. Commands that only read from
+	// the machine are still run.
+	DryRun func(node, command string)
+
+	// Sudo is used to run commands as root on controller machines.
+	// It isn't used on this machine if juju-restore is run as root,
+	// or on remote machines when logging in as root. LXD containers
+	// and Kubernetes pods run commands as root without it.
+	Sudo Sudo
+
+	// ScriptOutput, if set, is called with each line of output from
+	// the scripts run on a machine as soon as it's written, so that
+	// long-running scripts show progress. The lines are also logged
+	// at debug level.
+	ScriptOutput func(node, line string)
+}
+
+// DefaultCommandTimeout is long enough for any of the commands
+// juju-restore runs on a healthy machine, including stopping an agent
+// that is slow to shut down.
+const DefaultCommandTimeout = 10 * time.Minute
+
+// DefaultConfig returns the config that works for a standard Juju
+// controller.
+func DefaultConfig() Config {
+	return Config{
+		SSH:            DefaultSSHOptions(),
+		CommandTimeout: DefaultCommandTimeout,
+		Sudo:           DefaultSudo(),
+	}
+}
+
+// sshOptionsFor returns the ssh settings for the specified machine,
+// applying any override for its machine ID and then its IP address.
+func (c Config) sshOptionsFor(ip, jujuID string) SSHOptions {
+	options := c.SSH
+	if override, ok := c.NodeSSH[jujuID]; ok {
+		options = options.Merge(override)
 	}
-	return New(ip, member.JujuMachineID, runner)
+	if override, ok := c.NodeSSH[ip]; ok {
+		options = options.Merge(override)
+	}
+	return options
+}
+
+// lxdContainerFor returns the container for the specified machine,
+// if it's been configured to use lxc exec.
+func (c Config) lxdContainerFor(ip, jujuID string) (LXDContainer, bool) {
+	if container, ok := c.NodeLXD[jujuID]; ok {
+		return container, true
+	}
+	container, ok := c.NodeLXD[ip]
+	return container, ok
+}
+
+// NewControllerNodeFactory returns a core.ControllerNodeFactory that
+// creates machines using the config passed in.
+func NewControllerNodeFactory(config Config) core.ControllerNodeFactory {
+	return func(member core.ReplicaSetMember) core.ControllerNode {
+		host, err := splitMemberHost(member.Name)
+		if err != nil {
+			// Use the whole name - connecting will fail and report
+			// the problem.
+			logger.Warningf("%v", err)
+			host = member.Name
+		}
+		if config.Kubernetes != nil {
+			pod := newKubernetesNode(config, member, host)
+			config.configure(pod.Machine, host)
+			return pod
+		}
+		ip := host
+		if !member.Self {
+			ip = resolveHost(host)
+		}
+		sudo := config.localSudo()
+		runner := NewLocalRunner(config.CommandTimeout, sudo)
+		if container, ok := config.lxdContainerFor(ip, member.JujuMachineID); ok && !member.Self {
+			runner = NewLXDRunner(container, config.CommandTimeout)
+			sudo = nil
+		} else if !member.Self {
+			ssh := config.sshOptionsFor(ip, member.JujuMachineID)
+			sudo = config.remoteSudo(ssh)
+			runner = NewRemoteRunner(RemoteRunnerParams{
+				IP:             ip,
+				SSH:            ssh,
+				ConfirmHostKey: config.ConfirmHostKey,
+				Timeout:        config.CommandTimeout,
+				Sudo:           sudo,
+				LocalSudo:      config.localSudo(),
+			})
+		}
+		m := NewWithName(host, ip, member.JujuMachineID, runner)
+		m.SetSudo(sudo)
+		config.configure(m, host)
+		return m
+	}
+}
+
+// configure makes the machine report the commands that would change
+// it to DryRun and its scripts' output to ScriptOutput, if they're
+// set.
+func (c Config) configure(m *Machine, host string) {
+	if c.DryRun != nil {
+		m.ReportChanges(func(command string) {
+			c.DryRun(host, command)
+		})
+	}
+	if c.ScriptOutput != nil {
+		m.SetScriptOutput(func(line string) {
+			c.ScriptOutput(host, line)
+		})
+	}
+}
+
+// ControllerNodeForReplicaSetMember returns ControllerNode for
+// ReplicaSetMember using the default config.
+func ControllerNodeForReplicaSetMember(member core.ReplicaSetMember) core.ControllerNode {
+	return NewControllerNodeFactory(DefaultConfig())(member)
 }
 
 // Machine represents a juju controller machine and holds a runner for
 // running commands on that machine (whether it's the current machine
 // or a different one).
 type Machine struct {
-	ip string
+	name string
+	ip   string
 
 	jujuID  string
 	command CommandRunner
+	// changes runs the commands that change the machine - it's the
+	// same as command unless they're being reported instead.
+	changes CommandRunner
+
+	// sudo is used to stop and start services as root.
+	sudo Sudo
+
+	// scriptOutput, if set, is passed each line of output from
+	// scripts as they run.
+	scriptOutput func(line string)
+
+	// agentService caches the agent's service once it's been found.
+	agentService *agentService
 }
 
 // New returns a machine that satisfies core.ControllerNode.
 func New(ip string, jujuID string, runner CommandRunner) *Machine {
-	return &Machine{ip, jujuID, runner}
+	return NewWithName(ip, ip, jujuID, runner)
+}
+
+// NewWithName returns a machine that is displayed using name (the
+// host from the replica set config) but reached at ip.
+func NewWithName(name, ip string, jujuID string, runner CommandRunner) *Machine {
+	return &Machine{
+		name:    name,
+		ip:      ip,
+		jujuID:  jujuID,
+		command: runner,
+		changes: runner,
+		sudo:    DefaultSudo(),
+	}
+}
+
+// SetSudo sets how the machine runs commands as root. It should be
+// called before ReportChanges so reported commands use it too.
+func (m *Machine) SetSudo(sudo Sudo) {
+	m.sudo = sudo
+}
+
+// SetScriptOutput makes the machine pass each line of output from the
+// scripts it runs to output as soon as it's written, if its runner
+// can stream output.
+func (m *Machine) SetScriptOutput(output func(line string)) {
+	m.scriptOutput = output
+}
+
+// runScript runs the script with the runner, logging each line of its
+// output as it's written if the runner can stream it.
+func (m *Machine) runScript(runner CommandRunner, script string, args ...string) (string, error) {
+	streaming, ok := runner.(StreamingRunner)
+	if !ok {
+		return runner.RunScript(script, args...)
+	}
+	return streaming.RunScriptStreaming(func(line string) {
+		logger.Debugf("%s: %s", m.name, line)
+		if m.scriptOutput != nil {
+			m.scriptOutput(line)
+		}
+	}, script, args...)
+}
+
+// ReportChanges makes the machine pass the commands that would change
+// it to report instead of running them, for a dry run.
+func (m *Machine) ReportChanges(report func(command string)) {
+	m.changes = NewDryRunRunner(m.sudo, report)
+}
+
+// Name implements ControllerNode.Name.
+func (m *Machine) Name() string {
+	return m.name
 }
 
 // IP implements ControllerNode.IP.
@@ -47,9 +254,9 @@ func (m *Machine) IP() string {
 	return m.ip
 }
 
-// String reports "machine n (ip)".
+// String reports "machine n (name)".
 func (m *Machine) String() string {
-	return fmt.Sprintf("machine %s (%s)", m.jujuID, m.ip)
+	return fmt.Sprintf("machine %s (%s)", m.jujuID, m.name)
 }
 
 // Ping implements ControllerNode.Ping()
@@ -79,21 +286,74 @@ func (m *Machine) StartAgent() error {
 }
 
 func (m *Machine) ctrlAgent(op string) error {
-	command := []string{"sudo", "systemctl", op, fmt.Sprintf("jujud-machine-%v", m.jujuID)}
-	out, err := m.command.Run(command...)
+	service, err := m.findAgentService()
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if out != "" {
-		return errors.Errorf("start agent command should not have returned any output, but got %v", out)
+	out, err := m.changes.Run(m.sudo.command(service.command(op)...)...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// snap reports what it did, but systemctl should be silent.
+	if out != "" && !service.snap {
+		return errors.Errorf("%s agent command should not have returned any output, but got %v", op, out)
 	}
 	return nil
 }
 
+// RestartDatabase implements ControllerNode.RestartDatabase.
+func (m *Machine) RestartDatabase() error {
+	_, err := m.runScript(m.changes, restartDatabaseScript)
+	return errors.Annotate(err, "restarting juju-db")
+}
+
+// snapDatabaseScript sets snap_db_dir to where the juju-db snap
+// keeps the database (empty if it isn't installed from the snap) and
+// snap_service to its mongod service. Tracks of the snap haven't all
+// used the same layout, so the snap is asked rather than assumed.
+const snapDatabaseScript = `
+snap_db_dir=
+for dir in /var/snap/juju-db/common/db /var/snap/juju-db/current/db; do
+    if [ -d "$dir" ]; then
+        snap_db_dir=$dir
+        break
+    fi
+done
+snap_service=$(snap services juju-db 2>/dev/null | awk 'NR > 1 && $1 ~ /daemon|mongod/ { print $1; exit }')
+snap_service=${snap_service:-juju-db.daemon}
+`
+
+// restartDatabaseScript restarts juju-db, whether it's installed from
+// the snap or not.
+const restartDatabaseScript = snapDatabaseScript + `
+if [ -n "$snap_db_dir" ]; then
+    snap restart "$snap_service"
+else
+    systemctl restart juju-db
+fi
+`
+
+func (m *Machine) findAgentService() (agentService, error) {
+	if m.agentService != nil {
+		return *m.agentService, nil
+	}
+	out, err := m.runScript(m.command, listAgentServicesScript)
+	if err != nil {
+		return agentService{}, errors.Annotate(err, "listing agent services")
+	}
+	service, err := chooseAgentService(m.jujuID, out)
+	if err != nil {
+		return agentService{}, errors.Trace(err)
+	}
+	logger.Debugf("agent service for %s is %s", m, service.name)
+	m.agentService = &service
+	return service, nil
+}
+
 // UpdateAgentVersion edits the agent.conf and updates the symlink to
 // point to the tools for the specified version.
 func (m *Machine) UpdateAgentVersion(targetVersion version.Number) error {
-	out, err := m.command.RunScript(updateAgentVersionScript, m.jujuID, targetVersion.String())
+	out, err := m.runScript(m.changes, updateAgentVersionScript, m.jujuID, targetVersion.String())
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -103,6 +363,13 @@ func (m *Machine) UpdateAgentVersion(targetVersion version.Number) error {
 	return nil
 }
 
+// listAgentServicesScript lists the service units that could be
+// running the machine agent, whether installed by Juju directly or
+// from a snap.
+const listAgentServicesScript = `
+systemctl list-unit-files --no-legend --no-pager --type=service 'jujud-*' 'snap.*jujud*' | awk '{print $1}'
+`
+
 const updateAgentVersionScript = `
 set -e
 cd /var/lib/juju/tools
@@ -0,0 +1,210 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine_test
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version/v2"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju-restore/core"
+	"github.com/juju/juju-restore/machine"
+)
+
+type machineSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&machineSuite{})
+
+func (s *machineSuite) TestAgentServiceStandard(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-machine-0.service\njujud-machine-1.service\n", "", ""},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	c.Assert(m.StopAgent(), jc.ErrorIsNil)
+	c.Assert(m.StartAgent(), jc.ErrorIsNil)
+	// The service is only looked up once.
+	c.Assert(runner.Calls(), gc.HasLen, 3)
+	c.Assert(runner.Calls()[0].FuncName, gc.Equals, "RunScript")
+	runner.CheckCall(c, 1, "Run", []string{"sudo", "systemctl", "stop", "jujud-machine-1"})
+	runner.CheckCall(c, 2, "Run", []string{"sudo", "systemctl", "start", "jujud-machine-1"})
+}
+
+func (s *machineSuite) TestAgentServiceSnap(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"snap.jujud.machine.service\n", "Stopped.\n"},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	c.Assert(m.StopAgent(), jc.ErrorIsNil)
+	runner.CheckCall(c, 1, "Run", []string{"sudo", "snap", "stop", "jujud.machine"})
+}
+
+func (s *machineSuite) TestAgentServiceAlternativeName(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-controller.service\n", ""},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	c.Assert(m.StopAgent(), jc.ErrorIsNil)
+	runner.CheckCall(c, 1, "Run", []string{"sudo", "systemctl", "stop", "jujud-controller"})
+}
+
+func (s *machineSuite) TestAgentServiceSudo(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-machine-1.service\n", "", ""},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	m.SetSudo(machine.Sudo{"doas", "-n"})
+	c.Assert(m.StopAgent(), jc.ErrorIsNil)
+	m.SetSudo(nil)
+	c.Assert(m.StartAgent(), jc.ErrorIsNil)
+	runner.CheckCall(c, 1, "Run", []string{"doas", "-n", "systemctl", "stop", "jujud-machine-1"})
+	runner.CheckCall(c, 2, "Run", []string{"systemctl", "start", "jujud-machine-1"})
+}
+
+func (s *machineSuite) TestAgentLog(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-machine-1.service\n", "started\n"},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	out, err := m.AgentLog(100)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "started\n")
+	runner.CheckCall(c, 1, "Run", []string{"sudo", "journalctl", "--unit", "jujud-machine-1", "--lines", "100", "--no-pager", "--output", "cat"})
+}
+
+func (s *machineSuite) TestAgentServiceNotFound(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}}
+	m := machine.New("10.0.0.1", "1", runner)
+	err := m.StopAgent()
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+	c.Assert(err, gc.ErrorMatches, "agent service for machine 1 not found")
+}
+
+func (s *machineSuite) TestAgentServiceAmbiguous(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		out:  "jujud-machine-0.service\njujud-machine-2.service\n",
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	err := m.StopAgent()
+	c.Assert(err, gc.ErrorMatches, "can't tell which agent service is for machine 1: found jujud-machine-0, jujud-machine-2")
+}
+
+func (s *machineSuite) TestAgentServiceUnexpectedOutput(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-machine-1.service\n", "surprise\n"},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	err := m.StartAgent()
+	c.Assert(err, gc.ErrorMatches, "start agent command should not have returned any output, but got surprise\n")
+}
+
+func (s *machineSuite) TestRestartDatabase(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}}
+	m := machine.New("10.0.0.1", "1", runner)
+	c.Assert(m.RestartDatabase(), jc.ErrorIsNil)
+	runner.CheckCallNames(c, "RunScript")
+	c.Assert(runner.Calls()[0].Args[0], jc.Contains, `snap restart "$snap_service"`)
+	c.Assert(runner.Calls()[0].Args[0], jc.Contains, "snap services juju-db")
+	c.Assert(runner.Calls()[0].Args[0], jc.Contains, "systemctl restart juju-db")
+}
+
+func (s *machineSuite) TestRestartDatabaseError(c *gc.C) {
+	runner := &fakeRunner{Stub: &testing.Stub{}}
+	runner.SetErrors(errors.New("unit juju-db.service not found"))
+	m := machine.New("10.0.0.1", "1", runner)
+	c.Assert(m.RestartDatabase(), gc.ErrorMatches, "restarting juju-db: unit juju-db.service not found")
+}
+
+func (s *machineSuite) TestStatus(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{
+			"snap.jujud.machine.service\n",
+			"free:   2147483648\ndb-size: 1073741824\nagent: active\ndb: inactive\ndb-version: 4.4.18 (rev 160)\ntag: machine-1\ncontroller: controller-dawkins-rules\n",
+		},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	status, err := m.Status()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(status, gc.Equals, core.NodeStatus{
+		FreeSpace:       2147483648,
+		DatabaseSize:    1073741824,
+		AgentState:      "active",
+		DatabaseState:   "inactive",
+		DatabaseVersion: "4.4.18 (rev 160)",
+		MachineTag:      "machine-1",
+		ControllerUUID:  "dawkins-rules",
+	})
+	c.Assert(runner.Calls()[1].Args[1], gc.DeepEquals, []string{"snap.jujud.machine"})
+}
+
+func (s *machineSuite) TestStatusBadOutput(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-machine-1.service\n", "free: \ndb-size: 10\n"},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	_, err := m.Status()
+	c.Assert(err, gc.ErrorMatches, `parsing free: strconv.ParseUint: parsing "": invalid syntax`)
+}
+
+func (s *machineSuite) TestTime(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		out:  "1584462504123456789\n",
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	t, err := m.Time()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(t.UTC(), gc.Equals, time.Date(2020, 3, 17, 16, 28, 24, 123456789, time.UTC))
+	runner.CheckCall(c, 0, "Run", []string{"date", "+%s%N"})
+}
+
+func (s *machineSuite) TestReportChanges(c *gc.C) {
+	runner := &fakeRunner{
+		Stub: &testing.Stub{},
+		outs: []string{"jujud-machine-1.service\n", "free: 10\ndb-size: 10\nagent: active\ndb: active\n"},
+	}
+	m := machine.New("10.0.0.1", "1", runner)
+	var reported []string
+	m.ReportChanges(func(command string) {
+		reported = append(reported, command)
+	})
+	c.Assert(m.StopAgent(), jc.ErrorIsNil)
+	c.Assert(m.UpdateAgentVersion(version.MustParse("2.9.37")), jc.ErrorIsNil)
+	c.Assert(m.StartAgent(), jc.ErrorIsNil)
+	// Reading from the machine still runs commands.
+	_, err := m.Status()
+	c.Assert(err, jc.ErrorIsNil)
+	runner.CheckCallNames(c, "RunScript", "RunScript")
+
+	c.Assert(reported, gc.HasLen, 3)
+	c.Assert(reported[0], gc.Equals, "sudo systemctl stop jujud-machine-1")
+	c.Assert(reported[1], jc.HasPrefix, "sudo bash -s -- 1 2.9.37 <<'EOF'\nset -e\ncd /var/lib/juju/tools\n")
+	c.Assert(reported[1], jc.HasSuffix, "agent.conf\nEOF")
+	c.Assert(reported[2], gc.Equals, "sudo systemctl start jujud-machine-1")
+}
+
+func (s *machineSuite) TestDryRunRunnerQuotes(c *gc.C) {
+	var reported string
+	runner := machine.NewDryRunRunner(machine.DefaultSudo(), func(command string) {
+		reported = command
+	})
+	out, err := runner.Run("sed", "-i", "s/^a: .*$/a: it's/", "/etc/x.conf")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(out, gc.Equals, "")
+	c.Assert(reported, gc.Equals, `sed -i 's/^a: .*$/a: it'\''s/' /etc/x.conf`)
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// agentService is the service running the machine agent on a
+// controller machine.
+type agentService struct {
+	// name is the systemd unit name without the .service suffix,
+	// or the snap service name (<snap>.<app>) for snap services.
+	name string
+
+	// snap is true if the service is managed by snapd.
+	snap bool
+}
+
+// command returns the command to stop or start the service, which
+// needs to be run as root.
+func (s agentService) command(op string) []string {
+	if s.snap {
+		return []string{"snap", op, s.name}
+	}
+	return []string{"systemctl", op, s.name}
+}
+
+// unit returns the systemd unit name for the service - snapd runs
+// its services as snap.<snap>.<app> units.
+func (s agentService) unit() string {
+	if s.snap {
+		return "snap." + s.name
+	}
+	return s.name
+}
+
+// chooseAgentService picks the agent service for the machine from
+// the unit names listed on it. The standard jujud-machine-<id> unit is
+// preferred, otherwise there must be exactly one other candidate.
+func chooseAgentService(jujuID, units string) (agentService, error) {
+	standard := fmt.Sprintf("jujud-machine-%s", jujuID)
+	var candidates []agentService
+	for _, unit := range strings.Fields(units) {
+		name := strings.TrimSuffix(unit, ".service")
+		if name == standard {
+			return agentService{name: name}, nil
+		}
+		if strings.HasPrefix(name, "snap.") {
+			candidates = append(candidates, agentService{
+				name: strings.TrimPrefix(name, "snap."),
+				snap: true,
+			})
+			continue
+		}
+		candidates = append(candidates, agentService{name: name})
+	}
+	switch len(candidates) {
+	case 0:
+		return agentService{}, errors.NotFoundf("agent service for machine %s", jujuID)
+	case 1:
+		return candidates[0], nil
+	}
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.name
+	}
+	return agentService{}, errors.Errorf("can't tell which agent service is for machine %s: found %s", jujuID, strings.Join(names, ", "))
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju-restore/core"
+)
+
+// Status implements ControllerNode.Status.
+func (m *Machine) Status() (core.NodeStatus, error) {
+	service, err := m.findAgentService()
+	if err != nil {
+		return core.NodeStatus{}, errors.Trace(err)
+	}
+	out, err := m.runScript(m.command, nodeStatusScript, service.unit())
+	if err != nil {
+		return core.NodeStatus{}, errors.Annotate(err, "getting node status")
+	}
+	return parseNodeStatus(out)
+}
+
+// Time implements ControllerNode.Time.
+func (m *Machine) Time() (time.Time, error) {
+	out, err := m.command.Run("date", "+%s%N")
+	if err != nil {
+		return time.Time{}, errors.Annotate(err, "getting time")
+	}
+	nanos, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Annotatef(err, "parsing time %q", out)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// AgentLog implements ControllerNode.AgentLog, reading the agent
+// service's journal.
+func (m *Machine) AgentLog(lines int) (string, error) {
+	service, err := m.findAgentService()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	out, err := m.command.Run(m.sudo.command(
+		"journalctl", "--unit", service.unit(), "--lines", strconv.Itoa(lines), "--no-pager", "--output", "cat",
+	)...)
+	return out, errors.Annotate(err, "reading agent log")
+}
+
+// AgentLog implements ControllerNode.AgentLog, reading the agent
+// service's log from pebble.
+func (p *Pod) AgentLog(lines int) (string, error) {
+	out, err := p.command.Run(p.pebble, "logs", "-n", strconv.Itoa(lines), p.service)
+	return out, errors.Annotate(err, "reading agent log")
+}
+
+// Status implements ControllerNode.Status. The database runs in a
+// separate container of the pod, so only the agent state is
+// reported.
+func (p *Pod) Status() (core.NodeStatus, error) {
+	out, err := p.command.Run(p.pebble, "services", p.service)
+	if err != nil {
+		return core.NodeStatus{}, errors.Annotate(err, "getting agent service status")
+	}
+	// The output is a table with a heading line, and the service's
+	// current state in the third column.
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return core.NodeStatus{}, errors.Errorf("unexpected pebble services output %q", out)
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) < 3 {
+		return core.NodeStatus{}, errors.Errorf("unexpected pebble services output %q", out)
+	}
+	return core.NodeStatus{AgentState: fields[2]}, nil
+}
+
+// parseNodeStatus reads the "key: value" lines written by
+// nodeStatusScript.
+func parseNodeStatus(out string) (core.NodeStatus, error) {
+	var status core.NodeStatus
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return core.NodeStatus{}, errors.Errorf("unexpected node status line %q", line)
+		}
+		key, value := parts[0], strings.TrimSpace(parts[1])
+		var err error
+		switch key {
+		case "free":
+			status.FreeSpace, err = strconv.ParseUint(value, 10, 64)
+		case "db-size":
+			status.DatabaseSize, err = strconv.ParseUint(value, 10, 64)
+		case "agent":
+			status.AgentState = value
+		case "db":
+			status.DatabaseState = value
+		case "db-version":
+			status.DatabaseVersion = value
+		case "tag":
+			status.MachineTag = value
+		case "controller":
+			status.ControllerUUID = strings.TrimPrefix(value, "controller-")
+		}
+		if err != nil {
+			return core.NodeStatus{}, errors.Annotatef(err, "parsing %s", key)
+		}
+	}
+	return status, nil
+}
+
+// nodeStatusScript reports the space available to the database, the
+// size of the database files and the states of the agent service
+// (passed as $1) and juju-db, whether it's installed from the snap or
+// not. systemctl is-active exits non-zero for services that aren't
+// running, so errors aren't fatal. The version of mongod is reported
+// from the snap with the track it follows, or the newest mongod Juju
+// installed otherwise. The machine agent's tag and controller are
+// reported from its agent.conf if there is one.
+const nodeStatusScript = snapDatabaseScript + `
+db_dir=/var/lib/juju/db
+db_unit=juju-db
+db_version=
+if [ -n "$snap_db_dir" ]; then
+    db_dir=$snap_db_dir
+    db_unit=snap.$snap_service
+    db_version=$(snap list juju-db 2>/dev/null | awk 'NR == 2 { print $2 " (rev " $3 ", " $4 ")" }')
+else
+    mongod=$(ls /usr/lib/juju/mongo*/bin/mongod 2>/dev/null | tail -n 1)
+    if [ -n "$mongod" ]; then
+        db_version=$("$mongod" --version | sed -n 's/^db version v//p')
+    fi
+fi
+echo "free: $(df --output=avail --block-size=1 "$db_dir" | tail -n 1)"
+echo "db-size: $(du --summarize --bytes "$db_dir" | cut -f 1)"
+echo "agent: $(systemctl is-active "$1")"
+echo "db: $(systemctl is-active "$db_unit")"
+echo "db-version: $db_version"
+conf=$(ls /var/lib/juju/agents/machine-*/agent.conf 2>/dev/null | head -n 1)
+if [ -n "$conf" ]; then
+    echo "tag: $(sed -n 's/^tag: *//p' "$conf" | tr -d '"')"
+    echo "controller: $(sed -n 's/^controller: *//p' "$conf" | tr -d '"')"
+fi
+`
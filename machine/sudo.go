@@ -0,0 +1,44 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"os"
+)
+
+// Sudo is the command, with any arguments, used to run commands as
+// root. An empty Sudo runs commands as they are, for when they're
+// already run as root.
+type Sudo []string
+
+// DefaultSudo runs commands as root with sudo.
+func DefaultSudo() Sudo {
+	return Sudo{"sudo"}
+}
+
+// command returns the command line to run args as root.
+func (s Sudo) command(args ...string) []string {
+	return append(append([]string(nil), s...), args...)
+}
+
+// effectiveUID is patched out in tests.
+var effectiveUID = os.Geteuid
+
+// localSudo returns how to run commands as root on this machine -
+// they're run directly if juju-restore is running as root.
+func (c Config) localSudo() Sudo {
+	if effectiveUID() == 0 {
+		return nil
+	}
+	return c.Sudo
+}
+
+// remoteSudo returns how to run commands as root on a machine reached
+// over ssh - they're run directly if the ssh user is root.
+func (c Config) remoteSudo(ssh SSHOptions) Sudo {
+	if ssh.User == "root" {
+		return nil
+	}
+	return c.Sudo
+}
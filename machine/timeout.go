@@ -0,0 +1,57 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package machine
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killGracePeriod is how long a timed out command has to exit after
+// being sent SIGTERM before it is sent SIGKILL. sudo needs SIGTERM to
+// pass the signal on to the command it is running.
+var killGracePeriod = 5 * time.Second
+
+// runWithTimeout runs the command in its own process group, killing
+// the whole group if it doesn't finish within the timeout.
+func runWithTimeout(command *exec.Cmd, timeout time.Duration) error {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := command.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	pgid := -command.Process.Pid
+	logger.Debugf("killing %q after %v", strings.Join(command.Args, " "), timeout)
+	_ = syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		_ = syscall.Kill(pgid, syscall.SIGKILL)
+		// Don't wait indefinitely - a child that we aren't allowed to
+		// signal could still be holding the output pipes open.
+		select {
+		case <-done:
+		case <-time.After(killGracePeriod):
+		}
+	}
+	return &runError{
+		kind:    commandTimedOut,
+		message: fmt.Sprintf("%q didn't finish within %v", strings.Join(command.Args, " "), timeout),
+	}
+}
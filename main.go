@@ -4,7 +4,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	corecmd "github.com/juju/cmd/v3"
 	"github.com/juju/loggo"
@@ -33,12 +37,128 @@ func Run(args []string) int {
 		return 2
 	}
 
-	restorer := cmd.NewRestoreCommand(
+	if filepath.Base(args[0]) == cmd.PluginName {
+		self, err := os.Executable()
+		if err != nil {
+			logger.Errorf("%v", err)
+			return 2
+		}
+		plugin := cmd.NewPluginCommand(cmd.RunJuju, self)
+		return corecmd.Main(cmd.WithExitCodes(plugin), ctx, args[1:])
+	}
+	args = args[1:]
+	if len(args) > 0 {
+		if newCommand, ok := subcommands[args[0]]; ok {
+			command, err := newCommand()
+			if err != nil {
+				logger.Errorf("%v", err)
+				return 2
+			}
+			return corecmd.Main(cmd.WithExitCodes(command), ctx, args[1:])
+		}
+	}
+	restore := &withSubcommands{newRestoreCommand()}
+	return corecmd.Main(cmd.WithExitCodes(restore), ctx, args)
+}
+
+// subcommands creates the commands run when the first argument is
+// their name. Anything else is a restore, and "restore" can be given
+// explicitly to restore a backup file with the same name as one of
+// them.
+var subcommands = map[string]func() (corecmd.Command, error){
+	"restore": func() (corecmd.Command, error) {
+		return newRestoreCommand(), nil
+	},
+	"creds": func() (corecmd.Command, error) {
+		return cmd.NewCredsCommand(db.Dial, cmd.ReadCredsFromAgentConf), nil
+	},
+	"controller-info": func() (corecmd.Command, error) {
+		return cmd.NewControllerInfoCommand(db.Dial, cmd.ReadCredsFromAgentConf), nil
+	},
+	"cleanup": func() (corecmd.Command, error) {
+		return cmd.NewCleanupCommand(db.Dial, cmd.ReadCredsFromAgentConf, backup.FindTempDirs), nil
+	},
+	"create-backup": func() (corecmd.Command, error) {
+		return cmd.NewCreateBackupCommand(db.Dial, cmd.ReadCredsFromAgentConf, db.Dump, db.DumpOplog, backup.Open, backup.Create, "/"), nil
+	},
+	"verify-all": func() (corecmd.Command, error) {
+		return cmd.NewVerifyAllCommand(backup.Verify), nil
+	},
+	"history": func() (corecmd.Command, error) {
+		return cmd.NewHistoryCommand(), nil
+	},
+	"watch": func() (corecmd.Command, error) {
+		return cmd.NewWatchCommand(db.Dial, cmd.ReadCredsFromAgentConf), nil
+	},
+	"approve": func() (corecmd.Command, error) {
+		return cmd.NewApproveCommand(), nil
+	},
+	"sanitize": func() (corecmd.Command, error) {
+		return cmd.NewSanitizeCommand(backup.Sanitize), nil
+	},
+	"export": func() (corecmd.Command, error) {
+		return cmd.NewExportCommand(backup.Export), nil
+	},
+	"query": func() (corecmd.Command, error) {
+		return cmd.NewQueryCommand(backup.Query), nil
+	},
+	"diff": func() (corecmd.Command, error) {
+		return cmd.NewDiffCommand(backup.Diff), nil
+	},
+	"repair": func() (corecmd.Command, error) {
+		return cmd.NewRepairCommand(backup.Salvage), nil
+	},
+	"rebuild": func() (corecmd.Command, error) {
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		return cmd.NewRebuildCommand(cmd.RunJuju, backup.Open, self), nil
+	},
+	"serve": func() (corecmd.Command, error) {
+		return cmd.NewServeCommand(newRestoreCommand), nil
+	},
+}
+
+// withSubcommands lists the subcommands in the restore command's
+// help, since it's what runs for juju-restore --help.
+type withSubcommands struct {
+	corecmd.Command
+}
+
+// Info is part of cmd.Command.
+func (c *withSubcommands) Info() *corecmd.Info {
+	info := *c.Command.Info()
+	var names []string
+	width := 0
+	for name := range subcommands {
+		names = append(names, name)
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+	sort.Strings(names)
+	var doc strings.Builder
+	doc.WriteString(info.Doc)
+	doc.WriteString("\nSubcommands (run juju-restore <subcommand> --help for details):\n")
+	for _, name := range names {
+		command, err := subcommands[name]()
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&doc, "    %-*s  %s\n", width, name, command.Info().Purpose)
+	}
+	info.Doc = doc.String()
+	return &info
+}
+
+func newRestoreCommand() corecmd.Command {
+	return cmd.NewRestoreCommand(
 		db.Dial,
-		backup.Open,
-		machine.ControllerNodeForReplicaSetMember,
+		backup.OpenChecked,
+		machine.NewControllerNodeFactory,
 		cmd.ReadCredsFromAgentConf,
+		cmd.DetectController,
 		os.Getenv("JUJU_RESTORE_DEV_MODE") == "on",
 	)
-	return corecmd.Main(restorer, ctx, args[1:])
 }